@@ -0,0 +1,341 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+)
+
+const (
+	archiveVersion = 1
+
+	// An archive is a tar stream containing the meta file, then every segment
+	// file under archiveSegmentDir and finally the manifest.
+	archiveMetaName     = "meta.json"
+	archiveSegmentDir   = "segments/"
+	archiveManifestName = "manifest.json"
+)
+
+// ArchiveManifest is the last file in an archive written by Archive. It lists
+// every other file in the archive with its checksum.
+type ArchiveManifest struct {
+	Version    int           `json:"version"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	FirstIndex uint64        `json:"firstIndex"`
+	LastIndex  uint64        `json:"lastIndex"`
+	Files      []ArchiveFile `json:"files"`
+}
+
+// ArchiveFile describes one file in an archive.
+type ArchiveFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// rawSegmentOpener is implemented by SegmentFilers that can open segment files
+// to read their raw contents, like the default one.
+type rawSegmentOpener interface {
+	OpenFile(info types.SegmentInfo) (types.ReadableFile, error)
+}
+
+// Archive writes the whole log to wr as a single tar archive containing the
+// segment files, the segment metadata and a manifest with their checksums.
+// Unarchive turns it back into a WAL directory on another machine. Values in
+// the stable store aren't included. Writes are only blocked while the tail
+// segment is copied into memory. It needs the default SegmentFiler.
+func (w *WAL) Archive(ctx context.Context, wr io.Writer) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	opener, ok := w.sf.(rawSegmentOpener)
+	if !ok {
+		return fmt.Errorf("archive isn't supported by the SegmentFiler in use")
+	}
+
+	// Copy the tail while holding the write lock so we never see a batch that's
+	// only partly written. The state we hold stops any sealed segment files
+	// being deleted until we're done even if they are truncated meanwhile.
+	w.writeMu.Lock()
+	s, release := w.acquireState()
+	defer release()
+	persisted := s.Persistent()
+	var tail []byte
+	var err error
+	if n := len(persisted.Segments); n > 0 {
+		tail, err = readTailFile(opener, persisted.Segments[n-1])
+	}
+	w.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tw := tar.NewWriter(wr)
+	manifest := ArchiveManifest{
+		Version:    archiveVersion,
+		CreatedAt:  now,
+		FirstIndex: s.firstIndex(),
+		LastIndex:  s.lastIndex(),
+	}
+	add := func(name string, size int64, r io.Reader) error {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     size,
+			Mode:     0644,
+			ModTime:  now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		h := sha256.New()
+		r = &throttledReader{ctx: ctx, w: w, r: r}
+		if _, err := io.Copy(io.MultiWriter(tw, h), r); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", name, err)
+		}
+		manifest.Files = append(manifest.Files, ArchiveFile{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))})
+		return nil
+	}
+
+	meta, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	if err := add(archiveMetaName, int64(len(meta)), bytes.NewReader(meta)); err != nil {
+		return err
+	}
+
+	for i, si := range persisted.Segments {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := archiveSegmentDir + segment.FileName(si)
+		if i == len(persisted.Segments)-1 {
+			if tail == nil {
+				// The tail file hasn't been created yet, Open will create it.
+				continue
+			}
+			if err := add(name, int64(len(tail)), bytes.NewReader(tail)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := archiveSealedFile(opener, si, name, add); err != nil {
+			return err
+		}
+	}
+
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     archiveManifestName,
+		Size:     int64(len(raw)),
+		Mode:     0644,
+		ModTime:  now,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(raw); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// readTailFile reads the whole tail segment file into memory. It returns nil
+// if the file doesn't exist yet.
+func readTailFile(opener rawSegmentOpener, si types.SegmentInfo) ([]byte, error) {
+	rf, err := opener.OpenFile(si)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Close()
+	buf, err := io.ReadAll(io.NewSectionReader(rf, 0, math.MaxInt64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tail segment %s: %w", segment.FileName(si), err)
+	}
+	return buf, nil
+}
+
+// archiveSealedFile passes a sealed segment file to add. Sealed files don't
+// change so we can measure them and then stream them without buffering.
+func archiveSealedFile(opener rawSegmentOpener, si types.SegmentInfo, name string, add func(string, int64, io.Reader) error) error {
+	rf, err := opener.OpenFile(si)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	size, err := io.Copy(io.Discard, io.NewSectionReader(rf, 0, math.MaxInt64))
+	if err != nil {
+		return fmt.Errorf("failed to read segment %s: %w", segment.FileName(si), err)
+	}
+	return add(name, size, io.NewSectionReader(rf, 0, size))
+}
+
+// Unarchive creates a WAL in dir from an archive written by Archive. dir must
+// exist and not already contain a log. Only the MetaStore given by opts, if
+// any, is used, and the metadata is encrypted if WithEncryption is given too;
+// segment files are always written to dir. Every file is checked
+// against the manifest before the metadata is committed, so the WAL can only
+// be opened if the whole archive was intact. If it fails dir may be left with
+// some of the segment files which must be removed before trying again.
+func Unarchive(dir string, rd io.Reader, opts ...walOpt) error {
+	w := &WAL{dir: dir}
+	for _, opt := range opts {
+		opt(w)
+	}
+	meta := w.metaDB
+	if meta == nil {
+		meta = defaultMetaStore()
+	}
+	if w.encryptKeys != nil {
+		em, err := newEncryptedMeta(meta, w.encryptKeys, w.cipherSuite, w.lockKeys, false)
+		if err != nil {
+			return err
+		}
+		meta = em
+	}
+	existing, err := meta.Load(dir)
+	if err != nil {
+		return err
+	}
+	defer meta.Close()
+	if len(existing.Segments) > 0 {
+		return fmt.Errorf("can't unarchive into %s which already contains a log", dir)
+	}
+
+	var (
+		vfs      = fs.New()
+		tr       = tar.NewReader(rd)
+		state    *types.PersistentState
+		manifest *ArchiveManifest
+		got      = make(map[string]ArchiveFile)
+		expected map[string]bool
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if manifest != nil {
+			return fmt.Errorf("unexpected file %s after the manifest", hdr.Name)
+		}
+		h := sha256.New()
+		switch {
+		case hdr.Name == archiveMetaName:
+			raw, err := io.ReadAll(io.TeeReader(tr, h))
+			if err != nil {
+				return err
+			}
+			state = &types.PersistentState{}
+			if err := json.Unmarshal(raw, state); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", archiveMetaName, err)
+			}
+			expected = make(map[string]bool)
+			for _, si := range state.Segments {
+				expected[segment.FileName(si)] = true
+			}
+
+		case strings.HasPrefix(hdr.Name, archiveSegmentDir):
+			name := strings.TrimPrefix(hdr.Name, archiveSegmentDir)
+			if !expected[name] {
+				return fmt.Errorf("unexpected segment file %s in archive", hdr.Name)
+			}
+			if err := unarchiveFile(vfs, dir, name, io.TeeReader(tr, h)); err != nil {
+				return err
+			}
+
+		case hdr.Name == archiveManifestName:
+			manifest = &ArchiveManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", archiveManifestName, err)
+			}
+			continue
+
+		default:
+			return fmt.Errorf("unexpected file %s in archive", hdr.Name)
+		}
+		got[hdr.Name] = ArchiveFile{Name: hdr.Name, Size: hdr.Size, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	if state == nil || manifest == nil {
+		return fmt.Errorf("archive is incomplete, it must contain %s and %s", archiveMetaName, archiveManifestName)
+	}
+	if manifest.Version != archiveVersion {
+		return fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if err := checkArchiveFiles(manifest, got); err != nil {
+		return err
+	}
+	return meta.CommitState(*state)
+}
+
+func unarchiveFile(vfs *fs.FS, dir, name string, r io.Reader) error {
+	wf, err := vfs.Create(dir, name, 0)
+	if err != nil {
+		return err
+	}
+	defer wf.Close()
+	if _, err := io.Copy(&offsetWriter{w: wf}, r); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return wf.Sync()
+}
+
+// checkArchiveFiles makes sure the files read from an archive are exactly those
+// in its manifest.
+func checkArchiveFiles(manifest *ArchiveManifest, got map[string]ArchiveFile) error {
+	for _, want := range manifest.Files {
+		f, ok := got[want.Name]
+		if !ok {
+			return fmt.Errorf("archive is missing %s", want.Name)
+		}
+		if f != want {
+			return fmt.Errorf("%w: %s doesn't match the archive manifest: got size %d sha256 %s, want size %d sha256 %s",
+				ErrCorrupt, want.Name, f.Size, f.SHA256, want.Size, want.SHA256)
+		}
+		delete(got, want.Name)
+	}
+	for name := range got {
+		return fmt.Errorf("%s isn't in the archive manifest", name)
+	}
+	return nil
+}
+
+// offsetWriter adapts an io.WriterAt to write sequentially from the start.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
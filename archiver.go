@@ -0,0 +1,208 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+	"github.com/go-kit/log/level"
+)
+
+// Archiver is given the segments that TruncateFront removes from a WAL opened
+// WithArchiveOnTruncate, to move or upload somewhere they're kept for longer
+// before the WAL deletes them.
+type Archiver interface {
+	// ArchiveSegment is passed the segment's info and its file, which is read
+	// exactly as it is on disk, so it's still compressed or encrypted if the
+	// segment is. Everything needed from f must be read before returning. The
+	// segment is only deleted if it returns nil.
+	ArchiveSegment(info types.SegmentInfo, f types.ReadableFile) error
+}
+
+// DirArchiver is an Archiver that copies segment files into a directory with
+// the names they had in the WAL's.
+type DirArchiver struct {
+	vfs types.VFS
+	dir string
+}
+
+// NewDirArchiver returns a DirArchiver copying segments into dir, which must
+// already exist, using vfs.
+func NewDirArchiver(vfs types.VFS, dir string) *DirArchiver {
+	return &DirArchiver{vfs: vfs, dir: dir}
+}
+
+// ArchiveSegment implements Archiver. The copy is written under a temporary
+// name and renamed into place once it's synced, replacing any earlier copy.
+func (a *DirArchiver) ArchiveSegment(info types.SegmentInfo, f types.ReadableFile) error {
+	name := segment.FileName(info)
+	tmpName := name + ".tmp"
+
+	// A failed copy may have left a temporary file behind.
+	if err := a.vfs.Delete(a.dir, tmpName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	wf, err := a.vfs.Create(a.dir, tmpName, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.NewOffsetWriter(wf, 0), io.NewSectionReader(f, 0, math.MaxInt64))
+	if err == nil {
+		err = wf.Sync()
+	}
+	if cerr := wf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		a.vfs.Delete(a.dir, tmpName)
+		return fmt.Errorf("failed to copy %s: %w", name, err)
+	}
+	return a.vfs.Rename(a.dir, tmpName, name)
+}
+
+// archivePendingKey is the stable key holding the segments that TruncateFront
+// removed but that haven't been archived yet, as JSON. They're recorded before
+// the truncation is committed so a failed archive or a crash before it can be
+// retried when the WAL is next opened, rather than the files being deleted as
+// left over.
+var archivePendingKey = []byte("\x00wal/archive-pending")
+
+// pendingArchivesLocked returns the segments waiting to be archived by ID.
+// The caller must hold archiveMu.
+func (w *WAL) pendingArchivesLocked() (map[uint64]types.SegmentInfo, error) {
+	raw, err := w.metaDB.GetStable(archivePendingKey)
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[uint64]types.SegmentInfo)
+	if len(raw) == 0 {
+		return pending, nil
+	}
+	var infos []types.SegmentInfo
+	if err := json.Unmarshal(raw, &infos); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode segments pending archive: %s", ErrCorrupt, err)
+	}
+	for _, info := range infos {
+		pending[info.ID] = info
+	}
+	return pending, nil
+}
+
+func (w *WAL) storePendingArchivesLocked(pending map[uint64]types.SegmentInfo) error {
+	if len(pending) == 0 {
+		return w.metaDB.SetStable(archivePendingKey, nil)
+	}
+	infos := make([]types.SegmentInfo, 0, len(pending))
+	for _, info := range pending {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	raw, err := json.Marshal(infos)
+	if err != nil {
+		return err
+	}
+	return w.metaDB.SetStable(archivePendingKey, raw)
+}
+
+// updatePendingArchives adds the segments in add to those waiting to be
+// archived and removes those with the IDs in remove.
+func (w *WAL) updatePendingArchives(add []types.SegmentInfo, remove []uint64) error {
+	w.archiveMu.Lock()
+	defer w.archiveMu.Unlock()
+	pending, err := w.pendingArchivesLocked()
+	if err != nil {
+		return err
+	}
+	for _, info := range add {
+		pending[info.ID] = info
+	}
+	for _, id := range remove {
+		delete(pending, id)
+	}
+	return w.storePendingArchivesLocked(pending)
+}
+
+// archiveSegments passes each segment in toArchive to the Archiver before
+// it's deleted. Segments that fail to archive are removed from toDelete so
+// their files are left where they are, and stay pending to be retried when
+// the WAL is next opened.
+func (w *WAL) archiveSegments(toArchive []types.SegmentInfo, toDelete map[uint64]uint64) {
+	if len(toArchive) == 0 {
+		return
+	}
+	opener := w.sf.(rawSegmentOpener)
+	done := make([]uint64, 0, len(toArchive))
+	for _, info := range toArchive {
+		err := w.archiveSegment(opener, info)
+		if errors.Is(err, os.ErrNotExist) {
+			// The tail of an empty log may never have been created.
+			done = append(done, info.ID)
+			continue
+		}
+		if err != nil {
+			level.Error(w.logger).Log("msg", "failed to archive truncated segment, leaving its file in place",
+				"baseIndex", info.BaseIndex, "id", info.ID, "err", err)
+			delete(toDelete, info.ID)
+			continue
+		}
+		done = append(done, info.ID)
+	}
+	if err := w.updatePendingArchives(nil, done); err != nil {
+		// They're archived again when the WAL is next opened, which is harmless.
+		level.Error(w.logger).Log("msg", "failed to record archived segments", "err", err)
+	}
+}
+
+// retryPendingArchives archives the segments left pending when the WAL was
+// last open, before the leftover files in toDelete are deleted. Those that
+// are still in the log, because the truncation that removed them was never
+// committed, are no longer pending, and those that fail again are removed from
+// toDelete. If the WAL was opened without WithArchiveOnTruncate they're
+// deleted along with the other leftovers, and dropped once it's next opened
+// with it.
+func (w *WAL) retryPendingArchives(toDelete map[uint64]uint64) error {
+	if w.archiver == nil {
+		return nil
+	}
+	w.archiveMu.Lock()
+	pending, err := w.pendingArchivesLocked()
+	w.archiveMu.Unlock()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	var (
+		toArchive []types.SegmentInfo
+		drop      []uint64
+	)
+	for id, info := range pending {
+		if _, ok := toDelete[id]; ok {
+			toArchive = append(toArchive, info)
+		} else {
+			drop = append(drop, id)
+		}
+	}
+	sort.Slice(toArchive, func(i, j int) bool { return toArchive[i].ID < toArchive[j].ID })
+	if err := w.updatePendingArchives(nil, drop); err != nil {
+		return err
+	}
+	w.archiveSegments(toArchive, toDelete)
+	return nil
+}
+
+func (w *WAL) archiveSegment(opener rawSegmentOpener, info types.SegmentInfo) error {
+	f, err := opener.OpenFile(info)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.archiver.ArchiveSegment(info, f)
+}
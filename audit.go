@@ -0,0 +1,184 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/go-kit/log/level"
+)
+
+// AuditOp is the kind of destructive operation an AuditRecord describes.
+type AuditOp string
+
+const (
+	AuditTruncateFront AuditOp = "truncate-front"
+	AuditTruncateBack  AuditOp = "truncate-back"
+	AuditResetTo       AuditOp = "reset-to"
+	AuditDeleteSegment AuditOp = "delete-segment"
+)
+
+// AuditRecord is an entry in the audit log kept with WithAuditLog, recording
+// an operation that removed entries from the log or deleted a segment.
+type AuditRecord struct {
+	// Seq numbers the records from 1 in the order they were made.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Op   AuditOp   `json:"op"`
+
+	// Index is the index given to TruncateFront, TruncateBack or ResetTo.
+	Index uint64 `json:"index,omitempty"`
+
+	// First and Last are the first and last indexes the operation removed,
+	// both zero if it removed none, for example from an empty log.
+	First uint64 `json:"first,omitempty"`
+	Last  uint64 `json:"last,omitempty"`
+
+	// SegmentID and BaseIndex identify the segment AuditDeleteSegment deleted.
+	SegmentID uint64 `json:"segmentID,omitempty"`
+	BaseIndex uint64 `json:"baseIndex,omitempty"`
+
+	// Cause is the operation that a segment was deleted because of, if it was
+	// deleted because of a truncation or reset.
+	Cause AuditOp `json:"cause,omitempty"`
+
+	// Reason is the reason given by the caller of one of the WithReason
+	// methods, or why the WAL itself deleted a segment.
+	Reason string `json:"reason,omitempty"`
+}
+
+var (
+	// auditStateKey is the stable key holding the sequence numbers of the
+	// oldest audit record kept and the next one.
+	auditStateKey = []byte("\x00wal/audit")
+
+	// auditRecordPrefix is followed by a record's sequence number in hex to
+	// make its key, so keys are valid UTF-8 for stores that need it.
+	auditRecordPrefix = "\x00wal/audit/"
+)
+
+func auditRecordKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x", auditRecordPrefix, seq))
+}
+
+// auditLog keeps AuditRecords in the MetaStore's stable store, so they're as
+// durable as raft's term and vote, and encrypted along with them. Each record
+// has a key of its own that's never rewritten.
+type auditLog struct {
+	meta types.MetaStore
+
+	// keep is the most records kept, or zero for all of them.
+	keep int
+
+	mu          sync.Mutex
+	loaded      bool
+	first, next uint64
+}
+
+// loadLocked reads the sequence numbers the first time they're needed, so
+// that WALs that don't keep an audit log never read them. The caller must
+// hold mu.
+func (a *auditLog) loadLocked() error {
+	if a.loaded {
+		return nil
+	}
+	raw, err := a.meta.GetStable(auditStateKey)
+	if err != nil {
+		return err
+	}
+	a.first, a.next = 1, 1
+	if raw != nil {
+		if len(raw) != 16 {
+			return fmt.Errorf("%w: audit log state is %d bytes, expected 16", ErrCorrupt, len(raw))
+		}
+		a.first, a.next = binary.BigEndian.Uint64(raw), binary.BigEndian.Uint64(raw[8:])
+	}
+	a.loaded = true
+	return nil
+}
+
+// append stores rec as the next record, and drops the oldest ones beyond
+// keep. The state is only updated once the record is stored so a crash in
+// between leaves a record that's overwritten by the next.
+func (a *auditLog) append(rec AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.loadLocked(); err != nil {
+		return err
+	}
+	rec.Seq = a.next
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := a.meta.SetStable(auditRecordKey(rec.Seq), raw); err != nil {
+		return err
+	}
+	first, next := a.first, a.next+1
+	if a.keep > 0 && next-first > uint64(a.keep) {
+		first = next - uint64(a.keep)
+	}
+	var state [16]byte
+	binary.BigEndian.PutUint64(state[:], first)
+	binary.BigEndian.PutUint64(state[8:], next)
+	if err := a.meta.SetStable(auditStateKey, state[:]); err != nil {
+		return err
+	}
+	for seq := a.first; seq < first; seq++ {
+		if err := a.meta.SetStable(auditRecordKey(seq), nil); err != nil {
+			return err
+		}
+	}
+	a.first, a.next = first, next
+	return nil
+}
+
+// records returns every record kept, oldest first.
+func (a *auditLog) records() ([]AuditRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.loadLocked(); err != nil {
+		return nil, err
+	}
+	recs := make([]AuditRecord, 0, a.next-a.first)
+	for seq := a.first; seq < a.next; seq++ {
+		raw, err := a.meta.GetStable(auditRecordKey(seq))
+		if err != nil {
+			return nil, err
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return nil, fmt.Errorf("%w: failed to decode audit record %d: %s", ErrCorrupt, seq, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// AuditLog returns the records of destructive operations kept with
+// WithAuditLog, oldest first. Records kept before the WAL was reopened are
+// included even if it's no longer keeping them.
+func (w *WAL) AuditLog() ([]AuditRecord, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	return w.audit.records()
+}
+
+// recordAudit adds rec to the audit log if one is being kept. The operation
+// it records has already happened so failing to record it is only logged.
+func (w *WAL) recordAudit(rec AuditRecord) {
+	if !w.auditOn || w.readOnly {
+		return
+	}
+	rec.Time = time.Now()
+	if err := w.audit.append(rec); err != nil {
+		level.Error(w.logger).Log("msg", "failed to record in audit log", "op", rec.Op, "err", err)
+	}
+}
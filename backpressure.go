@@ -0,0 +1,55 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"fmt"
+	"sync"
+)
+
+// pendingLimit keeps track of the bytes of appends that have been made but
+// not yet synced, including those waiting for writeMu or for the tail to be
+// rotated, and holds back or turns away appends beyond its max.
+type pendingLimit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending int64
+	max     int64
+	reject  bool
+}
+
+func newPendingLimit(max int64, reject bool) *pendingLimit {
+	p := &pendingLimit{max: max, reject: reject}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// acquirePending adds n bytes to the appends pending, first waiting until
+// they fit under the limit set with WithMaxPendingBytes or returning an error
+// wrapping ErrBackpressure if appends are rejected instead. An append larger
+// than the limit goes ahead once nothing else is pending. The func returned
+// must be called once the append is done. It does nothing without a limit.
+func (w *WAL) acquirePending(n int64) (func(), error) {
+	p := w.pendingLimit
+	if p == nil {
+		return func() {}, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.pending > 0 && p.pending+n > p.max {
+		if p.reject {
+			return nil, fmt.Errorf("%w: %d bytes of appends are pending and the limit is %d", ErrBackpressure, p.pending, p.max)
+		}
+		p.cond.Wait()
+	}
+	p.pending += n
+	w.metrics.pendingAppendBytes.Set(float64(p.pending))
+	return func() {
+		p.mu.Lock()
+		p.pending -= n
+		w.metrics.pendingAppendBytes.Set(float64(p.pending))
+		p.mu.Unlock()
+		p.cond.Broadcast()
+	}, nil
+}
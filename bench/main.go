@@ -1,6 +1,10 @@
 // Copyright (c) HashiCorp, Inc
 // SPDX-License-Identifier: MPL-2.0
 
+// Command bench appends to a WAL at a steady rate for a while, optionally
+// truncating it as it goes, and reports latency histograms of how it holds up
+// under sustained load. To measure single operations and track the results
+// over time, use `wal bench` from cmd/wal instead.
 package main
 
 import (
@@ -0,0 +1,151 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// entryCache is an LRU of recently appended or read entries that sits in front
+// of segment reads. It's bounded by entry count, Data bytes or both.
+//
+// Reads that miss the cache race with truncations: a reader may fetch an entry
+// from a state that is then truncated and rewritten before it inserts the
+// entry. To avoid caching stale data, readers note the generation before they
+// acquire state and only insert if no truncation has happened since.
+type entryCache struct {
+	maxEntries int
+	maxBytes   int
+
+	mu    sync.Mutex
+	gen   uint64
+	bytes int
+	ll    *list.List // of *types.LogEntry, most recently used at the front
+	items map[uint64]*list.Element
+}
+
+func newEntryCache(maxEntries, maxBytes int) *entryCache {
+	return &entryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[uint64]*list.Element),
+	}
+}
+
+// generation returns the current truncation generation to pass to addRead.
+func (c *entryCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get copies the cached entry at idx into le if there is one. Data is only
+// copied if withData is true.
+func (c *entryCache) get(idx uint64, le *types.LogEntry, withData bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[idx]
+	if !ok {
+		return false
+	}
+	c.ll.MoveToFront(el)
+	e := el.Value.(*types.LogEntry)
+	le.Index = e.Index
+	le.Term = e.Term
+	le.Type = e.Type
+	le.AppendedAt = e.AppendedAt
+	// Copy into the caller's buffers when they're big enough, as reads from
+	// segments do.
+	meta := le.Meta
+	le.Meta = nil
+	if len(e.Meta) > 0 {
+		le.Meta = append(meta[:0], e.Meta...)
+	}
+	if withData {
+		le.Data = append(le.Data[:0], e.Data...)
+	}
+	return true
+}
+
+// addRead caches an entry read from a segment as long as no truncation has
+// happened since gen.
+func (c *entryCache) addRead(gen uint64, le *types.LogEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	c.addLocked(le)
+}
+
+// addAppended caches newly appended entries. The caller must hold the WAL's
+// writeMu.
+func (c *entryCache) addAppended(entries []types.LogEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range entries {
+		c.addLocked(&entries[i])
+	}
+}
+
+func (c *entryCache) addLocked(le *types.LogEntry) {
+	if c.maxBytes > 0 && len(le.Data) > c.maxBytes {
+		// Never going to fit.
+		return
+	}
+	e := &types.LogEntry{
+		Index:      le.Index,
+		Term:       le.Term,
+		Type:       le.Type,
+		AppendedAt: le.AppendedAt,
+		Meta:       append([]byte(nil), le.Meta...),
+		Data:       append([]byte(nil), le.Data...),
+	}
+	if el, ok := c.items[e.Index]; ok {
+		c.bytes -= len(el.Value.(*types.LogEntry).Data)
+		el.Value = e
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[e.Index] = c.ll.PushFront(e)
+	}
+	c.bytes += len(e.Data)
+
+	for (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) ||
+		(c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+func (c *entryCache) removeLocked(el *list.Element) {
+	e := c.ll.Remove(el).(*types.LogEntry)
+	delete(c.items, e.Index)
+	c.bytes -= len(e.Data)
+}
+
+// truncate removes all entries outside [min, max] and invalidates any reads
+// that are in flight. It must be called after the truncation is visible to
+// readers.
+func (c *entryCache) truncate(min, max uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*types.LogEntry)
+		if e.Index < min || e.Index > max {
+			c.removeLocked(el)
+		}
+		el = next
+	}
+}
+
+// reset removes every entry, for when the log is loaded from disk again.
+func (c *entryCache) reset() {
+	c.truncate(1, 0)
+}
@@ -0,0 +1,316 @@
+// Copyright (c) HashiCorp, Inc.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/metadb"
+	"github.com/dreamsxin/wal/types"
+)
+
+// benchOpts are the parameters of a bench run.
+type benchOpts struct {
+	dir       string
+	ops       int
+	entrySize int
+	batchSize int
+	segSize   int
+	trail     int
+	sync      string
+}
+
+// benchResult is what a workload measured. Seconds is the total time of the
+// timed operations and latencies are in microseconds.
+type benchResult struct {
+	Workload  string  `json:"workload"`
+	Sync      string  `json:"sync"`
+	EntrySize int     `json:"entry_size"`
+	BatchSize int     `json:"batch_size"`
+	Ops       int     `json:"ops"`
+	Seconds   float64 `json:"seconds"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	MeanUs    float64 `json:"mean_us"`
+	P50Us     float64 `json:"p50_us"`
+	P90Us     float64 `json:"p90_us"`
+	P99Us     float64 `json:"p99_us"`
+	P999Us    float64 `json:"p999_us"`
+	MaxUs     float64 `json:"max_us"`
+}
+
+// benchWorkloads runs a workload against w, returning the latency of each of
+// o.ops operations.
+var benchWorkloads = map[string]func(w *wal.WAL, o benchOpts) ([]time.Duration, error){
+	"append":   benchAppend,
+	"read":     benchRead,
+	"truncate": benchTruncate,
+}
+
+// bench times appends, reads or truncations against a new WAL in a temporary
+// dir and prints latency percentiles.
+func bench(args []string) error {
+	var (
+		o         benchOpts
+		workloads string
+		format    string
+	)
+	fl := flag.NewFlagSet("bench", flag.ExitOnError)
+	fl.StringVar(&o.dir, "dir", "", "dir to create the WAL in, on the disk to measure. It's created in a new temporary dir inside it which is deleted afterwards. Defaults to the system's temporary dir.")
+	fl.StringVar(&workloads, "workload", "append", "comma separated workloads to run, each against a new WAL: append, read or truncate")
+	fl.IntVar(&o.ops, "ops", 10000, "number of operations to time in each workload")
+	fl.IntVar(&o.entrySize, "entry-size", 128, "size of each entry's data in bytes")
+	fl.IntVar(&o.batchSize, "batch", 1, "number of entries appended in each StoreLogs call")
+	fl.IntVar(&o.segSize, "seg", 64, "segment size in MiB")
+	fl.IntVar(&o.trail, "trail", 10000, "number of entries the truncate workload leaves after each truncation")
+	fl.StringVar(&o.sync, "sync", "always", "how appends are made durable: always syncs segments to disk, none skips segment syncs and mem keeps everything in memory")
+	fl.StringVar(&format, "format", "text", "output format: text, json or csv")
+	fl.Parse(args)
+	if fl.NArg() != 0 || o.ops < 1 || o.entrySize < 0 || o.batchSize < 1 || o.segSize < 1 || o.trail < 1 {
+		return errUsage
+	}
+	switch o.sync {
+	case "always", "none", "mem":
+	default:
+		return fmt.Errorf("%w: unknown sync policy %q", errUsage, o.sync)
+	}
+	var names []string
+	for _, name := range strings.Split(workloads, ",") {
+		if _, ok := benchWorkloads[name]; !ok {
+			return fmt.Errorf("%w: unknown workload %q", errUsage, name)
+		}
+		names = append(names, name)
+	}
+	write, ok := benchWriters[format]
+	if !ok {
+		return fmt.Errorf("%w: unknown format %q", errUsage, format)
+	}
+
+	results := make([]benchResult, 0, len(names))
+	for _, name := range names {
+		r, err := runBench(name, o)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		results = append(results, r)
+	}
+	return write(os.Stdout, results)
+}
+
+// runBench runs the named workload against a new WAL and summarizes it.
+func runBench(name string, o benchOpts) (benchResult, error) {
+	dir, err := os.MkdirTemp(o.dir, "wal-bench-*")
+	if err != nil {
+		return benchResult{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	segSize := wal.WithSegmentSize(o.segSize * 1024 * 1024)
+	var w *wal.WAL
+	switch o.sync {
+	case "none":
+		// Keep the metadata in BoltDB as it would be without a VFS.
+		w, err = wal.Open(dir, segSize, wal.WithVFS(noSyncVFS{fs.New()}), wal.WithMetaStore(&metadb.BoltMetaDB{}))
+	case "mem":
+		w, err = wal.Open(dir, segSize, wal.WithVFS(fs.NewMem()))
+	default:
+		w, err = wal.Open(dir, segSize)
+	}
+	if err != nil {
+		return benchResult{}, err
+	}
+	lats, err := benchWorkloads[name](w, o)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return benchResult{}, err
+	}
+	return summarize(name, o, lats), nil
+}
+
+// benchEntries returns n entries of o.entrySize bytes starting at index idx.
+func benchEntries(idx uint64, n int, o benchOpts) []types.LogEntry {
+	data := make([]byte, o.entrySize)
+	rand.Read(data)
+	entries := make([]types.LogEntry, n)
+	for i := range entries {
+		entries[i] = types.LogEntry{Index: idx + uint64(i), Term: 1, Data: data}
+	}
+	return entries
+}
+
+// benchAppend times each of o.ops batches appended.
+func benchAppend(w *wal.WAL, o benchOpts) ([]time.Duration, error) {
+	lats := make([]time.Duration, o.ops)
+	idx := uint64(1)
+	for i := range lats {
+		entries := benchEntries(idx, o.batchSize, o)
+		start := time.Now()
+		if err := w.StoreLogs(entries); err != nil {
+			return nil, err
+		}
+		lats[i] = time.Since(start)
+		idx += uint64(o.batchSize)
+	}
+	return lats, nil
+}
+
+// benchRead appends o.ops batches and then times o.ops reads of entries
+// chosen at random.
+func benchRead(w *wal.WAL, o benchOpts) ([]time.Duration, error) {
+	if _, err := benchAppend(w, o); err != nil {
+		return nil, err
+	}
+	last, err := w.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	lats := make([]time.Duration, o.ops)
+	var le types.LogEntry
+	for i := range lats {
+		idx := uint64(rand.Int63n(int64(last))) + 1
+		start := time.Now()
+		if err := w.GetLog(idx, &le); err != nil {
+			return nil, fmt.Errorf("reading index %d: %w", idx, err)
+		}
+		lats[i] = time.Since(start)
+	}
+	return lats, nil
+}
+
+// benchTruncate appends o.ops batches, after each truncating the front of the
+// log back to o.trail entries as raft does after a snapshot. Only the
+// truncations are timed.
+func benchTruncate(w *wal.WAL, o benchOpts) ([]time.Duration, error) {
+	lats := make([]time.Duration, 0, o.ops)
+	idx := uint64(1)
+	for i := 0; i < o.ops; i++ {
+		if err := w.StoreLogs(benchEntries(idx, o.batchSize, o)); err != nil {
+			return nil, err
+		}
+		idx += uint64(o.batchSize)
+		last := idx - 1
+		if last <= uint64(o.trail) {
+			continue
+		}
+		start := time.Now()
+		if err := w.TruncateFront(last - uint64(o.trail) + 1); err != nil {
+			return nil, err
+		}
+		lats = append(lats, time.Since(start))
+	}
+	if len(lats) == 0 {
+		return nil, fmt.Errorf("nothing was truncated, append more than -trail entries")
+	}
+	return lats, nil
+}
+
+// summarize works out the throughput and percentiles of lats. Only the timed
+// operations count, not the appends some workloads make first.
+func summarize(name string, o benchOpts, lats []time.Duration) benchResult {
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+	var total time.Duration
+	for _, l := range lats {
+		total += l
+	}
+	us := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+	pct := func(p float64) float64 {
+		i := int(p * float64(len(lats)))
+		if i >= len(lats) {
+			i = len(lats) - 1
+		}
+		return us(lats[i])
+	}
+	return benchResult{
+		Workload:  name,
+		Sync:      o.sync,
+		EntrySize: o.entrySize,
+		BatchSize: o.batchSize,
+		Ops:       len(lats),
+		Seconds:   total.Seconds(),
+		OpsPerSec: float64(len(lats)) / total.Seconds(),
+		MeanUs:    us(total) / float64(len(lats)),
+		P50Us:     pct(0.5),
+		P90Us:     pct(0.9),
+		P99Us:     pct(0.99),
+		P999Us:    pct(0.999),
+		MaxUs:     us(lats[len(lats)-1]),
+	}
+}
+
+// benchWriters print results in each -format.
+var benchWriters = map[string]func(io.Writer, []benchResult) error{
+	"text": writeBenchText,
+	"json": writeBenchJSON,
+	"csv":  writeBenchCSV,
+}
+
+func writeBenchText(out io.Writer, results []benchResult) error {
+	fmt.Fprintf(out, "%-9s %7s %8s %9s %9s %9s %9s %9s %9s\n",
+		"workload", "ops", "ops/s", "mean(us)", "p50", "p90", "p99", "p99.9", "max")
+	for _, r := range results {
+		fmt.Fprintf(out, "%-9s %7d %8.0f %9.1f %9.1f %9.1f %9.1f %9.1f %9.1f\n",
+			r.Workload, r.Ops, r.OpsPerSec, r.MeanUs, r.P50Us, r.P90Us, r.P99Us, r.P999Us, r.MaxUs)
+	}
+	return nil
+}
+
+func writeBenchJSON(out io.Writer, results []benchResult) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+func writeBenchCSV(out io.Writer, results []benchResult) error {
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"workload", "sync", "entry_size", "batch_size", "ops", "seconds", "ops_per_sec",
+		"mean_us", "p50_us", "p90_us", "p99_us", "p999_us", "max_us"})
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, r := range results {
+		cw.Write([]string{r.Workload, r.Sync, strconv.Itoa(r.EntrySize), strconv.Itoa(r.BatchSize),
+			strconv.Itoa(r.Ops), f(r.Seconds), f(r.OpsPerSec), f(r.MeanUs), f(r.P50Us), f(r.P90Us),
+			f(r.P99Us), f(r.P999Us), f(r.MaxUs)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// noSyncVFS is a VFS whose files never sync, to measure the WAL without the
+// cost of making appends durable.
+type noSyncVFS struct {
+	*fs.FS
+}
+
+func (v noSyncVFS) Create(dir, name string, size uint64) (types.WritableFile, error) {
+	f, err := v.FS.Create(dir, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return noSyncFile{f}, nil
+}
+
+func (v noSyncVFS) OpenWriter(dir, name string) (types.WritableFile, error) {
+	f, err := v.FS.OpenWriter(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return noSyncFile{f}, nil
+}
+
+type noSyncFile struct {
+	types.WritableFile
+}
+
+func (noSyncFile) Sync() error { return nil }
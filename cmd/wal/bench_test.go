@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	lats := make([]time.Duration, 1000)
+	for i := range lats {
+		// Out of order to check they're sorted.
+		lats[i] = time.Duration(len(lats)-i) * time.Microsecond
+	}
+	o := benchOpts{entrySize: 128, batchSize: 10, sync: "mem"}
+	r := summarize("append", o, lats)
+
+	require.Equal(t, "append", r.Workload)
+	require.Equal(t, "mem", r.Sync)
+	require.Equal(t, 128, r.EntrySize)
+	require.Equal(t, 10, r.BatchSize)
+	require.Equal(t, 1000, r.Ops)
+	require.InDelta(t, 0.5005, r.Seconds, 1e-9)
+	require.InDelta(t, 1000/0.5005, r.OpsPerSec, 1e-6)
+	require.InDelta(t, 500.5, r.MeanUs, 1e-9)
+	require.Equal(t, 501.0, r.P50Us)
+	require.Equal(t, 901.0, r.P90Us)
+	require.Equal(t, 991.0, r.P99Us)
+	require.Equal(t, 1000.0, r.P999Us)
+	require.Equal(t, 1000.0, r.MaxUs)
+
+	// A single operation is every percentile.
+	r = summarize("read", o, []time.Duration{3 * time.Microsecond})
+	require.Equal(t, 3.0, r.P50Us)
+	require.Equal(t, 3.0, r.P999Us)
+}
+
+func TestBenchWriters(t *testing.T) {
+	results := []benchResult{
+		{Workload: "append", Sync: "always", EntrySize: 128, BatchSize: 1, Ops: 2, Seconds: 0.25, OpsPerSec: 8, MeanUs: 125000, P50Us: 100000.5, P90Us: 150000, P99Us: 150000, P999Us: 150000, MaxUs: 150000},
+		{Workload: "read", Sync: "always", EntrySize: 128, BatchSize: 1, Ops: 1, Seconds: 0.001, OpsPerSec: 1000, MeanUs: 1000, P50Us: 1000, P90Us: 1000, P99Us: 1000, P999Us: 1000, MaxUs: 1000},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeBenchJSON(&buf, results))
+	var decoded []benchResult
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, results, decoded)
+	require.Contains(t, buf.String(), `"p999_us": 150000`)
+
+	buf.Reset()
+	require.NoError(t, writeBenchCSV(&buf, results))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	require.Equal(t, []string{"workload", "sync", "entry_size", "batch_size", "ops", "seconds", "ops_per_sec",
+		"mean_us", "p50_us", "p90_us", "p99_us", "p999_us", "max_us"}, rows[0])
+	require.Equal(t, []string{"append", "always", "128", "1", "2", "0.25", "8",
+		"125000", "100000.5", "150000", "150000", "150000", "150000"}, rows[1])
+	require.Equal(t, "read", rows[2][0])
+
+	buf.Reset()
+	require.NoError(t, writeBenchText(&buf, results))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	require.True(t, strings.HasPrefix(lines[0], "workload"))
+	require.Equal(t, []string{"append", "2", "8", "125000.0", "100000.5", "150000.0", "150000.0", "150000.0", "150000.0"}, strings.Fields(lines[1]))
+}
+
+func TestBenchMem(t *testing.T) {
+	o := benchOpts{ops: 50, entrySize: 16, batchSize: 2, segSize: 1, trail: 20, sync: "mem"}
+	for name := range benchWorkloads {
+		r, err := runBench(name, o)
+		require.NoError(t, err, name)
+		require.NotZero(t, r.Ops, name)
+		require.LessOrEqual(t, r.P50Us, r.MaxUs, name)
+	}
+}
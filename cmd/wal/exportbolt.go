@@ -0,0 +1,50 @@
+// Copyright (c) HashiCorp, Inc.
+
+//go:build !wasm
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/raftwal"
+)
+
+// keyList collects repeated -key flags.
+type keyList []string
+
+func (k *keyList) String() string     { return strings.Join(*k, ",") }
+func (k *keyList) Set(v string) error { *k = append(*k, v); return nil }
+
+// exportBolt writes the WAL into a raft-boltdb file so a node can be moved back
+// to raft-boltdb.
+func exportBolt(args []string) error {
+	var keys keyList
+	fs := flag.NewFlagSet("export-bolt", flag.ExitOnError)
+	fs.Var(&keys, "key", "an extra stable store key to copy as is, may be repeated. Raft's own keys are always copied.")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+
+	w, err := wal.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	extra := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		extra = append(extra, []byte(k))
+	}
+	n, err := raftwal.ExportBolt(context.Background(), w, fs.Arg(1), extra...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d entries to %s\n", n, fs.Arg(1))
+	return nil
+}
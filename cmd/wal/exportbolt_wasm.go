@@ -0,0 +1,12 @@
+// Copyright (c) HashiCorp, Inc.
+
+//go:build wasm
+
+package main
+
+import "fmt"
+
+// exportBolt is unsupported on WebAssembly, which BoltDB doesn't build for.
+func exportBolt(args []string) error {
+	return fmt.Errorf("export-bolt isn't supported on WebAssembly")
+}
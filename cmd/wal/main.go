@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+
+// Command wal performs offline maintenance on a WAL directory. The application
+// that owns the WAL must not be running. It can also benchmark the WAL on a
+// disk.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/segment"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{
+		name:  "export-bolt",
+		usage: "export-bolt [-key NAME]... <path to WAL dir> <path to new bolt file>",
+		run:   exportBolt,
+	},
+	{
+		name:  "bench",
+		usage: "bench [-workload append,read,truncate] [-ops N] [-entry-size N] [-batch N] [-seg MiB] [-trail N] [-sync always|none|mem] [-format text|json|csv] [-dir DIR]",
+		run:   bench,
+	},
+	{
+		name:  "migrate-format",
+		usage: "migrate-format <path to WAL dir>",
+		run:   migrateFormat,
+	},
+}
+
+// errUsage is returned by commands given the wrong arguments.
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	var cmd *command
+	for i := range commands {
+		if len(os.Args) > 1 && commands[i].name == os.Args[1] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		usage()
+	}
+	err := cmd.run(os.Args[2:])
+	if errors.Is(err, errUsage) {
+		if err != errUsage {
+			fmt.Printf("ERROR: %s\n", err)
+		}
+		usage()
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Println("Usage:")
+	for _, cmd := range commands {
+		fmt.Println("  wal", cmd.usage)
+	}
+	os.Exit(1)
+}
+
+// migrateFormat rewrites any segments written in an older format.
+func migrateFormat(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	w, err := wal.Open(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := w.MigrateFormat(context.Background())
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d segments to format version %d\n", n, segment.FormatVersion)
+	return nil
+}
@@ -3,10 +3,13 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 
+	"github.com/dreamsxin/wal"
 	"github.com/dreamsxin/wal/fs"
 	"github.com/dreamsxin/wal/segment"
 	"github.com/dreamsxin/wal/types"
@@ -35,10 +38,16 @@ func main() {
 	vfs := fs.New()
 	f := segment.NewFiler(o.Dir, vfs)
 
+	// Write entries in the same format as wal.Export so the output can be
+	// imported again.
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
 	err := f.DumpLogs(o.After, o.Before, func(info types.SegmentInfo, e types.LogEntry) (bool, error) {
-		fmt.Println("TODO: decode bytes:", e.Data)
-		return true, nil
+		return true, enc.Encode(wal.NewExportEntry(e))
 	})
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
 	if err != nil {
 		fmt.Printf("ERROR: %s\n", err)
 		os.Exit(1)
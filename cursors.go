@@ -0,0 +1,82 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// cursorsKey is the stable store key that all cursors are stored under.
+var cursorsKey = []byte("wal-cursors")
+
+// ErrNoCursor is returned when a named cursor doesn't exist.
+var ErrNoCursor = errors.New("cursor not found")
+
+// Cursor returns the index stored for the named cursor. Cursors are a
+// durable place for consumers of the log such as replicas or indexers to record
+// how far they have got. The WAL doesn't interpret them in any way. It returns
+// ErrNoCursor if the cursor hasn't been set.
+func (w *WAL) Cursor(name string) (uint64, error) {
+	cursors, err := w.Cursors()
+	if err != nil {
+		return 0, err
+	}
+	idx, ok := cursors[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrNoCursor, name)
+	}
+	return idx, nil
+}
+
+// Cursors returns every named cursor and its index.
+func (w *WAL) Cursors() (map[string]uint64, error) {
+	raw, err := w.GetStable(cursorsKey)
+	if err != nil {
+		return nil, err
+	}
+	cursors := make(map[string]uint64)
+	if len(raw) == 0 {
+		return cursors, nil
+	}
+	if err := json.Unmarshal(raw, &cursors); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode cursors: %s", ErrCorrupt, err)
+	}
+	return cursors, nil
+}
+
+// SetCursor durably stores index for the named cursor.
+func (w *WAL) SetCursor(name string, index uint64) error {
+	return w.updateCursors(func(cursors map[string]uint64) {
+		cursors[name] = index
+	})
+}
+
+// DeleteCursor removes the named cursor. It's not an error if it doesn't
+// exist.
+func (w *WAL) DeleteCursor(name string) error {
+	return w.updateCursors(func(cursors map[string]uint64) {
+		delete(cursors, name)
+	})
+}
+
+func (w *WAL) updateCursors(fn func(map[string]uint64)) error {
+	w.cursorMu.Lock()
+	defer w.cursorMu.Unlock()
+
+	cursors, err := w.Cursors()
+	if err != nil {
+		return err
+	}
+	fn(cursors)
+	if len(cursors) == 0 {
+		return w.SetStable(cursorsKey, nil)
+	}
+	raw, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+	return w.SetStable(cursorsKey, raw)
+}
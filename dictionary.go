@@ -0,0 +1,81 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+)
+
+// TrainDictionary trains a compression dictionary on the data of up to samples
+// of the most recent entries and compresses segments created from then on
+// with it, as SetDictionary does. Small entries that have a lot in common,
+// like most raft commands, compress much better with one. It returns the
+// dictionary so that it can be given to WithCompressionDictionary or other
+// WALs. The tail segment keeps the dictionary it was created with, so the
+// new one is used from the next rotation.
+func (w *WAL) TrainDictionary(samples int) ([]byte, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	if w.compression == segment.CompressionNone {
+		return nil, fmt.Errorf("a compression dictionary needs a compression codec")
+	}
+	last, err := w.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	var data [][]byte
+	for idx := last; idx > 0 && len(data) < samples; idx-- {
+		var le types.LogEntry
+		err := w.GetLog(idx, &le)
+		if errors.Is(err, ErrNotFound) {
+			// The head was truncated, so that's all there is.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, le.Data)
+	}
+	dict := segment.TrainDictionary(data, segment.DefaultDictionarySize)
+	if dict == nil {
+		return nil, fmt.Errorf("the %d most recent entries have too little in common to train a dictionary", len(data))
+	}
+	if err := w.SetDictionary(dict); err != nil {
+		return nil, err
+	}
+	return dict, nil
+}
+
+// SetDictionary compresses segments created from now on with dict as a preset
+// dictionary, with the same requirements as WithCompressionDictionary. Once
+// the WAL is reopened it carries on with the dictionary of its tail segment
+// unless WithCompressionDictionary gives another.
+func (w *WAL) SetDictionary(dict []byte) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	if w.compression == segment.CompressionNone {
+		return fmt.Errorf("a compression dictionary needs a compression codec")
+	}
+	return w.useDictionary(dict)
+}
+
+func (w *WAL) useDictionary(dict []byte) error {
+	sd, ok := w.sf.(types.SegmentDictionaries)
+	if !ok {
+		return fmt.Errorf("a compression dictionary needs a SegmentFiler that supports them")
+	}
+	id, err := sd.AddDictionary(dict)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&w.dictID, id)
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// Digest returns a SHA-256 hash of the entries from start to end inclusive. It
+// covers each entry's Index, Term, Type, Meta and Data but not AppendedAt, so
+// two replicas holding the same entries always produce the same digest
+// regardless of when or how they were written. It returns an error wrapping
+// ErrOutOfRange if the range isn't entirely in the log.
+func (w *WAL) Digest(start, end uint64) ([]byte, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	s, release := w.acquireState()
+	defer release()
+
+	if err := checkDigestRange(s, start, end); err != nil {
+		return nil, err
+	}
+	return digestRange(s, start, end)
+}
+
+// DigestNode is a node in a tree of digests over a range of the log. Leaves
+// cover up to a fixed number of consecutive entries and each parent's Digest
+// is a hash of its children's, so two replicas can compare the roots and then
+// only descend into the subtrees that differ to find where they diverge.
+type DigestNode struct {
+	// First and Last are the range of indexes covered by this node.
+	First, Last uint64
+
+	Digest []byte
+
+	// Left and Right are nil for leaves.
+	Left, Right *DigestNode
+}
+
+// DigestTree returns a tree of digests over the entries from start to end
+// inclusive with leaves of leafSize entries, the last leaf may be shorter. Each
+// leaf's Digest is what Digest returns for its range. Trees can only be
+// compared with Diff if they were built with the same start, end and leafSize.
+func (w *WAL) DigestTree(start, end, leafSize uint64) (*DigestNode, error) {
+	if leafSize == 0 {
+		return nil, fmt.Errorf("leafSize must be greater than zero")
+	}
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	s, release := w.acquireState()
+	defer release()
+
+	if err := checkDigestRange(s, start, end); err != nil {
+		return nil, err
+	}
+
+	var nodes []*DigestNode
+	for first := start; first <= end; first += leafSize {
+		last := first + leafSize - 1
+		if last > end || last < first {
+			last = end
+		}
+		d, err := digestRange(s, first, last)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, &DigestNode{First: first, Last: last, Digest: d})
+		if last == end {
+			break
+		}
+	}
+
+	// Pair up nodes level by level until only the root is left. An odd node out
+	// is promoted to the next level as is.
+	for len(nodes) > 1 {
+		parents := make([]*DigestNode, 0, (len(nodes)+1)/2)
+		for i := 0; i < len(nodes); i += 2 {
+			if i+1 == len(nodes) {
+				parents = append(parents, nodes[i])
+				continue
+			}
+			l, r := nodes[i], nodes[i+1]
+			h := sha256.New()
+			h.Write(l.Digest)
+			h.Write(r.Digest)
+			parents = append(parents, &DigestNode{
+				First:  l.First,
+				Last:   r.Last,
+				Digest: h.Sum(nil),
+				Left:   l,
+				Right:  r,
+			})
+		}
+		nodes = parents
+	}
+	return nodes[0], nil
+}
+
+// Diff returns the leaves of n whose digests differ from the corresponding
+// leaves of other, in index order. It only descends into subtrees whose
+// digests differ. Both trees must have been built with the same arguments to
+// DigestTree.
+func (n *DigestNode) Diff(other *DigestNode) []*DigestNode {
+	if n == nil || other == nil || bytes.Equal(n.Digest, other.Digest) {
+		return nil
+	}
+	if n.Left == nil || other.Left == nil {
+		return []*DigestNode{n}
+	}
+	return append(n.Left.Diff(other.Left), n.Right.Diff(other.Right)...)
+}
+
+func checkDigestRange(s *state, start, end uint64) error {
+	first, last := s.firstIndex(), s.lastIndex()
+	if start > end || start < first || end > last || last == 0 {
+		return fmt.Errorf("digest %w: first=%d, last=%d, start=%d, end=%d", ErrOutOfRange, first, last, start, end)
+	}
+	return nil
+}
+
+func digestRange(s *state, start, end uint64) ([]byte, error) {
+	h := sha256.New()
+	var le types.LogEntry
+	for idx := start; idx <= end; idx++ {
+		if err := s.getLog(idx, &le); err != nil {
+			return nil, err
+		}
+		le.Index = idx
+		writeDigestEntry(h, &le)
+		if idx == end {
+			// Avoid overflowing if end is the largest index possible.
+			break
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// writeDigestEntry writes an unambiguous encoding of the fields of le that
+// replicas must agree on into h.
+func writeDigestEntry(h hash.Hash, le *types.LogEntry) {
+	var buf [8 + 8 + 1 + 4]byte
+	binary.LittleEndian.PutUint64(buf[0:], le.Index)
+	binary.LittleEndian.PutUint64(buf[8:], le.Term)
+	buf[16] = le.Type
+	binary.LittleEndian.PutUint32(buf[17:], uint32(len(le.Meta)))
+	h.Write(buf[:])
+	h.Write(le.Meta)
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(le.Data)))
+	h.Write(buf[:4])
+	h.Write(le.Data)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+)
+
+var (
+	// encryptedStateKey is the stable key that the encrypted PersistentState
+	// is kept under. The leading zero byte keeps it clear of raft's keys and
+	// any an application is likely to choose.
+	encryptedStateKey = []byte("\x00wal/encrypted-state")
+
+	// sealedValueMagic prefixes encrypted stable values so that values stored
+	// before encryption was turned on can still be read.
+	sealedValueMagic = []byte("\xf0WE\x01")
+)
+
+// encryptedMeta wraps the MetaStore of a WAL opened WithEncryption so that
+// neither its segment metadata nor its stable values are kept in plaintext.
+// The PersistentState is sealed whole and stored under encryptedStateKey,
+// leaving the inner store's own state empty, and each stable value is sealed
+// and bound to its key so values can't be swapped between keys. State and
+// values written before encryption was turned on are still read, and replaced
+// by encrypted ones the next time the state is committed or the value read.
+type encryptedMeta struct {
+	types.MetaStore
+	enc *segment.Encrypter
+
+	// readOnly stops plaintext values being rewritten when they're read.
+	readOnly bool
+
+	// plain is whether the inner store's own state still needs clearing.
+	plain bool
+}
+
+func newEncryptedMeta(inner types.MetaStore, keys types.KeyProvider, suite uint8, lockKeys, readOnly bool) (*encryptedMeta, error) {
+	enc, err := segment.NewEncrypter(keys, suite, lockKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedMeta{MetaStore: inner, enc: enc, readOnly: readOnly}, nil
+}
+
+// Load implements types.MetaStore.
+func (m *encryptedMeta) Load(dir string) (types.PersistentState, error) {
+	ps, err := m.MetaStore.Load(dir)
+	if err != nil {
+		return ps, err
+	}
+	m.plain = ps.NextSegmentID != 0 || len(ps.Segments) > 0
+	sealed, err := m.MetaStore.GetStable(encryptedStateKey)
+	if err != nil || sealed == nil {
+		return ps, err
+	}
+	raw, err := m.enc.Open(nil, sealed, []byte("state"))
+	if err != nil {
+		return types.PersistentState{}, fmt.Errorf("failed to decrypt WAL metadata: %w", err)
+	}
+	var state types.PersistentState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return types.PersistentState{}, fmt.Errorf("%w: failed to decode WAL metadata: %s", ErrCorrupt, err)
+	}
+	return state, nil
+}
+
+// CommitState implements types.MetaStore. The encrypted state is stored before
+// any plaintext state is cleared so that a crash in between leaves the newer
+// one to be loaded.
+func (m *encryptedMeta) CommitState(ps types.PersistentState) error {
+	raw, err := json.Marshal(ps)
+	if err != nil {
+		return err
+	}
+	sealed, err := m.enc.Seal(nil, raw, []byte("state"))
+	if err != nil {
+		return err
+	}
+	if err := m.MetaStore.SetStable(encryptedStateKey, sealed); err != nil {
+		return err
+	}
+	if m.plain {
+		if err := m.MetaStore.CommitState(types.PersistentState{}); err != nil {
+			return err
+		}
+		m.plain = false
+	}
+	return nil
+}
+
+// GetStable implements types.MetaStore.
+func (m *encryptedMeta) GetStable(key []byte) ([]byte, error) {
+	val, err := m.MetaStore.GetStable(key)
+	if err != nil || val == nil {
+		return val, err
+	}
+	if !bytes.HasPrefix(val, sealedValueMagic) {
+		// Stored before encryption was turned on.
+		if !m.readOnly {
+			if err := m.SetStable(key, val); err != nil {
+				return nil, err
+			}
+		}
+		return val, nil
+	}
+	val, err = m.enc.Open(nil, val[len(sealedValueMagic):], stableAAD(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt stable value: %w", err)
+	}
+	return val, nil
+}
+
+// SetStable implements types.MetaStore.
+func (m *encryptedMeta) SetStable(key []byte, val []byte) error {
+	if val == nil {
+		return m.MetaStore.SetStable(key, nil)
+	}
+	sealed, err := m.enc.Seal(append([]byte(nil), sealedValueMagic...), val, stableAAD(key))
+	if err != nil {
+		return err
+	}
+	return m.MetaStore.SetStable(key, sealed)
+}
+
+// Close implements io.Closer, wiping the keys it kept.
+func (m *encryptedMeta) Close() error {
+	m.enc.WipeKeys()
+	return m.MetaStore.Close()
+}
+
+func stableAAD(key []byte) []byte {
+	return append([]byte("stable:"), key...)
+}
+
+// checkMetaEncryption returns an error if meta, which loaded ps, holds state
+// encrypted by a WAL opened WithEncryption, since without the keys the log
+// would look empty and its segments be deleted. Encrypted state always leaves
+// the store's own state empty so others needn't be checked.
+func checkMetaEncryption(meta types.MetaStore, ps types.PersistentState) error {
+	if _, ok := meta.(*encryptedMeta); ok || ps.NextSegmentID != 0 || len(ps.Segments) > 0 {
+		return nil
+	}
+	sealed, err := meta.GetStable(encryptedStateKey)
+	if err != nil {
+		return err
+	}
+	if sealed != nil {
+		return fmt.Errorf("%w: the WAL's metadata is encrypted", segment.ErrNoEncryptionKeys)
+	}
+	return nil
+}
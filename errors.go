@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+)
+
+// SegmentError is returned by reads that fail for some reason other than the
+// entry not existing, wrapping the cause with which segment and entry were
+// being read.
+type SegmentError struct {
+	ID        uint64
+	BaseIndex uint64
+	Index     uint64
+
+	// Offset is where in the segment file the problem was found, or -1 if
+	// that isn't known.
+	Offset int64
+
+	Err error
+}
+
+func (e *SegmentError) Error() string {
+	if e.Offset >= 0 {
+		return fmt.Sprintf("segment %d reading index %d at offset %d: %s", e.ID, e.Index, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("segment %d reading index %d: %s", e.ID, e.Index, e.Err)
+}
+
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// wrapSegmentError wraps err from reading idx from the segment described by
+// info in a SegmentError. ErrNotFound and ErrClosed are returned as they are
+// since they say nothing about the segment.
+func wrapSegmentError(info types.SegmentInfo, idx uint64, err error) error {
+	if err == nil || err == ErrNotFound || errors.Is(err, ErrClosed) {
+		return err
+	}
+	se := &SegmentError{ID: info.ID, BaseIndex: info.BaseIndex, Index: idx, Offset: -1, Err: err}
+	var fe *segment.FrameError
+	if errors.As(err, &fe) {
+		se.Offset = fe.Offset
+	}
+	return se
+}
+
+// IsCorrupt reports whether err is because data on disk is damaged or isn't
+// what it should be. Retrying won't help, though another copy of the data
+// might.
+func IsCorrupt(err error) bool {
+	return errors.Is(err, ErrCorrupt)
+}
+
+// IsRetryable reports whether err is from a problem that may clear up by
+// itself, such as the disk being full, the process running out of file
+// descriptors or an append being throttled, so that the same call could
+// succeed later. Errors after which the WAL needs ClearError or Reopen,
+// corruption and mistakes by the caller such as ErrConflict aren't retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, ErrFailed) || errors.Is(err, ErrClosed) || IsCorrupt(err) {
+		return false
+	}
+	if errors.Is(err, ErrDiskFull) || errors.Is(err, ErrThrottled) || errors.Is(err, ErrBackpressure) {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EAGAIN, syscall.EINTR, syscall.EMFILE, syscall.ENFILE} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var te interface{ Timeout() bool }
+	return errors.As(err, &te) && te.Timeout()
+}
+
+// Phases the read_errors_total metric counts errors in.
+const (
+	readPhaseRecovery = "recovery"
+	readPhaseRead     = "read"
+	readPhaseVerify   = "verify"
+	readPhaseScrub    = "scrub"
+)
+
+// countReadError counts err in the read_errors_total metric if it's because
+// segment data is damaged or missing. It returns err so it can wrap a return.
+func (w *WAL) countReadError(phase string, err error) error {
+	var kind string
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, segment.ErrChecksum):
+		kind = "checksum"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		kind = "unexpected_eof"
+	case IsCorrupt(err):
+		kind = "corrupt"
+	default:
+		return err
+	}
+	w.metrics.readErrors.WithLabelValues(kind, phase).Inc()
+	return err
+}
@@ -0,0 +1,175 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// ExportOptions controls what Export writes.
+type ExportOptions struct {
+	// Start and End are the inclusive range of indexes to export. A zero Start
+	// means the first entry in the log and a zero End means the last. End is
+	// clamped to the end of the log.
+	Start, End uint64
+
+	// OmitData leaves out each entry's Data, for example to share the shape of
+	// a log in a bug report without its contents.
+	OmitData bool
+}
+
+// ExportEntry is how Export writes each entry as a line of JSON. Meta and Data
+// are base64 encoded like any []byte. AppendedAt is zero if the entry was
+// written before append times were recorded.
+type ExportEntry struct {
+	Index      uint64    `json:"index"`
+	Term       uint64    `json:"term"`
+	Type       uint8     `json:"type"`
+	Meta       []byte    `json:"meta,omitempty"`
+	AppendedAt time.Time `json:"appendedAt"`
+	Data       []byte    `json:"data,omitempty"`
+}
+
+// NewExportEntry returns le as an ExportEntry.
+func NewExportEntry(le types.LogEntry) ExportEntry {
+	return ExportEntry{
+		Index:      le.Index,
+		Term:       le.Term,
+		Type:       le.Type,
+		Meta:       le.Meta,
+		AppendedAt: le.AppendedAt,
+		Data:       le.Data,
+	}
+}
+
+// LogEntry returns e as a types.LogEntry.
+func (e ExportEntry) LogEntry() types.LogEntry {
+	return types.LogEntry{
+		Index:      e.Index,
+		Term:       e.Term,
+		Type:       e.Type,
+		Meta:       e.Meta,
+		AppendedAt: e.AppendedAt,
+		Data:       e.Data,
+	}
+}
+
+// importBatchSize is how many entries Import appends at once.
+const importBatchSize = 256
+
+// errExportDone stops the Replay in Export once End has been reached.
+var errExportDone = errors.New("export done")
+
+// Export writes the entries in the range chosen by opts to wr as JSON lines,
+// one ExportEntry per line, for offline analysis or to Import into another
+// WAL later. Like Replay it returns an error wrapping ErrOutOfRange if Start
+// has been truncated from the front of the log.
+func (w *WAL) Export(ctx context.Context, wr io.Writer, opts ExportOptions) error {
+	bw := bufio.NewWriter(wr)
+	enc := json.NewEncoder(bw)
+	err := w.Replay(ctx, opts.Start, func(le types.LogEntry) error {
+		if opts.End > 0 && le.Index > opts.End {
+			return errExportDone
+		}
+		e := NewExportEntry(le)
+		if opts.OmitData {
+			e.Data = nil
+		}
+		return enc.Encode(e)
+	})
+	if err != nil && err != errExportDone {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Import builds a new WAL in dir from JSON lines in the format written by
+// Export, passing opts to Open. dir must not already contain a log. Indexes
+// must be contiguous and increasing, though the first can be anything. Entries
+// keep the AppendedAt they were exported with. Segments are sealed as they fill
+// up exactly as if the entries had been appended normally. It returns the
+// number of entries imported. If it fails part way through dir is left with
+// the entries imported so far.
+func Import(dir string, rd io.Reader, opts ...walOpt) (int, error) {
+	w, err := Open(dir, opts...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := importEntries(w, rd)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func importEntries(w *WAL, rd io.Reader) (int, error) {
+	dec := json.NewDecoder(rd)
+	return importFrom(w, func() (types.LogEntry, error) {
+		var e ExportEntry
+		if err := dec.Decode(&e); err != nil {
+			if err != io.EOF {
+				err = fmt.Errorf("failed to decode entry: %w", err)
+			}
+			return types.LogEntry{}, err
+		}
+		return e.LogEntry(), nil
+	})
+}
+
+// importFrom appends the entries returned by next to w, which must be empty,
+// until next returns io.EOF. It's shared by the importers for each source
+// format and checks that indexes are contiguous.
+func importFrom(w *WAL, next func() (types.LogEntry, error)) (int, error) {
+	last, err := w.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+	if last != 0 {
+		return 0, fmt.Errorf("can't import into %s which already contains entries up to %d", w.dir, last)
+	}
+
+	var (
+		n     int
+		prev  uint64
+		batch = make([]types.LogEntry, 0, importBatchSize)
+	)
+	for {
+		e, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, fmt.Errorf("after index %d: %w", prev, err)
+		}
+		if e.Index == 0 {
+			return n, fmt.Errorf("entry after index %d has no index", prev)
+		}
+		if prev > 0 && e.Index != prev+1 {
+			return n, fmt.Errorf("index %d doesn't follow %d, indexes must be contiguous", e.Index, prev)
+		}
+		prev = e.Index
+		batch = append(batch, e)
+		if len(batch) == importBatchSize {
+			if err := w.StoreLogs(batch); err != nil {
+				return n, err
+			}
+			n += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := w.StoreLogs(batch); err != nil {
+			return n, err
+		}
+		n += len(batch)
+	}
+	return n, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/go-kit/log/level"
+)
+
+// SyncErrorPolicy decides what the WAL does when writing or syncing the tail
+// segment fails.
+type SyncErrorPolicy int
+
+const (
+	// SyncErrorSticky fails every append with ErrFailed until ClearError is
+	// called or the WAL is reopened.
+	SyncErrorSticky SyncErrorPolicy = iota
+
+	// SyncErrorClose closes the WAL, so that it has to be opened again,
+	// recovering the tail as after a crash, before it can be used again.
+	SyncErrorClose
+
+	// SyncErrorPanic panics. Raft can't safely carry on if it doesn't know
+	// what's on disk, and restarting the process is the simplest way to make
+	// sure nothing does.
+	SyncErrorPanic
+)
+
+// appendFailedLocked returns the error for an append to the tail that failed
+// with err. If the tail's file was left in an unknown state the WAL is marked
+// failed so that nothing more is written to it. The caller must hold writeMu.
+func (w *WAL) appendFailedLocked(err error) error {
+	err = wrapDiskFull(err)
+	if !errors.Is(err, types.ErrWriteFailed) {
+		return err
+	}
+	// Retrying could sync pages the kernel has already thrown away and report
+	// success, so stop here until ClearError moves on to a new file.
+	w.failErr = err
+	err = fmt.Errorf("%w: %w", ErrFailed, err)
+	switch w.syncErrorPolicy {
+	case SyncErrorPanic:
+		panic(err)
+	case SyncErrorClose:
+		level.Error(w.logger).Log("msg", "write to tail segment failed, closing WAL", "err", err)
+		// Close needs writeMu which the caller holds.
+		go func() {
+			if err := w.Close(); err != nil {
+				level.Error(w.logger).Log("msg", "failed to close WAL", "err", err)
+			}
+		}()
+	default:
+		level.Error(w.logger).Log("msg", "write to tail segment failed, appends will fail until the error is cleared", "err", err)
+	}
+	return err
+}
+
+// ClearError recovers the WAL after a failed write to the tail segment so that
+// appends can carry on. The failed tail is sealed as it stood after the last
+// successful append and a new tail segment is started after it, so the file
+// that failed is never written to again. It does nothing if no write has
+// failed.
+//
+// If it returns an error the WAL is still failed. Closing it and opening it
+// again is then the way to recover.
+func (w *WAL) ClearError() error {
+	if err := w.checkWritable(); err != nil {
+		return err
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+
+	if w.failErr == nil {
+		return nil
+	}
+	txn := stateTxn(func(newState *state) (func(), func() error, error) {
+		tail := newState.getTailInfo()
+		if tail == nil {
+			// Can't happen
+			return nil, nil, fmt.Errorf("no tail found during recovery")
+		}
+		// The tail only reports entries from appends that succeeded.
+		lastIdx := newState.tail.LastIndex()
+		fin := func() {}
+		if lastIdx < tail.BaseIndex {
+			// Nothing in the tail was ever committed so replace it with a new one
+			// at the same BaseIndex.
+			newState.segments = newState.segments.Delete(tail.BaseIndex)
+			newState.tail = nil
+			newState.nextBaseIndex = tail.BaseIndex
+			fin = func() {
+				w.closeSegments([]io.Closer{tail.r})
+				w.deleteSegments(map[uint64]uint64{tail.ID: tail.BaseIndex},
+					AuditRecord{Reason: "failed tail replaced by ClearError"})
+			}
+		} else {
+			// Seal it without writing an index, as TruncateBack does, so reads of
+			// it scan the file instead.
+			tail.SealTime = time.Now()
+			tail.MaxIndex = lastIdx
+			newState.segments = newState.segments.Set(tail.BaseIndex, *tail)
+		}
+		post, err := w.createNextSegment(newState)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fin, post, nil
+	})
+	if err := w.mutateStateLocked(txn); err != nil {
+		return err
+	}
+	w.failErr = nil
+	return nil
+}
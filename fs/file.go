@@ -10,7 +10,11 @@ import (
 	"github.com/dreamsxin/wal/types"
 )
 
-var _ types.WritableFile = &File{}
+var (
+	_ types.WritableFile     = &File{}
+	_ types.PageCacheDropper = &File{}
+	_ types.VectorWriter     = &File{}
+)
 
 // File wraps an os.File and implements types.WritableFile. It ensures that the
 // first time Sync is called on the file, that the parent directory is also
@@ -38,3 +42,15 @@ func (f *File) Sync() error {
 	}
 	return nil
 }
+
+// DropPageCache advises the OS that the file's cached pages can be dropped.
+// It's a no-op on platforms that don't support it.
+func (f *File) DropPageCache() error {
+	return dropPageCache(&f.File)
+}
+
+// WriteVectorAt writes bufs one after another starting at off. It uses a
+// single pwritev where the platform has it.
+func (f *File) WriteVectorAt(bufs [][]byte, off int64) (int, error) {
+	return writeVectorAt(&f.File, bufs, off)
+}
@@ -10,7 +10,6 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/coreos/etcd/pkg/fileutil"
 	"github.com/dreamsxin/wal/types"
 )
 
@@ -29,29 +28,36 @@ func New() *FS {
 // ListDir returns a list of all files in the specified dir in lexicographical
 // order. If the dir doesn't exist, it must return an error. Empty array with
 // nil error is assumed to mean that the directory exists and was readable,
-// but contains no files.
+// but contains no files. On Windows deleted files that couldn't be removed yet
+// are left out, and removed if they can be now.
 func (fs *FS) ListDir(dir string) ([]string, error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
-	names := make([]string, len(files))
-	for i, f := range files {
-		if f.IsDir() {
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || leftoverFile(dir, f.Name()) {
 			continue
 		}
-		names[i] = f.Name()
+		names = append(names, f.Name())
 	}
 	return names, nil
 }
 
+// FreeSpace returns the number of bytes available to unprivileged users on
+// the filesystem dir is on. It's only supported on Linux and macOS.
+func (fs *FS) FreeSpace(dir string) (uint64, error) {
+	return freeSpace(dir)
+}
+
 // Create creates a new file with the given name. If a file with the same name
 // already exists an error is returned. If a non-zero size is given,
 // implementations should make a best effort to pre-allocate the file to be
 // that size. The dir must already exist and be writable to the current
 // process.
 func (fs *FS) Create(dir string, name string, size uint64) (types.WritableFile, error) {
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_RDWR, os.FileMode(0644))
+	f, err := openFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_RDWR, os.FileMode(0644))
 	if err != nil {
 		return nil, err
 	}
@@ -60,8 +66,11 @@ func (fs *FS) Create(dir string, name string, size uint64) (types.WritableFile,
 		if size > math.MaxInt32 {
 			return nil, fmt.Errorf("maximum file size is %d bytes", math.MaxInt32)
 		}
-		if err := fileutil.Preallocate(f, int64(size), true); err != nil {
+		if err := preallocate(f, int64(size)); err != nil {
+			// Don't leave the file behind, so that creating it can be retried
+			// once there's more space.
 			f.Close()
+			os.Remove(f.Name())
 			return nil, err
 		}
 	}
@@ -90,7 +99,7 @@ func (fs *FS) Create(dir string, name string, size uint64) (types.WritableFile,
 // Delete indicates the file is no longer required. Typically it should be
 // deleted from the underlying system to free disk space.
 func (fs *FS) Delete(dir string, name string) error {
-	if err := os.Remove(filepath.Join(dir, name)); err != nil {
+	if err := removeFile(filepath.Join(dir, name)); err != nil {
 		return err
 	}
 	// Make sure parent directory metadata is fsynced too before we call this
@@ -98,12 +107,40 @@ func (fs *FS) Delete(dir string, name string) error {
 	return syncDir(dir)
 }
 
+// Rename atomically replaces the file newName, if there is one, with the file
+// oldName. Both are in dir. The parent dir is fsynced before it returns.
+func (fs *FS) Rename(dir, oldName, newName string) error {
+	if err := os.Rename(filepath.Join(dir, oldName), filepath.Join(dir, newName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// MoveFile implements types.FileMover. newDir is created if need be, and both
+// dirs are fsynced before it returns.
+func (fs *FS) MoveFile(oldDir, oldName, newDir, newName string) error {
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(oldDir, oldName), filepath.Join(newDir, newName)); err != nil {
+		return err
+	}
+	if err := syncDir(newDir); err != nil {
+		return err
+	}
+	return syncDir(oldDir)
+}
+
 // OpenReader opens an existing file in read-only mode. If the file doesn't
 // exist or permission is denied, an error is returned, otherwise no checks
 // are made about the well-formedness of the file, it may be empty, the wrong
 // size or corrupt in arbitrary ways.
 func (fs *FS) OpenReader(dir string, name string) (types.ReadableFile, error) {
-	return os.OpenFile(filepath.Join(dir, name), os.O_RDONLY, os.FileMode(0644))
+	f, err := openFile(filepath.Join(dir, name), os.O_RDONLY, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
 // OpenWriter opens a file in read-write mode. If the file doesn't exist or
@@ -111,18 +148,18 @@ func (fs *FS) OpenReader(dir string, name string) (types.ReadableFile, error) {
 // about the well-formedness of the file, it may be empty, the wrong size or
 // corrupt in arbitrary ways.
 func (fs *FS) OpenWriter(dir string, name string) (types.WritableFile, error) {
-	return os.OpenFile(filepath.Join(dir, name), os.O_RDWR, os.FileMode(0644))
-}
-
-func syncDir(dir string) error {
-	f, err := os.Open(dir)
-	if err != nil {
-		return err
-	}
-	err = f.Sync()
-	closeErr := f.Close()
+	f, err := openFile(filepath.Join(dir, name), os.O_RDWR, os.FileMode(0644))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return closeErr
+	// The file already exists so there's no need to fsync the dir on the first
+	// Sync.
+	return &File{new: 1, dir: dir, File: *f}, nil
+}
+
+// SyncDir fsyncs dir so that files created, renamed or deleted in it are
+// durable. Windows can't sync a dir, and NTFS journals those changes itself,
+// so there it does nothing.
+func SyncDir(dir string) error {
+	return syncDir(dir)
 }
@@ -6,10 +6,13 @@ package fs
 import (
 	"bytes"
 	"io"
+	iofs "io/fs"
 	"os"
 	"path/filepath"
 	"testing"
+	"testing/fstest"
 
+	"github.com/dreamsxin/wal/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -89,6 +92,9 @@ func TestFS(t *testing.T) {
 	require.Equal(t, 1024, n)
 	require.NoError(t, wf.Sync())
 
+	// Dropping synced pages from the page cache doesn't change the contents.
+	require.NoError(t, wf.(types.PageCacheDropper).DropPageCache())
+
 	// And read back prior and new data through the writer. Read across the old
 	// and new data written - first byte is old data rest is new.
 	n, err = wf.ReadAt(buf[:], 2047)
@@ -108,6 +114,15 @@ func TestFS(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []string{"00001-abcd1234.wal"}, files)
 
+	// Rename should replace the target.
+	other, err := fs.Create(tmpDir, "other", 0)
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+	require.NoError(t, fs.Rename(tmpDir, "other", "00001-abcd1234.wal"))
+	files, err = fs.ListDir(tmpDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"00001-abcd1234.wal"}, files)
+
 	// Delete should work
 	require.NoError(t, fs.Delete(tmpDir, "00001-abcd1234.wal"))
 
@@ -116,22 +131,244 @@ func TestFS(t *testing.T) {
 	require.Equal(t, []string{}, files)
 }
 
+func TestFSDeleteWhileOpen(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "raft-wal-fs-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	fs := New()
+	wf, err := fs.Create(tmpDir, "00001-abcd1234.wal", 0)
+	require.NoError(t, err)
+	defer wf.Close()
+	_, err = wf.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+	require.NoError(t, wf.Sync())
+	rf, err := fs.OpenReader(tmpDir, "00001-abcd1234.wal")
+	require.NoError(t, err)
+	defer rf.Close()
+
+	// Open files can be renamed and deleted, and their names reused at once,
+	// while they can still be read.
+	require.NoError(t, fs.Rename(tmpDir, "00001-abcd1234.wal", "00002-abcd1234.wal"))
+	require.NoError(t, fs.Delete(tmpDir, "00002-abcd1234.wal"))
+	buf := make([]byte, 5)
+	_, err = rf.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	wf2, err := fs.Create(tmpDir, "00002-abcd1234.wal", 0)
+	require.NoError(t, err)
+	require.NoError(t, wf2.Close())
+	files, err := fs.ListDir(tmpDir)
+	require.NoError(t, err)
+	var wals []string
+	for _, f := range files {
+		if filepath.Ext(f) == ".wal" {
+			wals = append(wals, f)
+		}
+	}
+	require.Equal(t, []string{"00002-abcd1234.wal"}, wals)
+}
+
+func TestWriteVectorAt(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "raft-wal-fs-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, vfs := range []types.VFS{New(), NewMem()} {
+		wf, err := vfs.Create(tmpDir, "vec.wal", 0)
+		require.NoError(t, err)
+
+		// More buffers than one pwritev takes, some of them empty.
+		var bufs [][]byte
+		var want []byte
+		for i := 0; i < 2500; i++ {
+			b := bytes.Repeat([]byte{byte(i)}, i%7)
+			bufs = append(bufs, b)
+			want = append(want, b...)
+		}
+		n, err := wf.(types.VectorWriter).WriteVectorAt(bufs, 100)
+		require.NoError(t, err)
+		require.Equal(t, len(want), n)
+
+		got := make([]byte, len(want))
+		_, err = wf.ReadAt(got, 100)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+		require.NoError(t, wf.Close())
+		require.NoError(t, vfs.Delete(tmpDir, "vec.wal"))
+	}
+}
+
 func TestRealFSNoDir(t *testing.T) {
 	fs := New()
 
 	_, err := fs.ListDir("/not-a-real-dir")
 	require.Error(t, err)
-	require.Contains(t, err.Error(), "no such file or directory")
+	require.ErrorIs(t, err, os.ErrNotExist)
 
 	_, err = fs.Create("/not-a-real-dir", "foo", 1024)
 	require.Error(t, err)
-	require.Contains(t, err.Error(), "no such file or directory")
+	require.ErrorIs(t, err, os.ErrNotExist)
 
 	_, err = fs.OpenReader("/not-a-real-dir", "foo")
 	require.Error(t, err)
-	require.Contains(t, err.Error(), "no such file or directory")
+	require.ErrorIs(t, err, os.ErrNotExist)
 
 	_, err = fs.OpenWriter("/not-a-real-dir", "foo")
 	require.Error(t, err)
-	require.Contains(t, err.Error(), "no such file or directory")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMemFS(t *testing.T) {
+	fs := NewMem()
+
+	files, err := fs.ListDir("dir")
+	require.NoError(t, err)
+	require.Len(t, files, 0)
+
+	wf, err := fs.Create("dir", "00001-abcd1234.wal", 4096)
+	require.NoError(t, err)
+	_, err = fs.Create("dir", "00001-abcd1234.wal", 4096)
+	require.ErrorIs(t, err, os.ErrExist)
+
+	// Preallocated bytes read as zero until written.
+	n, err := wf.WriteAt(bytes.Repeat([]byte{'1'}, 1024), 1024)
+	require.NoError(t, err)
+	require.Equal(t, 1024, n)
+	var buf [1024]byte
+	buf[0] = 'x'
+	n, err = wf.ReadAt(buf[:], 0)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, byte(0), buf[0])
+
+	// Writes past the preallocated end extend the file.
+	_, err = wf.WriteAt(bytes.Repeat([]byte{'2'}, 1024), 4096)
+	require.NoError(t, err)
+	require.NoError(t, wf.Sync())
+
+	// But not past what a slice can hold, rather than overflowing.
+	_, err = wf.WriteAt(buf[:], 1<<62)
+	require.Error(t, err)
+
+	rf, err := fs.OpenReader("dir", "00001-abcd1234.wal")
+	require.NoError(t, err)
+	n, err = rf.ReadAt(buf[:], 4096)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, byte('2'), buf[0])
+	n, err = rf.ReadAt(buf[:], 4608)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 512, n)
+	_, err = rf.(types.WritableFile).WriteAt(buf[:], 0)
+	require.ErrorIs(t, err, os.ErrPermission)
+
+	// Rename replaces the target but open handles still see the old file.
+	_, err = fs.Create("dir", "b", 0)
+	require.NoError(t, err)
+	require.NoError(t, fs.Rename("dir", "00001-abcd1234.wal", "b"))
+	files, err = fs.ListDir("dir")
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, files)
+	wf, err = fs.OpenWriter("dir", "b")
+	require.NoError(t, err)
+	n, err = wf.ReadAt(buf[:], 1024)
+	require.NoError(t, err)
+	require.Equal(t, byte('1'), buf[0])
+
+	require.NoError(t, fs.Delete("dir", "b"))
+	require.ErrorIs(t, fs.Delete("dir", "b"), os.ErrNotExist)
+	_, err = fs.OpenReader("dir", "b")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	n, err = rf.ReadAt(buf[:], 4096)
+	require.NoError(t, err)
+	require.Equal(t, byte('2'), buf[0])
+}
+
+// noReaderAtFS hides the ReadAt method of the files it opens, like a zip.
+type noReaderAtFS struct{ iofs.FS }
+
+func (fsys noReaderAtFS) Open(name string) (iofs.File, error) {
+	f, err := fsys.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return f, nil
+	}
+	return struct{ iofs.File }{f}, nil
+}
+
+func TestMoveFile(t *testing.T) {
+	for name, vfs := range map[string]types.VFS{"FS": New(), "MemFS": NewMem()} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			wf, err := vfs.Create(dir, "a.wal", 0)
+			require.NoError(t, err)
+			_, err = wf.WriteAt([]byte("data"), 0)
+			require.NoError(t, err)
+			require.NoError(t, wf.Close())
+
+			// The new dir is created.
+			newDir := filepath.Join(dir, "trash")
+			mover := vfs.(types.FileMover)
+			require.NoError(t, mover.MoveFile(dir, "a.wal", newDir, "1-a.wal"))
+			names, err := vfs.ListDir(newDir)
+			require.NoError(t, err)
+			require.Equal(t, []string{"1-a.wal"}, names)
+			rf, err := vfs.OpenReader(newDir, "1-a.wal")
+			require.NoError(t, err)
+			buf := make([]byte, 4)
+			_, err = rf.ReadAt(buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, "data", string(buf))
+			require.NoError(t, rf.Close())
+
+			_, err = vfs.OpenReader(dir, "a.wal")
+			require.ErrorIs(t, err, os.ErrNotExist)
+			require.ErrorIs(t, mover.MoveFile(dir, "a.wal", newDir, "2-a.wal"), os.ErrNotExist)
+		})
+	}
+}
+
+func TestReadOnlyFS(t *testing.T) {
+	mapFS := fstest.MapFS{
+		"wal/a":     &fstest.MapFile{Data: []byte("hello")},
+		"wal/b":     &fstest.MapFile{Data: []byte("world")},
+		"wal/dir/c": &fstest.MapFile{Data: []byte("nested")},
+	}
+	for name, fsys := range map[string]iofs.FS{"ReaderAt": mapFS, "no ReaderAt": noReaderAtFS{mapFS}} {
+		t.Run(name, func(t *testing.T) {
+			fs := NewReadOnly(fsys)
+
+			files, err := fs.ListDir("wal")
+			require.NoError(t, err)
+			require.Equal(t, []string{"a", "b"}, files)
+
+			rf, err := fs.OpenReader("wal", "b")
+			require.NoError(t, err)
+			var buf [3]byte
+			n, err := rf.ReadAt(buf[:], 2)
+			require.NoError(t, err)
+			require.Equal(t, "rld", string(buf[:n]))
+			_, err = rf.ReadAt(buf[:], 4)
+			require.ErrorIs(t, err, io.EOF)
+			require.NoError(t, rf.Close())
+
+			wf, err := fs.OpenWriter("wal", "a")
+			require.NoError(t, err)
+			_, err = wf.WriteAt([]byte("x"), 0)
+			require.ErrorIs(t, err, types.ErrReadOnly)
+			require.ErrorIs(t, wf.Sync(), types.ErrReadOnly)
+			require.NoError(t, wf.Close())
+
+			_, err = fs.OpenReader("wal", "missing")
+			require.ErrorIs(t, err, os.ErrNotExist)
+			_, err = fs.Create("wal", "new", 0)
+			require.ErrorIs(t, err, types.ErrReadOnly)
+			require.ErrorIs(t, fs.Delete("wal", "a"), types.ErrReadOnly)
+			require.ErrorIs(t, fs.Rename("wal", "a", "b"), types.ErrReadOnly)
+		})
+	}
 }
@@ -0,0 +1,11 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import "errors"
+
+// ErrIOUringUnsupported is returned by NewIOUring if the binary wasn't built
+// for Linux with the iouring build tag, or the kernel won't create an
+// io_uring.
+var ErrIOUringUnsupported = errors.New("io_uring is not supported")
@@ -0,0 +1,478 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux && iouring
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/dreamsxin/wal/types"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	_ types.VFS          = &IOUringFS{}
+	_ types.WritableFile = &iouringFile{}
+	_ types.VectorWriter = &iouringFile{}
+)
+
+// IOUringFS is an experimental VFS that does the same as FS except that
+// reads, writes and syncs of files go through io_uring rather than a syscall
+// each. Every IOUringFS in the process shares one ring, so that the
+// operations of several WALs on the same host that are in flight at once are
+// submitted to the kernel and reaped together.
+//
+// It's only built on Linux with the iouring build tag.
+type IOUringFS struct {
+	FS
+	ring *iouring
+}
+
+var sharedRing struct {
+	once sync.Once
+	ring *iouring
+	err  error
+}
+
+// NewIOUring returns an IOUringFS, setting up the shared ring the first time
+// it's called. It returns an error wrapping ErrIOUringUnsupported if the
+// kernel won't create one.
+func NewIOUring() (types.VFS, error) {
+	sharedRing.once.Do(func() {
+		sharedRing.ring, sharedRing.err = newIOURing(iouringEntries)
+	})
+	if sharedRing.err != nil {
+		return nil, sharedRing.err
+	}
+	return &IOUringFS{ring: sharedRing.ring}, nil
+}
+
+// Create implements types.VFS.
+func (fs *IOUringFS) Create(dir string, name string, size uint64) (types.WritableFile, error) {
+	wf, err := fs.FS.Create(dir, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return &iouringFile{File: wf.(*File), ring: fs.ring}, nil
+}
+
+// OpenReader implements types.VFS.
+func (fs *IOUringFS) OpenReader(dir string, name string) (types.ReadableFile, error) {
+	rf, err := fs.FS.OpenReader(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &iouringReader{File: rf.(*os.File), ring: fs.ring}, nil
+}
+
+// OpenWriter implements types.VFS.
+func (fs *IOUringFS) OpenWriter(dir string, name string) (types.WritableFile, error) {
+	wf, err := fs.FS.OpenWriter(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &iouringFile{File: wf.(*File), ring: fs.ring}, nil
+}
+
+// iouringFile is a File whose reads, writes and syncs go through the ring.
+type iouringFile struct {
+	*File
+	ring *iouring
+}
+
+func (f *iouringFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.ring.readAt(&f.File.File, p, off)
+}
+
+func (f *iouringFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.ring.writeAt(&f.File.File, [][]byte{p}, off)
+}
+
+// WriteVectorAt implements types.VectorWriter.
+func (f *iouringFile) WriteVectorAt(bufs [][]byte, off int64) (int, error) {
+	return f.ring.writeAt(&f.File.File, bufs, off)
+}
+
+// Sync fsyncs the file and, the first time it's called since the file was
+// created, its parent dir, as File.Sync does.
+func (f *iouringFile) Sync() error {
+	if err := f.ring.fsync(&f.File.File); err != nil {
+		return err
+	}
+	if atomic.SwapUint32(&f.new, 1) == 0 {
+		return syncDir(f.dir)
+	}
+	return nil
+}
+
+// iouringReader is a read-only file whose reads go through the ring.
+type iouringReader struct {
+	*os.File
+	ring *iouring
+}
+
+func (f *iouringReader) ReadAt(p []byte, off int64) (int, error) {
+	return f.ring.readAt(f.File, p, off)
+}
+
+const (
+	// iouringEntries is the size of the submission queue. The completion
+	// queue is twice as big.
+	iouringEntries = 256
+
+	iouringOpReadv  = 1
+	iouringOpWritev = 2
+	iouringOpFsync  = 3
+
+	iouringEnterGetEvents = 1 << 0
+
+	iouringOffSQRing = 0
+	iouringOffCQRing = 0x8000000
+	iouringOffSQEs   = 0x10000000
+)
+
+// These mirror the kernel's struct io_uring_sqe, io_uring_cqe and
+// io_uring_params.
+type (
+	iouringSQE struct {
+		opcode      uint8
+		flags       uint8
+		ioprio      uint16
+		fd          int32
+		off         uint64
+		addr        uint64
+		len         uint32
+		opFlags     uint32
+		userData    uint64
+		bufIndex    uint16
+		personality uint16
+		spliceFdIn  int32
+		_           [2]uint64
+	}
+
+	iouringCQE struct {
+		userData uint64
+		res      int32
+		flags    uint32
+	}
+
+	iouringParams struct {
+		sqEntries    uint32
+		cqEntries    uint32
+		flags        uint32
+		sqThreadCPU  uint32
+		sqThreadIdle uint32
+		features     uint32
+		wqFd         uint32
+		resv         [3]uint32
+		sqOff        struct {
+			head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+			userAddr                                                        uint64
+		}
+		cqOff struct {
+			head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+			userAddr                                                        uint64
+		}
+	}
+)
+
+// iouring is an io_uring shared by any number of goroutines. Each queues its
+// operation and then either waits in the kernel for completions, if nobody
+// else is, or waits to be woken by whoever is. Whoever waits in the kernel
+// submits everything queued by then along with its own operation, and hands
+// out every completion it reaps.
+type iouring struct {
+	fd                     int
+	sqRing, cqRing, sqeMem []byte
+
+	sqTail, sqMask *uint32
+	sqArray        []uint32
+	sqes           []iouringSQE
+	cqHead, cqTail *uint32
+	cqMask         *uint32
+	cqes           []iouringCQE
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// ops are the operations queued or in flight by user data. There are
+	// never more than the submission queue holds so the completion queue
+	// can't overflow.
+	ops    map[uint64]*iouringOp
+	nextID uint64
+	// pending is the number of operations queued but not yet submitted.
+	pending uint32
+	// polling is set while a goroutine is waiting in the kernel.
+	polling bool
+	// err is set if the ring can't be used any more.
+	err error
+}
+
+// iouringOp is an operation queued on the ring. iov keeps the buffers it reads
+// or writes reachable until it's done, since the kernel only has their
+// addresses.
+type iouringOp struct {
+	iov  []unix.Iovec
+	res  int32
+	done bool
+}
+
+func newIOURing(entries uint32) (*iouring, error) {
+	var p iouringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("%w: io_uring_setup: %w", ErrIOUringUnsupported, errno)
+	}
+	r := &iouring{fd: int(fd), ops: make(map[uint64]*iouringOp)}
+	r.cond = sync.NewCond(&r.mu)
+
+	var err error
+	mmap := func(offset int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+		var b []byte
+		b, err = unix.Mmap(r.fd, offset, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		return b
+	}
+	r.sqRing = mmap(iouringOffSQRing, p.sqOff.array+p.sqEntries*4)
+	r.cqRing = mmap(iouringOffCQRing, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(iouringCQE{})))
+	r.sqeMem = mmap(iouringOffSQEs, p.sqEntries*uint32(unsafe.Sizeof(iouringSQE{})))
+	if err != nil {
+		r.close()
+		return nil, fmt.Errorf("failed to map io_uring: %w", err)
+	}
+
+	u32 := func(b []byte, off uint32) *uint32 {
+		return (*uint32)(unsafe.Pointer(&b[off]))
+	}
+	r.sqTail = u32(r.sqRing, p.sqOff.tail)
+	r.sqMask = u32(r.sqRing, p.sqOff.ringMask)
+	r.sqArray = unsafe.Slice(u32(r.sqRing, p.sqOff.array), p.sqEntries)
+	r.sqes = unsafe.Slice((*iouringSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = u32(r.cqRing, p.cqOff.head)
+	r.cqTail = u32(r.cqRing, p.cqOff.tail)
+	r.cqMask = u32(r.cqRing, p.cqOff.ringMask)
+	r.cqes = unsafe.Slice((*iouringCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return r, nil
+}
+
+// close unmaps and closes the ring. The shared ring lives as long as the
+// process so it's only used if setting it up fails.
+func (r *iouring) close() {
+	for _, b := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+	unix.Close(r.fd)
+}
+
+// readAt reads len(p) bytes from f at off, returning io.EOF if it reaches the
+// end of the file first, as io.ReaderAt does.
+func (r *iouring) readAt(f *os.File, p []byte, off int64) (int, error) {
+	total := 0
+	for total < len(p) {
+		res, err := r.doFile(f, iouringOpReadv, [][]byte{p[total:]}, off+int64(total))
+		if err != nil {
+			return total, err
+		}
+		if res < 0 {
+			return total, &os.PathError{Op: "read", Path: f.Name(), Err: unix.Errno(-res)}
+		}
+		if res == 0 {
+			return total, io.EOF
+		}
+		total += int(res)
+	}
+	return total, nil
+}
+
+// writeAt writes bufs one after another to f starting at off.
+func (r *iouring) writeAt(f *os.File, bufs [][]byte, off int64) (int, error) {
+	total := 0
+	for bufs = skipWritten(bufs, 0); len(bufs) > 0; {
+		iovs := bufs
+		if len(iovs) > maxIOVecs {
+			iovs = iovs[:maxIOVecs]
+		}
+		res, err := r.doFile(f, iouringOpWritev, iovs, off)
+		if err != nil {
+			return total, err
+		}
+		if res < 0 {
+			return total, &os.PathError{Op: "write", Path: f.Name(), Err: unix.Errno(-res)}
+		}
+		if res == 0 {
+			return total, &os.PathError{Op: "write", Path: f.Name(), Err: unix.EIO}
+		}
+		total += int(res)
+		off += int64(res)
+		bufs = skipWritten(bufs, int(res))
+	}
+	return total, nil
+}
+
+// fsync syncs f.
+func (r *iouring) fsync(f *os.File) error {
+	res, err := r.doFile(f, iouringOpFsync, nil, 0)
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return &os.PathError{Op: "sync", Path: f.Name(), Err: unix.Errno(-res)}
+	}
+	return nil
+}
+
+// doFile runs an operation on f with bufs as its iovecs and returns its
+// result. Interrupted operations are retried. f's descriptor is held open
+// until the operation is done so that it can't be reused by another file.
+func (r *iouring) doFile(f *os.File, opcode uint8, bufs [][]byte, off int64) (int32, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	op := &iouringOp{iov: make([]unix.Iovec, 0, len(bufs))}
+	for _, b := range bufs {
+		if len(b) > 0 {
+			iov := unix.Iovec{Base: &b[0]}
+			iov.SetLen(len(b))
+			op.iov = append(op.iov, iov)
+		}
+	}
+	var res int32
+	cerr := rc.Control(func(fd uintptr) {
+		for {
+			res, err = r.do(op, func(sqe *iouringSQE) {
+				sqe.opcode = opcode
+				sqe.fd = int32(fd)
+				sqe.off = uint64(off)
+				if len(op.iov) > 0 {
+					sqe.addr = uint64(uintptr(unsafe.Pointer(&op.iov[0])))
+					sqe.len = uint32(len(op.iov))
+				}
+			})
+			if err != nil || (res != -int32(unix.EINTR) && res != -int32(unix.EAGAIN)) {
+				return
+			}
+			op.done = false
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return res, err
+}
+
+// do queues op, which fill describes, and waits until it's done.
+func (r *iouring) do(op *iouringOp, fill func(sqe *iouringSQE)) (int32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.err == nil && len(r.ops) >= len(r.sqes) {
+		// Whoever owns the ops in flight will reap them and wake us.
+		r.cond.Wait()
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	r.nextID++
+	id := r.nextID
+	tail := *r.sqTail
+	idx := tail & *r.sqMask
+	sqe := &r.sqes[idx]
+	*sqe = iouringSQE{}
+	fill(sqe)
+	sqe.userData = id
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.ops[id] = op
+	r.pending++
+
+	for !op.done {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.polling {
+			// Submit now rather than waiting for what the poller is waiting
+			// for, then wait for the poller to reap it.
+			if r.pending > 0 {
+				n, err := r.enterLocked(0)
+				if err != nil {
+					r.fail(err)
+					continue
+				}
+				if n > 0 {
+					continue
+				}
+			}
+			r.cond.Wait()
+			continue
+		}
+		r.polling = true
+		_, err := r.enterLocked(1)
+		r.polling = false
+		r.reapLocked()
+		r.cond.Broadcast()
+		if err != nil {
+			r.fail(err)
+		}
+	}
+	return op.res, nil
+}
+
+// enterLocked submits everything queued and, if minComplete is set, waits
+// for that many completions. It returns the number submitted. r.mu is
+// released while it's in the kernel.
+func (r *iouring) enterLocked(minComplete uint32) (uint32, error) {
+	var flags uintptr
+	if minComplete > 0 {
+		flags = iouringEnterGetEvents
+	}
+	toSubmit := r.pending
+	r.mu.Unlock()
+	n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), flags, 0, 0)
+	r.mu.Lock()
+	switch errno {
+	case 0:
+	case unix.EINTR, unix.EAGAIN, unix.EBUSY:
+		return 0, nil
+	default:
+		return 0, os.NewSyscallError("io_uring_enter", errno)
+	}
+	// Others may have submitted some of what was pending in the meantime, but
+	// the kernel never submits more than has been queued.
+	r.pending -= uint32(n)
+	return uint32(n), nil
+}
+
+// reapLocked hands out every completion in the completion queue.
+func (r *iouring) reapLocked() {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqe := r.cqes[head&*r.cqMask]
+		if op, ok := r.ops[cqe.userData]; ok {
+			op.res = cqe.res
+			op.done = true
+			delete(r.ops, cqe.userData)
+		}
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+// fail stops the ring being used after io_uring_enter fails in a way that
+// can't be retried. Every operation queued or in flight fails with err.
+func (r *iouring) fail(err error) {
+	if r.err == nil {
+		r.err = fmt.Errorf("io_uring failed: %w", err)
+	}
+	r.cond.Broadcast()
+}
@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux && iouring
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOUringFS(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "raft-wal-iouring-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	vfs, err := NewIOUring()
+	require.NoError(t, err)
+
+	wf, err := vfs.Create(tmpDir, "00001-abcd1234.wal", 64*1024)
+	require.NoError(t, err)
+	defer wf.Close()
+
+	n, err := wf.WriteAt(bytes.Repeat([]byte{'1'}, 1024), 0)
+	require.NoError(t, err)
+	require.Equal(t, 1024, n)
+
+	// More buffers than one writev takes, some of them empty.
+	var bufs [][]byte
+	var want []byte
+	for i := 0; i < 2500; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, i%7)
+		bufs = append(bufs, b)
+		want = append(want, b...)
+	}
+	n, err = wf.(types.VectorWriter).WriteVectorAt(bufs, 1024)
+	require.NoError(t, err)
+	require.Equal(t, len(want), n)
+	require.NoError(t, wf.Sync())
+
+	got := make([]byte, len(want))
+	n, err = wf.ReadAt(got, 1024)
+	require.NoError(t, err)
+	require.Equal(t, len(want), n)
+	require.Equal(t, want, got)
+
+	rf, err := vfs.OpenReader(tmpDir, "00001-abcd1234.wal")
+	require.NoError(t, err)
+	defer rf.Close()
+	n, err = rf.ReadAt(got[:1024], 0)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{'1'}, 1024), got[:n])
+
+	// Reading past the end returns what there is and io.EOF.
+	buf := make([]byte, 100)
+	n, err = rf.ReadAt(buf, 64*1024-10)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 10, n)
+
+	// Closed files fail rather than using whatever has their descriptor now.
+	require.NoError(t, rf.Close())
+	_, err = rf.ReadAt(buf, 0)
+	require.Error(t, err)
+}
+
+func TestIOUringConcurrent(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "raft-wal-iouring-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	vfs, err := NewIOUring()
+	require.NoError(t, err)
+
+	// Many more writers than the ring has room for, several to each file.
+	const files, writers, writes = 8, 64, 50
+	var wfs []types.WritableFile
+	for i := 0; i < files; i++ {
+		wf, err := vfs.Create(tmpDir, fmt.Sprintf("%05d.wal", i), 0)
+		require.NoError(t, err)
+		defer wf.Close()
+		wfs = append(wfs, wf)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			wf := wfs[w%files]
+			for i := 0; i < writes; i++ {
+				val := []byte(fmt.Sprintf("%04d:%04d;", w, i))
+				off := int64((w/files*writes + i) * len(val))
+				if _, err := wf.WriteAt(val, off); err != nil {
+					errs <- err
+					return
+				}
+				if i%10 == 0 {
+					if err := wf.Sync(); err != nil {
+						errs <- err
+						return
+					}
+				}
+				got := make([]byte, len(val))
+				if _, err := wf.ReadAt(got, off); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(val, got) {
+					errs <- fmt.Errorf("read %q, wrote %q", got, val)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
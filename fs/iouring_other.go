@@ -0,0 +1,14 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux || !iouring
+
+package fs
+
+import "github.com/dreamsxin/wal/types"
+
+// NewIOUring returns ErrIOUringUnsupported. The io_uring backend is only built
+// on Linux with the iouring build tag.
+func NewIOUring() (types.VFS, error) {
+	return nil, ErrIOUringUnsupported
+}
@@ -0,0 +1,17 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux || !iouring
+
+package fs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOUringUnsupported(t *testing.T) {
+	_, err := NewIOUring()
+	require.ErrorIs(t, err, ErrIOUringUnsupported)
+}
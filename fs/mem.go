@@ -0,0 +1,238 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+var (
+	_ types.VFS          = &MemFS{}
+	_ types.WritableFile = &memHandle{}
+	_ types.VectorWriter = &memHandle{}
+)
+
+// MemFS implements the wal.VFS interface entirely in memory. It's intended for
+// tests that want to run quickly and deterministically without touching the
+// disk. Every dir is treated as existing, and is empty until files are created
+// in it. Nothing is lost when a process "crashes" since Sync is a no-op; use
+// a MemFS for speed, not for testing durability.
+//
+// As with a real file system, a file that's deleted or replaced by Rename
+// stays readable and writable through any handles already open on it.
+type MemFS struct {
+	mu   sync.Mutex
+	dirs map[string]map[string]*memFile
+}
+
+// NewMem returns an empty MemFS.
+func NewMem() *MemFS {
+	return &MemFS{dirs: make(map[string]map[string]*memFile)}
+}
+
+// memFile is the contents of one file in a MemFS.
+type memFile struct {
+	mu   sync.RWMutex
+	data []byte
+	// size is the length of the file, which may be more than len(data) if it
+	// was preallocated. Bytes past len(data) read as zero.
+	size int64
+}
+
+// ListDir returns a list of all files in the specified dir in lexicographical
+// order.
+func (fs *MemFS) ListDir(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	names := make([]string, 0, len(fs.dirs[dir]))
+	for name := range fs.dirs[dir] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Create creates a new file with the given name. If a file with the same name
+// already exists an error is returned. The file reports size as its length
+// straight away but memory is only used as it's written.
+func (fs *MemFS) Create(dir string, name string, size uint64) (types.WritableFile, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	files := fs.dirs[dir]
+	if files == nil {
+		files = make(map[string]*memFile)
+		fs.dirs[dir] = files
+	}
+	if _, ok := files[name]; ok {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	f := &memFile{size: int64(size)}
+	files[name] = f
+	return &memHandle{f: f}, nil
+}
+
+// Delete removes the file from dir.
+func (fs *MemFS) Delete(dir string, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.dirs[dir][name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.dirs[dir], name)
+	return nil
+}
+
+// Rename atomically replaces the file newName, if there is one, with the file
+// oldName. Both are in dir.
+func (fs *MemFS) Rename(dir, oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.dirs[dir][oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	delete(fs.dirs[dir], oldName)
+	fs.dirs[dir][newName] = f
+	return nil
+}
+
+// MoveFile implements types.FileMover.
+func (fs *MemFS) MoveFile(oldDir, oldName, newDir, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.dirs[oldDir][oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	files := fs.dirs[newDir]
+	if files == nil {
+		files = make(map[string]*memFile)
+		fs.dirs[newDir] = files
+	}
+	delete(fs.dirs[oldDir], oldName)
+	files[newName] = f
+	return nil
+}
+
+// OpenReader opens an existing file in read-only mode.
+func (fs *MemFS) OpenReader(dir string, name string) (types.ReadableFile, error) {
+	return fs.open(dir, name, true)
+}
+
+// OpenWriter opens an existing file in read-write mode.
+func (fs *MemFS) OpenWriter(dir string, name string) (types.WritableFile, error) {
+	return fs.open(dir, name, false)
+}
+
+func (fs *MemFS) open(dir, name string, readOnly bool) (*memHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.dirs[dir][name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memHandle{f: f, readOnly: readOnly}, nil
+}
+
+// memHandle is an open memFile.
+type memHandle struct {
+	f        *memFile
+	readOnly bool
+}
+
+// ReadAt implements io.ReaderAt.
+func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	h.f.mu.RLock()
+	defer h.f.mu.RUnlock()
+
+	if off >= h.f.size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	var err error
+	if rem := h.f.size - off; int64(n) > rem {
+		n, err = int(rem), io.EOF
+	}
+	copied := 0
+	if off < int64(len(h.f.data)) {
+		copied = copy(p[:n], h.f.data[off:])
+	}
+	for i := copied; i < n; i++ {
+		p[i] = 0
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt, extending the file if needed.
+func (h *memHandle) WriteAt(p []byte, off int64) (int, error) {
+	if h.readOnly {
+		return 0, os.ErrPermission
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	end := off + int64(len(p))
+	if end > math.MaxInt/2 {
+		// The data is held in a single slice so it can't grow past what an int
+		// can index, which is only 2GiB on 32-bit platforms.
+		return 0, fmt.Errorf("offset %d is too large for an in-memory file", off)
+	}
+	if end > int64(len(h.f.data)) {
+		if end > int64(cap(h.f.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, h.f.data)
+			h.f.data = data
+		} else {
+			h.f.data = h.f.data[:end]
+		}
+	}
+	copy(h.f.data[off:], p)
+	if end > h.f.size {
+		h.f.size = end
+	}
+	return len(p), nil
+}
+
+// WriteVectorAt implements types.VectorWriter.
+func (h *memHandle) WriteVectorAt(bufs [][]byte, off int64) (int, error) {
+	total := 0
+	for _, b := range bufs {
+		n, err := h.WriteAt(b, off)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		off += int64(n)
+	}
+	return total, nil
+}
+
+// Sync is a no-op since there's nowhere more durable to put the data.
+func (h *memHandle) Sync() error {
+	return nil
+}
+
+// Close implements io.Closer. The handle mustn't be used after it's closed.
+func (h *memHandle) Close() error {
+	return nil
+}
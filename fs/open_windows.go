@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// openFile opens name as os.OpenFile does except that it's shared for delete
+// as well as read and write, so that segments can be deleted or renamed while
+// readers still have them open, as on other platforms. It only handles the
+// flags FS uses.
+func openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	var access uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		access = windows.GENERIC_READ
+	case os.O_WRONLY:
+		access = windows.GENERIC_WRITE
+	case os.O_RDWR:
+		access = windows.GENERIC_READ | windows.GENERIC_WRITE
+	}
+	var mode uint32
+	switch {
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		mode = windows.CREATE_NEW
+	case flag&os.O_CREATE != 0:
+		mode = windows.OPEN_ALWAYS
+	default:
+		mode = windows.OPEN_EXISTING
+	}
+	share := uint32(windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE | windows.FILE_SHARE_DELETE)
+	h, err := windows.CreateFile(path, access, share, nil, mode, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(h), name), nil
+}
+
+const deletedSuffix = ".deleted"
+
+var (
+	deletedFiles uint64
+
+	// removeRenamed deletes a file removeFile renamed. Tests replace it.
+	removeRenamed = os.Remove
+)
+
+// removeFile deletes name. A file that's still open keeps its name until the
+// last handle to it is closed, so it's renamed out of the way first to leave
+// the name free at once. The new name doesn't end with a segment file's
+// extension so it's never mistaken for one.
+//
+// Once it's renamed the name is free, which is all that callers rely on, so a
+// file that can't be deleted yet, say because another process opened it
+// without sharing it for delete, doesn't fail the delete. It's left for
+// ListDir to sweep up.
+func removeFile(name string) error {
+	deleted := fmt.Sprintf("%s.%d-%d%s", name, time.Now().UnixNano(), atomic.AddUint64(&deletedFiles, 1), deletedSuffix)
+	if err := os.Rename(name, deleted); err != nil {
+		return err
+	}
+	removeRenamed(deleted)
+	return nil
+}
+
+// leftoverFile reports whether name in dir is a file removeFile renamed but
+// couldn't delete, and tries again to delete it.
+func leftoverFile(dir, name string) bool {
+	if !strings.HasSuffix(name, deletedSuffix) {
+		return false
+	}
+	removeRenamed(filepath.Join(dir, name))
+	return true
+}
+
+// syncDir does nothing since Windows can't sync a dir. NTFS journals changes
+// to dirs itself.
+func syncDir(dir string) error {
+	return nil
+}
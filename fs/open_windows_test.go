@@ -0,0 +1,51 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+
+package fs
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteLeavesUndeletableFile(t *testing.T) {
+	dir := t.TempDir()
+	fs := New()
+
+	wf, err := fs.Create(dir, "00001-abcd1234.wal", 1024)
+	require.NoError(t, err)
+	require.NoError(t, wf.Close())
+
+	// Once the file is renamed the name is free, so failing to delete it
+	// doesn't fail the Delete.
+	removeRenamed = func(string) error { return os.ErrPermission }
+	defer func() { removeRenamed = os.Remove }()
+	require.NoError(t, fs.Delete(dir, "00001-abcd1234.wal"))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, strings.HasSuffix(entries[0].Name(), deletedSuffix))
+
+	// The name can be used again and the leftover is never listed.
+	wf, err = fs.Create(dir, "00001-abcd1234.wal", 1024)
+	require.NoError(t, err)
+	require.NoError(t, wf.Close())
+	names, err := fs.ListDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"00001-abcd1234.wal"}, names)
+
+	// Listing once it can be deleted sweeps it up.
+	removeRenamed = os.Remove
+	names, err = fs.ListDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"00001-abcd1234.wal"}, names)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
@@ -0,0 +1,12 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux
+
+package fs
+
+import "os"
+
+func dropPageCache(f *os.File) error {
+	return nil
+}
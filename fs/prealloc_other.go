@@ -0,0 +1,16 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !wasm
+
+package fs
+
+import (
+	"os"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+func preallocate(f *os.File, size int64) error {
+	return fileutil.Preallocate(f, size, true)
+}
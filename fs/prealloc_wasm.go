@@ -0,0 +1,12 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import "os"
+
+// preallocate can only extend the file since there's no fallocate. It reads
+// as zeros either way.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import (
+	"bytes"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+var _ types.VFS = &ReadOnlyFS{}
+
+// ReadOnlyFS implements the wal.VFS interface on top of an io/fs.FS such as an
+// embed.FS, a zip.Reader or os.DirFS, for reading a WAL that mustn't or can't
+// be changed. Dirs are slash-separated paths within the FS as io/fs expects,
+// with "." for its root. Every method that would change a file fails with an
+// error wrapping types.ErrReadOnly, though OpenWriter does open existing files
+// so that the tail segment can be read; it's their WriteAt and Sync that fail.
+//
+// Files that implement io.ReaderAt are read in place. Others, such as those in
+// a zip, are read into memory when they are opened.
+type ReadOnlyFS struct {
+	fsys iofs.FS
+}
+
+// NewReadOnly returns a ReadOnlyFS that reads from fsys.
+func NewReadOnly(fsys iofs.FS) *ReadOnlyFS {
+	return &ReadOnlyFS{fsys: fsys}
+}
+
+// ListDir returns a list of all files in the specified dir in lexicographical
+// order.
+func (fs *ReadOnlyFS) ListDir(dir string) ([]string, error) {
+	entries, err := iofs.ReadDir(fs.fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// Create fails with an error wrapping types.ErrReadOnly.
+func (fs *ReadOnlyFS) Create(dir string, name string, size uint64) (types.WritableFile, error) {
+	return nil, &os.PathError{Op: "create", Path: path.Join(dir, name), Err: types.ErrReadOnly}
+}
+
+// Delete fails with an error wrapping types.ErrReadOnly.
+func (fs *ReadOnlyFS) Delete(dir string, name string) error {
+	return &os.PathError{Op: "remove", Path: path.Join(dir, name), Err: types.ErrReadOnly}
+}
+
+// Rename fails with an error wrapping types.ErrReadOnly.
+func (fs *ReadOnlyFS) Rename(dir, oldName, newName string) error {
+	return &os.LinkError{Op: "rename", Old: path.Join(dir, oldName), New: path.Join(dir, newName), Err: types.ErrReadOnly}
+}
+
+// OpenReader opens an existing file for reading.
+func (fs *ReadOnlyFS) OpenReader(dir string, name string) (types.ReadableFile, error) {
+	return fs.open(dir, name)
+}
+
+// OpenWriter opens an existing file for reading. Writes to it fail with an
+// error wrapping types.ErrReadOnly.
+func (fs *ReadOnlyFS) OpenWriter(dir string, name string) (types.WritableFile, error) {
+	return fs.open(dir, name)
+}
+
+func (fs *ReadOnlyFS) open(dir, name string) (*readOnlyFile, error) {
+	f, err := fs.fsys.Open(path.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	if ra, ok := f.(io.ReaderAt); ok {
+		return &readOnlyFile{ReaderAt: ra, Closer: f, name: name}, nil
+	}
+	buf, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{ReaderAt: bytes.NewReader(buf), Closer: io.NopCloser(nil), name: name}, nil
+}
+
+// readOnlyFile is a file opened by a ReadOnlyFS.
+type readOnlyFile struct {
+	io.ReaderAt
+	io.Closer
+	name string
+}
+
+// WriteAt fails with an error wrapping types.ErrReadOnly.
+func (f *readOnlyFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: types.ErrReadOnly}
+}
+
+// Sync fails with an error wrapping types.ErrReadOnly.
+func (f *readOnlyFile) Sync() error {
+	return &os.PathError{Op: "sync", Path: f.name, Err: types.ErrReadOnly}
+}
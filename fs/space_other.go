@@ -0,0 +1,15 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux && !darwin
+
+package fs
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, fmt.Errorf("free space of %s can't be found on %s", dir, runtime.GOOS)
+}
@@ -0,0 +1,57 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package fs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxIOVecs is the most buffers Linux takes in one pwritev (IOV_MAX).
+const maxIOVecs = 1024
+
+func writeVectorAt(f *os.File, bufs [][]byte, off int64) (int, error) {
+	fd := int(f.Fd())
+	total := 0
+	for bufs = skipWritten(bufs, 0); len(bufs) > 0; {
+		iovs := bufs
+		if len(iovs) > maxIOVecs {
+			iovs = iovs[:maxIOVecs]
+		}
+		n, err := unix.Pwritev(fd, iovs, off)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return total, &os.PathError{Op: "pwritev", Path: f.Name(), Err: err}
+		}
+		if n == 0 {
+			return total, &os.PathError{Op: "pwritev", Path: f.Name(), Err: unix.EIO}
+		}
+		total += n
+		off += int64(n)
+		bufs = skipWritten(bufs, n)
+	}
+	return total, nil
+}
+
+// skipWritten returns what's left of bufs once the first n bytes have been
+// written, leaving out empty buffers at the start. bufs isn't changed.
+func skipWritten(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if n == 0 {
+		return bufs
+	}
+	// Written part way through a buffer.
+	rest := make([][]byte, len(bufs))
+	copy(rest, bufs)
+	rest[0] = rest[0][n:]
+	return rest
+}
@@ -0,0 +1,206 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// lazyReader is a SegmentReader for a sealed segment that isn't opened until
+// it's first read. It's used in place of the real one with
+// WithLazySegmentOpen or WithMaxOpenSegments. In the second case lru may
+// close it again once it's been unused for long enough, after which the next
+// read opens it again.
+type lazyReader struct {
+	sf   types.SegmentFiler
+	info types.SegmentInfo
+	lru  *segmentLRU
+
+	mu sync.Mutex
+	r  types.SegmentReader
+	// refs counts the reads using r. If lru evicts it while there are some,
+	// evicted is set and the last of them closes it.
+	refs    int
+	evicted bool
+	closed  bool
+
+	// elem is the reader's place in lru. It's guarded by lru.mu.
+	elem *list.Element
+}
+
+func newLazyReader(sf types.SegmentFiler, info types.SegmentInfo, lru *segmentLRU) *lazyReader {
+	return &lazyReader{sf: sf, info: info, lru: lru}
+}
+
+// acquire returns the segment's reader, opening it if it isn't open. The
+// caller must call release when it's done with it. If opening fails the next
+// call tries again.
+func (l *lazyReader) acquire() (types.SegmentReader, func(), error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, nil, ErrClosed
+	}
+	if l.r == nil {
+		r, err := l.sf.Open(l.info)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, nil, fmt.Errorf("failed to open segment %d: %w", l.info.ID, err)
+		}
+		l.r = r
+	}
+	l.refs++
+	l.evicted = false
+	r := l.r
+	l.mu.Unlock()
+
+	if l.lru != nil {
+		l.lru.touch(l)
+	}
+	return r, l.release, nil
+}
+
+func (l *lazyReader) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 && l.evicted {
+		l.closeReaderLocked()
+	}
+}
+
+// evict closes the reader, or arranges for it to be closed once the reads
+// using it are done.
+func (l *lazyReader) evict() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.refs > 0 {
+		l.evicted = true
+		return
+	}
+	l.closeReaderLocked()
+}
+
+func (l *lazyReader) closeReaderLocked() error {
+	l.evicted = false
+	if l.r == nil {
+		return nil
+	}
+	err := l.r.Close()
+	l.r = nil
+	return err
+}
+
+// Close closes the segment if it's open and stops it being opened again.
+func (l *lazyReader) Close() error {
+	if l.lru != nil {
+		l.lru.remove(l)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	if l.refs > 0 {
+		l.evicted = true
+		return nil
+	}
+	return l.closeReaderLocked()
+}
+
+func (l *lazyReader) GetLog(idx uint64, le *types.LogEntry) error {
+	r, release, err := l.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return r.GetLog(idx, le)
+}
+
+func (l *lazyReader) GetLogMeta(idx uint64, le *types.LogEntry) error {
+	r, release, err := l.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return r.GetLogMeta(idx, le)
+}
+
+func (l *lazyReader) TermRuns() ([]types.TermRun, error) {
+	r, release, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return r.TermRuns()
+}
+
+// openSealed returns the reader for a sealed segment. With
+// WithLazySegmentOpen or WithMaxOpenSegments it's only opened when first read.
+func (w *WAL) openSealed(info types.SegmentInfo) (types.SegmentReader, error) {
+	if w.lazyOpen || w.segmentLRU != nil {
+		return newLazyReader(w.sf, info, w.segmentLRU), nil
+	}
+	return w.sf.Open(info)
+}
+
+// segmentReader returns r, or the reader a lazyReader stands in for so that
+// callers can check which optional interfaces it implements. release must be
+// called once the returned reader is no longer used.
+func segmentReader(r types.SegmentReader) (types.SegmentReader, func(), error) {
+	if l, ok := r.(*lazyReader); ok {
+		return l.acquire()
+	}
+	return r, func() {}, nil
+}
+
+// segmentLRU bounds how many lazyReaders are open at once by closing the
+// least recently used.
+type segmentLRU struct {
+	max int
+
+	mu sync.Mutex
+	ll *list.List // of *lazyReader, most recently used at the front
+}
+
+func newSegmentLRU(max int) *segmentLRU {
+	return &segmentLRU{max: max, ll: list.New()}
+}
+
+// touch records that l was just used and evicts whatever no longer fits.
+func (c *segmentLRU) touch(l *lazyReader) {
+	c.mu.Lock()
+	if l.elem != nil {
+		c.ll.MoveToFront(l.elem)
+	} else {
+		l.elem = c.ll.PushFront(l)
+	}
+	var victims []*lazyReader
+	for c.ll.Len() > c.max {
+		v := c.ll.Remove(c.ll.Back()).(*lazyReader)
+		v.elem = nil
+		victims = append(victims, v)
+	}
+	c.mu.Unlock()
+
+	// Evicting takes each reader's lock, which is never held together with mu.
+	for _, v := range victims {
+		v.evict()
+	}
+}
+
+func (c *segmentLRU) remove(l *lazyReader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if l.elem != nil {
+		c.ll.Remove(l.elem)
+		l.elem = nil
+	}
+}
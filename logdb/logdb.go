@@ -0,0 +1,343 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package logdb is a shim for multi-raft engines such as dragonboat that keep
+// many raft groups in one log DB. It exposes the batch, term and state
+// operations those engines need using one WAL per group under a shared
+// directory. It doesn't import any engine's types so callers convert to and
+// from their own entry and state types; snapshot metadata is left to the
+// engine.
+package logdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+)
+
+var (
+	// ErrCompacted is returned when reading entries that have been removed from
+	// the front of a group's log.
+	ErrCompacted = errors.New("entries have been compacted")
+
+	// ErrUnavailable is returned when reading entries after the end of a group's
+	// log.
+	ErrUnavailable = errors.New("entries are not available")
+
+	// ErrClosed is returned by any call made after Close.
+	ErrClosed = errors.New("closed")
+)
+
+// stateKey is the stable store key each group's State is persisted under.
+var stateKey = []byte("logdb-state")
+
+// GroupID identifies a single raft group (a shard and replica in dragonboat's
+// terms).
+type GroupID struct {
+	ShardID   uint64
+	ReplicaID uint64
+}
+
+func (g GroupID) dirName() string {
+	return fmt.Sprintf("%020d-%020d", g.ShardID, g.ReplicaID)
+}
+
+// State is the persistent raft state of a group.
+type State struct {
+	Term   uint64
+	Vote   uint64
+	Commit uint64
+}
+
+// Update is the set of changes to persist for one group. Entries must be
+// contiguous. If they overlap entries already in the log, the existing
+// entries from the first new index onwards are replaced.
+type Update struct {
+	GroupID
+	Entries []types.LogEntry
+
+	// State is written if non-nil.
+	State *State
+}
+
+// RaftState is what a group recovers on restart.
+type RaftState struct {
+	State      State
+	FirstIndex uint64
+	EntryCount uint64
+}
+
+// OpenFunc opens the WAL for a group in dir.
+type OpenFunc func(dir string) (*wal.WAL, error)
+
+// DB manages one WAL per group under a single directory.
+type DB struct {
+	dir  string
+	open OpenFunc
+
+	mu     sync.Mutex
+	closed bool
+	groups map[GroupID]*wal.WAL
+}
+
+// Open returns a DB that stores groups under dir. Each group's WAL is opened
+// with open the first time it's used. A nil open uses wal.Open with default
+// options.
+func Open(dir string, open OpenFunc) (*DB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if open == nil {
+		open = func(dir string) (*wal.WAL, error) {
+			return wal.Open(dir)
+		}
+	}
+	return &DB{
+		dir:    dir,
+		open:   open,
+		groups: make(map[GroupID]*wal.WAL),
+	}, nil
+}
+
+// group returns the WAL for id, opening it if needed.
+func (db *DB) group(id GroupID) (*wal.WAL, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if w, ok := db.groups[id]; ok {
+		return w, nil
+	}
+	dir := filepath.Join(db.dir, id.dirName())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w, err := db.open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("opening group %d-%d: %w", id.ShardID, id.ReplicaID, err)
+	}
+	db.groups[id] = w
+	return w, nil
+}
+
+// SaveRaftState persists a batch of updates that may span many groups. Each
+// group is written concurrently so that their fsyncs overlap. Updates for the
+// same group are applied in order. The first error encountered is returned;
+// updates for other groups may still have been applied.
+func (db *DB) SaveRaftState(updates []Update) error {
+	byGroup := make(map[GroupID][]Update)
+	var order []GroupID
+	for _, u := range updates {
+		if _, ok := byGroup[u.GroupID]; !ok {
+			order = append(order, u.GroupID)
+		}
+		byGroup[u.GroupID] = append(byGroup[u.GroupID], u)
+	}
+
+	errs := make([]error, len(order))
+	var wg sync.WaitGroup
+	for i, id := range order {
+		wg.Add(1)
+		go func(i int, id GroupID) {
+			defer wg.Done()
+			errs[i] = db.saveGroup(id, byGroup[id])
+		}(i, id)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) saveGroup(id GroupID, updates []Update) error {
+	w, err := db.group(id)
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		if len(u.Entries) > 0 {
+			if err := storeEntries(w, u.Entries); err != nil {
+				return err
+			}
+		}
+		if u.State != nil {
+			if err := w.SetStable(stateKey, encodeState(*u.State)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storeEntries appends entries, first removing any existing entries they
+// replace.
+func storeEntries(w *wal.WAL, entries []types.LogEntry) error {
+	first, last, err := w.IndexRange()
+	if err != nil {
+		return err
+	}
+	newFirst := entries[0].Index
+	switch {
+	case last == 0 || newFirst == last+1:
+		// Plain append.
+	case newFirst <= first:
+		// Replacing the whole log.
+		if err := w.ResetTo(newFirst); err != nil {
+			return err
+		}
+	case newFirst <= last:
+		if err := w.TruncateBack(newFirst - 1); err != nil {
+			return err
+		}
+	}
+	return w.StoreLogs(entries)
+}
+
+// ReadRaftState returns the persisted state of a group and the range of
+// entries in its log.
+func (db *DB) ReadRaftState(id GroupID) (RaftState, error) {
+	w, err := db.group(id)
+	if err != nil {
+		return RaftState{}, err
+	}
+	var rs RaftState
+	raw, err := w.GetStable(stateKey)
+	if err != nil {
+		return rs, err
+	}
+	if rs.State, err = decodeState(raw); err != nil {
+		return rs, err
+	}
+	first, last, err := w.IndexRange()
+	if err != nil {
+		return rs, err
+	}
+	if last > 0 {
+		rs.FirstIndex = first
+		rs.EntryCount = last - first + 1
+	}
+	return rs, nil
+}
+
+// IterateEntries appends entries in [low, high) to ents until their total
+// Data size would exceed maxSize and returns the extended slice and its size.
+// At least one entry is always returned if low is in the log.
+func (db *DB) IterateEntries(id GroupID, low, high, maxSize uint64, ents []types.LogEntry) ([]types.LogEntry, uint64, error) {
+	w, err := db.group(id)
+	if err != nil {
+		return ents, 0, err
+	}
+	first, last, err := w.IndexRange()
+	if err != nil {
+		return ents, 0, err
+	}
+	if low < first {
+		return ents, 0, ErrCompacted
+	}
+	if high > last+1 {
+		return ents, 0, ErrUnavailable
+	}
+
+	var size uint64
+	for idx := low; idx < high; idx++ {
+		var le types.LogEntry
+		if err := w.GetLog(idx, &le); err != nil {
+			return ents, size, err
+		}
+		if size > 0 && size+uint64(len(le.Data)) > maxSize {
+			break
+		}
+		size += uint64(len(le.Data))
+		ents = append(ents, le)
+	}
+	return ents, size, nil
+}
+
+// Term returns the term of the entry at index in a group's log.
+func (db *DB) Term(id GroupID, index uint64) (uint64, error) {
+	w, err := db.group(id)
+	if err != nil {
+		return 0, err
+	}
+	return w.TermAt(index)
+}
+
+// RemoveEntriesTo removes entries up to and including index from a group's
+// log.
+func (db *DB) RemoveEntriesTo(id GroupID, index uint64) error {
+	w, err := db.group(id)
+	if err != nil {
+		return err
+	}
+	return w.TruncateFront(index + 1)
+}
+
+// RemoveGroupData closes a group's WAL and deletes all of its data.
+func (db *DB) RemoveGroupData(id GroupID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if w, ok := db.groups[id]; ok {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		delete(db.groups, id)
+	}
+	return os.RemoveAll(filepath.Join(db.dir, id.dirName()))
+}
+
+// Close closes every open group's WAL.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	var firstErr error
+	for id, w := range db.groups {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(db.groups, id)
+	}
+	return firstErr
+}
+
+func encodeState(s State) []byte {
+	buf := make([]byte, 24)
+	binary.LittleEndian.PutUint64(buf[0:], s.Term)
+	binary.LittleEndian.PutUint64(buf[8:], s.Vote)
+	binary.LittleEndian.PutUint64(buf[16:], s.Commit)
+	return buf
+}
+
+func decodeState(raw []byte) (State, error) {
+	if len(raw) == 0 {
+		return State{}, nil
+	}
+	if len(raw) != 24 {
+		return State{}, fmt.Errorf("%w: raft state is %d bytes", types.ErrCorrupt, len(raw))
+	}
+	return State{
+		Term:   binary.LittleEndian.Uint64(raw[0:]),
+		Vote:   binary.LittleEndian.Uint64(raw[8:]),
+		Commit: binary.LittleEndian.Uint64(raw[16:]),
+	}, nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package logdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestDB(t *testing.T) (*DB, string) {
+	t.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "raft-wal-logdb-test-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	db, err := Open(tmpDir, func(dir string) (*wal.WAL, error) {
+		return wal.Open(dir, wal.WithSegmentSize(8*1024))
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db, tmpDir
+}
+
+func makeEntries(first, n, term uint64) []types.LogEntry {
+	entries := make([]types.LogEntry, 0, n)
+	for idx := first; idx < first+n; idx++ {
+		entries = append(entries, types.LogEntry{
+			Index: idx,
+			Term:  term,
+			Data:  []byte(fmt.Sprintf("%05d-%d", idx, term)),
+		})
+	}
+	return entries
+}
+
+func TestSaveRaftState(t *testing.T) {
+	db, dir := openTestDB(t)
+
+	g1 := GroupID{ShardID: 1, ReplicaID: 1}
+	g2 := GroupID{ShardID: 2, ReplicaID: 1}
+
+	// One batch spanning both groups, with two updates for g1.
+	err := db.SaveRaftState([]Update{
+		{GroupID: g1, Entries: makeEntries(1, 50, 1)},
+		{GroupID: g2, Entries: makeEntries(1, 10, 1), State: &State{Term: 1, Vote: 2, Commit: 5}},
+		{GroupID: g1, Entries: makeEntries(51, 50, 2), State: &State{Term: 2, Vote: 1, Commit: 80}},
+	})
+	require.NoError(t, err)
+
+	rs, err := db.ReadRaftState(g1)
+	require.NoError(t, err)
+	require.Equal(t, RaftState{State: State{Term: 2, Vote: 1, Commit: 80}, FirstIndex: 1, EntryCount: 100}, rs)
+
+	rs, err = db.ReadRaftState(g2)
+	require.NoError(t, err)
+	require.Equal(t, RaftState{State: State{Term: 1, Vote: 2, Commit: 5}, FirstIndex: 1, EntryCount: 10}, rs)
+
+	term, err := db.Term(g1, 75)
+	require.NoError(t, err)
+	require.Equal(t, 2, int(term))
+
+	// Conflicting entries replace the existing suffix.
+	require.NoError(t, db.SaveRaftState([]Update{{GroupID: g1, Entries: makeEntries(90, 5, 3)}}))
+	rs, err = db.ReadRaftState(g1)
+	require.NoError(t, err)
+	require.Equal(t, 94, int(rs.EntryCount))
+	term, err = db.Term(g1, 94)
+	require.NoError(t, err)
+	require.Equal(t, 3, int(term))
+
+	// State survives reopening.
+	require.NoError(t, db.Close())
+	_, err = db.ReadRaftState(g1)
+	require.ErrorIs(t, err, ErrClosed)
+
+	db, err = Open(dir, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	rs, err = db.ReadRaftState(g1)
+	require.NoError(t, err)
+	require.Equal(t, RaftState{State: State{Term: 2, Vote: 1, Commit: 80}, FirstIndex: 1, EntryCount: 94}, rs)
+}
+
+func TestIterateEntries(t *testing.T) {
+	db, _ := openTestDB(t)
+	g := GroupID{ShardID: 7, ReplicaID: 3}
+
+	require.NoError(t, db.SaveRaftState([]Update{{GroupID: g, Entries: makeEntries(1, 100, 1)}}))
+	require.NoError(t, db.RemoveEntriesTo(g, 9))
+
+	_, _, err := db.IterateEntries(g, 5, 20, 1024, nil)
+	require.ErrorIs(t, err, ErrCompacted)
+	_, _, err = db.IterateEntries(g, 90, 102, 1024, nil)
+	require.ErrorIs(t, err, ErrUnavailable)
+
+	ents, size, err := db.IterateEntries(g, 10, 101, 1<<20, nil)
+	require.NoError(t, err)
+	require.Len(t, ents, 91)
+	require.Equal(t, 91*len("00010-1"), int(size))
+	require.Equal(t, 10, int(ents[0].Index))
+
+	// maxSize limits the result, but one entry is always returned.
+	ents, size, err = db.IterateEntries(g, 10, 101, 3*7, nil)
+	require.NoError(t, err)
+	require.Len(t, ents, 3)
+	require.Equal(t, 21, int(size))
+
+	ents, _, err = db.IterateEntries(g, 10, 101, 1, nil)
+	require.NoError(t, err)
+	require.Len(t, ents, 1)
+
+	// Replacing the whole log resets it.
+	require.NoError(t, db.SaveRaftState([]Update{{GroupID: g, Entries: makeEntries(5, 10, 2)}}))
+	rs, err := db.ReadRaftState(g)
+	require.NoError(t, err)
+	require.Equal(t, 5, int(rs.FirstIndex))
+	require.Equal(t, 10, int(rs.EntryCount))
+
+	require.NoError(t, db.RemoveGroupData(g))
+	rs, err = db.ReadRaftState(g)
+	require.NoError(t, err)
+	require.Equal(t, RaftState{}, rs)
+}
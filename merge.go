@@ -0,0 +1,336 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// mergeSmallFraction is the fraction of the segment size that a sealed
+	// segment must be smaller than to be merged with its neighbours.
+	mergeSmallFraction = 4
+
+	// Segments written by compaction are sized to fit their entries, leaving
+	// about this much room for each one's frame headers and index entry and
+	// for the segment's header and seal.
+	compactEntryOverhead   = 64
+	compactSegmentOverhead = 4096
+)
+
+// runMerger merges runs of small segments once per mergeEvery until Close.
+func (w *WAL) runMerger() {
+	defer close(w.mergeDone)
+
+	ticker := time.NewTicker(w.mergeEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.mergeStop:
+			return
+		case <-ticker.C:
+		}
+		if _, err := w.mergeSegments(w.mergeStop); err != nil {
+			level.Error(w.logger).Log("msg", "failed to merge small segments", "err", err)
+		}
+	}
+}
+
+// MergeSegments merges each run of neighbouring sealed segments that are
+// small, as frequent truncations and rotations leave behind, into as few new
+// segments as they fit in, which WithSegmentMerging otherwise does in the
+// background. That keeps the number of segments, and so the files the WAL
+// holds open and the time Open takes, down on long-lived logs. It also
+// rewrites each segment that was the tail when TruncateBack removed entries
+// from it, since the bytes of the removed entries and the rest of the space
+// preallocated for the segment are otherwise never reclaimed. The entries of
+// each run are copied without blocking appends and the copies swapped in
+// atomically, after which the old files are deleted once no reads are using
+// them. Segments in different dirs aren't merged. It returns the number of
+// segments replaced.
+func (w *WAL) MergeSegments(ctx context.Context) (int, error) {
+	if err := w.checkWritable(); err != nil {
+		return 0, err
+	}
+	n, err := w.mergeSegments(ctx.Done())
+	if err == nil {
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+// mergeSegments merges runs of small segments until done is closed.
+func (w *WAL) mergeSegments(done <-chan struct{}) (int, error) {
+	// The state is held until every run is merged so the files being copied
+	// can't be deleted from under us if they're truncated meanwhile.
+	s, release := w.acquireState()
+	defer release()
+
+	n := 0
+	for _, run := range w.compactionRuns(s) {
+		select {
+		case <-done:
+			return n, nil
+		default:
+		}
+		if err := w.checkClosed(); err != nil {
+			return n, err
+		}
+		if !w.waitIO(done, run.size) {
+			return n, nil
+		}
+		segs := run.segs
+		merged, err := w.mergeRun(run)
+		if err != nil {
+			return n, fmt.Errorf("failed to merge segments %d to %d: %w", segs[0].ID, segs[len(segs)-1].ID, err)
+		}
+		if merged {
+			n += len(segs)
+		}
+	}
+	return n, nil
+}
+
+// compactRun is a run of neighbouring segments to rewrite as one, holding
+// about size bytes of entries.
+type compactRun struct {
+	segs []segmentState
+	size int64
+}
+
+// compactionRuns returns each run of two or more neighbouring sealed segments
+// in s that are small, in the same dir and fit in one segment together, and
+// each segment sealed by TruncateBack on its own unless it's in such a run.
+func (w *WAL) compactionRuns(s *state) []compactRun {
+	small := int64(w.segmentSize) / mergeSmallFraction
+	var (
+		runs []compactRun
+		run  compactRun
+	)
+	flush := func() {
+		if len(run.segs) > 1 || (len(run.segs) == 1 && truncatedTail(run.segs[0].SegmentInfo)) {
+			runs = append(runs, run)
+		}
+		run = compactRun{}
+	}
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if seg.SealTime.IsZero() {
+			flush()
+			continue
+		}
+		size := segmentDataSize(seg, small)
+		if size >= small {
+			flush()
+			if truncatedTail(seg.SegmentInfo) {
+				size = segmentDataSize(seg, int64(w.segmentSize))
+				runs = append(runs, compactRun{segs: []segmentState{seg}, size: size})
+			}
+			continue
+		}
+		if len(run.segs) > 0 && (seg.Dir != run.segs[0].Dir || run.size+size > int64(w.segmentSize)) {
+			flush()
+		}
+		run.segs = append(run.segs, seg)
+		run.size += size
+	}
+	flush()
+	return runs
+}
+
+// truncatedTail returns whether info is a segment that TruncateBack sealed
+// while it was still the tail. Its file was never sealed so it has no index,
+// and everything after MaxIndex, including any space preallocated for it, is
+// dead.
+func truncatedTail(info types.SegmentInfo) bool {
+	return !info.SealTime.IsZero() && info.IndexStart == 0
+}
+
+// segmentDataSize returns about how many bytes of entries the sealed segment
+// seg holds, or limit if it's at least that. Segments sealed by TruncateBack
+// have no index to say where their entries end so they're measured instead.
+func segmentDataSize(seg segmentState, limit int64) int64 {
+	if !truncatedTail(seg.SegmentInfo) {
+		return int64(seg.IndexStart)
+	}
+	sr, release, err := segmentReader(seg.r)
+	if err != nil {
+		return limit
+	}
+	defer release()
+	dr, ok := sr.(types.SegmentDataReader)
+	if !ok {
+		return limit
+	}
+	var size int64
+	for idx := seg.MinIndex; idx <= seg.MaxIndex; idx++ {
+		_, n, err := dr.GetLogReader(idx)
+		if err != nil {
+			return limit
+		}
+		if size += n; size >= limit {
+			return limit
+		}
+	}
+	return size
+}
+
+// mergeRun copies the entries of the segments in run into new segments and
+// swaps them in for the old ones. It returns false if any of them changed in
+// the meantime, for example by being truncated.
+func (w *WAL) mergeRun(cr compactRun) (bool, error) {
+	run := cr.segs
+	first, last := run[0], run[len(run)-1]
+
+	// The new segment's file is preallocated to its size limit so it's only
+	// as big as the entries need, or it would waste what's being reclaimed.
+	sizeLimit := uint64(cr.size) + (last.MaxIndex-first.MinIndex+1)*compactEntryOverhead + compactSegmentOverhead
+	if sizeLimit > uint64(w.segmentSize) {
+		sizeLimit = uint64(w.segmentSize)
+	}
+
+	var (
+		done []segmentState
+		cur  types.SegmentInfo
+		sw   types.SegmentWriter
+	)
+	discard := func(reason string) {
+		toDelete := make(map[uint64]uint64)
+		toClose := make([]io.Closer, 0, len(done)+1)
+		for _, ss := range done {
+			toDelete[ss.ID] = ss.BaseIndex
+			toClose = append(toClose, ss.r)
+		}
+		if sw != nil {
+			toDelete[cur.ID] = cur.BaseIndex
+			toClose = append(toClose, sw)
+		}
+		w.closeSegments(toClose)
+		w.deleteSegments(toDelete, AuditRecord{Reason: reason})
+	}
+	fail := func(err error) (bool, error) {
+		discard("partial copy from a failed merge")
+		return false, err
+	}
+	finish := func(indexStart uint64) {
+		cur.MaxIndex = sw.LastIndex()
+		cur.IndexStart = indexStart
+		cur.SealTime = last.SealTime
+		if cs, ok := sw.(types.SegmentChecksummer); ok {
+			cur.Checksum, _ = cs.SealedChecksum()
+		}
+		done = append(done, segmentState{SegmentInfo: cur, r: sw})
+		sw = nil
+	}
+
+	batch := make([]types.LogEntry, 0, migrateBatchSize)
+	i := 0
+	for idx := first.MinIndex; idx <= last.MaxIndex; {
+		batch = batch[:0]
+		for ; idx <= last.MaxIndex && len(batch) < migrateBatchSize; idx++ {
+			for idx > run[i].MaxIndex {
+				i++
+			}
+			var le types.LogEntry
+			if err := run[i].r.GetLog(idx, &le); err != nil {
+				return fail(err)
+			}
+			le.Index = idx
+			batch = append(batch, le)
+		}
+
+		if sw == nil {
+			// Commit the new segment's ID before creating its file, as for any
+			// other new segment, so it's never reused after a crash.
+			var id uint64
+			w.stateMu.Lock()
+			err := w.mutateStateLocked(func(s *state) (func(), func() error, error) {
+				id = s.nextSegmentID
+				s.nextSegmentID++
+				return nil, nil, nil
+			})
+			w.stateMu.Unlock()
+			if err != nil {
+				return fail(err)
+			}
+			cur = w.newSegment(id, batch[0].Index)
+			cur.SizeLimit = uint32(sizeLimit)
+			cur.CreateTime = first.CreateTime
+			cur.Dir = first.Dir
+			sw, err = w.sf.Create(cur)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		if err := sw.Append(batch); err != nil {
+			return fail(err)
+		}
+		sealed, indexStart, err := sw.Sealed()
+		if err != nil {
+			return fail(err)
+		}
+		if sealed {
+			finish(indexStart)
+		}
+	}
+	if sw != nil {
+		sealer, ok := sw.(types.SegmentSealer)
+		if !ok {
+			return fail(fmt.Errorf("merging isn't supported by the SegmentFiler in use"))
+		}
+		indexStart, err := sealer.Seal()
+		if err != nil {
+			return fail(err)
+		}
+		finish(indexStart)
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+
+	s := w.loadState()
+	changed := atomic.LoadUint32(&w.closed) == 1
+	for _, seg := range run {
+		now, ok := s.segments.Get(seg.BaseIndex)
+		if !ok || now.ID != seg.ID || now.Dir != seg.Dir || now.MinIndex != seg.MinIndex || now.MaxIndex != seg.MaxIndex {
+			changed = true
+		}
+	}
+	if changed {
+		discard("copy from a merge of segments that changed meanwhile")
+		return false, nil
+	}
+
+	err := w.mutateStateLocked(func(s *state) (func(), func() error, error) {
+		toDelete := make(map[uint64]uint64, len(run))
+		toClose := make([]io.Closer, 0, len(run))
+		for _, seg := range run {
+			s.segments = s.segments.Delete(seg.BaseIndex)
+			toDelete[seg.ID] = seg.BaseIndex
+			toClose = append(toClose, seg.r)
+		}
+		for _, ss := range done {
+			s.segments = s.segments.Set(ss.BaseIndex, ss)
+		}
+		fin := func() {
+			w.closeSegments(toClose)
+			w.deleteSegments(toDelete, AuditRecord{Reason: "merged with neighbouring small segments"})
+		}
+		return fin, nil, nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	return true, nil
+}
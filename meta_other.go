@@ -0,0 +1,15 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !wasm
+
+package wal
+
+import (
+	"github.com/dreamsxin/wal/metadb"
+	"github.com/dreamsxin/wal/types"
+)
+
+func defaultMetaStore() types.MetaStore {
+	return &metadb.BoltMetaDB{}
+}
@@ -0,0 +1,15 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"github.com/dreamsxin/wal/metadb"
+	"github.com/dreamsxin/wal/types"
+)
+
+// defaultMetaStore keeps metadata in flat files since BoltDB can't be built
+// for WebAssembly.
+func defaultMetaStore() types.MetaStore {
+	return &metadb.FlatMetaDB{}
+}
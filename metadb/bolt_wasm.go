@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import (
+	"fmt"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// BoltMetaDB can't be used on WebAssembly since BoltDB needs mmap. Load always
+// fails with ErrBoltUnsupported.
+type BoltMetaDB struct{}
+
+// Load implements types.MetaStore
+func (db *BoltMetaDB) Load(dir string) (types.PersistentState, error) {
+	return types.PersistentState{}, ErrBoltUnsupported
+}
+
+// CommitState implements types.MetaStore
+func (db *BoltMetaDB) CommitState(state types.PersistentState) error {
+	return ErrUnintialized
+}
+
+// GetStable implements types.MetaStore
+func (db *BoltMetaDB) GetStable(key []byte) ([]byte, error) {
+	return nil, ErrUnintialized
+}
+
+// SetStable implements types.MetaStore
+func (db *BoltMetaDB) SetStable(key []byte, value []byte) error {
+	return ErrUnintialized
+}
+
+// Close implements io.Closer
+func (db *BoltMetaDB) Close() error {
+	return nil
+}
+
+// loadBolt fails since a wal-meta.db can't be read without BoltDB.
+func (db *ReadOnlyMetaDB) loadBolt(dir string) (types.PersistentState, error) {
+	return types.PersistentState{}, fmt.Errorf("can't read %s: %w", FileName, ErrBoltUnsupported)
+}
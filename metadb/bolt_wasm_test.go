@@ -0,0 +1,19 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltMetaDBUnsupported(t *testing.T) {
+	var db BoltMetaDB
+	_, err := db.Load(t.TempDir())
+	require.ErrorIs(t, err, ErrBoltUnsupported)
+	_, err = db.GetStable([]byte("foo"))
+	require.ErrorIs(t, err, ErrUnintialized)
+	require.NoError(t, db.Close())
+}
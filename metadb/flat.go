@@ -0,0 +1,290 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/types"
+)
+
+const (
+	// FlatFileA and FlatFileB are the names of the two files FlatMetaDB
+	// alternates between.
+	FlatFileA = "wal-meta.a"
+	FlatFileB = "wal-meta.b"
+
+	flatMagic     = 0x3c9f51d2
+	flatVersion   = 1
+	flatHeaderLen = 24
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// flatFiles is indexed by sequence number modulo 2 to find the file a copy of
+// the metadata is written to.
+var flatFiles = [2]string{FlatFileA, FlatFileB}
+
+// FlatMetaDB implements types.MetaStore with plain files rather than BoltDB.
+// Every change rewrites the whole state, along with any stable values, over
+// the older of two files, so the previous copy is always left intact. Each
+// copy is written under a temporary name, synced and renamed into place so it
+// replaces the old one atomically, and it's checksummed so that if the newer
+// copy is ever found damaged Load falls back to the older one, losing only the
+// last change. Since every SetStable rewrites the file it suits callers that
+// make little use of the stable store.
+//
+// The zero value stores its files with the OS file system. Use NewFlatMetaDB
+// to keep them in another types.VFS.
+type FlatMetaDB struct {
+	mu     sync.Mutex
+	vfs    types.VFS
+	dir    string
+	loaded bool
+
+	// seq is the sequence number of the newest copy on disk. The next is
+	// written with seq+1 to the other file.
+	seq    uint64
+	state  types.PersistentState
+	stable map[string][]byte
+}
+
+// NewFlatMetaDB returns a FlatMetaDB that stores its files in vfs.
+func NewFlatMetaDB(vfs types.VFS) *FlatMetaDB {
+	return &FlatMetaDB{vfs: vfs}
+}
+
+// flatMeta is the JSON encoded payload of each file.
+type flatMeta struct {
+	State  types.PersistentState
+	Stable map[string][]byte `json:",omitempty"`
+}
+
+/*
+	File format
+
+	0      1      2      3      4      5      6      7      8
+	+------+------+------+------+------+------+------+------+
+	| Magic                     | Version                   |
+	+------+------+------+------+------+------+------+------+
+	| Seq                                                   |
+	+------+------+------+------+------+------+------+------+
+	| Length                    | CRC                       |
+	+------+------+------+------+------+------+------+------+
+	| JSON payload ...
+	+------+------+------+------+
+
+	CRC is a CRC32 (Castagnoli) of the header before it and the payload.
+*/
+
+// Load implements types.MetaStore. It reads both files and returns the state
+// from the newest intact one.
+func (db *FlatMetaDB) Load(dir string) (types.PersistentState, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.dir != "" && db.dir != dir {
+		return types.PersistentState{}, fmt.Errorf("can't load dir %s, already open in dir %s", dir, db.dir)
+	}
+	if db.vfs == nil {
+		db.vfs = fs.New()
+	}
+
+	var (
+		newest  *flatMeta
+		seq     uint64
+		found   bool
+		lastErr error
+	)
+	for _, name := range flatFiles {
+		m, s, err := db.readFlatFile(dir, name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		found = true
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if newest == nil || s > seq {
+			newest, seq = m, s
+		}
+	}
+	if newest == nil {
+		if found {
+			return types.PersistentState{}, lastErr
+		}
+		// Refuse to start an empty log over the top of one whose metadata is
+		// in BoltDB since the WAL would delete all of its segments.
+		names, err := db.vfs.ListDir(dir)
+		if err != nil {
+			return types.PersistentState{}, err
+		}
+		for _, name := range names {
+			if name == FileName {
+				return types.PersistentState{}, fmt.Errorf("%s already has metadata in %s", dir, FileName)
+			}
+		}
+		newest = &flatMeta{}
+	}
+
+	db.dir, db.loaded, db.seq = dir, true, seq
+	db.state, db.stable = newest.State, newest.Stable
+	if db.stable == nil {
+		db.stable = make(map[string][]byte)
+	}
+	return db.state, nil
+}
+
+// CommitState implements types.MetaStore.
+func (db *FlatMetaDB) CommitState(state types.PersistentState) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.loaded {
+		return ErrUnintialized
+	}
+	if err := db.writeLocked(flatMeta{State: state, Stable: db.stable}); err != nil {
+		return err
+	}
+	db.state = state
+	return nil
+}
+
+// GetStable implements types.MetaStore.
+func (db *FlatMetaDB) GetStable(key []byte) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.loaded {
+		return nil, ErrUnintialized
+	}
+	val, ok := db.stable[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// SetStable implements types.MetaStore.
+func (db *FlatMetaDB) SetStable(key []byte, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.loaded {
+		return ErrUnintialized
+	}
+	stable := make(map[string][]byte, len(db.stable)+1)
+	for k, v := range db.stable {
+		stable[k] = v
+	}
+	if value == nil {
+		delete(stable, string(key))
+	} else {
+		stable[string(key)] = append([]byte(nil), value...)
+	}
+	if err := db.writeLocked(flatMeta{State: db.state, Stable: stable}); err != nil {
+		return err
+	}
+	db.stable = stable
+	return nil
+}
+
+// Close implements io.Closer.
+func (db *FlatMetaDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.loaded = false
+	db.state, db.stable = types.PersistentState{}, nil
+	return nil
+}
+
+// writeLocked durably writes m as the next copy of the metadata, over the
+// older of the two files. db.mu must be held.
+func (db *FlatMetaDB) writeLocked(m flatMeta) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode persisted state: %w", err)
+	}
+	seq := db.seq + 1
+	buf := make([]byte, flatHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:], flatMagic)
+	binary.LittleEndian.PutUint32(buf[4:], flatVersion)
+	binary.LittleEndian.PutUint64(buf[8:], seq)
+	binary.LittleEndian.PutUint32(buf[16:], uint32(len(payload)))
+	copy(buf[flatHeaderLen:], payload)
+	binary.LittleEndian.PutUint32(buf[20:], flatCRC(buf))
+
+	name := flatFiles[seq%2]
+	tmpName := name + ".tmp"
+	// A temporary file may be left over if we crashed while writing it.
+	if err := db.vfs.Delete(db.dir, tmpName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f, err := db.vfs.Create(db.dir, tmpName, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(buf, 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpName, err)
+	}
+	if err := db.vfs.Rename(db.dir, tmpName, name); err != nil {
+		return err
+	}
+	db.seq = seq
+	return nil
+}
+
+// readFlatFile reads and checks one copy of the metadata, returning it and
+// its sequence number.
+func (db *FlatMetaDB) readFlatFile(dir, name string) (*flatMeta, uint64, error) {
+	f, err := db.vfs.OpenReader(dir, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf, err := io.ReadAll(io.NewSectionReader(f, 0, math.MaxInt64))
+	f.Close()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if len(buf) < flatHeaderLen || binary.LittleEndian.Uint32(buf[0:]) != flatMagic {
+		return nil, 0, fmt.Errorf("%w: %s is not a metadata file", types.ErrCorrupt, name)
+	}
+	if v := binary.LittleEndian.Uint32(buf[4:]); v != flatVersion {
+		return nil, 0, fmt.Errorf("%s has unsupported version %d", name, v)
+	}
+	if int(binary.LittleEndian.Uint32(buf[16:])) != len(buf)-flatHeaderLen ||
+		binary.LittleEndian.Uint32(buf[20:]) != flatCRC(buf) {
+		return nil, 0, fmt.Errorf("%w: %s checksum doesn't match", types.ErrCorrupt, name)
+	}
+	var m flatMeta
+	if err := json.Unmarshal(buf[flatHeaderLen:], &m); err != nil {
+		return nil, 0, fmt.Errorf("%w: failed to parse persisted state: %s", types.ErrCorrupt, err)
+	}
+	return &m, binary.LittleEndian.Uint64(buf[8:]), nil
+}
+
+// flatCRC returns the checksum of an encoded file, which covers everything
+// but the checksum itself.
+func flatCRC(buf []byte) uint32 {
+	crc := crc32.Checksum(buf[:20], crcTable)
+	return crc32.Update(crc, crcTable, buf[flatHeaderLen:])
+}
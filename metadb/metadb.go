@@ -1,6 +1,8 @@
 // Copyright (c) HashiCorp, Inc
 // SPDX-License-Identifier: MPL-2.0
 
+//go:build !wasm
+
 package metadb
 
 import (
@@ -10,28 +12,11 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/dreamsxin/wal/fs"
 	"github.com/dreamsxin/wal/types"
 	"go.etcd.io/bbolt"
 )
 
-const (
-	// FileName is the default file name for the bolt db file.
-	FileName = "wal-meta.db"
-
-	// *Bucket are the names used for internal bolt buckets
-	MetaBucket   = "wal-meta"
-	StableBucket = "stable"
-
-	// We just need one key for now so use the byte 'm' for meta arbitrarily.
-	MetaKey = "m"
-)
-
-var (
-	// ErrUnintialized is returned when any call is made before Load has opened
-	// the DB file.
-	ErrUnintialized = errors.New("uninitialized")
-)
-
 // BoltMetaDB implements types.MetaStore using BoltDB as a reliable persistent
 // store. See repo README for reasons for this design choice and performance
 // implications.
@@ -80,6 +65,14 @@ func (db *BoltMetaDB) ensureOpen(dir string) error {
 		return fmt.Errorf("failed to stat %s: %w", FileName, err)
 	}
 
+	// Refuse to start an empty log over the top of one whose metadata is in a
+	// FlatMetaDB since the WAL would delete all of its segments.
+	for _, name := range flatFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return fmt.Errorf("%s already has metadata in %s", dir, name)
+		}
+	}
+
 	// File doesn't exist, initialize a new DB in a crash-safe way
 	if err := safeInitBoltDB(dir); err != nil {
 		return fmt.Errorf("failed initializing meta DB: %w", err)
@@ -134,16 +127,7 @@ func safeInitBoltDB(dir string) error {
 
 	// And Fsync that parent dir to make sure the new new file with it's new name
 	// is persisted!
-	dirF, err := os.Open(dir)
-	if err != nil {
-		return err
-	}
-	err = dirF.Sync()
-	closeErr := dirF.Close()
-	if err != nil {
-		return err
-	}
-	return closeErr
+	return fs.SyncDir(dir)
 }
 
 // Load loads the existing persisted state. If there is no existing state
@@ -206,6 +190,58 @@ func (db *BoltMetaDB) CommitState(state types.PersistentState) error {
 	return tx.Commit()
 }
 
+// GetStable returns a value from stable store or nil if it doesn't exist. May
+// be called concurrently by multiple threads.
+func (db *BoltMetaDB) GetStable(key []byte) ([]byte, error) {
+	if db.db == nil {
+		return nil, ErrUnintialized
+	}
+
+	tx, err := db.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	stable := tx.Bucket([]byte(StableBucket))
+
+	val := stable.Get(key)
+	if val == nil {
+		return nil, nil
+	}
+
+	// Need to copy the value since bolt only guarantees the slice is valid until
+	// end of txn.
+	ret := make([]byte, len(val))
+	copy(ret, val)
+	return ret, nil
+}
+
+// SetStable stores a value in the stable store. Setting a nil value removes
+// the key. May be called concurrently with GetStable.
+func (db *BoltMetaDB) SetStable(key []byte, value []byte) error {
+	if db.db == nil {
+		return ErrUnintialized
+	}
+
+	tx, err := db.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stable := tx.Bucket([]byte(StableBucket))
+
+	if value == nil {
+		err = stable.Delete(key)
+	} else {
+		err = stable.Put(key, value)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // Close implements io.Closer
 func (db *BoltMetaDB) Close() error {
 	if db.db == nil {
@@ -6,14 +6,27 @@ package metadb
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
+	"github.com/dreamsxin/wal/fs"
 	"github.com/dreamsxin/wal/types"
 	"github.com/stretchr/testify/require"
 )
 
+// requireBolt skips t on platforms BoltMetaDB isn't supported on.
+func requireBolt(t *testing.T) {
+	t.Helper()
+	if runtime.GOARCH == "wasm" {
+		t.Skip("BoltDB isn't supported on wasm")
+	}
+}
+
 func TestMetaDB(t *testing.T) {
+	requireBolt(t)
+
 	cases := []struct {
 		name       string
 		writeState *types.PersistentState
@@ -60,6 +73,8 @@ func TestMetaDB(t *testing.T) {
 }
 
 func TestMetaDBErrors(t *testing.T) {
+	requireBolt(t)
+
 	tmpDir, err := os.MkdirTemp("", "raft-wal-meta-test-*")
 	require.NoError(t, err)
 	defer os.RemoveAll(tmpDir)
@@ -86,7 +101,7 @@ func TestMetaDBErrors(t *testing.T) {
 	// Loading from a non-existent dir is an error
 	var db2 BoltMetaDB
 	_, err = db2.Load("fake-dir-that-does-not-exist")
-	require.ErrorContains(t, err, "no such file or directory")
+	require.ErrorIs(t, err, os.ErrNotExist)
 }
 
 func makeState(nSegs int) *types.PersistentState {
@@ -128,3 +143,190 @@ func makeState(nSegs int) *types.PersistentState {
 	}
 	return state
 }
+
+func TestMetaDBStable(t *testing.T) {
+	requireBolt(t)
+
+	tmpDir, err := os.MkdirTemp("", "raft-wal-meta-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	var db BoltMetaDB
+	_, err = db.GetStable([]byte("foo"))
+	require.ErrorIs(t, err, ErrUnintialized)
+	require.ErrorIs(t, db.SetStable([]byte("foo"), []byte("bar")), ErrUnintialized)
+
+	_, err = db.Load(tmpDir)
+	require.NoError(t, err)
+
+	val, err := db.GetStable([]byte("foo"))
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	require.NoError(t, db.SetStable([]byte("foo"), []byte("bar")))
+	require.NoError(t, db.SetStable([]byte("baz"), []byte("qux")))
+	require.NoError(t, db.Close())
+
+	// Values persist across reopening.
+	db = BoltMetaDB{}
+	_, err = db.Load(tmpDir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val, err = db.GetStable([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(val))
+
+	// Setting nil deletes.
+	require.NoError(t, db.SetStable([]byte("foo"), nil))
+	val, err = db.GetStable([]byte("foo"))
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	val, err = db.GetStable([]byte("baz"))
+	require.NoError(t, err)
+	require.Equal(t, "qux", string(val))
+}
+
+func TestFlatMetaDB(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "raft-wal-meta-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	var db FlatMetaDB
+	require.ErrorIs(t, db.CommitState(types.PersistentState{NextSegmentID: 1234}), ErrUnintialized)
+
+	gotState, err := db.Load(tmpDir)
+	require.NoError(t, err)
+	require.Equal(t, 0, int(gotState.NextSegmentID))
+	require.Empty(t, gotState.Segments)
+
+	older, newer := makeState(3), makeState(4)
+	require.NoError(t, db.CommitState(*older))
+	require.NoError(t, db.SetStable([]byte("foo"), []byte("bar")))
+	require.NoError(t, db.CommitState(*newer))
+	require.NoError(t, db.Close())
+
+	// Both the state and stable values persist across reopening.
+	db = FlatMetaDB{}
+	gotState, err = db.Load(tmpDir)
+	require.NoError(t, err)
+	require.Equal(t, *newer, gotState)
+	val, err := db.GetStable([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(val))
+	require.NoError(t, db.SetStable([]byte("foo"), nil))
+	val, err = db.GetStable([]byte("foo"))
+	require.NoError(t, err)
+	require.Nil(t, val)
+	require.NoError(t, db.Close())
+
+	// If the newest copy is damaged the older one is used, losing the last
+	// change. The last SetStable was the fourth write so it went to file A.
+	path := filepath.Join(tmpDir, FlatFileA)
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	buf[len(buf)-2] ^= 0x1
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+	db = FlatMetaDB{}
+	gotState, err = db.Load(tmpDir)
+	require.NoError(t, err)
+	require.Equal(t, *newer, gotState)
+	val, err = db.GetStable([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(val))
+	require.NoError(t, db.Close())
+
+	// But not if both are.
+	path = filepath.Join(tmpDir, FlatFileB)
+	buf, err = os.ReadFile(path)
+	require.NoError(t, err)
+	buf[len(buf)-2] ^= 0x1
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+	db = FlatMetaDB{}
+	_, err = db.Load(tmpDir)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+
+	// Neither store will start afresh over the other's metadata.
+	requireBolt(t)
+	var bolt BoltMetaDB
+	_, err = bolt.Load(tmpDir)
+	require.ErrorContains(t, err, "already has metadata")
+
+	boltDir, err := os.MkdirTemp("", "raft-wal-meta-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(boltDir)
+	bolt = BoltMetaDB{}
+	_, err = bolt.Load(boltDir)
+	require.NoError(t, err)
+	require.NoError(t, bolt.Close())
+	db = FlatMetaDB{}
+	_, err = db.Load(boltDir)
+	require.ErrorContains(t, err, "already has metadata")
+}
+
+func TestFlatMetaDBVFS(t *testing.T) {
+	mem := fs.NewMem()
+	db := NewFlatMetaDB(mem)
+	_, err := db.Load("meta")
+	require.NoError(t, err)
+	state := types.PersistentState{NextSegmentID: 2, Segments: []types.SegmentInfo{{ID: 1, BaseIndex: 1}}}
+	require.NoError(t, db.CommitState(state))
+	require.NoError(t, db.SetStable([]byte("foo"), []byte("bar")))
+	require.NoError(t, db.Close())
+
+	names, err := mem.ListDir("meta")
+	require.NoError(t, err)
+	require.Equal(t, []string{FlatFileA, FlatFileB}, names)
+
+	db = NewFlatMetaDB(mem)
+	got, err := db.Load("meta")
+	require.NoError(t, err)
+	require.Equal(t, state, got)
+	val, err := db.GetStable([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(val))
+	require.NoError(t, db.Close())
+}
+
+func TestReadOnlyMetaDB(t *testing.T) {
+	state := types.PersistentState{NextSegmentID: 2, Segments: []types.SegmentInfo{{ID: 1, BaseIndex: 1}}}
+	stores := map[string]func(dir string) types.MetaStore{
+		"bolt": func(string) types.MetaStore { return &BoltMetaDB{} },
+		"flat": func(string) types.MetaStore { return &FlatMetaDB{} },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			if name == "bolt" {
+				requireBolt(t)
+			}
+			tmpDir, err := os.MkdirTemp("", "raft-wal-meta-test-*")
+			require.NoError(t, err)
+			defer os.RemoveAll(tmpDir)
+
+			db := newStore(tmpDir)
+			_, err = db.Load(tmpDir)
+			require.NoError(t, err)
+			require.NoError(t, db.CommitState(state))
+			require.NoError(t, db.SetStable([]byte("foo"), []byte("bar")))
+			require.NoError(t, db.Close())
+
+			ro := NewReadOnlyMetaDB(fs.NewReadOnly(os.DirFS(tmpDir)))
+			got, err := ro.Load(".")
+			require.NoError(t, err)
+			require.Equal(t, state, got)
+			val, err := ro.GetStable([]byte("foo"))
+			require.NoError(t, err)
+			require.Equal(t, "bar", string(val))
+			require.ErrorIs(t, ro.CommitState(state), types.ErrReadOnly)
+			require.ErrorIs(t, ro.SetStable([]byte("foo"), nil), types.ErrReadOnly)
+			require.NoError(t, ro.Close())
+		})
+	}
+
+	emptyDir, err := os.MkdirTemp("", "raft-wal-meta-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(emptyDir)
+	_, err = NewReadOnlyMetaDB(fs.New()).Load(emptyDir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
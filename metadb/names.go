@@ -0,0 +1,28 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import "errors"
+
+const (
+	// FileName is the default file name for the bolt db file.
+	FileName = "wal-meta.db"
+
+	// *Bucket are the names used for internal bolt buckets
+	MetaBucket   = "wal-meta"
+	StableBucket = "stable"
+
+	// We just need one key for now so use the byte 'm' for meta arbitrarily.
+	MetaKey = "m"
+)
+
+var (
+	// ErrUnintialized is returned when any call is made before Load has opened
+	// the DB file.
+	ErrUnintialized = errors.New("uninitialized")
+
+	// ErrBoltUnsupported is returned by BoltMetaDB on platforms BoltDB doesn't
+	// build for, such as WebAssembly. Use FlatMetaDB there instead.
+	ErrBoltUnsupported = errors.New("BoltDB is not supported on this platform")
+)
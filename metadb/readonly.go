@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// ReadOnlyMetaDB implements types.MetaStore for a WAL that is only read. Load
+// reads the metadata and the whole stable store into memory from a types.VFS,
+// whether it was written by BoltMetaDB or FlatMetaDB. Since BoltDB can only
+// read real files, a wal-meta.db is first copied to a temporary file that is
+// removed again before Load returns. CommitState and SetStable fail with
+// types.ErrReadOnly.
+type ReadOnlyMetaDB struct {
+	mu     sync.Mutex
+	vfs    types.VFS
+	loaded bool
+	stable map[string][]byte
+}
+
+// NewReadOnlyMetaDB returns a ReadOnlyMetaDB that reads from vfs.
+func NewReadOnlyMetaDB(vfs types.VFS) *ReadOnlyMetaDB {
+	return &ReadOnlyMetaDB{vfs: vfs}
+}
+
+// Load implements types.MetaStore. Unlike other MetaStores it doesn't start
+// an empty log if there's no metadata in dir but returns an error wrapping
+// os.ErrNotExist.
+func (db *ReadOnlyMetaDB) Load(dir string) (types.PersistentState, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	names, err := db.vfs.ListDir(dir)
+	if err != nil {
+		return types.PersistentState{}, err
+	}
+	for _, name := range names {
+		switch name {
+		case FileName:
+			return db.loadBolt(dir)
+		case FlatFileA, FlatFileB:
+			flat := NewFlatMetaDB(db.vfs)
+			state, err := flat.Load(dir)
+			if err != nil {
+				return state, err
+			}
+			db.loaded, db.stable = true, flat.stable
+			return state, nil
+		}
+	}
+	return types.PersistentState{}, fmt.Errorf("no WAL metadata found in %s: %w", dir, os.ErrNotExist)
+}
+
+// CommitState implements types.MetaStore. It always fails with
+// types.ErrReadOnly.
+func (db *ReadOnlyMetaDB) CommitState(types.PersistentState) error {
+	return types.ErrReadOnly
+}
+
+// GetStable implements types.MetaStore.
+func (db *ReadOnlyMetaDB) GetStable(key []byte) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.loaded {
+		return nil, ErrUnintialized
+	}
+	val, ok := db.stable[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// SetStable implements types.MetaStore. It always fails with
+// types.ErrReadOnly.
+func (db *ReadOnlyMetaDB) SetStable(key []byte, value []byte) error {
+	return types.ErrReadOnly
+}
+
+// Close implements io.Closer.
+func (db *ReadOnlyMetaDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.loaded, db.stable = false, nil
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !wasm
+
+package metadb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/dreamsxin/wal/types"
+	"go.etcd.io/bbolt"
+)
+
+// loadBolt reads the state and stable store from the wal-meta.db in dir.
+func (db *ReadOnlyMetaDB) loadBolt(dir string) (types.PersistentState, error) {
+	var state types.PersistentState
+
+	tmpName, err := db.copyToTemp(dir, FileName)
+	if err != nil {
+		return state, err
+	}
+	defer os.Remove(tmpName)
+
+	bb, err := bbolt.Open(tmpName, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		return state, fmt.Errorf("failed to open %s: %w", FileName, err)
+	}
+	defer bb.Close()
+
+	stable := make(map[string][]byte)
+	err = bb.View(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket([]byte(MetaBucket))
+		if meta == nil {
+			return fmt.Errorf("%w: %s has no %s bucket", types.ErrCorrupt, FileName, MetaBucket)
+		}
+		if raw := meta.Get([]byte(MetaKey)); raw != nil {
+			if err := json.Unmarshal(raw, &state); err != nil {
+				return fmt.Errorf("%w: failed to parse persisted state: %s", types.ErrCorrupt, err)
+			}
+		}
+		if b := tx.Bucket([]byte(StableBucket)); b != nil {
+			return b.ForEach(func(k, v []byte) error {
+				stable[string(k)] = append([]byte(nil), v...)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return types.PersistentState{}, err
+	}
+	db.loaded, db.stable = true, stable
+	return state, nil
+}
+
+// copyToTemp copies the file name in dir to a new temporary file on the OS
+// file system and returns its path.
+func (db *ReadOnlyMetaDB) copyToTemp(dir, name string) (string, error) {
+	rf, err := db.vfs.OpenReader(dir, name)
+	if err != nil {
+		return "", err
+	}
+	defer rf.Close()
+
+	tmp, err := os.CreateTemp("", "wal-meta-*.db")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(rf, 0, math.MaxInt64))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to copy %s: %w", name, err)
+	}
+	return tmp.Name(), nil
+}
@@ -4,8 +4,12 @@
 package wal
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dreamsxin/wal/segment"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type walMetrics struct {
@@ -18,41 +22,95 @@ type walMetrics struct {
 	entriesTruncated      *prometheus.CounterVec
 	truncations           *prometheus.CounterVec
 	lastSegmentAgeSeconds prometheus.Gauge
+	freeBytes             prometheus.Gauge
+	stableGets            prometheus.Counter
+	stableSets            prometheus.Counter
+	entryCacheHits        prometheus.Counter
+	entryCacheMisses      prometheus.Counter
+	readErrors            *prometheus.CounterVec
+	metaCommits           *prometheus.CounterVec
+	metaCommitSeconds     prometheus.Histogram
+	segmentsScrubbed      prometheus.Counter
+	appendsThrottled      prometheus.Counter
+	pendingAppendBytes    prometheus.Gauge
+}
+
+// metricsRegisterer returns the registerer the WAL's metrics are registered
+// with, which adds the namespace, subsystem and labels set by
+// WithMetricsNamespace and WithMetricsConstLabels.
+func (w *WAL) metricsRegisterer() (prometheus.Registerer, error) {
+	reg := w.reg
+	if len(w.metricsLabels) > 0 {
+		for name := range w.metricsLabels {
+			if !validMetricName(name) || strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("invalid metrics label name %q", name)
+			}
+		}
+		reg = prometheus.WrapRegistererWith(w.metricsLabels, reg)
+	}
+	var prefix string
+	for _, p := range []string{w.metricsNamespace, w.metricsSubsystem} {
+		if p == "" {
+			continue
+		}
+		if !validMetricName(p) {
+			return nil, fmt.Errorf("invalid metrics namespace or subsystem %q", p)
+		}
+		prefix += p + "_"
+	}
+	if prefix != "" {
+		reg = prometheus.WrapRegistererWithPrefix(prefix, reg)
+	}
+	return reg, nil
 }
 
-func newWALMetrics(reg prometheus.Registerer) *walMetrics {
+// validMetricName reports whether s can be used as, or as part of, a metric
+// or label name.
+func validMetricName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func newWALMetrics(f *metricsFactory) *walMetrics {
 	return &walMetrics{
-		bytesWritten: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		bytesWritten: f.NewCounter(prometheus.CounterOpts{
 			Name: "entry_bytes_written",
 			Help: "entry_bytes_written counts the bytes of log entry after encoding." +
 				" Actual bytes written to disk might be slightly higher as it" +
 				" includes headers and index entries.",
 		}),
-		entriesWritten: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		entriesWritten: f.NewCounter(prometheus.CounterOpts{
 			Name: "entries_written",
 			Help: "entries_written counts the number of entries written.",
 		}),
-		appends: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		appends: f.NewCounter(prometheus.CounterOpts{
 			Name: "appends",
 			Help: "appends counts the number of calls to StoreLog(s) i.e." +
 				" number of batches of entries appended.",
 		}),
-		entryBytesRead: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		entryBytesRead: f.NewCounter(prometheus.CounterOpts{
 			Name: "entry_bytes_read",
 			Help: "entry_bytes_read counts the bytes of log entry read from" +
 				" segments before decoding. actual bytes read from disk might be higher" +
 				" as it includes headers and index entries and possible secondary reads" +
 				" for large entries that don't fit in buffers.",
 		}),
-		entriesRead: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		entriesRead: f.NewCounter(prometheus.CounterOpts{
 			Name: "entries_read",
 			Help: "entries_read counts the number of calls to get_log.",
 		}),
-		segmentRotations: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		segmentRotations: f.NewCounter(prometheus.CounterOpts{
 			Name: "segment_rotations",
 			Help: "segment_rotations counts how many times we move to a new segment file.",
 		}),
-		entriesTruncated: promauto.With(reg).NewCounterVec(
+		entriesTruncated: f.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "entries_truncated_total",
 				Help: "entries_truncated counts how many log entries have been truncated" +
@@ -60,7 +118,7 @@ func newWALMetrics(reg prometheus.Registerer) *walMetrics {
 			},
 			[]string{"type"},
 		),
-		truncations: promauto.With(reg).NewCounterVec(
+		truncations: f.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "truncations_total",
 				Help: "truncations is the number of truncate calls categorized by whether" +
@@ -68,12 +126,145 @@ func newWALMetrics(reg prometheus.Registerer) *walMetrics {
 			},
 			[]string{"type", "success"},
 		),
-		lastSegmentAgeSeconds: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		freeBytes: f.NewGauge(prometheus.GaugeOpts{
+			Name: "free_bytes",
+			Help: "free_bytes is the free space on the filesystem segments are" +
+				" being written to, as last checked when a segment was created or," +
+				" if a reserve is set, when entries were appended.",
+		}),
+		lastSegmentAgeSeconds: f.NewGauge(prometheus.GaugeOpts{
 			Name: "last_segment_age_seconds",
 			Help: "last_segment_age_seconds is a gauge that is set each time we" +
 				" rotate a segment and describes the number of seconds between when" +
 				" that segment file was first created and when it was sealed. this" +
 				" gives a rough estimate how quickly writes are filling the disk.",
 		}),
+		stableGets: f.NewCounter(prometheus.CounterOpts{
+			Name: "stable_gets",
+			Help: "stable_gets counts how many calls are made to GetStable, Get or GetUint64.",
+		}),
+		stableSets: f.NewCounter(prometheus.CounterOpts{
+			Name: "stable_sets",
+			Help: "stable_sets counts how many calls are made to SetStable, Set or SetUint64.",
+		}),
+		entryCacheHits: f.NewCounter(prometheus.CounterOpts{
+			Name: "entry_cache_hits",
+			Help: "entry_cache_hits counts calls to get_log served from the entry cache.",
+		}),
+		entryCacheMisses: f.NewCounter(prometheus.CounterOpts{
+			Name: "entry_cache_misses",
+			Help: "entry_cache_misses counts calls to get_log that weren't in the entry" +
+				" cache and had to read from segments.",
+		}),
+		readErrors: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "read_errors_total",
+				Help: "read_errors_total counts reads that failed because segment data" +
+					" is damaged or missing, categorized by kind (checksum for data that" +
+					" doesn't match its checksum, unexpected_eof for data that ends early" +
+					" and corrupt for anything else that wraps ErrCorrupt) and by phase" +
+					" (recovery while opening, read, verify and scrub).",
+			},
+			[]string{"kind", "phase"},
+		),
+		metaCommits: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "meta_commits_total",
+				Help: "meta_commits_total counts how many times the segment list is" +
+					" committed to the meta store, which happens on every rotation and" +
+					" truncation, categorized by whether the commit was successful or not.",
+			},
+			[]string{"success"},
+		),
+		metaCommitSeconds: f.NewHistogram(prometheus.HistogramOpts{
+			Name: "meta_commit_seconds",
+			Help: "meta_commit_seconds is the time taken to commit the segment list" +
+				" to the meta store. appends wait for commits during rotation so slow" +
+				" commits hold up writes.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}),
+		appendsThrottled: f.NewCounter(prometheus.CounterOpts{
+			Name: "appends_throttled",
+			Help: "appends_throttled counts appends that had to wait for, or were" +
+				" rejected by, the write rate limit.",
+		}),
+		pendingAppendBytes: f.NewGauge(prometheus.GaugeOpts{
+			Name: "pending_append_bytes",
+			Help: "pending_append_bytes is the entry bytes of appends waiting to be" +
+				" written and synced, when WithMaxPendingBytes is used.",
+		}),
+		segmentsScrubbed: f.NewCounter(prometheus.CounterOpts{
+			Name: "segments_scrubbed",
+			Help: "segments_scrubbed counts sealed segments verified by the background scrubber.",
+		}),
+	}
+}
+
+// registerBlockCacheMetrics exposes the hit and miss counts of a segment block
+// cache.
+func registerBlockCacheMetrics(f *metricsFactory, c *segment.BlockCache) {
+	f.NewCounterFunc(prometheus.CounterOpts{
+		Name: "block_cache_hits",
+		Help: "block_cache_hits counts reads of sealed segment blocks served from the block cache.",
+	}, func() float64 { return float64(c.Hits()) })
+	f.NewCounterFunc(prometheus.CounterOpts{
+		Name: "block_cache_misses",
+		Help: "block_cache_misses counts reads of sealed segment blocks that had to read the file.",
+	}, func() float64 { return float64(c.Misses()) })
+}
+
+// metricsFactory creates metrics and registers them like promauto, except that
+// a metric another WAL already registered with the same registerer is reused
+// rather than panicking, so that several WALs can share a registerer. Shared
+// counters and histograms add up what each WAL records, but a shared gauge
+// only holds whatever WAL set it last and a shared func only reports the WAL
+// that registered it, so those are listed in shared for the WAL to warn
+// about. WithMetricsConstLabels keeps them apart.
+type metricsFactory struct {
+	reg    prometheus.Registerer
+	shared []string
+}
+
+// register registers c and returns it, or the collector registered before it
+// with the same name and labels along with true.
+func (f *metricsFactory) register(c prometheus.Collector) (prometheus.Collector, bool) {
+	if err := f.reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector, true
+		}
+		panic(err)
+	}
+	return c, false
+}
+
+func (f *metricsFactory) NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	c, _ := f.register(prometheus.NewCounter(opts))
+	return c.(prometheus.Counter)
+}
+
+func (f *metricsFactory) NewCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	c, _ := f.register(prometheus.NewCounterVec(opts, labels))
+	return c.(*prometheus.CounterVec)
+}
+
+func (f *metricsFactory) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	c, reused := f.register(prometheus.NewGauge(opts))
+	if reused {
+		f.shared = append(f.shared, opts.Name)
+	}
+	return c.(prometheus.Gauge)
+}
+
+func (f *metricsFactory) NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	c, _ := f.register(prometheus.NewHistogram(opts))
+	return c.(prometheus.Histogram)
+}
+
+// NewCounterFunc registers a counter that calls fn. If one is already
+// registered fn is dropped and only the first WAL's fn is reported.
+func (f *metricsFactory) NewCounterFunc(opts prometheus.CounterOpts, fn func() float64) {
+	if _, reused := f.register(prometheus.NewCounterFunc(opts, fn)); reused {
+		f.shared = append(f.shared, opts.Name)
 	}
 }
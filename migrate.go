@@ -0,0 +1,184 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+)
+
+// migrateBatchSize is how many entries MigrateFormat copies at once.
+const migrateBatchSize = 256
+
+// MigrateFormat rewrites every sealed segment written in an older format than
+// segment.FormatVersion, including those written by upstream
+// hashicorp/raft-wal, in the current format. Each is replaced atomically so
+// readers and appends carry on meanwhile, although appends are blocked while
+// each segment is copied. The tail segment is left as it is until it's
+// sealed. Entries that were written without an append time are given the time
+// they are rewritten. It returns the number of segments rewritten.
+func (w *WAL) MigrateFormat(ctx context.Context) (int, error) {
+	if err := w.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	s, release := w.acquireState()
+	var old []types.SegmentInfo
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if !seg.SealTime.IsZero() && seg.FormatVersion < segment.FormatVersion {
+			old = append(old, seg.SegmentInfo)
+		}
+	}
+	release()
+
+	n := 0
+	for _, info := range old {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if err := w.checkClosed(); err != nil {
+			return n, err
+		}
+		if !w.waitIO(ctx.Done(), approxFileSize(info)) {
+			return n, ctx.Err()
+		}
+		migrated, err := w.migrateSegment(info)
+		if err != nil {
+			return n, fmt.Errorf("failed to migrate segment %d: %w", info.ID, err)
+		}
+		if migrated {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// migrateSegment copies the entries of the sealed segment described by info
+// into one or more new segments in the current format and swaps them in for
+// it. It returns false if the segment was truncated away in the meantime.
+func (w *WAL) migrateSegment(info types.SegmentInfo) (bool, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if awaitCh := w.awaitRotate; awaitCh != nil {
+		w.writeMu.Unlock()
+		<-awaitCh
+		w.writeMu.Lock()
+	}
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+
+	old, ok := w.loadState().segments.Get(info.BaseIndex)
+	if !ok || old.ID != info.ID || old.SealTime.IsZero() {
+		return false, nil
+	}
+
+	var (
+		done []segmentState
+		cur  types.SegmentInfo
+		sw   types.SegmentWriter
+	)
+	fail := func(err error) (bool, error) {
+		toDelete := make(map[uint64]uint64)
+		toClose := make([]io.Closer, 0, len(done)+1)
+		for _, ss := range done {
+			toDelete[ss.ID] = ss.BaseIndex
+			toClose = append(toClose, ss.r)
+		}
+		if sw != nil {
+			toDelete[cur.ID] = cur.BaseIndex
+			toClose = append(toClose, sw)
+		}
+		w.closeSegments(toClose)
+		w.deleteSegments(toDelete, AuditRecord{Reason: "partial copy from a failed format migration"})
+		return false, err
+	}
+	finish := func(indexStart uint64) {
+		cur.MaxIndex = sw.LastIndex()
+		cur.IndexStart = indexStart
+		cur.SealTime = old.SealTime
+		if cs, ok := sw.(types.SegmentChecksummer); ok {
+			cur.Checksum, _ = cs.SealedChecksum()
+		}
+		done = append(done, segmentState{SegmentInfo: cur, r: sw})
+		sw = nil
+	}
+
+	batch := make([]types.LogEntry, 0, migrateBatchSize)
+	for idx := old.MinIndex; idx <= old.MaxIndex; {
+		batch = batch[:0]
+		for ; idx <= old.MaxIndex && len(batch) < migrateBatchSize; idx++ {
+			var le types.LogEntry
+			if err := old.r.GetLog(idx, &le); err != nil {
+				return fail(err)
+			}
+			le.Index = idx
+			batch = append(batch, le)
+		}
+
+		if sw == nil {
+			// Commit the new segment's ID before creating its file, as for any
+			// other new segment, so it's never reused after a crash.
+			var id uint64
+			err := w.mutateStateLocked(func(s *state) (func(), func() error, error) {
+				id = s.nextSegmentID
+				s.nextSegmentID++
+				return nil, nil, nil
+			})
+			if err != nil {
+				return fail(err)
+			}
+			cur = w.newSegment(id, batch[0].Index)
+			cur.CreateTime = old.CreateTime
+			cur.Dir = old.Dir
+			sw, err = w.sf.Create(cur)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		if err := sw.Append(batch); err != nil {
+			return fail(err)
+		}
+		sealed, indexStart, err := sw.Sealed()
+		if err != nil {
+			return fail(err)
+		}
+		if sealed {
+			finish(indexStart)
+		}
+	}
+	if sw != nil {
+		sealer, ok := sw.(types.SegmentSealer)
+		if !ok {
+			return fail(fmt.Errorf("migration isn't supported by the SegmentFiler in use"))
+		}
+		indexStart, err := sealer.Seal()
+		if err != nil {
+			return fail(err)
+		}
+		finish(indexStart)
+	}
+
+	err := w.mutateStateLocked(func(s *state) (func(), func() error, error) {
+		s.segments = s.segments.Delete(old.BaseIndex)
+		for _, ss := range done {
+			s.segments = s.segments.Set(ss.BaseIndex, ss)
+		}
+		fin := func() {
+			w.closeSegments([]io.Closer{old.r})
+			w.deleteSegments(map[uint64]uint64{old.ID: old.BaseIndex},
+				AuditRecord{Reason: "replaced by a copy in the current format"})
+		}
+		return fin, nil, nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	return true, nil
+}
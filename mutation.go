@@ -0,0 +1,47 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+var payloadTable = crc32.MakeTable(crc32.Castagnoli)
+
+// payloadSums holds a checksum of the Meta and Data of each entry of an append
+// so that WithMutationCheck can tell if the caller changed them before the
+// append finished.
+type payloadSums []uint32
+
+// sumPayloads returns the checksums of entries' payloads if WithMutationCheck
+// is set, or nil otherwise, which verify treats as nothing to check.
+func (w *WAL) sumPayloads(entries []types.LogEntry) payloadSums {
+	if !w.mutationCheck {
+		return nil
+	}
+	sums := make(payloadSums, len(entries))
+	for i, e := range entries {
+		sums[i] = sumPayload(e)
+	}
+	return sums
+}
+
+func sumPayload(e types.LogEntry) uint32 {
+	return crc32.Update(crc32.Checksum(e.Meta, payloadTable), payloadTable, e.Data)
+}
+
+// verify panics if the payload of any of entries no longer matches its
+// checksum. stage says how far the append had got, for the message.
+func (ps payloadSums) verify(entries []types.LogEntry, stage string) {
+	for i, sum := range ps {
+		if sumPayload(entries[i]) != sum {
+			panic(fmt.Sprintf("wal: the Data or Meta of entry %d passed to StoreLogs "+
+				"was modified %s; callers must not change an append's buffers until "+
+				"StoreLogs returns, or must use WithCopyOnAppend", entries[i].Index, stage))
+		}
+	}
+}
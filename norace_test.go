@@ -0,0 +1,8 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !race
+
+package wal
+
+const raceEnabled = false
@@ -4,22 +4,66 @@
 package wal
 
 import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
 	"github.com/dreamsxin/wal/fs"
 	"github.com/dreamsxin/wal/metadb"
 	"github.com/dreamsxin/wal/segment"
 	"github.com/dreamsxin/wal/types"
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 )
 
 // WithMetaStore is an option that allows a custom MetaStore to be provided to
-// the WAL. If not used the default MetaStore is used.
+// the WAL, for example to keep the WAL's metadata inside a database the caller
+// already has. If not used the default MetaStore is used. The WAL calls Load
+// with its dir when opened and takes ownership of db, closing it when the WAL
+// is closed. db must meet the durability guarantees documented on
+// types.MetaStore and may only back one WAL.
 func WithMetaStore(db types.MetaStore) walOpt {
 	return func(w *WAL) {
 		w.metaDB = db
 	}
 }
 
+// WithFlatMetaStore is an option that keeps the WAL's metadata in a pair of
+// checksummed flat files using metadb.FlatMetaDB rather than in BoltDB. It
+// suits logs that make little use of the stable store, since each SetStable
+// rewrites the whole file. A log can't switch between the two once created.
+func WithFlatMetaStore() walOpt {
+	return func(w *WAL) {
+		w.flatMeta = true
+	}
+}
+
+// WithVFS is an option that makes the default SegmentFiler and MetaStore keep
+// their files in vfs rather than going straight to the OS, for example to use
+// an fs.MemFS in tests. Since BoltDB can only use the OS file system, the
+// metadata is kept as with WithFlatMetaStore.
+func WithVFS(vfs types.VFS) walOpt {
+	return func(w *WAL) {
+		w.vfs = vfs
+	}
+}
+
+// WithIOUring is an experimental option that makes the default SegmentFiler
+// read, write and sync segment files through io_uring, with one ring shared
+// by every WAL in the process, rather than making a syscall for each. It only
+// works in binaries built for Linux with the iouring build tag, and Open fails
+// with an error wrapping fs.ErrIOUringUnsupported otherwise. The metadata
+// isn't affected. It has no effect if WithVFS or WithSegmentFiler is used.
+func WithIOUring() walOpt {
+	return func(w *WAL) {
+		w.ioUring = true
+	}
+}
+
 // WithSegmentFiler is an option that allows a custom SegmentFiler (and hence
 // Segment Reader/Writer implementation) to be provided to the WAL. If not used
 // the default SegmentFiler is used.
@@ -43,36 +87,787 @@ func WithSegmentSize(size int) walOpt {
 	}
 }
 
+// WithInitialBaseIndex is an option that makes a brand new WAL start its first
+// segment at idx rather than 1. A log can start at any index anyway, but if the
+// first append isn't at the first segment's base index the empty segment has
+// to be deleted and created again, which a new node restored from a snapshot
+// can avoid by passing the snapshot's index plus one. It has no effect on an
+// existing log. An idx of 0 is treated as 1.
+func WithInitialBaseIndex(idx uint64) walOpt {
+	return func(w *WAL) {
+		w.initialBaseIndex = idx
+	}
+}
+
 // WithMetricsRegisterer is an option that allows specifying a custom prometheus
-// metrics registerer.
+// metrics registerer. Several WALs may share one, in which case their counters
+// and histograms are added together unless WithMetricsConstLabels gives each
+// different labels. Gauges such as free_bytes and block cache counters can't
+// be added up so only report one of them, and Open logs a warning.
 func WithMetricsRegisterer(reg prometheus.Registerer) walOpt {
 	return func(w *WAL) {
 		w.reg = reg
 	}
 }
 
+// WithMetricsNamespace is an option that puts namespace and subsystem in front
+// of the name of every metric, as a Prometheus namespace and subsystem would,
+// so that several WALs, or a WAL and other components, can share a registerer
+// without their metrics colliding. Either may be empty.
+func WithMetricsNamespace(namespace, subsystem string) walOpt {
+	return func(w *WAL) {
+		w.metricsNamespace = namespace
+		w.metricsSubsystem = subsystem
+	}
+}
+
+// WithMetricsConstLabels is an option that adds labels to every metric, for
+// example to tell apart the metrics of several WALs in the same registerer.
+func WithMetricsConstLabels(labels prometheus.Labels) walOpt {
+	return func(w *WAL) {
+		w.metricsLabels = labels
+	}
+}
+
+// WithEntryCache is an option that enables an in-memory LRU cache of up to
+// maxEntries recently appended or read entries in front of segment reads.
+func WithEntryCache(maxEntries int) walOpt {
+	return func(w *WAL) {
+		w.cacheEntries = maxEntries
+	}
+}
+
+// WithEntryCacheBytes is an option that enables the entry cache bounded by the
+// total size of cached entries' Data. It may be combined with WithEntryCache in
+// which case both limits apply.
+func WithEntryCacheBytes(maxBytes int) walOpt {
+	return func(w *WAL) {
+		w.cacheBytes = maxBytes
+	}
+}
+
+// WithBlockCache is an option that enables a cache of up to maxBytes of data
+// read from sealed segments. It has no effect if WithSegmentFiler is used.
+func WithBlockCache(maxBytes int) walOpt {
+	return func(w *WAL) {
+		w.blockCacheBytes = maxBytes
+	}
+}
+
+// WithTailBuffer is an option that keeps up to maxBytes of the most recently
+// appended data of the tail segment in memory so that reads of recent entries
+// never touch the file. It has no effect if WithSegmentFiler is used.
+func WithTailBuffer(maxBytes int) walOpt {
+	return func(w *WAL) {
+		w.tailBufferBytes = maxBytes
+	}
+}
+
+// WithReadAhead is an option that makes sequential reads of sealed segments,
+// such as replaying the log from the start, read the file in chunks of size
+// bytes and prefetch the next chunk in the background. It has no effect if
+// WithSegmentFiler is used.
+func WithReadAhead(size int) walOpt {
+	return func(w *WAL) {
+		w.readAheadSize = size
+	}
+}
+
+// WithEvictSealedFromPageCache is an option that drops each segment file from
+// the OS page cache as soon as it's sealed. Large logs that are rarely read
+// back then don't evict the application's own working set. It has no effect
+// if WithSegmentFiler is used.
+func WithEvictSealedFromPageCache() walOpt {
+	return func(w *WAL) {
+		w.evictSealed = true
+	}
+}
+
+// WithDoubleWrite is an option that protects entries that are already
+// committed from a torn write of the batch after them, on storage that may
+// damage a whole sector when a write to part of it is interrupted. Before
+// each batch the committed part of the sector it starts in is saved to a
+// small file beside the tail segment, which recovery writes back. It costs an
+// extra write and fsync of up to 4KiB per batch. It has no effect if
+// WithSegmentFiler is used.
+func WithDoubleWrite() walOpt {
+	return func(w *WAL) {
+		w.doubleWrite = true
+	}
+}
+
+// WithSealedMarkers is an option that creates an empty marker file beside
+// each segment when it's sealed, whose name records the segment's MaxIndex as
+// segment.WithSealedMarkers describes, so tools can see which entries each
+// sealed file holds by listing the WAL's dirs. It has no effect if
+// WithSegmentFiler is used.
+func WithSealedMarkers() walOpt {
+	return func(w *WAL) {
+		w.sealedMarkers = true
+	}
+}
+
+// WithManifest is an option that keeps a manifest of the WAL's segment files
+// beside its metadata, as segment.WithManifest describes, so Open reads that
+// rather than listing the WAL's dirs to find segments left behind by a crash.
+// That's worth having when the dirs hold tens of thousands of files or are on
+// a network filesystem. Read-only WALs list the dirs as usual. If the WAL was
+// opened without the option since the manifest was last kept, Open finds it
+// has missed segments and rebuilds it. It has no effect if WithSegmentFiler is
+// used.
+func WithManifest() walOpt {
+	return func(w *WAL) {
+		w.manifest = true
+	}
+}
+
+// WithVerifyOnRead is an option that checks each entry's checksum every time
+// it's read rather than only relying on recovery to detect corruption. Reads
+// of corrupt entries return an error wrapping ErrCorrupt that identifies the
+// segment file and offset. It has no effect if WithSegmentFiler is used.
+func WithVerifyOnRead() walOpt {
+	return func(w *WAL) {
+		w.verifyOnRead = true
+	}
+}
+
+// WithHMAC is an option that signs every segment with an HMAC-SHA256 of the
+// whole file when it's sealed using keys' current key. This gives integrity
+// protection without encryption. If strict is true the signature of every
+// sealed segment is checked when it's opened, which reads the whole segment,
+// and unsigned or modified segments fail to open with ErrCorrupt. It has no
+// effect if WithSegmentFiler is used.
+func WithHMAC(keys types.KeyProvider, strict bool) walOpt {
+	return func(w *WAL) {
+		w.hmacKeys = keys
+		w.strictHMAC = strict
+	}
+}
+
+// WithIndexInterval is an option that makes segments only index every nth
+// entry, both in memory while they are the tail and in the index written when
+// they are sealed. Reading any other entry means reading through the frame
+// headers after the nearest indexed one, so larger values trade a little read
+// CPU for smaller indexes, which matters most for logs of tiny entries. Older
+// versions can't read segments written with an interval above 1. If
+// WithSegmentFiler is used new segments are still marked sparse in their
+// SegmentInfo but it's up to the SegmentFiler how they are indexed.
+func WithIndexInterval(n int) walOpt {
+	return func(w *WAL) {
+		w.indexInterval = n
+	}
+}
+
+// WithCompression is an option that compresses the data of appended entries
+// with the compression codec registered with ID id, such as
+// segment.CompressionDeflate. Other codecs are registered with
+// segment.RegisterCompression. Entries that WithCompressionPolicy says aren't
+// worth it, and those too big for a single frame, are stored as they are.
+// Only segments created
+// with the option set are compressed, and versions that don't support
+// compression can't read them. Reading a compressed entry needs its codec to
+// be registered whatever the option is set to. If WithSegmentFiler is used new
+// segments are still marked as compressed in their SegmentInfo but it's up to
+// the SegmentFiler whether they are.
+func WithCompression(id uint8) walOpt {
+	return func(w *WAL) {
+		w.compression = id
+	}
+}
+
+// WithCompressionPolicy is an option that sets which entries WithCompression
+// compresses: those big enough, and whose sample compresses well enough, that
+// it's worth the CPU. Fields left as zero take their defaults, so without the
+// option entries under 128 bytes, and those whose first 4KiB doesn't compress
+// to 90% or less, aren't compressed. Whether an entry is compressed is
+// recorded in its frame so changing the policy doesn't affect reading.
+func WithCompressionPolicy(p segment.CompressionPolicy) walOpt {
+	return func(w *WAL) {
+		w.compressPolicy = p
+	}
+}
+
+// WithCompressionDictionary is an option that compresses new segments with
+// dict as a preset dictionary, for example one returned by TrainDictionary
+// earlier. It needs WithCompression with a codec that supports dictionaries,
+// such as segment.CompressionDeflate, and a SegmentFiler that implements
+// types.SegmentDictionaries as the default one does.
+func WithCompressionDictionary(dict []byte) walOpt {
+	return func(w *WAL) {
+		w.compressDict = dict
+	}
+}
+
+// WithEncryption is an option that encrypts the data of appended entries with
+// the cipher suite suite, segment.CipherAES256GCM or
+// segment.CipherChaCha20Poly1305, using keys' current key, which must be
+// segment.CipherKeySize bytes. Each entry's data is sealed with a random nonce
+// and bound to its index; its Type and Meta aren't encrypted. Entries are
+// compressed before they're encrypted, and ones too big for a single frame
+// are refused with segment.ErrEncryptedTooBig rather than chunked. The suite
+// is recorded in each segment's SegmentInfo.Cipher, and the key's ID in each
+// entry, so the suite can be changed for new segments and keys rotated while
+// older segments stay readable as long as keys still returns their keys.
+// Builds made with GOEXPERIMENT=boringcrypto only offer AES-GCM, done by the
+// BoringCrypto module, and refuse ChaCha20-Poly1305 for both writing and
+// reading; see segment.FIPSOnly. Only segments created with the option set
+// are encrypted, and versions that don't support encryption can't read them.
+// If WithSegmentFiler is used new segments are still marked as encrypted in
+// their SegmentInfo but it's up to the SegmentFiler whether they are. The
+// MetaStore's segment metadata and stable values, such as raft's CurrentTerm,
+// are encrypted too, whichever MetaStore is used. Plaintext metadata from
+// before the option was set is encrypted as it's next written or read, but
+// once it's encrypted the WAL can only be opened with the option.
+func WithEncryption(keys types.KeyProvider, suite uint8) walOpt {
+	return func(w *WAL) {
+		w.encryptKeys = keys
+		w.cipherSuite = suite
+	}
+}
+
+// WithAuditLog is an option that records every TruncateFront, TruncateBack
+// and ResetTo that succeeds, and every segment deleted, in an audit log kept
+// in the MetaStore's stable store, which AuditLog returns. Each record has the
+// time, the range of indexes removed and the reason given to the WithReason
+// variants of the methods, or why the WAL deleted a segment itself. Records
+// are only ever added, but once there are more than keep the oldest are
+// dropped; zero keeps them all. Each record costs a couple of stable store
+// writes, made after the operation has released its locks. Records are
+// encrypted along with the rest of the stable store by WithEncryption.
+func WithAuditLog(keep int) walOpt {
+	return func(w *WAL) {
+		w.auditOn = true
+		w.auditKeep = keep
+	}
+}
+
+// WithDeleteGracePeriod is an option that keeps the files of segments the WAL
+// deletes, after truncations or for any other reason, for d before deleting
+// them for good, so that an accidental truncation can still be undone by
+// hand. Deleted segments are moved to the segment.TrashDir subdirectory of
+// the dir they were in, named as segment.WithTrash describes, and purged in
+// the background. Since truncated segments stay on disk for d they still
+// count against free space until then. If WithSegmentFiler is used the
+// SegmentFiler must implement types.SegmentTrash, and WithVFS's VFS must
+// implement types.FileMover.
+func WithDeleteGracePeriod(d time.Duration) walOpt {
+	return func(w *WAL) {
+		w.deleteGrace = d
+	}
+}
+
+// WithArchiveOnTruncate is an option that hands each segment TruncateFront
+// removes to a, to move or upload somewhere it's kept, before the segment is
+// deleted. That makes truncating the head of the log, as raft does after a
+// snapshot, a retention policy rather than the end of the data. Segments are
+// archived once no reads are using them, usually by TruncateFront before it
+// returns. They're recorded in the stable store before the truncation is
+// committed, so those that fail to archive, or aren't archived because of a
+// crash, are left where they are and retried the next time the WAL is opened
+// rather than deleted. If it's opened without this option they're deleted
+// instead. Segments removed by TruncateBack or ResetTo are deleted as usual.
+// If WithSegmentFiler is used the SegmentFiler must be able to open segment
+// files, as the default can.
+func WithArchiveOnTruncate(a Archiver) walOpt {
+	return func(w *WAL) {
+		w.archiver = a
+	}
+}
+
+// WithSegmentMerging is an option that merges runs of small sealed segments
+// into larger ones, and reclaims the space left in segments by TruncateBack,
+// once per interval in the background, as MergeSegments describes. Segments
+// are small if they're less than a quarter of the segment size.
+func WithSegmentMerging(interval time.Duration) walOpt {
+	return func(w *WAL) {
+		w.mergeEvery = interval
+	}
+}
+
+// WithKeyLocking is an option that locks the copies of encryption keys the WAL
+// keeps into memory so they're never written to swap, as
+// segment.WithKeyLocking describes. Copies are kept so that reading older
+// entries and metadata doesn't fetch their keys every time, and are zeroed when
+// the WAL is closed or, for the previous current key, when the KeyProvider's
+// current key changes. A KeyProvider that implements types.KeyReleaser has its
+// keys fetched for each use and released straight afterwards instead, so none
+// are kept at all. Fetching a key fails if it can't be locked, for example
+// because RLIMIT_MEMLOCK is too low. It needs WithEncryption and is only
+// supported on Linux and macOS.
+func WithKeyLocking() walOpt {
+	return func(w *WAL) {
+		w.lockKeys = true
+	}
+}
+
+// WithStrictRecovery is an option that makes Open read every sealed segment in
+// full and check it against the checksum recorded when it was sealed, failing
+// with ErrCorrupt if any has been damaged since. Sealed segments are otherwise
+// only checked as their entries are read or by Verify, so this catches bit rot
+// early at the cost of a slower Open. Segments sealed before checksums were
+// recorded can't be checked. It has no effect if WithSegmentFiler is used.
+func WithStrictRecovery() walOpt {
+	return func(w *WAL) {
+		w.strictRecovery = true
+	}
+}
+
+// WithSegmentFileNaming is an option that names segment files with n rather
+// than the default scheme, for example to keep an existing naming convention
+// or let several WALs share a directory. The same naming must be used every
+// time the WAL is opened. WALs sharing a directory also need their metadata
+// kept apart, since it's always stored under the same names, for example with
+// WithMetaStore. It has no effect if WithSegmentFiler is used.
+func WithSegmentFileNaming(n segment.FileNaming) walOpt {
+	return func(w *WAL) {
+		w.fileNaming = n
+	}
+}
+
+// WithDataDirs is an option that creates new segments in dirs, chosen
+// according to the PlacementPolicy, rather than in the WAL's own directory.
+// That lets a log be larger than any one volume or spread its IO over several
+// disks. The dirs must already exist. Metadata stays in the WAL's directory
+// and records which dir each segment is in, so dirs can be added later, but
+// one can only be dropped once no segments are left in it. Without
+// WithSegmentFiler, segment files in any of dirs that the metadata doesn't
+// know about are deleted by Open like those in the WAL's own directory.
+func WithDataDirs(dirs ...string) walOpt {
+	return func(w *WAL) {
+		w.dataDirs = dirs
+	}
+}
+
+// WithPlacementPolicy is an option that sets how WithDataDirs chooses the dir
+// for each new segment. The default is PlaceRoundRobin.
+func WithPlacementPolicy(p PlacementPolicy) walOpt {
+	return func(w *WAL) {
+		w.placement = p
+	}
+}
+
+// WithColdDir is an option that moves each sealed segment to dir once it was
+// sealed more than moveAfter ago, so that older parts of the log that are
+// rarely read can be kept on slower or cheaper storage. A background
+// goroutine copies each segment and then swaps the copy in, so reads and
+// appends carry on meanwhile and reads of the segment follow it to its new
+// location. The old file is deleted once no reads are using it. A crash
+// during a move can leave a copy behind that's deleted along with the
+// segment when it's truncated. dir must already exist and must not be the
+// WAL's directory or one of its data dirs. It needs a SegmentFiler that
+// implements types.SegmentMover, as the default does.
+func WithColdDir(dir string, moveAfter time.Duration) walOpt {
+	return func(w *WAL) {
+		w.coldDir = dir
+		w.coldAfter = moveAfter
+	}
+}
+
+// WithScrub is an option that verifies every sealed segment in the background
+// once per interval, as Verify would, so that damage to segments that are
+// rarely read is found while there's still time to do something about it.
+// Segments are verified one after another, pausing between them to read at
+// most about bytesPerSec, or without pausing if bytesPerSec is zero. Damage
+// found is logged, counted by the read_errors_total metric in the scrub
+// phase and passed to the func set with WithScrubHandler.
+func WithScrub(interval time.Duration, bytesPerSec int64) walOpt {
+	return func(w *WAL) {
+		w.scrubInterval = interval
+		w.scrubBytesPerSec = bytesPerSec
+	}
+}
+
+// WithScrubHandler is an option that calls fn with each segment that fails
+// verification when scrubbing with WithScrub, and the error. fn is called
+// from the scrubbing goroutine which waits for it.
+func WithScrubHandler(fn func(seg types.SegmentInfo, err error)) walOpt {
+	return func(w *WAL) {
+		w.scrubHandler = fn
+	}
+}
+
+// WithBackgroundIOLimit is an option that limits how fast background work
+// reads and writes segment files, so that it doesn't take disk bandwidth that
+// appends and syncs need. It covers scrubbing, moving segments to the cold
+// dir, MigrateFormat and Archive, which share the one limit of bytesPerSec.
+// Deleting segments isn't limited since it doesn't read or write them. Zero,
+// the default, means no limit. SetBackgroundIOLimit changes it later.
+func WithBackgroundIOLimit(bytesPerSec int64) walOpt {
+	return func(w *WAL) {
+		w.backgroundIOLimit = bytesPerSec
+	}
+}
+
+// WithWriteRateLimit is an option that limits appends to bytesPerSec bytes of
+// entry data and metadata per second on average, allowing bursts of up to
+// burst bytes, so that a runaway writer can't take over a disk shared with
+// others. Appends that would exceed it wait until they can go ahead, unless
+// WithWriteRateLimitReject is also used.
+func WithWriteRateLimit(bytesPerSec int64, burst int) walOpt {
+	return func(w *WAL) {
+		w.writeRate = bytesPerSec
+		w.writeBurst = burst
+	}
+}
+
+// WithWriteRateLimitReject is an option that makes appends that would exceed
+// the limit set with WithWriteRateLimit fail straight away with a
+// ThrottleError saying when to try again, rather than waiting. Appends larger
+// than the burst always fail.
+func WithWriteRateLimitReject() walOpt {
+	return func(w *WAL) {
+		w.rejectThrottled = true
+	}
+}
+
+// WithMaxPendingBytes is an option that limits the entry data and metadata of
+// appends that have been made but not yet written and synced, including those
+// queued behind another append or waiting for the tail segment to be rotated,
+// to n bytes. Beyond that appends wait their turn, or fail with
+// ErrBackpressure if WithBackpressureReject is used, so that callers can't
+// pile up ever more memory when the disk can't keep up. An append larger
+// than n goes ahead once nothing else is pending.
+func WithMaxPendingBytes(n int64) walOpt {
+	return func(w *WAL) {
+		w.maxPendingBytes = n
+	}
+}
+
+// WithBackpressureReject is an option that makes appends beyond the limit set
+// with WithMaxPendingBytes fail straight away with ErrBackpressure rather
+// than waiting.
+func WithBackpressureReject() walOpt {
+	return func(w *WAL) {
+		w.rejectBackpressure = true
+	}
+}
+
+// WithPipelinedAppends is an option that lets the next append be encoded and
+// written to the tail segment while the sync of earlier ones is still in
+// flight, rather than leaving the CPU idle during every fsync. Each append
+// still returns only once it's durable. At most window appends, up to
+// segment.MaxPipelineDepth, may be written but not yet synced at once; beyond
+// that appends wait for a sync to finish. It has no effect on segments whose SegmentWriter doesn't implement
+// types.SegmentPipeliner.
+func WithPipelinedAppends(window int) walOpt {
+	return func(w *WAL) {
+		w.pipelineWindow = window
+	}
+}
+
+// WithCopyOnAppend is an option that makes StoreLogs copy each entry's Data
+// and Meta before appending it, so that nothing written refers to the
+// caller's buffers. The built-in segment files are done with them by the time
+// StoreLogs returns, but a custom SegmentWriter that defers IO past Append may
+// not be, and a caller reusing its batch buffers could then corrupt writes
+// still in flight. It costs a copy of every batch.
+func WithCopyOnAppend() walOpt {
+	return func(w *WAL) {
+		w.copyOnAppend = true
+	}
+}
+
+// WithMutationCheck is a debugging option that checksums each entry's Data and
+// Meta when StoreLogs is called and checks them again just before the batch is
+// written and after it's written and synced. If the caller changed any of them
+// in the meantime, which could otherwise leave something other than what was
+// acknowledged on disk, it panics naming the entry. Each batch is checksummed
+// several times, so it's meant for tests and debugging.
+func WithMutationCheck() walOpt {
+	return func(w *WAL) {
+		w.mutationCheck = true
+	}
+}
+
+// WithMinFreeBytes is an option that keeps n bytes free on the filesystem
+// segments are written to. An append, or the creation of a new segment, that
+// would leave less than that fails up front with an error wrapping
+// ErrDiskFull rather than running out of space part way through. Once space
+// is freed, appending can carry on. It checks the free space before every
+// append so it has a small cost, and has no effect where the VFS can't
+// report free space.
+func WithMinFreeBytes(n uint64) walOpt {
+	return func(w *WAL) {
+		w.minFreeBytes = n
+	}
+}
+
+// WithSyncErrorPolicy is an option that sets what happens when writing or
+// syncing the tail segment fails. The default is SyncErrorSticky.
+func WithSyncErrorPolicy(p SyncErrorPolicy) walOpt {
+	return func(w *WAL) {
+		w.syncErrorPolicy = p
+	}
+}
+
+// WithLazySegmentOpen is an option that leaves each sealed segment closed until
+// an entry in it is first read, rather than opening them all in Open. Most
+// sealed segments of a large log are never read again so this saves both time
+// in Open and file descriptors. Any problem with a segment's file that Open
+// would have found is instead returned by the first read of it. It can't be
+// used with WithStrictRecovery.
+func WithLazySegmentOpen() walOpt {
+	return func(w *WAL) {
+		w.lazyOpen = true
+	}
+}
+
+// WithMaxOpenSegments is an option that keeps at most n sealed segments open,
+// closing the least recently read when another needs opening, so that a log
+// with a great many segments doesn't run the process out of file descriptors.
+// It opens segments lazily as WithLazySegmentOpen does. A segment that's
+// still being read when it's closed stays open until the reads finish, so n
+// can be briefly exceeded.
+func WithMaxOpenSegments(n int) walOpt {
+	return func(w *WAL) {
+		w.maxOpenSegments = n
+	}
+}
+
+// WithRecoveryProgress is an option that calls fn as Open recovers the WAL, so
+// that a service with a large log can report how far it has got rather than
+// appearing to hang. phase is one of the RecoveryPhase constants, each
+// reported with how much of it is done out of its total. fn is called from
+// the goroutine calling Open and should return quickly.
+func WithRecoveryProgress(fn func(done, total int, phase string)) walOpt {
+	return func(w *WAL) {
+		w.recoveryProgress = fn
+	}
+}
+
 func (w *WAL) applyDefaultsAndValidate() error {
 	// Defaults
 	if w.logger == nil {
 		w.logger = log.NewNopLogger()
 	}
+	if w.deleteGrace < 0 {
+		return fmt.Errorf("delete grace period can't be negative")
+	}
+	if w.mergeEvery < 0 {
+		return fmt.Errorf("segment merging interval can't be negative")
+	}
+	if w.scrubInterval < 0 || w.scrubBytesPerSec < 0 {
+		return fmt.Errorf("scrub interval and rate can't be negative")
+	}
+	if w.writeRate < 0 || (w.writeRate > 0 && w.writeBurst <= 0) {
+		return fmt.Errorf("write rate limit needs a positive rate and burst")
+	}
+	if w.rejectThrottled && w.writeRate == 0 {
+		return fmt.Errorf("rejecting throttled appends needs a write rate limit")
+	}
+	if w.writeRate > 0 && w.writeLimiter == nil {
+		w.writeLimiter = rate.NewLimiter(rate.Limit(w.writeRate), w.writeBurst)
+	}
+	if w.maxPendingBytes < 0 || (w.rejectBackpressure && w.maxPendingBytes == 0) {
+		return fmt.Errorf("rejecting appends needs a positive max pending bytes")
+	}
+	if w.maxPendingBytes > 0 && w.pendingLimit == nil {
+		w.pendingLimit = newPendingLimit(w.maxPendingBytes, w.rejectBackpressure)
+	}
+	if w.pipelineWindow < 0 || w.pipelineWindow > segment.MaxPipelineDepth {
+		return fmt.Errorf("pipelined appends window must be between 0 and %d", segment.MaxPipelineDepth)
+	}
+	if w.pipelineWindow > 0 && w.pipeline == nil {
+		w.pipeline = make(chan struct{}, w.pipelineWindow)
+	}
+	if w.backgroundIOLimit < 0 {
+		return fmt.Errorf("background IO limit can't be negative")
+	}
+	if w.ioLimiter == nil {
+		w.ioLimiter = newIOLimiter(w.backgroundIOLimit)
+	}
+	if w.strictHMAC && w.hmacKeys == nil {
+		return fmt.Errorf("strict HMAC verification needs a KeyProvider")
+	}
+	if w.indexInterval < 0 {
+		return fmt.Errorf("index interval can't be negative")
+	}
+	if w.compression != segment.CompressionNone {
+		if _, err := segment.LookupCompression(w.compression); err != nil {
+			return err
+		}
+	}
+	if err := w.compressPolicy.Validate(); err != nil {
+		return err
+	}
+	if w.encryptKeys != nil || w.cipherSuite != segment.CipherNone {
+		if w.encryptKeys == nil {
+			return fmt.Errorf("encryption needs a KeyProvider")
+		}
+		if w.cipherSuite == segment.CipherNone {
+			return fmt.Errorf("encryption needs a cipher suite")
+		}
+		if err := segment.CheckCipher(w.cipherSuite); err != nil {
+			return err
+		}
+	}
+	if w.lockKeys {
+		if w.encryptKeys == nil {
+			return fmt.Errorf("key locking needs encryption")
+		}
+		if !segment.KeyLockingSupported {
+			return fmt.Errorf("keys can't be locked into memory on %s", runtime.GOOS)
+		}
+	}
+	if w.placement != PlaceRoundRobin && w.placement != PlaceFillThenSpill {
+		return fmt.Errorf("unknown placement policy %d", w.placement)
+	}
+	if w.maxOpenSegments < 0 {
+		return fmt.Errorf("max open segments can't be negative")
+	}
+	if (w.lazyOpen || w.maxOpenSegments > 0) && w.strictRecovery {
+		return fmt.Errorf("lazy segment opening can't be used with strict recovery")
+	}
+	if w.syncErrorPolicy < SyncErrorSticky || w.syncErrorPolicy > SyncErrorPanic {
+		return fmt.Errorf("unknown sync error policy %d", w.syncErrorPolicy)
+	}
+	if w.coldDir != "" {
+		if w.coldAfter < 0 {
+			return fmt.Errorf("cold dir move delay can't be negative")
+		}
+		if filepath.Clean(w.coldDir) == filepath.Clean(w.dir) {
+			return fmt.Errorf("cold dir can't be the WAL's directory")
+		}
+		for _, d := range w.dataDirs {
+			if filepath.Clean(w.coldDir) == filepath.Clean(d) {
+				return fmt.Errorf("cold dir can't be one of the data dirs")
+			}
+		}
+	}
 	if w.sf == nil {
-		// These are not actually swappable via options right now but we override
-		// them in tests. Only load the default implementations if they are not set.
-		vfs := fs.New()
-		w.sf = segment.NewFiler(w.dir, vfs)
+		vfs := w.vfs
+		switch {
+		case vfs != nil:
+		case w.ioUring:
+			var err error
+			if vfs, err = fs.NewIOUring(); err != nil {
+				return err
+			}
+		default:
+			vfs = fs.New()
+		}
+		if w.blockCacheBytes > 0 {
+			w.blockCache = segment.NewBlockCache(w.blockCacheBytes)
+		}
+		noop := func(*segment.Filer) {}
+		evict, verify, strict, dw, encrypt, lock, trash, markers, manifest := noop, noop, noop, noop, noop, noop, noop, noop, noop
+		if w.evictSealed {
+			evict = segment.WithEvictSealedFromPageCache()
+		}
+		if w.verifyOnRead {
+			verify = segment.WithVerifyOnRead()
+		}
+		if w.strictRecovery {
+			strict = segment.WithStrictRecovery()
+		}
+		if w.doubleWrite {
+			dw = segment.WithDoubleWrite()
+		}
+		if w.sealedMarkers {
+			if w.fileNaming.Extension == ".sealed" {
+				return fmt.Errorf("segment files can't have the extension sealed markers do")
+			}
+			markers = segment.WithSealedMarkers()
+		}
+		if w.manifest && !w.readOnly {
+			manifest = segment.WithManifest()
+		}
+		if w.encryptKeys != nil {
+			encrypt = segment.WithEncryption(w.encryptKeys)
+		}
+		if w.lockKeys {
+			lock = segment.WithKeyLocking()
+		}
+		if w.deleteGrace > 0 {
+			if _, ok := vfs.(types.FileMover); !ok {
+				return fmt.Errorf("a delete grace period needs a VFS that can move files")
+			}
+			trash = segment.WithTrash()
+		}
+		w.sf = segment.NewFiler(w.dir, vfs,
+			segment.WithBlockCache(w.blockCache),
+			segment.WithTailBuffer(w.tailBufferBytes),
+			segment.WithReadAhead(w.readAheadSize),
+			segment.WithHMAC(w.hmacKeys, w.strictHMAC),
+			segment.WithIndexInterval(w.indexInterval),
+			segment.WithCompression(w.compression),
+			segment.WithCompressionPolicy(w.compressPolicy),
+			segment.WithFileNaming(w.fileNaming),
+			segment.WithDataDirs(w.allDataDirs()...),
+			evict,
+			verify,
+			strict,
+			dw,
+			encrypt,
+			lock,
+			trash,
+			markers,
+			manifest,
+		)
+	}
+	if _, ok := w.sf.(types.SegmentMover); w.coldDir != "" && !ok {
+		return fmt.Errorf("a cold dir needs a SegmentFiler that can move segments")
+	}
+	if _, ok := w.sf.(types.SegmentTrash); w.deleteGrace > 0 && !ok {
+		return fmt.Errorf("a delete grace period needs a SegmentFiler with a trash")
+	}
+	if _, ok := w.sf.(rawSegmentOpener); w.archiver != nil && !ok {
+		return fmt.Errorf("archiving on truncate needs a SegmentFiler that can open segment files")
+	}
+	if w.compressDict != nil {
+		if w.compression == segment.CompressionNone {
+			return fmt.Errorf("a compression dictionary needs a compression codec")
+		}
+		if err := w.useDictionary(w.compressDict); err != nil {
+			return err
+		}
 	}
 	if w.reg == nil {
 		w.reg = prometheus.NewRegistry()
 	}
 	if w.metrics == nil {
-		w.metrics = newWALMetrics(w.reg)
+		reg, err := w.metricsRegisterer()
+		if err != nil {
+			return err
+		}
+		f := &metricsFactory{reg: reg}
+		w.metrics = newWALMetrics(f)
+		if w.blockCache != nil {
+			registerBlockCacheMetrics(f, w.blockCache)
+		}
+		if len(f.shared) > 0 {
+			level.Warn(w.logger).Log("msg", "metrics registered by another WAL only report one of them, use WithMetricsConstLabels to tell them apart", "metrics", strings.Join(f.shared, ","))
+		}
 	}
 	if w.metaDB == nil {
-		w.metaDB = &metadb.BoltMetaDB{}
+		switch {
+		case w.vfs != nil:
+			w.metaDB = metadb.NewFlatMetaDB(w.vfs)
+		case w.flatMeta:
+			w.metaDB = &metadb.FlatMetaDB{}
+		default:
+			w.metaDB = defaultMetaStore()
+		}
+	}
+	if w.encryptKeys != nil {
+		meta, err := newEncryptedMeta(w.metaDB, w.encryptKeys, w.cipherSuite, w.lockKeys, w.readOnly)
+		if err != nil {
+			return err
+		}
+		w.metaDB = meta
 	}
+	if w.auditKeep < 0 {
+		return fmt.Errorf("audit log records kept can't be negative")
+	}
+	w.audit = &auditLog{meta: w.metaDB, keep: w.auditKeep}
 	if w.segmentSize == 0 {
 		w.segmentSize = DefaultSegmentSize
 	}
+	if w.cacheEntries < 0 || w.cacheBytes < 0 {
+		return fmt.Errorf("entry cache limits can't be negative")
+	}
+	if w.cache == nil && (w.cacheEntries > 0 || w.cacheBytes > 0) {
+		w.cache = newEntryCache(w.cacheEntries, w.cacheBytes)
+	}
 	return nil
 }
@@ -0,0 +1,79 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"fmt"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// enterPipeline waits for room in the window set with WithPipelinedAppends
+// and returns a func to call once the append is synced. It does nothing if
+// appends aren't pipelined. It must be called before writeMu is taken.
+func (w *WAL) enterPipeline() func() {
+	if w.pipeline == nil {
+		return func() {}
+	}
+	w.pipelineMu.RLock()
+	w.pipeline <- struct{}{}
+	return func() {
+		<-w.pipeline
+		w.pipelineMu.RUnlock()
+	}
+}
+
+// drainPipeline waits for every pipelined append to be synced and holds off
+// any more until the returned func is called. Anything that replaces or
+// closes the tail segment must call it before taking writeMu.
+func (w *WAL) drainPipeline() func() {
+	if w.pipeline == nil {
+		return func() {}
+	}
+	w.pipelineMu.Lock()
+	return w.pipelineMu.Unlock
+}
+
+// appendTailLocked appends entries to the tail. If appends are pipelined and
+// the tail supports it the entries may not be durable yet, in which case the
+// func returned must be called once writeMu is released to wait until they
+// are. Otherwise it's nil. The caller must hold writeMu.
+func (w *WAL) appendTailLocked(tail types.SegmentWriter, entries []types.LogEntry) (func() error, error) {
+	if p, ok := tail.(types.SegmentPipeliner); ok && w.pipeline != nil {
+		return p.AppendAsync(entries)
+	}
+	return nil, tail.Append(entries)
+}
+
+// awaitAppended waits for pipelined entries appended with appendTailLocked to
+// be synced.
+func (w *WAL) awaitAppended(wait func() error, entries []types.LogEntry) error {
+	if err := wait(); err != nil {
+		w.writeMu.Lock()
+		defer w.writeMu.Unlock()
+		if w.failErr != nil {
+			// Another append's sync failed first.
+			return fmt.Errorf("%w: %w", ErrFailed, w.failErr)
+		}
+		return w.appendFailedLocked(err)
+	}
+	if w.cache != nil {
+		// Only cache entries once they're durable since cached entries are
+		// read without checking the tail.
+		w.cache.addAppended(entries)
+	}
+	return nil
+}
+
+// lastAppendedLocked returns the last index appended to the log including any
+// pipelined appends that aren't synced yet. The caller must hold writeMu.
+func (w *WAL) lastAppendedLocked(s *state) uint64 {
+	last := s.lastIndex()
+	if p, ok := s.tail.(types.SegmentPipeliner); ok {
+		if idx := p.LastAppendedIndex(); idx > last {
+			return idx
+		}
+	}
+	return last
+}
@@ -0,0 +1,69 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"github.com/dreamsxin/wal/types"
+)
+
+// PlacementPolicy decides which of the dirs given to WithDataDirs each new
+// segment is created in. Whatever the policy, a dir that's known not to have
+// room for a whole segment is skipped if another does.
+type PlacementPolicy int
+
+const (
+	// PlaceRoundRobin creates each segment in the dir after the previous
+	// segment's, spreading IO evenly over all of them.
+	PlaceRoundRobin PlacementPolicy = iota
+
+	// PlaceFillThenSpill creates segments in the first dir until it's full,
+	// then in the next, and so on.
+	PlaceFillThenSpill
+)
+
+// placeSegment returns the dir a new segment of size bytes should be created
+// in, given the info of the segment before it if there is one. It returns ""
+// if the WAL has no data dirs.
+func (w *WAL) placeSegment(prev *types.SegmentInfo, size uint64) string {
+	n := len(w.dataDirs)
+	if n == 0 {
+		return ""
+	}
+	start := 0
+	if prev != nil {
+		for i, d := range w.dataDirs {
+			if d == prev.Dir {
+				start = i
+				if w.placement == PlaceRoundRobin {
+					start = (i + 1) % n
+				}
+				break
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		dir := w.dataDirs[(start+i)%n]
+		if w.hasRoom(dir, size) {
+			return dir
+		}
+	}
+	// Everywhere is full so it doesn't matter which fails.
+	return w.dataDirs[start]
+}
+
+// hasRoom returns false if dir is known not to have space for size more
+// bytes as well as the reserve set with WithMinFreeBytes.
+func (w *WAL) hasRoom(dir string, size uint64) bool {
+	free, ok := w.freeSpace(dir)
+	return !ok || free >= size+w.minFreeBytes
+}
+
+// allDataDirs returns every dir other than the WAL's own that segments may be
+// in.
+func (w *WAL) allDataDirs() []string {
+	if w.coldDir == "" {
+		return w.dataDirs
+	}
+	return append(append([]string(nil), w.dataDirs...), w.coldDir)
+}
@@ -0,0 +1,27 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+// The phases of recovery reported to the func given to WithRecoveryProgress.
+const (
+	// RecoveryPhaseList is reported once the segment files on disk have been
+	// listed, with done and total both the number found.
+	RecoveryPhaseList = "list"
+
+	// RecoveryPhaseOpen is reported after each sealed segment is opened, with
+	// done the number opened so far out of total.
+	RecoveryPhaseOpen = "open"
+
+	// RecoveryPhaseTail is reported with done 0 before the tail segment is
+	// scanned to find its last complete append, which can take a while if it's
+	// large, and with done 1 after. total is 1.
+	RecoveryPhaseTail = "tail"
+)
+
+// reportProgress calls the func given to WithRecoveryProgress, if any.
+func (w *WAL) reportProgress(done, total int, phase string) {
+	if w.recoveryProgress != nil {
+		w.recoveryProgress(done, total, phase)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !wasm
+
+package raftwal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// These are the bucket names raft-boltdb uses.
+	boltLogsBucket = []byte("logs")
+	boltConfBucket = []byte("conf")
+
+	// raftUint64Keys are the uint64 values hashicorp/raft keeps in its
+	// StableStore. The WAL stores them little endian but raft-boltdb expects
+	// big endian.
+	raftUint64Keys = [][]byte{[]byte("CurrentTerm"), []byte("LastVoteTerm")}
+
+	// raftBytesKeys are the other values hashicorp/raft keeps in its
+	// StableStore.
+	raftBytesKeys = [][]byte{[]byte("LastVoteCand")}
+)
+
+// boltExportBatchSize is how many entries are written in each bolt
+// transaction.
+const boltExportBatchSize = 1024
+
+// ExportBolt writes every entry in w along with raft's stable store values to
+// a new raft-boltdb database at path. It gives nodes a way back to
+// raft-boltdb. Any extraKeys are copied from the stable store as is. The file
+// at path must not already exist. It returns the number of entries written.
+func ExportBolt(ctx context.Context, w *wal.WAL, path string, extraKeys ...[]byte) (int, error) {
+	if _, err := os.Stat(path); err == nil {
+		return 0, fmt.Errorf("%s already exists", path)
+	}
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltLogsBucket); err != nil {
+			return err
+		}
+		conf, err := tx.CreateBucketIfNotExists(boltConfBucket)
+		if err != nil {
+			return err
+		}
+		return exportStable(w, conf, extraKeys)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		n     int
+		batch []*raft.Log
+	)
+	flush := func() error {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			b := tx.Bucket(boltLogsBucket)
+			for _, l := range batch {
+				var buf bytes.Buffer
+				if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(l); err != nil {
+					return err
+				}
+				if err := b.Put(uint64ToBytes(l.Index), buf.Bytes()); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		n += len(batch)
+		batch = batch[:0]
+		return err
+	}
+	err = w.Replay(ctx, 0, func(le types.LogEntry) error {
+		var l raft.Log
+		fromEntry(&le, &l)
+		batch = append(batch, &l)
+		if len(batch) == boltExportBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, db.Sync()
+}
+
+func exportStable(w *wal.WAL, conf *bbolt.Bucket, extraKeys [][]byte) error {
+	for _, k := range raftUint64Keys {
+		raw, err := w.GetStable(k)
+		if err != nil {
+			return err
+		}
+		if raw == nil {
+			continue
+		}
+		v, err := w.GetUint64(k)
+		if err != nil {
+			return err
+		}
+		if err := conf.Put(k, uint64ToBytes(v)); err != nil {
+			return err
+		}
+	}
+	for _, k := range append(raftBytesKeys, extraKeys...) {
+		v, err := w.GetStable(k)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+		if err := conf.Put(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uint64ToBytes(u uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], u)
+	return buf[:]
+}
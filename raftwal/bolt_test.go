@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !wasm
+
+package raftwal
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func TestExportBolt(t *testing.T) {
+	s := openTestStore(t)
+	logs := makeRaftLogs(1, 2500)
+	require.NoError(t, s.StoreLogs(logs))
+	require.NoError(t, s.DeleteRange(1, 99))
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 7))
+	require.NoError(t, s.Set([]byte("LastVoteCand"), []byte("node-1")))
+	require.NoError(t, s.Set([]byte("custom"), []byte("value")))
+
+	dir, err := os.MkdirTemp("", "raft-wal-export-bolt-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "raft.db")
+
+	n, err := ExportBolt(context.Background(), s.WAL(), path, []byte("custom"))
+	require.NoError(t, err)
+	require.Equal(t, 2401, n)
+
+	_, err = ExportBolt(context.Background(), s.WAL(), path)
+	require.ErrorContains(t, err, "already exists")
+
+	db, err := bbolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		conf := tx.Bucket(boltConfBucket)
+		require.Equal(t, 7, int(binary.BigEndian.Uint64(conf.Get([]byte("CurrentTerm")))))
+		require.Nil(t, conf.Get([]byte("LastVoteTerm")))
+		require.Equal(t, "node-1", string(conf.Get([]byte("LastVoteCand"))))
+		require.Equal(t, "value", string(conf.Get([]byte("custom"))))
+
+		// Entries are keyed by big endian index and msgpack encoded like
+		// raft-boltdb does.
+		c := tx.Bucket(boltLogsBucket).Cursor()
+		k, v := c.First()
+		require.Equal(t, 100, int(binary.BigEndian.Uint64(k)))
+		var l raft.Log
+		require.NoError(t, codec.NewDecoderBytes(v, &codec.MsgpackHandle{}).Decode(&l))
+		want := logs[99]
+		require.Equal(t, want.Index, l.Index)
+		require.Equal(t, want.Term, l.Term)
+		require.Equal(t, want.Type, l.Type)
+		require.Equal(t, want.Data, l.Data)
+		require.Equal(t, want.Extensions, l.Extensions)
+		require.True(t, want.AppendedAt.Equal(l.AppendedAt))
+
+		k, _ = c.Last()
+		require.Equal(t, 2500, int(binary.BigEndian.Uint64(k)))
+		require.Equal(t, 2401, tx.Bucket(boltLogsBucket).Stats().KeyN)
+		return nil
+	}))
+}
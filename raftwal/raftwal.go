@@ -0,0 +1,154 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package raftwal adapts a *wal.WAL for use as the log and stable store of a
+// hashicorp/raft node.
+package raftwal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+	"github.com/hashicorp/raft"
+)
+
+var (
+	_ raft.LogStore          = &Store{}
+	_ raft.StableStore       = &Store{}
+	_ raft.MonotonicLogStore = &Store{}
+)
+
+// Store implements raft.LogStore and raft.StableStore on top of a WAL. Raft's
+// Term, Type, Extensions and AppendedAt are stored as the entry's Term, Type,
+// Meta and AppendedAt so they can be read back without decoding the Data.
+type Store struct {
+	w *wal.WAL
+}
+
+// New returns a Store that reads and writes w. Closing the Store closes w.
+func New(w *wal.WAL) *Store {
+	return &Store{w: w}
+}
+
+// WAL returns the underlying WAL.
+func (s *Store) WAL() *wal.WAL {
+	return s.w
+}
+
+// FirstIndex implements raft.LogStore.
+func (s *Store) FirstIndex() (uint64, error) {
+	return s.w.FirstIndex()
+}
+
+// LastIndex implements raft.LogStore.
+func (s *Store) LastIndex() (uint64, error) {
+	return s.w.LastIndex()
+}
+
+// GetLog implements raft.LogStore. It returns raft.ErrLogNotFound if index is
+// not in the log.
+func (s *Store) GetLog(index uint64, log *raft.Log) error {
+	var le types.LogEntry
+	if err := s.w.GetLog(index, &le); err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			return raft.ErrLogNotFound
+		}
+		return err
+	}
+	fromEntry(&le, log)
+	return nil
+}
+
+// StoreLog implements raft.LogStore.
+func (s *Store) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs implements raft.LogStore. Extensions longer than
+// segment.MaxEntryMetaSize can't be stored and cause the batch to fail.
+func (s *Store) StoreLogs(logs []*raft.Log) error {
+	entries := make([]types.LogEntry, len(logs))
+	for i, l := range logs {
+		toEntry(l, &entries[i])
+	}
+	return s.w.StoreLogs(entries)
+}
+
+// DeleteRange implements raft.LogStore. Only ranges that include the first or
+// last entry in the log can be deleted since the WAL can only truncate from
+// either end.
+func (s *Store) DeleteRange(min, max uint64) error {
+	first, last, err := s.w.IndexRange()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case last == 0 || max < first || min > last:
+		// Nothing in the log overlaps the range.
+		return nil
+
+	case min <= first:
+		// Head truncation. This may remove everything if max >= last.
+		return s.w.TruncateFrontWithReason(max+1, fmt.Sprintf("raft DeleteRange(%d, %d)", min, max))
+
+	case max >= last:
+		// Tail truncation, min > first is implied.
+		return s.w.TruncateBackWithReason(min-1, fmt.Sprintf("raft DeleteRange(%d, %d)", min, max))
+
+	default:
+		return fmt.Errorf("%w: can't delete [%d, %d] from the middle of log [%d, %d]",
+			wal.ErrOutOfRange, min, max, first, last)
+	}
+}
+
+// IsMonotonic implements raft.MonotonicLogStore. The WAL never allows gaps
+// between entries so raft must remove all logs when restoring a snapshot.
+func (s *Store) IsMonotonic() bool {
+	return true
+}
+
+// Set implements raft.StableStore.
+func (s *Store) Set(key []byte, val []byte) error {
+	return s.w.Set(key, val)
+}
+
+// Get implements raft.StableStore.
+func (s *Store) Get(key []byte) ([]byte, error) {
+	return s.w.Get(key)
+}
+
+// SetUint64 implements raft.StableStore.
+func (s *Store) SetUint64(key []byte, val uint64) error {
+	return s.w.SetUint64(key, val)
+}
+
+// GetUint64 implements raft.StableStore.
+func (s *Store) GetUint64(key []byte) (uint64, error) {
+	return s.w.GetUint64(key)
+}
+
+// Close closes the underlying WAL.
+func (s *Store) Close() error {
+	return s.w.Close()
+}
+
+func toEntry(l *raft.Log, le *types.LogEntry) {
+	le.Index = l.Index
+	le.Term = l.Term
+	le.Type = uint8(l.Type)
+	le.Meta = l.Extensions
+	le.AppendedAt = l.AppendedAt
+	le.Data = l.Data
+}
+
+func fromEntry(le *types.LogEntry, l *raft.Log) {
+	l.Index = le.Index
+	l.Term = le.Term
+	l.Type = raft.LogType(le.Type)
+	l.Extensions = le.Meta
+	l.AppendedAt = le.AppendedAt
+	l.Data = le.Data
+}
@@ -0,0 +1,130 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package raftwal
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "raft-wal-raftwal-test-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	w, err := wal.Open(tmpDir, wal.WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	s := New(w)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func makeRaftLogs(first, n uint64) []*raft.Log {
+	logs := make([]*raft.Log, 0, n)
+	for idx := first; idx < first+n; idx++ {
+		logs = append(logs, &raft.Log{
+			Index:      idx,
+			Term:       idx / 10,
+			Type:       raft.LogType(idx % 3),
+			Data:       []byte(fmt.Sprintf("%05d", idx)),
+			Extensions: []byte(fmt.Sprintf("ext-%d", idx)),
+			AppendedAt: time.Unix(0, int64(idx)*1e6),
+		})
+	}
+	return logs
+}
+
+func TestStoreLogs(t *testing.T) {
+	s := openTestStore(t)
+
+	var log raft.Log
+	require.ErrorIs(t, s.GetLog(1, &log), raft.ErrLogNotFound)
+
+	logs := makeRaftLogs(1, 200)
+	require.NoError(t, s.StoreLog(logs[0]))
+	require.NoError(t, s.StoreLogs(logs[1:]))
+
+	first, err := s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1, int(first))
+	last, err := s.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 200, int(last))
+
+	for _, want := range logs {
+		var got raft.Log
+		require.NoError(t, s.GetLog(want.Index, &got))
+		require.Equal(t, want.Index, got.Index)
+		require.Equal(t, want.Term, got.Term)
+		require.Equal(t, want.Type, got.Type)
+		require.Equal(t, want.Data, got.Data)
+		require.Equal(t, want.Extensions, got.Extensions)
+		require.True(t, want.AppendedAt.Equal(got.AppendedAt))
+	}
+	require.ErrorIs(t, s.GetLog(201, &log), raft.ErrLogNotFound)
+	require.True(t, s.IsMonotonic())
+}
+
+func TestDeleteRange(t *testing.T) {
+	cases := []struct {
+		name      string
+		min, max  uint64
+		wantFirst uint64
+		wantLast  uint64
+		wantErr   error
+	}{
+		{name: "before", min: 1, max: 9, wantFirst: 10, wantLast: 100},
+		{name: "after", min: 101, max: 200, wantFirst: 10, wantLast: 100},
+		{name: "head", min: 1, max: 49, wantFirst: 50, wantLast: 100},
+		{name: "exact head", min: 10, max: 10, wantFirst: 11, wantLast: 100},
+		{name: "tail", min: 60, max: 200, wantFirst: 10, wantLast: 59},
+		{name: "exact tail", min: 100, max: 100, wantFirst: 10, wantLast: 99},
+		{name: "everything", min: 0, max: 1000, wantFirst: 0, wantLast: 0},
+		{name: "middle", min: 20, max: 30, wantErr: wal.ErrOutOfRange},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := openTestStore(t)
+			require.NoError(t, s.StoreLogs(makeRaftLogs(10, 91)))
+
+			err := s.DeleteRange(tc.min, tc.max)
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			first, err := s.FirstIndex()
+			require.NoError(t, err)
+			require.Equal(t, int(tc.wantFirst), int(first))
+			last, err := s.LastIndex()
+			require.NoError(t, err)
+			require.Equal(t, int(tc.wantLast), int(last))
+		})
+	}
+}
+
+func TestStableStore(t *testing.T) {
+	s := openTestStore(t)
+
+	require.NoError(t, s.Set([]byte("VotedFor"), []byte("node-1")))
+	val, err := s.Get([]byte("VotedFor"))
+	require.NoError(t, err)
+	require.Equal(t, "node-1", string(val))
+
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 42))
+	term, err := s.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, 42, int(term))
+}
@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// ThrottleError is returned by appends that would exceed the rate set with
+// WithWriteRateLimit when WithWriteRateLimitReject is used. Nothing was
+// written. It wraps ErrThrottled.
+type ThrottleError struct {
+	// RetryAfter is how long until the append would be allowed.
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrThrottled, e.RetryAfter)
+}
+
+func (e *ThrottleError) Unwrap() error {
+	return ErrThrottled
+}
+
+// throttleWrite waits until n more bytes may be appended, or returns a
+// ThrottleError if they may not be yet and appends are rejected rather than
+// blocked. It does nothing without a write rate limit.
+func (w *WAL) throttleWrite(n int64) error {
+	if w.writeLimiter == nil || n == 0 {
+		return nil
+	}
+	burst := int64(w.writeLimiter.Burst())
+	if w.rejectThrottled {
+		if n > burst {
+			return fmt.Errorf("append of %d bytes is larger than the write rate limit's burst of %d bytes", n, burst)
+		}
+		r := w.writeLimiter.ReserveN(time.Now(), int(n))
+		if d := r.Delay(); d > 0 {
+			r.Cancel()
+			w.metrics.appendsThrottled.Inc()
+			return &ThrottleError{RetryAfter: d}
+		}
+		return nil
+	}
+	if w.writeLimiter.TokensAt(time.Now()) < float64(n) {
+		w.metrics.appendsThrottled.Inc()
+	}
+	for n > 0 {
+		c := n
+		if c > burst {
+			c = burst
+		}
+		n -= c
+		if err := w.writeLimiter.WaitN(context.Background(), int(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entriesSize returns the bytes of data and metadata in entries, which is
+// what the write rate limit counts.
+func entriesSize(entries []types.LogEntry) int64 {
+	var n int64
+	for _, e := range entries {
+		n += int64(len(e.Data) + len(e.Meta))
+	}
+	return n
+}
@@ -0,0 +1,179 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// replayBatchSize is the most entries Replay reads from a single state.
+const replayBatchSize = 256
+
+type replayBatch struct {
+	entries []types.LogEntry
+	err     error
+
+	// caughtUp is sent once the reader reaches the end of the log. It then
+	// waits for the consumer to resume it and checks once more since fn may
+	// have appended more entries.
+	caughtUp bool
+}
+
+// Replay calls fn with every entry from fromIndex to the end of the log in
+// order, or from the first entry if fromIndex is zero. Entries are read in
+// batches and the next batch is read in the background while fn handles the
+// current one. Entries appended while replaying are included and Replay returns
+// nil once it has caught up with the end of the log. It stops and returns the
+// error if fn returns one or ctx is cancelled. fn may keep the entries it's
+// passed.
+//
+// If the next entry to replay is truncated from the front of the log before it
+// can be read, Replay returns an error wrapping ErrOutOfRange. The same happens
+// if entries that have already been replayed are truncated from the back and
+// possibly replaced, since the caller has then seen entries that are no longer
+// part of the log.
+func (w *WAL) Replay(ctx context.Context, fromIndex uint64, fn func(types.LogEntry) error) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	batches := make(chan replayBatch, 1)
+	resume := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.replayRead(ctx, fromIndex, batches, resume)
+	}()
+	defer func() {
+		// Don't leave the reader running once we return.
+		cancel()
+		<-done
+	}()
+
+	for b := range batches {
+		if b.err != nil {
+			return b.err
+		}
+		if b.caughtUp {
+			select {
+			case resume <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		for _, e := range b.entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// replayRead reads batches starting at next and sends them to out until it
+// reaches the end of the log, hits an error or ctx is cancelled. It closes out
+// when it's done.
+func (w *WAL) replayRead(ctx context.Context, next uint64, out chan<- replayBatch, resume <-chan struct{}) {
+	defer close(out)
+
+	var (
+		prev     types.LogEntry
+		caughtUp bool
+	)
+	for {
+		entries, err := w.readReplayBatch(next, prev.Index, prev.Term)
+		if err != nil {
+			entries = nil
+		} else if len(entries) == 0 {
+			if caughtUp {
+				return
+			}
+			select {
+			case out <- replayBatch{caughtUp: true}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-resume:
+			case <-ctx.Done():
+				return
+			}
+			caughtUp = true
+			continue
+		}
+		caughtUp = false
+		select {
+		case out <- replayBatch{entries: entries, err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		prev = entries[len(entries)-1]
+		next = prev.Index + 1
+	}
+}
+
+// readReplayBatch reads up to replayBatchSize entries from next. If prevIndex
+// is non-zero it's the last entry already replayed which must still be in the
+// log with prevTerm.
+func (w *WAL) readReplayBatch(next, prevIndex, prevTerm uint64) ([]types.LogEntry, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	s, release := w.acquireState()
+	defer release()
+
+	first, last := s.firstIndex(), s.lastIndex()
+	if prevIndex > 0 {
+		if prevIndex > last {
+			return nil, fmt.Errorf("replay %w: log was truncated back to %d after replaying %d", ErrOutOfRange, last, prevIndex)
+		}
+		if prevIndex >= first {
+			var le types.LogEntry
+			if err := s.getLogMeta(prevIndex, &le); err != nil {
+				return nil, w.countReadError(readPhaseRead, err)
+			}
+			if le.Term != prevTerm {
+				return nil, fmt.Errorf("replay %w: index %d was replaced after it was replayed", ErrOutOfRange, prevIndex)
+			}
+		}
+	}
+	if next == 0 {
+		next = first
+	}
+	if last == 0 || next > last {
+		return nil, nil
+	}
+	if next < first {
+		return nil, fmt.Errorf("replay %w: index %d has been truncated, first index is %d", ErrOutOfRange, next, first)
+	}
+
+	n := last - next + 1
+	if n > replayBatchSize {
+		n = replayBatchSize
+	}
+	entries := make([]types.LogEntry, n)
+	var bytes int
+	for i := range entries {
+		idx := next + uint64(i)
+		if err := s.getLog(idx, &entries[i]); err != nil {
+			return nil, w.countReadError(readPhaseRead, err)
+		}
+		entries[i].Index = idx
+		bytes += len(entries[i].Data)
+	}
+	w.metrics.entriesRead.Add(float64(n))
+	w.metrics.entryBytesRead.Add(float64(bytes))
+	return entries, nil
+}
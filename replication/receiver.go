@@ -0,0 +1,126 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package replication
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+)
+
+// ErrGap is returned by Apply when a batch starts after the end of the
+// destination log.
+var ErrGap = errors.New("batch doesn't follow on from the destination log")
+
+// Receiver appends replicated entries into a destination WAL.
+type Receiver struct {
+	w *wal.WAL
+}
+
+// NewReceiver returns a Receiver that appends to w.
+func NewReceiver(w *wal.WAL) *Receiver {
+	return &Receiver{w: w}
+}
+
+// NextIndex returns the index replication should resume from. It's zero if
+// the destination is empty meaning the Sender should start from the first
+// entry it has.
+func (r *Receiver) NextIndex() (uint64, error) {
+	last, err := r.w.LastIndex()
+	if err != nil || last == 0 {
+		return 0, err
+	}
+	return last + 1, nil
+}
+
+// Apply appends a batch of contiguous entries to the destination. It's
+// idempotent: entries the destination already has are skipped so batches can
+// safely be redelivered. If an entry conflicts with the one already at its
+// index, the destination is truncated from there and the batch's entries
+// replace it since the source is always right.
+func (r *Receiver) Apply(entries []types.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	first, last, err := r.w.IndexRange()
+	if err != nil {
+		return err
+	}
+	if last != 0 && entries[0].Index > last+1 {
+		return fmt.Errorf("%w: batch starts at %d but the destination ends at %d", ErrGap, entries[0].Index, last)
+	}
+
+	// Skip anything we already have.
+	for len(entries) > 0 && last != 0 && entries[0].Index <= last {
+		e := &entries[0]
+		if e.Index < first {
+			// Already truncated from the front of the destination.
+			entries = entries[1:]
+			continue
+		}
+		var have types.LogEntry
+		if err := r.w.GetLog(e.Index, &have); err != nil {
+			return err
+		}
+		if !sameEntry(e, &have) {
+			if err := r.truncateFrom(e.Index, first); err != nil {
+				return err
+			}
+			break
+		}
+		entries = entries[1:]
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return r.w.StoreLogs(entries)
+}
+
+// truncateFrom removes index and everything after it.
+func (r *Receiver) truncateFrom(index, first uint64) error {
+	if index == first {
+		// Nothing will be left so start again from index.
+		return r.w.ResetTo(index)
+	}
+	return r.w.TruncateBack(index - 1)
+}
+
+// Sync receives from a Sender's Serve on the other end of conn until ctx is
+// cancelled or an error occurs. It sends NextIndex to resume from and then
+// applies and acknowledges each batch. If conn is an io.Closer it's closed
+// when ctx is cancelled to unblock any pending reads or writes.
+func (r *Receiver) Sync(ctx context.Context, conn io.ReadWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	closeOnDone(ctx, conn)
+
+	next, err := r.NextIndex()
+	if err != nil {
+		return err
+	}
+	if err := writeUint64(conn, next); err != nil {
+		return fmt.Errorf("failed to send resume index: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	for {
+		entries, err := readBatch(br)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to read batch: %w", err)
+		}
+		if err := r.Apply(entries); err != nil {
+			return err
+		}
+		if err := writeUint64(conn, entries[len(entries)-1].Index); err != nil {
+			return fmt.Errorf("failed to acknowledge batch: %w", err)
+		}
+	}
+}
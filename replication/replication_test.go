@@ -0,0 +1,206 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestWAL(t *testing.T) *wal.WAL {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "raft-wal-replication-test-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	w, err := wal.Open(dir, wal.WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func makeEntries(start, num uint64) []types.LogEntry {
+	es := make([]types.LogEntry, 0, num)
+	for idx := start; idx < start+num; idx++ {
+		es = append(es, types.LogEntry{Index: idx, Term: 1, Data: []byte(fmt.Sprintf("%05d", idx))})
+	}
+	return es
+}
+
+func waitForLastIndex(t *testing.T, w *wal.WAL, want uint64) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		last, err := w.LastIndex()
+		return err == nil && last == want
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func requireSameDigest(t *testing.T, a, b *wal.WAL, start, end uint64) {
+	t.Helper()
+	da, err := a.Digest(start, end)
+	require.NoError(t, err)
+	db, err := b.Digest(start, end)
+	require.NoError(t, err)
+	require.Equal(t, da, db)
+}
+
+func TestRunAndApply(t *testing.T) {
+	src, dst := openTestWAL(t), openTestWAL(t)
+	require.NoError(t, src.StoreLogs(makeEntries(1, 500)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s := NewSender(src, WithMaxBatch(64, 1024), WithPollInterval(time.Millisecond))
+	r := NewReceiver(dst)
+	var maxBatch int
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(ctx, 0, func(_ context.Context, entries []types.LogEntry) error {
+			if len(entries) > maxBatch {
+				maxBatch = len(entries)
+			}
+			return r.Apply(entries)
+		})
+	}()
+	waitForLastIndex(t, dst, 500)
+
+	// New entries are tailed.
+	require.NoError(t, src.StoreLogs(makeEntries(501, 20)))
+	waitForLastIndex(t, dst, 520)
+
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+	requireSameDigest(t, src, dst, 1, 520)
+	require.LessOrEqual(t, maxBatch, 64)
+
+	// Append times are replicated too.
+	var a, b types.LogEntry
+	require.NoError(t, src.GetLog(10, &a))
+	require.NoError(t, dst.GetLog(10, &b))
+	require.True(t, a.AppendedAt.Equal(b.AppendedAt))
+}
+
+func TestApply(t *testing.T) {
+	dst := openTestWAL(t)
+	r := NewReceiver(dst)
+
+	next, err := r.NextIndex()
+	require.NoError(t, err)
+	require.Equal(t, 0, int(next))
+
+	// The destination starts wherever the first batch does.
+	require.NoError(t, r.Apply(makeEntries(10, 10)))
+	first, err := dst.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 10, int(first))
+	next, err = r.NextIndex()
+	require.NoError(t, err)
+	require.Equal(t, 20, int(next))
+
+	// Redelivery is a no-op.
+	require.NoError(t, r.Apply(makeEntries(10, 10)))
+	require.NoError(t, r.Apply(makeEntries(15, 10)))
+	last, err := dst.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 24, int(last))
+
+	// Gaps aren't allowed.
+	require.ErrorIs(t, r.Apply(makeEntries(30, 1)), ErrGap)
+
+	// Conflicting entries replace what's there.
+	conflict := makeEntries(20, 2)
+	conflict[0].Term = 2
+	require.NoError(t, r.Apply(conflict))
+	last, err = dst.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 21, int(last))
+	var le types.LogEntry
+	require.NoError(t, dst.GetLog(20, &le))
+	require.Equal(t, 2, int(le.Term))
+
+	// Even when they start at the first index.
+	conflict = makeEntries(10, 3)
+	conflict[0].Data = []byte("different")
+	require.NoError(t, r.Apply(conflict))
+	first, err = dst.FirstIndex()
+	require.NoError(t, err)
+	last, err = dst.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 10, int(first))
+	require.Equal(t, 12, int(last))
+	require.NoError(t, dst.GetLog(10, &le))
+	require.Equal(t, "different", string(le.Data))
+}
+
+func TestServeAndSync(t *testing.T) {
+	src, dst := openTestWAL(t), openTestWAL(t)
+	require.NoError(t, src.StoreLogs(makeEntries(1, 300)))
+
+	s := NewSender(src, WithMaxBatch(32, 1024*1024), WithPollInterval(time.Millisecond), WithWindow(2))
+	r := NewReceiver(dst)
+
+	run := func() (context.CancelFunc, chan error, chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		a, b := net.Pipe()
+		serveErr, syncErr := make(chan error, 1), make(chan error, 1)
+		go func() { serveErr <- s.Serve(ctx, a) }()
+		go func() { syncErr <- r.Sync(ctx, b) }()
+		return cancel, serveErr, syncErr
+	}
+
+	cancel, serveErr, syncErr := run()
+	waitForLastIndex(t, dst, 300)
+	cancel()
+	require.ErrorIs(t, <-serveErr, context.Canceled)
+	require.ErrorIs(t, <-syncErr, context.Canceled)
+
+	// Resume from where we left off after more entries were written.
+	require.NoError(t, src.StoreLogs(makeEntries(301, 100)))
+	cancel, serveErr, syncErr = run()
+	defer cancel()
+	waitForLastIndex(t, dst, 400)
+	requireSameDigest(t, src, dst, 1, 400)
+
+	// The Sender notices if the Receiver goes away even when idle.
+	cancel()
+	require.Error(t, <-serveErr)
+	require.Error(t, <-syncErr)
+}
+
+func TestSenderErrors(t *testing.T) {
+	src := openTestWAL(t)
+	require.NoError(t, src.StoreLogs(makeEntries(1, 50)))
+	s := NewSender(src, WithPollInterval(time.Millisecond))
+
+	// Diverging after entries were sent.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sent := make(chan struct{}, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(ctx, 1, func(context.Context, []types.LogEntry) error {
+			select {
+			case sent <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+	}()
+	<-sent
+	require.NoError(t, src.TruncateBack(40))
+	require.ErrorIs(t, <-errCh, ErrDiverged)
+
+	// Resuming from before the start.
+	require.NoError(t, src.TruncateFront(20))
+	err := s.Run(ctx, 5, func(context.Context, []types.LogEntry) error { return nil })
+	require.ErrorIs(t, err, ErrCompacted)
+}
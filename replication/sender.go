@@ -0,0 +1,275 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package replication keeps a warm standby copy of a WAL without running raft.
+// A Sender reads entries from a source WAL and keeps tailing it as new entries
+// are appended, and a Receiver appends them into a destination WAL. The two
+// can be used directly in-process or connected over any stream such as a TCP
+// connection, in which case the Receiver tells the Sender where to resume from
+// and acknowledges batches so that the Sender never gets more than a window of
+// batches ahead.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+)
+
+const (
+	// DefaultMaxBatchEntries is the default limit on entries per batch.
+	DefaultMaxBatchEntries = 256
+
+	// DefaultMaxBatchBytes is the default limit on the Data bytes per batch. A
+	// batch always contains at least one entry however big it is.
+	DefaultMaxBatchBytes = 1024 * 1024
+
+	// DefaultPollInterval is how often a Sender that has caught up checks the
+	// source for new entries.
+	DefaultPollInterval = 50 * time.Millisecond
+
+	// DefaultWindow is the default number of batches a Sender streaming over a
+	// connection may send before it has to wait for an acknowledgement.
+	DefaultWindow = 4
+)
+
+var (
+	// ErrCompacted is returned when the entries a Sender needs to send next
+	// have been truncated from the front of the source.
+	ErrCompacted = errors.New("entries have been compacted")
+
+	// ErrDiverged is returned by a Sender when an entry it has already sent has
+	// since been removed or rewritten in the source, for example by
+	// TruncateBack. The destination needs to be reconciled, for example using
+	// wal.DigestTree, before replication is restarted.
+	ErrDiverged = errors.New("source log has diverged from what was sent")
+)
+
+// Sender reads entries from a source WAL.
+type Sender struct {
+	w *wal.WAL
+
+	maxEntries   int
+	maxBytes     int
+	pollInterval time.Duration
+	window       int
+}
+
+type senderOpt func(*Sender)
+
+// WithMaxBatch limits how many entries and how many bytes of entry Data are
+// sent in each batch.
+func WithMaxBatch(entries, bytes int) senderOpt {
+	return func(s *Sender) {
+		s.maxEntries = entries
+		s.maxBytes = bytes
+	}
+}
+
+// WithPollInterval sets how often the source is checked for new entries once
+// everything has been sent.
+func WithPollInterval(d time.Duration) senderOpt {
+	return func(s *Sender) {
+		s.pollInterval = d
+	}
+}
+
+// WithWindow sets how many unacknowledged batches Serve allows in flight.
+func WithWindow(n int) senderOpt {
+	return func(s *Sender) {
+		s.window = n
+	}
+}
+
+// NewSender returns a Sender that reads from w.
+func NewSender(w *wal.WAL, opts ...senderOpt) *Sender {
+	s := &Sender{
+		w:            w,
+		maxEntries:   DefaultMaxBatchEntries,
+		maxBytes:     DefaultMaxBatchBytes,
+		pollInterval: DefaultPollInterval,
+		window:       DefaultWindow,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Run passes batches of entries starting at index from to send, in order,
+// until ctx is cancelled or an error occurs. If from is zero it starts at the
+// first entry in the source. Once it has caught up it keeps polling the source
+// and sends new entries as they are appended. send is called synchronously so
+// a slow consumer slows the Sender down rather than it buffering entries.
+func (s *Sender) Run(ctx context.Context, from uint64, send func(ctx context.Context, entries []types.LogEntry) error) error {
+	var (
+		next     = from
+		lastSent *types.LogEntry
+	)
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		first, last, err := s.w.IndexRange()
+		if err != nil {
+			return err
+		}
+		if lastSent != nil {
+			if err := s.checkNotDiverged(lastSent, last); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 && last > 0 {
+			next = first
+		}
+		if next != 0 && next < first {
+			return fmt.Errorf("%w: next index %d is before the first index %d", ErrCompacted, next, first)
+		}
+		if next == 0 || next > last {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		batch, err := s.readBatch(next, last)
+		if err != nil {
+			return err
+		}
+		if err := send(ctx, batch); err != nil {
+			return err
+		}
+		lastSent = &batch[len(batch)-1]
+		next = lastSent.Index + 1
+	}
+}
+
+// readBatch reads entries from next up to last within the batch limits.
+func (s *Sender) readBatch(next, last uint64) ([]types.LogEntry, error) {
+	var (
+		batch []types.LogEntry
+		size  int
+	)
+	for idx := next; idx <= last; idx++ {
+		var le types.LogEntry
+		if err := s.w.GetLog(idx, &le); err != nil {
+			if errors.Is(err, wal.ErrNotFound) && len(batch) == 0 {
+				return nil, fmt.Errorf("%w: failed to read index %d: %s", ErrCompacted, idx, err)
+			}
+			return nil, err
+		}
+		batch = append(batch, le)
+		size += len(le.Data)
+		if len(batch) >= s.maxEntries || size >= s.maxBytes {
+			break
+		}
+	}
+	return batch, nil
+}
+
+// checkNotDiverged makes sure the last entry sent is still in the source
+// unchanged.
+func (s *Sender) checkNotDiverged(sent *types.LogEntry, last uint64) error {
+	if sent.Index > last {
+		return fmt.Errorf("%w: index %d was sent but the source now ends at %d", ErrDiverged, sent.Index, last)
+	}
+	var le types.LogEntry
+	if err := s.w.GetLog(sent.Index, &le); err != nil {
+		if errors.Is(err, wal.ErrNotFound) {
+			// Truncated from the front which doesn't change what we sent.
+			return nil
+		}
+		return err
+	}
+	if !sameEntry(sent, &le) {
+		return fmt.Errorf("%w: index %d has been rewritten since it was sent", ErrDiverged, sent.Index)
+	}
+	return nil
+}
+
+// Serve replicates to a Receiver on the other end of conn until ctx is
+// cancelled or an error occurs. The Receiver sends the index to start from
+// and acknowledges every batch; Serve waits for acknowledgements once it has
+// the configured window of batches in flight. If conn is an io.Closer it's
+// closed when ctx is cancelled to unblock any pending reads or writes.
+func (s *Sender) Serve(ctx context.Context, conn io.ReadWriter) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	closeOnDone(ctx, conn)
+
+	from, err := readUint64(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read resume index: %w", err)
+	}
+
+	// Slots in the window are taken by sending a batch and released by its
+	// acknowledgement. If reading acknowledgements fails, for example because
+	// the Receiver went away, we stop even if there's nothing to send.
+	window := make(chan struct{}, s.window)
+	ackErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		for {
+			if _, err := readUint64(conn); err != nil {
+				ackErr <- fmt.Errorf("failed to read acknowledgement: %w", err)
+				return
+			}
+			select {
+			case <-window:
+			default:
+				ackErr <- fmt.Errorf("received an acknowledgement for a batch that wasn't sent")
+				return
+			}
+		}
+	}()
+
+	err = s.Run(ctx, from, func(ctx context.Context, entries []types.LogEntry) error {
+		select {
+		case window <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return writeBatch(conn, entries)
+	})
+	if parent.Err() == nil {
+		select {
+		case aerr := <-ackErr:
+			return aerr
+		default:
+		}
+	}
+	return err
+}
+
+// closeOnDone closes conn if it's an io.Closer once ctx is done.
+func closeOnDone(ctx context.Context, conn io.ReadWriter) {
+	if c, ok := conn.(io.Closer); ok {
+		go func() {
+			<-ctx.Done()
+			c.Close()
+		}()
+	}
+}
+
+// sameEntry reports whether a and b have the same contents. Like wal.Digest it
+// ignores AppendedAt which isn't part of an entry's identity.
+func sameEntry(a, b *types.LogEntry) bool {
+	return a.Index == b.Index &&
+		a.Term == b.Term &&
+		a.Type == b.Type &&
+		bytes.Equal(a.Meta, b.Meta) &&
+		bytes.Equal(a.Data, b.Data)
+}
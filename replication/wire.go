@@ -0,0 +1,124 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+)
+
+/*
+	Wire format
+
+	All integers are little-endian. The Receiver starts by sending the uint64
+	index to resume from. The Sender then sends batches and the Receiver replies
+	to each with the uint64 index of the last entry in it.
+
+	A batch is a uint32 entry count followed by that many entries:
+
+	+------------+------------+------+---------+------+------------+---------+------+
+	| Index u64  | Term u64   | Type | MetaLen | Meta | AppendedAt | DataLen | Data |
+	|            |            | u8   | u8      |      | i64 nanos  | u32     |      |
+	+------------+------------+------+---------+------+------------+---------+------+
+
+	AppendedAt is zero if the entry has no append time.
+*/
+
+// maxBatchEntries bounds the allocation made for a batch before any entries
+// are read.
+const maxBatchEntries = 1 << 20
+
+func writeUint64(w io.Writer, v uint64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func writeBatch(w io.Writer, entries []types.LogEntry) error {
+	bw := bufio.NewWriter(w)
+	var buf [8 + 8 + 2]byte
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(entries)))
+	bw.Write(buf[:4])
+	for _, e := range entries {
+		if len(e.Meta) > segment.MaxEntryMetaSize {
+			return segment.ErrMetaTooBig
+		}
+		binary.LittleEndian.PutUint64(buf[0:], e.Index)
+		binary.LittleEndian.PutUint64(buf[8:], e.Term)
+		buf[16] = e.Type
+		buf[17] = uint8(len(e.Meta))
+		bw.Write(buf[:18])
+		bw.Write(e.Meta)
+
+		var appendedAt int64
+		if !e.AppendedAt.IsZero() {
+			appendedAt = e.AppendedAt.UnixNano()
+		}
+		binary.LittleEndian.PutUint64(buf[0:], uint64(appendedAt))
+		binary.LittleEndian.PutUint32(buf[8:], uint32(len(e.Data)))
+		bw.Write(buf[:12])
+		bw.Write(e.Data)
+	}
+	return bw.Flush()
+}
+
+func readBatch(r io.Reader) ([]types.LogEntry, error) {
+	var buf [8 + 8 + 2]byte
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(buf[:4])
+	if n == 0 || n > maxBatchEntries {
+		return nil, fmt.Errorf("invalid batch of %d entries", n)
+	}
+	entries := make([]types.LogEntry, n)
+	for i := range entries {
+		e := &entries[i]
+		if _, err := io.ReadFull(r, buf[:18]); err != nil {
+			return nil, err
+		}
+		e.Index = binary.LittleEndian.Uint64(buf[0:])
+		e.Term = binary.LittleEndian.Uint64(buf[8:])
+		e.Type = buf[16]
+		if metaLen := int(buf[17]); metaLen > 0 {
+			e.Meta = make([]byte, metaLen)
+			if _, err := io.ReadFull(r, e.Meta); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := io.ReadFull(r, buf[:12]); err != nil {
+			return nil, err
+		}
+		if appendedAt := int64(binary.LittleEndian.Uint64(buf[0:])); appendedAt != 0 {
+			e.AppendedAt = time.Unix(0, appendedAt)
+		}
+		dataLen := binary.LittleEndian.Uint32(buf[8:])
+		if dataLen > segment.MaxChunkedEntrySize {
+			return nil, fmt.Errorf("entry %d is larger than MaxChunkedEntrySize", e.Index)
+		}
+		e.Data = make([]byte, dataLen)
+		if _, err := io.ReadFull(r, e.Data); err != nil {
+			return nil, err
+		}
+		if i > 0 && e.Index != entries[i-1].Index+1 {
+			return nil, fmt.Errorf("batch entries aren't contiguous: %d follows %d", e.Index, entries[i-1].Index)
+		}
+	}
+	return entries, nil
+}
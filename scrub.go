@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/go-kit/log/level"
+)
+
+// runScrubber verifies every sealed segment once per scrubInterval until
+// Close.
+func (w *WAL) runScrubber() {
+	defer close(w.scrubDone)
+
+	ticker := time.NewTicker(w.scrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.scrubStop:
+			return
+		case <-ticker.C:
+		}
+		w.scrubSegments()
+	}
+}
+
+// scrubSegments verifies each sealed segment in turn, pausing after each for
+// long enough to keep to scrubBytesPerSec. It returns early if the scrubber
+// is stopped.
+func (w *WAL) scrubSegments() {
+	s, release := w.acquireState()
+	var sealed []types.SegmentInfo
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if !seg.SealTime.IsZero() {
+			sealed = append(sealed, seg.SegmentInfo)
+		}
+	}
+	release()
+
+	for _, info := range sealed {
+		if !w.waitIO(w.scrubStop, approxFileSize(info)) {
+			return
+		}
+		start := time.Now()
+		if err := w.scrubSegment(info); err != nil {
+			w.countReadError(readPhaseScrub, err)
+			level.Error(w.logger).Log("msg", "segment failed scrub", "id", info.ID, "err", err)
+			if w.scrubHandler != nil {
+				w.scrubHandler(info, err)
+			}
+		}
+		var pause time.Duration
+		if w.scrubBytesPerSec > 0 {
+			size := uint64(approxFileSize(info))
+			pause = time.Duration(size*uint64(time.Second)/uint64(w.scrubBytesPerSec)) - time.Since(start)
+		}
+		select {
+		case <-w.scrubStop:
+			return
+		case <-time.After(pause):
+		}
+	}
+}
+
+// scrubSegment verifies the segment described by info if it's still in the
+// log. Segments whose reader can't verify itself are read entry by entry.
+func (w *WAL) scrubSegment(info types.SegmentInfo) error {
+	s, release := w.acquireState()
+	defer release()
+
+	seg, ok := s.segments.Get(info.BaseIndex)
+	if !ok || seg.ID != info.ID || seg.r == nil {
+		// Truncated away since the pass started.
+		return nil
+	}
+	sr, releaseReader, err := segmentReader(seg.r)
+	if err != nil {
+		return err
+	}
+	defer releaseReader()
+	w.metrics.segmentsScrubbed.Inc()
+	if v, ok := sr.(types.SegmentVerifier); ok {
+		if err := v.Verify(); err != nil {
+			return fmt.Errorf("segment %d failed verification: %w", seg.ID, err)
+		}
+		return nil
+	}
+	lo, hi := seg.BaseIndex, seg.MaxIndex
+	if seg.MinIndex > lo {
+		lo = seg.MinIndex
+	}
+	if first := s.firstIndex(); lo < first {
+		lo = first
+	}
+	var le types.LogEntry
+	for idx := lo; idx <= hi; idx++ {
+		if err := sr.GetLog(idx, &le); err != nil {
+			return fmt.Errorf("segment %d failed verification at index %d: %w", seg.ID, idx, err)
+		}
+	}
+	return nil
+}
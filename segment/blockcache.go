@@ -0,0 +1,162 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// blockSize is the unit sealed segment files are cached in. Reads larger than
+	// this bypass the cache so that one big entry doesn't evict everything else.
+	blockSize = 32 * 1024
+)
+
+type blockKey struct {
+	segmentID uint64
+	offset    int64
+}
+
+type block struct {
+	key blockKey
+	buf []byte
+}
+
+// BlockCache is a byte-bounded LRU of blocks read from sealed segment files.
+// One BlockCache may be shared by all the readers of a Filer. Since sealed
+// segments are immutable and segment IDs are never reused, cached blocks never
+// need invalidating.
+type BlockCache struct {
+	// hits and misses are accessed atomically. They come first so that
+	// they're 64-bit aligned on 32-bit platforms.
+	hits, misses uint64
+
+	maxBytes int
+
+	mu    sync.Mutex
+	bytes int
+	ll    *list.List // of *block, most recently used at the front
+	items map[blockKey]*list.Element
+}
+
+// NewBlockCache returns a BlockCache that holds up to maxBytes of file data.
+func NewBlockCache(maxBytes int) *BlockCache {
+	return &BlockCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[blockKey]*list.Element),
+	}
+}
+
+// Hits returns the number of block reads served from the cache.
+func (c *BlockCache) Hits() uint64 {
+	return atomic.LoadUint64(&c.hits)
+}
+
+// Misses returns the number of block reads that had to read the file.
+func (c *BlockCache) Misses() uint64 {
+	return atomic.LoadUint64(&c.misses)
+}
+
+func (c *BlockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*block).buf, true
+}
+
+func (c *BlockCache) add(key blockKey, buf []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(buf) > c.maxBytes {
+		return
+	}
+	if _, ok := c.items[key]; ok {
+		// Another reader beat us to it.
+		return
+	}
+	c.items[key] = c.ll.PushFront(&block{key: key, buf: buf})
+	c.bytes += len(buf)
+	for c.bytes > c.maxBytes {
+		b := c.ll.Remove(c.ll.Back()).(*block)
+		delete(c.items, b.key)
+		c.bytes -= len(b.buf)
+	}
+}
+
+// dropSegment removes all blocks for a segment.
+func (c *BlockCache) dropSegment(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if b := el.Value.(*block); b.key.segmentID == id {
+			c.ll.Remove(el)
+			delete(c.items, b.key)
+			c.bytes -= len(b.buf)
+		}
+		el = next
+	}
+}
+
+// cachedFile reads a sealed segment file through a BlockCache.
+type cachedFile struct {
+	rf    io.ReaderAt
+	id    uint64
+	cache *BlockCache
+}
+
+// readBlock returns the block at offset which may be short if it's the last
+// one in the file.
+func (f *cachedFile) readBlock(offset int64) ([]byte, error) {
+	key := blockKey{segmentID: f.id, offset: offset}
+	if buf, ok := f.cache.get(key); ok {
+		atomic.AddUint64(&f.cache.hits, 1)
+		return buf, nil
+	}
+	atomic.AddUint64(&f.cache.misses, 1)
+	buf := make([]byte, blockSize)
+	n, err := f.rf.ReadAt(buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	buf = buf[:n]
+	f.cache.add(key, buf)
+	return buf, nil
+}
+
+// ReadAt implements io.ReaderAt with the same EOF semantics as the underlying
+// file: a read that extends past the end returns what is available and
+// io.EOF.
+func (f *cachedFile) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > blockSize {
+		return f.rf.ReadAt(p, off)
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		blockOff := pos - pos%blockSize
+		buf, err := f.readBlock(blockOff)
+		if err != nil {
+			return n, err
+		}
+		start := int(pos - blockOff)
+		if start >= len(buf) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], buf[start:])
+		if len(buf) < blockSize && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
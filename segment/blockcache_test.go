@@ -0,0 +1,120 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCacheReader(t *testing.T) {
+	vfs := newTestVFS()
+	cache := NewBlockCache(1024 * 1024)
+	f := NewFiler("test", vfs, WithBlockCache(cache))
+
+	seg0 := testSegment(1)
+	seg0.SizeLimit = 256 * 1024
+	w, err := f.Create(seg0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	valFor := func(idx uint64) string {
+		// Vary sizes so frames straddle block boundaries, with the odd one
+		// bigger than a block.
+		n := int(idx%7) * 300
+		if idx%50 == 0 {
+			n = blockSize + 10
+		}
+		return fmt.Sprintf("%05d:%s", idx, strings.Repeat("v", n))
+	}
+
+	var last uint64
+	for idx := uint64(1); ; idx++ {
+		require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Term: 1, Data: []byte(valFor(idx))}}))
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			seg0.IndexStart = indexStart
+			last = idx
+			break
+		}
+	}
+	seg0.MaxIndex = last
+	seg0.SealTime = time.Now()
+
+	r, err := f.Open(seg0)
+	require.NoError(t, err)
+
+	readAll := func() {
+		for idx := uint64(1); idx <= last; idx++ {
+			var le types.LogEntry
+			require.NoError(t, r.GetLog(idx, &le))
+			require.Equal(t, valFor(idx), string(le.Data))
+			require.Equal(t, 1, int(le.Term))
+		}
+	}
+
+	readAll()
+	misses := cache.Misses()
+	require.Greater(t, int(misses), 0)
+
+	// Everything fits so the second pass never touches the file.
+	hits := cache.Hits()
+	readAll()
+	require.Equal(t, misses, cache.Misses())
+	require.Greater(t, int(cache.Hits()), int(hits))
+
+	// Closing drops the segment's blocks.
+	require.NoError(t, r.Close())
+	require.Equal(t, 0, cache.bytes)
+	require.Empty(t, cache.items)
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	cache := NewBlockCache(2 * blockSize)
+
+	data := []byte(strings.Repeat("0123456789", blockSize))
+	rf := newTestWritableFile(len(data))
+	_, err := rf.WriteAt(data, 0)
+	require.NoError(t, err)
+	f := &cachedFile{rf: rf, id: 1, cache: cache}
+
+	read := func(off int64, n int) {
+		t.Helper()
+		buf := make([]byte, n)
+		got, err := f.ReadAt(buf, off)
+		require.NoError(t, err)
+		require.Equal(t, n, got)
+		require.Equal(t, data[off:off+int64(n)], buf)
+	}
+
+	// Straddles blocks 0 and 1.
+	read(blockSize-5, 10)
+	require.Equal(t, 2, int(cache.Misses()))
+
+	read(0, 100)
+	require.Equal(t, 1, int(cache.Hits()))
+
+	// Block 2 evicts block 1 which is least recently used.
+	read(2*blockSize, 10)
+	require.Len(t, cache.items, 2)
+	require.Contains(t, cache.items, blockKey{segmentID: 1, offset: 0})
+	require.Contains(t, cache.items, blockKey{segmentID: 1, offset: 2 * blockSize})
+
+	// Reads past the end behave like the file.
+	buf := make([]byte, 20)
+	n, err := f.ReadAt(buf, int64(len(data)-10))
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 10, n)
+	require.Equal(t, data[len(data)-10:], buf[:10])
+
+	_, err = f.ReadAt(buf, int64(len(data)))
+	require.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,410 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// Cipher suite IDs. A segment with FeatureEncryption records the suite its
+// entries are encrypted with in SegmentInfo.Cipher, and each encrypted entry
+// frame records it again along with the ID of its key, so segments written
+// with different suites or keys can be read side by side. IDs are part of the
+// file format so a suite must keep its ID forever.
+const (
+	// CipherNone means the data isn't encrypted.
+	CipherNone uint8 = iota
+
+	// CipherAES256GCM is AES-256 in GCM mode. It's hardware accelerated on
+	// most platforms and is the only suite available in FIPS builds.
+	CipherAES256GCM
+
+	// CipherChaCha20Poly1305 is ChaCha20-Poly1305 (RFC 8439), which is faster
+	// than AES-GCM in software on platforms without AES instructions.
+	CipherChaCha20Poly1305
+)
+
+// CipherKeySize is the size of the keys both cipher suites take, which the
+// KeyProvider given to WithEncryption must return.
+const CipherKeySize = 32
+
+const (
+	// cipherNonceLen is the length of the random nonce every encrypted entry is
+	// sealed with.
+	cipherNonceLen = 12
+
+	// cipherOverhead is how much longer than its plaintext sealed data is.
+	// Both suites append a 16 byte authentication tag.
+	cipherOverhead = 16
+)
+
+// cipherSuite creates the AEAD for a suite from a key.
+type cipherSuite struct {
+	name string
+	new  func(key []byte) (cipher.AEAD, error)
+}
+
+// cipherSuites are the suites this build can use. ChaCha20-Poly1305 is only
+// added by builds that aren't restricted to FIPS approved algorithms.
+var cipherSuites = map[uint8]cipherSuite{
+	CipherAES256GCM: {name: "aes-256-gcm", new: newAESGCM},
+}
+
+var cipherNames = map[uint8]string{
+	CipherAES256GCM:        "aes-256-gcm",
+	CipherChaCha20Poly1305: "chacha20-poly1305",
+}
+
+// ErrNoEncryptionKeys is returned when reading an encrypted entry, or writing
+// to a segment with FeatureEncryption, without a KeyProvider given to
+// WithEncryption.
+var ErrNoEncryptionKeys = errors.New("segment is encrypted but no encryption keys were given")
+
+// ErrEncryptedTooBig is returned when appending an entry to an encrypted
+// segment that's too big for one frame. Entries are sealed whole so they can't
+// be split into chunks like other large entries.
+var ErrEncryptedTooBig = errors.New("encrypted entries larger than 64MiB are not supported")
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// CipherName returns a description of the suite with id for messages.
+func CipherName(id uint8) string {
+	if name, ok := cipherNames[id]; ok {
+		return fmt.Sprintf("%s (cipher %d)", name, id)
+	}
+	return fmt.Sprintf("cipher %d", id)
+}
+
+// CheckCipher returns an error wrapping types.ErrUnsupportedFormat if this
+// build can't encrypt or decrypt with the suite with id, either because it's
+// unknown or because the build is restricted to FIPS approved algorithms and
+// it isn't one.
+func CheckCipher(id uint8) error {
+	_, err := lookupCipher(id)
+	return err
+}
+
+func lookupCipher(id uint8) (cipherSuite, error) {
+	if s, ok := cipherSuites[id]; ok {
+		return s, nil
+	}
+	if _, ok := cipherNames[id]; ok && FIPSOnly {
+		return cipherSuite{}, fmt.Errorf("%w: %s isn't available in FIPS builds", types.ErrUnsupportedFormat, CipherName(id))
+	}
+	return cipherSuite{}, fmt.Errorf("%w: unknown %s", types.ErrUnsupportedFormat, CipherName(id))
+}
+
+// checkEncryption returns an error if entries can't be appended to a segment
+// with info because it has FeatureEncryption but no keys were given or its
+// suite can't be used.
+func checkEncryption(info types.SegmentInfo, opts fileOpts) error {
+	if info.Features&FeatureEncryption == 0 {
+		return nil
+	}
+	if opts.keys == nil {
+		return ErrNoEncryptionKeys
+	}
+	if info.Cipher == CipherNone {
+		return fmt.Errorf("segment %s has the encryption feature but no cipher suite", FileName(info))
+	}
+	return CheckCipher(info.Cipher)
+}
+
+// keyring makes AEADs from the keys a KeyProvider supplies. It belongs to the
+// Filer and is shared by all its segments. AEADs are made afresh for each use
+// so the only long lived copies of keys are the ones it caches in memory of
+// its own, which are zeroed when they're wiped or the current key rotates. It
+// caches nothing if the provider is a types.KeyReleaser or once it's wiped.
+// The AEADs' own copies of a key can't be zeroed, but are garbage as soon as
+// the entry they were made for has been sealed or opened.
+type keyring struct {
+	keys     types.KeyProvider
+	lock     bool
+	releaser types.KeyReleaser
+
+	mu        sync.RWMutex
+	cached    map[uint32][]byte
+	currentID uint32
+	wiped     bool
+}
+
+func newKeyring(keys types.KeyProvider, lock bool) *keyring {
+	releaser, _ := keys.(types.KeyReleaser)
+	return &keyring{keys: keys, lock: lock, releaser: releaser, cached: map[uint32][]byte{}}
+}
+
+// current returns the ID of the key new entries are encrypted with and an
+// AEAD for suite made from it. The current key is always fetched from the
+// provider, and if it's changed the copy of the last one is wiped.
+func (k *keyring) current(suite uint8) (uint32, cipher.AEAD, error) {
+	id, key, err := k.keys.CurrentKey()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get current encryption key: %w", err)
+	}
+	aead, err := newAEAD(suite, id, key)
+	k.release(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	k.mu.Lock()
+	if id != k.currentID {
+		if old, ok := k.cached[k.currentID]; ok {
+			freeKey(old, k.lock)
+			delete(k.cached, k.currentID)
+		}
+		k.currentID = id
+	}
+	k.mu.Unlock()
+	return id, aead, nil
+}
+
+// forKey returns an AEAD for suite made from the key with id.
+func (k *keyring) forKey(suite uint8, id uint32) (cipher.AEAD, error) {
+	k.mu.RLock()
+	if key, ok := k.cached[id]; ok {
+		// The AEAD is made under the lock since the copy could otherwise be
+		// wiped while it's being read.
+		defer k.mu.RUnlock()
+		return newAEAD(suite, id, key)
+	}
+	k.mu.RUnlock()
+
+	key, err := k.keys.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key %d: %w", id, err)
+	}
+	aead, err := newAEAD(suite, id, key)
+	if err != nil || k.releaser != nil {
+		k.release(id, key)
+		return aead, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.cached[id]; ok || k.wiped {
+		return aead, nil
+	}
+	buf, err := allocKey(len(key), k.lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock encryption key %d into memory: %w", id, err)
+	}
+	copy(buf, key)
+	k.cached[id] = buf
+	return aead, nil
+}
+
+// release hands key back to the provider if it wants it.
+func (k *keyring) release(id uint32, key []byte) {
+	releaseKey(k.keys, id, key)
+}
+
+// releaseKey hands key, with id, back to keys if it's a types.KeyReleaser.
+func releaseKey(keys types.KeyProvider, id uint32, key []byte) {
+	if r, ok := keys.(types.KeyReleaser); ok {
+		r.ReleaseKey(id, key)
+	}
+}
+
+// wipe zeroes and forgets every cached key, and stops more being cached.
+func (k *keyring) wipe() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for id, key := range k.cached {
+		freeKey(key, k.lock)
+		delete(k.cached, id)
+	}
+	k.wiped = true
+}
+
+// newAEAD returns an AEAD for suite made from key, which has id.
+func newAEAD(suite uint8, id uint32, key []byte) (cipher.AEAD, error) {
+	s, err := lookupCipher(suite)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != CipherKeySize {
+		return nil, fmt.Errorf("encryption key %d is %d bytes, %s needs %d", id, len(key), s.name, CipherKeySize)
+	}
+	aead, err := s.new(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s cipher: %w", s.name, err)
+	}
+	return aead, nil
+}
+
+// wipe zeroes b.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// entryEncryption is the encryption metadata of an entry frame with
+// frameFlagEncrypted set.
+type entryEncryption struct {
+	// suite is the ID of the cipher suite the data was encrypted with.
+	suite uint8
+
+	// keyID is the ID of the key it was encrypted with.
+	keyID uint32
+
+	// nonce is the random nonce it was sealed with.
+	nonce [cipherNonceLen]byte
+}
+
+// entryAAD returns the additional data an entry's data is sealed with. It
+// binds the data to the entry's place in the log so that an encrypted entry
+// can't be passed off as another.
+func entryAAD(ee entryEncryption, segID, idx uint64) [21]byte {
+	var aad [21]byte
+	binary.LittleEndian.PutUint64(aad[0:], segID)
+	binary.LittleEndian.PutUint64(aad[8:], idx)
+	aad[16] = ee.suite
+	binary.LittleEndian.PutUint32(aad[17:], ee.keyID)
+	return aad
+}
+
+// encryptEntry seals data, the data of the entry with index idx in segment
+// segID, with keys' current key and returns it along with the metadata
+// needed to open it again.
+func encryptEntry(keys *keyring, suite uint8, segID, idx uint64, data []byte) ([]byte, entryEncryption, error) {
+	if keys == nil {
+		return nil, entryEncryption{}, ErrNoEncryptionKeys
+	}
+	id, aead, err := keys.current(suite)
+	if err != nil {
+		return nil, entryEncryption{}, err
+	}
+	ee := entryEncryption{suite: suite, keyID: id}
+	if _, err := rand.Read(ee.nonce[:]); err != nil {
+		return nil, ee, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	aad := entryAAD(ee, segID, idx)
+	return aead.Seal(make([]byte, 0, len(data)+cipherOverhead), ee.nonce[:], data, aad[:]), ee, nil
+}
+
+// decryptEntry appends the data of the entry with index idx in segment segID,
+// sealed as described by ee, whose stored form is stored, to dst.
+func decryptEntry(dst, stored []byte, ee entryEncryption, keys *keyring, segID, idx uint64) ([]byte, error) {
+	if keys == nil {
+		return nil, ErrNoEncryptionKeys
+	}
+	aead, err := keys.forKey(ee.suite, ee.keyID)
+	if err != nil {
+		return nil, err
+	}
+	aad := entryAAD(ee, segID, idx)
+	out, err := aead.Open(dst, ee.nonce[:], stored, aad[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt entry with %s and key %d: %s", types.ErrCorrupt, CipherName(ee.suite), ee.keyID, err)
+	}
+	return out, nil
+}
+
+// entryDecoder turns the stored data of an entry frame that's compressed or
+// encrypted back into the entry's data.
+type entryDecoder struct {
+	segID uint64
+	keys  *keyring
+	dict  *dictionary
+}
+
+// decode appends the data of the entry with index idx, whose frame has flags
+// and metadata meta and stores stored, to dst. Encrypted data is decrypted
+// first since it's compressed before it's encrypted.
+func (d entryDecoder) decode(dst, stored, meta []byte, flags uint8, idx uint64) ([]byte, error) {
+	if flags&frameFlagEncrypted != 0 {
+		out := dst
+		if flags&frameFlagCompressed != 0 {
+			out = nil
+		}
+		plain, err := decryptEntry(out, stored, readEntryEncryption(meta, flags), d.keys, d.segID, idx)
+		if err != nil || flags&frameFlagCompressed == 0 {
+			return plain, err
+		}
+		stored = plain
+	}
+	return decompressEntry(dst, stored, readEntryCompression(meta, flags), d.dict)
+}
+
+// encryptedValueHeaderLen is the length of the cipher suite, key ID and nonce
+// that prefix a value sealed by an Encrypter.
+const encryptedValueHeaderLen = 1 + 4 + cipherNonceLen
+
+// Encrypter encrypts values kept outside of segments, such as the WAL's
+// metadata, with the same cipher suites and keys as entries. It's safe for
+// concurrent use.
+type Encrypter struct {
+	keys  *keyring
+	suite uint8
+}
+
+// NewEncrypter returns an Encrypter that seals values with suite and keys'
+// current key, and opens values sealed with any suite this build supports and
+// any key keys still has. Keys are kept as WithKeyLocking describes if
+// lockKeys is set.
+func NewEncrypter(keys types.KeyProvider, suite uint8, lockKeys bool) (*Encrypter, error) {
+	if err := CheckCipher(suite); err != nil {
+		return nil, err
+	}
+	return &Encrypter{keys: newKeyring(keys, lockKeys), suite: suite}, nil
+}
+
+// WipeKeys implements types.KeyWiper.
+func (e *Encrypter) WipeKeys() {
+	e.keys.wipe()
+}
+
+// Seal appends data encrypted with the current key to dst, prefixed by the
+// suite, the key's ID and the random nonce used. aad is authenticated along
+// with it but not stored, so the same aad must be given to Open, which binds
+// the value to, for example, the key it's stored under.
+func (e *Encrypter) Seal(dst, data, aad []byte) ([]byte, error) {
+	id, aead, err := e.keys.current(e.suite)
+	if err != nil {
+		return nil, err
+	}
+	start := len(dst)
+	dst = append(dst, make([]byte, encryptedValueHeaderLen)...)
+	hdr := dst[start:]
+	hdr[0] = e.suite
+	binary.LittleEndian.PutUint32(hdr[1:], id)
+	if _, err := rand.Read(hdr[5:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(dst, hdr[5:encryptedValueHeaderLen], data, append(hdr[:5:5], aad...)), nil
+}
+
+// Open appends the data in sealed, a value returned by Seal with the same aad,
+// to dst. It returns an error wrapping types.ErrCorrupt if the value has been
+// changed or wasn't sealed with aad.
+func (e *Encrypter) Open(dst, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < encryptedValueHeaderLen+cipherOverhead {
+		return nil, fmt.Errorf("%w: encrypted value is too short", types.ErrCorrupt)
+	}
+	suite, id := sealed[0], binary.LittleEndian.Uint32(sealed[1:])
+	aead, err := e.keys.forKey(suite, id)
+	if err != nil {
+		return nil, err
+	}
+	out, err := aead.Open(dst, sealed[5:encryptedValueHeaderLen], sealed[encryptedValueHeaderLen:], append(sealed[:5:5], aad...))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt value with %s and key %d: %s", types.ErrCorrupt, CipherName(suite), id, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,12 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build boringcrypto
+
+package segment
+
+// FIPSOnly is true in builds restricted to FIPS approved algorithms, made with
+// the boringcrypto build tag that GOEXPERIMENT=boringcrypto sets. AES-GCM is
+// then done by the BoringCrypto module and CipherChaCha20Poly1305 isn't
+// available.
+const FIPSOnly = true
@@ -0,0 +1,327 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func encryptionKeys() *testKeys {
+	return &testKeys{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, CipherKeySize)}}
+}
+
+func TestEncryptedSegment(t *testing.T) {
+	for _, suite := range []uint8{CipherAES256GCM, CipherChaCha20Poly1305} {
+		t.Run(CipherName(suite), func(t *testing.T) {
+			if err := CheckCipher(suite); err != nil {
+				require.True(t, FIPSOnly)
+				t.Skip(err)
+			}
+			keys := encryptionKeys()
+			vfs := newTestVFS()
+			f := NewFiler("test", vfs, WithEncryption(keys), WithCompression(CompressionDeflate))
+
+			seg := testSegment(1)
+			seg.SizeLimit = 1024 * 1024
+			seg.Features = CurrentFeatures | FeatureCompression | FeatureEncryption
+			seg.Cipher = suite
+			w, err := f.Create(seg)
+			require.NoError(t, err)
+
+			entries := []types.LogEntry{
+				// Compressed and then encrypted.
+				{Index: 1, Data: []byte(strings.Repeat("secret ", 1000))},
+				{Index: 2, Term: 3, Type: 4, Meta: []byte("meta"), AppendedAt: time.Unix(1700000000, 0), Data: []byte("a small secret")},
+				{Index: 3},
+			}
+			require.NoError(t, w.Append(entries))
+			require.False(t, bytes.Contains(vfs.files[FileName(seg)].getBuf(), []byte("secret")))
+
+			check := func(r types.SegmentReader) {
+				t.Helper()
+				for _, e := range entries {
+					var got types.LogEntry
+					require.NoError(t, r.GetLog(e.Index, &got))
+					require.Equal(t, string(e.Data), string(got.Data))
+					require.Equal(t, e.Term, got.Term)
+					require.Equal(t, string(e.Meta), string(got.Meta))
+
+					rd, size, err := r.(types.SegmentDataReader).GetLogReader(e.Index)
+					require.NoError(t, err)
+					require.Equal(t, len(e.Data), int(size))
+					data, err := io.ReadAll(rd)
+					require.NoError(t, err)
+					require.Equal(t, string(e.Data), string(data))
+				}
+			}
+			check(w)
+			r := w.(*Writer).r
+			for idx, compressed := range map[uint64]bool{1: true, 2: false, 3: false} {
+				offset, err := r.findFrameOffset(idx)
+				require.NoError(t, err)
+				fh, err := r.readFrameHeaderAt(int64(offset))
+				require.NoError(t, err)
+				require.NotZero(t, fh.flags&frameFlagEncrypted, "index %d", idx)
+				require.Equal(t, compressed, fh.flags&frameFlagCompressed != 0, "index %d", idx)
+			}
+
+			// Rotating the key leaves earlier entries readable.
+			keys.keys[2] = bytes.Repeat([]byte{2}, CipherKeySize)
+			keys.current = 2
+			vf := NewFiler("test", vfs, WithEncryption(keys), WithVerifyOnRead())
+			w, err = vf.RecoverTail(seg)
+			require.NoError(t, err)
+			check(w)
+			entries = append(entries, types.LogEntry{Index: 4, Data: []byte("another secret")})
+			require.NoError(t, w.Append(entries[3:]))
+			indexStart, err := w.(types.SegmentSealer).Seal()
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			seg.IndexStart, seg.MaxIndex = indexStart, 4
+
+			rd, err := vf.Open(seg)
+			require.NoError(t, err)
+			check(rd)
+			require.NoError(t, rd.(types.SegmentVerifier).Verify())
+			tr, err := rd.(*Reader).Trailer()
+			require.NoError(t, err)
+			require.Equal(t, 7000+14+14, int(tr.DataBytes))
+			require.NoError(t, rd.Close())
+
+			var dumped []string
+			require.NoError(t, vf.DumpSegment(seg.BaseIndex, seg.ID, 0, 0, func(_ types.SegmentInfo, e types.LogEntry) (bool, error) {
+				dumped = append(dumped, string(e.Data))
+				return true, nil
+			}))
+			require.Len(t, dumped, len(entries))
+			for i, e := range entries {
+				require.Equal(t, string(e.Data), dumped[i])
+			}
+
+			// Without the keys only the metadata can be read.
+			rd, err = NewFiler("test", vfs).Open(seg)
+			require.NoError(t, err)
+			var le types.LogEntry
+			require.ErrorIs(t, rd.GetLog(2, &le), ErrNoEncryptionKeys)
+			require.NoError(t, rd.GetLogMeta(2, &le))
+			require.Equal(t, "meta", string(le.Meta))
+			require.NoError(t, rd.Close())
+
+			// Nor with the wrong ones.
+			wrong := encryptionKeys()
+			wrong.keys[2] = bytes.Repeat([]byte{3}, CipherKeySize)
+			rd, err = NewFiler("test", vfs, WithEncryption(wrong)).Open(seg)
+			require.NoError(t, err)
+			require.NoError(t, rd.GetLog(2, &le))
+			require.ErrorIs(t, rd.GetLog(4, &le), types.ErrCorrupt)
+			delete(wrong.keys, 1)
+			require.ErrorContains(t, NewFiler("test", vfs, WithEncryption(wrong)).DumpSegment(seg.BaseIndex, seg.ID, 0, 0,
+				func(types.SegmentInfo, types.LogEntry) (bool, error) { return true, nil }), "unknown key 1")
+			require.NoError(t, rd.Close())
+
+			// Tampering is detected even when checksums aren't checked.
+			offset, err := r.findFrameOffset(2)
+			require.NoError(t, err)
+			fh, err := r.readFrameHeaderAt(int64(offset))
+			require.NoError(t, err)
+			vfs.files[FileName(seg)].getBuf()[int(offset)+frameHeaderLen+int(fh.len)-1] ^= 1
+			rd, err = NewFiler("test", vfs, WithEncryption(keys)).Open(seg)
+			require.NoError(t, err)
+			require.ErrorIs(t, rd.GetLog(2, &le), types.ErrCorrupt)
+			require.NoError(t, rd.Close())
+		})
+	}
+}
+
+func TestEncryptionErrors(t *testing.T) {
+	keys := encryptionKeys()
+	seg := testSegment(1)
+	seg.Features = CurrentFeatures | FeatureEncryption
+	seg.Cipher = CipherAES256GCM
+
+	_, err := NewFiler("test", newTestVFS()).Create(seg)
+	require.ErrorIs(t, err, ErrNoEncryptionKeys)
+	_, err = NewFiler("test", newTestVFS()).RecoverTail(seg)
+	require.ErrorIs(t, err, ErrNoEncryptionKeys)
+	f := NewFiler("test", newTestVFS(), WithEncryption(keys))
+
+	bad := seg
+	bad.Cipher = CipherNone
+	_, err = f.Create(bad)
+	require.ErrorContains(t, err, "no cipher suite")
+	bad.Cipher = 9
+	_, err = f.Create(bad)
+	require.ErrorIs(t, err, types.ErrUnsupportedFormat)
+	require.ErrorContains(t, err, "unknown cipher 9")
+
+	err = CheckCipher(CipherChaCha20Poly1305)
+	if FIPSOnly {
+		require.ErrorIs(t, err, types.ErrUnsupportedFormat)
+		require.ErrorContains(t, err, "chacha20-poly1305 (cipher 2) isn't available in FIPS builds")
+	} else {
+		require.NoError(t, err)
+	}
+
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Entries are sealed whole so they can't be chunked.
+	err = w.Append([]types.LogEntry{{Index: 1, Data: make([]byte, MaxEntrySize)}})
+	require.ErrorIs(t, err, ErrEncryptedTooBig)
+	err = w.(types.SegmentStreamAppender).AppendFrom(types.LogEntry{Index: 1}, strings.NewReader(""), MaxEntrySize+1)
+	require.ErrorIs(t, err, ErrEncryptedTooBig)
+
+	// Entries that would otherwise be streamed are read and sealed whole.
+	data := strings.Repeat("x", streamChunkSize+1)
+	require.NoError(t, w.(types.SegmentStreamAppender).AppendFrom(types.LogEntry{Index: 1}, strings.NewReader(data), int64(len(data))))
+	var le types.LogEntry
+	require.NoError(t, w.GetLog(1, &le))
+	require.Equal(t, data, string(le.Data))
+
+	keys.keys[1] = []byte("too short")
+	f = NewFiler("test", newTestVFS(), WithEncryption(keys))
+	w, err = f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+	require.ErrorContains(t, w.Append([]types.LogEntry{{Index: 1}}), "encryption key 1 is 9 bytes, aes-256-gcm needs 32")
+}
+
+// countingKeys counts how many times each key is fetched.
+type countingKeys struct {
+	*testKeys
+	fetched map[uint32]int
+}
+
+func (k *countingKeys) Key(id uint32) ([]byte, error) {
+	k.fetched[id]++
+	return k.testKeys.Key(id)
+}
+
+// releasingKeys hands out a copy of each key and wipes it once it's released,
+// like a client of a KMS might.
+type releasingKeys struct {
+	*testKeys
+	fetched, released int
+}
+
+func (k *releasingKeys) CurrentKey() (uint32, []byte, error) {
+	k.fetched++
+	id, key, err := k.testKeys.CurrentKey()
+	return id, append([]byte(nil), key...), err
+}
+
+func (k *releasingKeys) Key(id uint32) ([]byte, error) {
+	k.fetched++
+	key, err := k.testKeys.Key(id)
+	return append([]byte(nil), key...), err
+}
+
+func (k *releasingKeys) ReleaseKey(id uint32, key []byte) {
+	k.released++
+	wipe(key)
+}
+
+func TestKeyHygiene(t *testing.T) {
+	seg := testSegment(1)
+	seg.Features = CurrentFeatures | FeatureEncryption
+	seg.Cipher = CipherAES256GCM
+	read := func(r types.SegmentReader, last uint64) {
+		t.Helper()
+		for idx := uint64(1); idx <= last; idx++ {
+			var le types.LogEntry
+			require.NoError(t, r.GetLog(idx, &le))
+			require.Equal(t, fmt.Sprintf("secret %d", idx), string(le.Data))
+		}
+	}
+	appendEntries := func(w types.SegmentWriter, first, last uint64) {
+		t.Helper()
+		var entries []types.LogEntry
+		for idx := first; idx <= last; idx++ {
+			entries = append(entries, types.LogEntry{Index: idx, Data: []byte(fmt.Sprintf("secret %d", idx))})
+		}
+		require.NoError(t, w.Append(entries))
+	}
+	zero := make([]byte, CipherKeySize)
+
+	t.Run("cached", func(t *testing.T) {
+		keys := &countingKeys{testKeys: encryptionKeys(), fetched: map[uint32]int{}}
+		f := NewFiler("test", newTestVFS(), WithEncryption(keys))
+		w, err := f.Create(seg)
+		require.NoError(t, err)
+		defer w.Close()
+		appendEntries(w, 1, 3)
+		read(w, 3)
+		read(w, 3)
+		require.Equal(t, 1, keys.fetched[1])
+		copied := f.opts.keys.cached[1]
+		require.Equal(t, keys.keys[1], copied)
+
+		// Rotating the current key wipes the copy of the last one.
+		keys.keys[2] = bytes.Repeat([]byte{2}, CipherKeySize)
+		keys.current = 2
+		appendEntries(w, 4, 5)
+		require.Equal(t, zero, copied)
+		read(w, 5)
+		require.Equal(t, 2, keys.fetched[1])
+
+		// Wiping zeroes every copy and stops more being kept.
+		copied = f.opts.keys.cached[2]
+		require.Equal(t, keys.keys[2], copied)
+		f.WipeKeys()
+		require.Equal(t, zero, copied)
+		read(w, 5)
+		read(w, 5)
+		require.Equal(t, 2+2*3, keys.fetched[1])
+		require.Empty(t, f.opts.keys.cached)
+	})
+
+	t.Run("released", func(t *testing.T) {
+		keys := &releasingKeys{testKeys: encryptionKeys()}
+		f := NewFiler("test", newTestVFS(), WithEncryption(keys), WithHMAC(keys, true))
+		w, err := f.Create(seg)
+		require.NoError(t, err)
+		defer w.Close()
+		appendEntries(w, 1, 3)
+		read(w, 3)
+		read(w, 3)
+		require.Greater(t, keys.fetched, 6)
+		require.Equal(t, keys.fetched, keys.released)
+		require.Empty(t, f.opts.keys.cached)
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		keys := encryptionKeys()
+		f := NewFiler("test", newTestVFS(), WithEncryption(keys), WithKeyLocking())
+		w, err := f.Create(seg)
+		require.NoError(t, err)
+		defer w.Close()
+		appendEntries(w, 1, 3)
+		var le types.LogEntry
+		err = w.GetLog(1, &le)
+		if !KeyLockingSupported {
+			require.ErrorContains(t, err, "can't be locked into memory")
+			return
+		}
+		if err != nil {
+			require.ErrorContains(t, err, "failed to lock encryption key")
+			t.Skip(err)
+		}
+		read(w, 3)
+		copied := f.opts.keys.cached[1]
+		require.Equal(t, keys.keys[1], copied)
+		require.Equal(t, os.Getpagesize(), cap(copied))
+		f.WipeKeys()
+		require.Empty(t, f.opts.keys.cached)
+	})
+}
@@ -0,0 +1,346 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// Compression codec IDs. Each compressed entry frame records the ID of the
+// codec its data was compressed with, and readers look the codec up in the
+// registry to decompress it. IDs are part of the file format so a codec must
+// keep its ID forever. Only CompressionDeflate is built in. The IDs of other
+// well known algorithms are reserved so that independent implementations of
+// them agree, and IDs from CompressionCustom up are free for applications'
+// own codecs.
+const (
+	// CompressionNone is never registered. It means the data isn't compressed.
+	CompressionNone uint8 = iota
+
+	// CompressionDeflate is DEFLATE (RFC 1951) as implemented by compress/flate.
+	CompressionDeflate
+
+	// CompressionZstd is reserved for Zstandard.
+	CompressionZstd
+
+	// CompressionLZ4 is reserved for the LZ4 block format.
+	CompressionLZ4
+
+	// CompressionSnappy is reserved for the Snappy block format.
+	CompressionSnappy
+
+	// CompressionCustom is the first ID free for application defined codecs.
+	CompressionCustom uint8 = 128
+)
+
+var reservedCompressionNames = map[uint8]string{
+	CompressionDeflate: "deflate",
+	CompressionZstd:    "zstd",
+	CompressionLZ4:     "lz4",
+	CompressionSnappy:  "snappy",
+}
+
+// ErrCompressionNotRegistered is returned when reading an entry compressed
+// with a codec that hasn't been registered in this process. The error names
+// the codec. It wraps types.ErrUnsupportedFormat since the data isn't corrupt,
+// this build just can't read it.
+var ErrCompressionNotRegistered = fmt.Errorf("%w: compression codec not registered", types.ErrUnsupportedFormat)
+
+// CompressionCodec compresses and decompresses entry data. Implementations
+// must be safe for concurrent use.
+type CompressionCodec interface {
+	// ID is the codec's ID, recorded in every frame it compresses.
+	ID() uint8
+
+	// Name is a short name for the codec used in errors and tools.
+	Name() string
+
+	// Compress appends the compressed form of src to dst and returns the
+	// extended buffer.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress appends the decompressed form of src to dst and returns the
+	// extended buffer. size is the length the decompressed data had when it
+	// was compressed, so dst can be grown once up front.
+	Decompress(dst, src []byte, size int) ([]byte, error)
+}
+
+var compressionRegistry = struct {
+	sync.RWMutex
+	codecs map[uint8]CompressionCodec
+}{codecs: map[uint8]CompressionCodec{}}
+
+func init() {
+	if err := RegisterCompression(deflateCodec{}); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterCompression makes c available to segments in this process under
+// c.ID(), both for writing with WithCompression and for reading. It returns an
+// error if the ID is CompressionNone or already registered, or if it's one of
+// the reserved IDs and c has a different name. Codecs are usually registered
+// from the init function of the package that implements them.
+func RegisterCompression(c CompressionCodec) error {
+	id := c.ID()
+	if id == CompressionNone {
+		return errors.New("compression codec ID 0 is reserved for uncompressed data")
+	}
+	if name, ok := reservedCompressionNames[id]; ok && name != c.Name() {
+		return fmt.Errorf("compression codec ID %d is reserved for %s, not %s", id, name, c.Name())
+	}
+	compressionRegistry.Lock()
+	defer compressionRegistry.Unlock()
+	if old, ok := compressionRegistry.codecs[id]; ok {
+		return fmt.Errorf("compression codec ID %d is already registered to %s", id, old.Name())
+	}
+	compressionRegistry.codecs[id] = c
+	return nil
+}
+
+// LookupCompression returns the codec registered with id. If there isn't one
+// it returns an error wrapping ErrCompressionNotRegistered that names the
+// codec if the ID is a reserved one.
+func LookupCompression(id uint8) (CompressionCodec, error) {
+	compressionRegistry.RLock()
+	c, ok := compressionRegistry.codecs[id]
+	compressionRegistry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCompressionNotRegistered, CompressionName(id))
+	}
+	return c, nil
+}
+
+// CompressionName returns a description of the codec with id, including its
+// name if it's registered or reserved, for messages.
+func CompressionName(id uint8) string {
+	compressionRegistry.RLock()
+	c, ok := compressionRegistry.codecs[id]
+	compressionRegistry.RUnlock()
+	if ok {
+		return fmt.Sprintf("%s (codec %d)", c.Name(), id)
+	}
+	if name, ok := reservedCompressionNames[id]; ok {
+		return fmt.Sprintf("%s (codec %d)", name, id)
+	}
+	return fmt.Sprintf("codec %d", id)
+}
+
+// Defaults for the fields of CompressionPolicy left as zero.
+const (
+	DefaultCompressionMinSize    = 128
+	DefaultCompressionSampleSize = 4096
+	DefaultCompressionMaxRatio   = 0.9
+
+	// DefaultDictionaryMinSize replaces DefaultCompressionMinSize in segments
+	// with a dictionary, against which even small entries compress well.
+	DefaultDictionaryMinSize = 16
+)
+
+// CompressionPolicy decides which entries are worth compressing so that CPU
+// isn't wasted on data that's too small to gain much or that's already
+// compressed or encrypted. Entries that aren't worth it are stored as they
+// are, without the compressed flag on their frame, and cost nothing extra to
+// read. Zero fields take their defaults.
+type CompressionPolicy struct {
+	// MinSize is the smallest entry data that's compressed. Defaults to
+	// DefaultCompressionMinSize, or DefaultDictionaryMinSize in segments with
+	// a dictionary.
+	MinSize int
+
+	// SampleSize is how much of the start of larger entries is compressed
+	// first as a sample. Entries with at least twice as much data are only
+	// compressed in full if their sample compresses to within MaxRatio.
+	// Defaults to DefaultCompressionSampleSize, and a negative size compresses
+	// every entry in full.
+	SampleSize int
+
+	// MaxRatio is the most that compressed data, including the compression
+	// metadata in its frame, can be as a fraction of its original size for
+	// it to be stored compressed. It must be more than 0 and no more than 1.
+	// Defaults to DefaultCompressionMaxRatio.
+	MaxRatio float64
+}
+
+// withDefaults returns p with its zero fields set to their defaults for a
+// segment that has a dictionary or not.
+func (p CompressionPolicy) withDefaults(dict bool) CompressionPolicy {
+	if p.MinSize == 0 {
+		p.MinSize = DefaultCompressionMinSize
+		if dict {
+			p.MinSize = DefaultDictionaryMinSize
+		}
+	}
+	if p.SampleSize == 0 {
+		p.SampleSize = DefaultCompressionSampleSize
+	}
+	if p.MaxRatio == 0 {
+		p.MaxRatio = DefaultCompressionMaxRatio
+	}
+	return p
+}
+
+// Validate returns an error if p's fields are out of range.
+func (p CompressionPolicy) Validate() error {
+	if p.MinSize < 0 {
+		return fmt.Errorf("compression min size can't be negative")
+	}
+	if p.MaxRatio < 0 || p.MaxRatio > 1 {
+		return fmt.Errorf("compression max ratio must be between 0 and 1, got %v", p.MaxRatio)
+	}
+	return nil
+}
+
+// worthIt reports whether data of size n compressing to compressed bytes is
+// a good enough ratio to keep.
+func (p CompressionPolicy) worthIt(compressed, n int) bool {
+	return compressed < n && float64(compressed) <= p.MaxRatio*float64(n)
+}
+
+// entryCompression is the compression metadata of an entry frame with
+// frameFlagCompressed set.
+type entryCompression struct {
+	// codec is the ID of the codec the data was compressed with.
+	codec uint8
+
+	// size is the length of the data before it was compressed.
+	size uint32
+}
+
+// compressEntry returns data compressed with c, or false if p says it isn't
+// worth compressing, either before trying because it's small or its sample
+// doesn't compress well, or because it didn't save enough once the
+// compression metadata is added.
+func compressEntry(c CompressionCodec, p CompressionPolicy, data []byte) ([]byte, bool, error) {
+	if len(data) < p.MinSize || len(data) == 0 {
+		return nil, false, nil
+	}
+	var out []byte
+	if p.SampleSize > 0 && len(data) >= 2*p.SampleSize {
+		sample, err := c.Compress(nil, data[:p.SampleSize])
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to compress entry with %s: %w", c.Name(), err)
+		}
+		if !p.worthIt(len(sample), p.SampleSize) {
+			return nil, false, nil
+		}
+		out = sample[:0]
+	}
+	out, err := c.Compress(out, data)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to compress entry with %s: %w", c.Name(), err)
+	}
+	if !p.worthIt(len(out)+entryCompressionLen, len(data)) {
+		return nil, false, nil
+	}
+	return out, true, nil
+}
+
+// decompressEntry appends the data of an entry frame compressed as described
+// by ec, whose stored form is stored, to dst. dict is the segment's dictionary
+// if it has one.
+func decompressEntry(dst, stored []byte, ec entryCompression, dict *dictionary) ([]byte, error) {
+	c, err := LookupCompression(ec.codec)
+	if err != nil {
+		return nil, err
+	}
+	if dict != nil {
+		if c, err = dict.codec(c); err != nil {
+			return nil, err
+		}
+	}
+	if ec.size > MaxEntrySize {
+		return nil, fmt.Errorf("%w: compressed entry is larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
+	}
+	start := len(dst)
+	out, err := c.Decompress(dst, stored, int(ec.size))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decompress entry with %s: %s", types.ErrCorrupt, c.Name(), err)
+	}
+	if len(out)-start != int(ec.size) {
+		return nil, fmt.Errorf("%w: entry decompressed with %s to %d bytes, expected %d",
+			types.ErrCorrupt, c.Name(), len(out)-start, ec.size)
+	}
+	return out, nil
+}
+
+// deflateCodec is the built-in CompressionDeflate codec. Its writers and
+// readers are pooled since they're expensive to create.
+type deflateCodec struct{}
+
+var (
+	deflateWriters = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	deflateReaders = sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}}
+)
+
+func (deflateCodec) ID() uint8    { return CompressionDeflate }
+func (deflateCodec) Name() string { return "deflate" }
+
+func (deflateCodec) Compress(dst, src []byte) ([]byte, error) {
+	fw := deflateWriters.Get().(*flate.Writer)
+	defer deflateWriters.Put(fw)
+	return deflateCompress(fw, dst, src)
+}
+
+func (deflateCodec) Decompress(dst, src []byte, size int) ([]byte, error) {
+	fr := deflateReaders.Get().(io.ReadCloser)
+	defer deflateReaders.Put(fr)
+	return deflateDecompress(fr, nil, dst, src, size)
+}
+
+func deflateCompress(fw *flate.Writer, dst, src []byte) ([]byte, error) {
+	buf := appendWriter{buf: dst}
+	fw.Reset(&buf)
+	if _, err := fw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.buf, nil
+}
+
+func deflateDecompress(fr io.ReadCloser, dict, dst, src []byte, size int) ([]byte, error) {
+	if err := fr.(flate.Resetter).Reset(bytes.NewReader(src), dict); err != nil {
+		return nil, err
+	}
+	start := len(dst)
+	if cap(dst)-start < size {
+		grown := make([]byte, start, start+size)
+		copy(grown, dst)
+		dst = grown
+	}
+	dst = dst[:start+size]
+	if _, err := io.ReadFull(fr, dst[start:]); err != nil {
+		return nil, err
+	}
+	// The stream must end exactly where size says.
+	var extra [1]byte
+	if n, err := fr.Read(extra[:]); n != 0 || err != io.EOF {
+		return nil, errors.New("data continues past its recorded size")
+	}
+	return dst, nil
+}
+
+// appendWriter is an io.Writer that appends to buf.
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
@@ -0,0 +1,319 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+// testCodec is a custom codec that "compresses" runs of a repeated byte.
+type testCodec struct {
+	id   uint8
+	name string
+}
+
+func (c testCodec) ID() uint8    { return c.id }
+func (c testCodec) Name() string { return c.name }
+
+func (c testCodec) Compress(dst, src []byte) ([]byte, error) {
+	for len(src) > 0 {
+		n := 1
+		for n < len(src) && n < 255 && src[n] == src[0] {
+			n++
+		}
+		dst = append(dst, byte(n), src[0])
+		src = src[n:]
+	}
+	return dst, nil
+}
+
+func (c testCodec) Decompress(dst, src []byte, size int) ([]byte, error) {
+	for ; len(src) >= 2; src = src[2:] {
+		dst = append(dst, bytes.Repeat(src[1:2], int(src[0]))...)
+	}
+	return dst, nil
+}
+
+// unregisterCompression removes a codec registered by a test.
+func unregisterCompression(id uint8) {
+	compressionRegistry.Lock()
+	defer compressionRegistry.Unlock()
+	delete(compressionRegistry.codecs, id)
+}
+
+func TestRegisterCompression(t *testing.T) {
+	c, err := LookupCompression(CompressionDeflate)
+	require.NoError(t, err)
+	require.Equal(t, "deflate", c.Name())
+
+	require.ErrorContains(t, RegisterCompression(testCodec{id: CompressionNone, name: "none"}), "reserved for uncompressed")
+	require.ErrorContains(t, RegisterCompression(testCodec{id: CompressionZstd, name: "fake"}), "reserved for zstd, not fake")
+	require.ErrorContains(t, RegisterCompression(testCodec{id: CompressionDeflate, name: "deflate"}), "already registered to deflate")
+
+	// Unregistered codecs are named if their ID is reserved.
+	_, err = LookupCompression(CompressionLZ4)
+	require.ErrorIs(t, err, ErrCompressionNotRegistered)
+	require.ErrorIs(t, err, types.ErrUnsupportedFormat)
+	require.ErrorContains(t, err, "lz4 (codec 3)")
+	_, err = LookupCompression(CompressionCustom + 1)
+	require.ErrorContains(t, err, "codec 129")
+
+	custom := testCodec{id: CompressionCustom, name: "rle"}
+	require.NoError(t, RegisterCompression(custom))
+	defer unregisterCompression(CompressionCustom)
+	c, err = LookupCompression(CompressionCustom)
+	require.NoError(t, err)
+	require.Equal(t, custom, c)
+	require.Equal(t, "rle (codec 128)", CompressionName(CompressionCustom))
+}
+
+func TestDeflateCodec(t *testing.T) {
+	c, err := LookupCompression(CompressionDeflate)
+	require.NoError(t, err)
+	data := []byte(strings.Repeat("compress me please ", 100))
+	compressed, err := c.Compress([]byte("prefix"), data)
+	require.NoError(t, err)
+	require.Equal(t, "prefix", string(compressed[:6]))
+	require.Less(t, len(compressed), len(data))
+
+	out, err := c.Decompress([]byte("x"), compressed[6:], len(data))
+	require.NoError(t, err)
+	require.Equal(t, "x"+string(data), string(out))
+
+	// The data must be exactly the size recorded.
+	_, err = c.Decompress(nil, compressed[6:], len(data)-1)
+	require.Error(t, err)
+	_, err = c.Decompress(nil, compressed[6:], len(data)+1)
+	require.Error(t, err)
+}
+
+func TestCompressedSegment(t *testing.T) {
+	require.NoError(t, RegisterCompression(testCodec{id: CompressionCustom, name: "rle"}))
+	defer unregisterCompression(CompressionCustom)
+
+	for _, id := range []uint8{CompressionDeflate, CompressionCustom} {
+		t.Run(CompressionName(id), func(t *testing.T) {
+			vfs := newTestVFS()
+			f := NewFiler("test", vfs, WithCompression(id))
+
+			seg := testSegment(1)
+			seg.SizeLimit = 1024 * 1024
+			seg.Features = CurrentFeatures | FeatureCompression
+			w, err := f.Create(seg)
+			require.NoError(t, err)
+
+			random := make([]byte, 1000)
+			rand.New(rand.NewSource(1)).Read(random)
+			entries := []types.LogEntry{
+				{Index: 1, Data: bytes.Repeat([]byte("a"), 10000)},
+				{Index: 2, Term: 3, Type: 4, Meta: []byte("meta"), AppendedAt: time.Unix(1700000000, 0), Data: bytes.Repeat([]byte("b"), 5000)},
+				// Neither of these get any smaller so they are stored as they are.
+				{Index: 3, Data: random},
+				{Index: 4, Data: []byte("x")},
+				{Index: 5},
+			}
+			require.NoError(t, w.Append(entries))
+
+			check := func(r types.SegmentReader) {
+				t.Helper()
+				for _, e := range entries {
+					var got types.LogEntry
+					require.NoError(t, r.GetLog(e.Index, &got))
+					require.Equal(t, string(e.Data), string(got.Data))
+					require.Equal(t, e.Term, got.Term)
+					require.Equal(t, e.Type, got.Type)
+					require.Equal(t, string(e.Meta), string(got.Meta))
+
+					// Reusing a buffer that's big enough.
+					got.Data = make([]byte, 0, 20000)
+					require.NoError(t, r.GetLog(e.Index, &got))
+					require.Equal(t, string(e.Data), string(got.Data))
+
+					rd, size, err := r.(types.SegmentDataReader).GetLogReader(e.Index)
+					require.NoError(t, err)
+					require.Equal(t, len(e.Data), int(size))
+					data, err := io.ReadAll(rd)
+					require.NoError(t, err)
+					require.Equal(t, string(e.Data), string(data))
+				}
+			}
+			check(w)
+
+			// Only the compressible entries were compressed.
+			r := w.(*Writer).r
+			for idx, compressed := range map[uint64]bool{1: true, 2: true, 3: false, 4: false, 5: false} {
+				offset, err := r.findFrameOffset(idx)
+				require.NoError(t, err)
+				fh, err := r.readFrameHeaderAt(int64(offset))
+				require.NoError(t, err)
+				require.Equal(t, compressed, fh.flags&frameFlagCompressed != 0, "index %d", idx)
+			}
+
+			// Reads that verify checksums and the recovered tail agree.
+			vf := NewFiler("test", vfs, WithCompression(id), WithVerifyOnRead())
+			w, err = vf.RecoverTail(seg)
+			require.NoError(t, err)
+			check(w)
+			require.NoError(t, w.Append([]types.LogEntry{{Index: 6, Data: bytes.Repeat([]byte("c"), 3000)}}))
+			entries = append(entries, types.LogEntry{Index: 6, Data: bytes.Repeat([]byte("c"), 3000)})
+			indexStart, err := w.(types.SegmentSealer).Seal()
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			// Sealed segments can be read without the option set.
+			seg.IndexStart = indexStart
+			seg.MaxIndex = 6
+			rd, err := NewFiler("test", vfs).Open(seg)
+			require.NoError(t, err)
+			defer rd.Close()
+			check(rd)
+			require.NoError(t, rd.(types.SegmentVerifier).Verify())
+
+			tr, err := rd.(*Reader).Trailer()
+			require.NoError(t, err)
+			require.Equal(t, 10000+5000+1000+1+3000, int(tr.DataBytes))
+			require.Less(t, tr.StoredBytes, tr.DataBytes/2)
+
+			var dumped []string
+			require.NoError(t, f.DumpSegment(seg.BaseIndex, seg.ID, 0, 0, func(_ types.SegmentInfo, e types.LogEntry) (bool, error) {
+				dumped = append(dumped, string(e.Data))
+				return true, nil
+			}))
+			require.Len(t, dumped, len(entries))
+			for i, e := range entries {
+				require.Equal(t, string(e.Data), dumped[i])
+			}
+		})
+	}
+}
+
+func TestCompressionNotRegistered(t *testing.T) {
+	require.NoError(t, RegisterCompression(testCodec{id: CompressionCustom, name: "rle"}))
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithCompression(CompressionCustom))
+	seg := testSegment(1)
+	seg.Features = CurrentFeatures | FeatureCompression
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Data: bytes.Repeat([]byte("a"), 1000)}}))
+	unregisterCompression(CompressionCustom)
+
+	// Reads name the codec rather than reporting corruption.
+	for _, r := range []*Filer{f, NewFiler("test", vfs, WithVerifyOnRead())} {
+		rd, err := r.Open(seg)
+		require.NoError(t, err)
+		var le types.LogEntry
+		err = rd.GetLog(1, &le)
+		require.ErrorIs(t, err, ErrCompressionNotRegistered)
+		require.NotErrorIs(t, err, types.ErrCorrupt)
+		require.ErrorContains(t, err, "codec 128")
+		require.NoError(t, rd.GetLogMeta(1, &le))
+		require.NoError(t, rd.Close())
+	}
+
+	// Nor can a tail be created or recovered to write with it.
+	_, err = f.RecoverTail(seg)
+	require.ErrorIs(t, err, ErrCompressionNotRegistered)
+	_, err = f.Create(testSegment(2))
+	require.ErrorIs(t, err, ErrCompressionNotRegistered)
+}
+
+// countingCodec counts how many bytes it's asked to compress.
+type countingCodec struct {
+	CompressionCodec
+	compressed *int
+}
+
+func (c countingCodec) Compress(dst, src []byte) ([]byte, error) {
+	*c.compressed += len(src)
+	return c.CompressionCodec.Compress(dst, src)
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat("compress me please ", 4000))
+	// Compresses well at the start but not overall.
+	mixed := append(append([]byte{}, text[:5000]...), random...)
+
+	cases := []struct {
+		name       string
+		policy     CompressionPolicy
+		data       []byte
+		compressed bool
+		// tried is how much data the codec was given.
+		tried int
+	}{
+		{"default", CompressionPolicy{}, text, true, DefaultCompressionSampleSize + len(text)},
+		{"empty", CompressionPolicy{MinSize: -1}, nil, false, 0},
+		{"below min size", CompressionPolicy{}, text[:DefaultCompressionMinSize-1], false, 0},
+		{"at min size", CompressionPolicy{}, text[:DefaultCompressionMinSize], true, DefaultCompressionMinSize},
+		{"lower min size", CompressionPolicy{MinSize: 100}, bytes.Repeat([]byte("a"), 100), true, 100},
+		{"incompressible sample", CompressionPolicy{}, random, false, DefaultCompressionSampleSize},
+		{"too small to sample", CompressionPolicy{}, random[:2*DefaultCompressionSampleSize-1], false, 2*DefaultCompressionSampleSize - 1},
+		{"no sampling", CompressionPolicy{SampleSize: -1}, random, false, len(random)},
+		{"sample passes but whole doesn't", CompressionPolicy{}, mixed, false, DefaultCompressionSampleSize + len(mixed)},
+		{"any saving", CompressionPolicy{MaxRatio: 1}, mixed, true, DefaultCompressionSampleSize + len(mixed)},
+		{"strict ratio", CompressionPolicy{MaxRatio: 0.001}, text, false, DefaultCompressionSampleSize},
+	}
+	deflate, err := LookupCompression(CompressionDeflate)
+	require.NoError(t, err)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tried int
+			c := countingCodec{CompressionCodec: deflate, compressed: &tried}
+			out, ok, err := compressEntry(c, tc.policy.withDefaults(false), tc.data)
+			require.NoError(t, err)
+			require.Equal(t, tc.compressed, ok)
+			require.Equal(t, tc.tried, tried)
+			if ok {
+				got, err := decompressEntry(nil, out, entryCompression{codec: CompressionDeflate, size: uint32(len(tc.data))}, nil)
+				require.NoError(t, err)
+				require.Equal(t, tc.data, got)
+			}
+		})
+	}
+
+	require.NoError(t, CompressionPolicy{}.Validate())
+	require.NoError(t, CompressionPolicy{MinSize: 1, SampleSize: -1, MaxRatio: 1}.Validate())
+	require.Error(t, CompressionPolicy{MinSize: -1}.Validate())
+	require.Error(t, CompressionPolicy{MaxRatio: 1.5}.Validate())
+	require.Error(t, CompressionPolicy{MaxRatio: -0.5}.Validate())
+}
+
+func TestCompressionPolicyOption(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithCompression(CompressionDeflate), WithCompressionPolicy(CompressionPolicy{MinSize: 8}))
+	seg := testSegment(1)
+	seg.Features = CurrentFeatures | FeatureCompression
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	entries := []types.LogEntry{
+		{Index: 1, Data: bytes.Repeat([]byte("a"), 100)},
+		{Index: 2, Data: bytes.Repeat([]byte("a"), 7)},
+	}
+	require.NoError(t, w.Append(entries))
+	r := w.(*Writer).r
+	for idx, compressed := range map[uint64]bool{1: true, 2: false} {
+		offset, err := r.findFrameOffset(idx)
+		require.NoError(t, err)
+		fh, err := r.readFrameHeaderAt(int64(offset))
+		require.NoError(t, err)
+		require.Equal(t, compressed, fh.flags&frameFlagCompressed != 0, "index %d", idx)
+
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, entries[idx-1].Data, le.Data)
+	}
+}
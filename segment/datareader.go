@@ -0,0 +1,169 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// GetLogReader implements types.SegmentDataReader. The returned reader reads
+// the entry's data from the file a piece at a time, following it into any
+// chunk frames. If the segment verifies reads the entry's checksum is checked
+// as the end of the data is reached.
+func (r *Reader) GetLogReader(idx uint64) (io.Reader, int64, error) {
+	offset, err := r.findFrameOffset(idx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if r.info.Codec == CodecUpstreamBinaryV1 {
+		var le types.LogEntry
+		if ok, err := r.readUpstreamFrame(offset, &le, true); err != nil {
+			return nil, 0, err
+		} else if ok {
+			return bytes.NewReader(le.Data), int64(len(le.Data)), nil
+		}
+	}
+
+	var le types.LogEntry
+	fh, metaLen, err := r.readFrameMeta(offset, &le)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fh.typ != FrameEntry {
+		return nil, 0, fmt.Errorf("%w: expected entry frame for index %d in segment %s at offset %d, found type %d",
+			types.ErrCorrupt, idx, FileName(r.info), offset, fh.typ)
+	}
+	if fh.flags&(frameFlagCompressed|frameFlagEncrypted) != 0 {
+		// Compressed and encrypted entries always fit in one frame so just
+		// decode the whole thing.
+		if err := r.GetLog(idx, &le); err != nil {
+			return nil, 0, err
+		}
+		return bytes.NewReader(le.Data), int64(len(le.Data)), nil
+	}
+	dr := &dataReader{
+		r:         r,
+		off:       int64(offset) + int64(frameHeaderLen+metaLen),
+		remaining: int64(fh.len) - int64(metaLen),
+		more:      fh.flags&frameFlagMore != 0,
+		next:      int64(offset) + int64(encodedFrameSize(int(fh.len))),
+	}
+
+	// Add up the chunks to find the total size. Only their headers are read.
+	// If the last one ends with the entry's CRC note where it is.
+	size := dr.remaining
+	trailerOffset := int64(-1)
+	for next, cfh := dr.next, fh; cfh.flags&frameFlagMore != 0; next += int64(encodedFrameSize(int(cfh.len))) {
+		if cfh, err = r.readChunkHeaderAt(next); err != nil {
+			return nil, 0, err
+		}
+		size += int64(chunkDataLen(cfh))
+		if size > MaxChunkedEntrySize {
+			return nil, 0, fmt.Errorf("%w: chunked entry is larger than MaxChunkedEntrySize (%d bytes)", types.ErrCorrupt, MaxChunkedEntrySize)
+		}
+		if cfh.flags&frameFlagCRC != 0 {
+			trailerOffset = next + frameHeaderLen + int64(chunkDataLen(cfh))
+		}
+	}
+
+	if r.verify && (fh.flags&frameFlagCRC != 0 || trailerOffset >= 0) {
+		meta := make([]byte, metaLen)
+		if err := r.readFull(meta, int64(offset)+frameHeaderLen); err != nil {
+			return nil, 0, err
+		}
+		if fh.flags&frameFlagCRC != 0 {
+			dr.stored = binary.LittleEndian.Uint32(meta[metaLen-4:])
+			meta = meta[:metaLen-4]
+		} else {
+			var trailer [4]byte
+			if err := r.readFull(trailer[:], trailerOffset); err != nil {
+				return nil, 0, err
+			}
+			dr.stored = binary.LittleEndian.Uint32(trailer[:])
+		}
+		dr.crc = crc32.New(castagnoliTable)
+		dr.crc.Write(meta)
+		dr.idx = idx
+		dr.frameOffset = offset
+	}
+	return dr, size, nil
+}
+
+// readChunkHeaderAt reads the header of the chunk frame at offset.
+func (r *Reader) readChunkHeaderAt(offset int64) (frameHeader, error) {
+	fh, err := r.readFrameHeaderAt(offset)
+	if err != nil {
+		return fh, err
+	}
+	if fh.typ != FrameChunk {
+		return fh, fmt.Errorf("%w: expected chunk frame in segment %s at offset %d, found type %d",
+			types.ErrCorrupt, FileName(r.info), offset, fh.typ)
+	}
+	if fh.len > MaxEntrySize {
+		return fh, fmt.Errorf("%w: frame header indicates a record larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
+	}
+	return fh, nil
+}
+
+// dataReader streams the data of one entry from a segment file.
+type dataReader struct {
+	r *Reader
+
+	// off is the file offset of the next byte to read and remaining is how
+	// many bytes of data are left in the current frame from there. If more is
+	// true there's another chunk frame at next.
+	off, remaining int64
+	more           bool
+	next           int64
+
+	// crc is set if the entry's checksum should be verified. It's compared
+	// with stored once all the data has been read.
+	crc         hash.Hash32
+	stored      uint32
+	idx         uint64
+	frameOffset uint32
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for d.remaining == 0 {
+		if !d.more {
+			if d.crc != nil {
+				if computed := d.crc.Sum32(); computed != d.stored {
+					return 0, fmt.Errorf("%w: %w for index %d in segment %s at offset %d: stored %08x, computed %08x",
+						types.ErrCorrupt, ErrChecksum, d.idx, FileName(d.r.info), d.frameOffset, d.stored, computed)
+				}
+				d.crc = nil
+			}
+			return 0, io.EOF
+		}
+		fh, err := d.r.readChunkHeaderAt(d.next)
+		if err != nil {
+			return 0, err
+		}
+		d.off = d.next + frameHeaderLen
+		d.remaining = int64(chunkDataLen(fh))
+		d.more = fh.flags&frameFlagMore != 0
+		d.next += int64(encodedFrameSize(int(fh.len)))
+	}
+	if int64(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	if err := d.r.readFull(p, d.off); err != nil {
+		return 0, err
+	}
+	if d.crc != nil {
+		d.crc.Write(p)
+	}
+	d.off += int64(len(p))
+	d.remaining -= int64(len(p))
+	return len(p), nil
+}
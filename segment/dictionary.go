@@ -0,0 +1,388 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+const (
+	// DefaultDictionarySize is the size of dictionary TrainDictionary is
+	// usually asked for. It's the most DEFLATE can make use of.
+	DefaultDictionarySize = 32 * 1024
+
+	// MaxDictionarySize is the largest dictionary a segment can have.
+	MaxDictionarySize = 1024 * 1024
+
+	// dictionarySuffix is added to the name of a segment file to name the file
+	// holding its dictionary.
+	dictionarySuffix = ".dict"
+)
+
+// DictionaryCodec is a CompressionCodec that can compress with a preset
+// dictionary. Small entries that are similar to each other, like the commands
+// of a state machine, compress far better against a dictionary trained on
+// earlier entries than on their own.
+type DictionaryCodec interface {
+	CompressionCodec
+
+	// WithDictionary returns a codec with the same ID that compresses and
+	// decompresses with dict.
+	WithDictionary(dict []byte) (CompressionCodec, error)
+}
+
+// DictionaryID returns the ID that identifies dict in SegmentInfo.Dictionary.
+// It's derived from the dictionary's contents so a damaged or mismatched
+// dictionary file is detected when it's loaded.
+func DictionaryID(dict []byte) uint64 {
+	sum := sha256.Sum256(dict)
+	if id := binary.LittleEndian.Uint64(sum[:8]); id != 0 {
+		return id
+	}
+	return 1
+}
+
+// dictionary is a dictionary shared by the segments created with it, along
+// with the codecs bound to it so that their pools are shared too.
+type dictionary struct {
+	id   uint64
+	data []byte
+
+	mu     sync.Mutex
+	codecs map[uint8]CompressionCodec
+}
+
+func newDictionary(data []byte) *dictionary {
+	return &dictionary{id: DictionaryID(data), data: data, codecs: map[uint8]CompressionCodec{}}
+}
+
+// codec returns c bound to the dictionary.
+func (d *dictionary) codec(c CompressionCodec) (CompressionCodec, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dc, ok := d.codecs[c.ID()]; ok {
+		return dc, nil
+	}
+	dc, ok := c.(DictionaryCodec)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s doesn't support dictionaries", types.ErrUnsupportedFormat, CompressionName(c.ID()))
+	}
+	bound, err := dc.WithDictionary(d.data)
+	if err != nil {
+		return nil, err
+	}
+	d.codecs[c.ID()] = bound
+	return bound, nil
+}
+
+func dictionaryName(fname string) string {
+	return fname + dictionarySuffix
+}
+
+// AddDictionary implements types.SegmentDictionaries. Segments created with
+// the returned ID in SegmentInfo.Dictionary and FeatureDictionary set have
+// their entries compressed with dict, which is written to a file alongside
+// each of them.
+func (f *Filer) AddDictionary(dict []byte) (uint64, error) {
+	if len(dict) == 0 || len(dict) > MaxDictionarySize {
+		return 0, fmt.Errorf("dictionary must be between 1 and %d bytes, got %d", MaxDictionarySize, len(dict))
+	}
+	if f.opts.compression != CompressionNone {
+		c, err := LookupCompression(f.opts.compression)
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := c.(DictionaryCodec); !ok {
+			return 0, fmt.Errorf("%w: %s doesn't support dictionaries", types.ErrUnsupportedFormat, CompressionName(c.ID()))
+		}
+	}
+	d := newDictionary(append([]byte(nil), dict...))
+	f.dictMu.Lock()
+	defer f.dictMu.Unlock()
+	if f.dicts == nil {
+		f.dicts = map[uint64]*dictionary{}
+	}
+	if _, ok := f.dicts[d.id]; !ok {
+		f.dicts[d.id] = d
+	}
+	return d.id, nil
+}
+
+// dictionary returns the dictionary of the segment described by info, or nil
+// if it doesn't have FeatureDictionary. It's loaded from the file alongside
+// the segment unless it has been added or loaded already.
+func (f *Filer) dictionary(info types.SegmentInfo) (*dictionary, error) {
+	if info.Features&FeatureDictionary == 0 {
+		return nil, nil
+	}
+	f.dictMu.Lock()
+	defer f.dictMu.Unlock()
+	if d, ok := f.dicts[info.Dictionary]; ok {
+		return d, nil
+	}
+	data, err := readDictionary(f.vfs, f.segmentDir(info), dictionaryName(f.fileName(info.BaseIndex, info.ID)))
+	if errors.Is(err, os.ErrNotExist) {
+		// Not wrapped since a missing segment file means something else to
+		// RecoverTail's caller.
+		return nil, fmt.Errorf("%w: dictionary %016x of segment %s is missing", types.ErrCorrupt, info.Dictionary, FileName(info))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dictionary of segment %s: %w", FileName(info), err)
+	}
+	d := newDictionary(data)
+	if d.id != info.Dictionary {
+		return nil, fmt.Errorf("%w: dictionary of segment %s has ID %016x, expected %016x",
+			types.ErrCorrupt, FileName(info), d.id, info.Dictionary)
+	}
+	if f.dicts == nil {
+		f.dicts = map[uint64]*dictionary{}
+	}
+	f.dicts[d.id] = d
+	return d, nil
+}
+
+// readDictionary reads the whole of the named dictionary file in dir.
+func readDictionary(vfs types.VFS, dir, name string) ([]byte, error) {
+	rf, err := vfs.OpenReader(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Close()
+	return readAllFile(rf)
+}
+
+func readAllFile(rf types.ReadableFile) ([]byte, error) {
+	buf := make([]byte, 0, 4096)
+	for {
+		if len(buf) == cap(buf) {
+			if len(buf) >= MaxDictionarySize {
+				return nil, fmt.Errorf("%w: dictionary is larger than %d bytes", types.ErrCorrupt, MaxDictionarySize)
+			}
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := rf.ReadAt(buf[len(buf):cap(buf)], int64(len(buf)))
+		buf = buf[:len(buf)+n]
+		if errors.Is(err, io.EOF) {
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeDictionary durably writes d to the file alongside the segment fname in
+// dir, unless it's already there. It's written under a temporary name and
+// renamed into place so a crash never leaves part of one.
+func (f *Filer) writeDictionary(dir, fname string, d *dictionary) error {
+	name := dictionaryName(fname)
+	if existing, err := readDictionary(f.vfs, dir, name); err == nil && bytes.Equal(existing, d.data) {
+		return nil
+	}
+	tmpName := name + ".tmp"
+	if err := f.vfs.Delete(dir, tmpName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	wf, err := f.vfs.Create(dir, tmpName, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := wf.WriteAt(d.data, 0); err != nil {
+		wf.Close()
+		return err
+	}
+	if err := wf.Sync(); err != nil {
+		wf.Close()
+		return err
+	}
+	if err := wf.Close(); err != nil {
+		return err
+	}
+	return f.vfs.Rename(dir, tmpName, name)
+}
+
+// deleteDictionary deletes the dictionary file of the segment fname in dir if
+// there is one.
+func (f *Filer) deleteDictionary(dir, fname string) error {
+	if err := f.vfs.Delete(dir, dictionaryName(fname)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// TrainDictionary builds a dictionary of at most size bytes from samples,
+// which should be typical entries, for example the most recent ones. It picks
+// the pieces of the samples whose 8 byte substrings occur in the most other
+// samples, so what the entries have in common ends up in the dictionary and
+// what's unique to each doesn't. The most useful pieces go at the end, where
+// compressors find them most cheaply. It returns nil if the samples have
+// nothing in common.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	const (
+		// dmer is the length of the substrings counted. 8 bytes fit a uint64.
+		dmer = 8
+		// segLen is the length of each piece picked.
+		segLen = 64
+	)
+	if size < segLen {
+		return nil
+	}
+	key := func(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
+
+	// freq counts how many samples each dmer occurs in.
+	freq := map[uint64]int{}
+	total := 0
+	for _, s := range samples {
+		seen := map[uint64]struct{}{}
+		for i := 0; i+dmer <= len(s); i++ {
+			k := key(s[i:])
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				freq[k]++
+			}
+		}
+		total += len(s)
+	}
+
+	// The samples are split into as many epochs as there are pieces to pick
+	// and the best piece of each epoch is picked, so that the dictionary
+	// covers all of them rather than repeating the same common content.
+	type piece struct {
+		data  []byte
+		score int
+	}
+	var pieces []piece
+	epochLen := total / (size / segLen)
+	if epochLen < segLen {
+		epochLen = segLen
+	}
+	var epoch [][]byte
+	epochBytes := 0
+	pick := func() {
+		best := piece{}
+		for _, s := range epoch {
+			// Slide a window of segLen bytes over s, scoring it by the sum of
+			// the frequencies of the distinct dmers in it.
+			inWindow := map[uint64]int{}
+			score := 0
+			add := func(k uint64, delta int) {
+				n := inWindow[k]
+				inWindow[k] = n + delta
+				if c := freq[k]; c > 1 {
+					if n == 0 && delta > 0 {
+						score += c
+					} else if n == 1 && delta < 0 {
+						score -= c
+					}
+				}
+			}
+			end := len(s)
+			if end > segLen {
+				end = segLen
+			}
+			for i := 0; i+dmer <= end; i++ {
+				add(key(s[i:]), 1)
+			}
+			start := 0
+			for {
+				if score > best.score {
+					best = piece{data: s[start:end], score: score}
+				}
+				if end >= len(s) {
+					break
+				}
+				if start+dmer <= end {
+					add(key(s[start:]), -1)
+				}
+				start++
+				end++
+				if end-dmer >= start {
+					add(key(s[end-dmer:]), 1)
+				}
+			}
+		}
+		if best.score == 0 {
+			return
+		}
+		// Its dmers are covered now so other epochs pick something else.
+		for i := 0; i+dmer <= len(best.data); i++ {
+			freq[key(best.data[i:])] = 0
+		}
+		pieces = append(pieces, best)
+	}
+	for _, s := range samples {
+		epoch = append(epoch, s)
+		epochBytes += len(s)
+		if epochBytes >= epochLen {
+			pick()
+			epoch, epochBytes = epoch[:0], 0
+		}
+	}
+	if len(epoch) > 0 {
+		pick()
+	}
+	if len(pieces) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(pieces, func(i, j int) bool { return pieces[i].score < pieces[j].score })
+	var dict []byte
+	for _, p := range pieces {
+		dict = append(dict, p.data...)
+	}
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	return dict
+}
+
+// deflateDictCodec is deflateCodec with a preset dictionary. DEFLATE only
+// looks back 32KiB so only that much of the end of the dictionary is used.
+type deflateDictCodec struct {
+	dict    []byte
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (deflateCodec) WithDictionary(dict []byte) (CompressionCodec, error) {
+	if len(dict) > DefaultDictionarySize {
+		dict = dict[len(dict)-DefaultDictionarySize:]
+	}
+	c := &deflateDictCodec{dict: dict}
+	c.writers.New = func() any {
+		w, _ := flate.NewWriterDict(nil, flate.DefaultCompression, dict)
+		return w
+	}
+	c.readers.New = func() any {
+		return flate.NewReaderDict(nil, dict)
+	}
+	return c, nil
+}
+
+func (c *deflateDictCodec) ID() uint8    { return CompressionDeflate }
+func (c *deflateDictCodec) Name() string { return "deflate" }
+
+func (c *deflateDictCodec) Compress(dst, src []byte) ([]byte, error) {
+	// Reset keeps the dictionary the writer was created with.
+	fw := c.writers.Get().(*flate.Writer)
+	defer c.writers.Put(fw)
+	return deflateCompress(fw, dst, src)
+}
+
+func (c *deflateDictCodec) Decompress(dst, src []byte, size int) ([]byte, error) {
+	fr := c.readers.Get().(io.ReadCloser)
+	defer c.readers.Put(fr)
+	return deflateDecompress(fr, c.dict, dst, src, size)
+}
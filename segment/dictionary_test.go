@@ -0,0 +1,174 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+// commands returns n small entries like the commands of a key value store,
+// which have a lot in common with each other but little within each.
+func commands(rng *rand.Rand, n int) [][]byte {
+	ops := []string{"set", "delete", "cas"}
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = []byte(fmt.Sprintf(`{"op":"%s","key":"service/web/instances/%08x","session":"%016x","value":{"address":"10.0.%d.%d","port":%d,"healthy":true}}`,
+			ops[rng.Intn(len(ops))], rng.Uint32(), rng.Uint64(), rng.Intn(256), rng.Intn(256), 8000+rng.Intn(100)))
+	}
+	return out
+}
+
+func TestTrainDictionary(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	dict := TrainDictionary(commands(rng, 2000), DefaultDictionarySize)
+	require.NotEmpty(t, dict)
+	require.LessOrEqual(t, len(dict), DefaultDictionarySize)
+
+	deflate, err := LookupCompression(CompressionDeflate)
+	require.NoError(t, err)
+	withDict, err := deflate.(DictionaryCodec).WithDictionary(dict)
+	require.NoError(t, err)
+	require.Equal(t, CompressionDeflate, withDict.ID())
+
+	// Entries the dictionary wasn't trained on compress much better with it.
+	var plain, trained, raw int
+	for _, cmd := range commands(rng, 100) {
+		out, err := deflate.Compress(nil, cmd)
+		require.NoError(t, err)
+		plain += len(out)
+		out, err = withDict.Compress(nil, cmd)
+		require.NoError(t, err)
+		trained += len(out)
+		raw += len(cmd)
+
+		got, err := withDict.Decompress(nil, out, len(cmd))
+		require.NoError(t, err)
+		require.Equal(t, cmd, got)
+		_, err = deflate.Decompress(nil, out, len(cmd))
+		require.Error(t, err, "it can't be decompressed without the dictionary")
+	}
+	require.Less(t, trained, plain*2/3, "raw %d, plain %d, with dictionary %d", raw, plain, trained)
+
+	// Nothing in common, or nowhere to put it.
+	random := make([][]byte, 100)
+	for i := range random {
+		random[i] = make([]byte, 100)
+		rng.Read(random[i])
+	}
+	require.Nil(t, TrainDictionary(random, DefaultDictionarySize))
+	require.Nil(t, TrainDictionary(commands(rng, 100), 10))
+	require.Nil(t, TrainDictionary(nil, DefaultDictionarySize))
+}
+
+func TestDictionarySegment(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	dict := TrainDictionary(commands(rng, 1000), DefaultDictionarySize)
+	opts := []filerOpt{WithCompression(CompressionDeflate)}
+
+	vfs := fs.NewMem()
+	f := NewFiler("wal", vfs, append(opts, WithDataDirs("cold"))...)
+	id, err := f.AddDictionary(dict)
+	require.NoError(t, err)
+	require.Equal(t, DictionaryID(dict), id)
+	_, err = f.AddDictionary(nil)
+	require.Error(t, err)
+
+	seg := testSegment(1)
+	seg.SizeLimit = 1024 * 1024
+	seg.Features = CurrentFeatures | FeatureCompression | FeatureDictionary
+	seg.Dictionary = id
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+
+	entries := make([]types.LogEntry, 0, 100)
+	for i, cmd := range commands(rng, 100) {
+		entries = append(entries, types.LogEntry{Index: uint64(i + 1), Data: cmd})
+	}
+	require.NoError(t, w.Append(entries))
+	check := func(r types.SegmentReader) {
+		t.Helper()
+		for _, e := range entries {
+			var got types.LogEntry
+			require.NoError(t, r.GetLog(e.Index, &got))
+			require.Equal(t, string(e.Data), string(got.Data))
+		}
+	}
+	check(w)
+
+	// Recovery and reads from a fresh Filer load the dictionary from the file
+	// alongside the segment.
+	f = NewFiler("wal", vfs, append(opts, WithDataDirs("cold"))...)
+	w, err = f.RecoverTail(seg)
+	require.NoError(t, err)
+	check(w)
+	indexStart, err := w.(types.SegmentSealer).Seal()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	seg.IndexStart, seg.MaxIndex = indexStart, 100
+
+	r, err := NewFiler("wal", vfs).Open(seg)
+	require.NoError(t, err)
+	check(r)
+	tr, err := r.(*Reader).Trailer()
+	require.NoError(t, err)
+	require.Less(t, tr.StoredBytes, tr.DataBytes/2)
+	require.NoError(t, r.Close())
+
+	var dumped int
+	require.NoError(t, NewFiler("wal", vfs).DumpSegment(seg.BaseIndex, seg.ID, 0, 0, func(_ types.SegmentInfo, e types.LogEntry) (bool, error) {
+		require.Equal(t, string(entries[dumped].Data), string(e.Data))
+		dumped++
+		return true, nil
+	}))
+	require.Equal(t, len(entries), dumped)
+
+	// The dictionary moves with the segment.
+	require.NoError(t, f.CopySegment(seg, "cold"))
+	require.NoError(t, f.DeleteSegmentFile(seg))
+	names, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+	require.Empty(t, names)
+	seg.Dir = "cold"
+	r, err = NewFiler("wal", vfs, WithDataDirs("cold")).Open(seg)
+	require.NoError(t, err)
+	check(r)
+	require.NoError(t, r.Close())
+
+	// A dictionary that doesn't match, or is missing, is corruption rather
+	// than a missing segment.
+	wrong := seg
+	wrong.Dictionary++
+	_, err = NewFiler("wal", vfs).Open(wrong)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+	require.NoError(t, vfs.Delete("cold", dictionaryName(FileName(seg))))
+	_, err = NewFiler("wal", vfs).Open(seg)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+	require.NotErrorIs(t, err, os.ErrNotExist)
+
+	// Deleting the segment deletes its dictionary.
+	require.NoError(t, f.CopySegment(seg, "wal"))
+	require.NoError(t, f.Delete(seg.BaseIndex, seg.ID))
+	for _, dir := range []string{"wal", "cold"} {
+		names, err := vfs.ListDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, names)
+	}
+}
+
+func TestDictionaryUnsupported(t *testing.T) {
+	require.NoError(t, RegisterCompression(testCodec{id: CompressionCustom, name: "rle"}))
+	defer unregisterCompression(CompressionCustom)
+
+	f := NewFiler("wal", fs.NewMem(), WithCompression(CompressionCustom))
+	_, err := f.AddDictionary([]byte("dictionary"))
+	require.ErrorIs(t, err, types.ErrUnsupportedFormat)
+	require.ErrorContains(t, err, "rle (codec 128) doesn't support dictionaries")
+}
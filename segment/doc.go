@@ -0,0 +1,31 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package segment implements the segment files the WAL keeps its log in. It
+// can also be used without the WAL by anything that wants a single append-only
+// file of log entries that survives crashes the same way.
+//
+// A Filer creates and opens segment files in one directory:
+//
+//	f := segment.NewFiler(dir, fs.New())
+//	info := types.SegmentInfo{BaseIndex: 1, MinIndex: 1, ID: 1, SizeLimit: 64 * 1024 * 1024}
+//	sw, err := f.Create(info)
+//
+// Create and RecoverTail always return a *Writer and Open a *Reader, which
+// have a few more methods than the interfaces they're returned as.
+//
+// Appends must start at BaseIndex and have consecutive indexes. Each Append
+// call is written and fsynced as one commit, so after a crash the file holds
+// whole batches only. The segment seals itself by writing an index once it's
+// more than SizeLimit bytes, or it can be sealed early with (*Writer).Seal.
+// Nothing can be appended after that.
+//
+// To read a sealed segment, pass what (*Writer).SealedInfo returns to Open.
+// A caller that didn't keep it, for example after a restart, can call
+// RecoverTail with the info the segment was created with instead. It works on
+// sealed segments as well as unsealed ones, and leaves an unsealed segment
+// ready for more appends after dropping any partly written commit.
+//
+// ParseFrames and RawIterator read the frames of a segment file without
+// checking that they make sense, for tools that inspect damaged files.
+package segment
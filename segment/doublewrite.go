@@ -0,0 +1,198 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+const (
+	// doubleWriteSuffix is added to the name of a segment file to name its
+	// double-write file.
+	doubleWriteSuffix = ".dw"
+
+	// doubleWriteSectorSize is the unit writes are assumed to be torn in. The
+	// committed part of the sector a batch starts in is saved before the
+	// batch is written over the rest of it.
+	doubleWriteSectorSize = 4096
+
+	// doubleWriteMagic starts each saved sector.
+	doubleWriteMagic = 0x77646277 // "wbdw"
+
+	// doubleWriteHeaderLen is the length of the magic, offset, length and
+	// CRC that precede the saved bytes.
+	doubleWriteHeaderLen = 16
+)
+
+/*
+	The double-write file holds a single record, overwritten before each batch
+	that starts part way through a sector:
+
+	0      1      2      3      4      5      6      7      8
+	+------+------+------+------+------+------+------+------+
+	| Magic                     | Offset                    |
+	+------+------+------+------+------+------+------+------+
+	| Length                    | CRC                       |
+	+------+------+------+------+------+------+------+------+
+	| Length bytes from the segment file at Offset ...
+	+------+------+------+------+------+------+------+------+
+
+	The CRC (Castagnoli) covers the offset, length and bytes.
+*/
+
+// doubleWriteFile is a segment's double-write file.
+type doubleWriteFile struct {
+	wf     types.WritableFile
+	remove func() error
+	buf    []byte
+}
+
+// save copies the committed bytes of the sector that writes from offset will
+// start in to the double-write file and syncs it. It does nothing if offset
+// is at the start of a sector.
+func (d *doubleWriteFile) save(src io.ReaderAt, offset uint32) error {
+	start := offset - offset%doubleWriteSectorSize
+	n := offset - start
+	if n == 0 {
+		return nil
+	}
+	if cap(d.buf) < doubleWriteHeaderLen+int(n) {
+		d.buf = make([]byte, doubleWriteHeaderLen+doubleWriteSectorSize)
+	}
+	buf := d.buf[:doubleWriteHeaderLen+int(n)]
+	if _, err := src.ReadAt(buf[doubleWriteHeaderLen:], int64(start)); err != nil {
+		return fmt.Errorf("failed to read sector to double-write: %w", err)
+	}
+	binary.LittleEndian.PutUint32(buf[0:4], doubleWriteMagic)
+	binary.LittleEndian.PutUint32(buf[4:8], start)
+	binary.LittleEndian.PutUint32(buf[8:12], n)
+	crc := crc32.Checksum(buf[4:12], castagnoliTable)
+	crc = crc32.Update(crc, castagnoliTable, buf[doubleWriteHeaderLen:])
+	binary.LittleEndian.PutUint32(buf[12:16], crc)
+	if _, err := d.wf.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return d.wf.Sync()
+}
+
+// close closes the file and, if the segment has been sealed, deletes it.
+func (d *doubleWriteFile) close(sealed bool) error {
+	err := d.wf.Close()
+	if sealed {
+		if rerr := d.remove(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// restoreDoubleWrite writes the sector saved in rf, if there's an intact one,
+// back to wf and syncs it. The bytes saved were already committed so putting
+// them back is always safe, and repairs them if a torn write of the batch
+// after them damaged them.
+func restoreDoubleWrite(rf types.ReadableFile, wf types.WritableFile) error {
+	var hdr [doubleWriteHeaderLen]byte
+	if _, err := rf.ReadAt(hdr[:], 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			// Nothing has been saved yet or the save was torn.
+			return nil
+		}
+		return err
+	}
+	if binary.LittleEndian.Uint32(hdr[0:4]) != doubleWriteMagic {
+		return nil
+	}
+	offset := binary.LittleEndian.Uint32(hdr[4:8])
+	n := binary.LittleEndian.Uint32(hdr[8:12])
+	if n == 0 || n >= doubleWriteSectorSize || offset%doubleWriteSectorSize != 0 {
+		return nil
+	}
+	data := make([]byte, n)
+	if _, err := rf.ReadAt(data, doubleWriteHeaderLen); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	crc := crc32.Checksum(hdr[4:12], castagnoliTable)
+	crc = crc32.Update(crc, castagnoliTable, data)
+	if crc != binary.LittleEndian.Uint32(hdr[12:16]) {
+		// The save was torn so the segment wasn't written after it.
+		return nil
+	}
+	if _, err := wf.WriteAt(data, int64(offset)); err != nil {
+		return fmt.Errorf("failed to restore double-written sector: %w", err)
+	}
+	return wf.Sync()
+}
+
+// doubleWriteName returns the name of the double-write file of the segment
+// file fname.
+func doubleWriteName(fname string) string {
+	return fname + doubleWriteSuffix
+}
+
+// openDoubleWrite restores the sector saved in the double-write file of the
+// tail segment file fname in dir, open as wf, if it has one. If double-writes
+// are enabled it returns the file ready for the next save, creating it if
+// needed. Otherwise any file is deleted and it returns nil.
+func (f *Filer) openDoubleWrite(dir, fname string, wf types.WritableFile) (*doubleWriteFile, error) {
+	dwName := doubleWriteName(fname)
+	rf, err := f.vfs.OpenReader(dir, dwName)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if !f.opts.doubleWrite {
+			return nil, nil
+		}
+		return f.createDoubleWrite(dir, fname)
+	case err != nil:
+		return nil, err
+	}
+	err = restoreDoubleWrite(rf, wf)
+	rf.Close()
+	if err != nil {
+		return nil, err
+	}
+	if !f.opts.doubleWrite {
+		if err := f.vfs.Delete(dir, dwName); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	dwf, err := f.vfs.OpenWriter(dir, dwName)
+	if err != nil {
+		return nil, err
+	}
+	return f.newDoubleWrite(dir, dwName, dwf), nil
+}
+
+// createDoubleWrite creates the double-write file of the segment file fname
+// in dir, replacing any left behind by a segment that was deleted.
+func (f *Filer) createDoubleWrite(dir, fname string) (*doubleWriteFile, error) {
+	dwName := doubleWriteName(fname)
+	if err := f.vfs.Delete(dir, dwName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	dwf, err := f.vfs.Create(dir, dwName, doubleWriteHeaderLen+doubleWriteSectorSize)
+	if err != nil {
+		return nil, err
+	}
+	return f.newDoubleWrite(dir, dwName, dwf), nil
+}
+
+func (f *Filer) newDoubleWrite(dir, dwName string, wf types.WritableFile) *doubleWriteFile {
+	return &doubleWriteFile{
+		wf: wf,
+		remove: func() error {
+			return f.vfs.Delete(dir, dwName)
+		},
+	}
+}
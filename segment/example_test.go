@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment_test
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+)
+
+func Example() {
+	dir, err := os.MkdirTemp("", "segment-example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := segment.NewFiler(dir, fs.New())
+	info := types.SegmentInfo{BaseIndex: 1, MinIndex: 1, ID: 1, SizeLimit: 1024 * 1024}
+	sw, err := f.Create(info)
+	if err != nil {
+		panic(err)
+	}
+	err = sw.Append([]types.LogEntry{
+		{Index: 1, Data: []byte("one")},
+		{Index: 2, Data: []byte("two")},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// Seal it early rather than waiting for it to fill up.
+	w := sw.(*segment.Writer)
+	if _, err := w.Seal(); err != nil {
+		panic(err)
+	}
+	sealed, _ := w.SealedInfo()
+	w.Close()
+
+	r, err := f.Open(sealed)
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+	var le types.LogEntry
+	for idx := sealed.BaseIndex; idx <= sealed.MaxIndex; idx++ {
+		if err := r.GetLog(idx, &le); err != nil {
+			panic(err)
+		}
+		fmt.Printf("%d: %s\n", idx, le.Data)
+	}
+	// Output:
+	// 1: one
+	// 2: two
+}
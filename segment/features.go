@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// Feature bits are recorded in each segment's file header and in its
+// SegmentInfo.Features. A reader must understand every feature a segment has
+// set to read it correctly, so segments with a feature this version doesn't
+// support are refused with an error naming it rather than misread.
+const (
+	// FeatureCompression marks a segment whose entry data may be compressed.
+	FeatureCompression uint16 = 1 << iota
+
+	// FeatureEncryption marks a segment whose entry data is encrypted with the
+	// cipher suite in SegmentInfo.Cipher.
+	FeatureEncryption
+
+	// FeatureTermIndex marks a segment that records the term runs of its
+	// entries in a terms frame when it's sealed.
+	FeatureTermIndex
+
+	// FeatureSparse marks a segment that may only index every Nth entry. See
+	// WithIndexInterval.
+	FeatureSparse
+
+	// FeatureChunking marks a segment that may split entries larger than
+	// MaxEntrySize across several frames.
+	FeatureChunking
+
+	// FeatureDictionary marks a segment whose compressed entries were
+	// compressed with the dictionary in SegmentInfo.Dictionary, which is kept
+	// in a file alongside the segment's.
+	FeatureDictionary
+)
+
+const (
+	// SupportedFeatures is the set of features this version can read.
+	SupportedFeatures = FeatureCompression | FeatureEncryption | FeatureTermIndex | FeatureSparse | FeatureChunking | FeatureDictionary
+
+	// CurrentFeatures is the set of features segments are always created with.
+	// FeatureSparse, FeatureCompression, FeatureDictionary and
+	// FeatureEncryption are added to those created with them set in their
+	// SegmentInfo.
+	CurrentFeatures = FeatureTermIndex | FeatureChunking
+)
+
+var featureNames = map[uint16]string{
+	FeatureCompression: "compression",
+	FeatureEncryption:  "encryption",
+	FeatureTermIndex:   "term-index",
+	FeatureSparse:      "sparse",
+	FeatureChunking:    "chunking",
+	FeatureDictionary:  "dictionary",
+}
+
+// FeatureNames returns the names of the feature bits set in features, in bit
+// order. Bits without a name are shown by number.
+func FeatureNames(features uint16) []string {
+	var names []string
+	for features != 0 {
+		bit := uint16(1) << bits.TrailingZeros16(features)
+		features &^= bit
+		name, ok := featureNames[bit]
+		if !ok {
+			name = fmt.Sprintf("unknown(%#x)", bit)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// CheckFeatures returns an error wrapping types.ErrUnsupportedFormat that names
+// any features in info this version can't read.
+func CheckFeatures(info types.SegmentInfo) error {
+	if missing := info.Features &^ SupportedFeatures; missing != 0 {
+		return fmt.Errorf("%w: segment %s requires features this version doesn't support: %s",
+			types.ErrUnsupportedFormat, FileName(info), strings.Join(FeatureNames(missing), ", "))
+	}
+	return nil
+}
@@ -7,36 +7,337 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dreamsxin/wal/types"
 )
 
-const (
-	segmentFileSuffix      = ".wal"
-	segmentFileNamePattern = "%020d-%016x" + segmentFileSuffix
-)
+const segmentFileSuffix = ".wal"
 
 // Filer implements the abstraction for managing a set of segment files in a
 // directory. It uses a VFS to abstract actual file system operations for easier
 // testing.
 type Filer struct {
-	dir string
-	vfs types.VFS
+	dir    string
+	vfs    types.VFS
+	naming FileNaming
+
+	// dataDirs are other dirs segment files may be in.
+	dataDirs []string
+
+	opts fileOpts
+
+	// dicts are the dictionaries added to the Filer or loaded for segments
+	// that have one, by ID.
+	dictMu sync.Mutex
+	dicts  map[uint64]*dictionary
+
+	// manifest lists the segments if the Filer was created WithManifest.
+	manifest *manifest
+
+	// markers are the names of the sealed markers created WithSealedMarkers.
+	markers markerIndex
+}
+
+// fileOpts configures the readers and writers a Filer creates.
+type fileOpts struct {
+	// cache is optional and used for reads of sealed segments.
+	cache *BlockCache
+
+	// tailBufferSize is the number of recently written bytes of the tail
+	// segment to keep in memory, zero disables it.
+	tailBufferSize int
+
+	// readAheadSize is the chunk size sequential reads of sealed segments
+	// prefetch in, zero disables read-ahead.
+	readAheadSize int
+
+	// evictSealed drops each segment file from the OS page cache when it's
+	// sealed.
+	evictSealed bool
+
+	// verifyOnRead checks the checksum of every entry read.
+	verifyOnRead bool
+
+	// hmacKeys is set if segments are signed when they are sealed. In strict
+	// mode the signature is also checked when sealed segments are opened.
+	hmacKeys   types.KeyProvider
+	strictHMAC bool
+
+	// indexInterval is how many entries apart the offsets recorded in the
+	// index of segments with FeatureSparse are.
+	indexInterval int
+
+	// strictChecksum makes Open check sealed segments against their checksums.
+	strictChecksum bool
+
+	// doubleWrite saves the committed part of the sector each batch starts in
+	// to the tail's double-write file before writing it.
+	doubleWrite bool
+
+	// compression is the ID of the codec that entries in segments with
+	// FeatureCompression are compressed with, CompressionNone for none.
+	compression uint8
+
+	// compressionPolicy decides which entries are compressed. Its zero fields
+	// take their defaults.
+	compressionPolicy CompressionPolicy
+
+	// keys encrypt the entries of segments with FeatureEncryption and decrypt
+	// encrypted entries. It's nil if no keys were given. It's made from
+	// encryptKeys once all the options are applied.
+	keys        *keyring
+	encryptKeys types.KeyProvider
+
+	// lockKeys locks the copies of keys that are kept into memory.
+	lockKeys bool
+
+	// trash makes Delete move files to the trash instead of deleting them.
+	trash bool
+
+	// sealedMarkers creates a marker named after each segment's MaxIndex
+	// when it's sealed.
+	sealedMarkers bool
+
+	// manifest keeps a manifest of the segments for List to read.
+	manifest bool
+
+	// dict is the dictionary of the segment being opened, if it has one. It's
+	// set for each segment rather than by an option.
+	dict *dictionary
+}
+
+type filerOpt func(*Filer)
+
+// WithFileNaming is an option that names segment files with n rather than the
+// default scheme. The same naming must be used every time the directory is
+// opened.
+func WithFileNaming(n FileNaming) filerOpt {
+	return func(f *Filer) {
+		f.naming = n
+	}
+}
+
+// WithDataDirs is an option that makes the Filer look for segment files in
+// dirs as well as its own dir when listing, deleting or dumping them. Segments
+// are created in and opened from the Dir in their SegmentInfo, or the Filer's
+// own dir if that's empty, so dirs must include every Dir used.
+func WithDataDirs(dirs ...string) filerOpt {
+	return func(f *Filer) {
+		f.dataDirs = dirs
+	}
+}
+
+// WithBlockCache is an option that makes readers of sealed segments read
+// through the given cache.
+func WithBlockCache(c *BlockCache) filerOpt {
+	return func(f *Filer) {
+		f.opts.cache = c
+	}
+}
+
+// WithTailBuffer is an option that keeps up to size bytes of the most recently
+// written frames of each tail segment in memory so that reads of recent
+// entries are served without reading the file.
+func WithTailBuffer(size int) filerOpt {
+	return func(f *Filer) {
+		f.opts.tailBufferSize = size
+	}
+}
+
+// WithReadAhead is an option that makes readers of sealed segments that see
+// sequential access read the file in chunks of size bytes, prefetching the
+// next chunk in the background. This speeds up replaying the whole log on
+// storage with high per-read latency.
+func WithReadAhead(size int) filerOpt {
+	return func(f *Filer) {
+		f.opts.readAheadSize = size
+	}
+}
+
+// WithEvictSealedFromPageCache is an option that asks the OS to drop each
+// segment file's pages from its cache once the segment is sealed, so that a
+// large log doesn't push more useful data out of memory. Files only support
+// this if they implement types.PageCacheDropper.
+func WithEvictSealedFromPageCache() filerOpt {
+	return func(f *Filer) {
+		f.opts.evictSealed = true
+	}
+}
+
+// WithVerifyOnRead is an option that makes every read check the entry's
+// checksum and return an error wrapping types.ErrCorrupt if it doesn't match.
+// This costs a CRC of the whole entry on every read.
+func WithVerifyOnRead() filerOpt {
+	return func(f *Filer) {
+		f.opts.verifyOnRead = true
+	}
+}
+
+// WithHMAC is an option that signs each segment with an HMAC-SHA256 of the
+// whole file when it's sealed, using the current key from keys. If strict is
+// true, Open reads the whole segment to check its signature and fails with an
+// error wrapping types.ErrCorrupt if it's missing or doesn't match.
+func WithHMAC(keys types.KeyProvider, strict bool) filerOpt {
+	return func(f *Filer) {
+		f.opts.hmacKeys = keys
+		f.opts.strictHMAC = strict
+	}
+}
+
+// WithIndexInterval is an option that makes segments created with
+// FeatureSparse set in their SegmentInfo only record the offset of every nth
+// entry, both in memory while they are the tail and in the index written when
+// they are sealed. Reads of the entries in between scan forward from the
+// nearest recorded one. Segments without FeatureSparse index every entry.
+func WithIndexInterval(n int) filerOpt {
+	return func(f *Filer) {
+		f.opts.indexInterval = n
+	}
+}
+
+// WithStrictRecovery is an option that makes Open read the whole of each
+// sealed segment to check it against the checksum recorded in its SegmentInfo
+// when it was sealed, and the one in its trailer, failing with an error
+// wrapping types.ErrCorrupt if either doesn't match. Segments without
+// checksums are opened as usual.
+func WithStrictRecovery() filerOpt {
+	return func(f *Filer) {
+		f.opts.strictChecksum = true
+	}
+}
+
+// WithDoubleWrite is an option that protects the tail segment from torn
+// sector writes on storage that doesn't guarantee that writing part of a
+// sector leaves the rest of it intact. Before each batch is written, the part
+// of the sector it starts in that's already committed, which includes the
+// last commit frame, is copied to a small double-write file next to the
+// segment and synced. RecoverTail writes it back before recovering the
+// segment, so a torn write can never damage what was already committed. It
+// costs an extra write and sync of up to one sector for each batch.
+func WithDoubleWrite() filerOpt {
+	return func(f *Filer) {
+		f.opts.doubleWrite = true
+	}
+}
+
+// WithCompression is an option that compresses the data of entries appended
+// to segments created with FeatureCompression set in their SegmentInfo with
+// the registered codec with ID id. Entries that the policy set with
+// WithCompressionPolicy says aren't worth it, and those too big for a single
+// frame, are stored as they are. Creating or
+// recovering a tail fails if the codec isn't registered. Segments without
+// FeatureCompression aren't compressed. Compressed entries can be read
+// whatever the option is set to, as long as their codec is registered.
+func WithCompression(id uint8) filerOpt {
+	return func(f *Filer) {
+		f.opts.compression = id
+	}
+}
+
+// WithCompressionPolicy is an option that sets which entries WithCompression
+// compresses. Without it every field of the policy takes its default.
+func WithCompressionPolicy(p CompressionPolicy) filerOpt {
+	return func(f *Filer) {
+		f.opts.compressionPolicy = p
+	}
+}
+
+// WithEncryption is an option that encrypts the data of entries appended to
+// segments created with FeatureEncryption set in their SegmentInfo, with the
+// cipher suite in their SegmentInfo.Cipher and keys' current key, which must
+// be CipherKeySize bytes. Each entry records the ID of its key so keys can be
+// rotated, and Key must keep returning older keys for as long as segments
+// encrypted with them exist. Creating or recovering an encrypted tail fails
+// without the option, and reading an encrypted entry without it returns
+// ErrNoEncryptionKeys. The keys older entries are read with are copied so
+// that they're not fetched for every read, unless keys is a
+// types.KeyReleaser, and WipeKeys zeroes the copies.
+func WithEncryption(keys types.KeyProvider) filerOpt {
+	return func(f *Filer) {
+		f.opts.encryptKeys = keys
+	}
+}
+
+// WithKeyLocking is an option that locks the copies of encryption keys the
+// Filer keeps, so that reading older entries doesn't fetch their key every
+// time, into memory so they're never written to swap. Each key is kept on
+// pages of its own outside the Go heap. Fetching a key fails if it can't be
+// locked, for example because RLIMIT_MEMLOCK is too low, or on platforms where
+// KeyLockingSupported is false. Keys aren't copied at all if the KeyProvider
+// is a types.KeyReleaser.
+func WithKeyLocking() filerOpt {
+	return func(f *Filer) {
+		f.opts.lockKeys = true
+	}
 }
 
 // NewFiler creates a Filer ready for use.
-func NewFiler(dir string, vfs types.VFS) *Filer {
-	return &Filer{
+func NewFiler(dir string, vfs types.VFS, opts ...filerOpt) *Filer {
+	f := &Filer{
 		dir: dir,
 		vfs: vfs,
 	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.opts.encryptKeys != nil {
+		f.opts.keys = newKeyring(f.opts.encryptKeys, f.opts.lockKeys)
+	}
+	if f.opts.manifest {
+		f.manifest = &manifest{vfs: vfs, dir: dir, name: f.naming.ManifestName()}
+	}
+	return f
+}
+
+// WipeKeys implements types.KeyWiper. Entries can still be encrypted and
+// decrypted afterwards, but their keys are fetched each time.
+func (f *Filer) WipeKeys() {
+	if f.opts.keys != nil {
+		f.opts.keys.wipe()
+	}
 }
 
 // FileName returns the formatted file name expected for this segment.
 // SegmentFiler implementations could choose to ignore this but it's here to
 func FileName(i types.SegmentInfo) string {
-	return fmt.Sprintf(segmentFileNamePattern, i.BaseIndex, i.ID)
+	return FileNaming{}.Name(i.BaseIndex, i.ID)
+}
+
+// segmentDir returns the dir the file for the given segment is in.
+func (f *Filer) segmentDir(info types.SegmentInfo) string {
+	if info.Dir != "" {
+		return info.Dir
+	}
+	return f.dir
+}
+
+// dirs returns every dir segment files may be in, starting with f's own.
+func (f *Filer) dirs() []string {
+	dirs := []string{f.dir}
+	for _, d := range f.dataDirs {
+		if d != f.dir {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// fileName returns the name of the file for the given segment under f's
+// naming scheme.
+func (f *Filer) fileName(baseIndex, ID uint64) string {
+	return f.naming.Name(baseIndex, ID)
+}
+
+// OpenFile opens the file for the segment with the given info to read its raw
+// contents, for example to copy it elsewhere. Nothing about the file is
+// validated.
+func (f *Filer) OpenFile(info types.SegmentInfo) (types.ReadableFile, error) {
+	return f.vfs.OpenReader(f.segmentDir(info), f.fileName(info.BaseIndex, info.ID))
 }
 
 // Create adds a new segment with the given info and returns a writer or an
@@ -45,14 +346,58 @@ func (f *Filer) Create(info types.SegmentInfo) (types.SegmentWriter, error) {
 	if info.BaseIndex == 0 {
 		return nil, fmt.Errorf("BaseIndex must be greater than zero")
 	}
-	fname := FileName(info)
+	if err := checkFormatVersion(info); err != nil {
+		return nil, err
+	}
+	if err := CheckFeatures(info); err != nil {
+		return nil, err
+	}
+	if err := checkCodec(info); err != nil {
+		return nil, err
+	}
+	if err := checkEncryption(info, f.opts); err != nil {
+		return nil, err
+	}
+	fname := f.fileName(info.BaseIndex, info.ID)
 
-	wf, err := f.vfs.Create(f.dir, fname, uint64(info.SizeLimit))
+	dir := f.segmentDir(info)
+	d, err := f.dictionary(info)
+	if err != nil {
+		return nil, err
+	}
+	// The segment is in the manifest before any of its files exist so none
+	// can be left behind unlisted.
+	if f.manifest != nil {
+		if err := f.manifest.add(info.ID, info.BaseIndex, f.scan); err != nil {
+			return nil, err
+		}
+	}
+	opts := f.opts
+	opts.dict = d
+	// The dictionary is written first so the segment never exists without it.
+	if opts.dict != nil {
+		if err := f.writeDictionary(dir, fname, opts.dict); err != nil {
+			return nil, err
+		}
+	}
+	wf, err := f.vfs.Create(dir, fname, uint64(info.SizeLimit))
 	if err != nil {
 		return nil, err
 	}
 
-	return createFile(info, wf)
+	w, err := createFile(info, wf, opts)
+	if err != nil {
+		return nil, err
+	}
+	w.onSealed = f.sealedHook(dir, fname)
+	if !f.opts.doubleWrite {
+		return w, nil
+	}
+	if w.dw, err = f.createDoubleWrite(dir, fname); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
 }
 
 // RecoverTail is called on an unsealed segment when re-opening the WAL it will
@@ -61,22 +406,76 @@ func (f *Filer) Create(info types.SegmentInfo) (types.SegmentWriter, error) {
 // expected tail segment doesn't exist it must return an error wrapping
 // os.ErrNotExist.
 func (f *Filer) RecoverTail(info types.SegmentInfo) (types.SegmentWriter, error) {
-	fname := FileName(info)
+	if err := checkFormatVersion(info); err != nil {
+		return nil, err
+	}
+	if err := CheckFeatures(info); err != nil {
+		return nil, err
+	}
+	if err := checkCodec(info); err != nil {
+		return nil, err
+	}
+	if err := checkEncryption(info, f.opts); err != nil {
+		return nil, err
+	}
+	fname := f.fileName(info.BaseIndex, info.ID)
 
-	wf, err := f.vfs.OpenWriter(f.dir, fname)
+	dir := f.segmentDir(info)
+	wf, err := f.vfs.OpenWriter(dir, fname)
 	if err != nil {
 		return nil, err
 	}
 
-	return recoverFile(info, wf)
+	opts := f.opts
+	if opts.dict, err = f.dictionary(info); err != nil {
+		wf.Close()
+		return nil, err
+	}
+
+	// Put back anything a torn write damaged before reading the file.
+	dw, err := f.openDoubleWrite(dir, fname, wf)
+	if err != nil {
+		wf.Close()
+		return nil, err
+	}
+	w, err := recoverFile(info, wf, opts)
+	if err != nil {
+		if dw != nil {
+			dw.close(false)
+		}
+		return nil, err
+	}
+	w.dw = dw
+	w.onSealed = f.sealedHook(dir, fname)
+	if sealed, _, _ := w.Sealed(); sealed {
+		// It was sealed just before a crash so it won't be written again.
+		if dw != nil {
+			w.dw = nil
+			dw.close(true)
+		}
+		if w.onSealed != nil {
+			w.onSealed(w.LastIndex())
+			w.onSealed = nil
+		}
+	}
+	return w, nil
 }
 
 // Open an already sealed segment for reading. Open may validate the file's
 // header and return an error if it doesn't match the expected info.
 func (f *Filer) Open(info types.SegmentInfo) (types.SegmentReader, error) {
-	fname := FileName(info)
+	if err := checkFormatVersion(info); err != nil {
+		return nil, err
+	}
+	if err := CheckFeatures(info); err != nil {
+		return nil, err
+	}
+	if err := checkCodec(info); err != nil {
+		return nil, err
+	}
+	fname := f.fileName(info.BaseIndex, info.ID)
 
-	rf, err := f.vfs.OpenReader(f.dir, fname)
+	rf, err := f.vfs.OpenReader(f.segmentDir(info), fname)
 	if err != nil {
 		return nil, err
 	}
@@ -106,56 +505,315 @@ func (f *Filer) Open(info types.SegmentInfo) (types.SegmentReader, error) {
 		return nil, err
 	}
 
-	return openReader(info, rf)
+	opts := f.opts
+	if opts.dict, err = f.dictionary(info); err != nil {
+		rf.Close()
+		return nil, err
+	}
+
+	if info.IndexStart == 0 {
+		// The WAL seals a tail without writing an index when it truncates it or
+		// a write to it fails, so its entries are found the way recovery finds
+		// them. It's never written to so it doesn't need a codec to compress
+		// with.
+		opts.compression = CompressionNone
+		w, err := recoverFile(info, readOnlyFile{rf}, opts)
+		if err != nil {
+			rf.Close()
+			return nil, err
+		}
+		w.r.sealed()
+		return w.r, nil
+	}
+
+	r, err := openReader(info, rf, opts)
+	if err != nil {
+		return nil, err
+	}
+	if f.opts.strictHMAC {
+		if err := r.verifyHMAC(f.opts.hmacKeys); err != nil {
+			rf.Close()
+			return nil, err
+		}
+	}
+	// The trailer is small and read once so checking it against the metadata
+	// is cheap enough to do for every segment.
+	t, err := r.Trailer()
+	if err == nil && t != nil {
+		err = r.checkTrailer(t)
+	}
+	if err == nil && f.opts.strictChecksum && (t != nil || info.Checksum != 0) {
+		err = r.verifyChecksums(t)
+	}
+	if err != nil {
+		rf.Close()
+		return nil, err
+	}
+	r.sealed()
+	return r, nil
+}
+
+// readOnlyFile lets a sealed segment with no index be read through a Writer,
+// which never writes unless it's appended to.
+type readOnlyFile struct {
+	types.ReadableFile
+}
+
+func (readOnlyFile) WriteAt([]byte, int64) (int, error) {
+	return 0, types.ErrSealed
+}
+
+func (readOnlyFile) Sync() error {
+	return types.ErrSealed
 }
 
 // List returns the set of segment IDs currently stored. It's used by the WAL
 // on recovery to find any segment files that need to be deleted following a
 // unclean shutdown. The returned map is a map of ID -> BaseIndex. BaseIndex
 // is returned to allow subsequent Delete calls to be made.
+//
+// With WithManifest the segments are read from the manifest instead.
 func (f *Filer) List() (map[uint64]uint64, error) {
+	if f.manifest != nil {
+		return f.manifest.list(f.scan)
+	}
+	return f.scan()
+}
+
+// CheckManifest rebuilds the manifest kept WithManifest from a listing of the
+// dirs unless the last segment it recorded has the ID before nextID, the ID
+// the next segment will get, so List doesn't miss segments created by a Filer
+// without the option. It does nothing without the option.
+func (f *Filer) CheckManifest(nextID uint64) error {
+	if f.manifest == nil {
+		return nil
+	}
+	return f.manifest.check(nextID, f.scan)
+}
+
+// scan lists the segments in f's dirs.
+func (f *Filer) scan() (map[uint64]uint64, error) {
 	segs, _, err := f.listInternal()
 	return segs, err
 }
 
 func (f *Filer) listInternal() (map[uint64]uint64, []uint64, error) {
-	files, err := f.vfs.ListDir(f.dir)
-	if err != nil {
-		return nil, nil, err
-	}
-
 	segs := make(map[uint64]uint64)
 	sorted := make([]uint64, 0)
-	for _, file := range files {
-		if !strings.HasSuffix(file, segmentFileSuffix) {
-			continue
-		}
-		// Parse BaseIndex and ID from the file name
-		var bIdx, id uint64
-		n, err := fmt.Sscanf(file, segmentFileNamePattern, &bIdx, &id)
+	for _, dir := range f.dirs() {
+		files, err := f.vfs.ListDir(dir)
 		if err != nil {
-			return nil, nil, types.ErrCorrupt
+			return nil, nil, err
 		}
-		if n != 2 {
-			// Misnamed segment files with the right suffix indicates a bug or
-			// tampering, we can't be sure what's happened to the data.
-			return nil, nil, types.ErrCorrupt
+		for _, file := range files {
+			if !strings.HasPrefix(file, f.naming.Prefix) || !strings.HasSuffix(file, f.naming.extension()) {
+				continue
+			}
+			bIdx, id, ok := f.naming.Parse(file)
+			if !ok {
+				// Misnamed segment files with the right suffix indicates a bug or
+				// tampering, we can't be sure what's happened to the data.
+				return nil, nil, types.ErrCorrupt
+			}
+			if f.naming.OmitBaseIndex {
+				if bIdx, err = f.readBaseIndex(dir, file); err != nil {
+					return nil, nil, err
+				}
+			}
+			if _, ok := segs[id]; ok {
+				continue
+			}
+			segs[id] = bIdx
+			sorted = append(sorted, id)
 		}
-		segs[id] = bIdx
-		sorted = append(sorted, id)
 	}
+	// Names only sort in ID order if they are padded.
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
 
 	return segs, sorted, nil
 }
 
+// readBaseIndex reads the BaseIndex from the header of the named file in dir. It
+// returns zero if the header hasn't been written yet, which happens if the
+// process crashed before the segment's first commit.
+func (f *Filer) readBaseIndex(dir, name string) (uint64, error) {
+	rf, err := f.vfs.OpenReader(dir, name)
+	if err != nil {
+		return 0, err
+	}
+	defer rf.Close()
+
+	var hdr [fileHeaderLen]byte
+	if n, err := rf.ReadAt(hdr[:], 0); n < fileHeaderLen {
+		if err == nil || errors.Is(err, io.EOF) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if isZero(hdr[:]) {
+		return 0, nil
+	}
+	info, err := readFileHeader(hdr[:])
+	if err != nil {
+		return 0, fmt.Errorf("failed to read header of segment file %s: %w", name, err)
+	}
+	return info.BaseIndex, nil
+}
+
 // Delete removes the segment with given baseIndex and id if it exists. Note
 // that baseIndex is technically redundant since ID is unique on it's own. But
 // in practice we name files (or keys) with both so that they sort correctly.
 // This interface allows a  simpler implementation where we can just delete
 // the file if it exists without having to scan the underlying storage for a.
+//
+// With WithDataDirs the file is deleted from every dir it's in, since a crash
+// while a segment was being moved can leave a copy of it behind. With
+// WithTrash the files are moved to the trash instead.
 func (f *Filer) Delete(baseIndex uint64, ID uint64) error {
-	fname := fmt.Sprintf(segmentFileNamePattern, baseIndex, ID)
-	return f.vfs.Delete(f.dir, fname)
+	fname := f.fileName(baseIndex, ID)
+	now := time.Now()
+	remove := func(dir, name string) error {
+		if f.opts.trash {
+			return f.trashFile(dir, name, now)
+		}
+		return f.vfs.Delete(dir, name)
+	}
+	var notExist error
+	deleted := false
+	for _, dir := range f.dirs() {
+		err := remove(dir, fname)
+		if errors.Is(err, os.ErrNotExist) {
+			notExist = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		deleted = true
+		// Tails have a double-write file if they were written with it, and
+		// segments a dictionary if they're compressed with one.
+		for _, name := range []string{doubleWriteName(fname), dictionaryName(fname)} {
+			if err := remove(dir, name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := f.removeSealedMarkers(dir, fname, remove); err != nil {
+			return err
+		}
+	}
+	if f.manifest != nil {
+		if err := f.manifest.remove(ID, f.scan); err != nil {
+			return err
+		}
+	}
+	if !deleted {
+		return notExist
+	}
+	return nil
+}
+
+// copyChunkSize is how much of a segment file CopySegment copies at once.
+const copyChunkSize = 1024 * 1024
+
+// CopySegment implements types.SegmentMover. The copy is written under a
+// temporary name and renamed into place once it's synced. The segment's
+// dictionary is copied first if it has one.
+func (f *Filer) CopySegment(info types.SegmentInfo, dir string) error {
+	fname := f.fileName(info.BaseIndex, info.ID)
+	tmpName := fname + ".tmp"
+
+	d, err := f.dictionary(info)
+	if err != nil {
+		return err
+	}
+	if d != nil {
+		if err := f.writeDictionary(dir, fname, d); err != nil {
+			return err
+		}
+	}
+
+	src, err := f.vfs.OpenReader(f.segmentDir(info), fname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// A crash during an earlier copy may have left the temporary file.
+	if err := f.vfs.Delete(dir, tmpName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	dst, err := f.vfs.Create(dir, tmpName, 0)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, copyChunkSize)
+	var off int64
+	for {
+		n, err := src.ReadAt(buf, off)
+		if n > 0 {
+			if _, werr := dst.WriteAt(buf[:n], off); werr != nil {
+				dst.Close()
+				return werr
+			}
+			off += int64(n)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := f.vfs.Rename(dir, tmpName, fname); err != nil {
+		return err
+	}
+	markers, err := f.sealedMarkers(f.segmentDir(info), fname)
+	if err != nil {
+		return err
+	}
+	for _, name := range markers {
+		if err := f.createMarker(dir, name); err != nil {
+			return err
+		}
+		f.markers.mu.Lock()
+		f.markers.addLocked(dir, fname, name)
+		f.markers.mu.Unlock()
+	}
+	return nil
+}
+
+// DeleteSegmentFile implements types.SegmentMover.
+func (f *Filer) DeleteSegmentFile(info types.SegmentInfo) error {
+	fname := f.fileName(info.BaseIndex, info.ID)
+	err := f.vfs.Delete(f.segmentDir(info), fname)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := f.removeSealedMarkers(f.segmentDir(info), fname, f.vfs.Delete); err != nil {
+		return err
+	}
+	return f.deleteDictionary(f.segmentDir(info), fname)
+}
+
+// openAnyDir opens the named segment file in whichever of f's dirs it's in.
+func (f *Filer) openAnyDir(name string) (types.ReadableFile, error) {
+	var err error
+	for _, dir := range f.dirs() {
+		var rf types.ReadableFile
+		rf, err = f.vfs.OpenReader(dir, name)
+		if !errors.Is(err, os.ErrNotExist) {
+			return rf, err
+		}
+	}
+	return nil, err
 }
 
 // DumpSegment attempts to read the segment file specified by the baseIndex and
@@ -171,9 +829,9 @@ func (f *Filer) Delete(baseIndex uint64, ID uint64) error {
 // entry and the raw bytes of the entry itself. The callback must return true to
 // continue reading. The data slice is only valid for the lifetime of the call.
 func (f *Filer) DumpSegment(baseIndex uint64, ID uint64, after, before uint64, fn func(info types.SegmentInfo, e types.LogEntry) (bool, error)) error {
-	fname := fmt.Sprintf(segmentFileNamePattern, baseIndex, ID)
+	fname := f.fileName(baseIndex, ID)
 
-	rf, err := f.vfs.OpenReader(f.dir, fname)
+	rf, err := f.openAnyDir(fname)
 	if err != nil {
 		return err
 	}
@@ -185,39 +843,108 @@ func (f *Filer) DumpSegment(baseIndex uint64, ID uint64, after, before uint64, f
 		Index  uint64
 		Offset int64
 		Len    uint32
+		Flags  uint8
+		// Chunks are the chunk frames holding the rest of a large entry's data.
+		Chunks []frameInfo
 	}
 	var batch []frameInfo
+	inBatch := false
+
+	// The segment's dictionary, if it has one, is loaded when the first entry
+	// that needs it is read.
+	var dict *dictionary
+	loadDict := func(info types.SegmentInfo) (*dictionary, error) {
+		if dict != nil || info.Features&FeatureDictionary == 0 {
+			return dict, nil
+		}
+		drf, err := f.openAnyDir(dictionaryName(fname))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load dictionary of segment %s: %w", fname, err)
+		}
+		defer drf.Close()
+		data, err := readAllFile(drf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load dictionary of segment %s: %w", fname, err)
+		}
+		dict = newDictionary(data)
+		return dict, nil
+	}
+
+	readFrame := func(frame frameInfo, buf []byte) ([]byte, error) {
+		// Check the header is reasonable
+		if frame.Len > MaxEntrySize {
+			return nil, fmt.Errorf("failed to read entry idx=%d, frame header length (%d) is too big",
+				frame.Index, frame.Len)
+		}
+		if frame.Len > uint32(cap(buf)) {
+			buf = make([]byte, frame.Len)
+		}
+		n, err := rf.ReadAt(buf[:frame.Len], frame.Offset+frameHeaderLen)
+		if err != nil && !(err == io.EOF && uint32(n) == frame.Len) {
+			return nil, err
+		}
+		if uint32(n) < frame.Len {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return buf[:n], nil
+	}
 
 	_, err = readThroughSegment(rf, func(info types.SegmentInfo, fh frameHeader, offset int64) (bool, error) {
 		if fh.typ == FrameCommit {
 			// All the previous entries have been committed. Read them and send up to
 			// caller.
 			for _, frame := range batch {
-				// Check the header is reasonable
-				if frame.Len > MaxEntrySize {
-					return false, fmt.Errorf("failed to read entry idx=%d, frame header length (%d) is too big: %w",
-						frame.Index, frame.Len, err)
-				}
-
-				if frame.Len > uint32(len(buf)) {
-					buf = make([]byte, frame.Len)
+				payload, err := readFrame(frame, buf)
+				if err != nil {
+					return false, err
 				}
+				buf = payload[:cap(payload)]
 
-				n, err := rf.ReadAt(buf[:frame.Len], frame.Offset+frameHeaderLen)
+				e := types.LogEntry{Index: frame.Index}
+				metaLen, err := readEntryMeta(payload, frame.Flags, &e)
 				if err != nil {
-					return false, err
+					return false, fmt.Errorf("failed to read entry idx=%d metadata: %w", frame.Index, err)
 				}
-				if uint32(n) < frame.Len {
-					return false, io.ErrUnexpectedEOF
+				e.Data = payload[metaLen:]
+				if frame.Flags&(frameFlagCompressed|frameFlagEncrypted) != 0 {
+					d, err := loadDict(info)
+					if err != nil {
+						return false, err
+					}
+					dec := entryDecoder{segID: info.ID, keys: f.opts.keys, dict: d}
+					if e.Data, err = dec.decode(nil, e.Data, payload[:metaLen], frame.Flags, frame.Index); err != nil {
+						return false, fmt.Errorf("failed to read entry idx=%d: %w", frame.Index, err)
+					}
+				}
+				if len(frame.Chunks) > 0 {
+					e.Data = append([]byte(nil), e.Data...)
+					for _, chunk := range frame.Chunks {
+						data, err := readFrame(chunk, nil)
+						if err != nil {
+							return false, err
+						}
+						if chunk.Flags&frameFlagCRC != 0 {
+							// Drop the CRC a streamed entry's last chunk ends with.
+							data = data[:len(data)-4]
+						}
+						e.Data = append(e.Data, data...)
+					}
 				}
 
-				ok, err := fn(info, types.LogEntry{Index: frame.Index, Data: buf[:n]})
+				ok, err := fn(info, e)
 				if !ok || err != nil {
 					return ok, err
 				}
 			}
 			// Reset batch
 			batch = batch[:0]
+			inBatch = false
+			return true, nil
+		}
+
+		if fh.typ == FrameChunk && inBatch {
+			last := &batch[len(batch)-1]
+			last.Chunks = append(last.Chunks, frameInfo{last.Index, offset, fh.len, fh.flags, nil})
 			return true, nil
 		}
 
@@ -225,6 +952,7 @@ func (f *Filer) DumpSegment(baseIndex uint64, ID uint64, after, before uint64, f
 			return true, nil
 		}
 
+		inBatch = false
 		if idx <= after {
 			// Not in the range we care about, skip reading the entry.
 			idx++
@@ -235,7 +963,8 @@ func (f *Filer) DumpSegment(baseIndex uint64, ID uint64, after, before uint64, f
 			return false, nil
 		}
 
-		batch = append(batch, frameInfo{idx, offset, fh.len})
+		batch = append(batch, frameInfo{idx, offset, fh.len, fh.flags, nil})
+		inBatch = true
 		idx++
 		return true, nil
 	})
@@ -5,11 +5,17 @@ package segment
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/dreamsxin/wal/fs"
 	"github.com/dreamsxin/wal/types"
 	"github.com/stretchr/testify/require"
 )
@@ -509,6 +515,469 @@ func TestListEdgeCases(t *testing.T) {
 	}
 }
 
+func TestFileNaming(t *testing.T) {
+	cases := []struct {
+		naming FileNaming
+		want   string
+	}{
+		{FileNaming{}, "00000000000000000012-00000000000000ab.wal"},
+		{FileNaming{Prefix: "raft-", Extension: ".log"}, "raft-00000000000000000012-00000000000000ab.log"},
+		{FileNaming{NoPadding: true}, "12-ab.wal"},
+		{FileNaming{OmitBaseIndex: true}, "00000000000000ab.wal"},
+		{FileNaming{Prefix: "s", NoPadding: true, OmitBaseIndex: true}, "sab.wal"},
+	}
+	for _, tc := range cases {
+		name := tc.naming.Name(12, 0xab)
+		require.Equal(t, tc.want, name)
+		base, id, ok := tc.naming.Parse(name)
+		require.True(t, ok)
+		require.Equal(t, uint64(0xab), id)
+		if !tc.naming.OmitBaseIndex {
+			require.Equal(t, uint64(12), base)
+		}
+
+		sealed := tc.naming.SealedName(12, 0xab, 99)
+		require.True(t, strings.HasPrefix(sealed, name+"."), sealed)
+		_, _, ok = tc.naming.Parse(sealed)
+		require.False(t, ok, "a marker isn't a segment")
+		base, id, maxIndex, ok := tc.naming.ParseSealed(sealed)
+		require.True(t, ok)
+		require.Equal(t, uint64(0xab), id)
+		require.Equal(t, uint64(99), maxIndex)
+		if !tc.naming.OmitBaseIndex {
+			require.Equal(t, uint64(12), base)
+		}
+		_, _, _, ok = tc.naming.ParseSealed(name)
+		require.False(t, ok, "a segment isn't a marker")
+	}
+	require.Equal(t, "00000000000000000012-00000000000000ab.wal.00000000000000000099.sealed", FileNaming{}.SealedName(12, 0xab, 99))
+	require.Equal(t, "12-ab.wal.99.sealed", FileNaming{NoPadding: true}.SealedName(12, 0xab, 99))
+
+	for _, name := range []string{"12-ab.log", "raft-12-ab.wal", "-ab.wal", "12-.wal", "12-+ab.wal", "12-zz.wal", "12ab.wal"} {
+		_, _, ok := FileNaming{}.Parse(name)
+		require.False(t, ok, name)
+	}
+	for _, name := range []string{"12-ab.wal.sealed", "12-ab.wal.+99.sealed", "12-ab.wal.x.sealed", "12-ab.log.99.sealed", "12-ab.wal.99"} {
+		_, _, _, ok := FileNaming{}.ParseSealed(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestSealedMarkers(t *testing.T) {
+	vfs := fs.NewMem()
+	f := NewFiler("wal", vfs, WithSealedMarkers(), WithDataDirs("cold"))
+
+	// Filled up, sealed early, and still the tail.
+	var infos []types.SegmentInfo
+	for i, n := range []int{1000, 10, 10} {
+		info := testSegment(uint64(i*1000 + 1))
+		info.SizeLimit = 8 * 1024
+		w, err := f.Create(info)
+		require.NoError(t, err)
+		for idx := info.BaseIndex; idx < info.BaseIndex+uint64(n); idx++ {
+			require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Data: []byte("data")}}))
+			if sealed, indexStart, err := w.Sealed(); sealed {
+				require.NoError(t, err)
+				info.IndexStart = indexStart
+				break
+			}
+		}
+		if i == 1 {
+			info.IndexStart, err = w.(types.SegmentSealer).Seal()
+			require.NoError(t, err)
+		}
+		info.MaxIndex = w.LastIndex()
+		require.NoError(t, w.Close())
+		infos = append(infos, info)
+	}
+	require.NotZero(t, infos[0].IndexStart)
+	require.Less(t, infos[0].MaxIndex, uint64(1000))
+
+	maxIndexes, err := f.SealedMaxIndexes()
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]uint64{infos[0].ID: infos[0].MaxIndex, infos[1].ID: infos[1].MaxIndex}, maxIndexes)
+	names, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+	require.Contains(t, names, FileNaming{}.SealedName(infos[1].BaseIndex, infos[1].ID, 1010))
+
+	// Markers don't look like segments, and a tail sealed before a crash gets
+	// one when it's recovered.
+	list, err := f.List()
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	require.NoError(t, vfs.Delete("wal", FileNaming{}.SealedName(infos[1].BaseIndex, infos[1].ID, 1010)))
+	w, err := f.RecoverTail(infos[1])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	maxIndexes, err = f.SealedMaxIndexes()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1010), maxIndexes[infos[1].ID])
+
+	// Markers follow their segments.
+	require.NoError(t, f.CopySegment(infos[0], "cold"))
+	require.NoError(t, f.DeleteSegmentFile(infos[0]))
+	for _, info := range infos[1:] {
+		require.NoError(t, f.Delete(info.BaseIndex, info.ID))
+	}
+	names, err = vfs.ListDir("wal")
+	require.NoError(t, err)
+	require.Empty(t, names)
+	names, err = vfs.ListDir("cold")
+	require.NoError(t, err)
+	require.Equal(t, []string{FileName(infos[0]), FileNaming{}.SealedName(infos[0].BaseIndex, infos[0].ID, infos[0].MaxIndex)}, names)
+
+	// Without the option there are none.
+	f = NewFiler("plain", vfs)
+	info := testSegment(1)
+	w, err = f.Create(info)
+	require.NoError(t, err)
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Data: []byte("data")}}))
+	_, err = w.(types.SegmentSealer).Seal()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	names, err = vfs.ListDir("plain")
+	require.NoError(t, err)
+	require.Equal(t, []string{FileName(info)}, names)
+}
+
+// listCountingVFS counts calls to ListDir.
+type listCountingVFS struct {
+	types.VFS
+	lists int
+}
+
+func (v *listCountingVFS) ListDir(dir string) ([]string, error) {
+	v.lists++
+	return v.VFS.ListDir(dir)
+}
+
+func TestSealedMarkersDeleteWithoutListing(t *testing.T) {
+	vfs := &listCountingVFS{VFS: fs.NewMem()}
+	f := NewFiler("wal", vfs, WithSealedMarkers())
+	var infos []types.SegmentInfo
+	for i := 0; i < 10; i++ {
+		info := testSegment(uint64(i*10 + 1))
+		w, err := f.Create(info)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: info.BaseIndex, Data: []byte("data")}}))
+		_, err = w.(types.SegmentSealer).Seal()
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		infos = append(infos, info)
+	}
+
+	// A Filer that created the markers deletes them without listing the dir.
+	require.NoError(t, f.Delete(infos[0].BaseIndex, infos[0].ID))
+	require.Zero(t, vfs.lists)
+
+	// A new one, as after a restart, lists it once to find them.
+	f = NewFiler("wal", vfs, WithSealedMarkers())
+	for _, info := range infos[1:] {
+		require.NoError(t, f.Delete(info.BaseIndex, info.ID))
+	}
+	require.Equal(t, 1, vfs.lists)
+	names, err := vfs.VFS.ListDir("wal")
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestListFileNaming(t *testing.T) {
+	vfs := newTestVFS()
+	a := NewFiler("test", vfs, WithFileNaming(FileNaming{Prefix: "a-", NoPadding: true, OmitBaseIndex: true}))
+	b := NewFiler("test", vfs, WithFileNaming(FileNaming{Prefix: "b-"}))
+
+	// IDs above 9 check that listing sorts by ID rather than name.
+	want := make(map[uint64]uint64)
+	for i := uint64(8); i < 12; i++ {
+		w, err := a.Create(types.SegmentInfo{BaseIndex: i * 100, ID: i, SizeLimit: 4096})
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: i * 100, Data: []byte("data")}}))
+		w.Close()
+		want[i] = i * 100
+	}
+	_, err := b.Create(testSegment(1))
+	require.NoError(t, err)
+	require.Contains(t, vfs.files, "a-a.wal")
+
+	segs, sorted, err := a.listInternal()
+	require.NoError(t, err)
+	require.Equal(t, want, segs)
+	require.Equal(t, []uint64{8, 9, 10, 11}, sorted)
+
+	list, err := b.List()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	// A segment that crashed before its first commit has no header to read the
+	// BaseIndex from.
+	_, err = vfs.Create("test", "a-c.wal", 4096)
+	require.NoError(t, err)
+	list, err = a.List()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), list[0xc])
+
+	require.NoError(t, a.Delete(0, 0xc))
+	require.NoError(t, a.Delete(800, 8))
+	list, err = a.List()
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+}
+
+func TestFilerDataDirs(t *testing.T) {
+	vfs := fs.NewMem()
+	f := NewFiler("wal", vfs, WithDataDirs("a", "b"))
+
+	want := make(map[uint64]uint64)
+	for i, dir := range []string{"", "a", "b"} {
+		info := testSegment(uint64(i*100 + 1))
+		info.Dir = dir
+		w, err := f.Create(info)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: info.BaseIndex, Data: []byte("data")}}))
+		w.Close()
+		want[info.ID] = info.BaseIndex
+
+		names, err := vfs.ListDir(f.segmentDir(info))
+		require.NoError(t, err)
+		require.Contains(t, names, FileName(info))
+
+		w, err = f.RecoverTail(info)
+		require.NoError(t, err)
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(info.BaseIndex, &le))
+		w.Close()
+	}
+
+	list, err := f.List()
+	require.NoError(t, err)
+	require.Equal(t, want, list)
+
+	var got []uint64
+	require.NoError(t, f.DumpLogs(0, 0, func(info types.SegmentInfo, e types.LogEntry) (bool, error) {
+		got = append(got, e.Index)
+		return true, nil
+	}))
+	require.Equal(t, []uint64{1, 101, 201}, got)
+
+	for id, base := range want {
+		require.NoError(t, f.Delete(base, id))
+	}
+	list, err = f.List()
+	require.NoError(t, err)
+	require.Empty(t, list)
+}
+
+func TestTrash(t *testing.T) {
+	vfs := fs.NewMem()
+	f := NewFiler("wal", vfs, WithDataDirs("cold"), WithTrash(), WithDoubleWrite())
+
+	var infos []types.SegmentInfo
+	for i, dir := range []string{"", "cold"} {
+		info := testSegment(uint64(i*100 + 1))
+		info.Dir = dir
+		w, err := f.Create(info)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: info.BaseIndex, Data: []byte("data")}}))
+		require.NoError(t, w.Close())
+		infos = append(infos, info)
+	}
+
+	before := time.Now()
+	for _, info := range infos {
+		require.NoError(t, f.Delete(info.BaseIndex, info.ID))
+	}
+	list, err := f.List()
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	// Each segment's files are in the trash of the dir they were in, and can
+	// still be read from there.
+	for _, info := range infos {
+		dir := f.segmentDir(info)
+		names, err := vfs.ListDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, names)
+		trash := filepath.Join(dir, TrashDir)
+		names, err = vfs.ListDir(trash)
+		require.NoError(t, err)
+		require.Len(t, names, 2)
+		var segName string
+		for _, name := range names {
+			deleted, ok := parseTrashName(name)
+			require.True(t, ok, name)
+			require.False(t, deleted.Before(before.Truncate(time.Nanosecond)))
+			if strings.HasSuffix(name, FileName(info)) {
+				segName = name
+			}
+		}
+		require.NotEmpty(t, segName)
+		require.NoError(t, vfs.MoveFile(trash, segName, "restored", FileName(info)))
+		info.Dir = "restored"
+		r, err := NewFiler("wal", vfs).Open(info)
+		require.NoError(t, err)
+		var le types.LogEntry
+		require.NoError(t, r.GetLog(info.BaseIndex, &le))
+		require.Equal(t, "data", string(le.Data))
+		require.NoError(t, r.Close())
+	}
+
+	n, err := f.PurgeTrash(before.Add(-time.Second))
+	require.NoError(t, err)
+	require.Zero(t, n)
+	n, err = f.PurgeTrash(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	for _, dir := range []string{"wal", "cold"} {
+		names, err := vfs.ListDir(filepath.Join(dir, TrashDir))
+		require.NoError(t, err)
+		require.Empty(t, names)
+	}
+
+	// Without a VFS that can move files, segments aren't deleted at all.
+	f = NewFiler("test", newTestVFS(), WithTrash())
+	info := testSegment(1)
+	w, err := f.Create(info)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.ErrorContains(t, f.Delete(info.BaseIndex, info.ID), "can't move files")
+	list, err = f.List()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+}
+
+func TestManifest(t *testing.T) {
+	vfs := fs.NewMem()
+	create := func(f *Filer, info types.SegmentInfo) {
+		t.Helper()
+		w, err := f.Create(info)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	seg := func(id uint64, dir string) types.SegmentInfo {
+		info := testSegment(id * 100)
+		info.ID, info.Dir = id, dir
+		return info
+	}
+	list := func(f *Filer) map[uint64]uint64 {
+		t.Helper()
+		segs, err := f.List()
+		require.NoError(t, err)
+		return segs
+	}
+	name := FileNaming{}.ManifestName()
+
+	// Segments created before the manifest are found by listing the dirs
+	// the first time.
+	create(NewFiler("wal", vfs), seg(1, ""))
+	f := NewFiler("wal", vfs, WithManifest(), WithDataDirs("cold"))
+	create(f, seg(2, "cold"))
+	create(f, seg(3, ""))
+	want := map[uint64]uint64{1: 100, 2: 200, 3: 300}
+	require.Equal(t, want, list(f))
+
+	// After that only the manifest is read, so files it didn't create aren't
+	// listed.
+	create(NewFiler("wal", vfs), seg(4, ""))
+	require.Equal(t, want, list(NewFiler("wal", vfs, WithManifest(), WithDataDirs("cold"))))
+	require.Contains(t, list(NewFiler("wal", vfs, WithDataDirs("cold"))), uint64(4))
+
+	// Unless CheckManifest is told a segment with a higher ID than it has seen
+	// was created, when it's rebuilt from the dirs.
+	f = NewFiler("wal", vfs, WithManifest(), WithDataDirs("cold"))
+	require.NoError(t, f.CheckManifest(4))
+	require.Equal(t, want, list(f))
+	require.NoError(t, f.CheckManifest(5))
+	require.Contains(t, list(NewFiler("wal", vfs, WithManifest(), WithDataDirs("cold"))), uint64(4))
+	require.NoError(t, f.Delete(400, 4))
+
+	require.NoError(t, f.Delete(200, 2))
+	delete(want, 2)
+	require.Equal(t, want, list(NewFiler("wal", vfs, WithManifest(), WithDataDirs("cold"))))
+
+	// A record torn by a crash is ignored and the manifest rewritten.
+	readManifest := func() string {
+		t.Helper()
+		rf, err := vfs.OpenReader("wal", name)
+		require.NoError(t, err)
+		defer rf.Close()
+		raw, err := io.ReadAll(io.NewSectionReader(rf, 0, 1<<20))
+		require.NoError(t, err)
+		return string(raw)
+	}
+	wf, err := vfs.OpenWriter("wal", name)
+	require.NoError(t, err)
+	_, err = wf.WriteAt([]byte("+ff 12"), int64(len(readManifest())))
+	require.NoError(t, err)
+	require.NoError(t, wf.Close())
+	f = NewFiler("wal", vfs, WithManifest(), WithDataDirs("cold"))
+	require.Equal(t, want, list(f))
+	require.Equal(t, manifestHeader(5)+"+1 100\n+3 300\n", readManifest())
+
+	// One that can't be read is rebuilt from the dirs.
+	require.NoError(t, vfs.Delete("wal", name))
+	wf, err = vfs.Create("wal", name, 0)
+	require.NoError(t, err)
+	_, err = wf.WriteAt([]byte("garbage\n"), 0)
+	require.NoError(t, err)
+	require.NoError(t, wf.Close())
+	require.Equal(t, want, list(NewFiler("wal", vfs, WithManifest(), WithDataDirs("cold"))))
+	require.True(t, strings.HasPrefix(readManifest(), manifestMagic+" "))
+
+	// Deleted segments don't pile up.
+	for id := uint64(10); id < 500; id++ {
+		create(f, seg(id, ""))
+		require.NoError(t, f.Delete(id*100, id))
+	}
+	require.Equal(t, want, list(NewFiler("wal", vfs, WithManifest())))
+	require.LessOrEqual(t, strings.Count(readManifest(), "\n"), 1+2*len(want)+manifestSlack+1)
+
+	// The segment is listed even if creating its file fails.
+	failing := newTestVFS()
+	f = NewFiler("test", failing, WithManifest())
+	require.Empty(t, list(f))
+	failing.createErr = errors.New("disk full")
+	_, err = f.Create(seg(7, ""))
+	require.Error(t, err)
+	require.Equal(t, map[uint64]uint64{7: 700}, list(f))
+	failing.createErr = nil
+	if err := f.Delete(700, 7); err != nil {
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+	require.Empty(t, list(f))
+}
+
+func TestCopySegment(t *testing.T) {
+	vfs := fs.NewMem()
+	f := NewFiler("wal", vfs, WithDataDirs("cold"))
+
+	info := testSegment(1)
+	w, err := f.Create(info)
+	require.NoError(t, err)
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Data: []byte("one")}}))
+	indexStart, err := w.(*Writer).Seal()
+	require.NoError(t, err)
+	info.IndexStart, info.MaxIndex = indexStart, 1
+	w.Close()
+
+	// A temporary file left by an earlier copy is replaced.
+	_, err = vfs.Create("cold", FileName(info)+".tmp", 0)
+	require.NoError(t, err)
+	require.NoError(t, f.CopySegment(info, "cold"))
+	names, err := vfs.ListDir("cold")
+	require.NoError(t, err)
+	require.Equal(t, []string{FileName(info)}, names)
+
+	require.NoError(t, f.DeleteSegmentFile(info))
+	require.NoError(t, f.DeleteSegmentFile(info), "deleting a missing file is fine")
+	info.Dir = "cold"
+	r, err := f.Open(info)
+	require.NoError(t, err)
+	defer r.Close()
+	var le types.LogEntry
+	require.NoError(t, r.GetLog(1, &le))
+	require.Equal(t, "one", string(le.Data))
+}
+
 var nextSegID uint64
 
 func testSegment(baseIndex uint64) types.SegmentInfo {
@@ -567,7 +1036,7 @@ func TestDumpSegment(t *testing.T) {
 		return true, nil
 	})
 	require.NoError(t, err)
-	require.Equal(t, 93, totalDumped)
+	require.Equal(t, 82, totalDumped)
 
 	err = f.DumpSegment(seg2.BaseIndex, seg2.ID, 0, 0, func(info types.SegmentInfo, e types.LogEntry) (bool, error) {
 		require.Equal(t, seg2.BaseIndex, info.BaseIndex)
@@ -579,7 +1048,7 @@ func TestDumpSegment(t *testing.T) {
 		return true, nil
 	})
 	require.NoError(t, err)
-	require.Equal(t, 94, totalDumped)
+	require.Equal(t, 83, totalDumped)
 
 	// Ensure if we ask to stop that we stop
 	totalDumped = 0
@@ -608,9 +1077,10 @@ func TestDumpSegment(t *testing.T) {
 
 	// Now we twiddle the underlying VFS to zero out the commit frame.
 	// lastSyncState will point to the offset just before the new record and the
-	// commit frame will be just after.
+	// commit frame will be just after. The payload is the data plus its 8 byte
+	// append time.
 	file := testFileFor(t, w)
-	_, err = file.WriteAt(bytes.Repeat([]byte{0}, 1024), int64(file.lastSyncStart+encodedFrameSize(8)))
+	_, err = file.WriteAt(bytes.Repeat([]byte{0}, 1024), int64(file.lastSyncStart+encodedFrameSize(8+8)))
 	require.NoError(t, err)
 
 	// Now dumping should only return one entry
@@ -689,13 +1159,204 @@ func TestDumpLogs(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int(idx), totalDumped)
 
-	// Test limiting the range (the code above appends 280 records currently)
+	// Test limiting the range (the code above appends 238 records currently)
 	totalDumped = 0
 	lastDumpedIndex = 150 // We are dumping _after_ 150
 	lastSegID = -1
 	segIndex = 0 // 151 is in the second segment (index 1) so start from the index before
 
-	err = f.DumpLogs(150, 250, verifyFn)
+	err = f.DumpLogs(150, 230, verifyFn)
 	require.NoError(t, err)
-	require.Equal(t, int(250-150-1), totalDumped)
+	require.Equal(t, int(230-150-1), totalDumped)
+}
+
+func TestEvictSealedFromPageCache(t *testing.T) {
+	for _, evict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("evict=%v", evict), func(t *testing.T) {
+			vfs := newTestVFS()
+			f := NewFiler("test", vfs)
+			if evict {
+				f = NewFiler("test", vfs, WithEvictSealedFromPageCache())
+			}
+
+			w, err := f.Create(testSegment(1))
+			require.NoError(t, err)
+			defer w.Close()
+			file := testFileFor(t, w)
+
+			for idx := uint64(1); ; idx++ {
+				val := strings.Repeat(fmt.Sprintf("%03d ", idx), 128)
+				require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Data: []byte(val)}}))
+				sealed, _, err := w.Sealed()
+				require.NoError(t, err)
+				if sealed {
+					break
+				}
+				require.Equal(t, 0, file.pagesDropped)
+			}
+
+			want := 0
+			if evict {
+				want = 1
+			}
+			require.Equal(t, want, file.pagesDropped)
+		})
+	}
+}
+
+type testKeys struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (k *testKeys) CurrentKey() (uint32, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *testKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %d", id)
+	}
+	return key, nil
+}
+
+func TestHMAC(t *testing.T) {
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{1: []byte("key one")}}
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithHMAC(keys, true))
+
+	// writeSealed appends to the segment until it's sealed, recovering the tail
+	// part way through to check the signature covers what was written before.
+	writeSealed := func(f *Filer, seg types.SegmentInfo) types.SegmentInfo {
+		t.Helper()
+		w, err := f.Create(seg)
+		require.NoError(t, err)
+		for idx := uint64(1); ; idx++ {
+			if idx == 5 {
+				require.NoError(t, w.Close())
+				w, err = f.RecoverTail(seg)
+				require.NoError(t, err)
+			}
+			val := strings.Repeat(fmt.Sprintf("%03d ", idx), 64)
+			require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Term: 1, Data: []byte(val)}}))
+			sealed, indexStart, err := w.Sealed()
+			require.NoError(t, err)
+			if sealed {
+				seg.IndexStart = indexStart
+				seg.MaxIndex = idx
+				seg.SealTime = time.Now()
+				break
+			}
+		}
+		require.NoError(t, w.Close())
+		return seg
+	}
+
+	seg := writeSealed(f, testSegment(1))
+
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	var le types.LogEntry
+	require.NoError(t, r.GetLog(seg.MaxIndex, &le))
+	require.NoError(t, r.Close())
+
+	// Rotating the key doesn't stop older segments verifying.
+	keys.keys[2] = []byte("key two")
+	keys.current = 2
+	r, err = f.Open(seg)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	// Tamper with an entry.
+	file := vfs.files[FileName(seg)]
+	buf := file.getBuf()
+	buf[fileHeaderLen+frameHeaderLen+20] ^= 0x1
+	_, err = f.Open(seg)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+	require.ErrorContains(t, err, "HMAC doesn't match")
+
+	// Non-strict mode doesn't check on open but Verify does.
+	lax := NewFiler("test", vfs, WithHMAC(keys, false))
+	r, err = lax.Open(seg)
+	require.NoError(t, err)
+	err = r.(types.SegmentVerifier).Verify()
+	require.ErrorIs(t, err, types.ErrCorrupt)
+	require.ErrorContains(t, err, "HMAC doesn't match")
+	require.NoError(t, r.Close())
+
+	// Unsigned segments fail strict verification.
+	unsigned := writeSealed(NewFiler("test", vfs), testSegment(1))
+	_, err = f.Open(unsigned)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+	require.ErrorContains(t, err, "is not signed")
+
+	// But are fine when verified in non-strict mode.
+	r, err = lax.Open(unsigned)
+	require.NoError(t, err)
+	require.NoError(t, r.(types.SegmentVerifier).Verify())
+	require.NoError(t, r.Close())
+}
+
+func TestDoubleWrite(t *testing.T) {
+	for _, dw := range []bool{false, true} {
+		t.Run(fmt.Sprintf("doubleWrite=%v", dw), func(t *testing.T) {
+			vfs := newTestVFS()
+			f := NewFiler("test", vfs)
+			if dw {
+				f = NewFiler("test", vfs, WithDoubleWrite())
+			}
+			seg := testSegment(1)
+			fname := FileName(seg)
+			entry := func(idx uint64) []types.LogEntry {
+				return []types.LogEntry{{Index: idx, Data: []byte(fmt.Sprintf("%05d: double", idx))}}
+			}
+
+			w, err := f.Create(seg)
+			require.NoError(t, err)
+			require.NoError(t, w.Append(entry(1)))
+			require.NoError(t, w.Append(entry(2)))
+			committed := int64(w.(*Writer).writer.writeOffset)
+			require.NotZero(t, committed%doubleWriteSectorSize)
+			require.NoError(t, w.Append(entry(3)))
+			w.Close()
+
+			// A torn write of the last batch zeroes the commit frame of the one
+			// before it, which shares its sector, and corrupts its own entry. The
+			// byte is flipped rather than overwritten since it's part of the
+			// entry's append time, which could already hold any value.
+			tf := testFileFor(t, w)
+			_, err = tf.WriteAt(make([]byte, frameHeaderLen), committed-frameHeaderLen)
+			require.NoError(t, err)
+			b := make([]byte, 1)
+			_, err = tf.ReadAt(b, committed+frameHeaderLen+2)
+			require.NoError(t, err)
+			b[0] ^= 0xff
+			_, err = tf.WriteAt(b, committed+frameHeaderLen+2)
+			require.NoError(t, err)
+
+			rw, err := f.RecoverTail(seg)
+			require.NoError(t, err)
+			want := uint64(1)
+			if dw {
+				want = 2
+			}
+			require.Equal(t, want, rw.LastIndex())
+
+			// Once sealed there's nothing more to protect.
+			_, hasDW := vfs.files[doubleWriteName(fname)]
+			require.Equal(t, dw, hasDW)
+			_, err = rw.(*Writer).Seal()
+			require.NoError(t, err)
+			_, hasDW = vfs.files[doubleWriteName(fname)]
+			require.False(t, hasDW)
+			rw.Close()
+
+			// Delete removes one left behind.
+			_, err = vfs.Create("test", doubleWriteName(fname), 0)
+			require.NoError(t, err)
+			require.NoError(t, f.Delete(seg.BaseIndex, seg.ID))
+			require.Empty(t, vfs.files)
+		})
+	}
 }
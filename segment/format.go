@@ -5,22 +5,39 @@ package segment
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"time"
 
 	"github.com/dreamsxin/wal/types"
 )
 
 const (
-	// MaxEntrySize is the largest we allow any single raft log entry to be. This
-	// is larger than our raft implementation ever allows so seems safe to encode
-	// statically for now. We could make this configurable. It's main purpose it
-	// to limit allocation when reading entries back if their lengths are
-	// corrupted.
+	// MaxEntrySize is the largest we allow any single frame's payload to be.
+	// This is larger than our raft implementation ever allows so seems safe to
+	// encode statically for now. We could make this configurable. It's main
+	// purpose it to limit allocation when reading entries back if their lengths
+	// are corrupted. Entries that don't fit in one frame are split into chunks.
 	MaxEntrySize = 64 * 1024 * 1024 // 64 MiB
 
+	// MaxChunkedEntrySize is the largest entry we allow once it's split into
+	// chunks of at most MaxEntrySize.
+	MaxChunkedEntrySize = 1024 * 1024 * 1024 // 1 GiB
+
+	// streamChunkSize is the most data a streamed entry reads into each of its
+	// chunk frames, and so the most memory streaming an entry needs.
+	streamChunkSize = 1024 * 1024 // 1 MiB
+
+	// MaxEntryMetaSize is the largest LogEntry.Meta we support. Meta is intended
+	// to be small enough to be read along with the frame header so it's limited
+	// to a single length byte.
+	MaxEntryMetaSize = 255
+
 	// minBufSize is the size we allocate read and write buffers. Setting it
 	// larger wastes more memory but increases the chances that we'll read the
 	// whole frame in a single shot and not need a second allocation and trip to
@@ -28,7 +45,6 @@ const (
 	minBufSize = 64 * 1024
 
 	fileHeaderLen = 32
-	version       = 0
 	magic         = 0x58eb6b0d
 
 	// Note that this must remain a power of 2 to ensure aligning to this also
@@ -36,26 +52,155 @@ const (
 	frameHeaderLen = 8
 )
 
+// FormatVersion is the version of the segment format this package writes. It's
+// recorded in each segment's file header and in its SegmentInfo. Version 0 is
+// every segment written before versions were recorded, including by upstream
+// hashicorp/raft-wal. Those may lack per-entry checksums and terms frames and
+// can be rewritten in the current format with wal.MigrateFormat. Segments with
+// a version newer than this are refused rather than misread.
+//
+// Version 2 delta encodes the index frame written when a segment is sealed.
+// Version 3 adds a trailer frame summarising the segment when it's sealed.
+// Version 4 adds a checksum to the index frame.
+const FormatVersion = 4
+
+// deltaIndexVersion is the first FormatVersion that writes delta encoded index
+// frames.
+const deltaIndexVersion = 2
+
+// trailerVersion is the first FormatVersion that writes a trailer frame.
+const trailerVersion = 3
+
+// indexCRCVersion is the first FormatVersion that writes a checksum in the
+// index frame.
+const indexCRCVersion = 4
+
 const ( // Start iota from 0
 	FrameInvalid uint8 = iota
 	FrameEntry
 	FrameIndex
 	FrameCommit
+	FrameTerms
+	FrameHMAC
+
+	// FrameChunk holds the next part of the data of an entry too big for one
+	// frame. Chunks directly follow the entry frame they belong to.
+	FrameChunk
+
+	// FrameTrailer summarises a sealed segment. It follows the index frame and
+	// terms frame, if there is one, and comes before the HMAC frame.
+	FrameTrailer
+)
+
+const (
+	// frameFlagTerm is set on an entry frame when its payload is prefixed by the
+	// entry's Term.
+	frameFlagTerm uint8 = 1 << iota
+
+	// frameFlagMeta is set on an entry frame when its payload contains the
+	// entry's Type and Meta. They follow the Term and AppendedAt if present.
+	frameFlagMeta
+
+	// frameFlagAppendedAt is set on an entry frame when its payload contains
+	// the time the entry was appended. It follows the Term if there is one.
+	frameFlagAppendedAt
+
+	// frameFlagCRC is set on an entry frame when its payload contains a CRC32
+	// (Castagnoli) of the rest of the payload. It's the last metadata field,
+	// directly before the entry's data. Streamed entries don't know their CRC
+	// when their entry frame is written so instead it's set on their last chunk
+	// frame, whose payload then ends with the CRC.
+	frameFlagCRC
+
+	// frameFlagMore is set on an entry or chunk frame when the entry's data
+	// continues in a chunk frame that directly follows it. An entry's CRC covers
+	// all of its data, not just the part in the entry frame.
+	frameFlagMore
+
+	// frameFlagCompressed is set on an entry frame whose data is compressed.
+	// Its payload then contains the uint8 ID of the compression codec and the
+	// uint32 length of the uncompressed data, after the Type and Meta and
+	// before the CRC, which covers the compressed data. Compressed entries are
+	// never chunked.
+	frameFlagCompressed
+
+	// frameFlagEncrypted is set on an entry frame whose data is encrypted. Its
+	// payload then contains the uint8 ID of the cipher suite, the uint32 ID of
+	// the key and the nonce, after any compression metadata and before the
+	// CRC, which covers the encrypted data. Data is compressed before it's
+	// encrypted. Encrypted entries are never chunked.
+	frameFlagEncrypted
+
+	// knownEntryFlags is the set of all flags we understand. An entry frame with
+	// any other flag set is treated as corrupt.
+	knownEntryFlags = frameFlagTerm | frameFlagMeta | frameFlagAppendedAt | frameFlagCRC | frameFlagMore | frameFlagCompressed | frameFlagEncrypted
+
+	// commitFlagPipelined is set on a commit frame written by AppendAsync,
+	// after which later batches may have been written before it was synced.
+	// Unlike other commit frames, frames following it don't show that it made
+	// it to disk.
+	commitFlagPipelined uint8 = 1
+
+	// indexFlagDelta is set on an index frame when its offsets are delta
+	// encoded rather than stored as an array of uint32s. See
+	// writeDeltaIndexFrame.
+	indexFlagDelta uint8 = 1
+
+	// indexFlagSparse is set on a delta encoded index frame that only records
+	// the offset of every Nth entry. N is the uvarint its payload starts with.
+	indexFlagSparse uint8 = 2
+
+	// indexFlagCRC is set on a delta encoded index frame whose payload ends
+	// with a CRC32 (Castagnoli) of the rest of the payload.
+	indexFlagCRC uint8 = 4
+
+	// maxEntryMetaLen is the largest prefix that any combination of flags can add
+	// to an entry frame's payload.
+	maxEntryMetaLen = 8 + 8 + 2 + MaxEntryMetaSize + entryCompressionLen + entryEncryptionLen + 4
+
+	// entryCompressionLen is the length of the codec ID and uncompressed length
+	// in the payload of a compressed entry frame.
+	entryCompressionLen = 1 + 4
+
+	// entryEncryptionLen is the length of the cipher suite, key ID and nonce in
+	// the payload of an encrypted entry frame.
+	entryEncryptionLen = 1 + 4 + cipherNonceLen
+
+	// termRunLen is the encoded size of each types.TermRun in a terms frame.
+	termRunLen = 16
+
+	// hmacLen is the length of an HMAC frame's payload: a uint32 key ID, four
+	// reserved bytes and an HMAC-SHA256.
+	hmacLen = 8 + sha256.Size
 )
 
 var (
 	// ErrTooBig indicates that the caller tried to write a logEntry with a
 	// payload that's larger than we are prepared to support.
-	ErrTooBig = errors.New("entries larger than 64MiB are not supported")
+	ErrTooBig = errors.New("entries larger than 1GiB are not supported")
+
+	// ErrMetaTooBig indicates that the caller tried to write a logEntry with Meta
+	// larger than MaxEntryMetaSize.
+	ErrMetaTooBig = errors.New("entry meta larger than 255 bytes is not supported")
 )
 
+// checkFormatVersion returns an error if info is for a segment written in a
+// newer format than we understand.
+func checkFormatVersion(info types.SegmentInfo) error {
+	if info.FormatVersion > FormatVersion {
+		return fmt.Errorf("%w: segment %s has format version %d but only versions up to %d are supported",
+			types.ErrUnsupportedFormat, FileName(info), info.FormatVersion, FormatVersion)
+	}
+	return nil
+}
+
 /*
 
   File Header functions
 
 	0      1      2      3      4      5      6      7      8
 	+------+------+------+------+------+------+------+------+
-	| Magic                     | Reserved           | Vsn  |
+	| Magic                     | Features    | Rsvd | Vsn  |
 	+------+------+------+------+------+------+------+------+
 	| BaseIndex                                             |
 	+------+------+------+------+------+------+------+------+
@@ -67,17 +212,19 @@ var (
 */
 
 // writeFileHeader writes a file header into buf for the given file metadata.
+// The header always records the current FormatVersion and CurrentFeatures
+// since that's what the rest of the file will be written with, plus
+// FeatureSparse and FeatureCompression if info has them.
 func writeFileHeader(buf []byte, info types.SegmentInfo) error {
 	if len(buf) < fileHeaderLen {
 		return io.ErrShortBuffer
 	}
 
 	binary.LittleEndian.PutUint32(buf[0:4], magic)
-	// Explicitly zero Reserved bytes just in case
-	buf[4] = 0
-	buf[5] = 0
+	binary.LittleEndian.PutUint16(buf[4:6], CurrentFeatures|info.Features&(FeatureSparse|FeatureCompression|FeatureDictionary|FeatureEncryption))
+	// Explicitly zero Reserved byte just in case
 	buf[6] = 0
-	buf[7] = version
+	buf[7] = FormatVersion
 	binary.LittleEndian.PutUint64(buf[8:16], info.BaseIndex)
 	binary.LittleEndian.PutUint64(buf[16:24], info.ID)
 	// I removed the codec option from this library since we let the caller
@@ -94,15 +241,21 @@ func readFileHeader(buf []byte) (*types.SegmentInfo, error) {
 	}
 
 	var i types.SegmentInfo
-	m := binary.LittleEndian.Uint64(buf[0:8])
+	m := binary.LittleEndian.Uint32(buf[0:4])
 	if m != magic {
 		return nil, types.ErrCorrupt
 	}
-	if buf[7] != version {
-		return nil, types.ErrCorrupt
+	if buf[7] > FormatVersion {
+		return nil, fmt.Errorf("%w: segment header has format version %d but only versions up to %d are supported",
+			types.ErrUnsupportedFormat, buf[7], FormatVersion)
 	}
+	i.FormatVersion = buf[7]
+	i.Features = binary.LittleEndian.Uint16(buf[4:6])
 	i.BaseIndex = binary.LittleEndian.Uint64(buf[8:16])
 	i.ID = binary.LittleEndian.Uint64(buf[16:24])
+	if err := CheckFeatures(i); err != nil {
+		return nil, err
+	}
 	return &i, nil
 }
 
@@ -115,6 +268,16 @@ func validateFileHeader(got, expect types.SegmentInfo) error {
 		return fmt.Errorf("%w: segment header BaseIndex %d doesn't match metadata %d",
 			types.ErrCorrupt, got.BaseIndex, expect.BaseIndex)
 	}
+	// Metadata written before versions were recorded has no version so there's
+	// nothing to compare.
+	if expect.FormatVersion != 0 && expect.FormatVersion != got.FormatVersion {
+		return fmt.Errorf("%w: segment header format version %d doesn't match metadata %d",
+			types.ErrCorrupt, got.FormatVersion, expect.FormatVersion)
+	}
+	if expect.FormatVersion != 0 && expect.Features != got.Features {
+		return fmt.Errorf("%w: segment header features %#x don't match metadata %#x",
+			types.ErrCorrupt, got.Features, expect.Features)
+	}
 
 	return nil
 }
@@ -124,14 +287,15 @@ func validateFileHeader(got, expect types.SegmentInfo) error {
 
 	0      1      2      3      4      5      6      7      8
 	+------+------+------+------+------+------+------+------+
-	| Type | Reserved           | Length/CRC                |
+	| Type | Flags| Reserved    | Length/CRC                |
 	+------+------+------+------+------+------+------+------+
 */
 
 type frameHeader struct {
-	typ uint8
-	len uint32
-	crc uint32
+	typ   uint8
+	flags uint8
+	len   uint32
+	crc   uint32
 }
 
 func writeFrame(buf []byte, h frameHeader, payload []byte) error {
@@ -155,7 +319,7 @@ func writeFrameHeader(buf []byte, h frameHeader) error {
 		return io.ErrShortBuffer
 	}
 	buf[0] = h.typ
-	buf[1] = 0
+	buf[1] = h.flags
 	buf[2] = 0
 	buf[3] = 0
 	lOrCRC := h.len
@@ -187,12 +351,52 @@ func readFrameHeader(buf []byte) (frameHeader, error) {
 		}
 		return h, fmt.Errorf("%w: corrupt frame header with type 0 but non-zero other fields", types.ErrCorrupt)
 
-	case FrameEntry, FrameIndex:
+	case FrameEntry:
+		h.typ = buf[0]
+		h.flags = buf[1]
+		h.len = binary.LittleEndian.Uint32(buf[4:8])
+		if h.flags&^knownEntryFlags != 0 {
+			return h, fmt.Errorf("%w: corrupt frame header with unknown flags %#x", types.ErrCorrupt, h.flags)
+		}
+		if h.flags&frameFlagCompressed != 0 && h.flags&frameFlagMore != 0 {
+			return h, fmt.Errorf("%w: corrupt frame header for a chunked entry that's compressed", types.ErrCorrupt)
+		}
+		if h.flags&frameFlagEncrypted != 0 && h.flags&frameFlagMore != 0 {
+			return h, fmt.Errorf("%w: corrupt frame header for a chunked entry that's encrypted", types.ErrCorrupt)
+		}
+		if int(h.len) < minEntryMetaLen(h.flags) {
+			return h, fmt.Errorf("%w: entry frame length %d is too short for its flags %#x", types.ErrCorrupt, h.len, h.flags)
+		}
+
+	case FrameChunk:
+		h.typ = buf[0]
+		h.flags = buf[1]
+		h.len = binary.LittleEndian.Uint32(buf[4:8])
+		if h.flags&^(frameFlagMore|frameFlagCRC) != 0 || h.flags == frameFlagMore|frameFlagCRC {
+			return h, fmt.Errorf("%w: corrupt chunk frame header with unknown flags %#x", types.ErrCorrupt, h.flags)
+		}
+		if h.flags&frameFlagCRC != 0 && h.len < 4 {
+			return h, fmt.Errorf("%w: chunk frame length %d is too short for its checksum", types.ErrCorrupt, h.len)
+		}
+
+	case FrameIndex:
+		h.typ = buf[0]
+		h.flags = buf[1]
+		h.len = binary.LittleEndian.Uint32(buf[4:8])
+		if h.flags&^(indexFlagDelta|indexFlagSparse|indexFlagCRC) != 0 || (h.flags != 0 && h.flags&indexFlagDelta == 0) {
+			return h, fmt.Errorf("%w: corrupt index frame header with unknown flags %#x", types.ErrCorrupt, h.flags)
+		}
+		if h.flags&indexFlagCRC != 0 && h.len < 4 {
+			return h, fmt.Errorf("%w: index frame length %d is too short for its checksum", types.ErrCorrupt, h.len)
+		}
+
+	case FrameTerms, FrameHMAC, FrameTrailer:
 		h.typ = buf[0]
 		h.len = binary.LittleEndian.Uint32(buf[4:8])
 
 	case FrameCommit:
 		h.typ = buf[0]
+		h.flags = buf[1]
 		h.crc = binary.LittleEndian.Uint32(buf[4:8])
 	}
 	return h, nil
@@ -248,3 +452,517 @@ func writeIndexFrame(buf []byte, offsets []uint32) error {
 	}
 	return nil
 }
+
+// deltaIndexEntryLen returns how many bytes the entry for the frame at offset
+// takes in a delta encoded index when it follows the frame at prev. prev is 0
+// for the first entry.
+func deltaIndexEntryLen(prev, offset uint32) int {
+	return uvarintLen(uint64(offset-prev) / frameHeaderLen)
+}
+
+// deltaIndexLen returns the length of the payload of a delta encoded index
+// frame for offsets.
+func deltaIndexLen(offsets []uint32) int {
+	n, prev := 0, uint32(0)
+	for _, o := range offsets {
+		n += deltaIndexEntryLen(prev, o)
+		prev = o
+	}
+	return n
+}
+
+// deltaIndexFrameSize returns the encoded size of a delta encoded index frame
+// with an offsets payload of indexLen bytes that records every interval'th
+// entry, with a checksum if withCRC is true.
+func deltaIndexFrameSize(indexLen int, interval uint64, withCRC bool) int {
+	if interval > 1 {
+		indexLen += uvarintLen(interval)
+	}
+	if withCRC {
+		indexLen += 4
+	}
+	return encodedFrameSize(indexLen)
+}
+
+// writeDeltaIndexFrame writes an index frame for offsets into buf with each
+// offset stored as a uvarint of its distance from the previous one (or from
+// zero for the first) divided by frameHeaderLen, since frames are always
+// aligned to that. Entries smaller than about 1KiB take a single byte rather
+// than four. If interval is more than 1, offsets are those of every
+// interval'th entry and the frame is marked sparse. If withCRC is true the
+// payload ends with a checksum of the rest of it so that a damaged index is
+// caught before it sends reads to the wrong place.
+func writeDeltaIndexFrame(buf []byte, offsets []uint32, interval uint64, withCRC bool) error {
+	l := deltaIndexLen(offsets)
+	if len(buf) < deltaIndexFrameSize(l, interval, withCRC) {
+		return io.ErrShortBuffer
+	}
+	fh := frameHeader{
+		typ:   FrameIndex,
+		flags: indexFlagDelta,
+		len:   uint32(l),
+	}
+	cursor := frameHeaderLen
+	if interval > 1 {
+		fh.flags |= indexFlagSparse
+		n := binary.PutUvarint(buf[cursor:], interval)
+		fh.len += uint32(n)
+		cursor += n
+	}
+	if withCRC {
+		fh.flags |= indexFlagCRC
+		fh.len += 4
+	}
+	if err := writeFrameHeader(buf, fh); err != nil {
+		return err
+	}
+	prev := uint32(0)
+	for _, o := range offsets {
+		if o <= prev || o%frameHeaderLen != 0 {
+			return fmt.Errorf("can't delta encode index offset %d after %d", o, prev)
+		}
+		cursor += binary.PutUvarint(buf[cursor:], uint64(o-prev)/frameHeaderLen)
+		prev = o
+	}
+	if withCRC {
+		crc := crc32.Checksum(buf[frameHeaderLen:cursor], castagnoliTable)
+		binary.LittleEndian.PutUint32(buf[cursor:], crc)
+		cursor += 4
+	}
+	// Explicitly write null bytes for padding
+	for i := 0; i < padLen(int(fh.len)); i++ {
+		buf[cursor+i] = 0x0
+	}
+	return nil
+}
+
+// readIndexCRC checks the checksum at the end of the payload of an index frame
+// with flags, if it has one, and returns the rest of the payload.
+func readIndexCRC(buf []byte, flags uint8) ([]byte, error) {
+	if flags&indexFlagCRC == 0 {
+		return buf, nil
+	}
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("%w: index frame is too short for its checksum", types.ErrCorrupt)
+	}
+	payload := buf[:len(buf)-4]
+	if crc32.Checksum(payload, castagnoliTable) != binary.LittleEndian.Uint32(buf[len(payload):]) {
+		return nil, fmt.Errorf("%w: index frame %w", types.ErrCorrupt, ErrChecksum)
+	}
+	return payload, nil
+}
+
+// readIndexInterval reads the interval from the start of the payload of an
+// index frame with flags. It returns 1 if the index isn't sparse, and the rest
+// of the payload.
+func readIndexInterval(buf []byte, flags uint8) (uint64, []byte, error) {
+	if flags&indexFlagSparse == 0 {
+		return 1, buf, nil
+	}
+	interval, n := binary.Uvarint(buf)
+	if n <= 0 || interval < 2 {
+		return 0, nil, fmt.Errorf("%w: bad interval in sparse index frame", types.ErrCorrupt)
+	}
+	return interval, buf[n:], nil
+}
+
+// readDeltaIndex decodes the offsets in the payload of a delta encoded index
+// frame after any interval.
+func readDeltaIndex(buf []byte) ([]uint32, error) {
+	// Every offset takes at least one byte.
+	offsets := make([]uint32, 0, len(buf))
+	var prev uint64
+	for len(buf) > 0 {
+		d, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad varint in index frame", types.ErrCorrupt)
+		}
+		if d == 0 {
+			return nil, fmt.Errorf("%w: index frame offsets aren't increasing", types.ErrCorrupt)
+		}
+		prev += d * frameHeaderLen
+		if prev > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: index frame offset overflows", types.ErrCorrupt)
+		}
+		offsets = append(offsets, uint32(prev))
+		buf = buf[n:]
+	}
+	return offsets, nil
+}
+
+// uvarintLen returns the number of bytes binary.PutUvarint uses for x.
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// entryFlags returns the frame flags needed to encode the metadata of e.
+func entryFlags(e types.LogEntry) uint8 {
+	flags := frameFlagCRC
+	if e.Term > 0 {
+		flags |= frameFlagTerm
+	}
+	if !e.AppendedAt.IsZero() {
+		flags |= frameFlagAppendedAt
+	}
+	if e.Type > 0 || len(e.Meta) > 0 {
+		flags |= frameFlagMeta
+	}
+	return flags
+}
+
+// minEntryMetaLen returns the smallest number of bytes of metadata that can
+// prefix the data in an entry frame with the given flags.
+func minEntryMetaLen(flags uint8) int {
+	n := 0
+	if flags&frameFlagTerm != 0 {
+		n += 8
+	}
+	if flags&frameFlagAppendedAt != 0 {
+		n += 8
+	}
+	if flags&frameFlagMeta != 0 {
+		n += 2
+	}
+	if flags&frameFlagCompressed != 0 {
+		n += entryCompressionLen
+	}
+	if flags&frameFlagEncrypted != 0 {
+		n += entryEncryptionLen
+	}
+	if flags&frameFlagCRC != 0 {
+		n += 4
+	}
+	return n
+}
+
+// encodedEntryMetaLen returns the number of bytes of metadata that will
+// prefix e's data in its entry frame.
+func encodedEntryMetaLen(e types.LogEntry) int {
+	n := minEntryMetaLen(entryFlags(e))
+	if entryFlags(e)&frameFlagMeta != 0 {
+		n += len(e.Meta)
+	}
+	return n
+}
+
+// writeEntryFrame writes an entry frame for e into buf. The frame's payload is
+// the entry metadata indicated by flags followed by e.Data.
+func writeEntryFrame(buf []byte, e types.LogEntry) error {
+	return writeEntryFrameFlags(buf, e, entryFlags(e), e.Data)
+}
+
+// streamedEntryMetaLen returns the number of bytes of metadata in the entry
+// frame of a streamed entry, which has no CRC.
+func streamedEntryMetaLen(e types.LogEntry) int {
+	return encodedEntryMetaLen(e) - 4
+}
+
+// writeStreamedEntryFrame writes the entry frame of a streamed entry into buf.
+// It holds only e's metadata. The data all follows in chunk frames, the last
+// of which carries the CRC.
+func writeStreamedEntryFrame(buf []byte, e types.LogEntry) error {
+	return writeEntryFrameFlags(buf, e, entryFlags(e)&^frameFlagCRC|frameFlagMore, nil)
+}
+
+// writeEntryFrameFlags writes an entry frame for e with the given flags and
+// data into buf.
+func writeEntryFrameFlags(buf []byte, e types.LogEntry, flags uint8, data []byte) error {
+	cursor, err := writeEntryFramePrefix(buf, e, flags, len(data))
+	if err != nil {
+		return err
+	}
+	if len(buf) < encodedFrameSize(cursor-frameHeaderLen+len(data)) {
+		return io.ErrShortBuffer
+	}
+	cursor += copy(buf[cursor:], data)
+	// Explicitly write null bytes for padding
+	for i := 0; i < padLen(cursor-frameHeaderLen); i++ {
+		buf[cursor+i] = 0x0
+	}
+	return nil
+}
+
+// writeEntryFramePrefix writes the header and metadata of an entry frame for e
+// with the given flags and dataLen bytes of data into buf, and returns their
+// length. The data and padding are left to the caller.
+func writeEntryFramePrefix(buf []byte, e types.LogEntry, flags uint8, dataLen int) (int, error) {
+	return writeCodedEntryFramePrefix(buf, e, flags, dataLen, entryCompression{}, entryEncryption{})
+}
+
+// writeCodedEntryFramePrefix is writeEntryFramePrefix for a frame that may
+// have frameFlagCompressed or frameFlagEncrypted set, in which case e.Data is
+// the data as stored and ec and ee record how it was compressed and
+// encrypted.
+func writeCodedEntryFramePrefix(buf []byte, e types.LogEntry, flags uint8, dataLen int, ec entryCompression, ee entryEncryption) (int, error) {
+	if len(e.Meta) > MaxEntryMetaSize {
+		return 0, ErrMetaTooBig
+	}
+	metaLen := minEntryMetaLen(flags)
+	if flags&frameFlagMeta != 0 {
+		metaLen += len(e.Meta)
+	}
+	fh := frameHeader{
+		typ:   FrameEntry,
+		flags: flags,
+		len:   uint32(metaLen + dataLen),
+	}
+	if len(buf) < frameHeaderLen+metaLen {
+		return 0, io.ErrShortBuffer
+	}
+	if err := writeFrameHeader(buf, fh); err != nil {
+		return 0, err
+	}
+	cursor := frameHeaderLen
+	if flags&frameFlagTerm != 0 {
+		binary.LittleEndian.PutUint64(buf[cursor:], e.Term)
+		cursor += 8
+	}
+	if flags&frameFlagAppendedAt != 0 {
+		binary.LittleEndian.PutUint64(buf[cursor:], uint64(e.AppendedAt.UnixNano()))
+		cursor += 8
+	}
+	if flags&frameFlagMeta != 0 {
+		buf[cursor] = e.Type
+		buf[cursor+1] = uint8(len(e.Meta))
+		cursor += 2
+		cursor += copy(buf[cursor:], e.Meta)
+	}
+	if flags&frameFlagCompressed != 0 {
+		buf[cursor] = ec.codec
+		binary.LittleEndian.PutUint32(buf[cursor+1:], ec.size)
+		cursor += entryCompressionLen
+	}
+	if flags&frameFlagEncrypted != 0 {
+		buf[cursor] = ee.suite
+		binary.LittleEndian.PutUint32(buf[cursor+1:], ee.keyID)
+		copy(buf[cursor+5:], ee.nonce[:])
+		cursor += entryEncryptionLen
+	}
+	if flags&frameFlagCRC != 0 {
+		crc := entryCRC(buf[frameHeaderLen:cursor], e.Data)
+		binary.LittleEndian.PutUint32(buf[cursor:], crc)
+		cursor += 4
+	}
+	return cursor, nil
+}
+
+// chunkFrameHeader returns the header of a chunk frame holding data.
+func chunkFrameHeader(data []byte, more bool) frameHeader {
+	fh := frameHeader{typ: FrameChunk, len: uint32(len(data))}
+	if more {
+		fh.flags = frameFlagMore
+	}
+	return fh
+}
+
+// chunkDataLen returns how much of the payload of a chunk frame with header fh
+// is entry data rather than a trailing CRC.
+func chunkDataLen(fh frameHeader) int {
+	if fh.flags&frameFlagCRC != 0 {
+		return int(fh.len) - 4
+	}
+	return int(fh.len)
+}
+
+// readEntryMeta decodes the metadata prefix described by flags from buf into
+// le. It returns the number of bytes of metadata read which is the offset in
+// the payload that the entry's data starts at. le.Meta is reused if it has
+// enough capacity.
+func readEntryMeta(buf []byte, flags uint8, le *types.LogEntry) (int, error) {
+	if len(buf) < minEntryMetaLen(flags) {
+		return 0, io.ErrShortBuffer
+	}
+	meta := le.Meta
+	le.Term, le.Type, le.Meta, le.AppendedAt = 0, 0, nil, time.Time{}
+	cursor := 0
+	if flags&frameFlagTerm != 0 {
+		le.Term = binary.LittleEndian.Uint64(buf[cursor:])
+		cursor += 8
+	}
+	if flags&frameFlagAppendedAt != 0 {
+		le.AppendedAt = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[cursor:])))
+		cursor += 8
+	}
+	if flags&frameFlagMeta != 0 {
+		le.Type = buf[cursor]
+		metaLen := int(buf[cursor+1])
+		cursor += 2
+		if len(buf) < cursor+metaLen {
+			return 0, io.ErrShortBuffer
+		}
+		if metaLen > 0 {
+			le.Meta = append(meta[:0], buf[cursor:cursor+metaLen]...)
+		}
+		cursor += metaLen
+	}
+	if flags&frameFlagCompressed != 0 {
+		if len(buf) < cursor+entryCompressionLen {
+			return 0, io.ErrShortBuffer
+		}
+		cursor += entryCompressionLen
+	}
+	if flags&frameFlagEncrypted != 0 {
+		if len(buf) < cursor+entryEncryptionLen {
+			return 0, io.ErrShortBuffer
+		}
+		cursor += entryEncryptionLen
+	}
+	if flags&frameFlagCRC != 0 {
+		if len(buf) < cursor+4 {
+			return 0, io.ErrShortBuffer
+		}
+		cursor += 4
+	}
+	return cursor, nil
+}
+
+// readEntryCompression returns the compression metadata from meta, the
+// metadata of an entry frame with flags as measured by readEntryMeta. It's
+// zero if the frame isn't compressed.
+func readEntryCompression(meta []byte, flags uint8) entryCompression {
+	if flags&frameFlagCompressed == 0 {
+		return entryCompression{}
+	}
+	end := len(meta)
+	if flags&frameFlagCRC != 0 {
+		end -= 4
+	}
+	if flags&frameFlagEncrypted != 0 {
+		end -= entryEncryptionLen
+	}
+	return entryCompression{
+		codec: meta[end-entryCompressionLen],
+		size:  binary.LittleEndian.Uint32(meta[end-4:]),
+	}
+}
+
+// readEntryEncryption returns the encryption metadata from meta, the metadata
+// of an entry frame with flags as measured by readEntryMeta. It's zero if the
+// frame isn't encrypted.
+func readEntryEncryption(meta []byte, flags uint8) entryEncryption {
+	if flags&frameFlagEncrypted == 0 {
+		return entryEncryption{}
+	}
+	end := len(meta)
+	if flags&frameFlagCRC != 0 {
+		end -= 4
+	}
+	start := end - entryEncryptionLen
+	ee := entryEncryption{
+		suite: meta[start],
+		keyID: binary.LittleEndian.Uint32(meta[start+1:]),
+	}
+	copy(ee.nonce[:], meta[start+5:end])
+	return ee
+}
+
+// entryPayloadCRC returns the CRC stored in an entry frame's payload and the
+// CRC computed over the rest of the payload. metaLen is the length of the
+// payload's metadata as returned by readEntryMeta. It must only be called for
+// frames with frameFlagCRC set.
+func entryPayloadCRC(payload []byte, metaLen int) (stored, computed uint32) {
+	crcStart := metaLen - 4
+	stored = binary.LittleEndian.Uint32(payload[crcStart:])
+	return stored, entryCRC(payload[:crcStart], payload[metaLen:])
+}
+
+// entryCRC returns the CRC of an entry given the metadata that precedes the
+// CRC in its payload and all of its data.
+func entryCRC(meta, data []byte) uint32 {
+	crc := crc32.Checksum(meta, castagnoliTable)
+	return crc32.Update(crc, castagnoliTable, data)
+}
+
+func termsFrameSize(numRuns int) int {
+	if numRuns == 0 {
+		return 0
+	}
+	return encodedFrameSize(numRuns * termRunLen)
+}
+
+// writeTermsFrame writes a frame recording the term of every entry in the
+// segment as a list of runs. It's written just after the index frame when a
+// segment containing any entries with a non-zero Term is sealed.
+func writeTermsFrame(buf []byte, runs []types.TermRun) error {
+	if len(buf) < termsFrameSize(len(runs)) {
+		return io.ErrShortBuffer
+	}
+	fh := frameHeader{
+		typ: FrameTerms,
+		len: uint32(len(runs) * termRunLen),
+	}
+	if err := writeFrameHeader(buf, fh); err != nil {
+		return err
+	}
+	cursor := frameHeaderLen
+	for _, r := range runs {
+		binary.LittleEndian.PutUint64(buf[cursor:], r.Term)
+		binary.LittleEndian.PutUint64(buf[cursor+8:], r.FirstIndex)
+		cursor += termRunLen
+	}
+	return nil
+}
+
+// readTermRuns decodes the payload of a terms frame.
+func readTermRuns(buf []byte) ([]types.TermRun, error) {
+	if len(buf)%termRunLen != 0 {
+		return nil, fmt.Errorf("%w: terms frame length %d is not a multiple of %d", types.ErrCorrupt, len(buf), termRunLen)
+	}
+	runs := make([]types.TermRun, 0, len(buf)/termRunLen)
+	for cursor := 0; cursor < len(buf); cursor += termRunLen {
+		runs = append(runs, types.TermRun{
+			Term:       binary.LittleEndian.Uint64(buf[cursor:]),
+			FirstIndex: binary.LittleEndian.Uint64(buf[cursor+8:]),
+		})
+	}
+	return runs, nil
+}
+
+// appendTermRun records that the entry at idx has term in runs, returning the
+// (possibly) extended slice.
+func appendTermRun(runs []types.TermRun, idx, term uint64) []types.TermRun {
+	if len(runs) > 0 && runs[len(runs)-1].Term == term {
+		return runs
+	}
+	return append(runs, types.TermRun{Term: term, FirstIndex: idx})
+}
+
+// trimTermRuns drops any runs that start after lastIdx.
+func trimTermRuns(runs []types.TermRun, lastIdx uint64) []types.TermRun {
+	for len(runs) > 0 && runs[len(runs)-1].FirstIndex > lastIdx {
+		runs = runs[:len(runs)-1]
+	}
+	return runs
+}
+
+// writeHMACFrame writes a frame containing sum, an HMAC-SHA256 of everything in
+// the segment file before the frame, computed with the key keyID.
+func writeHMACFrame(buf []byte, keyID uint32, sum []byte) error {
+	if len(buf) < encodedFrameSize(hmacLen) {
+		return io.ErrShortBuffer
+	}
+	fh := frameHeader{
+		typ: FrameHMAC,
+		len: hmacLen,
+	}
+	if err := writeFrameHeader(buf, fh); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(buf[frameHeaderLen:], keyID)
+	binary.LittleEndian.PutUint32(buf[frameHeaderLen+4:], 0)
+	copy(buf[frameHeaderLen+8:], sum)
+	return nil
+}
+
+// readHMAC decodes the payload of an HMAC frame.
+func readHMAC(buf []byte) (uint32, []byte, error) {
+	if len(buf) != hmacLen {
+		return 0, nil, fmt.Errorf("%w: HMAC frame has length %d, expected %d", types.ErrCorrupt, len(buf), hmacLen)
+	}
+	return binary.LittleEndian.Uint32(buf), buf[8:], nil
+}
@@ -4,8 +4,13 @@
 package segment
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -87,6 +92,68 @@ func TestFileHeaderCodec(t *testing.T) {
 			},
 			wantValidateErr: "corrupt",
 		},
+		{
+			name: "newer version reading",
+			info: types.SegmentInfo{
+				BaseIndex: 1234,
+				ID:        4321,
+			},
+			corrupt: func(buf []byte) []byte {
+				buf[7] = FormatVersion + 1
+				return buf
+			},
+			wantReadErr: "unsupported segment format",
+		},
+		{
+			name: "version doesn't match meta",
+			info: types.SegmentInfo{
+				BaseIndex:     1234,
+				ID:            4321,
+				FormatVersion: FormatVersion,
+			},
+			corrupt: func(buf []byte) []byte {
+				buf[7] = 0
+				return buf
+			},
+			wantValidateErr: "corrupt",
+		},
+		{
+			name: "unsupported feature reading",
+			info: types.SegmentInfo{
+				BaseIndex: 1234,
+				ID:        4321,
+			},
+			corrupt: func(buf []byte) []byte {
+				buf[4] |= 1 << 6
+				return buf
+			},
+			wantReadErr: "doesn't support: unknown(0x40)",
+		},
+		{
+			name: "features don't match meta",
+			info: types.SegmentInfo{
+				BaseIndex:     1234,
+				ID:            4321,
+				FormatVersion: FormatVersion,
+				Features:      CurrentFeatures,
+			},
+			corrupt: func(buf []byte) []byte {
+				buf[4] = 0
+				return buf
+			},
+			wantValidateErr: "corrupt",
+		},
+		{
+			name: "old version reading",
+			info: types.SegmentInfo{
+				BaseIndex: 1234,
+				ID:        4321,
+			},
+			corrupt: func(buf []byte) []byte {
+				buf[7] = 0
+				return buf
+			},
+		},
 	}
 
 	for _, tc := range cases {
@@ -135,6 +202,9 @@ func TestFileHeaderCodecFuzz(t *testing.T) {
 	var buf [fileHeaderLen]byte
 	for i := 0; i < 1000; i++ {
 		fzz.Fuzz(&info)
+		// The header always records the current version and features.
+		info.FormatVersion = FormatVersion
+		info.Features = CurrentFeatures
 		err := writeFileHeader(buf[:], info)
 		require.NoError(t, err)
 
@@ -156,7 +226,7 @@ func TestFrameCodecFuzz(t *testing.T) {
 	// Allocate an extra frameHeaderLen heres because some lengths might end up
 	// needing padding which takes them just over the buffer size.
 	var buf [math.MaxUint16 + frameHeaderLen + frameHeaderLen]byte
-	var val = []byte(strings.Repeat("A Value!", math.MaxUint16/8))
+	var val = []byte(strings.Repeat("A Value!", math.MaxUint16/8+1))
 	var fh frameHeader
 	for i := 0; i < 1000; i++ {
 		fzz.Fuzz(&length)
@@ -191,6 +261,45 @@ func TestFrameCodecFuzz(t *testing.T) {
 	}
 }
 
+func TestEntryFrameCodecFuzz(t *testing.T) {
+	fzz := fuzz.New().NilChance(0.2)
+
+	var e types.LogEntry
+	for i := 0; i < 1000; i++ {
+		fzz.Fuzz(&e)
+		if len(e.Meta) > MaxEntryMetaSize {
+			e.Meta = e.Meta[:MaxEntryMetaSize]
+		}
+
+		buf := make([]byte, encodedFrameSize(encodedEntryMetaLen(e)+len(e.Data)))
+		require.NoError(t, writeEntryFrame(buf, e))
+
+		fh, err := readFrameHeader(buf)
+		require.NoError(t, err)
+		require.Equal(t, FrameEntry, fh.typ)
+		require.Equal(t, entryFlags(e), fh.flags)
+
+		var got types.LogEntry
+		metaLen, err := readEntryMeta(buf[frameHeaderLen:frameHeaderLen+fh.len], fh.flags, &got)
+		require.NoError(t, err)
+		got.Data = buf[frameHeaderLen+metaLen : frameHeaderLen+fh.len]
+
+		stored, computed := entryPayloadCRC(buf[frameHeaderLen:frameHeaderLen+fh.len], metaLen)
+		require.Equal(t, stored, computed)
+
+		require.Equal(t, e.Term, got.Term)
+		require.Equal(t, e.Type, got.Type)
+		require.Equal(t, len(e.Meta), len(got.Meta))
+		if len(e.Meta) > 0 {
+			require.Equal(t, e.Meta, got.Meta)
+		}
+		require.Equal(t, len(e.Data), len(got.Data))
+		if len(e.Data) > 0 {
+			require.Equal(t, e.Data, got.Data)
+		}
+	}
+}
+
 func TestPadLen(t *testing.T) {
 	fzz := fuzz.New()
 	var length uint32
@@ -234,3 +343,232 @@ func TestWriteIndexFrame(t *testing.T) {
 		offset += 4
 	}
 }
+
+func TestWriteDeltaIndexFrame(t *testing.T) {
+	var index [1024]uint32
+	offset := uint32(fileHeaderLen)
+	for i := range index {
+		index[i] = offset
+		// Mostly small frames with the odd big one.
+		if i%100 == 99 {
+			offset += 64 * 1024
+		} else {
+			offset += 64
+		}
+	}
+
+	l := deltaIndexLen(index[:])
+	require.Less(t, l, len(index)*4/3)
+	buf := make([]byte, encodedFrameSize(l))
+	require.NoError(t, writeDeltaIndexFrame(buf, index[:], 1, false))
+
+	fh, err := readFrameHeader(buf)
+	require.NoError(t, err)
+	require.Equal(t, FrameIndex, fh.typ)
+	require.Equal(t, indexFlagDelta, fh.flags)
+	require.Equal(t, l, int(fh.len))
+
+	interval, payload, err := readIndexInterval(buf[frameHeaderLen:frameHeaderLen+l], fh.flags)
+	require.NoError(t, err)
+	require.Equal(t, 1, int(interval))
+	got, err := readDeltaIndex(payload)
+	require.NoError(t, err)
+	require.Equal(t, index[:], got)
+
+	// A sparse index records its interval first.
+	buf = make([]byte, deltaIndexFrameSize(l, 300, false))
+	require.NoError(t, writeDeltaIndexFrame(buf, index[:], 300, false))
+	fh, err = readFrameHeader(buf)
+	require.NoError(t, err)
+	require.Equal(t, indexFlagDelta|indexFlagSparse, fh.flags)
+	require.Equal(t, l+2, int(fh.len))
+	interval, payload, err = readIndexInterval(buf[frameHeaderLen:frameHeaderLen+int(fh.len)], fh.flags)
+	require.NoError(t, err)
+	require.Equal(t, 300, int(interval))
+	got, err = readDeltaIndex(payload)
+	require.NoError(t, err)
+	require.Equal(t, index[:], got)
+
+	// A checksum follows everything else and catches any damage.
+	buf = make([]byte, deltaIndexFrameSize(l, 300, true))
+	require.NoError(t, writeDeltaIndexFrame(buf, index[:], 300, true))
+	fh, err = readFrameHeader(buf)
+	require.NoError(t, err)
+	require.Equal(t, indexFlagDelta|indexFlagSparse|indexFlagCRC, fh.flags)
+	require.Equal(t, l+2+4, int(fh.len))
+	payload, err = readIndexCRC(buf[frameHeaderLen:frameHeaderLen+int(fh.len)], fh.flags)
+	require.NoError(t, err)
+	interval, payload, err = readIndexInterval(payload, fh.flags)
+	require.NoError(t, err)
+	require.Equal(t, 300, int(interval))
+	got, err = readDeltaIndex(payload)
+	require.NoError(t, err)
+	require.Equal(t, index[:], got)
+	buf[frameHeaderLen+10] ^= 0x1
+	_, err = readIndexCRC(buf[frameHeaderLen:frameHeaderLen+int(fh.len)], fh.flags)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+
+	// Offsets must be increasing and aligned.
+	require.Error(t, writeDeltaIndexFrame(buf, []uint32{64, 64}, 1, false))
+	require.Error(t, writeDeltaIndexFrame(buf, []uint32{65}, 1, false))
+
+	_, err = readDeltaIndex([]byte{4, 0})
+	require.ErrorIs(t, err, types.ErrCorrupt)
+	_, err = readDeltaIndex([]byte{4, 0x80})
+	require.ErrorIs(t, err, types.ErrCorrupt)
+}
+
+// sealedSegmentBytes returns the contents of a sealed segment file.
+func sealedSegmentBytes(t testing.TB) []byte {
+	f := NewFiler("test", newTestVFS())
+	w, err := f.Create(testSegment(1))
+	require.NoError(t, err)
+	defer w.Close()
+
+	for idx := uint64(1); ; idx++ {
+		val := strings.Repeat(fmt.Sprintf("%03d ", idx), 64)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Data: []byte(val)}}))
+		sealed, _, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			break
+		}
+	}
+	return append([]byte(nil), w.(*Writer).wf.(*testWritableFile).getBuf()...)
+}
+
+func TestParseFrames(t *testing.T) {
+	buf := sealedSegmentBytes(t)
+
+	info, frames, err := ParseFrames(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), info.BaseIndex)
+
+	// Each entry is committed on its own, then the index, trailer and a final
+	// commit seal the segment.
+	require.Equal(t, FrameEntry, frames[0].Type)
+	require.Equal(t, FrameCommit, frames[1].Type)
+	require.Nil(t, frames[1].Payload)
+	require.Equal(t, FrameCommit, frames[len(frames)-1].Type)
+	var frameTypes []uint8
+	for i, f := range frames {
+		frameTypes = append(frameTypes, f.Type)
+		require.Len(t, f.Payload, int(f.Len))
+		if i > 0 {
+			require.Greater(t, f.Offset, frames[i-1].Offset)
+		}
+	}
+	require.Contains(t, frameTypes, FrameIndex)
+	require.Contains(t, frameTypes, FrameTrailer)
+	require.Contains(t, string(frames[0].Payload), "001 ")
+
+	// Cutting the data off part way through a frame returns the frames before
+	// it and where it stopped.
+	cut := int(frames[2].Offset) + frameHeaderLen + 10
+	_, got, err := ParseFrames(buf[:cut])
+	require.ErrorIs(t, err, ErrTruncated)
+	var fe *FrameError
+	require.True(t, errors.As(err, &fe))
+	require.Equal(t, frames[2].Offset, fe.Offset)
+	require.Equal(t, frames[:2], got)
+
+	_, _, err = ParseFrames(buf[:fileHeaderLen-1])
+	require.ErrorIs(t, err, ErrTruncated)
+
+	// Trailing zeros, as in a preallocated file, aren't an error.
+	_, got, err = ParseFrames(append(buf[:frames[2].Offset:frames[2].Offset], make([]byte, 100)...))
+	require.NoError(t, err)
+	require.Equal(t, frames[:2], got)
+
+	// Nor is running out of data on a frame boundary.
+	_, got, err = ParseFrames(buf[:frames[2].Offset])
+	require.NoError(t, err)
+	require.Equal(t, frames[:2], got)
+
+	// An unknown frame type is corruption.
+	bad := append([]byte(nil), buf...)
+	bad[frames[2].Offset] = 0xEE
+	_, got, err = ParseFrames(bad)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+	require.True(t, errors.As(err, &fe))
+	require.Equal(t, frames[2].Offset, fe.Offset)
+	require.Len(t, got, 2)
+
+	// So is a length that can't be right for the frame type.
+	bad = append([]byte(nil), buf...)
+	binary.LittleEndian.PutUint32(bad[frames[0].Offset+4:], math.MaxUint32)
+	_, _, err = ParseFrames(bad)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+
+	// And a bad file header.
+	bad = append([]byte(nil), buf...)
+	bad[0] ^= 0xFF
+	_, _, err = ParseFrames(bad)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+}
+
+func TestRawIterator(t *testing.T) {
+	buf := sealedSegmentBytes(t)
+	_, want, err := ParseFrames(buf)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "seg.wal")
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+	it, err := OpenRawIterator(path)
+	require.NoError(t, err)
+	defer it.Close()
+
+	require.Equal(t, uint64(1), it.Info().BaseIndex)
+	var got []Frame
+	for it.Next() {
+		f := it.Frame()
+		f.Payload = append([]byte(nil), f.Payload...)
+		if f.Type == FrameCommit {
+			f.Payload = nil
+		}
+		got = append(got, f)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, want, got)
+
+	// A frame that runs past the end of the data stops it with an error after
+	// the frames before it.
+	cut := int(want[2].Offset) + frameHeaderLen + 10
+	it, err = NewRawIterator(bytes.NewReader(buf[:cut]), int64(cut))
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	require.True(t, it.Next())
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), ErrTruncated)
+	var fe *FrameError
+	require.True(t, errors.As(it.Err(), &fe))
+	require.Equal(t, want[2].Offset, fe.Offset)
+
+	_, err = NewRawIterator(bytes.NewReader(buf[:10]), 10)
+	require.ErrorIs(t, err, ErrTruncated)
+}
+
+func FuzzParseFrames(f *testing.F) {
+	buf := sealedSegmentBytes(f)
+	f.Add(buf)
+	f.Add(buf[:fileHeaderLen])
+	f.Add(buf[:len(buf)/2])
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		_, frames, err := ParseFrames(buf)
+		var fe *FrameError
+		if err != nil && !errors.As(err, &fe) {
+			t.Fatalf("error is not a *FrameError: %s", err)
+		}
+		end := int64(0)
+		for _, fr := range frames {
+			if fr.Offset < end {
+				t.Fatalf("frame at %d overlaps the one before, which ends at %d", fr.Offset, end)
+			}
+			end = fr.Offset + frameHeaderLen + int64(len(fr.Payload))
+			if end > int64(len(buf)) {
+				t.Fatalf("frame at %d ends at %d, past the end of the data", fr.Offset, end)
+			}
+		}
+	})
+}
@@ -0,0 +1,26 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux && !darwin
+
+package segment
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// KeyLockingSupported is whether keys can be locked into memory on this
+// platform; see WithKeyLocking.
+const KeyLockingSupported = false
+
+func allocKey(n int, lock bool) ([]byte, error) {
+	if lock {
+		return nil, fmt.Errorf("keys can't be locked into memory on %s", runtime.GOOS)
+	}
+	return make([]byte, n), nil
+}
+
+func freeKey(b []byte, locked bool) {
+	wipe(b)
+}
@@ -0,0 +1,45 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux || darwin
+
+package segment
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// KeyLockingSupported is whether keys can be locked into memory on this
+// platform; see WithKeyLocking.
+const KeyLockingSupported = true
+
+// allocKey returns a buffer of n bytes for a copy of a key. If lock is set it's
+// on pages of its own, mapped outside the Go heap and locked into memory so
+// they're never written to swap.
+func allocKey(n int, lock bool) ([]byte, error) {
+	if !lock {
+		return make([]byte, n), nil
+	}
+	page := os.Getpagesize()
+	b, err := unix.Mmap(-1, 0, (n+page-1)/page*page, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Mlock(b); err != nil {
+		unix.Munmap(b)
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// freeKey zeroes b, a buffer returned by allocKey with lock, and releases it.
+func freeKey(b []byte, locked bool) {
+	wipe(b)
+	if locked {
+		b = b[:cap(b)]
+		unix.Munlock(b)
+		unix.Munmap(b)
+	}
+}
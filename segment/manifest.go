@@ -0,0 +1,342 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+const (
+	// manifestMagic starts the first line of every manifest, which goes on to
+	// give next, as manifestHeader writes it.
+	manifestMagic = "wal-manifest 2"
+
+	// manifestSlack is how many more records than live segments a manifest
+	// may hold before it's rewritten with only the live ones.
+	manifestSlack = 128
+)
+
+// WithManifest is an option that keeps a manifest of the segments in the
+// Filer's dir, alongside the WAL's metadata, so that List reads one small file
+// instead of listing every dir and parsing each name, which is slow on dirs
+// with tens of thousands of files or on network filesystems. Create adds a
+// record to the manifest before the segment's file is created and Delete one
+// after it's deleted, so every file the Filer creates is listed even after a
+// crash. Records are appended and synced, and the manifest is rewritten with
+// only the segments that are left once it holds many more records than that.
+// If there's no manifest yet, or it's unreadable, List builds one from a
+// listing of the dirs.
+//
+// Segment files created by a Filer without the option aren't listed. The
+// manifest remembers the highest ID it has recorded, so CheckManifest, which a
+// WAL calls with its next segment ID when it opens, can tell when segments
+// were created without it and rebuild it from the dirs.
+func WithManifest() filerOpt {
+	return func(f *Filer) {
+		f.opts.manifest = true
+	}
+}
+
+// ManifestName returns the name of the manifest that WithManifest keeps for
+// segments named with n. WALs sharing a dir with different namings keep
+// different manifests.
+func (n FileNaming) ManifestName() string {
+	return n.Prefix + "segments" + n.extension() + ".manifest"
+}
+
+// manifest is the manifest a Filer created WithManifest keeps.
+type manifest struct {
+	vfs       types.VFS
+	dir, name string
+
+	mu     sync.Mutex
+	loaded bool
+	// live maps the ID of each segment in the manifest to its BaseIndex.
+	live map[uint64]uint64
+	// next is one more than the highest ID the manifest has recorded, even if
+	// that segment has since been deleted.
+	next uint64
+	// records and size are the number of records in the file and its length.
+	records int
+	size    int64
+}
+
+// loadLocked reads the manifest the first time it's needed, building it with
+// scan if there isn't one or it can't be read. A record torn by a crash, or
+// too many deleted segments, get it rewritten. The caller must hold mu.
+func (m *manifest) loadLocked(scan func() (map[uint64]uint64, error)) error {
+	if m.loaded {
+		return nil
+	}
+	live, next, records, torn, err := m.read()
+	if err != nil {
+		if live, err = scan(); err != nil {
+			return err
+		}
+		next = nextManifestID(live, 0)
+		torn = true
+	}
+	m.live, m.next, m.records = live, next, records
+	m.loaded = true
+	if torn || m.records > 2*len(m.live)+manifestSlack {
+		return m.rewriteLocked()
+	}
+	return nil
+}
+
+// check rebuilds the manifest from scan unless the last segment it recorded
+// is the one before nextID. If it's behind, segments were created without it.
+// If it's ahead, it recorded a segment the caller didn't allocate, which may
+// have hidden some created without it since.
+func (m *manifest) check(nextID uint64, scan func() (map[uint64]uint64, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLocked(scan); err != nil {
+		return err
+	}
+	if m.next == nextID {
+		return nil
+	}
+	live, err := scan()
+	if err != nil {
+		return err
+	}
+	m.live, m.next = live, nextManifestID(live, nextID)
+	return m.rewriteLocked()
+}
+
+// nextManifestID returns the larger of next and one more than the highest ID
+// in live.
+func nextManifestID(live map[uint64]uint64, next uint64) uint64 {
+	for id := range live {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	return next
+}
+
+// manifestHeader returns the first line of a manifest whose next is next.
+func manifestHeader(next uint64) string {
+	return fmt.Sprintf("%s %x\n", manifestMagic, next)
+}
+
+// read parses the manifest file. torn is true if its last record is
+// incomplete, which is ignored. A manifest written by an older version has a
+// different header so it's rebuilt.
+func (m *manifest) read() (live map[uint64]uint64, next uint64, records int, torn bool, err error) {
+	rf, err := m.vfs.OpenReader(m.dir, m.name)
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	defer rf.Close()
+	raw, err := io.ReadAll(io.NewSectionReader(rf, 0, math.MaxInt64))
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	nl := bytes.IndexByte(raw, '\n')
+	header, ok := "", false
+	if nl >= 0 {
+		header, ok = strings.CutPrefix(string(raw[:nl]), manifestMagic+" ")
+	}
+	if ok {
+		next, err = strconv.ParseUint(header, 16, 64)
+	}
+	if !ok || err != nil {
+		return nil, 0, 0, false, fmt.Errorf("%w: manifest %s has no header", types.ErrCorrupt, m.name)
+	}
+	m.size = int64(nl + 1)
+	rest := raw[nl+1:]
+	live = make(map[uint64]uint64)
+	for len(rest) > 0 {
+		nl := bytes.IndexByte(rest, '\n')
+		if nl < 0 {
+			return live, next, records, true, nil
+		}
+		line := string(rest[:nl])
+		id, err := applyManifestRecord(live, line)
+		if err != nil {
+			return nil, 0, 0, false, fmt.Errorf("%w: manifest %s: %s", types.ErrCorrupt, m.name, err)
+		}
+		if line[0] == '+' && id >= next {
+			next = id + 1
+		}
+		records++
+		m.size += int64(nl + 1)
+		rest = rest[nl+1:]
+	}
+	return live, next, records, false, nil
+}
+
+// applyManifestRecord applies the record line, without its newline, to live
+// and returns the ID it's for. "+<ID in hex> <BaseIndex>" adds a segment and
+// "-<ID in hex>" removes one.
+func applyManifestRecord(live map[uint64]uint64, line string) (uint64, error) {
+	if line == "" {
+		return 0, fmt.Errorf("empty record")
+	}
+	switch line[0] {
+	case '+':
+		id, base, ok := cutManifestRecord(line[1:])
+		if !ok {
+			return 0, fmt.Errorf("malformed record %q", line)
+		}
+		live[id] = base
+		return id, nil
+	case '-':
+		id, err := strconv.ParseUint(line[1:], 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed record %q", line)
+		}
+		delete(live, id)
+		return id, nil
+	default:
+		return 0, fmt.Errorf("malformed record %q", line)
+	}
+}
+
+func cutManifestRecord(s string) (id, base uint64, ok bool) {
+	idStr, baseStr, found := strings.Cut(s, " ")
+	if !found {
+		return 0, 0, false
+	}
+	id, err := strconv.ParseUint(idStr, 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	base, err = strconv.ParseUint(baseStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return id, base, true
+}
+
+// list returns a copy of the segments in the manifest by ID.
+func (m *manifest) list(scan func() (map[uint64]uint64, error)) (map[uint64]uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLocked(scan); err != nil {
+		return nil, err
+	}
+	segs := make(map[uint64]uint64, len(m.live))
+	for id, base := range m.live {
+		segs[id] = base
+	}
+	return segs, nil
+}
+
+// add records the segment with the given ID and BaseIndex. It must be called
+// before the segment's file is created.
+func (m *manifest) add(id, base uint64, scan func() (map[uint64]uint64, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLocked(scan); err != nil {
+		return err
+	}
+	if b, ok := m.live[id]; ok && b == base {
+		return nil
+	}
+	if err := m.appendLocked(fmt.Sprintf("+%x %d\n", id, base)); err != nil {
+		return err
+	}
+	m.live[id] = base
+	if id >= m.next {
+		m.next = id + 1
+	}
+	return nil
+}
+
+// remove records that the segment with the given ID was deleted. It must be
+// called after the segment's files are deleted.
+func (m *manifest) remove(id uint64, scan func() (map[uint64]uint64, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLocked(scan); err != nil {
+		return err
+	}
+	if _, ok := m.live[id]; !ok {
+		return nil
+	}
+	delete(m.live, id)
+	if m.records+1 > 2*len(m.live)+manifestSlack {
+		return m.rewriteLocked()
+	}
+	return m.appendLocked(fmt.Sprintf("-%x\n", id))
+}
+
+// appendLocked appends rec to the file and syncs it.
+func (m *manifest) appendLocked(rec string) error {
+	wf, err := m.vfs.OpenWriter(m.dir, m.name)
+	if err != nil {
+		return err
+	}
+	_, err = wf.WriteAt([]byte(rec), m.size)
+	if err == nil {
+		err = wf.Sync()
+	}
+	if cerr := wf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Whatever was written can't be trusted so the file is read again,
+		// and rewritten if the record is torn, before the next change.
+		m.loaded = false
+		return fmt.Errorf("failed to update manifest: %w", err)
+	}
+	m.size += int64(len(rec))
+	m.records++
+	return nil
+}
+
+// rewriteLocked replaces the file with one holding a record for each live
+// segment, written under a temporary name and renamed into place.
+func (m *manifest) rewriteLocked() error {
+	ids := make([]uint64, 0, len(m.live))
+	for id := range m.live {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var buf bytes.Buffer
+	buf.WriteString(manifestHeader(m.next))
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "+%x %d\n", id, m.live[id])
+	}
+
+	tmpName := m.name + ".tmp"
+	if err := m.vfs.Delete(m.dir, tmpName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	wf, err := m.vfs.Create(m.dir, tmpName, 0)
+	if err != nil {
+		return err
+	}
+	_, err = wf.WriteAt(buf.Bytes(), 0)
+	if err == nil {
+		err = wf.Sync()
+	}
+	if cerr := wf.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = m.vfs.Rename(m.dir, tmpName, m.name)
+	}
+	if err != nil {
+		m.loaded = false
+		return fmt.Errorf("failed to rewrite manifest: %w", err)
+	}
+	m.size = int64(buf.Len())
+	m.records = len(ids)
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// sealedMarkerSuffix ends the names of sealed markers.
+const sealedMarkerSuffix = ".sealed"
+
+// WithSealedMarkers is an option that creates an empty marker file alongside
+// each segment once it's sealed, named with FileNaming.SealedName so that the
+// name records the segment's MaxIndex. SealedMaxIndexes, and tools that only
+// list the dir, can then tell which entries each sealed file holds without
+// opening it. The MaxIndex is the last entry in the file, which TruncateBack
+// can leave beyond the last one the WAL still has. Segments sealed without the
+// option, or by a crash before their marker was created, simply have none.
+// Markers are copied, moved to the trash and deleted along with their
+// segments. The FileNaming's Extension must not be ".sealed".
+func WithSealedMarkers() filerOpt {
+	return func(f *Filer) {
+		f.opts.sealedMarkers = true
+	}
+}
+
+// markerIndex remembers the names of the sealed markers in each dir by the
+// segment file they're for, so that deleting or copying a segment needn't
+// list its dir to find its marker. A dir is listed the first time a segment
+// without a known marker is looked up in it, to find those created before the
+// Filer was, and after that it's kept up to date as markers are created and
+// removed.
+type markerIndex struct {
+	mu     sync.Mutex
+	loaded map[string]bool
+	names  map[string]map[string][]string
+}
+
+// addLocked records that name is a marker of the segment file fname in dir.
+// The caller must hold mu.
+func (m *markerIndex) addLocked(dir, fname, name string) {
+	if m.names == nil {
+		m.names = make(map[string]map[string][]string)
+	}
+	byFile := m.names[dir]
+	if byFile == nil {
+		byFile = make(map[string][]string)
+		m.names[dir] = byFile
+	}
+	for _, n := range byFile[fname] {
+		if n == name {
+			return
+		}
+	}
+	byFile[fname] = append(byFile[fname], name)
+}
+
+// markSealed creates the sealed marker of the segment file fname in dir,
+// which was sealed with maxIndex as its last entry. It's only a hint so it
+// isn't synced, and one that's already there is left as it is.
+func (f *Filer) markSealed(dir, fname string, maxIndex uint64) error {
+	name := f.naming.sealedName(fname, maxIndex)
+	if err := f.createMarker(dir, name); err != nil {
+		return err
+	}
+	f.markers.mu.Lock()
+	f.markers.addLocked(dir, fname, name)
+	f.markers.mu.Unlock()
+	return nil
+}
+
+// sealedHook returns the func a Writer for the segment file fname in dir calls
+// once it's sealed, or nil without WithSealedMarkers.
+func (f *Filer) sealedHook(dir, fname string) func(uint64) {
+	if !f.opts.sealedMarkers {
+		return nil
+	}
+	return func(maxIndex uint64) {
+		// The marker is only a hint so failing to create it doesn't fail the
+		// append that sealed the segment, which is already durable.
+		_ = f.markSealed(dir, fname, maxIndex)
+	}
+}
+
+// createMarker creates the empty file name in dir unless it's already there.
+func (f *Filer) createMarker(dir, name string) error {
+	wf, err := f.vfs.Create(dir, name, 0)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return wf.Close()
+}
+
+// sealedMarkers returns the names of the sealed markers of the segment file
+// fname in dir. There's normally at most one. Markers the Filer created are
+// found by name, and only the first lookup of another in each dir lists it.
+func (f *Filer) sealedMarkers(dir, fname string) ([]string, error) {
+	if !f.opts.sealedMarkers {
+		return nil, nil
+	}
+	f.markers.mu.Lock()
+	defer f.markers.mu.Unlock()
+	if len(f.markers.names[dir][fname]) == 0 && !f.markers.loaded[dir] {
+		names, err := f.vfs.ListDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, name := range names {
+			if strings.HasSuffix(name, sealedMarkerSuffix) {
+				if seg, _ := splitSealedName(name); seg != "" {
+					f.markers.addLocked(dir, seg, name)
+				}
+			}
+		}
+		if f.markers.loaded == nil {
+			f.markers.loaded = make(map[string]bool)
+		}
+		f.markers.loaded[dir] = true
+	}
+	markers := f.markers.names[dir][fname]
+	return append([]string(nil), markers...), nil
+}
+
+// removeSealedMarkers removes the sealed markers of the segment file fname in
+// dir with remove.
+func (f *Filer) removeSealedMarkers(dir, fname string, remove func(dir, name string) error) error {
+	markers, err := f.sealedMarkers(dir, fname)
+	if err != nil {
+		return err
+	}
+	for _, name := range markers {
+		if err := remove(dir, name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if len(markers) > 0 {
+		f.markers.mu.Lock()
+		delete(f.markers.names[dir], fname)
+		f.markers.mu.Unlock()
+	}
+	return nil
+}
+
+// SealedMaxIndexes returns the MaxIndex that the sealed marker of each
+// segment in f's dirs records, by ID, without opening any segment files.
+// Segments without a marker aren't included.
+func (f *Filer) SealedMaxIndexes() (map[uint64]uint64, error) {
+	maxIndexes := make(map[uint64]uint64)
+	for _, dir := range f.dirs() {
+		names, err := f.vfs.ListDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if _, id, maxIndex, ok := f.naming.ParseSealed(name); ok {
+				maxIndexes[id] = maxIndex
+			}
+		}
+	}
+	return maxIndexes, nil
+}
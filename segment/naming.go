@@ -0,0 +1,141 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FileNaming is how a Filer names segment files. The zero value is the
+// default scheme, where a segment with BaseIndex 1 and ID 2 is named
+// 00000000000000000001-0000000000000002.wal.
+//
+// Several WALs can share a directory if each names its segments with a
+// different Extension, or they all have a Prefix and none of those is the
+// start of another. A Filer treats any other file whose name has its Prefix
+// and Extension as a corrupt segment.
+type FileNaming struct {
+	// Prefix is put in front of every name.
+	Prefix string
+
+	// Extension ends every name. It's ".wal" if empty.
+	Extension string
+
+	// NoPadding writes numbers without leading zeros, so names are shorter
+	// but no longer sort in log order.
+	NoPadding bool
+
+	// OmitBaseIndex leaves the BaseIndex out of names, which is then read from
+	// each file's header when listing segments.
+	OmitBaseIndex bool
+}
+
+func (n FileNaming) extension() string {
+	if n.Extension == "" {
+		return segmentFileSuffix
+	}
+	return n.Extension
+}
+
+// Name returns the file name of the segment with the given BaseIndex and ID.
+func (n FileNaming) Name(baseIndex, ID uint64) string {
+	var id, base string
+	if n.NoPadding {
+		id = strconv.FormatUint(ID, 16)
+		base = strconv.FormatUint(baseIndex, 10)
+	} else {
+		id = fmt.Sprintf("%016x", ID)
+		base = fmt.Sprintf("%020d", baseIndex)
+	}
+	if n.OmitBaseIndex {
+		return n.Prefix + id + n.extension()
+	}
+	return n.Prefix + base + "-" + id + n.extension()
+}
+
+// Parse returns the BaseIndex and ID in name and true, or false if name isn't
+// one this scheme would give a segment. Numbers may be padded or not whatever
+// NoPadding says. BaseIndex is zero if OmitBaseIndex is set.
+func (n FileNaming) Parse(name string) (baseIndex, ID uint64, ok bool) {
+	if !strings.HasPrefix(name, n.Prefix) || !strings.HasSuffix(name, n.extension()) ||
+		len(name) < len(n.Prefix)+len(n.extension()) {
+		return 0, 0, false
+	}
+	rest := name[len(n.Prefix) : len(name)-len(n.extension())]
+	if !n.OmitBaseIndex {
+		base, id, found := strings.Cut(rest, "-")
+		if !found || !validNumber(base) {
+			return 0, 0, false
+		}
+		bi, err := strconv.ParseUint(base, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		baseIndex, rest = bi, id
+	}
+	if !validNumber(rest) {
+		return 0, 0, false
+	}
+	id, err := strconv.ParseUint(rest, 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return baseIndex, id, true
+}
+
+// validNumber reports whether s could be a number in a name. Any width is
+// accepted, padded or not, and ParseUint checks the digits themselves.
+func validNumber(s string) bool {
+	return s != "" && s[0] != '+' && s[0] != '-'
+}
+
+// SealedName returns the name of the marker file that WithSealedMarkers
+// creates alongside the segment with the given BaseIndex and ID once it's
+// sealed with maxIndex as its last entry. It's the segment's file name
+// followed by a dot, maxIndex and ".sealed", so the range of entries a sealed
+// file holds can be told from the names in its dir.
+func (n FileNaming) SealedName(baseIndex, ID, maxIndex uint64) string {
+	return n.sealedName(n.Name(baseIndex, ID), maxIndex)
+}
+
+func (n FileNaming) sealedName(fname string, maxIndex uint64) string {
+	if n.NoPadding {
+		return fname + "." + strconv.FormatUint(maxIndex, 10) + sealedMarkerSuffix
+	}
+	return fmt.Sprintf("%s.%020d%s", fname, maxIndex, sealedMarkerSuffix)
+}
+
+// ParseSealed returns the BaseIndex, ID and MaxIndex in name and true if it's
+// the name of a sealed marker, or false if it isn't, for example because it's
+// the name of a segment file itself, which Parse reads.
+func (n FileNaming) ParseSealed(name string) (baseIndex, ID, maxIndex uint64, ok bool) {
+	if !strings.HasSuffix(name, sealedMarkerSuffix) {
+		return 0, 0, 0, false
+	}
+	fname, maxStr := splitSealedName(name)
+	if !validNumber(maxStr) {
+		return 0, 0, 0, false
+	}
+	maxIndex, err := strconv.ParseUint(maxStr, 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	if baseIndex, ID, ok = n.Parse(fname); !ok {
+		return 0, 0, 0, false
+	}
+	return baseIndex, ID, maxIndex, true
+}
+
+// splitSealedName splits the name of a sealed marker into the name of its
+// segment file and its MaxIndex.
+func splitSealedName(name string) (fname, maxIndex string) {
+	rest := strings.TrimSuffix(name, sealedMarkerSuffix)
+	dot := strings.LastIndexByte(rest, '.')
+	if dot < 0 {
+		return "", ""
+	}
+	return rest[:dot], rest[dot+1:]
+}
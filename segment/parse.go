@@ -0,0 +1,173 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// ErrTruncated is wrapped by the FrameError ParseFrames returns when the
+// buffer ends part way through a frame.
+var ErrTruncated = errors.New("segment data ends mid-frame")
+
+// Frame is one frame of a segment file as parsed by ParseFrames.
+type Frame struct {
+	// Offset is the position of the frame's header in the file.
+	Offset int64
+
+	// Type is one of the Frame* constants, never FrameInvalid.
+	Type uint8
+
+	// Flags are the frame's flags. Their meaning depends on Type.
+	Flags uint8
+
+	// Len is the length of the payload. It's zero for commit frames.
+	Len uint32
+
+	// CRC is the checksum a commit frame records of the frames since the
+	// previous commit. It's zero for other frames.
+	CRC uint32
+
+	// Payload is the frame's payload without its padding. It's a slice of the
+	// buffer passed to ParseFrames, not a copy, and nil for commit frames.
+	Payload []byte
+}
+
+// FrameError describes where ParseFrames found a problem. Err wraps
+// types.ErrCorrupt if the data there is invalid, ErrTruncated if it stops
+// short, or types.ErrUnsupportedFormat if it's from a newer version.
+type FrameError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("segment frame at offset %d: %s", e.Offset, e.Err)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// ParseFrames parses buf, which holds the start of a segment file, into its
+// file header and frames. It never reads outside buf, doesn't allocate more
+// than a small multiple of the number of frames in it, and doesn't panic
+// whatever buf holds, so it's safe to use on damaged or hostile files.
+//
+// Parsing stops without error at the end of buf or at a header of all zeros,
+// which is where a file's written data ends if it was preallocated. Any other
+// problem stops it with a *FrameError, along with the frames before it.
+// Entries aren't decoded and no checksums are checked.
+func ParseFrames(buf []byte) (*types.SegmentInfo, []Frame, error) {
+	info, err := decodeFileHeader(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var frames []Frame
+	offset := fileHeaderLen
+	for offset < len(buf) {
+		hdr := buf[offset:]
+		if len(hdr) > frameHeaderLen {
+			hdr = hdr[:frameHeaderLen]
+		}
+		fh, size, err := decodeFrame(hdr, int64(len(buf)-offset))
+		if err != nil {
+			return info, frames, &FrameError{Offset: int64(offset), Err: err}
+		}
+		if fh.typ == FrameInvalid {
+			break
+		}
+		f := Frame{Offset: int64(offset), Type: fh.typ, Flags: fh.flags, Len: fh.len, CRC: fh.crc}
+		if fh.typ != FrameCommit {
+			start := offset + frameHeaderLen
+			f.Payload = buf[start : start+int(fh.len) : start+int(fh.len)]
+		}
+		frames = append(frames, f)
+		offset += int(size)
+	}
+	return info, frames, nil
+}
+
+// decodeFileHeader decodes the file header at the start of buf, returning a
+// *FrameError if it's missing or invalid.
+func decodeFileHeader(buf []byte) (*types.SegmentInfo, error) {
+	if len(buf) < fileHeaderLen {
+		return nil, &FrameError{Offset: 0, Err: fmt.Errorf("%w: file header is %d bytes, expected %d", ErrTruncated, len(buf), fileHeaderLen)}
+	}
+	info, err := readFileHeader(buf)
+	if err != nil {
+		if !errors.Is(err, types.ErrCorrupt) && !errors.Is(err, types.ErrUnsupportedFormat) {
+			err = fmt.Errorf("%w: %s", types.ErrCorrupt, err)
+		}
+		return nil, &FrameError{Offset: 0, Err: err}
+	}
+	return info, nil
+}
+
+// decodeFrame decodes hdr, the first frameHeaderLen bytes of a frame or fewer
+// if the data ends sooner, and checks that the whole frame fits in the left
+// bytes from its start. It returns the header and the frame's size including
+// padding, or a zero header where the written data ends.
+func decodeFrame(hdr []byte, left int64) (frameHeader, int64, error) {
+	if len(hdr) < frameHeaderLen {
+		if isZero(hdr) {
+			return frameHeader{}, 0, nil
+		}
+		return frameHeader{}, 0, fmt.Errorf("%w: partial frame header", ErrTruncated)
+	}
+	fh, err := readFrameHeader(hdr)
+	if err != nil || fh.typ == FrameInvalid {
+		return fh, 0, err
+	}
+	if err := checkFrameLen(fh); err != nil {
+		return fh, 0, err
+	}
+	if fh.typ == FrameCommit {
+		return fh, frameHeaderLen, nil
+	}
+	// Sizes are int64 so a huge length can't overflow.
+	size := int64(fh.len) + frameHeaderLen + int64(padLen(int(fh.len%frameHeaderLen)))
+	if size > left {
+		return fh, 0, fmt.Errorf("%w: frame with %d byte payload but only %d bytes left", ErrTruncated, fh.len, left)
+	}
+	return fh, size, nil
+}
+
+// checkFrameLen checks that the payload length in fh is possible for its
+// type.
+func checkFrameLen(fh frameHeader) error {
+	switch fh.typ {
+	case FrameEntry, FrameChunk:
+		if fh.len > MaxEntrySize {
+			return fmt.Errorf("%w: frame length %d is more than the maximum %d", types.ErrCorrupt, fh.len, MaxEntrySize)
+		}
+	case FrameTerms:
+		if fh.len%termRunLen != 0 {
+			return fmt.Errorf("%w: terms frame length %d is not a multiple of %d", types.ErrCorrupt, fh.len, termRunLen)
+		}
+	case FrameHMAC:
+		if fh.len != hmacLen {
+			return fmt.Errorf("%w: HMAC frame has length %d, expected %d", types.ErrCorrupt, fh.len, hmacLen)
+		}
+	case FrameTrailer:
+		if fh.len != trailerLen {
+			return fmt.Errorf("%w: trailer frame has length %d, expected %d", types.ErrCorrupt, fh.len, trailerLen)
+		}
+	}
+	return nil
+}
+
+// isZero returns true if every byte of buf is zero.
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// RawIterator reads the frames of a segment file one at a time, in the order
+// they are in the file, including commit, index and trailer frames. Like
+// ParseFrames it only checks that each frame header is well formed, so it
+// reads whatever is there even if the segment as a whole makes no sense, but
+// it doesn't need the whole file in memory.
+type RawIterator struct {
+	r      io.ReaderAt
+	closer io.Closer
+	size   int64
+	info   types.SegmentInfo
+	offset int64
+	frame  Frame
+	buf    []byte
+	err    error
+}
+
+// OpenRawIterator opens the segment file at path and reads its file header.
+// The RawIterator must be closed when done with.
+func OpenRawIterator(path string) (*RawIterator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	it, err := NewRawIterator(f, st.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	it.closer = f
+	return it, nil
+}
+
+// NewRawIterator returns a RawIterator over the first size bytes of r, which
+// hold a segment file. Close doesn't close r.
+func NewRawIterator(r io.ReaderAt, size int64) (*RawIterator, error) {
+	hdr := make([]byte, fileHeaderLen)
+	if size < fileHeaderLen {
+		hdr = hdr[:size]
+	}
+	if err := readFullAt(r, hdr, 0); err != nil {
+		return nil, err
+	}
+	info, err := decodeFileHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &RawIterator{r: r, size: size, info: *info, offset: fileHeaderLen}, nil
+}
+
+// Info returns what the segment's file header records about it.
+func (it *RawIterator) Info() types.SegmentInfo {
+	return it.info
+}
+
+// Next moves to the next frame and returns true, or returns false if there
+// are no more frames or it can't read the next one, in which case Err says
+// why.
+func (it *RawIterator) Next() bool {
+	if it.err != nil || it.offset >= it.size {
+		return false
+	}
+	hdr := make([]byte, frameHeaderLen)
+	if left := it.size - it.offset; left < frameHeaderLen {
+		hdr = hdr[:left]
+	}
+	if err := readFullAt(it.r, hdr, it.offset); err != nil {
+		it.err = err
+		return false
+	}
+	fh, size, err := decodeFrame(hdr, it.size-it.offset)
+	if err != nil {
+		it.err = &FrameError{Offset: it.offset, Err: err}
+		return false
+	}
+	if fh.typ == FrameInvalid {
+		// The written data ends here.
+		it.offset = it.size
+		return false
+	}
+	it.frame = Frame{Offset: it.offset, Type: fh.typ, Flags: fh.flags, Len: fh.len, CRC: fh.crc}
+	if fh.typ != FrameCommit {
+		if cap(it.buf) < int(fh.len) {
+			it.buf = make([]byte, fh.len)
+		}
+		payload := it.buf[:fh.len]
+		if err := readFullAt(it.r, payload, it.offset+frameHeaderLen); err != nil {
+			it.err = err
+			return false
+		}
+		it.frame.Payload = payload
+	}
+	it.offset += size
+	return true
+}
+
+// Frame returns the frame Next moved to. Its Payload is only valid until the
+// next call to Next.
+func (it *RawIterator) Frame() Frame {
+	return it.frame
+}
+
+// Err returns the error that stopped Next, or nil if it reached the end of the
+// written data.
+func (it *RawIterator) Err() error {
+	return it.err
+}
+
+// Close closes the file opened by OpenRawIterator.
+func (it *RawIterator) Close() error {
+	if it.closer == nil {
+		return nil
+	}
+	return it.closer.Close()
+}
+
+// readFullAt fills p from r at off. Unlike io.ReaderAt it doesn't return
+// io.EOF if p ends exactly at the end of r.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
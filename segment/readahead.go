@@ -0,0 +1,138 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// readAheadTrigger is how many reads in a row must move forward through the
+	// file before we start reading ahead.
+	readAheadTrigger = 3
+
+	// readAheadSlack is how far past the end of the previous read the next one
+	// may start and still count as sequential. Frames are padded and reads of
+	// the frame header over-read into the next frame so consecutive frame reads
+	// are never exactly contiguous.
+	readAheadSlack = frameHeaderLen + maxEntryMetaLen
+)
+
+// raChunk is a range of the file that has been or is being read ahead.
+type raChunk struct {
+	off  int64
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+// read copies the chunk's data at off into p. It returns false if the read
+// can't be served from this chunk. It may only be called once the chunk is
+// done.
+func (c *raChunk) read(p []byte, off int64) (int, bool, error) {
+	if c.err != nil || off < c.off || off >= c.off+int64(len(c.buf)) {
+		return 0, false, nil
+	}
+	n := copy(p, c.buf[off-c.off:])
+	if n < len(p) {
+		if len(c.buf) < cap(c.buf) {
+			// This chunk was cut short by the end of the file.
+			return n, true, io.EOF
+		}
+		// Straddles the end of the chunk, let the caller read it directly.
+		return 0, false, nil
+	}
+	return n, true, nil
+}
+
+func (c *raChunk) covers(off int64, size int) bool {
+	return c != nil && off >= c.off && off < c.off+int64(size)
+}
+
+// readAhead wraps a sealed segment file. Once it sees a run of forward reads
+// it reads the file in large chunks and fetches the next chunk in the
+// background while the current one is consumed. This turns replaying a log,
+// which reads every frame in order, into a few large reads instead of two
+// small ones per entry.
+type readAhead struct {
+	rf   io.ReaderAt
+	size int
+
+	// wg tracks background reads so that close can wait for them.
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	lastOff int64
+	lastEnd int64
+	run     int
+	cur     *raChunk
+	next    *raChunk
+}
+
+func newReadAhead(rf io.ReaderAt, size int) *readAhead {
+	return &readAhead{rf: rf, size: size}
+}
+
+// fetch starts reading the chunk at off in the background.
+func (ra *readAhead) fetch(off int64) *raChunk {
+	c := &raChunk{off: off, buf: make([]byte, ra.size), done: make(chan struct{})}
+	ra.wg.Add(1)
+	go func() {
+		defer ra.wg.Done()
+		defer close(c.done)
+		n, err := ra.rf.ReadAt(c.buf, off)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		c.buf, c.err = c.buf[:n], err
+	}()
+	return c
+}
+
+// ReadAt implements io.ReaderAt.
+func (ra *readAhead) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > ra.size {
+		return ra.rf.ReadAt(p, off)
+	}
+
+	ra.mu.Lock()
+	if off >= ra.lastOff && off <= ra.lastEnd+readAheadSlack {
+		ra.run++
+	} else {
+		ra.run = 0
+	}
+	ra.lastOff, ra.lastEnd = off, off+int64(len(p))
+
+	var c *raChunk
+	switch {
+	case ra.next.covers(off, ra.size):
+		// We've moved on to the chunk being read ahead, start on the one after.
+		c = ra.next
+		ra.cur = c
+		ra.next = ra.fetch(c.off + int64(ra.size))
+	case ra.cur.covers(off, ra.size):
+		c = ra.cur
+	}
+	if c == nil && ra.run >= readAheadTrigger {
+		c = ra.fetch(off)
+		ra.cur = c
+		ra.next = ra.fetch(off + int64(ra.size))
+	}
+	ra.mu.Unlock()
+
+	if c != nil {
+		<-c.done
+		if n, ok, err := c.read(p, off); ok {
+			return n, err
+		}
+	}
+	return ra.rf.ReadAt(p, off)
+}
+
+// close waits for any reads in flight so they don't outlive the file.
+func (ra *readAhead) close() {
+	ra.wg.Wait()
+}
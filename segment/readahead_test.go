@@ -0,0 +1,107 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+type countingReaderAt struct {
+	rf    io.ReaderAt
+	reads int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.rf.ReadAt(p, off)
+}
+
+func TestReadAhead(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 10000))
+	rf := newTestWritableFile(len(data))
+	_, err := rf.WriteAt(data, 0)
+	require.NoError(t, err)
+
+	crf := &countingReaderAt{rf: rf}
+	ra := newReadAhead(crf, 4096)
+	defer ra.close()
+
+	read := func(off int64, n int) {
+		t.Helper()
+		buf := make([]byte, n)
+		got, err := ra.ReadAt(buf, off)
+		if off+int64(n) > int64(len(data)) {
+			require.ErrorIs(t, err, io.EOF)
+		} else {
+			require.NoError(t, err)
+		}
+		require.Equal(t, data[off:off+int64(got)], buf[:got])
+	}
+
+	// Read through the whole file in small steps that overlap and skip a bit
+	// like frame reads do.
+	for off := int64(0); off < int64(len(data)); off += 90 {
+		read(off, 100)
+	}
+	sequentialReads := atomic.LoadInt64(&crf.reads)
+	require.Less(t, sequentialReads, int64(len(data)/90/4))
+
+	// Random reads still return the right data.
+	for i := 0; i < 1000; i++ {
+		read(rand.Int63n(int64(len(data))), rand.Intn(200)+1)
+	}
+}
+
+func TestReadAheadReader(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithReadAhead(8*1024), WithBlockCache(NewBlockCache(64*1024)))
+
+	seg0 := testSegment(1)
+	seg0.SizeLimit = 128 * 1024
+	w, err := f.Create(seg0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	valFor := func(idx uint64) string {
+		return fmt.Sprintf("%05d:%s", idx, strings.Repeat("v", int(idx%13)*40))
+	}
+	var last uint64
+	for idx := uint64(1); ; idx++ {
+		require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Term: 1, Data: []byte(valFor(idx))}}))
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			seg0.IndexStart = indexStart
+			last = idx
+			break
+		}
+	}
+	seg0.MaxIndex = last
+	seg0.SealTime = time.Now()
+
+	r, err := f.Open(seg0)
+	require.NoError(t, err)
+	defer r.Close()
+	_, ok := r.(*Reader).sealedRF.Load().(*readAhead)
+	require.True(t, ok)
+
+	// Both the writer, which sealed the segment, and the newly opened reader
+	// read ahead.
+	for _, sr := range []types.SegmentReader{w, r} {
+		var le types.LogEntry
+		for idx := uint64(1); idx <= last; idx++ {
+			require.NoError(t, sr.GetLog(idx, &le))
+			require.Equal(t, valFor(idx), string(le.Data))
+		}
+	}
+}
@@ -4,10 +4,15 @@
 package segment
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"sync"
+	"sync/atomic"
 
 	"github.com/dreamsxin/wal/types"
 )
@@ -17,28 +22,146 @@ type Reader struct {
 	info types.SegmentInfo
 	rf   types.ReadableFile
 
-	scratchFrameHeader []byte
-
 	// tail optionally providers an interface to the writer state when this is an
 	// unsealed segment so we can fetch from it's in-memory index.
 	tail tailWriter
+
+	// terms is loaded from the terms frame of a sealed segment the first time
+	// it's needed.
+	termsOnce sync.Once
+	terms     []types.TermRun
+	termsErr  error
+
+	// index holds the decoded offsets of a sealed segment with a delta encoded
+	// index frame, which records every indexInterval'th entry. It's loaded the
+	// first time it's needed. Segments with a plain index frame are read
+	// straight from the file instead and leave it nil.
+	indexOnce     sync.Once
+	index         []uint32
+	indexInterval uint64
+	indexErr      error
+
+	// trailer is loaded from the trailer frame of a sealed segment the first
+	// time it's needed. It's nil if the segment doesn't have one.
+	trailerOnce   sync.Once
+	trailer       *Trailer
+	trailerOffset int64
+	trailerErr    error
+
+	// cache and read-ahead are optional. Reads only go through them once the
+	// segment is sealed and sealedRF is set since until then the file is still
+	// changing.
+	cache         *BlockCache
+	readAheadSize int
+	sealedRF      atomic.Value // io.ReaderAt
+
+	// recent is optional and only set for tail segments. It serves reads of
+	// the most recently written frames from memory until the segment is
+	// sealed.
+	recent *tailBuffer
+
+	// verify makes every read check the entry frame's checksum.
+	verify bool
+
+	// dict is the dictionary compressed entries are compressed with if the
+	// segment has FeatureDictionary.
+	dict *dictionary
+
+	// keys decrypt encrypted entries. It's nil if no encryption keys were
+	// given, in which case they can't be read.
+	keys *keyring
+
+	// hmacKeys are used by Verify to check the signature of sealed segments.
+	hmacKeys   types.KeyProvider
+	strictHMAC bool
 }
 
 type tailWriter interface {
 	OffsetForFrame(idx uint64) (uint32, error)
+	TermRuns() ([]types.TermRun, error)
+	LastIndex() uint64
 }
 
-func openReader(info types.SegmentInfo, rf types.ReadableFile) (*Reader, error) {
+// ErrChecksum is wrapped, along with ErrCorrupt, by errors for data that
+// doesn't match its checksum, whether an entry's, an index frame's or a whole
+// sealed segment's.
+var ErrChecksum = errors.New("checksum doesn't match")
+
+// frameBufPool holds buffers big enough for a frame header and any entry
+// metadata. Reads go through an io.ReaderAt so a buffer on the stack would
+// escape and every read would allocate one. Reader can't keep a single buffer
+// since many goroutines may read the same segment at once.
+var frameBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([frameHeaderLen + maxEntryMetaLen]byte)
+	},
+}
+
+// errNotSigned is wrapped by verifyHMAC's error when a segment has no HMAC
+// frame so that Verify can tolerate unsigned segments outside of strict mode.
+var errNotSigned = errors.New("segment is not signed")
+
+func openReader(info types.SegmentInfo, rf types.ReadableFile, opts fileOpts) (*Reader, error) {
 	r := &Reader{
-		info: info,
-		rf:   rf,
+		info:          info,
+		rf:            rf,
+		cache:         opts.cache,
+		readAheadSize: opts.readAheadSize,
+		verify:        opts.verifyOnRead,
+		hmacKeys:      opts.hmacKeys,
+		strictHMAC:    opts.strictHMAC,
+		dict:          opts.dict,
+		keys:          opts.keys,
 	}
 
 	return r, nil
 }
 
-// Close implements io.Closer
+// sealed is called once the segment's file will no longer change so that
+// reads can be cached and read ahead.
+func (r *Reader) sealed() {
+	if r.recent != nil {
+		r.recent.release()
+	}
+	if r.cache == nil && r.readAheadSize == 0 {
+		return
+	}
+	var rf io.ReaderAt = r.rf
+	if r.cache != nil {
+		rf = &cachedFile{rf: rf, id: r.info.ID, cache: r.cache}
+	}
+	if r.readAheadSize > 0 {
+		rf = newReadAhead(rf, r.readAheadSize)
+	}
+	r.sealedRF.Store(rf)
+}
+
+// readAt reads from the segment file, through the block cache and read-ahead
+// if they're in use. Recent tail frames may be served from memory instead.
+func (r *Reader) readAt(p []byte, off int64) (int, error) {
+	if r.recent != nil {
+		if n, ok := r.recent.readAt(p, off); ok {
+			if n < len(p) {
+				return n, io.EOF
+			}
+			return n, nil
+		}
+	}
+	if rf, ok := r.sealedRF.Load().(io.ReaderAt); ok {
+		return rf.ReadAt(p, off)
+	}
+	return r.rf.ReadAt(p, off)
+}
+
+// Close implements io.Closer. Once a segment is closed it's either been deleted
+// or the WAL is shutting down so any cached blocks are dropped.
 func (r *Reader) Close() error {
+	if ra, ok := r.sealedRF.Load().(*readAhead); ok {
+		ra.close()
+	}
+	if r.cache != nil {
+		r.cache.dropSegment(r.info.ID)
+	}
 	return r.rf.Close()
 }
 
@@ -50,55 +173,590 @@ func (r *Reader) GetLog(idx uint64, le *types.LogEntry) error {
 		return err
 	}
 
-	if _, err := r.readFrame(offset, le); err != nil {
+	if r.info.Codec == CodecUpstreamBinaryV1 {
+		if ok, err := r.readUpstreamFrame(offset, le, true); ok || err != nil {
+			return err
+		}
+	}
+	if r.verify {
+		return r.readVerifiedFrame(idx, offset, le, true)
+	}
+	if _, err := r.readFrame(idx, offset, le); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (r *Reader) readFrame(offset uint32, le *types.LogEntry) (frameHeader, error) {
-	if cap(r.scratchFrameHeader) < frameHeaderLen {
-		r.scratchFrameHeader = make([]byte, frameHeaderLen)
+// GetLogMeta implements types.SegmentReader. It reads only the entry's
+// metadata, leaving le.Data untouched.
+func (r *Reader) GetLogMeta(idx uint64, le *types.LogEntry) error {
+	offset, err := r.findFrameOffset(idx)
+	if err != nil {
+		return err
 	}
-	r.scratchFrameHeader = r.scratchFrameHeader[:frameHeaderLen]
-	n, err := r.rf.ReadAt(r.scratchFrameHeader, int64(offset))
-	if errors.Is(err, io.EOF) && n >= frameHeaderLen {
-		// We might have hit EOF just because our read buffer (at least 64KiB) might
-		// be larger than the space left in the file (say if files are tiny or if we
-		// are reading a frame near the end.). So don't treat EOF as an error as
-		// long as we have actually managed to read a frameHeader - we'll work out
-		// if we got the whole thing or not below.
-		err = nil
 
-		// Re-slice buf.Bs so it's len() reflect only what we actually managed to
-		// read. Note this doesn't impact the buffer length when it's returned to
-		// the pool which will still return the whole cap.
-		le.Data = le.Data[:n]
+	if r.info.Codec == CodecUpstreamBinaryV1 {
+		if ok, err := r.readUpstreamFrame(offset, le, false); ok || err != nil {
+			return err
+		}
+	}
+	if r.verify {
+		return r.readVerifiedFrame(idx, offset, le, false)
 	}
+	if _, _, err := r.readFrameMeta(offset, le); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readVerifiedFrame reads the whole entry frame at offset and checks its
+// checksum before decoding it into le. Data is only set if withData is true.
+// Frames written before entries had checksums can't be verified and are
+// returned as is.
+func (r *Reader) readVerifiedFrame(idx uint64, offset uint32, le *types.LogEntry, withData bool) error {
+	fh, err := r.readFrameHeaderAt(int64(offset))
 	if err != nil {
-		return frameHeader{}, err
+		return err
+	}
+	if fh.typ != FrameEntry {
+		return fmt.Errorf("%w: expected entry frame for index %d in segment %s at offset %d, found type %d",
+			types.ErrCorrupt, idx, FileName(r.info), offset, fh.typ)
 	}
-	fh, err := readFrameHeader(r.scratchFrameHeader)
+	if fh.len > MaxEntrySize {
+		return fmt.Errorf("%w: frame header indicates a record larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
+	}
+
+	// Unless the entry is chunked, compressed or encrypted, the whole payload is
+	// read into le.Data's buffer if it's big enough and the data moved to the
+	// front of it once it's checked.
+	var payload []byte
+	reuse := withData && fh.flags&(frameFlagMore|frameFlagCompressed|frameFlagEncrypted) == 0 && cap(le.Data) >= int(fh.len)
+	if reuse {
+		payload = le.Data[:fh.len]
+	} else {
+		payload = make([]byte, fh.len)
+	}
+	if err := r.readFull(payload, int64(offset)+frameHeaderLen); err != nil {
+		return err
+	}
+	metaLen, err := readEntryMeta(payload, fh.flags, le)
 	if err != nil {
-		return fh, err
+		return fmt.Errorf("%w: failed to read entry metadata at offset %d: %s", types.ErrCorrupt, offset, err)
+	}
+	data := payload[metaLen:]
+	var (
+		trailer    uint32
+		hasTrailer bool
+	)
+	if fh.flags&frameFlagMore != 0 {
+		if data, trailer, hasTrailer, err = r.readChunks(offset, fh, data); err != nil {
+			return err
+		}
+	}
+	var stored, computed uint32
+	switch {
+	case fh.flags&frameFlagCRC != 0:
+		stored = binary.LittleEndian.Uint32(payload[metaLen-4:])
+		computed = entryCRC(payload[:metaLen-4], data)
+	case hasTrailer:
+		stored, computed = trailer, entryCRC(payload[:metaLen], data)
+	}
+	if stored != computed {
+		return fmt.Errorf("%w: %w for index %d in segment %s at offset %d: stored %08x, computed %08x",
+			types.ErrCorrupt, ErrChecksum, idx, FileName(r.info), offset, stored, computed)
+	}
+	if withData {
+		switch {
+		case fh.flags&(frameFlagCompressed|frameFlagEncrypted) != 0:
+			if data, err = r.decoder().decode(le.Data[:0], data, payload[:metaLen], fh.flags, idx); err != nil {
+				return fmt.Errorf("failed to read index %d in segment %s at offset %d: %w", idx, FileName(r.info), offset, err)
+			}
+		case reuse:
+			data = payload[:copy(payload, data)]
+		}
+		le.Data = data
 	}
+	return nil
+}
 
-	// Need to read more bytes, validate that len is a sensible number
+// readChunks appends the data in the chunk frames that follow the entry frame
+// at offset, which has header fh, to data. If the last chunk ends with the
+// entry's CRC, as a streamed entry's does, it's returned separately with ok
+// set to true.
+func (r *Reader) readChunks(offset uint32, fh frameHeader, data []byte) (_ []byte, crc uint32, ok bool, err error) {
+	next := int64(offset) + int64(encodedFrameSize(int(fh.len)))
+	for fh.flags&frameFlagMore != 0 {
+		fh, err = r.readFrameHeaderAt(next)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if fh.typ != FrameChunk {
+			return nil, 0, false, fmt.Errorf("%w: expected chunk frame in segment %s at offset %d, found type %d",
+				types.ErrCorrupt, FileName(r.info), next, fh.typ)
+		}
+		if fh.len > MaxEntrySize || len(data)+chunkDataLen(fh) > MaxChunkedEntrySize {
+			return nil, 0, false, fmt.Errorf("%w: chunked entry is larger than MaxChunkedEntrySize (%d bytes)", types.ErrCorrupt, MaxChunkedEntrySize)
+		}
+		start := len(data)
+		data = append(data, make([]byte, fh.len)...)
+		if err := r.readFull(data[start:], next+frameHeaderLen); err != nil {
+			return nil, 0, false, err
+		}
+		if fh.flags&frameFlagCRC != 0 {
+			end := start + chunkDataLen(fh)
+			crc, ok = binary.LittleEndian.Uint32(data[end:]), true
+			data = data[:end]
+		}
+		next += int64(encodedFrameSize(int(fh.len)))
+	}
+	return data, crc, ok, nil
+}
+
+// readUpstreamFrame reads the entry frame at offset if it was written by
+// upstream hashicorp/raft-wal. It returns false and leaves le untouched if the
+// frame is one of ours.
+func (r *Reader) readUpstreamFrame(offset uint32, le *types.LogEntry, withData bool) (bool, error) {
+	fh, err := r.readFrameHeaderAt(int64(offset))
+	if err != nil {
+		return false, err
+	}
+	if fh.typ != FrameEntry || !isUpstreamFrame(r.info, fh) {
+		return false, nil
+	}
 	if fh.len > MaxEntrySize {
-		return fh, fmt.Errorf("%w: frame header indicates a record larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
+		return true, fmt.Errorf("%w: frame header indicates a record larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
 	}
+	payload := make([]byte, fh.len)
+	if err := r.readFull(payload, int64(offset)+frameHeaderLen); err != nil {
+		return true, err
+	}
+	return true, decodeUpstreamEntry(payload, le, withData)
+}
 
-	if cap(le.Data) < int(fh.len) {
-		le.Data = make([]byte, fh.len)
+func (r *Reader) readFrame(idx uint64, offset uint32, le *types.LogEntry) (frameHeader, error) {
+	fh, metaLen, err := r.readFrameMeta(offset, le)
+	if err != nil {
+		return fh, err
 	}
-	le.Data = le.Data[:fh.len]
 
-	if _, err := r.rf.ReadAt(le.Data, int64(offset+frameHeaderLen)); err != nil {
+	dataLen := int(fh.len) - metaLen
+	if fh.flags&(frameFlagCompressed|frameFlagEncrypted) != 0 {
+		// The metadata is read again along with the data since how the data is
+		// stored is recorded in it.
+		payload := make([]byte, fh.len)
+		if err := r.readFull(payload, int64(offset)+frameHeaderLen); err != nil {
+			return fh, err
+		}
+		data, err := r.decoder().decode(le.Data[:0], payload[metaLen:], payload[:metaLen], fh.flags, idx)
+		if err != nil {
+			return fh, fmt.Errorf("failed to read entry in segment %s at offset %d: %w", FileName(r.info), offset, err)
+		}
+		le.Data = data
+		return fh, nil
+	}
+	if cap(le.Data) < dataLen {
+		le.Data = make([]byte, dataLen)
+	}
+	le.Data = le.Data[:dataLen]
+
+	if _, err := r.readAt(le.Data, int64(offset)+int64(frameHeaderLen+metaLen)); err != nil {
 		return fh, err
 	}
+	if fh.flags&frameFlagMore != 0 {
+		data, _, _, err := r.readChunks(offset, fh, le.Data)
+		if err != nil {
+			return fh, err
+		}
+		le.Data = data
+	}
 	return fh, nil
 }
 
+// decoder returns the entryDecoder for the segment's compressed and encrypted
+// entries.
+func (r *Reader) decoder() entryDecoder {
+	return entryDecoder{segID: r.info.ID, keys: r.keys, dict: r.dict}
+}
+
+// readFrameMeta reads the frame header and entry metadata of the frame at
+// offset into le. It returns the header and the length of the metadata.
+func (r *Reader) readFrameMeta(offset uint32, le *types.LogEntry) (frameHeader, int, error) {
+	// Read the header and any entry metadata in one go.
+	hdr := frameBufPool.Get().(*[frameHeaderLen + maxEntryMetaLen]byte)
+	defer frameBufPool.Put(hdr)
+	n, err := r.readAt(hdr[:], int64(offset))
+	if errors.Is(err, io.EOF) && n >= frameHeaderLen {
+		// We might have hit EOF just because our read buffer might be larger than
+		// the space left in the file (say if we are reading a small frame right at
+		// the end). So don't treat EOF as an error as long as we have actually
+		// managed to read a frameHeader - we'll work out if we got the whole thing
+		// or not below.
+		err = nil
+	}
+	if err != nil {
+		return frameHeader{}, 0, err
+	}
+	fh, err := readFrameHeader(hdr[:n])
+	if err != nil {
+		return fh, 0, err
+	}
+
+	// Need to read more bytes, validate that len is a sensible number
+	if fh.len > MaxEntrySize {
+		return fh, 0, fmt.Errorf("%w: frame header indicates a record larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
+	}
+
+	// Only parse metadata from within this frame's payload.
+	end := n
+	if frameHeaderLen+int(fh.len) < end {
+		end = frameHeaderLen + int(fh.len)
+	}
+	metaLen, err := readEntryMeta(hdr[frameHeaderLen:end], fh.flags, le)
+	if err != nil {
+		return fh, 0, fmt.Errorf("%w: failed to read entry metadata at offset %d: %s", types.ErrCorrupt, offset, err)
+	}
+	return fh, metaLen, nil
+}
+
+// TermRuns implements types.SegmentReader.
+func (r *Reader) TermRuns() ([]types.TermRun, error) {
+	if r.tail != nil {
+		return r.tail.TermRuns()
+	}
+	r.termsOnce.Do(func() {
+		r.terms, r.termsErr = r.loadTermRuns()
+	})
+	return r.terms, r.termsErr
+}
+
+// loadTermRuns reads the terms frame of a sealed segment which directly
+// follows the index frame. Segments that only contain entries with a zero Term
+// don't have a terms frame, in which case nil is returned.
+func (r *Reader) loadTermRuns() ([]types.TermRun, error) {
+	if r.info.IndexStart == 0 {
+		return nil, fmt.Errorf("sealed segment has no index block")
+	}
+	var hdr [frameHeaderLen]byte
+	if err := r.readFull(hdr[:], int64(r.info.IndexStart)-frameHeaderLen); err != nil {
+		return nil, fmt.Errorf("failed to read segment index header: %w", err)
+	}
+	ifh, err := readFrameHeader(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if ifh.typ != FrameIndex {
+		return nil, fmt.Errorf("%w: expected index frame at offset %d, found type %d",
+			types.ErrCorrupt, r.info.IndexStart-frameHeaderLen, ifh.typ)
+	}
+
+	termsOffset := int64(r.info.IndexStart) + int64(ifh.len) + int64(padLen(int(ifh.len)))
+	if err := r.readFull(hdr[:], termsOffset); err != nil {
+		return nil, fmt.Errorf("failed to read segment terms header: %w", err)
+	}
+	tfh, err := readFrameHeader(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if tfh.typ != FrameTerms {
+		if r.info.Codec == CodecUpstreamBinaryV1 {
+			return r.scanUpstreamTermRuns()
+		}
+		return nil, nil
+	}
+	if tfh.len > MaxEntrySize {
+		return nil, fmt.Errorf("%w: terms frame is larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
+	}
+	buf := make([]byte, tfh.len)
+	if err := r.readFull(buf, termsOffset+frameHeaderLen); err != nil {
+		return nil, fmt.Errorf("failed to read segment terms: %w", err)
+	}
+	return readTermRuns(buf)
+}
+
+// loadDeltaIndex reads and decodes the index frame of a sealed segment if it's
+// delta encoded, returning the offsets and how many entries apart they are. It
+// returns nil if the index is a plain array that can be read from the file as
+// needed.
+func (r *Reader) loadDeltaIndex() ([]uint32, uint64, error) {
+	offset := int64(r.info.IndexStart) - frameHeaderLen
+	fh, err := r.readFrameHeaderAt(offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read segment index header: %w", err)
+	}
+	if fh.typ != FrameIndex {
+		return nil, 0, fmt.Errorf("%w: expected index frame at offset %d, found type %d",
+			types.ErrCorrupt, offset, fh.typ)
+	}
+	if fh.flags&indexFlagDelta == 0 {
+		return nil, 0, nil
+	}
+	if fh.len > MaxEntrySize {
+		return nil, 0, fmt.Errorf("%w: index frame is larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
+	}
+	buf := make([]byte, fh.len)
+	if err := r.readFull(buf, int64(r.info.IndexStart)); err != nil {
+		return nil, 0, fmt.Errorf("failed to read segment index: %w", err)
+	}
+	buf, err = readIndexCRC(buf, fh.flags)
+	if err != nil {
+		return nil, 0, fmt.Errorf("segment %s: %w", FileName(r.info), err)
+	}
+	interval, buf, err := readIndexInterval(buf, fh.flags)
+	if err != nil {
+		return nil, 0, err
+	}
+	offsets, err := readDeltaIndex(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Offsets are increasing so checking the last is enough to know they all
+	// point at frames before the index.
+	if n := len(offsets); n > 0 && (offsets[0] < fileHeaderLen || int64(offsets[n-1]) >= offset) {
+		return nil, 0, fmt.Errorf("%w: segment %s index has offsets outside the file's entries",
+			types.ErrCorrupt, FileName(r.info))
+	}
+	return offsets, interval, nil
+}
+
+// skipEntries returns the offset of the entry frame n entries after the one at
+// offset. The frames in between are read through one at a time which is how
+// entries that a sparse index doesn't record are found.
+func (r *Reader) skipEntries(offset uint32, n uint64) (uint32, error) {
+	if n == 0 {
+		return offset, nil
+	}
+	pos := int64(offset)
+	for {
+		fh, err := r.readFrameHeaderAt(pos)
+		if err != nil {
+			return 0, err
+		}
+		switch fh.typ {
+		case FrameEntry:
+			if n == 0 {
+				return uint32(pos), nil
+			}
+			n--
+		case FrameChunk, FrameCommit:
+		case FrameInvalid:
+			return 0, fmt.Errorf("%w: ran out of frames looking for entry in segment %s at offset %d",
+				types.ErrCorrupt, FileName(r.info), pos)
+		default:
+			// We've reached the index so there's no such entry.
+			return 0, types.ErrNotFound
+		}
+		pos += int64(encodedFrameSize(int(fh.len)))
+	}
+}
+
+// scanUpstreamTermRuns works out the term runs of a sealed segment written by
+// upstream hashicorp/raft-wal, which doesn't write a terms frame, by reading
+// the Term of every entry.
+func (r *Reader) scanUpstreamTermRuns() ([]types.TermRun, error) {
+	var (
+		runs []types.TermRun
+		le   types.LogEntry
+	)
+	for idx := r.info.BaseIndex; idx <= r.info.MaxIndex; idx++ {
+		offset, err := r.findFrameOffset(idx)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := r.readUpstreamFrame(offset, &le, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if _, _, err := r.readFrameMeta(offset, &le); err != nil {
+				return nil, err
+			}
+		}
+		runs = appendTermRun(runs, idx, le.Term)
+	}
+	return runs, nil
+}
+
+// verifyHMAC checks the signature of a sealed segment. The HMAC frame is the
+// last one written when the segment was sealed.
+func (r *Reader) verifyHMAC(keys types.KeyProvider) error {
+	fh, offset, ok, err := r.findSealFrame(r.info.IndexStart, FrameHMAC)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %w: %s", types.ErrCorrupt, errNotSigned, FileName(r.info))
+	}
+
+	buf := make([]byte, fh.len)
+	if err := r.readFull(buf, offset+frameHeaderLen); err != nil {
+		return fmt.Errorf("failed to read segment HMAC: %w", err)
+	}
+	keyID, sum, err := readHMAC(buf)
+	if err != nil {
+		return err
+	}
+	key, err := keys.Key(keyID)
+	if err != nil {
+		return fmt.Errorf("failed to get key %d to verify segment %s: %w", keyID, FileName(r.info), err)
+	}
+	mac := hmac.New(sha256.New, key)
+	releaseKey(keys, keyID, key)
+	if _, err := io.Copy(mac, io.NewSectionReader(r.rf, 0, offset)); err != nil {
+		return fmt.Errorf("failed to read segment to verify it: %w", err)
+	}
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return fmt.Errorf("%w: segment %s HMAC doesn't match", types.ErrCorrupt, FileName(r.info))
+	}
+	return nil
+}
+
+// verifyChecksums checks a sealed segment against the checksum in its trailer
+// t, if it has one, and the checksum of the whole file recorded in its
+// metadata when it was sealed, if there is one. Both are checked in a single
+// sequential read that bypasses the block cache so verifying doesn't evict
+// blocks readers need.
+func (r *Reader) verifyChecksums(t *Trailer) error {
+	var end int64
+	if r.info.Checksum != 0 {
+		_, offset, ok, err := r.findSealFrame(r.info.IndexStart, FrameCommit)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: segment %s has no commit frame after its index", types.ErrCorrupt, FileName(r.info))
+		}
+		end = offset + frameHeaderLen
+	}
+
+	var (
+		crc  uint32
+		from int64
+		err  error
+	)
+	if t != nil {
+		if crc, err = r.updateCRC(0, 0, r.trailerOffset); err != nil {
+			return err
+		}
+		if crc != t.Checksum {
+			return fmt.Errorf("%w: segment %s %w its trailer", types.ErrCorrupt, FileName(r.info), ErrChecksum)
+		}
+		from = r.trailerOffset
+	}
+	if r.info.Checksum != 0 {
+		if crc, err = r.updateCRC(crc, from, end); err != nil {
+			return err
+		}
+		if crc != r.info.Checksum {
+			return fmt.Errorf("%w: segment %s %w its metadata", types.ErrCorrupt, FileName(r.info), ErrChecksum)
+		}
+	}
+	return nil
+}
+
+// updateCRC returns crc updated with the bytes of the file from offset from up
+// to offset to.
+func (r *Reader) updateCRC(crc uint32, from, to int64) (uint32, error) {
+	buf := make([]byte, minBufSize)
+	for from < to {
+		n := len(buf)
+		if int64(n) > to-from {
+			n = int(to - from)
+		}
+		m, err := r.rf.ReadAt(buf[:n], from)
+		if m < n {
+			if err == nil || err == io.EOF {
+				return 0, fmt.Errorf("%w: segment %s is truncated", types.ErrCorrupt, FileName(r.info))
+			}
+			return 0, fmt.Errorf("failed to read segment to verify it: %w", err)
+		}
+		crc = crc32.Update(crc, castagnoliTable, buf[:n])
+		from += int64(n)
+	}
+	return crc, nil
+}
+
+// Verify implements types.SegmentVerifier. It reads every entry in the
+// segment checking its checksum and, for sealed segments when HMAC keys are
+// configured, the segment's signature. Unsigned segments are only an error in
+// strict mode. Entries written before checksums were added can't be checked.
+// Sealed segments with a trailer or a checksum in their metadata are first
+// checked against those, which needs only one sequential read. Entries are
+// only read one by one to find the damage if that doesn't match.
+func (r *Reader) Verify() error {
+	if r.tail == nil && r.hmacKeys != nil {
+		err := r.verifyHMAC(r.hmacKeys)
+		if err != nil && (r.strictHMAC || !errors.Is(err, errNotSigned)) {
+			return err
+		}
+	}
+	t, err := r.Trailer()
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		if err := r.checkTrailer(t); err != nil {
+			return err
+		}
+	}
+	var sumErr error
+	if r.tail == nil && (t != nil || r.info.Checksum != 0) {
+		sumErr = r.verifyChecksums(t)
+		if sumErr == nil || !errors.Is(sumErr, ErrChecksum) {
+			return sumErr
+		}
+	}
+
+	first, last := r.info.BaseIndex, r.info.MaxIndex
+	if r.info.MinIndex > first {
+		first = r.info.MinIndex
+	}
+	if r.tail != nil {
+		last = r.tail.LastIndex()
+	}
+	var le types.LogEntry
+	for idx := first; idx <= last && last > 0; idx++ {
+		offset, err := r.findFrameOffset(idx)
+		if err != nil {
+			return fmt.Errorf("failed to find index %d in segment %s: %w", idx, FileName(r.info), err)
+		}
+		if r.info.Codec == CodecUpstreamBinaryV1 {
+			// Upstream frames have no checksum but we can at least check they
+			// decode.
+			if ok, err := r.readUpstreamFrame(offset, &le, true); ok || err != nil {
+				if err != nil {
+					return fmt.Errorf("failed to read index %d in segment %s: %w", idx, FileName(r.info), err)
+				}
+				continue
+			}
+		}
+		if err := r.readVerifiedFrame(idx, offset, &le, true); err != nil {
+			return err
+		}
+	}
+	// Any damage is somewhere the entries' own checksums don't cover.
+	return sumErr
+}
+
+func (r *Reader) readFrameHeaderAt(offset int64) (frameHeader, error) {
+	buf := frameBufPool.Get().(*[frameHeaderLen + maxEntryMetaLen]byte)
+	defer frameBufPool.Put(buf)
+	hdr := buf[:frameHeaderLen]
+	if err := r.readFull(hdr, offset); err != nil {
+		return frameHeader{}, fmt.Errorf("failed to read frame header at offset %d: %w", offset, err)
+	}
+	return readFrameHeader(hdr)
+}
+
+// readFull reads len(buf) bytes at offset treating an EOF only as an error if
+// we didn't manage to read everything.
+func (r *Reader) readFull(buf []byte, offset int64) error {
+	n, err := r.readAt(buf, offset)
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	return err
+}
+
 func (r *Reader) findFrameOffset(idx uint64) (uint32, error) {
 	if r.tail != nil {
 		// This is not a sealed segment.
@@ -117,10 +775,28 @@ func (r *Reader) findFrameOffset(idx uint64) (uint32, error) {
 	// IndexStart is the offset to the first entry in the index array. We need to
 	// find the byte offset to the Nth entry
 	entryOffset := (idx - r.info.BaseIndex)
+
+	r.indexOnce.Do(func() {
+		r.index, r.indexInterval, r.indexErr = r.loadDeltaIndex()
+	})
+	if r.indexErr != nil {
+		return 0, r.indexErr
+	}
+	if r.index != nil {
+		i := entryOffset / r.indexInterval
+		if i >= uint64(len(r.index)) {
+			return 0, fmt.Errorf("%w: no index entry for %d in segment %s which has %d entries",
+				types.ErrCorrupt, idx, FileName(r.info), len(r.index))
+		}
+		return r.skipEntries(r.index[i], entryOffset%r.indexInterval)
+	}
+
 	byteOffset := r.info.IndexStart + (entryOffset * 4)
 
-	var bs [4]byte
-	n, err := r.rf.ReadAt(bs[:], int64(byteOffset))
+	buf := frameBufPool.Get().(*[frameHeaderLen + maxEntryMetaLen]byte)
+	defer frameBufPool.Put(buf)
+	bs := buf[:4]
+	n, err := r.readAt(bs, int64(byteOffset))
 	if err == io.EOF && n == 4 {
 		// Read all of it just happened to be at end of file, ignore
 		err = nil
@@ -128,6 +804,10 @@ func (r *Reader) findFrameOffset(idx uint64) (uint32, error) {
 	if err != nil {
 		return 0, fmt.Errorf("failed to read segment index: %w", err)
 	}
-	offset := binary.LittleEndian.Uint32(bs[:])
+	offset := binary.LittleEndian.Uint32(bs)
+	if offset < fileHeaderLen || uint64(offset) >= r.info.IndexStart-frameHeaderLen {
+		return 0, fmt.Errorf("%w: segment %s index has offset %d for %d outside the file's entries",
+			types.ErrCorrupt, FileName(r.info), offset, idx)
+	}
 	return offset, nil
 }
@@ -4,7 +4,10 @@
 package segment
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 	"time"
@@ -30,11 +33,11 @@ func TestReader(t *testing.T) {
 			name:       "basic sealed",
 			firstIndex: 1,
 			entries: []entryDesc{
-				// 28 * 128 bytes entries are all that will fit in a 4KiB segment after
-				// headers and index size are accounted for.
-				{len: 128, num: 28},
+				// 25 * 128 bytes entries are all that will fit in a 4KiB segment after
+				// headers, append times, checksums, index and trailer are accounted for.
+				{len: 128, num: 25},
 			},
-			wantLastIndex: 28,
+			wantLastIndex: 25,
 		},
 		{
 			name:       "value larger than minBufSize",
@@ -49,7 +52,7 @@ func TestReader(t *testing.T) {
 			name:       "sealed file truncated",
 			firstIndex: 1,
 			entries: []entryDesc{
-				{len: 128, num: 28},
+				{len: 128, num: 25},
 			},
 			corrupt: func(twf *testWritableFile) error {
 				twf.Truncate(0)
@@ -136,3 +139,464 @@ func TestReader(t *testing.T) {
 		})
 	}
 }
+
+func TestReaderIndexEncoding(t *testing.T) {
+	for _, delta := range []bool{true, false} {
+		delta := delta
+		t.Run(fmt.Sprintf("delta=%v", delta), func(t *testing.T) {
+			vfs := newTestVFS()
+			f := NewFiler("test", vfs)
+
+			seg := testSegment(1)
+			w, err := f.Create(seg)
+			require.NoError(t, err)
+			defer w.Close()
+			// Tails created by older versions keep the plain index their header
+			// promises.
+			if !delta {
+				w.(*Writer).version = 1
+			}
+
+			idx := uint64(1)
+			for {
+				require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Data: []byte(fmt.Sprintf("entry %d", idx))}}))
+				sealed, indexStart, err := w.Sealed()
+				require.NoError(t, err)
+				if sealed {
+					seg.IndexStart = indexStart
+					break
+				}
+				idx++
+			}
+			seg.MaxIndex = idx
+			seg.SealTime = time.Now()
+
+			r, err := f.Open(seg)
+			require.NoError(t, err)
+			defer r.Close()
+			fh, err := r.(*Reader).readFrameHeaderAt(int64(seg.IndexStart) - frameHeaderLen)
+			require.NoError(t, err)
+			if delta {
+				require.Equal(t, indexFlagDelta|indexFlagCRC, fh.flags)
+				// Each small entry's offset takes a single byte, then there's the
+				// checksum.
+				require.Equal(t, int(idx)+4, int(fh.len))
+			} else {
+				require.Zero(t, fh.flags)
+				require.Equal(t, int(idx)*4, int(fh.len))
+			}
+
+			for i := uint64(1); i <= idx; i++ {
+				var le types.LogEntry
+				require.NoError(t, r.GetLog(i, &le))
+				require.Equal(t, fmt.Sprintf("entry %d", i), string(le.Data))
+			}
+			var le types.LogEntry
+			require.ErrorIs(t, r.GetLog(idx+1, &le), types.ErrNotFound)
+
+			// A damaged index is reported as corruption rather than sending reads
+			// to the wrong place.
+			buf := testFileFor(t, r).getBuf()
+			if delta {
+				buf[seg.IndexStart] ^= 0x1
+			} else {
+				copy(buf[seg.IndexStart:], []byte{0xff, 0xff, 0xff, 0x0f})
+			}
+			r2, err := f.Open(seg)
+			require.NoError(t, err)
+			defer r2.Close()
+			require.ErrorIs(t, r2.GetLog(1, &le), types.ErrCorrupt)
+		})
+	}
+}
+
+func TestReaderSparseIndex(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithIndexInterval(4))
+
+	seg := testSegment(1)
+	seg.Features = FeatureSparse
+	seg.SizeLimit = 4 * 1024 * 1024
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Include a streamed entry so that there are chunk frames to skip over.
+	big := bytes.Repeat([]byte("x"), streamChunkSize+10)
+	for idx := uint64(1); idx <= 20; idx++ {
+		if idx == 11 {
+			err = w.(types.SegmentStreamAppender).AppendFrom(types.LogEntry{Index: idx}, bytes.NewReader(big), int64(len(big)))
+		} else {
+			err = w.Append([]types.LogEntry{{Index: idx, Data: []byte(fmt.Sprintf("entry %d", idx))}})
+		}
+		require.NoError(t, err)
+	}
+	require.Len(t, w.(*Writer).getOffsets(), 5)
+
+	check := func(r types.SegmentReader) {
+		t.Helper()
+		for idx := uint64(1); idx <= 20; idx++ {
+			var le types.LogEntry
+			require.NoError(t, r.GetLog(idx, &le))
+			if idx == 11 {
+				require.True(t, bytes.Equal(big, le.Data), "streamed entry data doesn't match")
+			} else {
+				require.Equal(t, fmt.Sprintf("entry %d", idx), string(le.Data))
+			}
+		}
+		var le types.LogEntry
+		require.ErrorIs(t, r.GetLog(21, &le), types.ErrNotFound)
+	}
+	check(w)
+
+	// A recovered tail is indexed sparsely too.
+	rw, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, 20, int(rw.LastIndex()))
+	require.Len(t, rw.(*Writer).getOffsets(), 5)
+	check(rw)
+
+	indexStart, err := w.(types.SegmentSealer).Seal()
+	require.NoError(t, err)
+	seg.IndexStart = indexStart
+	seg.MaxIndex = 20
+	seg.SealTime = time.Now()
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	defer r.Close()
+	fh, err := r.(*Reader).readFrameHeaderAt(int64(indexStart) - frameHeaderLen)
+	require.NoError(t, err)
+	require.Equal(t, indexFlagDelta|indexFlagSparse|indexFlagCRC, fh.flags)
+	check(r)
+	require.NoError(t, r.(types.SegmentVerifier).Verify())
+
+	// Without FeatureSparse the interval doesn't apply.
+	seg2 := testSegment(1)
+	w2, err := f.Create(seg2)
+	require.NoError(t, err)
+	defer w2.Close()
+	require.NoError(t, w2.Append([]types.LogEntry{{Index: 1}, {Index: 2}}))
+	require.Len(t, w2.(*Writer).getOffsets(), 2)
+}
+
+func TestReaderTerms(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	seg0 := testSegment(1)
+	w, err := f.Create(seg0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	termFor := func(idx uint64) uint64 {
+		if idx < 10 {
+			return 0
+		}
+		return idx / 10
+	}
+
+	// Append until the segment seals, recovering the tail part way through to
+	// make sure terms survive recovery too.
+	idx := uint64(1)
+	for {
+		e := types.LogEntry{Index: idx, Term: termFor(idx), Data: []byte(fmt.Sprintf("%05d", idx))}
+		require.NoError(t, w.Append([]types.LogEntry{e}))
+		idx++
+
+		if idx == 25 {
+			w, err = f.RecoverTail(seg0)
+			require.NoError(t, err)
+		}
+
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			seg0.IndexStart = indexStart
+			break
+		}
+	}
+	last := w.LastIndex()
+	require.Greater(t, int(last), 30)
+
+	wantRuns := []types.TermRun{{Term: 0, FirstIndex: 1}}
+	for i := uint64(10); i <= last; i += 10 {
+		wantRuns = append(wantRuns, types.TermRun{Term: i / 10, FirstIndex: i})
+	}
+
+	runs, err := w.TermRuns()
+	require.NoError(t, err)
+	require.Equal(t, wantRuns, runs)
+
+	seg0.MaxIndex = last
+	seg0.SealTime = time.Now()
+	r, err := f.Open(seg0)
+	require.NoError(t, err)
+	defer r.Close()
+
+	runs, err = r.TermRuns()
+	require.NoError(t, err)
+	require.Equal(t, wantRuns, runs)
+
+	for i := uint64(1); i <= last; i++ {
+		var le types.LogEntry
+		require.NoError(t, r.GetLog(i, &le))
+		require.Equal(t, int(termFor(i)), int(le.Term))
+		require.Equal(t, fmt.Sprintf("%05d", i), string(le.Data))
+	}
+}
+
+func TestReaderNoTerms(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	seg0 := testSegment(1)
+	w, err := f.Create(seg0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	for idx := uint64(1); ; idx++ {
+		require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Data: []byte("no term")}}))
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			seg0.IndexStart = indexStart
+			seg0.MaxIndex = idx
+			break
+		}
+	}
+	seg0.SealTime = time.Now()
+
+	r, err := f.Open(seg0)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// Segments without any terms don't have a terms frame at all.
+	runs, err := r.TermRuns()
+	require.NoError(t, err)
+	require.Empty(t, runs)
+}
+
+func TestReaderMeta(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	seg0 := testSegment(1)
+	w, err := f.Create(seg0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	entryFor := func(idx uint64) types.LogEntry {
+		e := types.LogEntry{Index: idx, Data: []byte(fmt.Sprintf("%05d", idx))}
+		switch idx % 4 {
+		case 1:
+			// No metadata at all
+		case 2:
+			e.Type = uint8(idx)
+		case 3:
+			e.Meta = []byte(strings.Repeat("M", int(idx)))
+		default:
+			e.Term = idx
+			e.Type = uint8(idx)
+			e.Meta = []byte(strings.Repeat("m", MaxEntryMetaSize))
+		}
+		return e
+	}
+
+	err = w.Append([]types.LogEntry{{Index: 1, Meta: make([]byte, MaxEntryMetaSize+1)}})
+	require.ErrorIs(t, err, ErrMetaTooBig)
+
+	var last uint64
+	start := time.Now()
+	for idx := uint64(1); ; idx++ {
+		require.NoError(t, w.Append([]types.LogEntry{entryFor(idx)}))
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			seg0.IndexStart = indexStart
+			last = idx
+			break
+		}
+	}
+	seg0.MaxIndex = last
+	seg0.SealTime = time.Now()
+
+	r, err := f.Open(seg0)
+	require.NoError(t, err)
+	defer r.Close()
+
+	for _, sr := range []types.SegmentReader{w, r} {
+		for idx := uint64(1); idx <= last; idx++ {
+			want := entryFor(idx)
+
+			var le types.LogEntry
+			require.NoError(t, sr.GetLog(idx, &le))
+			require.Equal(t, want.Term, le.Term)
+			require.Equal(t, want.Type, le.Type)
+			require.Equal(t, want.Meta, le.Meta)
+			require.Equal(t, want.Data, le.Data)
+			if want.AppendedAt.IsZero() {
+				// Stamped by the writer at append time.
+				require.False(t, le.AppendedAt.Before(start))
+			} else {
+				require.True(t, want.AppendedAt.Equal(le.AppendedAt))
+			}
+
+			le = types.LogEntry{Data: []byte("untouched")}
+			require.NoError(t, sr.GetLogMeta(idx, &le))
+			require.Equal(t, want.Term, le.Term)
+			require.Equal(t, want.Type, le.Type)
+			require.Equal(t, want.Meta, le.Meta)
+			require.False(t, le.AppendedAt.IsZero())
+			require.Equal(t, "untouched", string(le.Data))
+		}
+	}
+}
+
+func TestReaderVerifyOnRead(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		t.Run(fmt.Sprintf("verify=%v", verify), func(t *testing.T) {
+			vfs := newTestVFS()
+			f := NewFiler("test", vfs)
+			if verify {
+				f = NewFiler("test", vfs, WithVerifyOnRead())
+			}
+
+			seg := testSegment(1)
+			w, err := f.Create(seg)
+			require.NoError(t, err)
+			defer w.Close()
+
+			entries := []types.LogEntry{
+				{Index: 1, Term: 1, Data: []byte("one")},
+				{Index: 2, Term: 1, Type: 3, Meta: []byte("meta"), Data: []byte("two")},
+				{Index: 3, Term: 1, Data: []byte("three")},
+			}
+			require.NoError(t, w.Append(entries))
+
+			var le types.LogEntry
+			for _, e := range entries {
+				require.NoError(t, w.GetLog(e.Index, &le))
+				require.Equal(t, e.Data, le.Data)
+				require.Equal(t, e.Meta, le.Meta)
+			}
+
+			require.NoError(t, w.(*Writer).Verify())
+
+			// Flip a bit in the data of entry 2 without touching its header.
+			offset, err := w.(*Writer).OffsetForFrame(2)
+			require.NoError(t, err)
+			file := testFileFor(t, w)
+			buf := file.getBuf()
+			frameLen := int(binary.LittleEndian.Uint32(buf[offset+4:]))
+			dataOff := int(offset) + frameHeaderLen + frameLen - len(entries[1].Data)
+			buf[dataOff] ^= 0x1
+
+			// Verify always checks regardless of the option.
+			require.ErrorIs(t, w.(*Writer).Verify(), types.ErrCorrupt)
+
+			err = w.GetLog(2, &le)
+			errMeta := w.GetLogMeta(2, &le)
+			if !verify {
+				require.NoError(t, err)
+				require.NoError(t, errMeta)
+				return
+			}
+			require.ErrorIs(t, err, types.ErrCorrupt)
+			require.ErrorContains(t, err, "index 2")
+			require.ErrorContains(t, err, FileName(seg))
+			require.ErrorContains(t, err, fmt.Sprintf("offset %d", offset))
+			require.ErrorIs(t, errMeta, types.ErrCorrupt)
+
+			// The others are still fine.
+			require.NoError(t, w.GetLog(1, &le))
+			require.NoError(t, w.GetLog(3, &le))
+			require.Equal(t, "three", string(le.Data))
+		})
+	}
+}
+
+func TestReaderChunkedEntries(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes entries larger than MaxEntrySize")
+	}
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithVerifyOnRead())
+
+	seg := testSegment(1)
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Big enough to need an entry frame and two chunks.
+	big := make([]byte, 2*MaxEntrySize+100)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	entries := []types.LogEntry{
+		{Index: 1, Term: 1, Data: []byte("one")},
+		{Index: 2, Term: 2, Type: 3, Meta: []byte("meta"), Data: big},
+		{Index: 3, Term: 2, Data: []byte("three")},
+	}
+	require.NoError(t, w.Append(entries))
+	sealed, indexStart, err := w.Sealed()
+	require.NoError(t, err)
+	require.True(t, sealed)
+
+	check := func(r types.SegmentReader) {
+		t.Helper()
+		var le types.LogEntry
+		require.NoError(t, r.GetLog(2, &le))
+		require.True(t, bytes.Equal(big, le.Data), "chunked entry data doesn't match")
+		require.Equal(t, 2, int(le.Term))
+		require.Equal(t, "meta", string(le.Meta))
+		require.NoError(t, r.GetLog(3, &le))
+		require.Equal(t, "three", string(le.Data))
+		require.NoError(t, r.(types.SegmentVerifier).Verify())
+
+		rd, size, err := r.(types.SegmentDataReader).GetLogReader(2)
+		require.NoError(t, err)
+		require.Equal(t, len(big), int(size))
+		got, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(big, got), "streamed chunked entry data doesn't match")
+	}
+	check(w)
+
+	seg.IndexStart = indexStart
+	seg.MaxIndex = 3
+	seg.SealTime = time.Now()
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	check(r)
+	runs, err := r.TermRuns()
+	require.NoError(t, err)
+	require.Equal(t, []types.TermRun{{Term: 1, FirstIndex: 1}, {Term: 2, FirstIndex: 2}}, runs)
+
+	// Chunks aren't mistaken for entries when the segment is recovered or
+	// dumped.
+	rw, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, 3, int(rw.LastIndex()))
+	check(rw)
+
+	var dumped []types.LogEntry
+	err = f.DumpSegment(seg.BaseIndex, seg.ID, 0, 0, func(_ types.SegmentInfo, e types.LogEntry) (bool, error) {
+		e.Data = append([]byte(nil), e.Data...)
+		dumped = append(dumped, e)
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, dumped, 3)
+	require.True(t, bytes.Equal(big, dumped[1].Data), "dumped chunked entry data doesn't match")
+
+	// The CRC covers the chunks too.
+	offset, err := w.(*Writer).OffsetForFrame(3)
+	require.NoError(t, err)
+	testFileFor(t, w).getBuf()[offset-frameHeaderLen] ^= 0x1
+	var le types.LogEntry
+	require.ErrorIs(t, w.GetLog(2, &le), types.ErrCorrupt)
+	rd, _, err := w.(types.SegmentDataReader).GetLogReader(2)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rd)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+}
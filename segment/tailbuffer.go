@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"sync"
+)
+
+// tailBuffer is a fixed size ring holding the most recently written bytes of
+// a tail segment file so that reads of recent entries don't need to touch the
+// file at all. It always covers a contiguous range of the file ending at the
+// last byte written.
+type tailBuffer struct {
+	mu     sync.RWMutex
+	buf    []byte
+	end    int64 // file offset just past the last byte written
+	filled int   // number of bytes before end that are in buf
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{buf: make([]byte, size)}
+}
+
+// write records that p was written to the file at off. Writes are expected to
+// be contiguous; if they aren't the buffer starts again from off.
+func (b *tailBuffer) write(p []byte, off int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf == nil {
+		return
+	}
+	if off != b.end {
+		b.end = off
+		b.filled = 0
+	}
+	size := len(b.buf)
+	if len(p) > size {
+		// Only the end of p will fit.
+		off += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+	pos := int(off % int64(size))
+	n := copy(b.buf[pos:], p)
+	copy(b.buf, p[n:])
+
+	b.end = off + int64(len(p))
+	b.filled += len(p)
+	if b.filled > size {
+		b.filled = size
+	}
+}
+
+// readAt copies the bytes at off into p if off is within the buffer. It
+// returns false if the read must go to the file instead. A read that extends
+// past the last byte written is short, in which case it's up to the caller to
+// treat it as reaching EOF.
+func (b *tailBuffer) readAt(p []byte, off int64) (int, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if off < b.end-int64(b.filled) || off >= b.end {
+		return 0, false
+	}
+	want := len(p)
+	if avail := b.end - off; int64(want) > avail {
+		want = int(avail)
+	}
+	size := len(b.buf)
+	pos := int(off % int64(size))
+	n := copy(p[:want], b.buf[pos:])
+	n += copy(p[n:want], b.buf)
+	return n, true
+}
+
+// release frees the buffer once the segment is sealed and reads no longer
+// need it.
+func (b *tailBuffer) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = nil
+	b.end = 0
+	b.filled = 0
+}
@@ -0,0 +1,99 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTailBufferRing(t *testing.T) {
+	b := newTailBuffer(16)
+
+	read := func(off int64, n int) (string, bool) {
+		p := make([]byte, n)
+		got, ok := b.readAt(p, off)
+		return string(p[:got]), ok
+	}
+
+	b.write([]byte("0123456789"), 100)
+	got, ok := read(102, 4)
+	require.True(t, ok)
+	require.Equal(t, "2345", got)
+
+	// Wraps around the end of the ring and pushes out the oldest bytes.
+	b.write([]byte("abcdefghij"), 110)
+	_, ok = read(103, 1)
+	require.False(t, ok)
+	got, ok = read(104, 16)
+	require.True(t, ok)
+	require.Equal(t, "456789abcdefghij", got)
+
+	// Reads past the end are short.
+	got, ok = read(118, 8)
+	require.True(t, ok)
+	require.Equal(t, "ij", got)
+	_, ok = read(120, 1)
+	require.False(t, ok)
+
+	// A write bigger than the ring keeps only its end.
+	b.write([]byte(strings.Repeat("x", 10)+"0123456789ABCDEF"), 120)
+	_, ok = read(129, 1)
+	require.False(t, ok)
+	got, ok = read(130, 16)
+	require.True(t, ok)
+	require.Equal(t, "0123456789ABCDEF", got)
+
+	// A non-contiguous write starts again.
+	b.write([]byte("zz"), 500)
+	_, ok = read(140, 1)
+	require.False(t, ok)
+	got, ok = read(500, 2)
+	require.True(t, ok)
+	require.Equal(t, "zz", got)
+
+	b.release()
+	_, ok = read(500, 2)
+	require.False(t, ok)
+}
+
+func TestTailBufferReader(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithTailBuffer(4096))
+
+	seg0 := testSegment(1)
+	seg0.SizeLimit = 64 * 1024
+	w, err := f.Create(seg0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	valFor := func(idx uint64) string {
+		return fmt.Sprintf("%05d:%s", idx, strings.Repeat("v", 100))
+	}
+	for idx := uint64(1); idx <= 200; idx++ {
+		require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Term: 1, Data: []byte(valFor(idx))}}))
+	}
+
+	// Replace the file contents with zeros. Anything still read correctly must
+	// have come from memory.
+	wf := testFileFor(t, w)
+	buf := wf.getBuf()
+	wf.buf.Store(make([]byte, len(buf), cap(buf)))
+
+	var le types.LogEntry
+	for idx := uint64(180); idx <= 200; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, valFor(idx), string(le.Data))
+		require.Equal(t, 1, int(le.Term))
+	}
+
+	// Old entries aren't in the buffer so they go to the (now blank) file.
+	if err := w.GetLog(1, &le); err == nil {
+		require.NotEqual(t, valFor(1), string(le.Data))
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// trailerLen is the length of a trailer frame's payload. See writeTrailerFrame.
+const trailerLen = 64
+
+// Trailer summarises a sealed segment. It's written when the segment is sealed
+// so it describes the segment as it was then: entries later removed by
+// truncating the head of the log are still counted.
+type Trailer struct {
+	// Entries is the number of entries in the segment. It's always
+	// MaxIndex-MinIndex+1.
+	Entries uint64
+
+	// MinIndex and MaxIndex are the first and last index in the segment.
+	MinIndex uint64
+	MaxIndex uint64
+
+	// MinAppendedAt and MaxAppendedAt are the earliest and latest append time
+	// of any entry. They are zero if no entry has one.
+	MinAppendedAt time.Time
+	MaxAppendedAt time.Time
+
+	// DataBytes is the total length of the entries' Data.
+	DataBytes uint64
+
+	// StoredBytes is how many bytes the entries' Data takes in the file. It's
+	// less than DataBytes if any entries are compressed.
+	StoredBytes uint64
+
+	// Checksum is a CRC32 (Castagnoli) of everything in the file before the
+	// trailer frame.
+	Checksum uint32
+}
+
+// segmentStats are the running totals a Writer keeps for the trailer.
+type segmentStats struct {
+	minAppendedAt, maxAppendedAt int64
+	dataBytes, storedBytes       uint64
+}
+
+// add records an entry appended at appendedAt, in Unix nanoseconds or zero if
+// it has no append time, with dataLen bytes of data that take storedLen bytes
+// in the file.
+func (s *segmentStats) add(appendedAt int64, dataLen, storedLen uint64) {
+	if appendedAt != 0 {
+		if s.minAppendedAt == 0 || appendedAt < s.minAppendedAt {
+			s.minAppendedAt = appendedAt
+		}
+		if appendedAt > s.maxAppendedAt {
+			s.maxAppendedAt = appendedAt
+		}
+	}
+	s.dataBytes += dataLen
+	s.storedBytes += storedLen
+}
+
+// unixNano returns t in Unix nanoseconds or zero if t is zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano.
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+/*
+	Trailer frame payload
+
+	0      1      2      3      4      5      6      7      8
+	+------+------+------+------+------+------+------+------+
+	| Entries                                               |
+	+------+------+------+------+------+------+------+------+
+	| MinIndex                                              |
+	+------+------+------+------+------+------+------+------+
+	| MaxIndex                                              |
+	+------+------+------+------+------+------+------+------+
+	| MinAppendedAt                                         |
+	+------+------+------+------+------+------+------+------+
+	| MaxAppendedAt                                         |
+	+------+------+------+------+------+------+------+------+
+	| DataBytes                                             |
+	+------+------+------+------+------+------+------+------+
+	| StoredBytes                                           |
+	+------+------+------+------+------+------+------+------+
+	| Checksum                  | Reserved                  |
+	+------+------+------+------+------+------+------+------+
+*/
+
+// writeTrailerFrame writes a trailer frame for t into buf.
+func writeTrailerFrame(buf []byte, t Trailer) error {
+	if len(buf) < encodedFrameSize(trailerLen) {
+		return io.ErrShortBuffer
+	}
+	fh := frameHeader{
+		typ: FrameTrailer,
+		len: trailerLen,
+	}
+	if err := writeFrameHeader(buf, fh); err != nil {
+		return err
+	}
+	p := buf[frameHeaderLen:]
+	binary.LittleEndian.PutUint64(p[0:], t.Entries)
+	binary.LittleEndian.PutUint64(p[8:], t.MinIndex)
+	binary.LittleEndian.PutUint64(p[16:], t.MaxIndex)
+	binary.LittleEndian.PutUint64(p[24:], uint64(unixNano(t.MinAppendedAt)))
+	binary.LittleEndian.PutUint64(p[32:], uint64(unixNano(t.MaxAppendedAt)))
+	binary.LittleEndian.PutUint64(p[40:], t.DataBytes)
+	binary.LittleEndian.PutUint64(p[48:], t.StoredBytes)
+	binary.LittleEndian.PutUint32(p[56:], t.Checksum)
+	binary.LittleEndian.PutUint32(p[60:], 0)
+	return nil
+}
+
+// readTrailer decodes the payload of a trailer frame.
+func readTrailer(buf []byte) (*Trailer, error) {
+	if len(buf) != trailerLen {
+		return nil, fmt.Errorf("%w: trailer frame has length %d, expected %d", types.ErrCorrupt, len(buf), trailerLen)
+	}
+	return &Trailer{
+		Entries:       binary.LittleEndian.Uint64(buf[0:]),
+		MinIndex:      binary.LittleEndian.Uint64(buf[8:]),
+		MaxIndex:      binary.LittleEndian.Uint64(buf[16:]),
+		MinAppendedAt: fromUnixNano(int64(binary.LittleEndian.Uint64(buf[24:]))),
+		MaxAppendedAt: fromUnixNano(int64(binary.LittleEndian.Uint64(buf[32:]))),
+		DataBytes:     binary.LittleEndian.Uint64(buf[40:]),
+		StoredBytes:   binary.LittleEndian.Uint64(buf[48:]),
+		Checksum:      binary.LittleEndian.Uint32(buf[56:]),
+	}, nil
+}
+
+// Trailer returns the trailer of a sealed segment, or nil if it was sealed by
+// a version that didn't write one or isn't sealed yet.
+func (r *Reader) Trailer() (*Trailer, error) {
+	if r.tail != nil || r.info.IndexStart == 0 {
+		return nil, nil
+	}
+	r.trailerOnce.Do(func() {
+		r.trailer, r.trailerOffset, r.trailerErr = r.loadTrailer(r.info.IndexStart)
+	})
+	return r.trailer, r.trailerErr
+}
+
+// loadTrailer reads the trailer of a segment sealed with its index at
+// indexStart and returns it along with the file offset of its frame.
+func (r *Reader) loadTrailer(indexStart uint64) (*Trailer, int64, error) {
+	fh, offset, ok, err := r.findSealFrame(indexStart, FrameTrailer)
+	if err != nil || !ok {
+		return nil, 0, err
+	}
+	if fh.len != trailerLen {
+		return nil, 0, fmt.Errorf("%w: trailer frame has length %d, expected %d", types.ErrCorrupt, fh.len, trailerLen)
+	}
+	var buf [trailerLen]byte
+	if err := r.readFull(buf[:], offset+frameHeaderLen); err != nil {
+		return nil, 0, fmt.Errorf("failed to read segment trailer: %w", err)
+	}
+	t, err := readTrailer(buf[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return t, offset, nil
+}
+
+// checkTrailer checks that t agrees with the segment's metadata.
+func (r *Reader) checkTrailer(t *Trailer) error {
+	if t.MinIndex != r.info.BaseIndex || t.MaxIndex < t.MinIndex || t.Entries != t.MaxIndex-t.MinIndex+1 {
+		return fmt.Errorf("%w: segment %s trailer has %d entries from %d to %d but BaseIndex is %d",
+			types.ErrCorrupt, FileName(r.info), t.Entries, t.MinIndex, t.MaxIndex, r.info.BaseIndex)
+	}
+	if r.info.MaxIndex != 0 && t.MaxIndex != r.info.MaxIndex {
+		return fmt.Errorf("%w: segment %s trailer MaxIndex %d doesn't match metadata %d",
+			types.ErrCorrupt, FileName(r.info), t.MaxIndex, r.info.MaxIndex)
+	}
+	return nil
+}
+
+// findSealFrame looks for a frame of type typ among those written after the
+// index frame when the segment was sealed: the terms, trailer and HMAC frames
+// in that order, each of them optional, and then the commit frame. It returns
+// the header and offset of the frame and whether it was found.
+func (r *Reader) findSealFrame(indexStart uint64, typ uint8) (frameHeader, int64, bool, error) {
+	if indexStart == 0 {
+		return frameHeader{}, 0, false, fmt.Errorf("sealed segment has no index block")
+	}
+	offset := int64(indexStart) - frameHeaderLen
+	fh, err := r.readFrameHeaderAt(offset)
+	if err != nil {
+		return fh, 0, false, err
+	}
+	if fh.typ != FrameIndex {
+		return fh, 0, false, fmt.Errorf("%w: expected index frame at offset %d, found type %d",
+			types.ErrCorrupt, offset, fh.typ)
+	}
+	for {
+		offset += int64(encodedFrameSize(int(fh.len)))
+		if fh, err = r.readFrameHeaderAt(offset); err != nil {
+			return fh, 0, false, err
+		}
+		if fh.typ == typ {
+			return fh, offset, true, nil
+		}
+		if fh.typ != FrameTerms && fh.typ != FrameTrailer && fh.typ != FrameHMAC {
+			return fh, 0, false, nil
+		}
+	}
+}
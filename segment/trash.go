@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// TrashDir is the subdirectory of each dir segments are in that WithTrash
+// moves the files of deleted segments to.
+const TrashDir = "trash"
+
+// WithTrash is an option that makes Delete move a segment's files, along with
+// its double-write file and dictionary if it has them, into the TrashDir
+// subdirectory of the dir they're in instead of deleting them. Each file's
+// name there is prefixed with the time it was deleted in Unix nanoseconds and
+// a dash, so a segment can be recovered by moving its files back and removing
+// the prefix, or read where it is with tools like waldump. PurgeTrash deletes
+// them for good. The VFS must implement types.FileMover.
+func WithTrash() filerOpt {
+	return func(f *Filer) {
+		f.opts.trash = true
+	}
+}
+
+// trashName returns the name the file name has in the trash if it was deleted
+// at t.
+func trashName(name string, t time.Time) string {
+	return fmt.Sprintf("%020d-%s", t.UnixNano(), name)
+}
+
+// parseTrashName returns the time the file with name in the trash was deleted.
+func parseTrashName(name string) (time.Time, bool) {
+	prefix, _, ok := strings.Cut(name, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// trashFile moves the file name in dir to the trash. It returns an error
+// wrapping os.ErrNotExist if there's no such file.
+func (f *Filer) trashFile(dir, name string, now time.Time) error {
+	mover, ok := f.vfs.(types.FileMover)
+	if !ok {
+		return fmt.Errorf("can't move %s to the trash since the VFS can't move files", name)
+	}
+	return mover.MoveFile(dir, name, filepath.Join(dir, TrashDir), trashName(name, now))
+}
+
+// PurgeTrash implements types.SegmentTrash.
+func (f *Filer) PurgeTrash(before time.Time) (int, error) {
+	n := 0
+	for _, dir := range f.dirs() {
+		trash := filepath.Join(dir, TrashDir)
+		names, err := f.vfs.ListDir(trash)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		for _, name := range names {
+			deleted, ok := parseTrashName(name)
+			if !ok || !deleted.Before(before) {
+				continue
+			}
+			if err := f.vfs.Delete(trash, name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// CodecUpstreamBinaryV1 is the SegmentInfo.Codec of segments created by
+// upstream hashicorp/raft-wal using its default BinaryCodec. The file and frame
+// formats are the same as ours but each entry frame's payload is a whole
+// raft.Log encoded by that codec rather than just its Data, and there are no
+// entry flags. Our own frames always have at least frameFlagCRC set so new
+// entries appended to a recovered upstream tail segment can still be told
+// apart.
+const CodecUpstreamBinaryV1 uint64 = 1
+
+// checkCodec returns an error if info is for a segment encoded with a codec
+// we can't read, such as a custom codec used with upstream hashicorp/raft-wal.
+func checkCodec(info types.SegmentInfo) error {
+	if info.Codec != 0 && info.Codec != CodecUpstreamBinaryV1 {
+		return fmt.Errorf("segment %s uses unsupported codec %d", FileName(info), info.Codec)
+	}
+	return nil
+}
+
+// isUpstreamFrame reports whether an entry frame in the segment described by
+// info was written by upstream hashicorp/raft-wal.
+func isUpstreamFrame(info types.SegmentInfo, fh frameHeader) bool {
+	return info.Codec == CodecUpstreamBinaryV1 && fh.flags == 0
+}
+
+// decodeUpstreamEntry decodes the payload of an upstream entry frame into le.
+// The payload is the uvarint encoded Index, Term and Type, then Data and
+// Extensions each prefixed with their uvarint length and finally AppendedAt as
+// encoded by time.Time's MarshalBinary. Extensions becomes le.Meta. Data is
+// only set if withData is true.
+func decodeUpstreamEntry(payload []byte, le *types.LogEntry, withData bool) error {
+	d := upstreamDecoder{buf: payload}
+	d.uvarint() // Index, which the caller already knows.
+	le.Term = d.uvarint()
+	typ := d.uvarint()
+	data := d.bytes()
+	meta := d.bytes()
+	if d.err != nil {
+		return fmt.Errorf("%w: failed to decode upstream entry: %s", types.ErrCorrupt, d.err)
+	}
+	if typ > 0xff {
+		return fmt.Errorf("%w: upstream entry type %d is out of range", types.ErrCorrupt, typ)
+	}
+	if len(meta) > MaxEntryMetaSize {
+		return fmt.Errorf("%w: upstream entry extensions are %d bytes", ErrMetaTooBig, len(meta))
+	}
+	le.Type = uint8(typ)
+	le.Meta = meta
+	le.AppendedAt = time.Time{}
+	if len(d.buf) > 0 {
+		if err := le.AppendedAt.UnmarshalBinary(d.buf); err != nil {
+			return fmt.Errorf("%w: failed to decode upstream entry append time: %s", types.ErrCorrupt, err)
+		}
+	}
+	if withData {
+		le.Data = data
+	}
+	return nil
+}
+
+type upstreamDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *upstreamDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *upstreamDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	bs := make([]byte, n)
+	copy(bs, d.buf[:n])
+	d.buf = d.buf[n:]
+	return bs
+}
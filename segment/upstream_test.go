@@ -0,0 +1,210 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeUpstreamEntry encodes le the way upstream hashicorp/raft-wal's
+// BinaryCodec encodes a raft.Log.
+func encodeUpstreamEntry(t *testing.T, le types.LogEntry) []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, le.Index)
+	buf = binary.AppendUvarint(buf, le.Term)
+	buf = binary.AppendUvarint(buf, uint64(le.Type))
+	buf = binary.AppendUvarint(buf, uint64(len(le.Data)))
+	buf = append(buf, le.Data...)
+	buf = binary.AppendUvarint(buf, uint64(len(le.Meta)))
+	buf = append(buf, le.Meta...)
+	ts, err := le.AppendedAt.MarshalBinary()
+	require.NoError(t, err)
+	return append(buf, ts...)
+}
+
+// writeUpstreamSegment writes an unsealed segment file the way upstream would,
+// committing each batch.
+func writeUpstreamSegment(t *testing.T, vfs *testVFS, info types.SegmentInfo, batches ...[]types.LogEntry) {
+	wf, err := vfs.Create("test", FileName(info), 0)
+	require.NoError(t, err)
+	buf := make([]byte, fileHeaderLen)
+	require.NoError(t, writeFileHeader(buf, info))
+	for _, batch := range batches {
+		for _, le := range batch {
+			payload := encodeUpstreamEntry(t, le)
+			frame := make([]byte, encodedFrameSize(len(payload)))
+			require.NoError(t, writeFrame(frame, frameHeader{typ: FrameEntry, len: uint32(len(payload))}, payload))
+			buf = append(buf, frame...)
+		}
+		// Each commit covers everything since the previous commit frame's header
+		// or the start of the file.
+		start := 0
+		if last := lastCommitEnd(buf); last > 0 {
+			start = last
+		}
+		commit := make([]byte, frameHeaderLen)
+		crc := crc32.Checksum(buf[start:], castagnoliTable)
+		require.NoError(t, writeFrameHeader(commit, frameHeader{typ: FrameCommit, crc: crc}))
+		buf = append(buf, commit...)
+	}
+	_, err = wf.WriteAt(buf, 0)
+	require.NoError(t, err)
+	require.NoError(t, wf.Close())
+}
+
+// lastCommitEnd returns the offset just after the last commit frame header in
+// buf or zero if there isn't one.
+func lastCommitEnd(buf []byte) int {
+	end := 0
+	for off := fileHeaderLen; off+frameHeaderLen <= len(buf); {
+		fh, err := readFrameHeader(buf[off:])
+		if err != nil || fh.typ == FrameInvalid {
+			break
+		}
+		if fh.typ == FrameCommit {
+			end = off + frameHeaderLen
+			off += frameHeaderLen
+			continue
+		}
+		off += encodedFrameSize(int(fh.len))
+	}
+	return end
+}
+
+func TestUpstreamSegment(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	appended := time.Now().Add(-time.Hour).Round(0)
+	upstreamEntry := func(idx uint64) types.LogEntry {
+		return types.LogEntry{
+			Index:      idx,
+			Term:       idx/4 + 1,
+			Type:       uint8(idx % 3),
+			Meta:       []byte(fmt.Sprintf("ext-%d", idx)),
+			AppendedAt: appended,
+			Data:       []byte(fmt.Sprintf("upstream %d", idx)),
+		}
+	}
+	var first, second []types.LogEntry
+	for idx := uint64(1); idx <= 10; idx++ {
+		if idx <= 6 {
+			first = append(first, upstreamEntry(idx))
+		} else {
+			second = append(second, upstreamEntry(idx))
+		}
+	}
+
+	seg := testSegment(1)
+	seg.Codec = CodecUpstreamBinaryV1
+	writeUpstreamSegment(t, vfs, seg, first, second)
+
+	// Recover it as our tail and read the upstream entries.
+	w, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, 10, int(w.LastIndex()))
+	check := func(r types.SegmentReader, idx uint64) {
+		t.Helper()
+		want := upstreamEntry(idx)
+		var le types.LogEntry
+		require.NoError(t, r.GetLog(idx, &le))
+		require.Equal(t, want.Data, le.Data)
+		require.Equal(t, want.Term, le.Term)
+		require.Equal(t, want.Type, le.Type)
+		require.Equal(t, want.Meta, le.Meta)
+		require.True(t, want.AppendedAt.Equal(le.AppendedAt))
+
+		var meta types.LogEntry
+		require.NoError(t, r.GetLogMeta(idx, &meta))
+		require.Equal(t, want.Term, meta.Term)
+		require.Nil(t, meta.Data)
+	}
+	for idx := uint64(1); idx <= 10; idx++ {
+		check(w, idx)
+	}
+	runs, err := w.TermRuns()
+	require.NoError(t, err)
+	require.Equal(t, []types.TermRun{{Term: 1, FirstIndex: 1}, {Term: 2, FirstIndex: 4}, {Term: 3, FirstIndex: 8}}, runs)
+
+	// Append our own entries after them until the segment is sealed.
+	var idx uint64
+	for idx = 11; ; idx++ {
+		require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Term: 5, Data: []byte(fmt.Sprintf("ours %d", idx))}}))
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			seg.IndexStart = indexStart
+			seg.MaxIndex = idx
+			break
+		}
+	}
+	require.NoError(t, w.Close())
+
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	defer r.Close()
+	for i := uint64(1); i <= 10; i++ {
+		check(r, i)
+	}
+	var le types.LogEntry
+	require.NoError(t, r.GetLog(idx, &le))
+	require.Equal(t, fmt.Sprintf("ours %d", idx), string(le.Data))
+	require.Equal(t, 5, int(le.Term))
+	runs, err = r.TermRuns()
+	require.NoError(t, err)
+	require.Equal(t, types.TermRun{Term: 5, FirstIndex: 11}, runs[len(runs)-1])
+	require.NoError(t, r.(types.SegmentVerifier).Verify())
+}
+
+func TestUpstreamSealedSegmentTerms(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	var es []types.LogEntry
+	for idx := uint64(1); idx <= 5; idx++ {
+		es = append(es, types.LogEntry{Index: idx, Term: idx / 3, Data: []byte("x")})
+	}
+	seg := testSegment(1)
+	seg.Codec = CodecUpstreamBinaryV1
+	writeUpstreamSegment(t, vfs, seg, es)
+
+	// Seal it the way upstream does, with an index frame but no terms frame.
+	file := vfs.files[FileName(seg)]
+	buf := file.getBuf()
+	end := lastCommitEnd(buf)
+	index := make([]byte, 4*len(es))
+	off := fileHeaderLen
+	for i := range es {
+		binary.LittleEndian.PutUint32(index[4*i:], uint32(off))
+		fh, err := readFrameHeader(buf[off:])
+		require.NoError(t, err)
+		off += encodedFrameSize(int(fh.len))
+	}
+	frame := make([]byte, encodedFrameSize(len(index))+frameHeaderLen)
+	require.NoError(t, writeFrame(frame, frameHeader{typ: FrameIndex, len: uint32(len(index))}, index))
+	require.NoError(t, writeFrameHeader(frame[encodedFrameSize(len(index)):], frameHeader{typ: FrameCommit}))
+	_, err := file.WriteAt(frame, int64(end))
+	require.NoError(t, err)
+	seg.IndexStart = uint64(end + frameHeaderLen)
+	seg.MaxIndex = 5
+
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	defer r.Close()
+	runs, err := r.TermRuns()
+	require.NoError(t, err)
+	require.Equal(t, []types.TermRun{{Term: 0, FirstIndex: 1}, {Term: 1, FirstIndex: 3}}, runs)
+
+	// Custom upstream codecs aren't supported.
+	seg.Codec = 1 << 16
+	_, err = f.Open(seg)
+	require.ErrorContains(t, err, "unsupported codec")
+}
@@ -141,6 +141,21 @@ func (fs *testVFS) OpenWriter(dir string, name string) (types.WritableFile, erro
 	return f, nil
 }
 
+// Rename atomically replaces the file newName, if there is one, with the file
+// oldName.
+func (fs *testVFS) Rename(dir, oldName, newName string) error {
+	if err := fs.setDir(dir); err != nil {
+		return err
+	}
+	f, ok := fs.files[oldName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	fs.files[newName] = f
+	delete(fs.files, oldName)
+	return nil
+}
+
 // testFileFor is a helper for reaching inside our interface types to access
 // the underlying "file".
 func testFileFor(t *testing.T, r types.SegmentReader) *testWritableFile {
@@ -162,6 +177,8 @@ type testWritableFile struct {
 	maxWritten    int
 	lastSyncStart int
 	closed, dirty bool
+	pagesDropped  int
+	writes        int
 }
 
 func newTestWritableFile(size int) *testWritableFile {
@@ -207,6 +224,20 @@ func (f *testWritableFile) Dump() string {
 }
 
 func (f *testWritableFile) WriteAt(p []byte, off int64) (n int, err error) {
+	f.writes++
+	return f.writeAt(p, off)
+}
+
+func (f *testWritableFile) WriteVectorAt(bufs [][]byte, off int64) (int, error) {
+	f.writes++
+	var p []byte
+	for _, b := range bufs {
+		p = append(p, b...)
+	}
+	return f.writeAt(p, off)
+}
+
+func (f *testWritableFile) writeAt(p []byte, off int64) (n int, err error) {
 	if !f.dirty {
 		f.lastSyncStart = int(off)
 	}
@@ -267,6 +298,11 @@ func (f *testWritableFile) Close() error {
 	return nil
 }
 
+func (f *testWritableFile) DropPageCache() error {
+	f.pagesDropped++
+	return nil
+}
+
 func (f *testWritableFile) Sync() error {
 	f.dirty = false
 	return nil
@@ -4,24 +4,44 @@
 package segment
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dreamsxin/wal/types"
 )
 
+// MaxPipelineDepth is the most batches AppendAsync may have written but not yet
+// synced at once. Recovering the tail looks this far back for the last batch
+// that was synced.
+const MaxPipelineDepth = 64
+
 // Writer allows appending logs to a segment file as well as reading them back.
 type Writer struct {
+	// commitIdx and flushedIdx are accessed atomically so they must stay first
+	// to be 64-bit aligned on 32-bit platforms.
+	//
 	// commitIdx is updated after an append batch is fully persisted to disk to
 	// allow readers to read the new value. Note that readers must not read values
 	// larger than this even if they are available in tailIndex as they are not
 	// yet committed to disk!
 	commitIdx uint64
 
+	// flushedIdx is the last index whose commit frame has been written to the
+	// file. The next sync makes everything up to it durable. It's only ahead of
+	// commitIdx while pipelined appends are waiting for their sync.
+	flushedIdx uint64
+
 	// offsets is the index offset. The first element corresponds to the
-	// BaseIndex. It is accessed concurrently by readers and the single writer
+	// BaseIndex. If the index is sparse each element is interval entries after
+	// the one before. It is accessed concurrently by readers and the single writer
 	// without locks! This is race-free via the following invariants:
 	//  - the slice here is never mutated only copied though it may still refer to
 	//    the same backing array.
@@ -36,6 +56,11 @@ type Writer struct {
 	//    the old slice.
 	offsets atomic.Value // []uint32
 
+	// terms records the Term of every entry appended as a list of runs. It
+	// follows the same concurrency rules as offsets: it's only ever appended to
+	// and readers must ignore runs starting after commitIdx.
+	terms atomic.Value // []types.TermRun
+
 	// writer state is accessed only on the (serial) write path so doesn't need
 	// synchronization.
 	writer struct {
@@ -55,45 +80,175 @@ type Writer struct {
 		// indexStart is set when the tail is sealed indicating the file offset at
 		// which the index array was written.
 		indexStart uint64
+
+		// indexLen is the length of the delta encoded index of the entries
+		// appended so far, kept up to date so that Append can cheaply tell
+		// whether the index will still fit.
+		indexLen int
+
+		// numEntries is the number of entries appended. It's the same as
+		// len(offsets) unless the index is sparse.
+		numEntries uint64
+
+		// mac is a running HMAC of everything flushed to the file so far. It's
+		// only used if keys is set and until the segment is sealed.
+		mac      hash.Hash
+		macKeyID uint32
+
+		// fileCRC is a running CRC32 (Castagnoli) of everything flushed to the
+		// file so far. Unlike crc it's never reset. It becomes the trailer's
+		// checksum when the segment is sealed, and once the sealing commit is
+		// flushed, the checksum of the whole file.
+		fileCRC uint32
+
+		// stats are the totals recorded in the trailer for the entries appended
+		// so far.
+		stats segmentStats
+
+		// dwSaved is set once the sector the batch being appended starts in has
+		// been saved to dw.
+		dwSaved bool
+
+		// vec holds the data of frames in the batch that's written straight
+		// from the caller's buffers rather than copied into commitBuf, and
+		// vecLen is its total length. iov is reused to pass the batch to vw.
+		vec    []vecPart
+		vecLen int
+		iov    [][]byte
 	}
 
 	info types.SegmentInfo
 	wf   types.WritableFile
-	r    types.SegmentReader
+	r    *Reader
+
+	// vw is wf if it can write a vector of buffers in one call, otherwise nil.
+	vw types.VectorWriter
+
+	evictSealed bool
+
+	// version is the format version in the file's header, which decides how
+	// the segment is sealed. It's only older than FormatVersion for tails
+	// created by older versions.
+	version uint8
+
+	// interval is how many entries apart those with an entry in offsets are.
+	// It's more than 1 only if the file's header has FeatureSparse and
+	// indexInterval is set. It doesn't change once the Writer is in use.
+	interval      uint64
+	indexInterval int
+
+	// codec compresses new entries. It's only set to compression, the codec
+	// the Filer was created with, if the file's header has FeatureCompression.
+	codec       CompressionCodec
+	compression CompressionCodec
+	policy      CompressionPolicy
+
+	// keys is set if segments are signed with an HMAC when they are sealed.
+	keys types.KeyProvider
+
+	// suite is the cipher suite new entries are encrypted with, CipherNone
+	// unless the file's header has FeatureEncryption, with keys from keyring.
+	suite   uint8
+	keyring *keyring
+
+	// dw is the tail's double-write file if the Filer was created with
+	// WithDoubleWrite. It's closed and deleted once the segment is sealed.
+	dw *doubleWriteFile
+
+	// onSealed is called with the last index once the segment is sealed if
+	// the Filer was created with WithSealedMarkers.
+	onSealed func(maxIndex uint64)
+
+	// syncMu serializes syncs, which pipelined appends make without holding up
+	// the next append. syncErr is the error a failed sync returned. Once one
+	// has failed the file's contents are unknown so every later sync fails too.
+	// syncFailed is set at the same time so appends can check for it without
+	// waiting for a sync in flight.
+	syncMu     sync.Mutex
+	syncErr    error
+	syncFailed uint32
+}
+
+// vecPart is data to be written after commitBuf[:at] and before the rest of
+// commitBuf.
+type vecPart struct {
+	at   int
+	data []byte
 }
 
-func createFile(info types.SegmentInfo, wf types.WritableFile) (*Writer, error) {
-	r, err := openReader(info, wf)
+// minVecLen is the least data a frame must have for it to be written straight
+// from the caller's buffer. Copying less is cheaper than another iovec.
+const minVecLen = 4 * 1024
+
+func createFile(info types.SegmentInfo, wf types.WritableFile, opts fileOpts) (*Writer, error) {
+	r, err := openReader(info, wf, opts)
 	if err != nil {
 		return nil, err
 	}
+	if opts.tailBufferSize > 0 {
+		r.recent = newTailBuffer(opts.tailBufferSize)
+	}
 	w := &Writer{
-		info: info,
-		wf:   wf,
-		r:    r,
+		info:          info,
+		wf:            wf,
+		r:             r,
+		evictSealed:   opts.evictSealed,
+		keys:          opts.hmacKeys,
+		keyring:       opts.keys,
+		indexInterval: opts.indexInterval,
+		policy:        opts.compressionPolicy.withDefaults(opts.dict != nil),
+	}
+	if w.compression, err = lookupWriterCodec(opts); err != nil {
+		return nil, err
 	}
+	w.vw, _ = wf.(types.VectorWriter)
 	r.tail = w
 	if err := w.initEmpty(); err != nil {
 		return nil, err
 	}
+	if err := w.initMAC(); err != nil {
+		return nil, err
+	}
 	return w, nil
 }
 
-func recoverFile(info types.SegmentInfo, wf types.WritableFile) (*Writer, error) {
-	r, err := openReader(info, wf)
+func recoverFile(info types.SegmentInfo, wf types.WritableFile, opts fileOpts) (*Writer, error) {
+	r, err := openReader(info, wf, opts)
 	if err != nil {
 		return nil, err
 	}
+	if opts.tailBufferSize > 0 {
+		r.recent = newTailBuffer(opts.tailBufferSize)
+	}
 	w := &Writer{
-		info: info,
-		wf:   wf,
-		r:    r,
+		info:          info,
+		wf:            wf,
+		r:             r,
+		evictSealed:   opts.evictSealed,
+		keys:          opts.hmacKeys,
+		keyring:       opts.keys,
+		indexInterval: opts.indexInterval,
+		policy:        opts.compressionPolicy.withDefaults(opts.dict != nil),
+	}
+	if w.compression, err = lookupWriterCodec(opts); err != nil {
+		return nil, err
 	}
+	w.vw, _ = wf.(types.VectorWriter)
 	r.tail = w
 
 	if err := w.recoverTail(); err != nil {
 		return nil, err
 	}
+	if err := w.initFileCRC(); err != nil {
+		return nil, err
+	}
+	if w.writer.indexStart > 0 {
+		r.sealed()
+		return w, nil
+	}
+	if err := w.initMAC(); err != nil {
+		return nil, err
+	}
 
 	return w, nil
 }
@@ -113,6 +268,89 @@ func (w *Writer) initEmpty() error {
 	// Initialize the index
 	offsets := make([]uint32, 0, 32*1024)
 	w.offsets.Store(offsets)
+	w.writer.indexLen = 0
+	w.writer.numEntries = 0
+	w.writer.fileCRC = 0
+	w.writer.stats = segmentStats{}
+	w.version = FormatVersion
+	w.setInterval(w.info.Features)
+	w.setCompression(w.info.Features)
+	w.setEncryption(w.info.Features)
+	w.terms.Store([]types.TermRun(nil))
+	return nil
+}
+
+// setInterval sets the index interval for a file whose header has features.
+func (w *Writer) setInterval(features uint16) {
+	w.interval = 1
+	if features&FeatureSparse != 0 && w.indexInterval > 1 {
+		w.interval = uint64(w.indexInterval)
+	}
+}
+
+// lookupWriterCodec returns the codec the Filer's options say to compress new
+// entries with, bound to the segment's dictionary if it has one, or nil for
+// none.
+func lookupWriterCodec(opts fileOpts) (CompressionCodec, error) {
+	if opts.compression == CompressionNone {
+		return nil, nil
+	}
+	c, err := LookupCompression(opts.compression)
+	if err != nil || opts.dict == nil {
+		return c, err
+	}
+	return opts.dict.codec(c)
+}
+
+// setCompression sets the codec new entries are compressed with for a file
+// whose header has features.
+func (w *Writer) setCompression(features uint16) {
+	w.codec = nil
+	if features&FeatureCompression != 0 {
+		w.codec = w.compression
+	}
+}
+
+// setEncryption sets the cipher suite new entries are encrypted with for a
+// file whose header has features.
+func (w *Writer) setEncryption(features uint16) {
+	w.suite = CipherNone
+	if features&FeatureEncryption != 0 {
+		w.suite = w.info.Cipher
+	}
+}
+
+// initMAC starts the running HMAC if segments are being signed. Anything
+// already written to the file, for example before a restart, is read back
+// into it.
+func (w *Writer) initMAC() error {
+	if w.keys == nil {
+		return nil
+	}
+	id, key, err := w.keys.CurrentKey()
+	if err != nil {
+		return fmt.Errorf("failed to get key to sign segment: %w", err)
+	}
+	w.writer.mac = hmac.New(sha256.New, key)
+	w.writer.macKeyID = id
+	releaseKey(w.keys, id, key)
+
+	r := io.NewSectionReader(w.wf, 0, int64(w.writer.writeOffset))
+	if _, err := io.Copy(w.writer.mac, r); err != nil {
+		return fmt.Errorf("failed to read segment to sign it: %w", err)
+	}
+	return nil
+}
+
+// initFileCRC reads back everything already written to the file, for example
+// before a restart, into the running checksum.
+func (w *Writer) initFileCRC() error {
+	h := crc32.New(castagnoliTable)
+	r := io.NewSectionReader(w.wf, 0, int64(w.writer.writeOffset))
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("failed to read segment to checksum it: %w", err)
+	}
+	w.writer.fileCRC = h.Sum32()
 	return nil
 }
 
@@ -123,14 +361,38 @@ func (w *Writer) recoverTail() error {
 		offset     int64
 		crcStart   int64
 		offsetsLen int
+		stats      segmentStats
+		pipelined  bool
 	}
-	var prevCommit, finalCommit *commitInfo
+	// Keep the commits since the last that's known to have been synced, which
+	// is trusted if there is one. Up to MaxPipelineDepth pipelined batches
+	// after the last that was synced may have been written.
+	var commits []*commitInfo
+	trusted := false
 
 	offsets := make([]uint32, 0, 32*1024)
+	var (
+		terms []types.TermRun
+		stats segmentStats
+	)
 
 	readInfo, err := readThroughSegment(w.wf, func(_ types.SegmentInfo, fh frameHeader, offset int64) (bool, error) {
 		switch fh.typ {
 		case FrameEntry:
+			// Record the term and the trailer's stats from the entry's metadata.
+			le, dataLen, storedLen, ok, err := w.readRecoveredMeta(fh, offset)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				// A partial frame can only be the result of a torn write in the
+				// final uncommitted batch. Stop here like we do for other torn
+				// frames.
+				return false, nil
+			}
+			terms = appendTermRun(terms, w.info.BaseIndex+uint64(len(offsets)), le.Term)
+			stats.add(unixNano(le.AppendedAt), dataLen, storedLen)
+
 			// Record the frame offset
 			offsets = append(offsets, uint32(offset))
 
@@ -140,17 +402,31 @@ func (w *Writer) recoverTail() error {
 			// We store the start of the actual array not the frame header.
 			w.writer.indexStart = uint64(offset) + frameHeaderLen
 
+		case FrameChunk:
+			// The rest of the data of the last entry.
+			stats.dataBytes += uint64(chunkDataLen(fh))
+			stats.storedBytes += uint64(chunkDataLen(fh))
+
 		case FrameCommit:
 			// The payload is not the length field in this case!
-			prevCommit = finalCommit
-			finalCommit = &commitInfo{
+			c := &commitInfo{
 				fh:         fh,
 				offset:     offset,
 				crcStart:   0,            // First commit includes the file header
 				offsetsLen: len(offsets), // Track how many entries were found up to this commit point.
+				stats:      stats,
+				pipelined:  fh.flags&commitFlagPipelined != 0,
+			}
+			if n := len(commits); n > 0 {
+				c.crcStart = commits[n-1].offset + frameHeaderLen
+				if !commits[n-1].pipelined {
+					// Nothing was written after it until it was synced.
+					commits, trusted = commits[n-1:], true
+				}
 			}
-			if prevCommit != nil {
-				finalCommit.crcStart = prevCommit.offset + frameHeaderLen
+			commits = append(commits, c)
+			if len(commits) > MaxPipelineDepth+1 {
+				commits, trusted = commits[1:], true
 			}
 		}
 		return true, nil
@@ -159,84 +435,164 @@ func (w *Writer) recoverTail() error {
 		return err
 	}
 
-	if finalCommit == nil {
+	if len(commits) == 0 {
 		// There were no commit frames found at all. This segment file is
 		// effectively empty. Init it that way ready for appending. This overwrites
 		// the file header so it doesn't matter if it was valid or not.
 		return w.initEmpty()
 	}
 
-	// Assume that the final commit is good for now and set the writer state
-	w.writer.writeOffset = uint32(finalCommit.offset + frameHeaderLen)
-
 	// Just store what we have for now to ensure the defer doesn't panic we'll
 	// probably update this below.
 	w.offsets.Store(offsets)
 
-	// Whichever path we take, fix up the commitIdx before we leave
+	// Whichever path we take, fix up the commitIdx and terms before we leave
 	defer func() {
 		ofs := w.getOffsets()
+		w.writer.numEntries = uint64(len(ofs))
 		if len(ofs) > 0 {
 			// Non atomic is OK because this file is not visible to any other threads
 			// yet.
 			w.commitIdx = w.info.BaseIndex + uint64(len(ofs)) - 1
+			w.flushedIdx = w.commitIdx
+			w.terms.Store(trimTermRuns(terms, w.commitIdx))
+			// Keep sealing the file with the index its header says it has.
+			w.version = readInfo.FormatVersion
+			w.setInterval(readInfo.Features)
+			w.setCompression(readInfo.Features)
+			w.setEncryption(readInfo.Features)
+			if w.interval > 1 {
+				sparse := make([]uint32, 0, (uint64(len(ofs))+w.interval-1)/w.interval)
+				for i := uint64(0); i < uint64(len(ofs)); i += w.interval {
+					sparse = append(sparse, ofs[i])
+				}
+				ofs = sparse
+				w.offsets.Store(ofs)
+			}
+			w.writer.indexLen = deltaIndexLen(ofs)
+		} else {
+			w.terms.Store([]types.TermRun(nil))
 		}
 	}()
 
-	if finalCommit.offsetsLen < len(offsets) {
-		// Some entries were found after the last commit. Those must be a partial
-		// write that was uncommitted so can be ignored. But the fact they were
-		// written at all means that the last commit frame must have been completed
-		// and acknowledged so we don't need to verify anything. Just truncate the
-		// extra entries from index and reset the write cursor to continue appending
-		// after the last commit.
-		offsets = offsets[:finalCommit.offsetsLen]
-		w.offsets.Store(offsets)
-
-		// Since at least one commit was found, the header better be valid!
-		return validateFileHeader(*readInfo, w.info)
-	}
-
-	// Last frame was a commit frame! Let's check that all the data written in
-	// that commit frame made it to disk.
-	// Verify the length first
-	bufLen := finalCommit.offset - finalCommit.crcStart
-	// We know bufLen can't be bigger than the whole segment file because none of
-	// the values above were read from the data just from the offsets we moved
-	// through.
-	batchBuf := make([]byte, bufLen)
-
-	if _, err := w.wf.ReadAt(batchBuf, finalCommit.crcStart); err != nil {
-		return fmt.Errorf("failed to read last committed batch for CRC validation: %w", err)
+	// Find the last commit that, along with every batch before it, made it to
+	// disk intact. Anything after it was never acknowledged so it's discarded.
+	// Nothing is written after a commit frame until it's synced unless it's
+	// pipelined, so only the last batch can be torn unless appends were
+	// pipelined, when any of the batches that weren't synced may be.
+	if last := commits[len(commits)-1]; !last.pipelined && last.offsetsLen < len(offsets) {
+		// Entries were written after it so it must have been synced.
+		commits, trusted = commits[len(commits)-1:], true
 	}
-
-	gotCrc := crc32.Checksum(batchBuf, castagnoliTable)
-	if gotCrc == finalCommit.fh.crc {
-		// All is good. We already setup the state we need for writer other than
-		// offsets.
-		w.offsets.Store(offsets)
-
-		// Since at least one commit was found, the header better be valid!
-		return validateFileHeader(*readInfo, w.info)
+	good := -1
+	for i, c := range commits {
+		if i == 0 && trusted {
+			good = i
+			continue
+		}
+		ok, err := w.checkCommit(c.fh, c.crcStart, c.offset)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		good = i
 	}
-
-	// Last commit was incomplete rewind back to the previous one or start of file
-	if prevCommit == nil {
-		// Init wil re-write the file header so it doesn't matter if it was corrupt
-		// or not!
+	if good < 0 {
+		// Even the first commit was incomplete. Init will re-write the file
+		// header so it doesn't matter if it was corrupt or not!
+		w.writer.indexStart = 0
 		return w.initEmpty()
 	}
 
-	w.writer.writeOffset = uint32(prevCommit.offset + frameHeaderLen)
-	offsets = offsets[:prevCommit.offsetsLen]
-	w.offsets.Store(offsets)
+	c := commits[good]
+	w.writer.writeOffset = uint32(c.offset + frameHeaderLen)
+	w.writer.stats = c.stats
+	if w.writer.indexStart > uint64(c.offset) {
+		// The index was written in a batch that didn't make it.
+		w.writer.indexStart = 0
+	}
+	w.offsets.Store(offsets[:c.offsetsLen])
 
 	// Since at least one commit was found, the header better be valid!
 	return validateFileHeader(*readInfo, w.info)
 }
 
+// checkCommit reports whether the data of the batch from crcStart up to the
+// commit frame at offset, whose header is fh, made it to disk intact.
+func (w *Writer) checkCommit(fh frameHeader, crcStart, offset int64) (bool, error) {
+	// We know the length can't be bigger than the whole segment file because
+	// none of the values were read from the data just from the offsets we moved
+	// through.
+	batchBuf := make([]byte, offset-crcStart)
+	if _, err := w.wf.ReadAt(batchBuf, crcStart); err != nil {
+		return false, fmt.Errorf("failed to read last committed batch for CRC validation: %w", err)
+	}
+	return crc32.Checksum(batchBuf, castagnoliTable) == fh.crc, nil
+}
+
+// readRecoveredMeta reads the metadata of the entry frame with header fh at
+// offset while recovering the tail, returning it, the length of its data and
+// how many bytes that takes in the frame. It returns false if the frame is
+// torn.
+func (w *Writer) readRecoveredMeta(fh frameHeader, offset int64) (types.LogEntry, uint64, uint64, bool, error) {
+	var le types.LogEntry
+	if isUpstreamFrame(w.info, fh) {
+		// Upstream entries end with their append time so have to be decoded
+		// whole.
+		if fh.len > MaxEntrySize {
+			return le, 0, 0, false, nil
+		}
+		payload := make([]byte, fh.len)
+		n, err := w.wf.ReadAt(payload, offset+frameHeaderLen)
+		if n < len(payload) {
+			return le, 0, 0, false, nil
+		}
+		if err != nil && err != io.EOF {
+			return le, 0, 0, false, err
+		}
+		if err := decodeUpstreamEntry(payload, &le, true); err != nil {
+			return le, 0, 0, false, nil
+		}
+		return le, uint64(len(le.Data)), uint64(len(le.Data)), true, nil
+	}
+
+	var buf [maxEntryMetaLen]byte
+	want := len(buf)
+	if int(fh.len) < want {
+		want = int(fh.len)
+	}
+	n, err := w.wf.ReadAt(buf[:want], offset+frameHeaderLen)
+	if n < want {
+		return le, 0, 0, false, nil
+	}
+	if err != nil && err != io.EOF {
+		return le, 0, 0, false, err
+	}
+	metaLen, err := readEntryMeta(buf[:n], fh.flags, &le)
+	if err != nil {
+		return le, 0, 0, false, nil
+	}
+	storedLen := uint64(int(fh.len) - metaLen)
+	switch {
+	case fh.flags&frameFlagCompressed != 0:
+		return le, uint64(readEntryCompression(buf[:metaLen], fh.flags).size), storedLen, true, nil
+	case fh.flags&frameFlagEncrypted != 0:
+		if storedLen < cipherOverhead {
+			return le, 0, 0, false, nil
+		}
+		return le, storedLen - cipherOverhead, storedLen, true, nil
+	}
+	return le, storedLen, storedLen, true, nil
+}
+
 // Close implements io.Closer
 func (w *Writer) Close() error {
+	if w.dw != nil {
+		w.dw.close(false)
+		w.dw = nil
+	}
 	return w.r.Close()
 }
 
@@ -245,6 +601,21 @@ func (w *Writer) GetLog(idx uint64, le *types.LogEntry) error {
 	return w.r.GetLog(idx, le)
 }
 
+// GetLogReader implements types.SegmentDataReader.
+func (w *Writer) GetLogReader(idx uint64) (io.Reader, int64, error) {
+	return w.r.GetLogReader(idx)
+}
+
+// Verify implements types.SegmentVerifier.
+func (w *Writer) Verify() error {
+	return w.r.Verify()
+}
+
+// GetLogMeta implements types.SegmentReader
+func (w *Writer) GetLogMeta(idx uint64, le *types.LogEntry) error {
+	return w.r.GetLogMeta(idx, le)
+}
+
 // Append adds one or more entries. It must not return until the entries are
 // durably stored otherwise raft's guarantees will be compromised.
 func (w *Writer) Append(entries []types.LogEntry) error {
@@ -255,37 +626,158 @@ func (w *Writer) Append(entries []types.LogEntry) error {
 	if w.writer.indexStart > 0 {
 		return types.ErrSealed
 	}
+	if err := w.appendEntries(entries); err != nil {
+		return err
+	}
+	return w.commitAppended(entries[len(entries)-1].Index)
+}
 
-	// Iterate entries and append each one
-	for _, e := range entries {
-		if err := w.appendEntry(e); err != nil {
-			return err
+// AppendAsync implements types.SegmentPipeliner. The entries are written to
+// the file and syncing them is left to the func returned, unless they fill
+// the segment. Then it's sealed and synced before AppendAsync returns, as
+// Append would, so that the WAL can rotate as soon as it sees it's sealed.
+func (w *Writer) AppendAsync(entries []types.LogEntry) (func() error, error) {
+	if len(entries) < 1 {
+		return func() error { return nil }, nil
+	}
+	if w.writer.indexStart > 0 {
+		return nil, types.ErrSealed
+	}
+	if atomic.LoadUint32(&w.syncFailed) == 1 {
+		// Don't write anything more to a file whose sync failed.
+		w.syncMu.Lock()
+		defer w.syncMu.Unlock()
+		return nil, w.syncErr
+	}
+	if err := w.appendEntries(entries); err != nil {
+		return nil, err
+	}
+	lastIdx := entries[len(entries)-1].Index
+	if err := w.sealIfFull(); err != nil {
+		return nil, err
+	}
+	if w.writer.indexStart > 0 {
+		if err := w.appendCommit(); err != nil {
+			return nil, err
 		}
+		w.committed(lastIdx)
+		return func() error { return nil }, nil
+	}
+	if err := w.writeCommit(true); err != nil {
+		return nil, err
 	}
+	return func() error { return w.syncUpTo(lastIdx) }, nil
+}
 
-	ofs := w.getOffsets()
-	// Work out if we need to seal before we commit and sync.
-	if (w.writer.writeOffset + uint32(len(w.writer.commitBuf)+indexFrameSize(len(ofs)))) > w.info.SizeLimit {
-		// Seal the segment! We seal it by writing an index frame before we commit.
-		if err := w.appendIndex(); err != nil {
+// LastAppendedIndex implements types.SegmentPipeliner.
+func (w *Writer) LastAppendedIndex() uint64 {
+	return atomic.LoadUint64(&w.flushedIdx)
+}
+
+// appendEntries encodes entries ready to be committed. All entries in the
+// batch that don't already have an append time share the same one.
+func (w *Writer) appendEntries(entries []types.LogEntry) error {
+	now := time.Now()
+	for _, e := range entries {
+		if e.AppendedAt.IsZero() {
+			e.AppendedAt = now
+		}
+		if err := w.appendEntry(e); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	// Write the commit frame
+// commitAppended seals the segment if it's now full and then commits
+// everything appended since the last commit, the last entry of which is
+// lastIdx.
+func (w *Writer) commitAppended(lastIdx uint64) error {
+	if err := w.sealIfFull(); err != nil {
+		return err
+	}
 	if err := w.appendCommit(); err != nil {
 		return err
 	}
+	w.committed(lastIdx)
+	return nil
+}
 
-	// Commit in-memory
-	atomic.StoreUint64(&w.commitIdx, entries[len(entries)-1].Index)
+// sealIfFull writes the index and everything else that seals the segment if
+// it won't fit after what's been appended since the last commit.
+func (w *Writer) sealIfFull() error {
+	sealLen := w.indexFrameSize() + termsFrameSize(len(w.sealTermRuns()))
+	if w.version >= trailerVersion {
+		sealLen += encodedFrameSize(trailerLen)
+	}
+	if w.writer.mac != nil {
+		sealLen += encodedFrameSize(hmacLen)
+	}
+	// Work out if we need to seal before we commit and sync.
+	if w.pendingOffset()+uint32(sealLen) > w.info.SizeLimit {
+		// Seal the segment! We seal it by writing an index frame before we commit.
+		return w.appendIndex()
+	}
 	return nil
 }
 
+// committed makes everything up to lastIdx, which has been synced, visible
+// to readers and finishes sealing the segment if it's sealed.
+func (w *Writer) committed(lastIdx uint64) {
+	atomic.StoreUint64(&w.commitIdx, lastIdx)
+	if w.writer.indexStart > 0 {
+		w.sealed()
+	}
+}
+
+// sealed is called once the commit that sealed the segment has been synced.
+func (w *Writer) sealed() {
+	w.r.sealed()
+	if w.dw != nil {
+		// Nothing more will be written to the file so there's nothing left to
+		// protect. Failing to delete it is harmless since the next RecoverTail
+		// or Delete of the file does.
+		_ = w.dw.close(true)
+		w.dw = nil
+	}
+	if w.onSealed != nil {
+		w.onSealed(w.LastIndex())
+		w.onSealed = nil
+	}
+	if pd, ok := w.wf.(types.PageCacheDropper); ok && w.evictSealed {
+		// This is only advice to the OS so failing isn't a reason to fail
+		// the append which is already durable.
+		_ = pd.DropPageCache()
+	}
+}
+
 func (w *Writer) getOffsets() []uint32 {
 	return w.offsets.Load().([]uint32)
 }
 
+func (w *Writer) getTerms() []types.TermRun {
+	return w.terms.Load().([]types.TermRun)
+}
+
+// sealTermRuns returns the term runs that need to be persisted in a terms frame
+// when the segment is sealed. If no entry has a non-zero Term there is nothing
+// to persist and nil is returned.
+func (w *Writer) sealTermRuns() []types.TermRun {
+	runs := w.getTerms()
+	for _, r := range runs {
+		if r.Term > 0 {
+			return runs
+		}
+	}
+	return nil
+}
+
+// TermRuns implements types.SegmentReader and tailWriter. It only returns runs
+// for committed entries.
+func (w *Writer) TermRuns() ([]types.TermRun, error) {
+	return trimTermRuns(w.getTerms(), w.LastIndex()), nil
+}
+
 // OffsetForFrame implements tailWriter and allows readers to lookup entry
 // frames in the tail's in-memory index.
 func (w *Writer) OffsetForFrame(idx uint64) (uint32, error) {
@@ -295,27 +787,62 @@ func (w *Writer) OffsetForFrame(idx uint64) (uint32, error) {
 	os := w.getOffsets()
 	entryIndex := idx - w.info.BaseIndex
 	// No bounds check on entryIndex since LastIndex must ensure it's in bounds.
+	if w.interval > 1 {
+		return w.r.skipEntries(os[entryIndex/w.interval], entryIndex%w.interval)
+	}
 	return os[entryIndex], nil
 }
 
 func (w *Writer) appendEntry(e types.LogEntry) error {
-	offsets := w.getOffsets()
+	if err := w.checkNextIndex(e.Index); err != nil {
+		return err
+	}
+
+	frameOffset, storedLen, err := w.appendEntryFrames(e)
+	if err != nil {
+		return err
+	}
+	w.recordEntry(e, frameOffset, uint64(len(e.Data)), storedLen)
+	return nil
+}
 
-	// Check the invariant that this entry is the next one we expect otherwise our
-	// index logic is incorrect and will result in panics on read.
-	if e.Index != w.info.BaseIndex+uint64(len(offsets)) {
+// checkNextIndex checks the invariant that idx is the next index we expect
+// otherwise our index logic is incorrect and will result in panics on read.
+func (w *Writer) checkNextIndex(idx uint64) error {
+	next := w.info.BaseIndex + w.writer.numEntries
+	if idx != next {
 		return fmt.Errorf("non-monotonic append to segment with BaseIndex=%d. Entry index %d, expected %d",
-			w.info.BaseIndex, e.Index, w.info.BaseIndex+uint64(len(offsets)))
+			w.info.BaseIndex, idx, next)
 	}
+	return nil
+}
 
-	fh := frameHeader{
-		typ: FrameEntry,
-		len: uint32(len(e.Data)),
+// recordEntry adds the entry e, whose entry frame was written at frameOffset
+// and which has dataLen bytes of data taking storedLen bytes in the file, to
+// the in-memory index.
+func (w *Writer) recordEntry(e types.LogEntry, frameOffset uint32, dataLen, storedLen uint64) {
+	w.writer.stats.add(unixNano(e.AppendedAt), dataLen, storedLen)
+
+	// Record the term. This follows the same rules as offsets below: readers
+	// can't see it until it's committed.
+	terms := w.getTerms()
+	if newTerms := appendTermRun(terms, e.Index, e.Term); len(newTerms) != len(terms) {
+		w.terms.Store(newTerms)
 	}
-	bufOffset, err := w.appendFrame(fh, e.Data)
-	if err != nil {
-		return err
+
+	n := w.writer.numEntries
+	w.writer.numEntries++
+	if n%w.interval != 0 {
+		// A sparse index doesn't record this one.
+		return
+	}
+	offsets := w.getOffsets()
+	prev := uint32(0)
+	if len(offsets) > 0 {
+		prev = offsets[len(offsets)-1]
 	}
+	w.writer.indexLen += deltaIndexEntryLen(prev, frameOffset)
+
 	// Update the offsets index
 
 	// Add the index entry. Note this is safe despite mutating the same backing
@@ -326,32 +853,303 @@ func (w *Writer) appendEntry(e types.LogEntry) error {
 	// same memory locations. Old readers might still be looking at the old
 	// array (lower than numEntries) through the current tail.offsets slice but
 	// we are not touching that at least below numEntries.
-	offsets = append(offsets, w.writer.writeOffset+uint32(bufOffset))
+	offsets = append(offsets, frameOffset)
 
 	// Now we can make it available to readers. Note that readers still
 	// shouldn't read it until we actually commit to disk (and increment
 	// commitIdx) but it's race free for them to now!
 	w.offsets.Store(offsets)
-	return nil
+}
+
+// appendEntryFrames appends the frames for e and returns the file offset of
+// its entry frame and how many bytes its data takes in the file. Entries too
+// big for one frame have the rest of their data split into chunk frames.
+// Unless the file can write the data straight from e.Data, each chunk is
+// flushed to the file before the next so that the commit buffer never needs
+// to hold more than one of them. Other entries are compressed if the segment
+// has a codec and its policy says they're worth it, and encrypted if the
+// segment is encrypted. Encrypted entries can't be chunked.
+func (w *Writer) appendEntryFrames(e types.LogEntry) (uint32, uint64, error) {
+	metaLen := encodedEntryMetaLen(e)
+	if w.suite != CipherNone && metaLen+entryEncryptionLen+len(e.Data)+cipherOverhead > MaxEntrySize {
+		return 0, 0, ErrEncryptedTooBig
+	}
+	if metaLen+len(e.Data) <= MaxEntrySize {
+		if w.codec != nil || w.suite != CipherNone {
+			return w.appendCodedEntryFrame(e, metaLen)
+		}
+		frameOffset, err := w.appendDataFrame(frameHeaderLen+metaLen, func(buf []byte) error {
+			_, err := writeEntryFramePrefix(buf, e, entryFlags(e), len(e.Data))
+			return err
+		}, e.Data)
+		return frameOffset, uint64(len(e.Data)), err
+	}
+	if len(e.Data) > MaxChunkedEntrySize {
+		return 0, 0, ErrTooBig
+	}
+
+	first := MaxEntrySize - metaLen
+	frameOffset, err := w.appendDataFrame(frameHeaderLen+metaLen, func(buf []byte) error {
+		_, err := writeEntryFramePrefix(buf, e, entryFlags(e)|frameFlagMore, first)
+		return err
+	}, e.Data[:first])
+	if err != nil {
+		return 0, 0, err
+	}
+	for rest := e.Data[first:]; len(rest) > 0; {
+		if w.vw == nil {
+			if err := w.flush(); err != nil {
+				return 0, 0, err
+			}
+		}
+		n := len(rest)
+		if n > MaxEntrySize {
+			n = MaxEntrySize
+		}
+		fh := chunkFrameHeader(rest[:n], n < len(rest))
+		_, err := w.appendDataFrame(frameHeaderLen, func(buf []byte) error {
+			return writeFrameHeader(buf, fh)
+		}, rest[:n])
+		if err != nil {
+			return 0, 0, err
+		}
+		rest = rest[n:]
+	}
+	return frameOffset, uint64(len(e.Data)), nil
+}
+
+// appendCodedEntryFrame appends the entry frame for e, whose metadata is
+// metaLen bytes before any compression or encryption metadata is added, with
+// its data compressed and encrypted as the segment calls for.
+func (w *Writer) appendCodedEntryFrame(e types.LogEntry, metaLen int) (uint32, uint64, error) {
+	flags := entryFlags(e)
+	var ec entryCompression
+	if w.codec != nil {
+		stored, ok, err := compressEntry(w.codec, w.policy, e.Data)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			ec = entryCompression{codec: w.codec.ID(), size: uint32(len(e.Data))}
+			e.Data = stored
+			flags |= frameFlagCompressed
+			metaLen += entryCompressionLen
+		}
+	}
+	var ee entryEncryption
+	if w.suite != CipherNone {
+		sealed, enc, err := encryptEntry(w.keyring, w.suite, w.info.ID, e.Index, e.Data)
+		if err != nil {
+			return 0, 0, err
+		}
+		e.Data, ee = sealed, enc
+		flags |= frameFlagEncrypted
+		metaLen += entryEncryptionLen
+	}
+	frameOffset, err := w.appendDataFrame(frameHeaderLen+metaLen, func(buf []byte) error {
+		_, err := writeCodedEntryFramePrefix(buf, e, flags, len(e.Data), ec, ee)
+		return err
+	}, e.Data)
+	return frameOffset, uint64(len(e.Data)), err
+}
+
+// appendDataFrame appends a frame made up of the prefixLen bytes enc writes,
+// then data and then padding, and returns the file offset it starts at. If
+// the file can write a vector of buffers and there's enough data, it's
+// written straight from data when the batch is flushed rather than copied
+// into commitBuf, so data mustn't change until then.
+func (w *Writer) appendDataFrame(prefixLen int, enc func(buf []byte) error, data []byte) (uint32, error) {
+	frameOffset := w.pendingOffset()
+	pad := padLen(prefixLen - frameHeaderLen + len(data))
+	if w.vw == nil || len(data) < minVecLen {
+		_, err := w.appendEncoded(prefixLen+len(data)+pad, func(buf []byte) error {
+			if err := enc(buf[:prefixLen]); err != nil {
+				return err
+			}
+			n := prefixLen + copy(buf[prefixLen:], data)
+			// Explicitly write null bytes for padding
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0x0
+			}
+			return nil
+		})
+		return frameOffset, err
+	}
+	if _, err := w.appendEncoded(prefixLen, enc); err != nil {
+		return 0, err
+	}
+	w.writer.vec = append(w.writer.vec, vecPart{at: len(w.writer.commitBuf), data: data})
+	w.writer.vecLen += len(data)
+	w.writer.crc = crc32.Update(w.writer.crc, castagnoliTable, data)
+	if pad > 0 {
+		_, err := w.appendEncoded(pad, func(buf []byte) error {
+			for i := range buf {
+				buf[i] = 0x0
+			}
+			return nil
+		})
+		return frameOffset, err
+	}
+	return frameOffset, nil
+}
+
+// pendingOffset returns the file offset the next frame appended will start
+// at.
+func (w *Writer) pendingOffset() uint32 {
+	return w.writer.writeOffset + uint32(w.writer.vecLen+len(w.writer.commitBuf))
+}
+
+// AppendFrom implements types.SegmentStreamAppender. Entries small enough are
+// read into memory and appended as usual. Larger ones are streamed: the entry
+// frame holds only the metadata and the data is copied from r straight into
+// chunk frames of up to streamChunkSize, each flushed before the next is read
+// so that memory use doesn't grow with the entry. The entry's CRC is computed
+// as the data goes past and stored at the end of the last chunk.
+func (w *Writer) AppendFrom(e types.LogEntry, r io.Reader, size int64) error {
+	if w.writer.indexStart > 0 {
+		return types.ErrSealed
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid entry size %d", size)
+	}
+	if size > MaxChunkedEntrySize {
+		return ErrTooBig
+	}
+	if w.suite != CipherNone && size > MaxEntrySize {
+		return ErrEncryptedTooBig
+	}
+	if e.AppendedAt.IsZero() {
+		e.AppendedAt = time.Now()
+	}
+	// Encrypted entries are sealed whole so they can't be streamed.
+	if size <= streamChunkSize || w.suite != CipherNone {
+		e.Data = make([]byte, size)
+		if _, err := io.ReadFull(r, e.Data); err != nil {
+			return fmt.Errorf("failed to read entry data: %w", err)
+		}
+		return w.Append([]types.LogEntry{e})
+	}
+	if err := w.checkNextIndex(e.Index); err != nil {
+		return err
+	}
+	if len(e.Meta) > MaxEntryMetaSize {
+		return ErrMetaTooBig
+	}
+
+	// Remember where we were so that if r fails we can carry on as if nothing
+	// had been written. Frames already flushed beyond writeOffset are simply
+	// overwritten by the next append.
+	writeOffset, crc, fileCRC := w.writer.writeOffset, w.writer.crc, w.writer.fileCRC
+	pending := append([]byte(nil), w.writer.commitBuf...)
+	pendingVec, pendingVecLen := append([]vecPart(nil), w.writer.vec...), w.writer.vecLen
+
+	frameOffset, err := w.streamEntryFrames(e, r, size)
+	if err != nil {
+		w.writer.writeOffset, w.writer.crc, w.writer.fileCRC = writeOffset, crc, fileCRC
+		w.writer.commitBuf = append(w.writer.commitBuf[:0], pending...)
+		w.writer.vec, w.writer.vecLen = append(w.writer.vec[:0], pendingVec...), pendingVecLen
+		if w.writer.mac != nil {
+			// The HMAC has already seen the flushed chunks so start it again.
+			if merr := w.initMAC(); merr != nil {
+				return merr
+			}
+		}
+		return err
+	}
+	w.recordEntry(e, frameOffset, uint64(size), uint64(size))
+	return w.commitAppended(e.Index)
+}
+
+// streamEntryFrames writes the entry frame for e and then size bytes of data
+// from r in chunk frames. It returns the file offset of the entry frame.
+func (w *Writer) streamEntryFrames(e types.LogEntry, r io.Reader, size int64) (uint32, error) {
+	metaLen := streamedEntryMetaLen(e)
+	frameOffset := w.pendingOffset()
+	bufOffset, err := w.appendEncoded(encodedFrameSize(metaLen), func(buf []byte) error {
+		return writeStreamedEntryFrame(buf, e)
+	})
+	if err != nil {
+		return 0, err
+	}
+	metaStart := bufOffset + frameHeaderLen
+	sum := crc32.Checksum(w.writer.commitBuf[metaStart:metaStart+metaLen], castagnoliTable)
+
+	for remaining := size; remaining > 0; {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+		n := int(remaining)
+		if n > streamChunkSize {
+			n = streamChunkSize
+		}
+		remaining -= int64(n)
+		fh := frameHeader{typ: FrameChunk, flags: frameFlagMore, len: uint32(n)}
+		if remaining == 0 {
+			fh.flags, fh.len = frameFlagCRC, uint32(n+4)
+		}
+		_, err := w.appendEncoded(encodedFrameSize(int(fh.len)), func(buf []byte) error {
+			if err := writeFrameHeader(buf, fh); err != nil {
+				return err
+			}
+			data := buf[frameHeaderLen : frameHeaderLen+n]
+			if _, err := io.ReadFull(r, data); err != nil {
+				return fmt.Errorf("failed to read entry data: %w", err)
+			}
+			sum = crc32.Update(sum, castagnoliTable, data)
+			end := frameHeaderLen + n
+			if remaining == 0 {
+				binary.LittleEndian.PutUint32(buf[end:], sum)
+				end += 4
+			}
+			// Explicitly write null bytes for padding
+			for i := end; i < len(buf); i++ {
+				buf[i] = 0x0
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return frameOffset, nil
 }
 
 func (w *Writer) appendCommit() error {
+	if err := w.writeCommit(false); err != nil {
+		return err
+	}
+	return w.syncUpTo(0)
+}
+
+// writeCommit writes the commit frame for everything appended since the last
+// one and flushes it to the file without syncing. pipelined is set if the
+// next batch may be written before it's synced.
+func (w *Writer) writeCommit(pipelined bool) error {
 	fh := frameHeader{
 		typ: FrameCommit,
 		crc: w.writer.crc,
 	}
+	if pipelined {
+		fh.flags = commitFlagPipelined
+	}
 	if _, err := w.appendFrame(fh, nil); err != nil {
 		return err
 	}
 
 	// Flush all writes to the file
-	if err := w.sync(); err != nil {
+	if err := w.flush(); err != nil {
 		return err
 	}
 
 	// Finally, reset crc so that by the time we write the next trailer
 	// we'll know where the append batch started.
 	w.writer.crc = 0
+	w.writer.dwSaved = false
+	if w.writer.numEntries > 0 {
+		// Probably not possible for there to be none, but just in case we ever
+		// commit the file with only meta data written...
+		atomic.StoreUint64(&w.flushedIdx, w.info.BaseIndex+w.writer.numEntries-1)
+	}
 	return nil
 }
 
@@ -374,12 +1172,18 @@ func (w *Writer) appendIndex() error {
 	// Append the index record before we commit (commit and flush happen later
 	// generally)
 	offsets := w.getOffsets()
-	l := indexFrameSize(len(offsets))
+	l := w.indexFrameSize()
 	w.ensureBufCap(l)
 
 	startOff := len(w.writer.commitBuf)
 
-	if err := writeIndexFrame(w.writer.commitBuf[startOff:startOff+l], offsets); err != nil {
+	var err error
+	if w.version >= deltaIndexVersion {
+		err = writeDeltaIndexFrame(w.writer.commitBuf[startOff:startOff+l], offsets, w.interval, w.version >= indexCRCVersion)
+	} else {
+		err = writeIndexFrame(w.writer.commitBuf[startOff:startOff+l], offsets)
+	}
+	if err != nil {
 		return err
 	}
 	w.writer.commitBuf = w.writer.commitBuf[:startOff+l]
@@ -389,19 +1193,97 @@ func (w *Writer) appendIndex() error {
 
 	// Record the file offset where the index starts (the actual index data so
 	// after the frame header).
-	w.writer.indexStart = uint64(w.writer.writeOffset) + uint64(startOff+frameHeaderLen)
+	w.writer.indexStart = uint64(w.writer.writeOffset) + uint64(w.writer.vecLen+startOff+frameHeaderLen)
+
+	// If any entries have terms, record them right after the index so readers
+	// can find them without decoding any entries.
+	if runs := w.sealTermRuns(); len(runs) > 0 {
+		_, err := w.appendEncoded(termsFrameSize(len(runs)), func(buf []byte) error {
+			return writeTermsFrame(buf, runs)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The trailer's checksum covers everything before it, including what's
+	// still in commitBuf.
+	if w.version >= trailerVersion {
+		sum := w.writer.fileCRC
+		for _, buf := range w.batchBufs() {
+			sum = crc32.Update(sum, castagnoliTable, buf)
+		}
+		t := w.trailer(sum)
+		_, err := w.appendEncoded(encodedFrameSize(trailerLen), func(buf []byte) error {
+			return writeTrailerFrame(buf, t)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Signing must come last since it covers everything before it.
+	if w.writer.mac != nil {
+		for _, buf := range w.batchBufs() {
+			w.writer.mac.Write(buf)
+		}
+		sum := w.writer.mac.Sum(nil)
+		keyID := w.writer.macKeyID
+		w.writer.mac = nil
+		_, err := w.appendEncoded(encodedFrameSize(hmacLen), func(buf []byte) error {
+			return writeHMACFrame(buf, keyID, sum)
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// trailer returns the trailer to seal the segment with given the checksum of
+// everything before it.
+func (w *Writer) trailer(checksum uint32) Trailer {
+	s := w.writer.stats
+	return Trailer{
+		Entries:       w.writer.numEntries,
+		MinIndex:      w.info.BaseIndex,
+		MaxIndex:      w.info.BaseIndex + w.writer.numEntries - 1,
+		MinAppendedAt: fromUnixNano(s.minAppendedAt),
+		MaxAppendedAt: fromUnixNano(s.maxAppendedAt),
+		DataBytes:     s.dataBytes,
+		StoredBytes:   s.storedBytes,
+		Checksum:      checksum,
+	}
+}
+
+// indexFrameSize returns the size of the index frame that would be written if
+// the segment was sealed now.
+func (w *Writer) indexFrameSize() int {
+	if w.version < deltaIndexVersion {
+		return indexFrameSize(len(w.getOffsets()))
+	}
+	if w.writer.numEntries == 0 {
+		return 0
+	}
+	return deltaIndexFrameSize(w.writer.indexLen, w.interval, w.version >= indexCRCVersion)
+}
+
 // appendFrame appends the given frame to the current block. The frame must fit
 // already otherwise an error will be returned.
 func (w *Writer) appendFrame(fh frameHeader, data []byte) (int, error) {
-	// Encode frame header into current block buffer
-	l := encodedFrameSize(len(data))
+	return w.appendEncoded(encodedFrameSize(len(data)), func(buf []byte) error {
+		return writeFrame(buf, fh, data)
+	})
+}
+
+// appendEncoded appends l bytes to the current block using enc to encode them
+// and updates the CRC. It returns the offset within the block that the frame
+// was written at.
+func (w *Writer) appendEncoded(l int, enc func(buf []byte) error) (int, error) {
 	w.ensureBufCap(l)
 
 	bufOffset := len(w.writer.commitBuf)
-	if err := writeFrame(w.writer.commitBuf[bufOffset:bufOffset+l], fh, data); err != nil {
+	if err := enc(w.writer.commitBuf[bufOffset : bufOffset+l]); err != nil {
 		return 0, err
 	}
 	// Update len of commitBuf since we resliced it for the write
@@ -413,43 +1295,101 @@ func (w *Writer) appendFrame(fh frameHeader, data []byte) (int, error) {
 }
 
 func (w *Writer) flush() error {
-	// Write to file
-	n, err := w.wf.WriteAt(w.writer.commitBuf, int64(w.writer.writeOffset))
-	if err == io.EOF && n == len(w.writer.commitBuf) {
+	if w.dw != nil && !w.writer.dwSaved {
+		// Save the committed part of the sector this batch starts in so that a
+		// torn write can't damage it.
+		if err := w.dw.save(w.wf, w.writer.writeOffset); err != nil {
+			return fmt.Errorf("%w: %w", types.ErrWriteFailed, err)
+		}
+		w.writer.dwSaved = true
+	}
+
+	// Write to file, in one call even if some of the batch is in vec.
+	bufs := w.batchBufs()
+	size := w.writer.vecLen + len(w.writer.commitBuf)
+	var (
+		n   int
+		err error
+	)
+	if len(bufs) == 1 {
+		n, err = w.wf.WriteAt(bufs[0], int64(w.writer.writeOffset))
+	} else {
+		n, err = w.vw.WriteVectorAt(bufs, int64(w.writer.writeOffset))
+	}
+	if err == io.EOF && n == size {
 		// Writer may return EOF even if it wrote all bytes if it wrote right up to
 		// the end of the file. Ignore that case though.
 		err = nil
 	}
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", types.ErrWriteFailed, err)
+	}
+	offset := int64(w.writer.writeOffset)
+	for _, buf := range bufs {
+		if w.writer.mac != nil {
+			w.writer.mac.Write(buf)
+		}
+		w.writer.fileCRC = crc32.Update(w.writer.fileCRC, castagnoliTable, buf)
+		if w.r.recent != nil {
+			w.r.recent.write(buf, offset)
+		}
+		offset += int64(len(buf))
 	}
 
-	// Reset writer state ready for next writes
-	w.writer.writeOffset += uint32(len(w.writer.commitBuf))
+	// Reset writer state ready for next writes, not holding on to the caller's
+	// buffers.
+	w.writer.writeOffset += uint32(size)
 	w.writer.commitBuf = w.writer.commitBuf[:0]
+	for i := range w.writer.vec {
+		w.writer.vec[i] = vecPart{}
+	}
+	w.writer.vec, w.writer.vecLen = w.writer.vec[:0], 0
+	for i := range w.writer.iov {
+		w.writer.iov[i] = nil
+	}
 	return nil
 }
 
-func (w *Writer) sync() error {
-	// Write out current buffer to file
-	if err := w.flush(); err != nil {
-		return err
+// batchBufs returns the batch waiting to be flushed as the buffers to write
+// in order.
+func (w *Writer) batchBufs() [][]byte {
+	buf := w.writer.commitBuf
+	iov := w.writer.iov[:0]
+	at := 0
+	for _, p := range w.writer.vec {
+		if p.at > at {
+			iov = append(iov, buf[at:p.at])
+		}
+		iov = append(iov, p.data)
+		at = p.at
 	}
-
-	// Sync file
-	if err := w.wf.Sync(); err != nil {
-		return err
+	if at < len(buf) || len(iov) == 0 {
+		iov = append(iov, buf[at:])
 	}
+	w.writer.iov = iov
+	return iov
+}
 
-	// Update commitIdx atomically
-	offsets := w.getOffsets()
-	commitIdx := uint64(0)
-	if len(offsets) > 0 {
-		// Probably not possible for the to be less, but just in case we ever flush
-		// the file with only meta data written...
-		commitIdx = uint64(w.info.BaseIndex) + uint64(len(offsets)) - 1
+// syncUpTo syncs everything flushed to the file so far and makes the entries
+// it covers visible to readers. If idx is non-zero and an earlier sync already
+// made it durable it does nothing. It may be called concurrently with the
+// next append.
+func (w *Writer) syncUpTo(idx uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+	if idx > 0 && atomic.LoadUint64(&w.commitIdx) >= idx {
+		return nil
 	}
-	atomic.StoreUint64(&w.commitIdx, commitIdx)
+	flushed := atomic.LoadUint64(&w.flushedIdx)
+	if err := w.wf.Sync(); err != nil {
+		w.syncErr = fmt.Errorf("%w: %w", types.ErrWriteFailed, err)
+		atomic.StoreUint32(&w.syncFailed, 1)
+		return w.syncErr
+	}
+	atomic.StoreUint64(&w.commitIdx, flushed)
 	return nil
 }
 
@@ -465,6 +1405,51 @@ func (w *Writer) Sealed() (bool, uint64, error) {
 	return true, w.writer.indexStart, nil
 }
 
+// SealedChecksum implements types.SegmentChecksummer. Once the segment is
+// sealed the running checksum covers everything up to the end of the commit
+// frame that sealed it, which is the whole file.
+func (w *Writer) SealedChecksum() (uint32, bool) {
+	if w.writer.indexStart == 0 {
+		return 0, false
+	}
+	return w.writer.fileCRC, true
+}
+
+// SealedInfo returns the segment's info with MaxIndex, IndexStart and
+// Checksum filled in as a Filer needs them to Open it once it's sealed, and
+// true. It returns false if the segment isn't sealed. SealTime is left as it
+// was.
+func (w *Writer) SealedInfo() (types.SegmentInfo, bool) {
+	if w.writer.indexStart == 0 {
+		return types.SegmentInfo{}, false
+	}
+	info := w.info
+	info.MaxIndex = w.LastIndex()
+	info.IndexStart = w.writer.indexStart
+	info.Checksum = w.writer.fileCRC
+	return info, true
+}
+
+// Seal seals the segment now rather than waiting for it to fill up. It
+// returns the file offset that the index starts at like Sealed. It's an error
+// to seal a segment with no entries.
+func (w *Writer) Seal() (uint64, error) {
+	if w.writer.indexStart > 0 {
+		return w.writer.indexStart, nil
+	}
+	if w.writer.numEntries == 0 {
+		return 0, fmt.Errorf("can't seal segment %s with no entries", FileName(w.info))
+	}
+	if err := w.appendIndex(); err != nil {
+		return 0, err
+	}
+	if err := w.appendCommit(); err != nil {
+		return 0, err
+	}
+	w.sealed()
+	return w.writer.indexStart, nil
+}
+
 // LastIndex returns the most recently persisted index in the log. It must
 // respond without blocking on append since it's needed frequently by read
 // paths that may call it concurrently. Typically this will be loaded from an
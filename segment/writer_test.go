@@ -4,8 +4,13 @@
 package segment
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/dreamsxin/wal/types"
@@ -118,3 +123,306 @@ func TestConcurrentReadersAndWriter(t *testing.T) {
 	require.Greater(t, int(atomic.LoadUint64(&numReads)), 1000)
 	require.Greater(t, int(atomic.LoadUint64(&sealedMaxIndex)), 1000)
 }
+
+func TestWriterAppendFrom(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithVerifyOnRead())
+
+	seg := testSegment(1)
+	seg.SizeLimit = 8 * 1024 * 1024
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+	sa := w.(types.SegmentStreamAppender)
+
+	// Big enough to be streamed in three chunks.
+	big := make([]byte, 2*streamChunkSize+100)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Term: 1, Data: []byte("one")}}))
+	require.NoError(t, sa.AppendFrom(types.LogEntry{Index: 2, Term: 2, Meta: []byte("meta")}, bytes.NewReader(big), int64(len(big))))
+	// Small entries are appended as usual.
+	require.NoError(t, sa.AppendFrom(types.LogEntry{Index: 3, Term: 2}, bytes.NewReader([]byte("three")), 5))
+
+	// A reader that fails or ends early leaves nothing behind.
+	bad := io.MultiReader(bytes.NewReader(big[:streamChunkSize+10]), iotest.ErrReader(errors.New("boom")))
+	require.ErrorContains(t, sa.AppendFrom(types.LogEntry{Index: 4}, bad, int64(len(big))), "boom")
+	err = sa.AppendFrom(types.LogEntry{Index: 4}, bytes.NewReader(big[:len(big)-1]), int64(len(big)))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, 3, int(w.LastIndex()))
+	require.Error(t, sa.AppendFrom(types.LogEntry{Index: 5}, bytes.NewReader(big), int64(len(big))))
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 4, Term: 2, Data: []byte("four")}}))
+
+	check := func(r types.SegmentReader) {
+		t.Helper()
+		var le types.LogEntry
+		require.NoError(t, r.GetLog(2, &le))
+		require.True(t, bytes.Equal(big, le.Data), "streamed entry data doesn't match")
+		require.Equal(t, 2, int(le.Term))
+		require.Equal(t, "meta", string(le.Meta))
+		require.False(t, le.AppendedAt.IsZero())
+		require.NoError(t, r.GetLog(3, &le))
+		require.Equal(t, "three", string(le.Data))
+		require.NoError(t, r.GetLog(4, &le))
+		require.Equal(t, "four", string(le.Data))
+		require.NoError(t, r.(types.SegmentVerifier).Verify())
+
+		rd, size, err := r.(types.SegmentDataReader).GetLogReader(2)
+		require.NoError(t, err)
+		require.Equal(t, len(big), int(size))
+		got, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(big, got), "streamed entry data read back through GetLogReader doesn't match")
+	}
+	check(w)
+
+	rw, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, 4, int(rw.LastIndex()))
+	check(rw)
+
+	var dumped []types.LogEntry
+	err = f.DumpSegment(seg.BaseIndex, seg.ID, 0, 0, func(_ types.SegmentInfo, e types.LogEntry) (bool, error) {
+		e.Data = append([]byte(nil), e.Data...)
+		dumped = append(dumped, e)
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, dumped, 4)
+	require.True(t, bytes.Equal(big, dumped[1].Data), "dumped streamed entry data doesn't match")
+
+	// The CRC at the end of the last chunk covers all the data.
+	offset, err := w.(*Writer).OffsetForFrame(2)
+	require.NoError(t, err)
+	testFileFor(t, w).getBuf()[int(offset)+streamChunkSize+100] ^= 0x1
+	var le types.LogEntry
+	require.ErrorIs(t, w.GetLog(2, &le), types.ErrCorrupt)
+	rd, _, err := w.(types.SegmentDataReader).GetLogReader(2)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rd)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+}
+
+func TestWriterTrailer(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	seg := testSegment(1)
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	start := time.Unix(1700000000, 0)
+	entry := func(idx uint64, data string) types.LogEntry {
+		return types.LogEntry{Index: idx, Term: 1, AppendedAt: start.Add(time.Duration(idx) * time.Second), Data: []byte(data)}
+	}
+	require.NoError(t, w.Append([]types.LogEntry{entry(1, "one"), entry(2, "two")}))
+
+	// The totals so far have to be recovered from the file.
+	w, err = f.RecoverTail(seg)
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.Append([]types.LogEntry{entry(3, "three")}))
+	// Entries without an append time only count towards the data.
+	require.NoError(t, w.(*Writer).appendEntry(types.LogEntry{Index: 4, Data: []byte("four")}))
+	require.NoError(t, w.(*Writer).commitAppended(4))
+	indexStart, err := w.(types.SegmentSealer).Seal()
+	require.NoError(t, err)
+
+	seg.IndexStart = indexStart
+	seg.MaxIndex = 4
+	seg.SealTime = time.Now()
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	tr, err := r.(*Reader).Trailer()
+	require.NoError(t, err)
+	require.NotNil(t, tr)
+	require.Equal(t, 4, int(tr.Entries))
+	require.Equal(t, 1, int(tr.MinIndex))
+	require.Equal(t, 4, int(tr.MaxIndex))
+	require.True(t, start.Add(time.Second).Equal(tr.MinAppendedAt))
+	require.True(t, start.Add(3*time.Second).Equal(tr.MaxAppendedAt))
+	require.Equal(t, 15, int(tr.DataBytes))
+	require.Equal(t, 15, int(tr.StoredBytes))
+	require.NoError(t, r.(types.SegmentVerifier).Verify())
+
+	// Metadata that disagrees with the trailer is caught on open.
+	bad := seg
+	bad.MaxIndex = 5
+	_, err = f.Open(bad)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+
+	// Damage that no entry's checksum covers, here in the padding after the
+	// first entry, is still found by the checksum of the whole file.
+	offset, err := r.(*Reader).findFrameOffset(1)
+	require.NoError(t, err)
+	testFileFor(t, r).getBuf()[int(offset)+frameHeaderLen+8+8+4+3] ^= 0x1
+	require.ErrorContains(t, r.(types.SegmentVerifier).Verify(), "checksum doesn't match its trailer")
+}
+
+func TestWriterSealedChecksum(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	seg := testSegment(1)
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+	_, ok := w.(types.SegmentChecksummer).SealedChecksum()
+	require.False(t, ok)
+
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Data: []byte("one")}, {Index: 2, Data: []byte("two")}}))
+	indexStart, err := w.(types.SegmentSealer).Seal()
+	require.NoError(t, err)
+	sum, ok := w.(types.SegmentChecksummer).SealedChecksum()
+	require.True(t, ok)
+
+	// A tail that was sealed just before a crash gets the same checksum.
+	rw, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	defer rw.Close()
+	got, ok := rw.(types.SegmentChecksummer).SealedChecksum()
+	require.True(t, ok)
+	require.Equal(t, sum, got)
+
+	seg.IndexStart = indexStart
+	seg.MaxIndex = 2
+	seg.SealTime = time.Now()
+	seg.Checksum = sum
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.(types.SegmentVerifier).Verify())
+
+	// Only the checksum in the metadata covers the commit frame that sealed the
+	// segment. Its reserved bytes aren't otherwise checked at all.
+	_, offset, ok, err := r.(*Reader).findSealFrame(indexStart, FrameCommit)
+	require.NoError(t, err)
+	require.True(t, ok)
+	testFileFor(t, r).getBuf()[offset+2] ^= 0x1
+	require.ErrorContains(t, r.(types.SegmentVerifier).Verify(), "checksum doesn't match its metadata")
+
+	// Strict recovery refuses to open it.
+	_, err = NewFiler("test", vfs, WithStrictRecovery()).Open(seg)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+	r2, err := f.Open(seg)
+	require.NoError(t, err)
+	require.NoError(t, r2.Close())
+}
+
+func TestWriterAppendAsync(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	seg := testSegment(1)
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	defer w.Close()
+	p := w.(types.SegmentPipeliner)
+	entry := func(idx uint64) []types.LogEntry {
+		return []types.LogEntry{{Index: idx, Data: []byte(fmt.Sprintf("%05d: async", idx))}}
+	}
+
+	require.NoError(t, w.Append(entry(1)))
+	var waits []func() error
+	for idx := uint64(2); idx <= 4; idx++ {
+		wait, err := p.AppendAsync(entry(idx))
+		require.NoError(t, err)
+		waits = append(waits, wait)
+	}
+	// Nothing is visible until it's synced, after which everything written is.
+	require.Equal(t, uint64(1), w.LastIndex())
+	require.Equal(t, uint64(4), p.LastAppendedIndex())
+	require.NoError(t, waits[1]())
+	require.Equal(t, uint64(4), w.LastIndex())
+	require.NoError(t, waits[0]())
+	require.NoError(t, waits[2]())
+
+	// After a crash with several batches unsynced, recovery keeps only those
+	// before the first that was torn even if later ones made it.
+	var torn int64
+	for idx := uint64(5); idx <= 7; idx++ {
+		if idx == 6 {
+			torn = int64(w.(*Writer).writer.writeOffset) + frameHeaderLen + 2
+		}
+		_, err := p.AppendAsync(entry(idx))
+		require.NoError(t, err)
+	}
+	_, err = testFileFor(t, w).WriteAt([]byte{0xff}, torn)
+	require.NoError(t, err)
+
+	rw, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	defer rw.Close()
+	require.Equal(t, uint64(5), rw.LastIndex())
+	var le types.LogEntry
+	require.NoError(t, rw.GetLog(5, &le))
+	require.Equal(t, "00005: async", string(le.Data))
+	require.NoError(t, rw.Append(entry(6)))
+	require.Equal(t, uint64(6), rw.LastIndex())
+}
+
+func TestWriterVectored(t *testing.T) {
+	data := func(idx uint64, n int) []byte {
+		return bytes.Repeat([]byte{byte(idx)}, n)
+	}
+	batches := [][]types.LogEntry{
+		{
+			{Index: 1, Data: []byte("small")},
+			{Index: 2, Term: 1, Data: data(2, 10*1024+3)},
+			{Index: 3, Data: []byte("small")},
+			{Index: 4, Type: 2, Meta: []byte("meta"), Data: data(4, minVecLen)},
+		},
+		{
+			{Index: 5, Data: data(5, 3*minVecLen+1)},
+		},
+	}
+
+	seg := testSegment(1)
+	seg.SizeLimit = 1024 * 1024
+	var files [][]byte
+	for _, vectored := range []bool{false, true} {
+		vfs := newTestVFS()
+		f := NewFiler("test", vfs)
+		w, err := f.Create(seg)
+		require.NoError(t, err)
+		if !vectored {
+			w.(*Writer).vw = nil
+		}
+		file := testFileFor(t, w)
+
+		for _, batch := range batches {
+			// The caller's copy of the data is free to change once Append returns.
+			entries := make([]types.LogEntry, len(batch))
+			for i, e := range batch {
+				e.Data = append([]byte(nil), e.Data...)
+				e.AppendedAt = time.Unix(int64(e.Index), 0)
+				entries[i] = e
+			}
+			writes := file.writes
+			require.NoError(t, w.Append(entries))
+			require.Equal(t, writes+1, file.writes, "vectored=%v", vectored)
+			for _, e := range entries {
+				e.Data[0] = 0xff
+			}
+		}
+		w.Close()
+		files = append(files, append([]byte(nil), file.getBuf()...))
+
+		rw, err := f.RecoverTail(seg)
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), rw.LastIndex())
+		for _, batch := range batches {
+			for _, e := range batch {
+				var le types.LogEntry
+				require.NoError(t, rw.GetLog(e.Index, &le))
+				require.True(t, bytes.Equal(e.Data, le.Data), "entry %d data doesn't match", e.Index)
+			}
+		}
+		rw.Close()
+	}
+	require.True(t, bytes.Equal(files[0], files[1]), "vectored writes changed the file")
+}
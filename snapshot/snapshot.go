@@ -0,0 +1,375 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package snapshot implements raft.SnapshotStore in the same directory as a
+// WAL so that a raft node needs only one storage directory. Snapshot state is
+// written to files alongside the segments while the list of complete
+// snapshots is kept in the WAL's MetaStore, so a snapshot only exists once
+// that list is durably committed.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/types"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// DirName is the sub directory of the WAL's directory that snapshot files
+	// are written to.
+	DirName = "snapshots"
+
+	snapSuffix = ".snap"
+	tmpSuffix  = ".tmp"
+)
+
+var (
+	// metaKey is the stable store key that the list of complete snapshots is
+	// stored under.
+	metaKey = []byte("snapshots")
+
+	crcTable = crc64.MakeTable(crc64.ECMA)
+
+	// ErrNotFound is returned by Open when there is no snapshot with the given
+	// ID.
+	ErrNotFound = errors.New("snapshot not found")
+)
+
+var _ raft.SnapshotStore = &Store{}
+
+// fileMeta is what we persist for each complete snapshot.
+type fileMeta struct {
+	raft.SnapshotMeta
+	CRC []byte
+}
+
+// Store is a raft.SnapshotStore that shares a WAL's directory and MetaStore.
+type Store struct {
+	w      *wal.WAL
+	dir    string
+	retain int
+
+	truncateLogs bool
+	trailingLogs uint64
+
+	// commitMu serializes updates to the persisted snapshot list.
+	commitMu sync.Mutex
+}
+
+type storeOpt func(*Store)
+
+// WithTrailingLogs makes the Store truncate the front of the WAL each time a
+// snapshot is committed, keeping only the n entries before the snapshot's
+// index (and everything after it). Without this option the log is left for
+// raft to compact.
+func WithTrailingLogs(n uint64) storeOpt {
+	return func(s *Store) {
+		s.truncateLogs = true
+		s.trailingLogs = n
+	}
+}
+
+// New returns a Store that keeps snapshots for w in w's directory. Only the
+// most recent retain snapshots are kept. Files left by snapshots that were
+// never committed, for example due to a crash, are removed.
+func New(w *wal.WAL, retain int, opts ...storeOpt) (*Store, error) {
+	if retain < 1 {
+		return nil, fmt.Errorf("must retain at least one snapshot")
+	}
+	s := &Store{
+		w:      w,
+		dir:    filepath.Join(w.Dir(), DirName),
+		retain: retain,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.removeUncommitted(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) fileName(id string) string {
+	return filepath.Join(s.dir, id+snapSuffix)
+}
+
+// removeUncommitted deletes any files in the snapshot dir that aren't in the
+// persisted list.
+func (s *Store) removeUncommitted() error {
+	metas, err := s.load()
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(metas))
+	for _, m := range metas {
+		keep[m.ID+snapSuffix] = true
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load returns the persisted snapshot list, newest first.
+func (s *Store) load() ([]fileMeta, error) {
+	raw, err := s.w.GetStable(metaKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var metas []fileMeta
+	if err := json.Unmarshal(raw, &metas); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse snapshot list: %s", types.ErrCorrupt, err)
+	}
+	return metas, nil
+}
+
+func (s *Store) save(metas []fileMeta) error {
+	raw, err := json.Marshal(metas)
+	if err != nil {
+		return err
+	}
+	return s.w.SetStable(metaKey, raw)
+}
+
+// snapshotID generates an ID that sorts the same way raft's file snapshots do.
+func snapshotID(term, index uint64) string {
+	return fmt.Sprintf("%d-%d-%d", term, index, time.Now().UnixMilli())
+}
+
+// Create implements raft.SnapshotStore.
+func (s *Store) Create(version raft.SnapshotVersion, index, term uint64,
+	configuration raft.Configuration, configurationIndex uint64,
+	trans raft.Transport) (raft.SnapshotSink, error) {
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	id := snapshotID(term, index)
+
+	f, err := os.OpenFile(filepath.Join(s.dir, id+tmpSuffix), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	hash := crc64.New(crcTable)
+	return &sink{
+		s:    s,
+		f:    f,
+		hash: hash,
+		buf:  bufio.NewWriter(io.MultiWriter(f, hash)),
+		meta: fileMeta{
+			SnapshotMeta: raft.SnapshotMeta{
+				Version:            version,
+				ID:                 id,
+				Index:              index,
+				Term:               term,
+				Configuration:      configuration,
+				ConfigurationIndex: configurationIndex,
+			},
+		},
+	}, nil
+}
+
+// List implements raft.SnapshotStore. Snapshots are returned newest first.
+func (s *Store) List() ([]*raft.SnapshotMeta, error) {
+	metas, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*raft.SnapshotMeta, 0, len(metas))
+	for i := range metas {
+		list = append(list, &metas[i].SnapshotMeta)
+	}
+	return list, nil
+}
+
+// Open implements raft.SnapshotStore. The snapshot's checksum is verified
+// before it's returned.
+func (s *Store) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	metas, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta *fileMeta
+	for i := range metas {
+		if metas[i].ID == id {
+			meta = &metas[i]
+			break
+		}
+	}
+	if meta == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	f, err := os.Open(s.fileName(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := crc64.New(crcTable)
+	if _, err := io.Copy(hash, f); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !bytes.Equal(hash.Sum(nil), meta.CRC) {
+		f.Close()
+		return nil, nil, fmt.Errorf("%w: snapshot %s checksum mismatch", types.ErrCorrupt, id)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &meta.SnapshotMeta, f, nil
+}
+
+// commit records a written snapshot in the persisted list, removes snapshots
+// past the retention limit and then truncates the log if configured to.
+func (s *Store) commit(meta fileMeta) error {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	metas, err := s.load()
+	if err != nil {
+		return err
+	}
+	metas = append(metas, meta)
+	sort.Slice(metas, func(i, j int) bool {
+		a, b := metas[i], metas[j]
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return strings.Compare(a.ID, b.ID) > 0
+	})
+	var reaped []fileMeta
+	if len(metas) > s.retain {
+		reaped = metas[s.retain:]
+		metas = metas[:s.retain]
+	}
+
+	// Once this is durable the snapshot exists and the reaped ones don't.
+	if err := s.save(metas); err != nil {
+		return err
+	}
+
+	// Failing to remove files isn't fatal, they'll be cleaned up by the next
+	// New.
+	for _, m := range reaped {
+		os.Remove(s.fileName(m.ID))
+	}
+
+	if s.truncateLogs && meta.Index > s.trailingLogs {
+		first, err := s.w.FirstIndex()
+		if err != nil {
+			return err
+		}
+		if newFirst := meta.Index - s.trailingLogs + 1; newFirst > first {
+			if err := s.w.TruncateFrontWithReason(newFirst, fmt.Sprintf("snapshot %s at index %d taken", meta.ID, meta.Index)); err != nil {
+				return fmt.Errorf("snapshot committed but failed to truncate log: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sink implements raft.SnapshotSink writing to a temporary file that is
+// renamed into place and committed on Close.
+type sink struct {
+	s    *Store
+	f    *os.File
+	hash hash.Hash64
+	buf  *bufio.Writer
+	meta fileMeta
+
+	closed bool
+}
+
+// ID implements raft.SnapshotSink.
+func (k *sink) ID() string {
+	return k.meta.ID
+}
+
+// Write implements io.Writer.
+func (k *sink) Write(b []byte) (int, error) {
+	n, err := k.buf.Write(b)
+	k.meta.Size += int64(n)
+	return n, err
+}
+
+// Close fsyncs the snapshot, moves it into place and commits it.
+func (k *sink) Close() error {
+	if k.closed {
+		return nil
+	}
+	k.closed = true
+
+	if err := k.finish(); err != nil {
+		os.Remove(k.f.Name())
+		return err
+	}
+	k.meta.CRC = k.hash.Sum(nil)
+	return k.s.commit(k.meta)
+}
+
+func (k *sink) finish() error {
+	if err := k.buf.Flush(); err != nil {
+		k.f.Close()
+		return err
+	}
+	if err := k.f.Sync(); err != nil {
+		k.f.Close()
+		return err
+	}
+	if err := k.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(k.f.Name(), k.s.fileName(k.meta.ID)); err != nil {
+		return err
+	}
+	// Fsync the dir so the rename is durable before the snapshot is committed.
+	return fs.SyncDir(k.s.dir)
+}
+
+// Cancel implements raft.SnapshotSink. It discards everything written.
+func (k *sink) Cancel() error {
+	if k.closed {
+		return nil
+	}
+	k.closed = true
+	closeErr := k.f.Close()
+	if err := os.Remove(k.f.Name()); err != nil {
+		return err
+	}
+	return closeErr
+}
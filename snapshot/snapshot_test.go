@@ -0,0 +1,174 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestWAL(t *testing.T, dir string) *wal.WAL {
+	t.Helper()
+	w, err := wal.Open(dir, wal.WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	return w
+}
+
+func testDir(t *testing.T) string {
+	t.Helper()
+	tmpDir, err := os.MkdirTemp("", "raft-wal-snapshot-test-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	return tmpDir
+}
+
+func writeSnapshot(t *testing.T, s *Store, index, term uint64, data string) string {
+	t.Helper()
+	sink, err := s.Create(1, index, term, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	_, err = sink.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	return sink.ID()
+}
+
+func TestStore(t *testing.T) {
+	dir := testDir(t)
+	w := openTestWAL(t, dir)
+
+	s, err := New(w, 2)
+	require.NoError(t, err)
+
+	list, err := s.List()
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	_, err = s.Create(2, 10, 1, raft.Configuration{}, 1, nil)
+	require.Error(t, err)
+
+	id1 := writeSnapshot(t, s, 10, 1, "first")
+	id2 := writeSnapshot(t, s, 20, 1, "second")
+
+	// Cancelled snapshots leave nothing behind.
+	sink, err := s.Create(1, 25, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("cancelled"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Cancel())
+
+	list, err = s.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, id2, list[0].ID)
+	require.Equal(t, id1, list[1].ID)
+	require.Equal(t, 20, int(list[0].Index))
+	require.Equal(t, int64(len("second")), list[0].Size)
+
+	meta, rc, err := s.Open(id2)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "second", string(got))
+	require.Equal(t, id2, meta.ID)
+
+	// A third snapshot reaps the oldest.
+	id3 := writeSnapshot(t, s, 30, 2, "third")
+	list, err = s.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, id3, list[0].ID)
+	_, _, err = s.Open(id1)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	files, err := os.ReadDir(filepath.Join(dir, DirName))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// Everything survives reopening, and the WAL still opens with the
+	// snapshot dir inside it.
+	require.NoError(t, w.Close())
+	w = openTestWAL(t, dir)
+	defer w.Close()
+	s, err = New(w, 2)
+	require.NoError(t, err)
+	list, err = s.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, id3, list[0].ID)
+}
+
+func TestStoreCorrupt(t *testing.T) {
+	dir := testDir(t)
+	w := openTestWAL(t, dir)
+	defer w.Close()
+
+	s, err := New(w, 1)
+	require.NoError(t, err)
+	id := writeSnapshot(t, s, 10, 1, "some state")
+
+	require.NoError(t, os.WriteFile(s.fileName(id), []byte("some other"), 0644))
+	_, _, err = s.Open(id)
+	require.ErrorIs(t, err, types.ErrCorrupt)
+}
+
+func TestStoreRemovesUncommitted(t *testing.T) {
+	dir := testDir(t)
+	w := openTestWAL(t, dir)
+	defer w.Close()
+
+	s, err := New(w, 1)
+	require.NoError(t, err)
+	id := writeSnapshot(t, s, 10, 1, "state")
+
+	// Simulate a crash part way through writing and before committing.
+	snapDir := filepath.Join(dir, DirName)
+	require.NoError(t, os.WriteFile(filepath.Join(snapDir, "1-20-1234.tmp"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(snapDir, "1-20-1234.snap"), nil, 0644))
+
+	_, err = New(w, 1)
+	require.NoError(t, err)
+
+	files, err := os.ReadDir(snapDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, id+snapSuffix, files[0].Name())
+}
+
+func TestStoreTrailingLogs(t *testing.T) {
+	dir := testDir(t)
+	w := openTestWAL(t, dir)
+	defer w.Close()
+
+	entries := make([]types.LogEntry, 0, 100)
+	for idx := uint64(1); idx <= 100; idx++ {
+		entries = append(entries, types.LogEntry{Index: idx, Data: []byte(fmt.Sprintf("%05d", idx))})
+	}
+	require.NoError(t, w.StoreLogs(entries))
+
+	s, err := New(w, 1, WithTrailingLogs(10))
+	require.NoError(t, err)
+
+	writeSnapshot(t, s, 5, 1, "too early to truncate")
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1, int(first))
+
+	writeSnapshot(t, s, 80, 1, "state")
+	first, err = w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 71, int(first))
+
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 100, int(last))
+}
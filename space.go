@@ -0,0 +1,65 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/types"
+)
+
+// entryOverhead is a generous estimate of the bytes each entry takes in a
+// segment on top of its data, for its frame header, padding, term, metadata
+// and index entry.
+const entryOverhead = 64
+
+// freeSpace returns the free space on the filesystem dir is on, where "" is
+// the WAL's own dir, and true. It returns false if it can't be found.
+func (w *WAL) freeSpace(dir string) (uint64, bool) {
+	if dir == "" {
+		dir = w.dir
+	}
+	var vfs types.VFS = fs.New()
+	if w.vfs != nil {
+		vfs = w.vfs
+	}
+	fsr, ok := vfs.(types.FreeSpaceReporter)
+	if !ok {
+		return 0, false
+	}
+	free, err := fsr.FreeSpace(dir)
+	if err != nil {
+		return 0, false
+	}
+	return free, true
+}
+
+// checkSpace returns an error wrapping ErrDiskFull if writing need more bytes
+// to dir would leave less than the reserve set with WithMinFreeBytes. It also
+// updates the free space metric. If the free space can't be found it assumes
+// there's enough.
+func (w *WAL) checkSpace(dir string, need uint64) error {
+	free, ok := w.freeSpace(dir)
+	if !ok {
+		return nil
+	}
+	w.metrics.freeBytes.Set(float64(free))
+	if w.minFreeBytes > 0 && free < need+w.minFreeBytes {
+		return fmt.Errorf("%w: %d bytes are free but writing %d needs %d with the reserve",
+			ErrDiskFull, free, need, need+w.minFreeBytes)
+	}
+	return nil
+}
+
+// wrapDiskFull makes err wrap ErrDiskFull too if it's because the disk is
+// full.
+func wrapDiskFull(err error) error {
+	if errors.Is(err, syscall.ENOSPC) && !errors.Is(err, ErrDiskFull) {
+		return fmt.Errorf("%w: %w", ErrDiskFull, err)
+	}
+	return err
+}
@@ -4,7 +4,9 @@
 package wal
 
 import (
+	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/benbjohnson/immutable"
 	"github.com/dreamsxin/wal/types"
@@ -64,7 +66,7 @@ func (s *state) getLog(index uint64, le *types.LogEntry) error {
 		if err != nil && err != ErrNotFound {
 			// Return actual errors since they might mask the fact that index really
 			// is in the tail but failed to read for some other reason.
-			return err
+			return wrapSegmentError(s.getTailInfo().SegmentInfo, index, err)
 		}
 		if err == nil {
 			// No error means we found it and just need to decode.
@@ -73,24 +75,34 @@ func (s *state) getLog(index uint64, le *types.LogEntry) error {
 		// Not in the tail segment, fall back to searching previous segments.
 	}
 
-	seg, err := s.findSegmentReader(index)
-	if err != nil {
-		return err
+	seg, ok := s.findSegment(index)
+	if !ok {
+		return ErrNotFound
 	}
+	return wrapSegmentError(seg.SegmentInfo, index, seg.r.GetLog(index, le))
+}
 
-	return seg.GetLog(index, le)
+func (s *state) getLogMeta(index uint64, le *types.LogEntry) error {
+	first, last := s.firstIndex(), s.lastIndex()
+	if last == 0 || index < first || index > last {
+		return ErrNotFound
+	}
+	seg, ok := s.findSegment(index)
+	if !ok {
+		return ErrNotFound
+	}
+	return wrapSegmentError(seg.SegmentInfo, index, seg.r.GetLogMeta(index, le))
 }
 
-// findSegmentReader searches the segment tree for the segment that contains the
-// log at index idx. It may return the tail segment which may not in fact
-// contain idx if idx is larger than the last written index. Typically this is
-// called after already checking with the tail writer whether the log is in
-// there which means the caller can be sure it's not going to return the tail
+// findSegment searches the segment tree for the segment that contains the log
+// at index idx. It may return the tail segment which may not in fact contain
+// idx if idx is larger than the last written index. Typically this is called
+// after already checking with the tail writer whether the log is in there
+// which means the caller can be sure it's not going to return the tail
 // segment.
-func (s *state) findSegmentReader(idx uint64) (types.SegmentReader, error) {
-
+func (s *state) findSegment(idx uint64) (segmentState, bool) {
 	if s.segments.Len() == 0 {
-		return nil, ErrNotFound
+		return segmentState{}, false
 	}
 
 	// Search for a segment with baseIndex.
@@ -100,6 +112,11 @@ func (s *state) findSegmentReader(idx uint64) (types.SegmentReader, error) {
 	// to the first result equal or greater so we are either at it (if equal) or
 	// on the one _after_ the one we need. We step back since that's most likely
 	it.Seek(idx)
+	if it.Done() {
+		// idx is past the BaseIndex of every segment so it can only be in the
+		// last one.
+		it.Last()
+	}
 	// The first call to Next/Prev actually returns the node the iterator is
 	// currently on (which is probably the one after the one we want) but in some
 	// edge cases we might actually want this one. Rather than reversing back and
@@ -111,10 +128,162 @@ func (s *state) findSegmentReader(idx uint64) (types.SegmentReader, error) {
 
 	// We either have the right segment or it doesn't exist.
 	if ok && seg.MinIndex <= idx && (seg.MaxIndex == 0 || seg.MaxIndex >= idx) {
-		return seg.r, nil
+		return seg, true
 	}
 
-	return nil, ErrNotFound
+	return segmentState{}, false
+}
+
+func (s *state) segmentRange(seg segmentState) (min, max uint64, ok bool) {
+	max = seg.MaxIndex
+	if seg.SealTime.IsZero() {
+		max = s.tail.LastIndex()
+	}
+	if max == 0 || max < seg.MinIndex {
+		return 0, 0, false
+	}
+	return seg.MinIndex, max, true
+}
+
+// segmentTermRuns returns the term runs for seg clipped to the range of
+// indexes that are readable in this state. The first run always starts at the
+// segment's first readable index.
+func (s *state) segmentTermRuns(seg segmentState) ([]types.TermRun, uint64, uint64, error) {
+	min, max, ok := s.segmentRange(seg)
+	if !ok || seg.r == nil {
+		return nil, 0, 0, nil
+	}
+	raw, err := seg.r.TermRuns()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	// Segments that don't have any terms recorded are all Term zero.
+	runs := []types.TermRun{{Term: 0, FirstIndex: min}}
+	for _, r := range raw {
+		if r.FirstIndex > max {
+			break
+		}
+		if r.FirstIndex <= min {
+			runs[0].Term = r.Term
+			continue
+		}
+		runs = append(runs, r)
+	}
+	return runs, min, max, nil
+}
+
+func (s *state) termAt(idx uint64) (uint64, error) {
+	first, last := s.firstIndex(), s.lastIndex()
+	if last == 0 || idx < first || idx > last {
+		return 0, ErrNotFound
+	}
+	seg, ok := s.findSegment(idx)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	runs, _, _, err := s.segmentTermRuns(seg)
+	if err != nil {
+		return 0, err
+	}
+	// Find the last run that starts at or before idx.
+	i := sort.Search(len(runs), func(i int) bool {
+		return runs[i].FirstIndex > idx
+	})
+	if i == 0 {
+		return 0, ErrNotFound
+	}
+	return runs[i-1].Term, nil
+}
+
+func (s *state) firstIndexOfTerm(term uint64) (uint64, error) {
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		runs, _, _, err := s.segmentTermRuns(seg)
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range runs {
+			if r.Term == term {
+				return r.FirstIndex, nil
+			}
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (s *state) lastIndexOfTerm(term uint64) (uint64, error) {
+	it := s.segments.Iterator()
+	it.Last()
+	for !it.Done() {
+		_, seg, _ := it.Prev()
+		runs, _, max, err := s.segmentTermRuns(seg)
+		if err != nil {
+			return 0, err
+		}
+		for i := len(runs) - 1; i >= 0; i-- {
+			if runs[i].Term == term {
+				if i+1 < len(runs) {
+					return runs[i+1].FirstIndex - 1, nil
+				}
+				return max, nil
+			}
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// firstIndexAtOrAfter finds the lowest index appended at or after t. It relies
+// on append times being non-decreasing through the log so that both the
+// segments and the entries within them can be binary searched.
+func (s *state) firstIndexAtOrAfter(t time.Time) (uint64, error) {
+	type segRange struct {
+		r        types.SegmentReader
+		min, max uint64
+	}
+	segs := make([]segRange, 0, s.segments.Len())
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		min, max, ok := s.segmentRange(seg)
+		if !ok || seg.r == nil {
+			continue
+		}
+		segs = append(segs, segRange{r: seg.r, min: min, max: max})
+	}
+
+	var searchErr error
+	atOrAfter := func(r types.SegmentReader, idx uint64) bool {
+		if searchErr != nil {
+			return true
+		}
+		var le types.LogEntry
+		if err := r.GetLogMeta(idx, &le); err != nil {
+			searchErr = err
+			return true
+		}
+		return !le.AppendedAt.Before(t)
+	}
+
+	// Find the first segment whose last entry is at or after t, then the first
+	// entry within it.
+	i := sort.Search(len(segs), func(i int) bool {
+		return atOrAfter(segs[i].r, segs[i].max)
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	if i == len(segs) {
+		return 0, ErrNotFound
+	}
+	seg := segs[i]
+	n := sort.Search(int(seg.max-seg.min), func(n int) bool {
+		return atOrAfter(seg.r, seg.min+uint64(n))
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	return seg.min + uint64(n), nil
 }
 
 func (s *state) getTailInfo() *segmentState {
@@ -131,6 +300,20 @@ func (s *state) append(entries []types.LogEntry) error {
 	return s.tail.Append(entries)
 }
 
+// len returns the number of entries in the log, adding up the ranges of the
+// segments rather than trusting the first and last indexes to span them.
+func (s *state) len() uint64 {
+	var n uint64
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if min, max, ok := s.segmentRange(seg); ok {
+			n += max - min + 1
+		}
+	}
+	return n
+}
+
 func (s *state) firstIndex() uint64 {
 	it := s.segments.Iterator()
 	_, seg, ok := it.Next()
@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"golang.org/x/time/rate"
+)
+
+// ioBurst is the most bytes of background IO let through at once. Larger
+// amounts wait for the limiter in chunks of this size.
+const ioBurst = 1 << 20
+
+// newIOLimiter returns the limiter for background IO of bytesPerSec, or no
+// limit if it's zero.
+func newIOLimiter(bytesPerSec int64) *rate.Limiter {
+	return rate.NewLimiter(ioLimit(bytesPerSec), ioBurst)
+}
+
+func ioLimit(bytesPerSec int64) rate.Limit {
+	if bytesPerSec <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSec)
+}
+
+// SetBackgroundIOLimit changes the limit set with WithBackgroundIOLimit while
+// the WAL is open. Zero removes the limit.
+func (w *WAL) SetBackgroundIOLimit(bytesPerSec int64) {
+	w.ioLimiter.SetLimit(ioLimit(bytesPerSec))
+}
+
+// approxFileSize guesses the size of a sealed segment's file. The index is
+// most of what comes after IndexStart.
+func approxFileSize(info types.SegmentInfo) int64 {
+	if info.IndexStart > 0 {
+		return int64(info.IndexStart)
+	}
+	return int64(info.SizeLimit)
+}
+
+// waitIO waits until background work may read or write n more bytes. It
+// returns false without waiting any longer if done is closed first.
+func (w *WAL) waitIO(done <-chan struct{}, n int64) bool {
+	for n > 0 {
+		c := n
+		if c > ioBurst {
+			c = ioBurst
+		}
+		n -= c
+		r := w.ioLimiter.ReserveN(time.Now(), int(c))
+		d := r.Delay()
+		if d == 0 {
+			continue
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-done:
+			t.Stop()
+			r.Cancel()
+			return false
+		case <-t.C:
+		}
+	}
+	return true
+}
+
+// throttledReader is a reader whose reads wait for the background IO limit.
+type throttledReader struct {
+	ctx context.Context
+	w   *WAL
+	r   io.Reader
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > ioBurst {
+		p = p[:ioBurst]
+	}
+	n, err := t.r.Read(p)
+	if !t.w.waitIO(t.ctx.Done(), int64(n)) {
+		return n, t.ctx.Err()
+	}
+	return n, err
+}
@@ -0,0 +1,276 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// TidwallFormat is the LogFormat a github.com/tidwall/wal log was written
+// with. It isn't recorded on disk so it has to be given to ImportTidwall.
+type TidwallFormat int
+
+const (
+	// TidwallBinary is tidwall/wal's default format where each entry is a
+	// uvarint length followed by the data.
+	TidwallBinary TidwallFormat = iota
+
+	// TidwallJSON is tidwall/wal's JSON format with one object per line.
+	TidwallJSON
+)
+
+// tidwallIndexLen is the length of the zero-padded first index tidwall/wal
+// names its segment files with.
+const tidwallIndexLen = 20
+
+// tidwallSegment is one segment file of a tidwall/wal log.
+type tidwallSegment struct {
+	index uint64
+	path  string
+}
+
+// ImportTidwall builds a new WAL in dir from the github.com/tidwall/wal log in
+// srcDir, passing opts to Open. srcDir is only read, it's not changed even if
+// it was left part way through a truncation. tidwall/wal doesn't record terms,
+// types or append times so entries are imported with a zero Term and Type and
+// the time of the import. Otherwise it behaves like Import.
+func ImportTidwall(dir, srcDir string, format TidwallFormat, opts ...walOpt) (int, error) {
+	if format != TidwallBinary && format != TidwallJSON {
+		return 0, fmt.Errorf("unknown tidwall format %d", format)
+	}
+	segs, err := listTidwallSegments(srcDir)
+	if err != nil {
+		return 0, err
+	}
+
+	w, err := Open(dir, opts...)
+	if err != nil {
+		return 0, err
+	}
+	r := tidwallReader{segs: segs, format: format}
+	n, err := importFrom(w, r.next)
+	if cerr := r.close(); err == nil {
+		err = cerr
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// listTidwallSegments returns the segments of the tidwall/wal log in dir in
+// order. Like tidwall/wal's own Open, segments made obsolete by a truncation
+// that was interrupted before it was finished (marked by a .START or .END
+// file) are skipped.
+func listTidwallSegments(dir string) ([]tidwallSegment, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(des))
+	for _, de := range des {
+		if !de.IsDir() {
+			names = append(names, de.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var segs []tidwallSegment
+	startIdx, endIdx := -1, -1
+	for _, name := range names {
+		if len(name) < tidwallIndexLen {
+			continue
+		}
+		isStart := len(name) == tidwallIndexLen+len(".START") && strings.HasSuffix(name, ".START")
+		isEnd := len(name) == tidwallIndexLen+len(".END") && strings.HasSuffix(name, ".END")
+		if len(name) != tidwallIndexLen && !isStart && !isEnd {
+			continue
+		}
+		index, err := strconv.ParseUint(name[:tidwallIndexLen], 10, 64)
+		if err != nil || index == 0 {
+			continue
+		}
+		if isStart {
+			startIdx = len(segs)
+		} else if isEnd && endIdx == -1 {
+			endIdx = len(segs)
+		}
+		segs = append(segs, tidwallSegment{index: index, path: filepath.Join(dir, name)})
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("no tidwall/wal segments found in %s", dir)
+	}
+	if startIdx != -1 {
+		if endIdx != -1 {
+			return nil, fmt.Errorf("%w: %s has both .START and .END segments", ErrCorrupt, dir)
+		}
+		// The plain file with the same index sorts before the .START one so
+		// it's dropped too.
+		segs = segs[startIdx:]
+	}
+	if endIdx != -1 {
+		segs = segs[:endIdx+1]
+		// The .END segment replaces the plain one with the same index.
+		if n := len(segs); n > 1 && segs[n-2].index == segs[n-1].index {
+			segs = append(segs[:n-2], segs[n-1])
+		}
+	}
+	for i := 1; i < len(segs); i++ {
+		if segs[i].index <= segs[i-1].index {
+			return nil, fmt.Errorf("%w: %s has overlapping segments", ErrCorrupt, dir)
+		}
+	}
+	return segs, nil
+}
+
+// tidwallReader reads entries from tidwall/wal segment files one at a time.
+type tidwallReader struct {
+	segs   []tidwallSegment
+	format TidwallFormat
+
+	f     *os.File
+	br    *bufio.Reader
+	seg   tidwallSegment
+	index uint64
+}
+
+func (r *tidwallReader) next() (types.LogEntry, error) {
+	for {
+		if r.br == nil {
+			if len(r.segs) == 0 {
+				return types.LogEntry{}, io.EOF
+			}
+			if err := r.open(); err != nil {
+				return types.LogEntry{}, err
+			}
+		}
+		var (
+			data []byte
+			err  error
+		)
+		if r.format == TidwallJSON {
+			data, err = r.readJSON()
+		} else {
+			data, err = r.readBinary()
+		}
+		if err == io.EOF {
+			if err := r.close(); err != nil {
+				return types.LogEntry{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return types.LogEntry{}, fmt.Errorf("failed to read %s: %w", r.seg.path, err)
+		}
+		le := types.LogEntry{Index: r.index, Data: data}
+		r.index++
+		return le, nil
+	}
+}
+
+func (r *tidwallReader) open() error {
+	seg := r.segs[0]
+	r.segs = r.segs[1:]
+	if r.index != 0 && seg.index != r.index {
+		return fmt.Errorf("%w: segment %s starts at %d but the previous one ended at %d",
+			ErrCorrupt, seg.path, seg.index, r.index-1)
+	}
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	r.f, r.br, r.seg, r.index = f, bufio.NewReader(f), seg, seg.index
+	return nil
+}
+
+func (r *tidwallReader) close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f, r.br = nil, nil
+	return err
+}
+
+// readBinary reads the next entry from a binary segment. It returns io.EOF
+// only at the end of a whole entry.
+func (r *tidwallReader) readBinary() ([]byte, error) {
+	size, err := binary.ReadUvarint(r.br)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad length for entry %d: %s", ErrCorrupt, r.index, err)
+	}
+	if size > math.MaxInt32 {
+		// Also guards against a corrupt length overflowing an int on 32-bit
+		// platforms.
+		return nil, fmt.Errorf("%w: entry %d has length %d", ErrCorrupt, r.index, size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.br, data); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || err == io.EOF {
+			return nil, fmt.Errorf("%w: entry %d is truncated", ErrCorrupt, r.index)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// tidwallJSONEntry is a line of a JSON segment. Data is prefixed with '+' if
+// it's stored as a string or '$' if it's base64 encoded.
+type tidwallJSONEntry struct {
+	Index string `json:"index"`
+	Data  string `json:"data"`
+}
+
+// readJSON reads the next entry from a JSON segment. It returns io.EOF only
+// at the end of a whole line.
+func (r *tidwallReader) readJSON() ([]byte, error) {
+	line, err := r.br.ReadBytes('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: entry %d is truncated", ErrCorrupt, r.index)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e tidwallJSONEntry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return nil, fmt.Errorf("%w: entry %d: %s", ErrCorrupt, r.index, err)
+	}
+	if idx, err := strconv.ParseUint(e.Index, 10, 64); err != nil || idx != r.index {
+		return nil, fmt.Errorf("%w: expected entry %d but found index %q", ErrCorrupt, r.index, e.Index)
+	}
+	if e.Data == "" {
+		return nil, fmt.Errorf("%w: entry %d has no data", ErrCorrupt, r.index)
+	}
+	switch e.Data[0] {
+	case '+':
+		return []byte(e.Data[1:]), nil
+	case '$':
+		data, err := base64.URLEncoding.DecodeString(e.Data[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: entry %d: %s", ErrCorrupt, r.index, err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("%w: entry %d has data with unknown prefix %q", ErrCorrupt, r.index, e.Data[0])
+}
@@ -0,0 +1,139 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/go-kit/log/level"
+)
+
+// checkInterval returns how often a background goroutine looks for work that's
+// due after, such as segments to move to the cold dir after they're sealed.
+func checkInterval(after time.Duration) time.Duration {
+	d := after / 4
+	if d < time.Second {
+		return time.Second
+	}
+	if d > time.Minute {
+		return time.Minute
+	}
+	return d
+}
+
+// runMover moves segments to the cold dir every so often until Close.
+func (w *WAL) runMover() {
+	defer close(w.moverDone)
+
+	ticker := time.NewTicker(checkInterval(w.coldAfter))
+	defer ticker.Stop()
+	for {
+		if _, err := w.moveColdSegments(); err != nil {
+			level.Error(w.logger).Log("msg", "failed to move segments to cold dir", "err", err)
+		}
+		select {
+		case <-w.moverStop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// moveColdSegments moves every sealed segment sealed more than coldAfter ago
+// to the cold dir. It returns the number moved.
+func (w *WAL) moveColdSegments() (int, error) {
+	cutoff := time.Now().Add(-w.coldAfter)
+	s, release := w.acquireState()
+	var old []types.SegmentInfo
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if !seg.SealTime.IsZero() && seg.SealTime.Before(cutoff) && seg.Dir != w.coldDir {
+			old = append(old, seg.SegmentInfo)
+		}
+	}
+	release()
+
+	n := 0
+	for _, info := range old {
+		select {
+		case <-w.moverStop:
+			return n, nil
+		default:
+		}
+		if !w.waitIO(w.moverStop, approxFileSize(info)) {
+			return n, nil
+		}
+		moved, err := w.moveSegment(info)
+		if err != nil {
+			return n, fmt.Errorf("failed to move segment %d: %w", info.ID, err)
+		}
+		if moved {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// moveSegment copies the sealed segment described by info to the cold dir and
+// swaps the copy in for it. Readers of the old file carry on until they're
+// done, after which it's deleted. It returns false if the segment was
+// truncated away in the meantime.
+func (w *WAL) moveSegment(info types.SegmentInfo) (bool, error) {
+	mover := w.sf.(types.SegmentMover)
+
+	// The file can't change once it's sealed so it's copied without holding
+	// up appends.
+	if err := mover.CopySegment(info, w.coldDir); err != nil {
+		return false, err
+	}
+	cold := info
+	cold.Dir = w.coldDir
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+
+	old, ok := w.loadState().segments.Get(info.BaseIndex)
+	if atomic.LoadUint32(&w.closed) == 1 || !ok || old.ID != info.ID || old.Dir != info.Dir {
+		if ok && old.ID == info.ID && old.Dir == w.coldDir {
+			// Don't delete the file that's in use.
+			return false, nil
+		}
+		if err := mover.DeleteSegmentFile(cold); err != nil {
+			level.Error(w.logger).Log("msg", "failed to delete unused copy of segment", "id", info.ID, "err", err)
+		}
+		return false, nil
+	}
+
+	// Truncations may have changed the info since it was copied.
+	cold = old.SegmentInfo
+	cold.Dir = w.coldDir
+	r, err := w.openSealed(cold)
+	if err != nil {
+		mover.DeleteSegmentFile(cold)
+		return false, err
+	}
+	err = w.mutateStateLocked(func(s *state) (func(), func() error, error) {
+		s.segments = s.segments.Set(cold.BaseIndex, segmentState{SegmentInfo: cold, r: r})
+		fin := func() {
+			w.closeSegments([]io.Closer{old.r})
+			if err := mover.DeleteSegmentFile(old.SegmentInfo); err != nil {
+				level.Error(w.logger).Log("msg", "failed to delete moved segment", "id", old.ID, "err", err)
+			}
+		}
+		return fin, nil, nil
+	})
+	if err != nil {
+		r.Close()
+		mover.DeleteSegmentFile(cold)
+		return false, err
+	}
+	return true, nil
+}
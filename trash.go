@@ -0,0 +1,45 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"github.com/go-kit/log/level"
+)
+
+// runPurger deletes segments that have been in the trash for longer than
+// deleteGrace every so often until Close.
+func (w *WAL) runPurger() {
+	defer close(w.purgeDone)
+
+	ticker := time.NewTicker(checkInterval(w.deleteGrace))
+	defer ticker.Stop()
+	for {
+		if _, err := w.PurgeTrash(); err != nil {
+			level.Error(w.logger).Log("msg", "failed to purge trash", "err", err)
+		}
+		select {
+		case <-w.purgeStop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeTrash deletes the files of segments that were deleted more than the
+// WithDeleteGracePeriod ago, which the WAL otherwise does every so often in
+// the background, and returns how many it deleted. It does nothing without
+// the option.
+func (w *WAL) PurgeTrash() (int, error) {
+	if err := w.checkWritable(); err != nil {
+		return 0, err
+	}
+	trash, ok := w.sf.(types.SegmentTrash)
+	if w.deleteGrace <= 0 || !ok {
+		return 0, nil
+	}
+	return trash.PurgeTrash(time.Now().Add(-w.deleteGrace))
+}
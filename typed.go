@@ -0,0 +1,166 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/dreamsxin/wal/types"
+)
+
+// maxPooledBuf is the largest buffer TypedWAL returns to its pools, so that
+// one huge value doesn't pin its buffer for good.
+const maxPooledBuf = 1 << 20
+
+// Codec encodes values of type T to and from the Data of log entries.
+type Codec[T any] interface {
+	// Marshal appends the encoding of v to dst and returns the extended
+	// buffer.
+	Marshal(dst []byte, v T) ([]byte, error)
+
+	// Unmarshal decodes data into v. data is only valid during the call, so v
+	// must not refer to it once Unmarshal returns.
+	Unmarshal(data []byte, v *T) error
+}
+
+// JSONCodec is a Codec that encodes values as JSON with encoding/json.
+type JSONCodec[T any] struct{}
+
+// Marshal implements Codec.
+func (JSONCodec[T]) Marshal(dst []byte, v T) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, b...), nil
+}
+
+// Unmarshal implements Codec.
+func (JSONCodec[T]) Unmarshal(data []byte, v *T) error {
+	return json.Unmarshal(data, v)
+}
+
+// TypedWAL stores and reads values of type T in a WAL, encoding them with a
+// Codec, so that callers don't each need to convert to and from LogEntry. The
+// buffers used to encode and decode are pooled. It's safe for concurrent use
+// as far as the WAL is, and entries stored directly in the WAL can be read
+// through it as long as the codec can decode them.
+type TypedWAL[T any] struct {
+	w     *WAL
+	codec Codec[T]
+
+	batches sync.Pool // of *typedBatch
+	entries sync.Pool // of *types.LogEntry
+}
+
+type typedBatch struct {
+	entries []types.LogEntry
+	ends    []int
+	buf     []byte
+}
+
+// NewTyped returns a TypedWAL storing values in w encoded with codec.
+func NewTyped[T any](w *WAL, codec Codec[T]) *TypedWAL[T] {
+	return &TypedWAL[T]{w: w, codec: codec}
+}
+
+// WAL returns the underlying WAL.
+func (t *TypedWAL[T]) WAL() *WAL {
+	return t.w
+}
+
+// Store appends vs to the log at consecutive indexes starting at first, with
+// the same rules as StoreLogs.
+func (t *TypedWAL[T]) Store(first uint64, vs ...T) error {
+	if len(vs) < 1 {
+		return nil
+	}
+	b, _ := t.batches.Get().(*typedBatch)
+	if b == nil {
+		b = &typedBatch{}
+	}
+	defer t.putBatch(b)
+
+	// Encode everything into one buffer first since it may move as it grows.
+	var err error
+	for i, v := range vs {
+		if b.buf, err = t.codec.Marshal(b.buf, v); err != nil {
+			return fmt.Errorf("failed to encode entry %d: %w", first+uint64(i), err)
+		}
+		b.ends = append(b.ends, len(b.buf))
+	}
+	start := 0
+	for i, end := range b.ends {
+		b.entries = append(b.entries, types.LogEntry{
+			Index: first + uint64(i),
+			Data:  b.buf[start:end:end],
+		})
+		start = end
+	}
+	return t.w.StoreLogs(b.entries)
+}
+
+func (t *TypedWAL[T]) putBatch(b *typedBatch) {
+	if cap(b.buf) > maxPooledBuf {
+		return
+	}
+	for i := range b.entries {
+		b.entries[i] = types.LogEntry{}
+	}
+	b.entries, b.ends, b.buf = b.entries[:0], b.ends[:0], b.buf[:0]
+	t.batches.Put(b)
+}
+
+// Get returns the value stored at index. Like GetLog it returns ErrNotFound if
+// there's no such entry.
+func (t *TypedWAL[T]) Get(index uint64) (T, error) {
+	var v T
+	err := t.GetInto(index, &v)
+	return v, err
+}
+
+// GetInto decodes the value stored at index into v.
+func (t *TypedWAL[T]) GetInto(index uint64, v *T) error {
+	le, _ := t.entries.Get().(*types.LogEntry)
+	if le == nil {
+		le = &types.LogEntry{}
+	}
+	defer t.putEntry(le)
+
+	if err := t.w.GetLog(index, le); err != nil {
+		return err
+	}
+	return t.decode(*le, v)
+}
+
+func (t *TypedWAL[T]) putEntry(le *types.LogEntry) {
+	if cap(le.Data) > maxPooledBuf {
+		return
+	}
+	// Keep the buffers for GetLog to reuse.
+	*le = types.LogEntry{Meta: le.Meta[:0], Data: le.Data[:0]}
+	t.entries.Put(le)
+}
+
+// Replay calls fn with the index and value of every entry from fromIndex to the
+// end of the log, as WAL.Replay does.
+func (t *TypedWAL[T]) Replay(ctx context.Context, fromIndex uint64, fn func(index uint64, v T) error) error {
+	return t.w.Replay(ctx, fromIndex, func(le types.LogEntry) error {
+		var v T
+		if err := t.decode(le, &v); err != nil {
+			return err
+		}
+		return fn(le.Index, v)
+	})
+}
+
+func (t *TypedWAL[T]) decode(le types.LogEntry, v *T) error {
+	if err := t.codec.Unmarshal(le.Data, v); err != nil {
+		return fmt.Errorf("failed to decode entry %d: %w", le.Index, err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package types
+
+// KeyProvider supplies secret keys to features that sign or encrypt data on
+// disk. Keys are identified by an ID which is stored alongside the data they
+// protect so that keys can be rotated: new data uses the current key while
+// older data can still be checked with the key it was written with.
+type KeyProvider interface {
+	// CurrentKey returns the ID and value of the key that new data should use.
+	CurrentKey() (id uint32, key []byte, err error)
+
+	// Key returns the key with the given ID. It must return an error if the key
+	// is unknown.
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyReleaser is an optional interface for a KeyProvider whose keys shouldn't
+// stay in memory any longer than they're needed, for example because they're
+// fetched from a KMS. Users of such a provider fetch a key each time they use
+// it rather than keeping a copy, and call ReleaseKey with it as soon as
+// they've finished with it, after which the provider may wipe or reuse it.
+type KeyReleaser interface {
+	ReleaseKey(id uint32, key []byte)
+}
+
+// KeyWiper is implemented by things, such as segment.Filer, that keep copies of
+// keys from a KeyProvider. WipeKeys zeroes every copy they hold and stops them
+// keeping new ones, so that keys needed later are fetched each time. The WAL
+// calls it when it's closed.
+type KeyWiper interface {
+	WipeKeys()
+}
@@ -22,6 +22,14 @@ type MetaStore interface {
 	// called concurrently with Get/SetStable operations.
 	CommitState(PersistentState) error
 
+	// GetStable returns a value from stable store or nil if it doesn't exist. May
+	// be called concurrently by multiple threads.
+	GetStable(key []byte) ([]byte, error)
+
+	// SetStable stores a value in the stable store. Setting a nil value removes
+	// the key. May be called concurrently with GetStable.
+	SetStable(key []byte, value []byte) error
+
 	io.Closer
 }
 
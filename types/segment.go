@@ -44,6 +44,39 @@ type SegmentInfo struct {
 	// limit in the sense that the final Append usually takes the segment file
 	// past this size before it is considered full and sealed.
 	SizeLimit uint32
+
+	// Codec is only set for segments created by upstream hashicorp/raft-wal,
+	// which records the codec its entries were encoded with here. Such segments
+	// are read using that codec. It's always zero for segments created by this
+	// package.
+	Codec uint64 `json:",omitempty"`
+
+	// FormatVersion is the version of the segment format the segment was
+	// written in. It's zero for segments created before versions were recorded.
+	FormatVersion uint8 `json:",omitempty"`
+
+	// Features is the set of optional format features the segment was written
+	// with. See the Feature constants in the segment package.
+	Features uint16 `json:",omitempty"`
+
+	// Checksum is the CRC32 (Castagnoli) of the whole segment file as it was
+	// when it was sealed. It's zero for unsealed segments, segments sealed
+	// before checksums were recorded and those whose SegmentWriter doesn't
+	// implement SegmentChecksummer, none of which can be checked.
+	Checksum uint32 `json:",omitempty"`
+
+	// Dir is the directory the segment file is in if it isn't in the WAL's own
+	// directory, which is only the case when segments are spread over several
+	// directories.
+	Dir string `json:",omitempty"`
+
+	// Dictionary is the ID of the dictionary the segment's entries are
+	// compressed with if it has the dictionary feature, and zero otherwise.
+	Dictionary uint64 `json:",omitempty"`
+
+	// Cipher is the ID of the cipher suite the segment's entries are encrypted
+	// with if it has the encryption feature, and zero otherwise.
+	Cipher uint8 `json:",omitempty"`
 }
 
 // SegmentFiler is the interface that provides access to segments to the WAL. It
@@ -96,7 +129,9 @@ type SegmentWriter interface {
 
 	// Append adds one or more entries. It must not return until the entries are
 	// durably stored otherwise raft's guarantees will be compromised. Append must
-	// not be called concurrently with any other call to Sealed or Append.
+	// not be called concurrently with any other call to Sealed or Append. The
+	// entries' Data and Meta belong to the caller and must not be referred to
+	// once Append returns.
 	Append(entries []LogEntry) error
 
 	// Sealed returns whether the segment is sealed or not. If it is it returns
@@ -125,4 +160,123 @@ type SegmentReader interface {
 	// GetLog writes the raw log entry bytes associated with idx into le.Data.
 	// If the log doesn't exist in this segment ErrNotFound must be returned.
 	GetLog(idx uint64, le *LogEntry) error
+
+	// GetLogMeta is like GetLog but only reads the entry's metadata (Term, Type
+	// and Meta) leaving le.Data untouched.
+	GetLogMeta(idx uint64, le *LogEntry) error
+
+	// TermRuns returns the terms of all committed entries in the segment as a
+	// list of runs in index order. It may include runs for entries outside of
+	// the segment's MinIndex/MaxIndex which the caller must ignore. It should
+	// not need to read any entry payloads.
+	TermRuns() ([]TermRun, error)
+}
+
+// SegmentVerifier may optionally be implemented by a SegmentReader that can
+// check the integrity of everything in its segment more thoroughly than
+// reading each entry would.
+type SegmentVerifier interface {
+	// Verify returns an error wrapping ErrCorrupt if any part of the segment
+	// fails validation.
+	Verify() error
+}
+
+// SegmentDataReader may optionally be implemented by a SegmentReader that can
+// stream an entry's Data rather than reading it all into memory.
+type SegmentDataReader interface {
+	// GetLogReader returns a reader for the Data of the entry at idx and its
+	// length. If the entry doesn't exist in this segment ErrNotFound must be
+	// returned. The reader is only valid until the segment is closed.
+	GetLogReader(idx uint64) (io.Reader, int64, error)
+}
+
+// SegmentSealer may optionally be implemented by a SegmentWriter that can be
+// sealed before it's full. It's used when rewriting segments, where the last
+// one needs to be sealed however little it holds.
+type SegmentSealer interface {
+	// Seal writes out the index and anything else needed to seal the segment
+	// and returns the file offset the index starts at like Sealed. Sealing an
+	// already sealed segment is a no-op.
+	Seal() (uint64, error)
+}
+
+// SegmentChecksummer may optionally be implemented by a SegmentWriter that
+// can checksum its whole file when it's sealed. The checksum is recorded in
+// the segment's SegmentInfo so that bit rot in a sealed segment, which is
+// otherwise never read back in full, can be found later.
+type SegmentChecksummer interface {
+	// SealedChecksum returns the CRC32 (Castagnoli) of the whole segment file,
+	// or false if the segment isn't sealed yet. Like Sealed it must not be
+	// called concurrently with Append.
+	SealedChecksum() (uint32, bool)
+}
+
+// SegmentMover may optionally be implemented by a SegmentFiler that can move
+// sealed segments between directories, which the WAL does in two steps so
+// that the segment is readable from one place or the other throughout.
+type SegmentMover interface {
+	// CopySegment durably copies the file of the sealed segment described by
+	// info to dir, after which the segment can be opened with its Dir set to
+	// dir. A crash part way through must not leave a partial copy that would
+	// be taken for a whole one.
+	CopySegment(info SegmentInfo, dir string) error
+
+	// DeleteSegmentFile deletes the segment's file from its Dir only, leaving
+	// any copy elsewhere. It's not an error if there's no such file.
+	DeleteSegmentFile(info SegmentInfo) error
+}
+
+// SegmentDictionaries may optionally be implemented by a SegmentFiler that can
+// compress segments with a shared dictionary.
+type SegmentDictionaries interface {
+	// AddDictionary makes dict available to segments created with the ID it
+	// returns as their Dictionary. The same dict always has the same ID.
+	AddDictionary(dict []byte) (uint64, error)
+}
+
+// SegmentStreamAppender may optionally be implemented by a SegmentWriter that
+// can append an entry while reading its Data from an io.Reader, so that large
+// entries never need to be held in memory.
+type SegmentStreamAppender interface {
+	// AppendFrom appends e with exactly size bytes read from r as its Data;
+	// e.Data is ignored. Like Append it must not return until the entry is
+	// durable. If r fails or ends early nothing must be appended.
+	AppendFrom(e LogEntry, r io.Reader, size int64) error
+}
+
+// SegmentPipeliner may optionally be implemented by a SegmentWriter that can
+// write a batch of entries without waiting for them to be synced, so that the
+// next batch can be encoded and written while the sync is in flight.
+type SegmentPipeliner interface {
+	// AppendAsync writes entries like Append but may return before they're
+	// durable. The returned func blocks until they are, syncing if no later
+	// sync already covered them, and must return nil before they're
+	// acknowledged. It may be called concurrently with AppendAsync and other
+	// such funcs. Entries aren't visible to readers until they're durable.
+	// Their Data and Meta may be referred to until the returned func returns.
+	AppendAsync(entries []LogEntry) (func() error, error)
+
+	// LastAppendedIndex returns the last index written, durable or not, or zero
+	// if nothing has been. Like Sealed it must not be called concurrently with
+	// Append.
+	LastAppendedIndex() uint64
+}
+
+// SegmentManifest may optionally be implemented by a SegmentFiler whose List
+// reads a record of the segments it created rather than listing files, which
+// misses segments created while the record wasn't kept.
+type SegmentManifest interface {
+	// CheckManifest is called before List with the ID the next segment will
+	// get. If the record doesn't end just below it, it must be rebuilt so that
+	// List returns every segment.
+	CheckManifest(nextID uint64) error
+}
+
+// SegmentTrash may optionally be implemented by a SegmentFiler that moves the
+// files of deleted segments to a trash dir rather than deleting them, so that
+// they can still be recovered for a while.
+type SegmentTrash interface {
+	// PurgeTrash deletes the files of segments deleted before before for good
+	// and returns how many files it deleted.
+	PurgeTrash(before time.Time) (int, error)
 }
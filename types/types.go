@@ -5,6 +5,7 @@ package types
 
 import (
 	"errors"
+	"time"
 )
 
 var (
@@ -12,10 +13,47 @@ var (
 	ErrCorrupt  = errors.New("WAL is corrupt")
 	ErrSealed   = errors.New("segment is sealed")
 	ErrClosed   = errors.New("closed")
+
+	// ErrUnsupportedFormat is returned when a segment was written in a newer
+	// format than this version of the package understands.
+	ErrUnsupportedFormat = errors.New("unsupported segment format")
+
+	// ErrReadOnly is returned when trying to change a WAL, or the files or
+	// metadata under it, that was opened read-only.
+	ErrReadOnly = errors.New("read-only")
+
+	// ErrWriteFailed is wrapped around the error from writing or syncing a
+	// segment file. After a failed sync the OS may have dropped the unwritten
+	// pages and still report later syncs as successful, so nothing more should
+	// be appended to that file until it has been recovered from disk.
+	ErrWriteFailed = errors.New("segment write failed")
 )
 
 // LogEntry represents an entry that has already been encoded.
 type LogEntry struct {
 	Index uint64
-	Data  []byte
+
+	// Term is optional. When non-zero it's stored alongside the entry so that it
+	// can be looked up without decoding Data.
+	Term uint64
+
+	// Type and Meta are optional. They are stored alongside the entry and can be
+	// read without reading Data which allows cheap filtering of entries (e.g.
+	// skipping no-op entries). Meta must be small (at most 255 bytes).
+	Type uint8
+	Meta []byte
+
+	// AppendedAt records when the entry was appended. If it's zero when the
+	// entry is stored, the time of the append is recorded.
+	AppendedAt time.Time
+
+	Data []byte
+}
+
+// TermRun describes a run of consecutive entries that share the same Term.
+// The run starts at FirstIndex and extends until the FirstIndex of the next
+// run (or the end of the segment).
+type TermRun struct {
+	Term       uint64
+	FirstIndex uint64
 }
@@ -6,8 +6,9 @@ package types
 import "io"
 
 // VFS is the interface WAL needs to interact with the file system. In
-// production it would normally be implemented by RealFS which interacts with
-// the operating system FS using standard go os package. It's useful to allow
+// production it would normally be implemented by fs.FS which interacts with
+// the operating system FS using standard go os package, while fs.MemFS keeps
+// everything in memory. It's useful to allow
 // testing both to run quicker (by being in memory only) and to make it easy to
 // simulate all kinds of disk errors and failure modes without needing a more
 // elaborate external test harness like ALICE.
@@ -40,6 +41,12 @@ type VFS interface {
 	// about the well-formedness of the file, it may be empty, the wrong size or
 	// corrupt in arbitrary ways.
 	OpenWriter(dir, name string) (WritableFile, error)
+
+	// Rename atomically replaces the file newName, if there is one, with the
+	// file oldName. Both are in dir. It must not return until the change is
+	// durable, so that after a crash either newName is the old file or it's
+	// the renamed one.
+	Rename(dir, oldName, newName string) error
 }
 
 // WritableFile provides random read-write access to a file as well as the
@@ -52,8 +59,36 @@ type WritableFile interface {
 	Sync() error
 }
 
+// PageCacheDropper may optionally be implemented by a WritableFile that can
+// tell the OS its cached pages won't be needed again soon. It's only ever
+// called on files that have been fully synced.
+type PageCacheDropper interface {
+	DropPageCache() error
+}
+
+// VectorWriter may optionally be implemented by a WritableFile that can write
+// several buffers one after another in a single call, as pwritev does. It
+// must write all of them unless it returns an error.
+type VectorWriter interface {
+	WriteVectorAt(bufs [][]byte, off int64) (int, error)
+}
+
+// FreeSpaceReporter may optionally be implemented by a VFS that can tell how
+// many more bytes can be written to the filesystem a dir is on.
+type FreeSpaceReporter interface {
+	FreeSpace(dir string) (uint64, error)
+}
+
 // ReadableFile provides random read access to a file.
 type ReadableFile interface {
 	io.ReaderAt
 	io.Closer
 }
+
+// FileMover may optionally be implemented by a VFS that can move a file from
+// one dir to another on the same filesystem without copying it. newDir is
+// created if it doesn't exist. Like Rename it must not return until the move
+// is durable.
+type FileMover interface {
+	MoveFile(oldDir, oldName, newDir, newName string) error
+}
@@ -4,10 +4,16 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	iofs "io/fs"
+	"math"
 	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,8 +22,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/benbjohnson/immutable"
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/metadb"
+	"github.com/dreamsxin/wal/segment"
 	"github.com/dreamsxin/wal/types"
 	"github.com/go-kit/log"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -27,6 +37,38 @@ var (
 	ErrClosed     = types.ErrClosed
 	ErrOutOfRange = errors.New("index out of range")
 
+	// ErrUnsupportedFormat is returned by Open if any segment was written in a
+	// newer format than this version of the package can read.
+	ErrUnsupportedFormat = types.ErrUnsupportedFormat
+
+	// ErrReadOnly is returned by methods that would change a WAL opened with
+	// OpenFS.
+	ErrReadOnly = types.ErrReadOnly
+
+	// ErrDiskFull is returned by appends that would leave less free space than
+	// the reserve set with WithMinFreeBytes, or that fail because the disk is
+	// full. Nothing is written so appending can carry on once space is freed.
+	ErrDiskFull = errors.New("not enough free disk space")
+
+	// ErrConflict is returned by appends whose first index doesn't follow on
+	// from the last entry in the log.
+	ErrConflict = errors.New("non-monotonic log entries")
+
+	// ErrFailed is returned by appends once writing or syncing the tail
+	// segment has failed, wrapped around that first error, until ClearError
+	// moves on to a new tail or the WAL is closed and opened again. See
+	// WithSyncErrorPolicy for the alternatives.
+	ErrFailed = errors.New("WAL failed after a write error")
+
+	// ErrThrottled is wrapped by the ThrottleError appends return when they'd
+	// exceed the rate set with WithWriteRateLimit.
+	ErrThrottled = errors.New("write rate limit exceeded")
+
+	// ErrBackpressure is returned by appends when more than the bytes set with
+	// WithMaxPendingBytes are already waiting to be written and
+	// WithBackpressureReject is used.
+	ErrBackpressure = errors.New("too many appends pending")
+
 	DefaultSegmentSize = 64 * 1024 * 1024
 )
 
@@ -60,31 +102,199 @@ type LogStore interface {
 
 // WAL is a write-ahead log suitable for github.com/hashicorp/raft.
 type WAL struct {
-	closed uint32 // atomically accessed to keep it first in struct for alignment.
+	// dictID is the ID of the dictionary new segments are compressed with, or
+	// zero for none. It's accessed atomically so it must stay first to be
+	// 64-bit aligned on 32-bit platforms.
+	dictID uint64
+
+	closed uint32 // accessed atomically
+
+	// forced is set, atomically, once CloseContext has given up waiting for
+	// Close and released the WAL's files itself.
+	forced uint32
 
 	dir    string
 	sf     types.SegmentFiler
 	metaDB types.MetaStore
 
-	reg     prometheus.Registerer
-	metrics *walMetrics
-
-	logger      log.Logger
-	segmentSize int
+	// audit reads and writes the audit log in metaDB. Records are only added
+	// if auditOn is set by WithAuditLog.
+	audit     *auditLog
+	auditOn   bool
+	auditKeep int
+
+	reg              prometheus.Registerer
+	metricsNamespace string
+	metricsSubsystem string
+	metricsLabels    prometheus.Labels
+	metrics          *walMetrics
+
+	logger           log.Logger
+	segmentSize      int
+	initialBaseIndex uint64
+
+	// cache is nil unless one of the entry cache options is used.
+	cacheEntries int
+	cacheBytes   int
+	cache        *entryCache
+
+	// blockCache is nil unless WithBlockCache is used with the default
+	// SegmentFiler.
+	blockCacheBytes int
+	blockCache      *segment.BlockCache
+
+	// These are passed to the default SegmentFiler.
+	tailBufferBytes int
+	readAheadSize   int
+	evictSealed     bool
+	verifyOnRead    bool
+	hmacKeys        types.KeyProvider
+	strictHMAC      bool
+	indexInterval   int
+	compression     uint8
+	compressPolicy  segment.CompressionPolicy
+	compressDict    []byte
+	encryptKeys     types.KeyProvider
+	cipherSuite     uint8
+	lockKeys        bool
+	strictRecovery  bool
+	doubleWrite     bool
+	sealedMarkers   bool
+	manifest        bool
+	ioUring         bool
+	fileNaming      segment.FileNaming
+	dataDirs        []string
+	placement       PlacementPolicy
+	vfs             types.VFS
+	flatMeta        bool
+
+	// coldDir is where sealed segments are moved coldAfter after they're
+	// sealed if it's set. moverStop is closed to stop the goroutine doing it,
+	// which closes moverDone when it exits.
+	coldDir   string
+	coldAfter time.Duration
+	moverStop chan struct{}
+	moverDone chan struct{}
+
+	// scrubInterval is how often sealed segments are verified in the
+	// background if it's set. scrubStop and scrubDone stop the goroutine doing
+	// it as moverStop and moverDone do the mover.
+	scrubInterval    time.Duration
+	scrubBytesPerSec int64
+	scrubHandler     func(types.SegmentInfo, error)
+	scrubStop        chan struct{}
+	scrubDone        chan struct{}
+
+	// deleteGrace is how long deleted segments are kept in the trash if it's
+	// set. purgeStop and purgeDone stop the goroutine purging it as moverStop
+	// and moverDone do the mover.
+	deleteGrace time.Duration
+	purgeStop   chan struct{}
+	purgeDone   chan struct{}
+
+	// archiver is given the segments TruncateFront removes, if it's set.
+	// archiveMu serializes updates to the segments pending archive.
+	archiver  Archiver
+	archiveMu sync.Mutex
+
+	// mergeEvery is how often small segments are merged if it's set.
+	// mergeStop and mergeDone stop the goroutine merging them as moverStop
+	// and moverDone do the mover.
+	mergeEvery time.Duration
+	mergeStop  chan struct{}
+	mergeDone  chan struct{}
+
+	// ioLimiter limits the rate of background IO to backgroundIOLimit bytes
+	// per second.
+	backgroundIOLimit int64
+	ioLimiter         *rate.Limiter
+
+	// writeLimiter limits appends to writeRate bytes per second if it's set.
+	writeRate       int64
+	writeBurst      int
+	rejectThrottled bool
+	writeLimiter    *rate.Limiter
+
+	// pendingLimit limits the bytes of appends waiting to be written to
+	// maxPendingBytes if it's set.
+	maxPendingBytes    int64
+	rejectBackpressure bool
+	pendingLimit       *pendingLimit
+
+	// pipeline has room for pipelineWindow appends that have been written but
+	// not yet synced if pipelined appends are enabled. pipelineMu is read
+	// locked by each of them until it's synced, before writeMu, and write
+	// locked by anything that needs them all finished first.
+	pipelineWindow int
+	pipeline       chan struct{}
+	pipelineMu     sync.RWMutex
+
+	// copyOnAppend makes StoreLogs copy the entries' data before appending it.
+	copyOnAppend bool
+
+	// mutationCheck makes StoreLogs panic if the caller changes the entries'
+	// data before the append finishes.
+	mutationCheck bool
+
+	// minFreeBytes is the free space that appends and new segments must leave.
+	minFreeBytes uint64
+
+	// lazyOpen defers opening sealed segments until they're first read. If
+	// maxOpenSegments is set, segmentLRU closes them again when too many are
+	// open.
+	lazyOpen        bool
+	maxOpenSegments int
+	segmentLRU      *segmentLRU
+
+	// recoveryProgress is called as Open recovers the WAL if it's set.
+	recoveryProgress func(done, total int, phase string)
+
+	// readOnly is set for WALs opened with OpenFS.
+	readOnly bool
 
 	// s is the current state of the WAL files. It is an immutable snapshot that
 	// can be accessed without a lock when reading. We only support a single
 	// writer so all methods that mutate either the WAL state or append to the
-	// tail of the log must hold the writeMu until they complete all changes.
+	// tail of the log must hold the writeMu, stateMu or both until they complete
+	// all changes.
 	s atomic.Value // *state
 
-	// writeMu must be held when modifying s or while appending to the tail.
-	// Although we take care never to let readers block writer, we still only
-	// allow a single writer to be updating the meta state at once. The mutex must
-	// be held before s is loaded until all modifications to s or appends to the
-	// tail are complete.
+	// writeMu must be held while appending to the tail or changing which
+	// segment is the tail. Although we take care never to let readers block
+	// writer, we still only allow a single writer at once. The mutex must be
+	// held before s is loaded until all appends to the tail are complete.
 	writeMu sync.Mutex
 
+	// stateMu must be held, after writeMu if both are, from loading s until
+	// any changes to it are committed. Appends only take it when they rotate
+	// the tail, so TruncateFront, which usually needs only stateMu, doesn't
+	// hold them up.
+	stateMu sync.Mutex
+
+	// deletes tracks segments being closed and deleted in the background after
+	// TruncateFront. deletesMu is held to add to it so that Close can wait for
+	// it.
+	deletesMu sync.Mutex
+	deletes   sync.WaitGroup
+
+	// released are the segments already closed by Close, or by CloseContext
+	// releasing them first, so that neither closes one twice.
+	releaseMu sync.Mutex
+	released  map[io.Closer]bool
+
+	// metaCloseOnce closes metaDB once, whether Close or CloseContext gets to
+	// it first, and metaCloseErr is what that returned.
+	metaCloseOnce sync.Once
+	metaCloseErr  error
+
+	// failErr is the write error that left the tail unusable, if there was
+	// one. It's guarded by writeMu.
+	failErr         error
+	syncErrorPolicy SyncErrorPolicy
+
+	// cursorMu serializes updates to the cursors in the stable store.
+	cursorMu sync.Mutex
+
 	// These chans are used to hand off serial execution for segment rotation to a
 	// background goroutine so that StoreLogs can return and allow the caller to
 	// get on with other work while we mess with files. The next call to StoreLogs
@@ -112,6 +322,15 @@ type walOpt func(*WAL)
 // recovery is attempted. If recovery is not possible an error is returned,
 // otherwise the returned *WAL is in a state ready for use.
 func Open(dir string, opts ...walOpt) (*WAL, error) {
+	return OpenContext(context.Background(), dir, opts...)
+}
+
+// OpenContext is Open but gives up if ctx is done before recovery finishes,
+// returning an error wrapping ctx's. It checks ctx before each segment is
+// opened, so a large WAL can be abandoned part way through, though a single
+// segment that is slow to open or recover still has to finish first. Nothing
+// recovery would change has been changed when it gives up.
+func OpenContext(ctx context.Context, dir string, opts ...walOpt) (*WAL, error) {
 	w := &WAL{
 		dir:           dir,
 		triggerRotate: make(chan uint64, 1),
@@ -123,38 +342,108 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 	if err := w.applyDefaultsAndValidate(); err != nil {
 		return nil, err
 	}
+	return w.open(ctx)
+}
+
+// OpenFS opens the WAL stored at the root of fsys for reading only, for
+// example one captured in a test fixture, an embed.FS or a zip archive of a
+// data directory. Its metadata may be in either wal-meta.db or the files
+// written by WithFlatMetaStore, and nothing in fsys is ever changed: the tail
+// segment is recovered in memory as Open would, and leftover segment files
+// are ignored rather than deleted. Methods that would change the log or the
+// stable store return ErrReadOnly. Options that supply the files or metadata,
+// WithVFS, WithMetaStore, WithFlatMetaStore and WithSegmentFiler, are
+// ignored.
+func OpenFS(fsys iofs.FS, opts ...walOpt) (*WAL, error) {
+	w := &WAL{
+		dir:           ".",
+		triggerRotate: make(chan uint64, 1),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	vfs := fs.NewReadOnly(fsys)
+	w.readOnly = true
+	w.vfs, w.flatMeta, w.sf = vfs, false, nil
+	w.metaDB = metadb.NewReadOnlyMetaDB(vfs)
+	if err := w.applyDefaultsAndValidate(); err != nil {
+		return nil, err
+	}
+	return w.open(context.Background())
+}
 
+// open loads the WAL's state and recovers its segments once its options have
+// been applied. It stops if ctx is done before it starts on the next segment.
+func (w *WAL) open(ctx context.Context) (*WAL, error) {
 	// Load or create metaDB
 	persisted, err := w.metaDB.Load(w.dir)
 	if err != nil {
 		return nil, err
 	}
 
+	// Fail before touching any files if a segment needs a newer format or a
+	// feature we don't have. The metaDB is closed so the caller can retry with
+	// a newer version in the same process.
+	if err := checkFormats(persisted.Segments); err != nil {
+		w.metaDB.Close()
+		return nil, err
+	}
+	if err := checkMetaEncryption(w.metaDB, persisted); err != nil {
+		w.metaDB.Close()
+		return nil, err
+	}
+
+	if w.maxOpenSegments > 0 {
+		w.segmentLRU = newSegmentLRU(w.maxOpenSegments)
+	}
+
 	newState := state{
 		segments:      &immutable.SortedMap[uint64, segmentState]{},
 		nextSegmentID: persisted.NextSegmentID,
 	}
 
+	// A filer that keeps a manifest of its segments must catch up with any
+	// created while it wasn't kept before List can be trusted.
+	if sm, ok := w.sf.(types.SegmentManifest); ok {
+		if err := sm.CheckManifest(persisted.NextSegmentID); err != nil {
+			w.abandonOpen(&newState)
+			return nil, err
+		}
+	}
+
 	// Get the set of all persisted segments so we can prune it down to just the
 	// unused ones as we go.
 	toDelete, err := w.sf.List()
 	if err != nil {
+		w.abandonOpen(&newState)
 		return nil, err
 	}
+	w.reportProgress(len(toDelete), len(toDelete), RecoveryPhaseList)
+	nSealed := len(persisted.Segments)
+	if nSealed > 0 && persisted.Segments[nSealed-1].SealTime.IsZero() {
+		nSealed--
+	}
 
 	// Build the state
 	recoveredTail := false
 	for i, si := range persisted.Segments {
+		if err := ctx.Err(); err != nil {
+			w.abandonOpen(&newState)
+			return nil, fmt.Errorf("recovery stopped at segment %d of %d: %w", i, len(persisted.Segments), err)
+		}
+
 		// We want to keep this segment since it's still in the metaDB list!
 		delete(toDelete, si.ID)
 
 		if si.SealTime.IsZero() {
 			// This is an unsealed segment. It _must_ be the last one. Safety check!
 			if i < len(persisted.Segments)-1 {
+				w.abandonOpen(&newState)
 				return nil, fmt.Errorf("unsealed segment is not at tail")
 			}
 
 			// Try to recover this segment
+			w.reportProgress(0, 1, RecoveryPhaseTail)
 			sw, err := w.sf.RecoverTail(si)
 			if errors.Is(err, os.ErrNotExist) {
 				// Handle no file specially. This can happen if we crashed right after
@@ -168,8 +457,10 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 				sw, err = w.sf.Create(si)
 			}
 			if err != nil {
-				return nil, err
+				w.abandonOpen(&newState)
+				return nil, w.countReadError(readPhaseRecovery, err)
 			}
+			w.reportProgress(1, 1, RecoveryPhaseTail)
 			// Set the tail and "reader" for this segment
 			ss := segmentState{
 				SegmentInfo: si,
@@ -179,6 +470,12 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 			newState.segments = newState.segments.Set(si.BaseIndex, ss)
 			recoveredTail = true
 
+			// Carry on compressing new segments with the tail's dictionary
+			// unless another was given.
+			if si.Features&segment.FeatureDictionary != 0 && atomic.LoadUint64(&w.dictID) == 0 {
+				atomic.StoreUint64(&w.dictID, si.Dictionary)
+			}
+
 			// We're done with this loop, break here to avoid nesting all the rest of
 			// the logic!
 			break
@@ -187,9 +484,10 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 		// This is a sealed segment
 
 		// Open segment reader
-		sr, err := w.sf.Open(si)
+		sr, err := w.openSealed(si)
 		if err != nil {
-			return nil, err
+			w.abandonOpen(&newState)
+			return nil, w.countReadError(readPhaseRecovery, err)
 		}
 
 		// Store the open reader to get logs from
@@ -198,18 +496,33 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 			r:           sr,
 		}
 		newState.segments = newState.segments.Set(si.BaseIndex, ss)
+		w.reportProgress(i+1, nSealed, RecoveryPhaseOpen)
 	}
 
+	if !recoveredTail && w.readOnly {
+		w.abandonOpen(&newState)
+		return nil, fmt.Errorf("WAL has no segments to read")
+	}
 	if !recoveredTail {
 		// There was no unsealed segment at the end. This can only really happen
 		// when the log is empty with zero segments (either on creation or after a
 		// truncation that removed all segments) since we otherwise never allow the
 		// state to have a sealed tail segment. But this logic works regardless!
 
-		// Create a new segment. We use baseIndex of 1 even though the first append
-		// might be much higher - we'll allow that since we know we have no records
-		// yet and so lastIndex will also be 0.
-		si := w.newSegment(newState.nextSegmentID, 1)
+		// Create a new segment. We use baseIndex of 1, unless the log is new and
+		// another was chosen with WithInitialBaseIndex, even though the first
+		// append might be much higher - we'll allow that since we know we have no
+		// records yet and so lastIndex will also be 0.
+		baseIndex := uint64(1)
+		if newState.segments.Len() == 0 && w.initialBaseIndex > 0 {
+			baseIndex = w.initialBaseIndex
+		}
+		si := w.newSegment(newState.nextSegmentID, baseIndex)
+		si.Dir = w.placeSegment(nil, uint64(si.SizeLimit))
+		if err := w.checkSpace(si.Dir, uint64(si.SizeLimit)); err != nil {
+			w.abandonOpen(&newState)
+			return nil, err
+		}
 		newState.nextSegmentID++
 		ss := segmentState{
 			SegmentInfo: si,
@@ -218,37 +531,119 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 
 		// Persist the new meta to "commit" it even before we create the file so we
 		// don't attempt to recreate files with duplicate IDs on a later failure.
-		if err := w.metaDB.CommitState(newState.Persistent()); err != nil {
+		if err := w.commitState(newState.Persistent()); err != nil {
+			w.abandonOpen(&newState)
 			return nil, err
 		}
 
 		// Create the new segment file
-		w, err := w.sf.Create(si)
+		sw, err := w.sf.Create(si)
 		if err != nil {
+			w.abandonOpen(&newState)
 			return nil, err
 		}
-		newState.tail = w
+		newState.tail = sw
 		// Update the segment in memory so we have a reader for the new segment. We
 		// don't need to commit again as this isn't changing the persisted metadata
 		// about the segment.
-		ss.r = w
+		ss.r = sw
 		newState.segments = newState.segments.Set(si.BaseIndex, ss)
 	}
 
+	// If we crashed after sealing the tail but before rotating to a new one the
+	// recovered tail can't take any more appends, so the rotation is finished
+	// once the WAL is running.
+	var (
+		tailSealed     bool
+		tailIndexStart uint64
+	)
+	if !w.readOnly {
+		tailSealed, tailIndexStart, err = newState.tail.Sealed()
+		if err != nil {
+			w.abandonOpen(&newState)
+			return nil, err
+		}
+	}
+
 	// Store the in-memory state (it was already persisted if we modified it
 	// above) there are no readers yet since we are constructing a new WAL so we
 	// don't need to jump through the mutateState hoops yet!
 	w.s.Store(&newState)
 
-	// Delete any unused segment files left over after a crash.
-	w.deleteSegments(toDelete)
+	// Delete any unused segment files left over after a crash, once those
+	// still waiting to be archived have been.
+	if !w.readOnly {
+		if err := w.retryPendingArchives(toDelete); err != nil {
+			level.Error(w.logger).Log("msg", "failed to read segments pending archive, leaving leftover segments in place", "err", err)
+		} else {
+			w.deleteSegments(toDelete, AuditRecord{Reason: "left over after a crash"})
+		}
+	}
+
+	// Reopen leaves the WAL closed until its new state is ready.
+	atomic.StoreUint32(&w.closed, 0)
 
 	// Start the rotation routine
-	go w.runRotate()
+	go w.runRotate(w.triggerRotate)
+	if w.coldDir != "" && !w.readOnly {
+		w.moverStop = make(chan struct{})
+		w.moverDone = make(chan struct{})
+		go w.runMover()
+	}
+	if w.scrubInterval > 0 {
+		w.scrubStop = make(chan struct{})
+		w.scrubDone = make(chan struct{})
+		go w.runScrubber()
+	}
+	if w.deleteGrace > 0 && !w.readOnly {
+		w.purgeStop = make(chan struct{})
+		w.purgeDone = make(chan struct{})
+		go w.runPurger()
+	}
+	if w.mergeEvery > 0 && !w.readOnly {
+		w.mergeStop = make(chan struct{})
+		w.mergeDone = make(chan struct{})
+		go w.runMerger()
+	}
+
+	if tailSealed {
+		w.writeMu.Lock()
+		w.triggerRotateLocked(tailIndexStart)
+		w.writeMu.Unlock()
+	}
 
 	return w, nil
 }
 
+// abandonOpen closes the segments opened so far into s and the metaDB when
+// open gives up. Every failure after the state is started must go through it,
+// or a failed Reopen, which can be retried, leaks the files it opened.
+func (w *WAL) abandonOpen(s *state) {
+	var toClose []io.Closer
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		toClose = append(toClose, seg.r)
+	}
+	w.closeSegments(toClose)
+	w.metaDB.Close()
+}
+
+// checkFormats returns an error wrapping ErrUnsupportedFormat if any of segs
+// was written in a format version or with features this version can't read.
+func checkFormats(segs []types.SegmentInfo) error {
+	for _, si := range segs {
+		if si.FormatVersion > segment.FormatVersion {
+			return fmt.Errorf("%w: segment %d has format version %d but this version only supports up to %d",
+				ErrUnsupportedFormat, si.ID, si.FormatVersion, segment.FormatVersion)
+		}
+		if err := segment.CheckFeatures(si); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // stateTxn represents a transaction body that mutates the state under the
 // writeLock. s is already a shallow copy of the current state that may be
 // mutated as needed. If a nil error is returned, s will be atomically set as
@@ -270,8 +665,20 @@ func (w *WAL) loadState() *state {
 	return w.s.Load().(*state)
 }
 
-// mutateState executes a stateTxn. writeLock MUST be held while calling this.
+// commitState persists ps to the metaDB, recording how long it took.
+func (w *WAL) commitState(ps types.PersistentState) error {
+	start := time.Now()
+	err := w.metaDB.CommitState(ps)
+	w.metrics.metaCommitSeconds.Observe(time.Since(start).Seconds())
+	w.metrics.metaCommits.WithLabelValues(strconv.FormatBool(err == nil)).Inc()
+	return err
+}
+
+// mutateState executes a stateTxn. stateMu MUST be held while calling this.
 func (w *WAL) mutateStateLocked(tx stateTxn) error {
+	if err := w.checkForced(); err != nil {
+		return err
+	}
 	s := w.loadState()
 	s.acquire()
 	defer s.release()
@@ -283,7 +690,7 @@ func (w *WAL) mutateStateLocked(tx stateTxn) error {
 	}
 
 	// Commit updates to meta
-	if err := w.metaDB.CommitState(newS.Persistent()); err != nil {
+	if err := w.commitState(newS.Persistent()); err != nil {
 		return err
 	}
 
@@ -310,148 +717,765 @@ func (w *WAL) acquireState() (*state, func()) {
 // newSegment creates a types.SegmentInfo with the passed ID and baseIndex, filling in
 // the segment parameters based on the current WAL configuration.
 func (w *WAL) newSegment(ID, baseIndex uint64) types.SegmentInfo {
+	features := segment.CurrentFeatures
+	if w.indexInterval > 1 {
+		features |= segment.FeatureSparse
+	}
+	var dictID uint64
+	if w.compression != segment.CompressionNone {
+		features |= segment.FeatureCompression
+		if dictID = atomic.LoadUint64(&w.dictID); dictID != 0 {
+			features |= segment.FeatureDictionary
+		}
+	}
+	if w.cipherSuite != segment.CipherNone {
+		features |= segment.FeatureEncryption
+	}
 	return types.SegmentInfo{
 		ID:        ID,
 		BaseIndex: baseIndex,
 		MinIndex:  baseIndex,
 		SizeLimit: uint32(w.segmentSize),
 
-		CreateTime: time.Now(),
+		CreateTime:    time.Now(),
+		FormatVersion: segment.FormatVersion,
+		Features:      features,
+		Dictionary:    dictID,
+		Cipher:        w.cipherSuite,
+	}
+}
+
+// Dir returns the directory the WAL was opened in.
+func (w *WAL) Dir() string {
+	return w.dir
+}
+
+// FirstIndex returns the first index written. 0 for no entries.
+func (w *WAL) FirstIndex() (uint64, error) {
+	if err := w.checkClosed(); err != nil {
+		return 0, err
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.firstIndex(), nil
+}
+
+// LastIndex returns the last index written. 0 for no entries.
+func (w *WAL) LastIndex() (uint64, error) {
+	if err := w.checkClosed(); err != nil {
+		return 0, err
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.lastIndex(), nil
+}
+
+// IndexRange returns the first and last indexes in the log, both 0 if it's
+// empty. Unlike calling FirstIndex and LastIndex separately, both come from the
+// same view of the log so they're consistent even if it's truncated
+// concurrently.
+func (w *WAL) IndexRange() (first, last uint64, err error) {
+	if err := w.checkClosed(); err != nil {
+		return 0, 0, err
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.firstIndex(), s.lastIndex(), nil
+}
+
+// Contains reports whether idx is in the log. It only checks the range of
+// indexes the log holds, without reading anything, so it's much cheaper than
+// calling GetLog and checking for ErrNotFound. It returns false once the WAL
+// is closed.
+func (w *WAL) Contains(idx uint64) bool {
+	if w.checkClosed() != nil {
+		return false
+	}
+	s, release := w.acquireState()
+	defer release()
+	last := s.lastIndex()
+	return last > 0 && idx >= s.firstIndex() && idx <= last
+}
+
+// Len returns the number of entries in the log. It's worked out from the
+// range of indexes each segment holds without reading anything. It returns 0
+// once the WAL is closed.
+func (w *WAL) Len() uint64 {
+	if w.checkClosed() != nil {
+		return 0
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.len()
+}
+
+// IsEmpty reports whether the log has no entries. It returns true once the WAL
+// is closed.
+func (w *WAL) IsEmpty() bool {
+	if w.checkClosed() != nil {
+		return true
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.lastIndex() == 0
+}
+
+// GetLog gets a log entry at a given index.
+func (w *WAL) GetLog(index uint64, log *types.LogEntry) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	w.metrics.entriesRead.Inc()
+
+	gen := w.cacheGeneration()
+	if w.getCachedLog(index, log) {
+		return nil
+	}
+
+	// The state is acquired and released directly rather than through
+	// acquireState since the release func it returns escapes, and so
+	// allocates, on 32-bit platforms.
+	s := w.loadState()
+	s.acquire()
+	defer s.release()
+	return w.readLog(s, gen, index, log)
+}
+
+// GetLastLog gets the last entry in the log. Unlike calling LastIndex and then
+// GetLog, the index and the entry come from the same view of the log, so a
+// concurrent truncation can't make it fail with ErrNotFound. ErrNotFound is
+// only returned if the log is empty.
+func (w *WAL) GetLastLog(log *types.LogEntry) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	w.metrics.entriesRead.Inc()
+
+	// The generation must be taken before the state so that an entry that's
+	// truncated after it's acquired isn't cached.
+	gen := w.cacheGeneration()
+	s, release := w.acquireState()
+	defer release()
+
+	index := s.lastIndex()
+	if index == 0 {
+		return ErrNotFound
+	}
+	if w.getCachedLog(index, log) {
+		return nil
+	}
+	return w.readLog(s, gen, index, log)
+}
+
+// cacheGeneration returns the entry cache's truncation generation to pass to
+// readLog, or zero if there's no cache.
+func (w *WAL) cacheGeneration() uint64 {
+	if w.cache == nil {
+		return 0
+	}
+	return w.cache.generation()
+}
+
+// getCachedLog reads the entry at index from the entry cache if it's there.
+func (w *WAL) getCachedLog(index uint64, log *types.LogEntry) bool {
+	if w.cache == nil {
+		return false
+	}
+	if w.cache.get(index, log, true) {
+		w.metrics.entryCacheHits.Inc()
+		return true
+	}
+	w.metrics.entryCacheMisses.Inc()
+	return false
+}
+
+// readLog reads the entry at index from the segments in s and caches it if
+// there have been no truncations since gen.
+func (w *WAL) readLog(s *state, gen, index uint64, log *types.LogEntry) error {
+	if err := s.getLog(index, log); err != nil {
+		return w.countReadError(readPhaseRead, err)
+	}
+	log.Index = index
+	w.metrics.entryBytesRead.Add(float64(len(log.Data)))
+	if w.cache != nil {
+		w.cache.addRead(gen, log)
+	}
+	return nil
+}
+
+// GetLogMeta gets the metadata (Term, Type, Meta and AppendedAt) of the log
+// entry at a given index without reading its Data which is left untouched.
+func (w *WAL) GetLogMeta(index uint64, log *types.LogEntry) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	if w.cache != nil && w.cache.get(index, log, false) {
+		return nil
+	}
+	s, release := w.acquireState()
+	defer release()
+
+	if err := s.getLogMeta(index, log); err != nil {
+		return w.countReadError(readPhaseRead, err)
+	}
+	log.Index = index
+	return nil
+}
+
+// GetLogReader returns a reader that streams the Data of the entry at index
+// from its segment file along with the length of the Data. Unlike GetLog the
+// Data is never held in memory all at once which suits very large entries. The
+// reader must be closed when done with. Until then the segment it reads from
+// isn't deleted even if the entry is truncated. ErrNotFound is returned if
+// index is not in the log.
+func (w *WAL) GetLogReader(index uint64) (io.ReadCloser, int64, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, 0, err
+	}
+	w.metrics.entriesRead.Inc()
+
+	s, release := w.acquireState()
+	first, last := s.firstIndex(), s.lastIndex()
+	if last == 0 || index < first || index > last {
+		release()
+		return nil, 0, ErrNotFound
+	}
+	seg, ok := s.findSegment(index)
+	if !ok {
+		release()
+		return nil, 0, ErrNotFound
+	}
+
+	var (
+		rd   io.Reader
+		size int64
+	)
+	sr, releaseReader, err := segmentReader(seg.r)
+	if err != nil {
+		release()
+		return nil, 0, w.countReadError(readPhaseRead, err)
+	}
+	if dr, ok := sr.(types.SegmentDataReader); ok {
+		rd, size, err = dr.GetLogReader(index)
+	} else {
+		// Fall back to reading the whole entry for SegmentReaders that can't
+		// stream.
+		var le types.LogEntry
+		err = sr.GetLog(index, &le)
+		rd, size = bytes.NewReader(le.Data), int64(len(le.Data))
+	}
+	if err != nil {
+		err = w.countReadError(readPhaseRead, wrapSegmentError(seg.SegmentInfo, index, err))
+		releaseReader()
+		release()
+		return nil, 0, err
+	}
+	w.metrics.entryBytesRead.Add(float64(size))
+	return &logReader{Reader: rd, release: func() {
+		releaseReader()
+		release()
+	}}, size, nil
+}
+
+// logReader holds the state a GetLogReader reader reads from until it's
+// closed.
+type logReader struct {
+	io.Reader
+	once    sync.Once
+	release func()
+}
+
+func (r *logReader) Close() error {
+	r.once.Do(r.release)
+	return nil
+}
+
+// TermAt returns the Term of the entry at index without reading the entry's
+// data. Entries stored without a Term have Term zero. ErrNotFound is returned if
+// index is not in the log.
+func (w *WAL) TermAt(index uint64) (uint64, error) {
+	if err := w.checkClosed(); err != nil {
+		return 0, err
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.termAt(index)
+}
+
+// FirstIndexOfTerm returns the lowest index in the log with the given Term. It
+// returns ErrNotFound if no entry in the log has that Term.
+func (w *WAL) FirstIndexOfTerm(term uint64) (uint64, error) {
+	if err := w.checkClosed(); err != nil {
+		return 0, err
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.firstIndexOfTerm(term)
+}
+
+// LastIndexOfTerm returns the highest index in the log with the given Term. It
+// returns ErrNotFound if no entry in the log has that Term.
+func (w *WAL) LastIndexOfTerm(term uint64) (uint64, error) {
+	if err := w.checkClosed(); err != nil {
+		return 0, err
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.lastIndexOfTerm(term)
+}
+
+// FirstIndexAtOrAfter returns the lowest index in the log that was appended at
+// or after t. Append times are assumed not to go backwards through the log;
+// entries stored without an append time are treated as older than any t. It
+// returns ErrNotFound if every entry was appended before t.
+func (w *WAL) FirstIndexAtOrAfter(t time.Time) (uint64, error) {
+	if err := w.checkClosed(); err != nil {
+		return 0, err
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.firstIndexAtOrAfter(t)
+}
+
+// Stats is a point-in-time summary of the WAL's contents.
+type Stats struct {
+	// FirstIndex and LastIndex are the range of indexes in the log. Both are zero
+	// if the log is empty.
+	FirstIndex uint64
+	LastIndex  uint64
+
+	// Entries is the number of entries in the log, as returned by Len.
+	Entries uint64
+
+	// Segments is the number of segments including the tail.
+	Segments int
+
+	// OldestAppendedAt and NewestAppendedAt are the append times of the entries
+	// at FirstIndex and LastIndex. They are zero if the log is empty or the
+	// entries were written before append times were recorded.
+	OldestAppendedAt time.Time
+	NewestAppendedAt time.Time
+}
+
+// Stats returns a summary of the current state of the WAL.
+func (w *WAL) Stats() (Stats, error) {
+	if err := w.checkClosed(); err != nil {
+		return Stats{}, err
+	}
+	s, release := w.acquireState()
+	defer release()
+
+	st := Stats{
+		FirstIndex: s.firstIndex(),
+		LastIndex:  s.lastIndex(),
+		Entries:    s.len(),
+		Segments:   s.segments.Len(),
+	}
+	if st.LastIndex == 0 {
+		return st, nil
+	}
+	var le types.LogEntry
+	if err := s.getLogMeta(st.FirstIndex, &le); err != nil {
+		return Stats{}, err
+	}
+	st.OldestAppendedAt = le.AppendedAt
+	if err := s.getLogMeta(st.LastIndex, &le); err != nil {
+		return Stats{}, err
+	}
+	st.NewestAppendedAt = le.AppendedAt
+	return st, nil
+}
+
+// Segments returns the info of every segment in the log in index order, the
+// last one being the unsealed tail.
+func (w *WAL) Segments() ([]types.SegmentInfo, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	s, release := w.acquireState()
+	defer release()
+	return s.Persistent().Segments, nil
+}
+
+// Verify checks the integrity of every entry in the log. Segments whose reader
+// implements types.SegmentVerifier check themselves which for the default
+// SegmentFiler means every entry's checksum, or for sealed segments the
+// checksums of the whole file, and, if WithHMAC is used, each sealed segment's
+// signature. Entries in other segments are just read. It
+// returns the first error found which wraps ErrCorrupt if it's due to bad data.
+func (w *WAL) Verify() error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	s, release := w.acquireState()
+	defer release()
+
+	first, last := s.firstIndex(), s.lastIndex()
+	if last == 0 {
+		return nil
+	}
+	var le types.LogEntry
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if seg.r == nil {
+			continue
+		}
+		sr, releaseReader, err := segmentReader(seg.r)
+		if err != nil {
+			return w.countReadError(readPhaseVerify, err)
+		}
+		v, ok := sr.(types.SegmentVerifier)
+		if ok {
+			err = v.Verify()
+		}
+		releaseReader()
+		if ok {
+			if err != nil {
+				return w.countReadError(readPhaseVerify, fmt.Errorf("segment %d failed verification: %w", seg.ID, err))
+			}
+			continue
+		}
+		lo, hi := seg.BaseIndex, seg.MaxIndex
+		if seg.MinIndex > lo {
+			lo = seg.MinIndex
+		}
+		if lo < first {
+			lo = first
+		}
+		if hi == 0 || hi > last {
+			hi = last
+		}
+		for idx := lo; idx <= hi; idx++ {
+			if err := seg.r.GetLog(idx, &le); err != nil {
+				return w.countReadError(readPhaseVerify, fmt.Errorf("segment %d failed verification at index %d: %w", seg.ID, idx, err))
+			}
+		}
+	}
+	return nil
+}
+
+// StoreLogs stores multiple log entries. It reads the entries' Data and Meta
+// while it runs, and may still be writing them until it returns, so the caller
+// must not modify them before then. Once it returns nothing refers to them and
+// the caller's buffers may be reused. A custom SegmentWriter that keeps them
+// for IO after Append returns breaks that unless WithCopyOnAppend is used.
+func (w *WAL) StoreLogs(encoded []types.LogEntry) error {
+	if err := w.checkWritable(); err != nil {
+		return err
+	}
+	if len(encoded) < 1 {
+		return nil
+	}
+	size := entriesSize(encoded)
+	if err := w.throttleWrite(size); err != nil {
+		return err
+	}
+	done, err := w.acquirePending(size)
+	if err != nil {
+		return err
+	}
+	defer done()
+	leave := w.enterPipeline()
+	defer leave()
+
+	owned := false
+	if w.copyOnAppend {
+		encoded = copyEntries(encoded, size)
+		owned = true
+	}
+	if w.cache != nil {
+		// Stamp append times here rather than leaving it to the segment so that
+		// the cached entries match what is written.
+		now := time.Now()
+		stamped := encoded
+		if !owned {
+			stamped = make([]types.LogEntry, len(encoded))
+		}
+		for i, l := range encoded {
+			if l.AppendedAt.IsZero() {
+				l.AppendedAt = now
+			}
+			stamped[i] = l
+		}
+		encoded = stamped
+	}
+	sums := w.sumPayloads(encoded)
+	wait, err := w.storeLogsLocked(encoded, sums)
+	if err != nil || wait == nil {
+		return err
+	}
+	if sums != nil {
+		synced := wait
+		wait = func() error {
+			err := synced()
+			if err == nil {
+				sums.verify(encoded, "while it was being synced")
+			}
+			return err
+		}
+	}
+	return w.awaitAppended(wait, encoded)
+}
+
+// copyEntries returns a copy of entries whose Data and Meta are copied into
+// one buffer of size bytes.
+func copyEntries(entries []types.LogEntry, size int64) []types.LogEntry {
+	copied := make([]types.LogEntry, len(entries))
+	buf := make([]byte, 0, size)
+	for i, e := range entries {
+		if e.Meta != nil {
+			buf = append(buf, e.Meta...)
+			e.Meta = buf[len(buf)-len(e.Meta) : len(buf) : len(buf)]
+		}
+		if e.Data != nil {
+			buf = append(buf, e.Data...)
+			e.Data = buf[len(buf)-len(e.Data) : len(buf) : len(buf)]
+		}
+		copied[i] = e
+	}
+	return copied
+}
+
+// storeLogsLocked takes writeMu and appends encoded to the tail. If the
+// append was pipelined the func returned must be called after to wait for it
+// to be synced. If sums is set the entries are checked against it either side
+// of the append.
+func (w *WAL) storeLogsLocked(encoded []types.LogEntry, sums payloadSums) (func() error, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	awaitCh := w.awaitRotate
+	if awaitCh != nil {
+		// We managed to race for writeMu with the background rotate operation which
+		// needs to complete first. Wait for it to complete.
+		w.writeMu.Unlock()
+		<-awaitCh
+		w.writeMu.Lock()
+	}
+
+	if err := w.checkForced(); err != nil {
+		return nil, err
+	}
+	if w.failErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailed, w.failErr)
+	}
+
+	s, release, err := w.acquireAppendStateLocked(encoded[0].Index)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Verify monotonicity since we assume it
+	lastIdx := w.lastAppendedLocked(s)
+
+	// Encode logs
+	nBytes := uint64(0)
+	for i, l := range encoded {
+		if lastIdx > 0 && l.Index != (lastIdx+1) {
+			return nil, fmt.Errorf("%w: tried to append index %d after %d", ErrConflict, l.Index, lastIdx)
+		}
+		lastIdx = l.Index
+		nBytes += uint64(len(encoded[i].Data))
+	}
+	if w.minFreeBytes > 0 {
+		if err := w.checkSpace(s.getTailInfo().Dir, nBytes+uint64(len(encoded))*entryOverhead); err != nil {
+			return nil, err
+		}
+	}
+	sums.verify(encoded, "before it was written")
+	wait, err := w.appendTailLocked(s.tail, encoded)
+	if ferr := w.checkForced(); ferr != nil {
+		// The tail was closed from under the append so whatever it returned
+		// says nothing about the disk.
+		return nil, ferr
+	}
+	if err != nil {
+		return nil, w.appendFailedLocked(err)
+	}
+	sums.verify(encoded, "while it was being written")
+	if w.cache != nil && wait == nil {
+		w.cache.addAppended(encoded)
+	}
+	w.metrics.appends.Inc()
+	w.metrics.entriesWritten.Add(float64(len(encoded)))
+	w.metrics.bytesWritten.Add(float64(nBytes))
+
+	// Check if we need to roll logs
+	sealed, indexStart, err := s.tail.Sealed()
+	if err != nil {
+		return nil, err
 	}
-}
-
-// FirstIndex returns the first index written. 0 for no entries.
-func (w *WAL) FirstIndex() (uint64, error) {
-	if err := w.checkClosed(); err != nil {
-		return 0, err
+	if sealed {
+		// Async rotation to allow caller to do more work while we mess with files.
+		w.triggerRotateLocked(indexStart)
 	}
-	s, release := w.acquireState()
-	defer release()
-	return s.firstIndex(), nil
+	return wait, nil
 }
 
-// LastIndex returns the last index written. 0 for no entries.
-func (w *WAL) LastIndex() (uint64, error) {
-	if err := w.checkClosed(); err != nil {
-		return 0, err
-	}
+// acquireAppendStateLocked acquires the state to append entries starting at
+// first to. The caller must hold writeMu and call release when it's done.
+//
+// Special case, if the log is currently empty and this is the first append,
+// we allow any starting index. We've already created an empty tail segment
+// though and probably started at index 1. Rather than break the invariant
+// that BaseIndex is the same as the first index in the segment (which causes
+// lots of extra complexity lower down) we simply accept the additional cost
+// in this rare case of removing the current tail and re-creating it with the
+// correct BaseIndex for the first log we are about to append. In practice,
+// this only happens on startup of a new server, or after a user snapshot
+// restore which are both rare enough events that the cost is not significant
+// since the cost of creating other state or restoring snapshots is larger
+// anyway. We could theoretically defer creating at all until we know for sure
+// but that is more complex internally since then everything has to handle the
+// uninitialized case where the is no tail yet with special cases.
+func (w *WAL) acquireAppendStateLocked(first uint64) (*state, func(), error) {
 	s, release := w.acquireState()
-	defer release()
-	return s.lastIndex(), nil
-}
 
-// GetLog gets a log entry at a given index.
-func (w *WAL) GetLog(index uint64, log *types.LogEntry) error {
-	if err := w.checkClosed(); err != nil {
-		return err
+	// Note we check first against the tail's BaseIndex rather than 1 so that this
+	// works even if we choose to initialize first segments to a BaseIndex other
+	// than 1. For example it might be marginally more performant to choose to
+	// initialize to the old MaxIndex + 1 after a truncate since that is what our
+	// raft library will use after a restore currently so will avoid this case on
+	// the next append, while still being generally safe.
+	if w.lastAppendedLocked(s) == 0 && first != s.getTailInfo().BaseIndex {
+		release()
+		w.stateMu.Lock()
+		err := w.resetEmptyFirstSegmentBaseIndex(first)
+		w.stateMu.Unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		// Re-read state now we just changed it.
+		s, release = w.acquireState()
 	}
-	s, release := w.acquireState()
-	defer release()
-	w.metrics.entriesRead.Inc()
 
-	if err := s.getLog(index, log); err != nil {
-		return err
+	// If the last rotation failed, for example because there wasn't room for
+	// a new segment, the tail is still sealed so try again.
+	if sealed, indexStart, err := s.tail.Sealed(); err == nil && sealed {
+		release()
+		w.stateMu.Lock()
+		err := w.rotateSegmentLocked(indexStart)
+		w.stateMu.Unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		s, release = w.acquireState()
 	}
-	log.Index = index
-	w.metrics.entryBytesRead.Add(float64(len(log.Data)))
-	return nil
+	return s, release, nil
 }
 
-// StoreLogs stores multiple log entries.
-func (w *WAL) StoreLogs(encoded []types.LogEntry) error {
-	if err := w.checkClosed(); err != nil {
+// AppendLogFrom appends the entry at idx with exactly size bytes of data read
+// from r, without first reading it all into memory like StoreLogs needs. The
+// data is copied into the tail segment a chunk at a time and its checksum
+// computed as it goes. The entry has no Term, Type or Meta. If r fails or runs
+// out early nothing is appended. Entries appended this way aren't cached.
+func (w *WAL) AppendLogFrom(idx uint64, r io.Reader, size int64) error {
+	if err := w.checkWritable(); err != nil {
 		return err
 	}
-	if len(encoded) < 1 {
-		return nil
+	if err := w.throttleWrite(size); err != nil {
+		return err
+	}
+	done, err := w.acquirePending(size)
+	if err != nil {
+		return err
 	}
+	defer done()
 
 	w.writeMu.Lock()
 	defer w.writeMu.Unlock()
 
-	awaitCh := w.awaitRotate
-	if awaitCh != nil {
-		// We managed to race for writeMu with the background rotate operation which
-		// needs to complete first. Wait for it to complete.
+	if awaitCh := w.awaitRotate; awaitCh != nil {
 		w.writeMu.Unlock()
 		<-awaitCh
 		w.writeMu.Lock()
 	}
 
-	s, release := w.acquireState()
+	if err := w.checkForced(); err != nil {
+		return err
+	}
+	if w.failErr != nil {
+		return fmt.Errorf("%w: %w", ErrFailed, w.failErr)
+	}
+
+	s, release, err := w.acquireAppendStateLocked(idx)
+	if err != nil {
+		return err
+	}
 	defer release()
 
-	// Verify monotonicity since we assume it
-	lastIdx := s.lastIndex()
-
-	// Special case, if the log is currently empty and this is the first append,
-	// we allow any starting index. We've already created an empty tail segment
-	// though and probably started at index 1. Rather than break the invariant
-	// that BaseIndex is the same as the first index in the segment (which causes
-	// lots of extra complexity lower down) we simply accept the additional cost
-	// in this rare case of removing the current tail and re-creating it with the
-	// correct BaseIndex for the first log we are about to append. In practice,
-	// this only happens on startup of a new server, or after a user snapshot
-	// restore which are both rare enough events that the cost is not significant
-	// since the cost of creating other state or restoring snapshots is larger
-	// anyway. We could theoretically defer creating at all until we know for sure
-	// but that is more complex internally since then everything has to handle the
-	// uninitialized case where the is no tail yet with special cases.
-	ti := s.getTailInfo()
-	// Note we check index != ti.BaseIndex rather than index != 1 so that this
-	// works even if we choose to initialize first segments to a BaseIndex other
-	// than 1. For example it might be marginally more performant to choose to
-	// initialize to the old MaxIndex + 1 after a truncate since that is what our
-	// raft library will use after a restore currently so will avoid this case on
-	// the next append, while still being generally safe.
-	if lastIdx == 0 && encoded[0].Index != ti.BaseIndex {
-		if err := w.resetEmptyFirstSegmentBaseIndex(encoded[0].Index); err != nil {
+	if lastIdx := w.lastAppendedLocked(s); lastIdx > 0 && idx != lastIdx+1 {
+		return fmt.Errorf("%w: tried to append index %d after %d", ErrConflict, idx, lastIdx)
+	}
+
+	if w.minFreeBytes > 0 && size > 0 {
+		if err := w.checkSpace(s.getTailInfo().Dir, uint64(size)+entryOverhead); err != nil {
 			return err
 		}
-
-		// Re-read state now we just changed it.
-		s2, release2 := w.acquireState()
-		defer release2()
-
-		// Overwrite the state we read before so the code below uses the new state
-		s = s2
 	}
 
-	// Encode logs
-	nBytes := uint64(0)
-	for i, l := range encoded {
-		if lastIdx > 0 && l.Index != (lastIdx+1) {
-			return fmt.Errorf("non-monotonic log entries: tried to append index %d after %d", l.Index, lastIdx)
+	e := types.LogEntry{Index: idx, AppendedAt: time.Now()}
+	if sa, ok := s.tail.(types.SegmentStreamAppender); ok {
+		err = sa.AppendFrom(e, r, size)
+	} else {
+		// The SegmentFiler in use can't stream so the best we can do is read it
+		// all first.
+		if size < 0 {
+			return fmt.Errorf("invalid entry size %d", size)
+		}
+		if size > math.MaxInt {
+			// Only possible on 32-bit platforms.
+			return fmt.Errorf("entry size %d is too large to buffer", size)
+		}
+		e.Data = make([]byte, size)
+		if _, err = io.ReadFull(r, e.Data); err == nil {
+			err = s.tail.Append([]types.LogEntry{e})
 		}
-		lastIdx = l.Index
-		nBytes += uint64(len(encoded[i].Data))
 	}
-	if err := s.tail.Append(encoded); err != nil {
-		return err
+	if ferr := w.checkForced(); ferr != nil {
+		return ferr
+	}
+	if err != nil {
+		return w.appendFailedLocked(err)
 	}
 	w.metrics.appends.Inc()
-	w.metrics.entriesWritten.Add(float64(len(encoded)))
-	w.metrics.bytesWritten.Add(float64(nBytes))
+	w.metrics.entriesWritten.Add(1)
+	w.metrics.bytesWritten.Add(float64(size))
 
-	// Check if we need to roll logs
 	sealed, indexStart, err := s.tail.Sealed()
 	if err != nil {
 		return err
 	}
 	if sealed {
-		// Async rotation to allow caller to do more work while we mess with files.
 		w.triggerRotateLocked(indexStart)
 	}
 	return nil
 }
 
 func (w *WAL) TruncateFront(index uint64) error {
+	return w.TruncateFrontWithReason(index, "")
+}
+
+// TruncateFrontWithReason is TruncateFront, recording reason in the audit log
+// if one is kept with WithAuditLog.
+func (w *WAL) TruncateFrontWithReason(index uint64, reason string) error {
+	var (
+		deleteOld func()
+		rec       *AuditRecord
+	)
 	err := func() error {
-		if err := w.checkClosed(); err != nil {
+		if err := w.checkWritable(); err != nil {
 			return err
 		}
-		w.writeMu.Lock()
-		defer w.writeMu.Unlock()
+		// Truncations that leave some of the log, as raft's after a snapshot do,
+		// don't touch the tail so they only need stateMu and appends carry on
+		// while the metadata is committed. Removing everything replaces the tail
+		// which needs writeMu as well. Appends only add to the log so once
+		// stateMu is held the answer can't change.
+		unlock := w.lockTruncateFront(index)
+		defer unlock()
 
 		s, release := w.acquireState()
 		defer release()
@@ -467,19 +1491,49 @@ func (w *WAL) TruncateFront(index uint64) error {
 		// StoreLogs, the firstIndex will be set to the index of the first log
 		// (special case with empty WAL).
 
-		return w.truncateHeadLocked(index)
+		rec = &AuditRecord{Op: AuditTruncateFront, Index: index, Reason: reason}
+		if first, last := s.firstIndex(), s.lastIndex(); first > 0 {
+			rec.First, rec.Last = first, last
+			if index <= last {
+				rec.Last = index - 1
+			}
+		}
+		var err error
+		deleteOld, err = w.truncateHeadLocked(index, 0, AuditRecord{Cause: AuditTruncateFront, Reason: reason})
+		if w.cache != nil {
+			w.cache.truncate(index, math.MaxUint64)
+		}
+		return err
 	}()
+	if err == nil && rec != nil {
+		w.recordAudit(*rec)
+	}
+	if deleteOld != nil {
+		// Delete the old segments now that appends aren't held up.
+		deleteOld()
+	}
 	w.metrics.truncations.WithLabelValues("front", fmt.Sprintf("%t", err == nil))
 	return err
 }
 
 func (w *WAL) TruncateBack(index uint64) error {
+	return w.TruncateBackWithReason(index, "")
+}
+
+// TruncateBackWithReason is TruncateBack, recording reason in the audit log if
+// one is kept with WithAuditLog.
+func (w *WAL) TruncateBackWithReason(index uint64, reason string) error {
+	var rec *AuditRecord
 	err := func() error {
-		if err := w.checkClosed(); err != nil {
+		if err := w.checkWritable(); err != nil {
 			return err
 		}
+		undrain := w.drainPipeline()
+		defer undrain()
 		w.writeMu.Lock()
 		defer w.writeMu.Unlock()
+		w.stateMu.Lock()
+		defer w.stateMu.Unlock()
 
 		s, release := w.acquireState()
 		defer release()
@@ -493,12 +1547,87 @@ func (w *WAL) TruncateBack(index uint64) error {
 			return fmt.Errorf("truncate back err %w: first=%d, last=%d, index=%d", ErrOutOfRange, first, last, index)
 		}
 
-		return w.truncateTailLocked(index)
+		rec = &AuditRecord{Op: AuditTruncateBack, Index: index, First: index + 1, Last: last, Reason: reason}
+		err := w.truncateTailLocked(index, AuditRecord{Cause: AuditTruncateBack, Reason: reason})
+		if w.cache != nil {
+			w.cache.truncate(0, index)
+		}
+		return err
 	}()
+	if err == nil && rec != nil {
+		w.recordAudit(*rec)
+	}
 	w.metrics.truncations.WithLabelValues("back", fmt.Sprintf("%t", err == nil))
 	return err
 }
 
+// ResetTo removes every entry in the log and leaves it empty with a new tail
+// segment starting at nextIndex, ready for the first entry after a snapshot is
+// installed. It's the same as a TruncateFront past the last index followed by
+// an append at nextIndex, but done in one step so that readers only ever see
+// the old log or the empty one, and the tail never has to be replaced again
+// when the append is at nextIndex. An append at any other index still works as
+// it does for any empty log.
+func (w *WAL) ResetTo(nextIndex uint64) error {
+	return w.ResetToWithReason(nextIndex, "")
+}
+
+// ResetToWithReason is ResetTo, recording reason in the audit log if one is
+// kept with WithAuditLog.
+func (w *WAL) ResetToWithReason(nextIndex uint64, reason string) error {
+	if nextIndex == 0 {
+		return fmt.Errorf("%w: can't reset to index 0", ErrOutOfRange)
+	}
+	var (
+		deleteOld func()
+		rec       *AuditRecord
+	)
+	err := func() error {
+		if err := w.checkWritable(); err != nil {
+			return err
+		}
+		undrain := w.drainPipeline()
+		defer undrain()
+		w.writeMu.Lock()
+		defer w.writeMu.Unlock()
+		if awaitCh := w.awaitRotate; awaitCh != nil {
+			// Let a pending rotation seal the old tail first rather than the
+			// new one.
+			w.writeMu.Unlock()
+			<-awaitCh
+			w.writeMu.Lock()
+		}
+		w.stateMu.Lock()
+		defer w.stateMu.Unlock()
+
+		s, release := w.acquireState()
+		first, last, tail := s.firstIndex(), s.lastIndex(), s.getTailInfo()
+		release()
+		if last == 0 && tail != nil && tail.BaseIndex == nextIndex && s.segments.Len() == 1 {
+			// Already reset.
+			return nil
+		}
+
+		rec = &AuditRecord{Op: AuditResetTo, Index: nextIndex, Reason: reason}
+		if last > 0 {
+			rec.First, rec.Last = first, last
+		}
+		var err error
+		deleteOld, err = w.truncateHeadLocked(math.MaxUint64, nextIndex, AuditRecord{Cause: AuditResetTo, Reason: reason})
+		if w.cache != nil {
+			w.cache.reset()
+		}
+		return err
+	}()
+	if err == nil && rec != nil {
+		w.recordAudit(*rec)
+	}
+	if deleteOld != nil {
+		deleteOld()
+	}
+	return err
+}
+
 func (w *WAL) triggerRotateLocked(indexStart uint64) {
 	if atomic.LoadUint32(&w.closed) == 1 {
 		return
@@ -507,24 +1636,25 @@ func (w *WAL) triggerRotateLocked(indexStart uint64) {
 	w.triggerRotate <- indexStart
 }
 
-func (w *WAL) runRotate() {
+func (w *WAL) runRotate(trigger chan uint64) {
 	for {
-		indexStart := <-w.triggerRotate
+		indexStart := <-trigger
 
 		w.writeMu.Lock()
 
 		// Either triggerRotate was closed by Close, or Close raced with a real
-		// trigger, either way shut down without changing anything else. In the
-		// second case the segment file is sealed but meta data isn't updated yet
-		// but we have to handle that case during recovery anyway so it's simpler
-		// not to try and complete the rotation here on an already-closed WAL.
+		// trigger, either way shut down without changing anything else. Close
+		// finishes the rotation itself in the second case. If the WAL has been
+		// reopened since, its own runRotate has taken over.
 		closed := atomic.LoadUint32(&w.closed)
-		if closed == 1 {
+		if closed == 1 || trigger != w.triggerRotate {
 			w.writeMu.Unlock()
 			return
 		}
 
+		w.stateMu.Lock()
 		err := w.rotateSegmentLocked(indexStart)
+		w.stateMu.Unlock()
 		if err != nil {
 			// The only possible errors indicate bugs and could probably validly be
 			// panics, but be conservative and just attempt to log them instead!
@@ -555,13 +1685,27 @@ func (w *WAL) rotateSegmentLocked(indexStart uint64) error {
 		tail.SealTime = time.Now()
 		tail.MaxIndex = newState.tail.LastIndex()
 		tail.IndexStart = indexStart
+		if cs, ok := newState.tail.(types.SegmentChecksummer); ok {
+			tail.Checksum, _ = cs.SealedChecksum()
+		}
 		w.metrics.lastSegmentAgeSeconds.Set(tail.SealTime.Sub(tail.CreateTime).Seconds())
 
+		var fin func()
+		if w.segmentLRU != nil {
+			// Leave the sealed segment to the LRU like the others rather than
+			// keeping the writer's file open.
+			old := tail.r
+			tail.r = newLazyReader(w.sf, tail.SegmentInfo, w.segmentLRU)
+			fin = func() {
+				w.closeSegments([]io.Closer{old})
+			}
+		}
+
 		// Update the old tail with the seal time etc.
 		newState.segments = newState.segments.Set(tail.BaseIndex, *tail)
 
 		post, err := w.createNextSegment(newState)
-		return nil, post, err
+		return fin, post, err
 	}
 	w.metrics.segmentRotations.Inc()
 	return w.mutateStateLocked(txn)
@@ -588,6 +1732,14 @@ func (w *WAL) createNextSegment(newState *state) (func() error, error) {
 
 	// Create a new segment
 	newTail := w.newSegment(newState.nextSegmentID, nextBaseIndex)
+	var prev *types.SegmentInfo
+	if tail != nil {
+		prev = &tail.SegmentInfo
+	}
+	newTail.Dir = w.placeSegment(prev, uint64(newTail.SizeLimit))
+	if err := w.checkSpace(newTail.Dir, uint64(newTail.SizeLimit)); err != nil {
+		return nil, err
+	}
 	newState.nextSegmentID++
 	ss := segmentState{
 		SegmentInfo: newTail,
@@ -642,7 +1794,8 @@ func (w *WAL) resetEmptyFirstSegmentBaseIndex(newBaseIndex uint64) error {
 			newState.tail = nil
 			fin = func() {
 				w.closeSegments([]io.Closer{tailSeg.r})
-				w.deleteSegments(map[uint64]uint64{tailSeg.ID: tailSeg.BaseIndex})
+				w.deleteSegments(map[uint64]uint64{tailSeg.ID: tailSeg.BaseIndex},
+					AuditRecord{Reason: "empty tail replaced to start at the first appended index"})
 			}
 		}
 
@@ -661,7 +1814,66 @@ func (w *WAL) resetEmptyFirstSegmentBaseIndex(newBaseIndex uint64) error {
 	return w.mutateStateLocked(txn)
 }
 
-func (w *WAL) truncateHeadLocked(newMin uint64) error {
+// lockTruncateFront takes the locks TruncateFront(index) needs and returns a
+// func that releases them.
+func (w *WAL) lockTruncateFront(index uint64) func() {
+	w.stateMu.Lock()
+	if index <= w.loadState().lastIndex() {
+		return w.stateMu.Unlock
+	}
+	w.stateMu.Unlock()
+	undrain := w.drainPipeline()
+	w.writeMu.Lock()
+	w.stateMu.Lock()
+	return func() {
+		w.stateMu.Unlock()
+		w.writeMu.Unlock()
+		undrain()
+	}
+}
+
+// deleteOnce runs fn either when the returned func is called, if finalizer
+// has already been called by then, or else in the background when finalizer
+// is called. It lets TruncateFront delete segments itself once it's unlocked
+// rather than in whichever call releases the old state last, which may be an
+// append holding writeMu.
+func (w *WAL) deleteOnce(fn func()) (finalizer func(), deleteNow func()) {
+	const (
+		pending = iota
+		released
+		leftToFinalizer
+	)
+	var st int32
+	finalizer = func() {
+		if atomic.CompareAndSwapInt32(&st, pending, released) {
+			return
+		}
+		w.deletesMu.Lock()
+		w.deletes.Add(1)
+		w.deletesMu.Unlock()
+		go func() {
+			defer w.deletes.Done()
+			fn()
+		}()
+	}
+	deleteNow = func() {
+		if atomic.CompareAndSwapInt32(&st, pending, leftToFinalizer) {
+			// Readers are still using the segments.
+			return
+		}
+		fn()
+	}
+	return finalizer, deleteNow
+}
+
+// truncateHeadLocked removes every entry before newMin. If that's all of them
+// the new empty tail starts at nextBaseIndex, or the old last index plus one if
+// it's zero. why says why segments are deleted in the audit log.
+func (w *WAL) truncateHeadLocked(newMin, nextBaseIndex uint64, why AuditRecord) (func(), error) {
+	var (
+		deleteOld func()
+		toArchive []types.SegmentInfo
+	)
 	txn := stateTxn(func(newState *state) (func(), func() error, error) {
 		oldLastIndex := newState.lastIndex()
 
@@ -691,9 +1903,19 @@ func (w *WAL) truncateHeadLocked(newMin uint64) error {
 
 			toDelete[seg.ID] = seg.BaseIndex
 			toClose = append(toClose, seg.r)
+			if w.archiver != nil && why.Cause == AuditTruncateFront {
+				toArchive = append(toArchive, seg.SegmentInfo)
+			}
 			newState.segments = newState.segments.Delete(seg.BaseIndex)
 			nTruncated += (maxIdx - seg.MinIndex + 1) // +1 because MaxIndex is inclusive
 		}
+		if len(toArchive) > 0 {
+			// Record them before the truncation is committed so they're
+			// archived even if we crash before the finalizer runs.
+			if err := w.updatePendingArchives(toArchive, nil); err != nil {
+				return nil, nil, err
+			}
+		}
 
 		// There may not be any segments (left) but if there are, update the new
 		// head's MinIndex.
@@ -706,11 +1928,14 @@ func (w *WAL) truncateHeadLocked(newMin uint64) error {
 		} else {
 			// If there is no head any more, then there is no tail either! We should
 			// create a new blank one ready for use when we next append like we do
-			// during initialization. As an optimization, we create it with a
-			// BaseIndex of the old MaxIndex + 1 since this is what our Raft library
-			// uses as the next log index after a restore so this avoids recreating
-			// the files a second time on the next append.
-			newState.nextBaseIndex = oldLastIndex + 1
+			// during initialization. As an optimization, unless told otherwise we
+			// create it with a BaseIndex of the old MaxIndex + 1 since this is what
+			// our Raft library uses as the next log index after a restore so this
+			// avoids recreating the files a second time on the next append.
+			if nextBaseIndex == 0 {
+				nextBaseIndex = oldLastIndex + 1
+			}
+			newState.nextBaseIndex = nextBaseIndex
 			pc, err := w.createNextSegment(newState)
 			if err != nil {
 				return nil, nil, err
@@ -721,17 +1946,26 @@ func (w *WAL) truncateHeadLocked(newMin uint64) error {
 
 		// Return a finalizer that will be called when all readers are done with the
 		// segments in the current state to close and delete old segments.
-		fin := func() {
+		fin, del := w.deleteOnce(func() {
 			w.closeSegments(toClose)
-			w.deleteSegments(toDelete)
-		}
+			w.archiveSegments(toArchive, toDelete)
+			w.deleteSegments(toDelete, why)
+		})
+		deleteOld = del
 		return fin, postCommit, nil
 	})
 
-	return w.mutateStateLocked(txn)
+	if err := w.mutateStateLocked(txn); err != nil {
+		// Any segments recorded as pending archive are left so, as the
+		// truncation may have been committed before the error. If it wasn't
+		// they're dropped when the WAL is next opened since they're still in
+		// the log.
+		return nil, err
+	}
+	return deleteOld, nil
 }
 
-func (w *WAL) truncateTailLocked(newMax uint64) error {
+func (w *WAL) truncateTailLocked(newMax uint64, why AuditRecord) error {
 	txn := stateTxn(func(newState *state) (func(), func() error, error) {
 		// Reverse iterate the segments to find any that are entirely deleted.
 		toDelete := make(map[uint64]uint64)
@@ -789,7 +2023,7 @@ func (w *WAL) truncateTailLocked(newMax uint64) error {
 		// segments in the current state to close and delete old segments.
 		fin := func() {
 			w.closeSegments(toClose)
-			w.deleteSegments(toDelete)
+			w.deleteSegments(toDelete, why)
 		}
 		return fin, pc, nil
 	})
@@ -797,13 +2031,20 @@ func (w *WAL) truncateTailLocked(newMax uint64) error {
 	return w.mutateStateLocked(txn)
 }
 
-func (w *WAL) deleteSegments(toDelete map[uint64]uint64) {
+// deleteSegments deletes the segments in toDelete, which maps their IDs to
+// their base indexes, recording each deletion in the audit log with the Cause
+// and Reason from why.
+func (w *WAL) deleteSegments(toDelete map[uint64]uint64, why AuditRecord) {
 	for ID, baseIndex := range toDelete {
 		if err := w.sf.Delete(baseIndex, ID); err != nil {
 			// This is not fatal. We can continue just old files might need manual
 			// cleanup somehow.
 			level.Error(w.logger).Log("msg", "failed to delete old segment", "baseIndex", baseIndex, "id", ID, "err", err)
+			continue
 		}
+		rec := why
+		rec.Op, rec.SegmentID, rec.BaseIndex = AuditDeleteSegment, ID, baseIndex
+		w.recordAudit(rec)
 	}
 }
 
@@ -826,25 +2067,70 @@ func (w *WAL) checkClosed() error {
 	return nil
 }
 
+// checkWritable is checkClosed for methods that change the WAL.
+func (w *WAL) checkWritable() error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
 // Close closes all open files related to the WAL. The WAL is in an invalid
 // state and should not be used again after this is called. It is safe (though a
 // no-op) to call it multiple times and concurrent reads and writes will either
 // complete safely or get ErrClosed returned depending on sequencing. Generally
 // reads and writes should be stopped before calling this to avoid propagating
 // errors to users during shutdown but it's safe from a data-race perspective.
+// If the tail segment has just been sealed Close finishes starting the next one
+// first, which means writing to disk, so it can block if the disk has gone away.
+// CloseContext doesn't.
 func (w *WAL) Close() error {
 	if old := atomic.SwapUint32(&w.closed, 1); old != 0 {
 		// Only close once
 		return nil
 	}
 
+	// The mover and merger take writeMu to swap in the segments they write
+	// so they have to be stopped first.
+	if w.moverStop != nil {
+		close(w.moverStop)
+		<-w.moverDone
+	}
+	if w.mergeStop != nil {
+		close(w.mergeStop)
+		<-w.mergeDone
+	}
+	if w.scrubStop != nil {
+		close(w.scrubStop)
+		<-w.scrubDone
+	}
+	if w.purgeStop != nil {
+		close(w.purgeStop)
+		<-w.purgeDone
+	}
+
 	// Wait for writes
+	undrain := w.drainPipeline()
+	defer undrain()
 	w.writeMu.Lock()
 	defer w.writeMu.Unlock()
-
-	// It doesn't matter if there is a rotation scheduled because runRotate will
-	// exist when it sees we are closed anyway.
-	w.awaitRotate = nil
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+
+	// If the tail was sealed but runRotate hasn't recorded it yet, do that now
+	// so that a clean shutdown doesn't leave it for Open to repair. runRotate
+	// exits without doing anything once it sees we are closed.
+	if err := w.finishRotateLocked(); err != nil {
+		level.Error(w.logger).Log("msg", "failed to finish rotation on close", "err", err)
+	}
+	if w.awaitRotate != nil {
+		// Unblock any writer waiting for the rotation.
+		close(w.awaitRotate)
+		w.awaitRotate = nil
+	}
 	// Awake and terminate the runRotate
 	close(w.triggerRotate)
 
@@ -870,8 +2156,220 @@ func (w *WAL) Close() error {
 	// lock and finalizers are only set on states that have been replaced under
 	// that same lock.
 	s.finalizer.Store(func() {
-		w.closeSegments(toClose)
+		w.releaseSegments(toClose)
+	})
+
+	w.deletesMu.Lock()
+	w.deletes.Wait()
+	w.deletesMu.Unlock()
+	if kw, ok := w.sf.(types.KeyWiper); ok {
+		kw.WipeKeys()
+	}
+	return w.closeMeta()
+}
+
+// closeMeta closes metaDB unless CloseContext already has.
+func (w *WAL) closeMeta() error {
+	w.metaCloseOnce.Do(func() {
+		w.metaCloseErr = w.metaDB.Close()
 	})
+	return w.metaCloseErr
+}
+
+// releaseSegments closes each of toClose that hasn't been already.
+func (w *WAL) releaseSegments(toClose []io.Closer) {
+	w.releaseMu.Lock()
+	if w.released == nil {
+		w.released = make(map[io.Closer]bool)
+	}
+	fresh := make([]io.Closer, 0, len(toClose))
+	for _, c := range toClose {
+		if c != nil && !w.released[c] {
+			w.released[c] = true
+			fresh = append(fresh, c)
+		}
+	}
+	w.releaseMu.Unlock()
+	w.closeSegments(fresh)
+}
+
+// errForceClosed is returned by calls that were in progress, or waiting to
+// start, when CloseContext released the WAL's files.
+var errForceClosed = fmt.Errorf("%w: the WAL was closed by CloseContext", ErrFailed)
+
+// checkForced returns errForceClosed if CloseContext has released the WAL's
+// files.
+func (w *WAL) checkForced() error {
+	if atomic.LoadUint32(&w.forced) != 0 {
+		return errForceClosed
+	}
+	return nil
+}
+
+// forceRelease marks the WAL failed and closes the tail, every segment in
+// before or the current state and the metadata store, without waiting for the
+// calls using them.
+func (w *WAL) forceRelease(before *state) {
+	atomic.StoreUint32(&w.forced, 1)
+	var toClose []io.Closer
+	for _, s := range []*state{before, w.loadState()} {
+		if s.tail != nil {
+			toClose = append(toClose, s.tail)
+		}
+		if s.segments == nil {
+			continue
+		}
+		it := s.segments.Iterator()
+		for !it.Done() {
+			_, seg, _ := it.Next()
+			toClose = append(toClose, seg.r)
+		}
+	}
+	w.releaseSegments(toClose)
+	// Closing the metadata store waits for a commit in progress, which may be
+	// the call that's stuck.
+	go func() {
+		if err := w.closeMeta(); err != nil {
+			level.Error(w.logger).Log("msg", "failed to close metadata store", "err", err)
+		}
+	}()
+}
+
+// finishRotateLocked rotates the tail if it's been sealed. The caller must hold
+// writeMu and stateMu.
+func (w *WAL) finishRotateLocked() error {
+	if w.readOnly || w.failErr != nil || w.checkForced() != nil {
+		return nil
+	}
+	s := w.loadState()
+	if s.tail == nil {
+		return nil
+	}
+	sealed, indexStart, err := s.tail.Sealed()
+	if err != nil || !sealed {
+		return err
+	}
+	return w.rotateSegmentLocked(indexStart)
+}
+
+// CloseContext is Close but stops waiting once ctx is done, for example when
+// the disk has gone away and an append or rotation is stuck in a write that
+// won't return. New calls get ErrClosed either way. If it stops waiting it
+// force-releases the WAL and returns an error wrapping ctx's: it's marked
+// failed and the tail, every open segment and the metadata store are closed
+// without waiting for the calls using them, even reads holding an old state.
+// Calls that were in progress or waiting for a lock then fail with ErrFailed,
+// or an error from the closed file, instead of hanging. What it can't release
+// is whatever a call stuck inside the operating system holds: the file, or for
+// a stuck metadata commit the metadata store, is only freed once that call
+// returns, and the goroutines waiting on it remain until then. A WAL released
+// this way can't be reopened.
+func (w *WAL) CloseContext(ctx context.Context) error {
+	before := w.loadState()
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		w.forceRelease(before)
+		return fmt.Errorf("gave up waiting for WAL to close and released its files: %w", ctx.Err())
+	}
+}
+
+// CloseWithTimeout is CloseContext with a context that's done after d.
+func (w *WAL) CloseWithTimeout(d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return w.CloseContext(ctx)
+}
+
+// Reopen closes the WAL, if it isn't already, and opens it again with the same
+// options, recovering the tail as Open does. It saves code embedding the WAL
+// from having to build a new one to recover from errors such as ErrFailed.
+// Calls made while it runs get ErrClosed, and if it fails the WAL stays closed
+// and Reopen can be tried again. It must not be called concurrently with
+// itself, and returns ErrFailed if CloseContext released the WAL's files.
+func (w *WAL) Reopen() error {
+	if err := w.checkForced(); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL: %w", err)
+	}
+
+	w.writeMu.Lock()
+	w.triggerRotate = make(chan uint64, 1)
+	w.awaitRotate = nil
+	w.failErr = nil
+	w.moverStop, w.moverDone = nil, nil
+	w.scrubStop, w.scrubDone = nil, nil
+	w.purgeStop, w.purgeDone = nil, nil
+	w.mergeStop, w.mergeDone = nil, nil
+	w.metaCloseOnce, w.metaCloseErr = sync.Once{}, nil
+	w.writeMu.Unlock()
+	w.releaseMu.Lock()
+	w.released = nil
+	w.releaseMu.Unlock()
+	if w.cache != nil {
+		w.cache.reset()
+	}
+
+	_, err := w.open(context.Background())
+	return err
+}
+
+// GetStable returns the value stored for key in the MetaStore's stable store
+// or nil if there is none. It's intended for small amounts of state that must
+// be kept durably alongside the log such as raft's CurrentTerm and VotedFor.
+func (w *WAL) GetStable(key []byte) ([]byte, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	w.metrics.stableGets.Inc()
+	return w.metaDB.GetStable(key)
+}
+
+// SetStable durably stores val for key in the MetaStore's stable store. A nil
+// val removes the key.
+func (w *WAL) SetStable(key []byte, val []byte) error {
+	if err := w.checkWritable(); err != nil {
+		return err
+	}
+	w.metrics.stableSets.Inc()
+	return w.metaDB.SetStable(key, val)
+}
+
+// Get implements raft.StableStore.
+func (w *WAL) Get(key []byte) ([]byte, error) {
+	return w.GetStable(key)
+}
+
+// Set implements raft.StableStore.
+func (w *WAL) Set(key []byte, val []byte) error {
+	return w.SetStable(key, val)
+}
+
+// GetUint64 implements raft.StableStore. Keys that don't exist return zero.
+func (w *WAL) GetUint64(key []byte) (uint64, error) {
+	raw, err := w.GetStable(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	if len(raw) != 8 {
+		return 0, fmt.Errorf("stable value for %q is %d bytes, not a uint64", key, len(raw))
+	}
+	return binary.LittleEndian.Uint64(raw), nil
+}
 
-	return w.metaDB.Close()
+// SetUint64 implements raft.StableStore.
+func (w *WAL) SetUint64(key []byte, val uint64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], val)
+	return w.SetStable(key, buf[:])
 }
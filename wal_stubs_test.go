@@ -175,8 +175,8 @@ func makeTestStorage(opts ...testStorageOpt) *testStorage {
 // WAL instance with ts.
 func stubStorage(ts *testStorage) walOpt {
 	return func(w *WAL) {
-		w.metaDB = ts
-		w.sf = ts
+		WithMetaStore(ts)(w)
+		WithSegmentFiler(ts)(w)
 	}
 }
 
@@ -502,11 +502,37 @@ func (s *testSegment) GetLog(idx uint64, le *types.LogEntry) error {
 		return ErrNotFound
 	}
 
+	le.Term, le.Type, le.Meta, le.AppendedAt = log.Term, log.Type, log.Meta, log.AppendedAt
 	le.Data = make([]byte, len(log.Data))
 	copy(le.Data, log.Data)
 	return nil
 }
 
+func (s *testSegment) GetLogMeta(idx uint64, le *types.LogEntry) error {
+	var full types.LogEntry
+	if err := s.GetLog(idx, &full); err != nil {
+		return err
+	}
+	le.Term, le.Type, le.Meta, le.AppendedAt = full.Term, full.Type, full.Meta, full.AppendedAt
+	return nil
+}
+
+func (s *testSegment) TermRuns() ([]types.TermRun, error) {
+	state := s.loadState()
+	if state.closed {
+		return nil, errors.New("closed")
+	}
+	var runs []types.TermRun
+	it := state.logs.Iterator()
+	for !it.Done() {
+		_, log, _ := it.Next()
+		if len(runs) == 0 || runs[len(runs)-1].Term != log.Term {
+			runs = append(runs, types.TermRun{Term: log.Term, FirstIndex: log.Index})
+		}
+	}
+	return runs, nil
+}
+
 func (s *testSegment) Append(entries []types.LogEntry) error {
 	sealed, _, err := s.Sealed()
 	if err != nil {
@@ -519,7 +545,11 @@ func (s *testSegment) Append(entries []types.LogEntry) error {
 		if newState.closed {
 			return errors.New("closed")
 		}
+		now := time.Now()
 		for _, e := range entries {
+			if e.AppendedAt.IsZero() {
+				e.AppendedAt = now
+			}
 			if e.Index != (newState.info.BaseIndex + uint64(newState.logs.Len())) {
 				return fmt.Errorf("non-monotonic append! BaseIndex=%d len=%d appended=%d",
 					newState.info.BaseIndex, newState.logs.Len(), e.Index)
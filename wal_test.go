@@ -4,14 +4,32 @@
 package wal
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/metadb"
+	"github.com/dreamsxin/wal/segment"
 	"github.com/dreamsxin/wal/types"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -38,6 +56,8 @@ func TestWALOpen(t *testing.T) {
 				"CommitState": 1,
 				"List":        1,
 				"Load":        1,
+				// Checks the metadata isn't encrypted.
+				"GetStable": 1,
 			},
 			expectFirstIndex: 0,
 			expectLastIndex:  0,
@@ -644,8 +664,2598 @@ func TestDeleteRange(t *testing.T) {
 	}
 }
 
+func TestTruncateBackReopen(t *testing.T) {
+	mem := fs.NewMem()
+	w, err := Open("wal", WithVFS(mem))
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 10)))
+
+	// Truncating the tail seals it without an index which must still be
+	// readable once the WAL is opened again.
+	require.NoError(t, w.TruncateBack(5))
+	require.NoError(t, w.StoreLogs(makeLogEntries(6, 10)))
+	require.NoError(t, w.Close())
+
+	w, err = Open("wal", WithVFS(mem))
+	require.NoError(t, err)
+	defer w.Close()
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(15), last)
+	for idx := uint64(1); idx <= last; idx++ {
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+}
+
+func TestTerms(t *testing.T) {
+	_, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+
+	// Spread three terms over three segments (test segments hold 100 entries).
+	termFor := func(idx uint64) uint64 {
+		switch {
+		case idx <= 50:
+			return 1
+		case idx <= 180:
+			return 2
+		default:
+			return 5
+		}
+	}
+	for idx := uint64(1); idx <= 250; idx += 10 {
+		batch := makeLogEntries(idx, 10)
+		for i := range batch {
+			batch[i].Term = termFor(batch[i].Index)
+		}
+		require.NoError(t, w.StoreLogs(batch))
+	}
+
+	for idx := uint64(1); idx <= 250; idx++ {
+		term, err := w.TermAt(idx)
+		require.NoError(t, err, "idx %d", idx)
+		require.Equal(t, int(termFor(idx)), int(term), "wrong term for index %d", idx)
+	}
+	_, err = w.TermAt(0)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = w.TermAt(251)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	var log types.LogEntry
+	require.NoError(t, w.GetLog(51, &log))
+	require.Equal(t, 2, int(log.Term))
+
+	assertRange := func(term, wantFirst, wantLast uint64) {
+		t.Helper()
+		first, err := w.FirstIndexOfTerm(term)
+		require.NoError(t, err)
+		require.Equal(t, int(wantFirst), int(first))
+		last, err := w.LastIndexOfTerm(term)
+		require.NoError(t, err)
+		require.Equal(t, int(wantLast), int(last))
+	}
+	assertRange(1, 1, 50)
+	assertRange(2, 51, 180)
+	assertRange(5, 181, 250)
+
+	_, err = w.FirstIndexOfTerm(3)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = w.LastIndexOfTerm(3)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Truncations should be reflected in the term ranges.
+	require.NoError(t, w.TruncateFront(60))
+	require.NoError(t, w.TruncateBack(190))
+
+	_, err = w.FirstIndexOfTerm(1)
+	require.ErrorIs(t, err, ErrNotFound)
+	assertRange(2, 60, 180)
+	assertRange(5, 181, 190)
+
+	_, err = w.TermAt(59)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = w.TermAt(191)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestGetLogMeta(t *testing.T) {
+	_, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segTail(10)}, nil, false)
+	require.NoError(t, err)
+
+	es := makeLogEntries(111, 5)
+	for i := range es {
+		es[i].Term = 3
+		es[i].Type = uint8(i)
+		es[i].Meta = []byte(fmt.Sprintf("meta %d", i))
+	}
+	require.NoError(t, w.StoreLogs(es))
+
+	for i, e := range es {
+		log := types.LogEntry{Data: []byte("untouched")}
+		require.NoError(t, w.GetLogMeta(e.Index, &log))
+		require.Equal(t, int(e.Index), int(log.Index))
+		require.Equal(t, 3, int(log.Term))
+		require.Equal(t, uint8(i), log.Type)
+		require.Equal(t, e.Meta, log.Meta)
+		require.Equal(t, "untouched", string(log.Data))
+	}
+
+	// Entries from before were stored without any metadata.
+	var log types.LogEntry
+	require.NoError(t, w.GetLogMeta(50, &log))
+	require.Equal(t, 0, int(log.Term))
+	require.Equal(t, uint8(0), log.Type)
+	require.Empty(t, log.Meta)
+
+	require.ErrorIs(t, w.GetLogMeta(0, &log), ErrNotFound)
+	require.ErrorIs(t, w.GetLogMeta(116, &log), ErrNotFound)
+}
+
+func TestGetLogAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops buffers at random under the race detector")
+	}
+	cases := map[string][]walOpt{
+		"default":        nil,
+		"verify on read": {WithVerifyOnRead()},
+		"block cache":    {WithBlockCache(1024 * 1024)},
+		"sparse index":   {WithIndexInterval(8)},
+		"entry cache":    {WithEntryCache(1000)},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			w, err := Open("wal", append(opts, WithVFS(fs.NewMem()), WithSegmentSize(16*1024))...)
+			require.NoError(t, err)
+			defer w.Close()
+
+			es := makeLogEntries(1, 1000)
+			for i := range es {
+				es[i].Meta = []byte("meta")
+			}
+			for i := 0; i < len(es); i += 10 {
+				require.NoError(t, w.StoreLogs(es[i:i+10]))
+			}
+			segs, err := w.Segments()
+			require.NoError(t, err)
+			require.Greater(t, len(segs), 2)
+
+			// Once the caller's buffers are big enough, reading from sealed
+			// segments and the tail allocates nothing.
+			log := types.LogEntry{Data: make([]byte, 0, 64), Meta: make([]byte, 0, 8)}
+			for _, idx := range []uint64{5, 500, 995} {
+				allocs := testing.AllocsPerRun(100, func() {
+					require.NoError(t, w.GetLog(idx, &log))
+				})
+				require.Equal(t, float64(0), allocs, "index %d", idx)
+				require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(log.Data))
+				require.Equal(t, "meta", string(log.Meta))
+			}
+		})
+	}
+}
+
+func TestGetLastLog(t *testing.T) {
+	w, err := Open("wal", WithVFS(fs.NewMem()), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+
+	var log types.LogEntry
+	require.ErrorIs(t, w.GetLastLog(&log), ErrNotFound)
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 100)))
+	require.NoError(t, w.GetLastLog(&log))
+	require.Equal(t, 100, int(log.Index))
+	require.Equal(t, "Log entry 100", string(log.Data))
+
+	require.NoError(t, w.TruncateBack(60))
+	require.NoError(t, w.GetLastLog(&log))
+	require.Equal(t, 60, int(log.Index))
+	require.Equal(t, "Log entry 60", string(log.Data))
+
+	// It never sees an index that's being truncated away concurrently.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := w.StoreLogs(makeLogEntries(61, 10)); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := w.TruncateBack(60); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		var log types.LogEntry
+		require.NoError(t, w.GetLastLog(&log))
+		require.Equal(t, fmt.Sprintf("Log entry %d", log.Index), string(log.Data))
+	}
+	wg.Wait()
+
+	require.NoError(t, w.Close())
+	require.ErrorIs(t, w.GetLastLog(&log), ErrClosed)
+}
+
+func TestIndexRange(t *testing.T) {
+	w, err := Open("wal", WithVFS(fs.NewMem()), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+
+	first, last, err := w.IndexRange()
+	require.NoError(t, err)
+	require.Equal(t, 0, int(first))
+	require.Equal(t, 0, int(last))
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 100)))
+	require.NoError(t, w.TruncateFront(10))
+	first, last, err = w.IndexRange()
+	require.NoError(t, err)
+	require.Equal(t, 10, int(first))
+	require.Equal(t, 100, int(last))
+
+	// Both bounds always come from the same view of the log, so while it's
+	// emptied and appended to again they're either both zero or a valid range.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for next := uint64(101); next < 1000; next += 5 {
+			if err := w.TruncateFront(next); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := w.StoreLogs(makeLogEntries(next, 5)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		first, last, err := w.IndexRange()
+		require.NoError(t, err)
+		require.Equal(t, first == 0, last == 0)
+		require.LessOrEqual(t, first, last)
+	}
+
+	require.NoError(t, w.Close())
+	_, _, err = w.IndexRange()
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestContainsAndIsEmpty(t *testing.T) {
+	w, err := Open("wal", WithVFS(fs.NewMem()), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+
+	require.True(t, w.IsEmpty())
+	require.False(t, w.Contains(0))
+	require.False(t, w.Contains(1))
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 100)))
+	require.NoError(t, w.TruncateFront(10))
+	require.False(t, w.IsEmpty())
+	for idx, want := range map[uint64]bool{0: false, 9: false, 10: true, 50: true, 100: true, 101: false} {
+		require.Equal(t, want, w.Contains(idx), "index %d", idx)
+	}
+
+	// Neither reads anything.
+	require.Equal(t, 0, int(testutil.ToFloat64(w.metrics.entriesRead)))
+
+	require.NoError(t, w.TruncateFront(101))
+	require.True(t, w.IsEmpty())
+	require.False(t, w.Contains(100))
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(101, 1)))
+	require.NoError(t, w.Close())
+	require.True(t, w.IsEmpty())
+	require.False(t, w.Contains(101))
+}
+
+func TestInitialBaseIndex(t *testing.T) {
+	vfs := fs.NewMem()
+	w, err := Open("wal", WithVFS(vfs), WithInitialBaseIndex(1000))
+	require.NoError(t, err)
+	require.True(t, w.IsEmpty())
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Len(t, segs, 1)
+	require.Equal(t, 1000, int(segs[0].BaseIndex))
+
+	// Appending from the base index keeps the segment rather than replacing
+	// it.
+	require.NoError(t, w.StoreLogs(makeLogEntries(1000, 10)))
+	after, err := w.Segments()
+	require.NoError(t, err)
+	require.Len(t, after, 1)
+	require.Equal(t, segs[0].ID, after[0].ID)
+	first, last, err := w.IndexRange()
+	require.NoError(t, err)
+	require.Equal(t, 1000, int(first))
+	require.Equal(t, 1009, int(last))
+	require.NoError(t, w.Close())
+
+	// It has no effect on an existing log.
+	w, err = Open("wal", WithVFS(vfs), WithInitialBaseIndex(5))
+	require.NoError(t, err)
+	first, err = w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1000, int(first))
+	require.NoError(t, w.Close())
+
+	// The first append can still be at any other index.
+	w, err = Open("other", WithVFS(vfs), WithInitialBaseIndex(1000))
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeLogEntries(5, 10)))
+	first, last, err = w.IndexRange()
+	require.NoError(t, err)
+	require.Equal(t, 5, int(first))
+	require.Equal(t, 14, int(last))
+	require.NoError(t, w.Close())
+}
+
+func TestResetTo(t *testing.T) {
+	vfs := fs.NewMem()
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithEntryCache(100))
+	require.NoError(t, err)
+
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	var log types.LogEntry
+	require.NoError(t, w.GetLog(1000, &log))
+
+	require.ErrorIs(t, w.ResetTo(0), ErrOutOfRange)
+	require.NoError(t, w.ResetTo(5000))
+	require.True(t, w.IsEmpty())
+	require.ErrorIs(t, w.GetLog(1000, &log), ErrNotFound)
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Len(t, segs, 1)
+	require.Equal(t, 5000, int(segs[0].BaseIndex))
+
+	// Only the new tail's file is left.
+	files, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+	var segFiles []string
+	for _, name := range files {
+		if strings.HasSuffix(name, ".wal") {
+			segFiles = append(segFiles, name)
+		}
+	}
+	require.Equal(t, []string{segment.FileName(segs[0])}, segFiles)
+
+	// Resetting to the same index again does nothing.
+	require.NoError(t, w.ResetTo(5000))
+	again, err := w.Segments()
+	require.NoError(t, err)
+	require.Equal(t, segs, again)
+
+	// Appending at the next index carries on with the same segment.
+	require.NoError(t, w.StoreLogs(makeLogEntries(5000, 10)))
+	again, err = w.Segments()
+	require.NoError(t, err)
+	require.Len(t, again, 1)
+	require.Equal(t, segs[0].ID, again[0].ID)
+	require.NoError(t, w.Close())
+
+	// The reset log is what's recovered, and it can go backwards too.
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	first, last, err := w.IndexRange()
+	require.NoError(t, err)
+	require.Equal(t, 5000, int(first))
+	require.Equal(t, 5009, int(last))
+	require.NoError(t, w.ResetTo(1))
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 10)))
+	require.Equal(t, 10, int(w.Len()))
+	require.NoError(t, w.Close())
+
+	require.ErrorIs(t, w.ResetTo(1), ErrClosed)
+}
+
+func TestCopyOnAppend(t *testing.T) {
+	// The stub segments keep the appended entries as they are, like a
+	// SegmentWriter that defers IO, so reusing the batch's buffers shows up
+	// in what's read back unless they're copied.
+	for _, copyOnAppend := range []bool{false, true} {
+		t.Run(fmt.Sprintf("copy=%v", copyOnAppend), func(t *testing.T) {
+			var opts []walOpt
+			if copyOnAppend {
+				opts = append(opts, WithCopyOnAppend())
+			}
+			_, w, err := testOpenWAL(t, nil, opts, false)
+			require.NoError(t, err)
+
+			batch := makeLogEntries(1, 10)
+			batch[0].Meta = []byte("meta")
+			require.NoError(t, w.StoreLogs(batch))
+			for i := range batch {
+				copy(batch[i].Data, "overwritten")
+			}
+			copy(batch[0].Meta, "xxxx")
+
+			var log types.LogEntry
+			require.NoError(t, w.GetLog(1, &log))
+			if copyOnAppend {
+				require.Equal(t, "Log entry 1", string(log.Data))
+				require.Equal(t, "meta", string(log.Meta))
+			} else {
+				require.Equal(t, "overwritten", string(log.Data))
+			}
+			require.NoError(t, w.GetLog(10, &log))
+			if copyOnAppend {
+				require.Equal(t, "Log entry 10", string(log.Data))
+			}
+		})
+	}
+}
+
+// mutatingFiler calls mutate with the entries of every append once the tail has
+// written them, like a caller changing its buffers during StoreLogs.
+type mutatingFiler struct {
+	types.SegmentFiler
+	mutate func([]types.LogEntry)
+}
+
+func (f *mutatingFiler) Create(info types.SegmentInfo) (types.SegmentWriter, error) {
+	sw, err := f.SegmentFiler.Create(info)
+	if err != nil {
+		return nil, err
+	}
+	return &mutatingWriter{SegmentWriter: sw, mutate: f.mutate}, nil
+}
+
+type mutatingWriter struct {
+	types.SegmentWriter
+	mutate func([]types.LogEntry)
+}
+
+func (w *mutatingWriter) Append(entries []types.LogEntry) error {
+	err := w.SegmentWriter.Append(entries)
+	w.mutate(entries)
+	return err
+}
+
+func TestMutationCheck(t *testing.T) {
+	mem := fs.NewMem()
+	var mutated uint64
+	sf := &mutatingFiler{
+		SegmentFiler: segment.NewFiler("wal", mem),
+		mutate: func(entries []types.LogEntry) {
+			for _, e := range entries {
+				if e.Index == mutated {
+					e.Data[0] = 'X'
+				}
+			}
+		},
+	}
+	w, err := Open("wal", WithVFS(mem), WithSegmentFiler(sf), WithMutationCheck())
+	require.NoError(t, err)
+
+	// Appends that leave their buffers alone are unaffected.
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 10)))
+
+	mutated = 15
+	require.PanicsWithValue(t, "wal: the Data or Meta of entry 15 passed to StoreLogs "+
+		"was modified while it was being written; callers must not change an "+
+		"append's buffers until StoreLogs returns, or must use WithCopyOnAppend",
+		func() { w.StoreLogs(makeLogEntries(11, 10)) })
+}
+
+func TestTypedWAL(t *testing.T) {
+	type event struct {
+		Name  string
+		Count int
+	}
+	w, err := Open("wal", WithVFS(fs.NewMem()), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	tw := NewTyped[event](w, JSONCodec[event]{})
+	require.Same(t, w, tw.WAL())
+
+	var want []event
+	for i := 1; i <= 500; i++ {
+		want = append(want, event{Name: fmt.Sprintf("event %d", i), Count: i})
+	}
+	for i := 0; i < len(want); i += 50 {
+		require.NoError(t, tw.Store(uint64(i+1), want[i:i+50]...))
+	}
+	require.NoError(t, tw.Store(501))
+
+	for i, e := range want {
+		got, err := tw.Get(uint64(i + 1))
+		require.NoError(t, err)
+		require.Equal(t, e, got)
+	}
+	_, err = tw.Get(501)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	var replayed []event
+	require.NoError(t, tw.Replay(context.Background(), 0, func(index uint64, v event) error {
+		require.Equal(t, uint64(len(replayed)+1), index)
+		replayed = append(replayed, v)
+		return nil
+	}))
+	require.Equal(t, want, replayed)
+
+	// Entries the codec can't decode are reported with their index.
+	require.NoError(t, w.StoreLogs([]types.LogEntry{{Index: 501, Data: []byte("not json")}}))
+	_, err = tw.Get(501)
+	require.ErrorContains(t, err, "failed to decode entry 501")
+
+	// Values that can't be encoded store nothing.
+	bad := NewTyped[func()](w, JSONCodec[func()]{})
+	require.ErrorContains(t, bad.Store(502, func() {}), "failed to encode entry 502")
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(501), last)
+}
+
+func TestLen(t *testing.T) {
+	w, err := Open("wal", WithVFS(fs.NewMem()), WithSegmentSize(8*1024), WithIndexInterval(8))
+	require.NoError(t, err)
+	require.Equal(t, 0, int(w.Len()))
+
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 2)
+	require.Equal(t, 1000, int(w.Len()))
+
+	require.NoError(t, w.TruncateFront(250))
+	require.NoError(t, w.TruncateBack(900))
+	require.Equal(t, 651, int(w.Len()))
+
+	// Emptying the log resets it to start at the next index.
+	require.NoError(t, w.TruncateFront(901))
+	require.Equal(t, 0, int(w.Len()))
+	require.NoError(t, w.StoreLogs(makeLogEntries(901, 10)))
+	require.Equal(t, 10, int(w.Len()))
+
+	require.NoError(t, w.Close())
+	require.Equal(t, 0, int(w.Len()))
+}
+
+func TestStats(t *testing.T) {
+	_, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+
+	st, err := w.Stats()
+	require.NoError(t, err)
+	require.Equal(t, Stats{Segments: 1}, st)
+
+	// Entries that already have an append time keep it.
+	oldest := time.Now().Add(-time.Hour).Round(0)
+	es := makeLogEntries(1, 150)
+	for i := range es {
+		es[i].AppendedAt = oldest
+	}
+	require.NoError(t, w.StoreLogs(es))
+
+	before := time.Now()
+	require.NoError(t, w.StoreLogs(makeLogEntries(151, 10)))
+	after := time.Now()
+
+	st, err = w.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 1, int(st.FirstIndex))
+	require.Equal(t, 160, int(st.LastIndex))
+	require.Equal(t, 160, int(st.Entries))
+	require.Equal(t, 2, st.Segments)
+	require.True(t, oldest.Equal(st.OldestAppendedAt))
+	require.False(t, st.NewestAppendedAt.Before(before))
+	require.False(t, st.NewestAppendedAt.After(after))
+
+	// Entries in the same batch share an append time.
+	var a, b types.LogEntry
+	require.NoError(t, w.GetLogMeta(151, &a))
+	require.NoError(t, w.GetLogMeta(160, &b))
+	require.True(t, a.AppendedAt.Equal(b.AppendedAt))
+
+	require.NoError(t, w.Close())
+	_, err = w.Stats()
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestFirstIndexAtOrAfter(t *testing.T) {
+	_, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+
+	_, err = w.FirstIndexAtOrAfter(time.Now())
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Write 350 entries over several segments, one second apart.
+	base := time.Now().Add(-time.Hour)
+	timeOf := func(idx uint64) time.Time {
+		return base.Add(time.Duration(idx) * time.Second)
+	}
+	for idx := uint64(1); idx <= 350; idx += 50 {
+		es := makeLogEntries(idx, 50)
+		for i := range es {
+			es[i].AppendedAt = timeOf(es[i].Index)
+		}
+		require.NoError(t, w.StoreLogs(es))
+	}
+
+	cases := []struct {
+		name    string
+		t       time.Time
+		want    uint64
+		wantErr error
+	}{
+		{name: "before all", t: base, want: 1},
+		{name: "first", t: timeOf(1), want: 1},
+		{name: "exact", t: timeOf(150), want: 150},
+		{name: "between", t: timeOf(150).Add(time.Millisecond), want: 151},
+		{name: "segment boundary", t: timeOf(101), want: 101},
+		{name: "last", t: timeOf(350), want: 350},
+		{name: "after all", t: timeOf(350).Add(time.Nanosecond), wantErr: ErrNotFound},
+	}
+	for _, tc := range cases {
+		got, err := w.FirstIndexAtOrAfter(tc.t)
+		if tc.wantErr != nil {
+			require.ErrorIs(t, err, tc.wantErr, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, int(tc.want), int(got), tc.name)
+	}
+
+	// Truncated entries are no longer found.
+	require.NoError(t, w.TruncateFront(120))
+	got, err := w.FirstIndexAtOrAfter(base)
+	require.NoError(t, err)
+	require.Equal(t, 120, int(got))
+
+	require.NoError(t, w.TruncateBack(200))
+	_, err = w.FirstIndexAtOrAfter(timeOf(201))
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestStableStore(t *testing.T) {
+	ts, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+
+	val, err := w.GetStable([]byte("missing"))
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	require.NoError(t, w.SetStable([]byte("foo"), []byte("bar")))
+	val, err = w.Get([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(val))
+
+	n, err := w.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, 0, int(n))
+
+	require.NoError(t, w.SetUint64([]byte("CurrentTerm"), 1234))
+	n, err = w.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, 1234, int(n))
+
+	// Values that aren't 8 bytes can't be read as a uint64.
+	_, err = w.GetUint64([]byte("foo"))
+	require.Error(t, err)
+
+	// Errors from the MetaStore are passed through.
+	ts.getStableErr = errors.New("IO error")
+	_, err = w.GetStable([]byte("foo"))
+	require.ErrorContains(t, err, "IO error")
+}
+
+func TestGetLogReader(t *testing.T) {
+	readAll := func(w *WAL, index uint64) string {
+		t.Helper()
+		rd, size, err := w.GetLogReader(index)
+		require.NoError(t, err)
+		defer rd.Close()
+		got, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		require.Equal(t, len(got), int(size))
+		return string(got)
+	}
+
+	// SegmentReaders that can't stream fall back to reading the whole entry.
+	_, stub, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+	require.NoError(t, stub.StoreLogs(makeLogEntries(1, 10)))
+	require.Equal(t, "Log entry 5", readAll(stub, 5))
+	_, _, err = stub.GetLogReader(11)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	dir, err := os.MkdirTemp("", "raft-wal-log-reader-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	w, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+	for idx := uint64(1); idx <= 500; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+
+	// Sealed segments and the tail.
+	require.Equal(t, "Log entry 5", readAll(w, 5))
+	require.Equal(t, "Log entry 500", readAll(w, 500))
+	_, _, err = w.GetLogReader(501)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// An open reader keeps reading after its entry is truncated away.
+	rd, _, err := w.GetLogReader(10)
+	require.NoError(t, err)
+	require.NoError(t, w.TruncateFront(300))
+	got, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, "Log entry 10", string(got))
+	require.NoError(t, rd.Close())
+	require.NoError(t, rd.Close())
+	_, _, err = w.GetLogReader(10)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestAppendLogFrom(t *testing.T) {
+	// SegmentWriters that can't stream have the data read in first.
+	_, stub, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+	require.NoError(t, stub.StoreLogs(makeLogEntries(1, 5)))
+	require.NoError(t, stub.AppendLogFrom(6, strings.NewReader("streamed"), 8))
+	var le types.LogEntry
+	require.NoError(t, stub.GetLog(6, &le))
+	require.Equal(t, "streamed", string(le.Data))
+
+	dir, err := os.MkdirTemp("", "raft-wal-append-from-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	w, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+
+	// The first append may start anywhere.
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024/16*3)
+	require.NoError(t, w.AppendLogFrom(100, bytes.NewReader(big), int64(len(big))))
+	require.NoError(t, w.StoreLogs(makeLogEntries(101, 10)))
+	err = w.AppendLogFrom(200, strings.NewReader("gap"), 3)
+	require.ErrorContains(t, err, "non-monotonic")
+	require.Error(t, w.AppendLogFrom(111, strings.NewReader("short"), 10))
+	require.NoError(t, w.AppendLogFrom(111, strings.NewReader("small"), 5))
+
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 100, int(first))
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 111, int(last))
+
+	require.NoError(t, w.GetLog(100, &le))
+	require.True(t, bytes.Equal(big, le.Data), "streamed entry data doesn't match")
+	require.NoError(t, w.GetLog(111, &le))
+	require.Equal(t, "small", string(le.Data))
+	require.NoError(t, w.GetLog(105, &le))
+	require.Equal(t, "Log entry 105", string(le.Data))
+}
+
+func TestIndexInterval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft-wal-index-interval-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := []walOpt{WithSegmentSize(8 * 1024), WithIndexInterval(8)}
+	w, err := Open(dir, opts...)
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 500; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	checkAll := func(w *WAL) {
+		t.Helper()
+		var le types.LogEntry
+		for idx := uint64(1); idx <= 500; idx++ {
+			require.NoError(t, w.GetLog(idx, &le))
+			require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+		}
+	}
+	checkAll(w)
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 1)
+	for _, seg := range segs {
+		require.NotZero(t, seg.Features&segment.FeatureSparse)
+	}
+	require.NoError(t, w.Close())
+
+	// The index interval is recorded in each segment so reopening without
+	// the option still reads them.
+	w, err = Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+	checkAll(w)
+}
+
+func TestCompression(t *testing.T) {
+	vfs := fs.NewMem()
+	opts := []walOpt{WithVFS(vfs), WithSegmentSize(8 * 1024), WithCompression(segment.CompressionDeflate)}
+	w, err := Open("wal", opts...)
+	require.NoError(t, err)
+	data := func(idx uint64) string {
+		return strings.Repeat(fmt.Sprintf("Log entry %d ", idx), 20)
+	}
+	for idx := uint64(1); idx <= 500; idx += 50 {
+		batch := makeLogEntries(idx, 50)
+		for i := range batch {
+			batch[i].Data = []byte(data(batch[i].Index))
+		}
+		require.NoError(t, w.StoreLogs(batch))
+	}
+	checkAll := func(w *WAL) {
+		t.Helper()
+		var le types.LogEntry
+		for idx := uint64(1); idx <= 500; idx++ {
+			require.NoError(t, w.GetLog(idx, &le))
+			require.Equal(t, data(idx), string(le.Data))
+		}
+	}
+	checkAll(w)
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 1)
+	for _, seg := range segs {
+		require.NotZero(t, seg.Features&segment.FeatureCompression)
+	}
+	require.NoError(t, w.Close())
+
+	// Whether an entry is compressed is recorded in its frame so reopening
+	// without the option still reads them.
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	checkAll(w)
+	require.NoError(t, w.Close())
+
+	_, err = Open("wal", WithVFS(vfs), WithCompression(segment.CompressionZstd))
+	require.ErrorIs(t, err, segment.ErrCompressionNotRegistered)
+	require.ErrorContains(t, err, "zstd (codec 2)")
+	_, err = Open("wal", WithVFS(vfs), WithCompressionPolicy(segment.CompressionPolicy{MaxRatio: 2}))
+	require.ErrorContains(t, err, "compression max ratio")
+}
+
+func TestTrainDictionary(t *testing.T) {
+	vfs := fs.NewMem()
+	opts := []walOpt{WithVFS(vfs), WithSegmentSize(8 * 1024), WithCompression(segment.CompressionDeflate)}
+	w, err := Open("wal", opts...)
+	require.NoError(t, err)
+	data := func(idx uint64) string {
+		return fmt.Sprintf(`{"op":"set","key":"service/web/instances/%d","value":{"port":%d,"healthy":true}}`, idx, 8000+idx%100)
+	}
+	store := func(w *WAL, first, n uint64) {
+		for idx := first; idx < first+n; idx += 50 {
+			batch := makeLogEntries(idx, 50)
+			for i := range batch {
+				batch[i].Data = []byte(data(batch[i].Index))
+			}
+			require.NoError(t, w.StoreLogs(batch))
+		}
+	}
+	store(w, 1, 200)
+	dict, err := w.TrainDictionary(100)
+	require.NoError(t, err)
+	require.NotEmpty(t, dict)
+
+	// Only segments created from then on use it.
+	store(w, 201, 800)
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Zero(t, segs[0].Features&segment.FeatureDictionary)
+	last := segs[len(segs)-1]
+	require.NotZero(t, last.Features&segment.FeatureDictionary)
+	require.Equal(t, segment.DictionaryID(dict), last.Dictionary)
+	require.NoError(t, w.Close())
+
+	// Reopened, the tail's dictionary carries on being used.
+	w, err = Open("wal", opts...)
+	require.NoError(t, err)
+	store(w, 1001, 500)
+	var le types.LogEntry
+	for idx := uint64(1); idx <= 1500; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, data(idx), string(le.Data))
+	}
+	segs, err = w.Segments()
+	require.NoError(t, err)
+	require.Equal(t, segment.DictionaryID(dict), segs[len(segs)-1].Dictionary)
+	require.NoError(t, w.Close())
+
+	_, err = Open("wal", WithVFS(vfs), WithCompressionDictionary(dict))
+	require.ErrorContains(t, err, "needs a compression codec")
+	w, err = Open("wal", WithVFS(vfs))
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.TrainDictionary(100)
+	require.ErrorContains(t, err, "needs a compression codec")
+}
+
+// testKeys is a types.KeyProvider of fixed keys.
+type testKeys struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (k *testKeys) CurrentKey() (uint32, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *testKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %d", id)
+	}
+	return key, nil
+}
+
+func TestEncryption(t *testing.T) {
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, segment.CipherKeySize)}}
+	vfs := fs.NewMem()
+	opts := []walOpt{WithVFS(vfs), WithSegmentSize(8 * 1024), WithCompression(segment.CompressionDeflate)}
+	w, err := Open("wal", append(opts, WithEncryption(keys, segment.CipherAES256GCM))...)
+	require.NoError(t, err)
+	data := func(idx uint64) string {
+		return strings.Repeat(fmt.Sprintf("Secret %d ", idx), 20)
+	}
+	store := func(w *WAL, first, n uint64) {
+		for idx := first; idx < first+n; idx += 50 {
+			batch := makeLogEntries(idx, 50)
+			for i := range batch {
+				batch[i].Data = []byte(data(batch[i].Index))
+			}
+			require.NoError(t, w.StoreLogs(batch))
+		}
+	}
+	checkAll := func(w *WAL, last uint64) {
+		t.Helper()
+		var le types.LogEntry
+		for idx := uint64(1); idx <= last; idx++ {
+			require.NoError(t, w.GetLog(idx, &le))
+			require.Equal(t, data(idx), string(le.Data))
+		}
+	}
+	store(w, 1, 500)
+	checkAll(w, 500)
+	require.NoError(t, w.Close())
+
+	// Reopening with another suite and a new key only changes new segments.
+	keys.keys[2] = bytes.Repeat([]byte{2}, segment.CipherKeySize)
+	keys.current = 2
+	suite := segment.CipherChaCha20Poly1305
+	if segment.FIPSOnly {
+		suite = segment.CipherAES256GCM
+	}
+	w, err = Open("wal", append(opts, WithEncryption(keys, suite))...)
+	require.NoError(t, err)
+	before, err := w.Segments()
+	require.NoError(t, err)
+	store(w, 501, 500)
+	checkAll(w, 1000)
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), len(before))
+	for i, seg := range segs {
+		require.NotZero(t, seg.Features&segment.FeatureEncryption)
+		want := suite
+		if i < len(before) {
+			want = segment.CipherAES256GCM
+		}
+		require.Equal(t, want, seg.Cipher, "segment %d", seg.ID)
+	}
+	require.NoError(t, w.Close())
+
+	// The tail can't be recovered without the keys.
+	_, err = Open("wal", opts...)
+	require.ErrorIs(t, err, segment.ErrNoEncryptionKeys)
+
+	_, err = Open("wal", WithVFS(vfs), WithEncryption(nil, segment.CipherAES256GCM))
+	require.ErrorContains(t, err, "encryption needs a KeyProvider")
+	_, err = Open("wal", WithVFS(vfs), WithEncryption(keys, segment.CipherNone))
+	require.ErrorContains(t, err, "encryption needs a cipher suite")
+	_, err = Open("wal", WithVFS(vfs), WithEncryption(keys, 9))
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+	_, err = Open("wal", WithVFS(vfs), WithKeyLocking())
+	require.ErrorContains(t, err, "key locking needs encryption")
+}
+
+func TestEncryptedMeta(t *testing.T) {
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, segment.CipherKeySize)}}
+	vfs := fs.NewMem()
+	encrypted := []walOpt{WithVFS(vfs), WithSegmentSize(8 * 1024), WithEncryption(keys, segment.CipherAES256GCM)}
+
+	// Start with plaintext metadata.
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 50)))
+	require.NoError(t, w.SetStable([]byte("CurrentTerm"), []byte("term-secret")))
+	require.NoError(t, w.Close())
+
+	raw := func() types.MetaStore {
+		t.Helper()
+		db := metadb.NewFlatMetaDB(vfs)
+		_, err := db.Load("wal")
+		require.NoError(t, err)
+		return db
+	}
+
+	// It's encrypted once opened with the keys and written or read.
+	w, err = Open("wal", encrypted...)
+	require.NoError(t, err)
+	val, err := w.GetStable([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, "term-secret", string(val))
+	require.NoError(t, w.SetStable([]byte("VotedFor"), []byte("voted-secret")))
+	for idx := uint64(51); idx <= 500; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	db := raw()
+	ps, err := db.Load("wal")
+	require.NoError(t, err)
+	require.Empty(t, ps.Segments)
+	require.Zero(t, ps.NextSegmentID)
+	for _, key := range []string{"CurrentTerm", "VotedFor"} {
+		val, err := db.GetStable([]byte(key))
+		require.NoError(t, err)
+		require.NotContains(t, string(val), "secret")
+	}
+	require.NoError(t, db.Close())
+
+	w, err = Open("wal", encrypted...)
+	require.NoError(t, err)
+	got, err := w.Segments()
+	require.NoError(t, err)
+	require.Len(t, got, len(segs))
+	for i := range segs {
+		require.Equal(t, segs[i].ID, got[i].ID)
+		require.Equal(t, segs[i].BaseIndex, got[i].BaseIndex)
+	}
+	for key, want := range map[string]string{"CurrentTerm": "term-secret", "VotedFor": "voted-secret"} {
+		val, err := w.GetStable([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, want, string(val))
+	}
+	require.NoError(t, w.SetStable([]byte("VotedFor"), nil))
+	val, err = w.GetStable([]byte("VotedFor"))
+	require.NoError(t, err)
+	require.Nil(t, val)
+	require.NoError(t, w.Close())
+
+	// Without the keys it can't be mistaken for an empty log.
+	_, err = Open("wal", WithVFS(vfs))
+	require.ErrorIs(t, err, segment.ErrNoEncryptionKeys)
+	require.ErrorContains(t, err, "metadata is encrypted")
+
+	// Values are bound to their keys.
+	db = raw()
+	sealed, err := db.GetStable([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.NoError(t, db.SetStable([]byte("VotedFor"), sealed))
+	require.NoError(t, db.Close())
+	w, err = Open("wal", encrypted...)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.GetStable([]byte("VotedFor"))
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestAuditLog(t *testing.T) {
+	vfs := fs.NewMem()
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithAuditLog(0))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 2000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 4)
+
+	require.NoError(t, w.TruncateFrontWithReason(800, "snapshot taken"))
+	require.NoError(t, w.TruncateFront(10)) // A no-op isn't recorded.
+	require.NoError(t, w.TruncateBackWithReason(1500, "conflicting entries"))
+	require.NoError(t, w.TruncateBack(1600))
+	require.NoError(t, w.ResetToWithReason(3000, "snapshot installed"))
+	require.NoError(t, w.Close())
+
+	type op struct {
+		Op          AuditOp
+		Index       uint64
+		First, Last uint64
+		Reason      string
+	}
+	check := func(w *WAL, want []op, deleted map[AuditOp]string) {
+		t.Helper()
+		recs, err := w.AuditLog()
+		require.NoError(t, err)
+		var got []op
+		causes := make(map[AuditOp]string)
+		for i, rec := range recs {
+			require.False(t, rec.Time.IsZero())
+			if i > 0 {
+				require.Equal(t, recs[i-1].Seq+1, rec.Seq)
+			}
+			if rec.Op == AuditDeleteSegment {
+				require.NotZero(t, rec.BaseIndex)
+				causes[rec.Cause] = rec.Reason
+				continue
+			}
+			got = append(got, op{rec.Op, rec.Index, rec.First, rec.Last, rec.Reason})
+		}
+		require.Equal(t, want, got)
+		require.Equal(t, deleted, causes)
+	}
+	want := []op{
+		{AuditTruncateFront, 800, 1, 799, "snapshot taken"},
+		{AuditTruncateBack, 1500, 1501, 2000, "conflicting entries"},
+		{AuditResetTo, 3000, 800, 1500, "snapshot installed"},
+	}
+	deleted := map[AuditOp]string{
+		AuditTruncateFront: "snapshot taken",
+		AuditTruncateBack:  "conflicting entries",
+		AuditResetTo:       "snapshot installed",
+	}
+
+	// Records outlive the WAL, and can be read without adding more.
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	recs, err := w.AuditLog()
+	require.NoError(t, err)
+	check(w, want, deleted)
+	require.NoError(t, w.StoreLogs(makeLogEntries(3000, 10)))
+	require.NoError(t, w.TruncateFront(3005))
+	check(w, want, deleted)
+	require.NoError(t, w.Close())
+
+	// Only the newest are kept.
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithAuditLog(2))
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.TruncateBackWithReason(3007, "a"))
+	require.NoError(t, w.TruncateBackWithReason(3006, "b"))
+	require.NoError(t, w.TruncateBackWithReason(3005, "c"))
+	kept, err := w.AuditLog()
+	require.NoError(t, err)
+	require.Len(t, kept, 2)
+	require.Equal(t, kept[0].Seq+1, kept[1].Seq)
+	require.Greater(t, kept[0].Seq, recs[len(recs)-1].Seq+2)
+	require.Equal(t, AuditTruncateBack, kept[1].Op)
+	require.Equal(t, "c", kept[1].Reason)
+	for seq := uint64(1); seq < kept[0].Seq; seq++ {
+		val, err := w.metaDB.GetStable(auditRecordKey(seq))
+		require.NoError(t, err)
+		require.Nil(t, val, "record %d", seq)
+	}
+
+	_, err = Open("other", WithVFS(vfs), WithAuditLog(-1))
+	require.ErrorContains(t, err, "can't be negative")
+}
+
+func TestStrictRecovery(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft-wal-strict-recovery-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 500; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 1)
+	require.NotZero(t, segs[0].Checksum)
+	require.NoError(t, w.Close())
+
+	// Flip a bit in the reserved bytes of the first entry's frame header, which
+	// no entry checksum covers.
+	path := filepath.Join(dir, segment.FileName(segs[0]))
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	buf[32+2] ^= 0x1
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+
+	// Without strict recovery the damage goes unnoticed until Verify.
+	w, err = Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	var le types.LogEntry
+	require.NoError(t, w.GetLog(1, &le))
+	require.ErrorIs(t, w.Verify(), ErrCorrupt)
+	require.NoError(t, w.Close())
+
+	_, err = Open(dir, WithSegmentSize(8*1024), WithStrictRecovery())
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestOpenFS(t *testing.T) {
+	for _, flat := range []bool{false, true} {
+		t.Run(fmt.Sprintf("flat=%v", flat), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "raft-wal-open-fs-test-*")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			opts := []walOpt{WithSegmentSize(8 * 1024)}
+			if flat {
+				opts = append(opts, WithFlatMetaStore())
+			}
+			w, err := Open(dir, opts...)
+			require.NoError(t, err)
+			for idx := uint64(1); idx <= 500; idx += 50 {
+				require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+			}
+			require.NoError(t, w.SetUint64([]byte("term"), 3))
+			require.NoError(t, w.Close())
+
+			// Copy the files into an in-memory FS so there's no chance of the
+			// originals being written.
+			fsys := fstest.MapFS{}
+			des, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			for _, de := range des {
+				buf, err := os.ReadFile(filepath.Join(dir, de.Name()))
+				require.NoError(t, err)
+				fsys[de.Name()] = &fstest.MapFile{Data: buf}
+			}
+			before := len(fsys)
+
+			w, err = OpenFS(fsys, opts...)
+			require.NoError(t, err)
+			var le types.LogEntry
+			for idx := uint64(1); idx <= 500; idx++ {
+				require.NoError(t, w.GetLog(idx, &le))
+				require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+			}
+			term, err := w.GetUint64([]byte("term"))
+			require.NoError(t, err)
+			require.Equal(t, 3, int(term))
+			require.NoError(t, w.Verify())
+
+			require.ErrorIs(t, w.StoreLogs(makeLogEntries(501, 1)), ErrReadOnly)
+			require.ErrorIs(t, w.TruncateFront(10), ErrReadOnly)
+			require.ErrorIs(t, w.TruncateBack(10), ErrReadOnly)
+			require.ErrorIs(t, w.SetUint64([]byte("term"), 4), ErrReadOnly)
+			require.NoError(t, w.Close())
+			require.Len(t, fsys, before)
+
+			// It can also read straight from a directory.
+			w, err = OpenFS(os.DirFS(dir))
+			require.NoError(t, err)
+			last, err := w.LastIndex()
+			require.NoError(t, err)
+			require.Equal(t, 500, int(last))
+			require.NoError(t, w.Close())
+		})
+	}
+
+	_, err := OpenFS(fstest.MapFS{})
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFlatMetaStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft-wal-flat-meta-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, WithSegmentSize(8*1024), WithFlatMetaStore())
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 200; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	require.NoError(t, w.SetUint64([]byte("term"), 3))
+	require.NoError(t, w.Close())
+
+	_, err = os.Stat(filepath.Join(dir, metadb.FileName))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	w, err = Open(dir, WithSegmentSize(8*1024), WithFlatMetaStore())
+	require.NoError(t, err)
+	defer w.Close()
+	var le types.LogEntry
+	for idx := uint64(1); idx <= 200; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+	term, err := w.GetUint64([]byte("term"))
+	require.NoError(t, err)
+	require.Equal(t, 3, int(term))
+}
+
+func TestWithVFS(t *testing.T) {
+	mem := fs.NewMem()
+	w, err := Open("wal", WithSegmentSize(8*1024), WithVFS(mem))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.Close())
+
+	names, err := mem.ListDir("wal")
+	require.NoError(t, err)
+	require.Contains(t, names, metadb.FlatFileB)
+	require.Greater(t, len(names), 3, "should have rotated segments")
+
+	w, err = Open("wal", WithSegmentSize(8*1024), WithVFS(mem))
+	require.NoError(t, err)
+	defer w.Close()
+	var le types.LogEntry
+	for idx := uint64(1); idx <= 1000; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+}
+
+func TestWithIOUring(t *testing.T) {
+	dir, err := os.MkdirTemp("", "wal-iouring")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	if _, err := fs.NewIOUring(); err != nil {
+		// Not built with the iouring tag, or not on Linux.
+		_, err := Open(dir, WithIOUring())
+		require.ErrorIs(t, err, fs.ErrIOUringUnsupported)
+		return
+	}
+
+	w, err := Open(dir, WithSegmentSize(8*1024), WithIOUring())
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.Close())
+
+	w, err = Open(dir, WithSegmentSize(8*1024), WithIOUring())
+	require.NoError(t, err)
+	defer w.Close()
+	var le types.LogEntry
+	for idx := uint64(1); idx <= 1000; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+}
+
+func TestWithSegmentFileNaming(t *testing.T) {
+	dir, err := os.MkdirTemp("", "wal-naming")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	naming := segment.FileNaming{Prefix: "raft-", Extension: ".log", NoPadding: true, OmitBaseIndex: true}
+	w, err := Open(dir, WithSegmentSize(8*1024), WithSegmentFileNaming(naming))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var segments int
+	for _, e := range entries {
+		require.False(t, strings.HasSuffix(e.Name(), ".wal"), e.Name())
+		if strings.HasPrefix(e.Name(), "raft-") {
+			segments++
+		}
+	}
+	require.Greater(t, segments, 1)
+	require.FileExists(t, filepath.Join(dir, "raft-1.log"))
+
+	w, err = Open(dir, WithSegmentSize(8*1024), WithSegmentFileNaming(naming))
+	require.NoError(t, err)
+	defer w.Close()
+	var le types.LogEntry
+	for idx := uint64(1); idx <= 1000; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+}
+
+func TestWithDataDirs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "wal-datadirs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var dataDirs []string
+	for _, d := range []string{"a", "b", "c"} {
+		dataDirs = append(dataDirs, filepath.Join(dir, d))
+		require.NoError(t, os.Mkdir(dataDirs[len(dataDirs)-1], 0755))
+	}
+
+	w, err := Open(dir, WithSegmentSize(8*1024), WithDataDirs(dataDirs...))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.Close())
+
+	countSegments := func(dir string) int {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		n := 0
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), ".wal") {
+				n++
+			}
+		}
+		return n
+	}
+	require.Zero(t, countSegments(dir))
+	counts := make([]int, len(dataDirs))
+	for i, d := range dataDirs {
+		counts[i] = countSegments(d)
+		require.NotZero(t, counts[i])
+	}
+	// Round robin keeps them within one of each other.
+	sort.Ints(counts)
+	require.LessOrEqual(t, counts[2]-counts[0], 1)
+
+	// The metadata says where each segment is, so the dirs can be listed in any
+	// order, or have one added, when it's opened again.
+	extra := filepath.Join(dir, "d")
+	require.NoError(t, os.Mkdir(extra, 0755))
+	w, err = Open(dir, WithSegmentSize(8*1024), WithDataDirs(extra, dataDirs[2], dataDirs[1], dataDirs[0]))
+	require.NoError(t, err)
+	defer w.Close()
+	var le types.LogEntry
+	for idx := uint64(1); idx <= 1000; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+}
+
+func TestWithColdDir(t *testing.T) {
+	mem := fs.NewMem()
+	w, err := Open("wal", WithSegmentSize(8*1024), WithVFS(mem), WithColdDir("cold", time.Hour))
+	require.NoError(t, err)
+	defer w.Close()
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+
+	s, release := w.acquireState()
+	first, ok := s.segments.Get(1)
+	require.True(t, ok)
+	name := segment.FileName(first.SegmentInfo)
+	moved, err := w.moveSegment(first.SegmentInfo)
+	require.NoError(t, err)
+	require.True(t, moved)
+
+	// The old file is kept until nothing is reading it.
+	hot, err := mem.ListDir("wal")
+	require.NoError(t, err)
+	require.Contains(t, hot, name)
+	var le types.LogEntry
+	require.NoError(t, first.r.GetLog(1, &le))
+	release()
+	hot, err = mem.ListDir("wal")
+	require.NoError(t, err)
+	require.NotContains(t, hot, name)
+	cold, err := mem.ListDir("cold")
+	require.NoError(t, err)
+	require.Equal(t, []string{name}, cold)
+
+	n, err := w.moveColdSegments()
+	require.NoError(t, err)
+	require.Zero(t, n, "nothing else was sealed long enough ago")
+
+	for idx := uint64(1); idx <= 1000; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+
+	// The metadata records where it moved to.
+	require.NoError(t, w.Close())
+	w, err = Open("wal", WithSegmentSize(8*1024), WithVFS(mem), WithColdDir("cold", time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, w.GetLog(1, &le))
+	require.Equal(t, "Log entry 1", string(le.Data))
+
+	// Truncating the segment deletes it from the cold dir.
+	require.NoError(t, w.TruncateFront(first.MaxIndex+1))
+	require.Eventually(t, func() bool {
+		cold, err := mem.ListDir("cold")
+		return err == nil && len(cold) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestColdDirMover(t *testing.T) {
+	mem := fs.NewMem()
+	w, err := Open("wal", WithSegmentSize(8*1024), WithVFS(mem), WithColdDir("cold", 0))
+	require.NoError(t, err)
+	defer w.Close()
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+
+	// Only the tail and metadata are left once the mover has been round.
+	require.Eventually(t, func() bool {
+		hot, err := mem.ListDir("wal")
+		require.NoError(t, err)
+		n := 0
+		for _, name := range hot {
+			if strings.HasSuffix(name, ".wal") {
+				n++
+			}
+		}
+		return n == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	var le types.LogEntry
+	for idx := uint64(1); idx <= 1000; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+
+	_, err = Open("wal2", WithVFS(mem), WithColdDir("wal2", 0))
+	require.ErrorContains(t, err, "cold dir can't be")
+}
+
+// spaceVFS is a MemFS that reports a set amount of free space in each dir.
+type spaceVFS struct {
+	*fs.MemFS
+	free map[string]uint64
+}
+
+func (v *spaceVFS) FreeSpace(dir string) (uint64, error) {
+	return v.free[dir], nil
+}
+
+func TestPlaceFillThenSpill(t *testing.T) {
+	vfs := &spaceVFS{MemFS: fs.NewMem(), free: map[string]uint64{"a": 1 << 30, "b": 1 << 30}}
+	w, err := Open("wal", WithSegmentSize(8*1024), WithVFS(vfs),
+		WithDataDirs("a", "b"), WithPlacementPolicy(PlaceFillThenSpill))
+	require.NoError(t, err)
+	defer w.Close()
+
+	segments := func(dir string) int {
+		names, err := vfs.ListDir(dir)
+		require.NoError(t, err)
+		return len(names)
+	}
+	store := func(first uint64) {
+		for idx := first; idx < first+1000; idx += 100 {
+			require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+		}
+	}
+
+	store(1)
+	require.Greater(t, segments("a"), 1)
+	require.Zero(t, segments("b"))
+
+	// Once a is full new segments spill over to b, and stay there even when a
+	// has room again.
+	vfs.free["a"] = 1024
+	store(1001)
+	inA := segments("a")
+	require.Greater(t, segments("b"), 1)
+	vfs.free["a"] = 1 << 30
+	store(2001)
+	require.Equal(t, inA, segments("a"))
+}
+
+func TestWithWriteRateLimit(t *testing.T) {
+	entry := func(idx uint64, size int) []types.LogEntry {
+		return []types.LogEntry{{Index: idx, Term: 1, Data: make([]byte, size)}}
+	}
+
+	w, err := Open("wal", WithVFS(fs.NewMem()), WithWriteRateLimit(1000, 1000), WithWriteRateLimitReject())
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.StoreLogs(entry(1, 800)))
+	err = w.StoreLogs(entry(2, 800))
+	var te *ThrottleError
+	require.ErrorAs(t, err, &te)
+	require.Greater(t, te.RetryAfter, time.Duration(0))
+	require.True(t, IsRetryable(err))
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), last)
+	err = w.StoreLogs(entry(2, 2000))
+	require.ErrorContains(t, err, "larger than the write rate limit's burst")
+	require.False(t, errors.Is(err, ErrThrottled))
+	require.Equal(t, 1.0, testutil.ToFloat64(w.metrics.appendsThrottled))
+
+	// Without WithWriteRateLimitReject appends wait instead.
+	w, err = Open("wal", WithVFS(fs.NewMem()), WithWriteRateLimit(10000, 1000))
+	require.NoError(t, err)
+	defer w.Close()
+	start := time.Now()
+	require.NoError(t, w.StoreLogs(entry(1, 1000)))
+	require.NoError(t, w.StoreLogs(entry(2, 1000)))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	_, err = Open("wal", WithVFS(fs.NewMem()), WithWriteRateLimit(1000, 0))
+	require.ErrorContains(t, err, "needs a positive rate and burst")
+}
+
+func TestWithMinFreeBytes(t *testing.T) {
+	const reserve = 1 << 20
+	vfs := &spaceVFS{MemFS: fs.NewMem(), free: map[string]uint64{"wal": 1 << 30}}
+	w, err := Open("wal", WithSegmentSize(8*1024), WithVFS(vfs), WithMinFreeBytes(reserve))
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 10)))
+	require.Equal(t, float64(1<<30), testutil.ToFloat64(w.metrics.freeBytes))
+
+	// An append that would eat into the reserve fails without writing anything.
+	vfs.free["wal"] = reserve + 100
+	err = w.StoreLogs(makeLogEntries(11, 10))
+	require.ErrorIs(t, err, ErrDiskFull)
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), last)
+
+	// With room for appends but not a new segment, appends carry on until the
+	// tail fills up and then fail.
+	vfs.free["wal"] = reserve + 4096
+	next := uint64(11)
+	for ; next < 1000; next++ {
+		err = w.StoreLogs(makeLogEntries(next, 1))
+		if err != nil {
+			break
+		}
+	}
+	require.ErrorIs(t, err, ErrDiskFull)
+	require.Less(t, next, uint64(1000))
+
+	// Once there's space the failed rotation is finished and appends work again.
+	vfs.free["wal"] = 1 << 30
+	require.NoError(t, w.StoreLogs(makeLogEntries(next, 1)))
+	var le types.LogEntry
+	for idx := uint64(1); idx <= next; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+	}
+	names, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+	segments := 0
+	for _, name := range names {
+		if strings.HasSuffix(name, ".wal") {
+			segments++
+		}
+	}
+	require.Equal(t, 2, segments)
+}
+
+// countingMetaStore is a MetaStore that counts the calls made to another.
+type countingMetaStore struct {
+	types.MetaStore
+	loads, commits int
+}
+
+func (ms *countingMetaStore) Load(dir string) (types.PersistentState, error) {
+	ms.loads++
+	return ms.MetaStore.Load(dir)
+}
+
+func (ms *countingMetaStore) CommitState(s types.PersistentState) error {
+	ms.commits++
+	return ms.MetaStore.CommitState(s)
+}
+
+func TestWithMetaStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft-wal-meta-store-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ms := &countingMetaStore{MetaStore: &metadb.FlatMetaDB{}}
+	w, err := Open(dir, WithSegmentSize(8*1024), WithMetaStore(ms))
+	require.NoError(t, err)
+	require.Equal(t, 1, ms.loads)
+	require.NotZero(t, ms.commits, "creating the first segment should commit state")
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 100)))
+	require.NoError(t, w.SetUint64([]byte("term"), 3))
+	require.NoError(t, w.Close())
+
+	ms = &countingMetaStore{MetaStore: &metadb.FlatMetaDB{}}
+	w, err = Open(dir, WithSegmentSize(8*1024), WithMetaStore(ms))
+	require.NoError(t, err)
+	defer w.Close()
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 100, int(last))
+	term, err := w.GetUint64([]byte("term"))
+	require.NoError(t, err)
+	require.Equal(t, 3, int(term))
+}
+
+func TestCursors(t *testing.T) {
+	ts, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+
+	cursors, err := w.Cursors()
+	require.NoError(t, err)
+	require.Empty(t, cursors)
+	_, err = w.Cursor("indexer")
+	require.ErrorIs(t, err, ErrNoCursor)
+
+	require.NoError(t, w.SetCursor("indexer", 10))
+	require.NoError(t, w.SetCursor("replica", 20))
+	require.NoError(t, w.SetCursor("indexer", 15))
+	idx, err := w.Cursor("indexer")
+	require.NoError(t, err)
+	require.Equal(t, 15, int(idx))
+	cursors, err = w.Cursors()
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"indexer": 15, "replica": 20}, cursors)
+
+	require.NoError(t, w.DeleteCursor("indexer"))
+	require.NoError(t, w.DeleteCursor("missing"))
+	_, err = w.Cursor("indexer")
+	require.ErrorIs(t, err, ErrNoCursor)
+
+	// Removing the last cursor removes the key.
+	require.NoError(t, w.DeleteCursor("replica"))
+	val, err := w.GetStable(cursorsKey)
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	ts.getStableErr = errors.New("IO error")
+	require.ErrorContains(t, w.SetCursor("indexer", 1), "IO error")
+}
+
+func TestSegmentsAndVerify(t *testing.T) {
+	_, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+	require.NoError(t, w.Verify())
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 150)))
+	require.NoError(t, w.StoreLogs(makeLogEntries(151, 10)))
+
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Len(t, segs, 2)
+	require.Equal(t, 1, int(segs[0].BaseIndex))
+	require.False(t, segs[0].SealTime.IsZero())
+	require.True(t, segs[1].SealTime.IsZero())
+
+	// The test segments don't implement SegmentVerifier so every entry is read.
+	require.NoError(t, w.Verify())
+
+	require.NoError(t, w.Close())
+	_, err = w.Segments()
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, w.Verify(), ErrClosed)
+}
+
+func TestVerifyCorruptSegment(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft-wal-verify-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 500; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	require.NoError(t, w.Verify())
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Flip a bit in an entry's data in the first segment.
+	path := filepath.Join(dir, segment.FileName(segs[0]))
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	i := bytes.Index(raw, []byte("Log entry 7"))
+	require.Greater(t, i, 0)
+	raw[i] ^= 0x1
+	require.NoError(t, os.WriteFile(path, raw, 0644))
+
+	w, err = Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+	err = w.Verify()
+	require.ErrorIs(t, err, ErrCorrupt)
+	require.ErrorContains(t, err, "index 7")
+	require.Equal(t, 1.0, testutil.ToFloat64(w.metrics.readErrors.WithLabelValues("checksum", "verify")))
+	require.NoError(t, w.Close())
+
+	// Reads say which segment is corrupt.
+	w, err = Open(dir, WithSegmentSize(8*1024), WithVerifyOnRead())
+	require.NoError(t, err)
+	defer w.Close()
+	var le types.LogEntry
+	err = w.GetLog(7, &le)
+	require.True(t, IsCorrupt(err))
+	require.False(t, IsRetryable(err))
+	var se *SegmentError
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, segs[0].ID, se.ID)
+	require.Equal(t, uint64(7), se.Index)
+	require.Equal(t, 1.0, testutil.ToFloat64(w.metrics.readErrors.WithLabelValues("checksum", "read")))
+	require.Equal(t, 0.0, testutil.ToFloat64(w.metrics.readErrors.WithLabelValues("checksum", "verify")))
+}
+
+func TestWithScrub(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 500; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	path := filepath.Join(dir, segment.FileName(segs[1]))
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	i := bytes.Index(raw, []byte(fmt.Sprintf("Log entry %d", segs[1].BaseIndex)))
+	require.Greater(t, i, 0)
+	raw[i] ^= 0x1
+	require.NoError(t, os.WriteFile(path, raw, 0644))
+
+	type failure struct {
+		seg types.SegmentInfo
+		err error
+	}
+	failed := make(chan failure, 1)
+	w, err = Open(dir, WithSegmentSize(8*1024), WithScrub(10*time.Millisecond, 0),
+		WithScrubHandler(func(seg types.SegmentInfo, err error) {
+			select {
+			case failed <- failure{seg, err}:
+			default:
+			}
+		}))
+	require.NoError(t, err)
+	defer w.Close()
+
+	select {
+	case f := <-failed:
+		require.Equal(t, segs[1].ID, f.seg.ID)
+		require.True(t, IsCorrupt(f.err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrubber didn't find the damaged segment")
+	}
+	require.NoError(t, w.Close())
+	require.GreaterOrEqual(t, testutil.ToFloat64(w.metrics.readErrors.WithLabelValues("checksum", "scrub")), 1.0)
+	require.GreaterOrEqual(t, testutil.ToFloat64(w.metrics.segmentsScrubbed), 2.0)
+
+	_, err = Open(dir, WithScrub(-time.Second, 0))
+	require.ErrorContains(t, err, "can't be negative")
+}
+
+func TestErrorClassification(t *testing.T) {
+	w, err := Open("wal", WithVFS(fs.NewMem()))
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 10)))
+
+	err = w.StoreLogs(makeLogEntries(20, 1))
+	require.ErrorIs(t, err, ErrConflict)
+	require.False(t, IsRetryable(err))
+	require.False(t, IsCorrupt(err))
+
+	require.True(t, IsRetryable(fmt.Errorf("%w: %w", ErrDiskFull, syscall.ENOSPC)))
+	require.True(t, IsRetryable(&os.PathError{Op: "open", Path: "x", Err: syscall.EMFILE}))
+	require.True(t, IsRetryable(os.ErrDeadlineExceeded))
+	require.False(t, IsRetryable(fmt.Errorf("%w: %w", ErrFailed, syscall.ENOSPC)))
+	require.False(t, IsRetryable(ErrClosed))
+	require.False(t, IsRetryable(nil))
+}
+
+func TestMetaCommitMetrics(t *testing.T) {
+	w, err := Open("wal", WithVFS(fs.NewMem()), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+	commits := func() int { return int(testutil.ToFloat64(w.metrics.metaCommits.WithLabelValues("true"))) }
+
+	// Creating the first segment commits.
+	require.Equal(t, 1, commits())
+
+	// Each rotation and truncation commits too. Close waits for any rotation
+	// still in progress.
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.TruncateFront(500))
+	require.NoError(t, w.Close())
+	rotations := int(testutil.ToFloat64(w.metrics.segmentRotations))
+	require.Greater(t, rotations, 0)
+	require.Equal(t, 2+rotations, commits())
+	require.Equal(t, 0.0, testutil.ToFloat64(w.metrics.metaCommits.WithLabelValues("false")))
+}
+
+func TestMetricsNamespace(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	opts := []walOpt{WithVFS(fs.NewMem()), WithMetricsRegisterer(reg), WithMetricsNamespace("raft", "wal")}
+
+	// Two WALs can share a registerer if their labels differ.
+	w1, err := Open("wal1", append(opts, WithMetricsConstLabels(prometheus.Labels{"wal": "1"}))...)
+	require.NoError(t, err)
+	defer w1.Close()
+	w2, err := Open("wal2", append(opts, WithMetricsConstLabels(prometheus.Labels{"wal": "2"}))...)
+	require.NoError(t, err)
+	defer w2.Close()
+	require.NoError(t, w1.StoreLogs(makeLogEntries(1, 2)))
+	require.NoError(t, w2.StoreLogs(makeLogEntries(1, 1)))
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP raft_wal_appends appends counts the number of calls to StoreLog(s) i.e. number of batches of entries appended.
+# TYPE raft_wal_appends counter
+raft_wal_appends{wal="1"} 1
+raft_wal_appends{wal="2"} 1
+# HELP raft_wal_entries_written entries_written counts the number of entries written.
+# TYPE raft_wal_entries_written counter
+raft_wal_entries_written{wal="1"} 2
+raft_wal_entries_written{wal="2"} 1
+`), "raft_wal_appends", "raft_wal_entries_written")
+	require.NoError(t, err)
+
+	// Without labels they share metrics. Counters add up but gauges and the
+	// block cache's counters can only report one WAL, which is logged.
+	var logged bytes.Buffer
+	opts = []walOpt{
+		WithVFS(fs.NewMem()),
+		WithMetricsRegisterer(prometheus.NewPedanticRegistry()),
+		WithBlockCache(1 << 20),
+		WithLogger(log.NewLogfmtLogger(&logged)),
+	}
+	w3, err := Open("wal3", opts...)
+	require.NoError(t, err)
+	defer w3.Close()
+	require.Empty(t, logged.String())
+	w4, err := Open("wal4", opts...)
+	require.NoError(t, err)
+	defer w4.Close()
+	require.NoError(t, w3.StoreLogs(makeLogEntries(1, 1)))
+	require.NoError(t, w4.StoreLogs(makeLogEntries(1, 1)))
+	require.Equal(t, 2.0, testutil.ToFloat64(w3.metrics.appends))
+	require.Contains(t, logged.String(), "level=warn")
+	require.Contains(t, logged.String(), "metrics=free_bytes,last_segment_age_seconds,pending_append_bytes,block_cache_hits,block_cache_misses")
+
+	_, err = Open("wal5", WithVFS(fs.NewMem()), WithMetricsNamespace("raft-wal", ""))
+	require.ErrorContains(t, err, "invalid metrics namespace")
+	_, err = Open("wal5", WithVFS(fs.NewMem()), WithMetricsConstLabels(prometheus.Labels{"1x": "y"}))
+	require.ErrorContains(t, err, "invalid metrics label name")
+}
+
+func TestEntryCache(t *testing.T) {
+	_, w, err := testOpenWAL(t, nil, []walOpt{WithEntryCache(50)}, false)
+	require.NoError(t, err)
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 50)))
+	require.NoError(t, w.StoreLogs(makeLogEntries(51, 50)))
+	es := makeLogEntries(101, 50)
+	es[49].Meta = []byte("meta")
+	require.NoError(t, w.StoreLogs(es))
+
+	// The caller reusing their buffers must not change what's cached.
+	es[49].Data[0] = 'X'
+
+	hits := func() int { return int(testutil.ToFloat64(w.metrics.entryCacheHits)) }
+	misses := func() int { return int(testutil.ToFloat64(w.metrics.entryCacheMisses)) }
+
+	// The most recent 50 appended entries are served from the cache.
+	for idx := uint64(101); idx <= 150; idx++ {
+		var log types.LogEntry
+		require.NoError(t, w.GetLog(idx, &log))
+		require.Equal(t, int(idx), int(log.Index))
+		require.Equal(t, string(makeLogEntries(idx, 1)[0].Data), string(log.Data))
+		require.False(t, log.AppendedAt.IsZero())
+	}
+	require.Equal(t, 50, hits())
+	require.Equal(t, 0, misses())
+
+	// Cached append times match what was written.
+	var cached, stored types.LogEntry
+	require.NoError(t, w.GetLogMeta(150, &cached))
+	require.Equal(t, "meta", string(cached.Meta))
+	require.NoError(t, w.loadState().getLogMeta(150, &stored))
+	require.True(t, cached.AppendedAt.Equal(stored.AppendedAt))
+
+	// Older entries miss and are then cached.
+	var log types.LogEntry
+	require.NoError(t, w.GetLog(10, &log))
+	require.Equal(t, 1, misses())
+	require.NoError(t, w.GetLog(10, &log))
+	require.Equal(t, 51, hits())
+
+	// Truncated entries are no longer returned, even if they were cached.
+	require.NoError(t, w.TruncateBack(140))
+	require.ErrorIs(t, w.GetLog(145, &log), ErrNotFound)
+	require.NoError(t, w.StoreLogs([]types.LogEntry{{Index: 141, Data: []byte("rewritten")}}))
+	require.NoError(t, w.GetLog(141, &log))
+	require.Equal(t, "rewritten", string(log.Data))
+
+	require.NoError(t, w.TruncateFront(20))
+	require.ErrorIs(t, w.GetLog(10, &log), ErrNotFound)
+}
+
+func TestEntryCacheEviction(t *testing.T) {
+	c := newEntryCache(3, 10)
+
+	add := func(idx uint64, data string) {
+		c.addAppended([]types.LogEntry{{Index: idx, Data: []byte(data)}})
+	}
+	has := func(idx uint64) bool {
+		var le types.LogEntry
+		return c.get(idx, &le, true)
+	}
+
+	add(1, "aa")
+	add(2, "bb")
+	add(3, "cc")
+	require.True(t, has(1))
+
+	// Count limit evicts the least recently used, which is 2 since 1 was just
+	// read.
+	add(4, "dd")
+	require.False(t, has(2))
+	require.True(t, has(1))
+	require.True(t, has(3))
+	require.True(t, has(4))
+
+	// Byte limit evicts until the new entry fits.
+	add(5, "eeeeeeee")
+	require.True(t, has(5))
+	require.True(t, has(4))
+	require.False(t, has(1))
+	require.False(t, has(3))
+	require.Equal(t, 10, c.bytes)
+
+	// Entries bigger than the byte limit are never cached.
+	add(6, "ffffffffffff")
+	require.False(t, has(6))
+
+	// Reads started before a truncation aren't cached.
+	gen := c.generation()
+	c.truncate(5, 10)
+	require.False(t, has(4))
+	c.addRead(gen, &types.LogEntry{Index: 7, Data: []byte("g")})
+	require.False(t, has(7))
+	c.addRead(c.generation(), &types.LogEntry{Index: 7, Data: []byte("g")})
+	require.True(t, has(7))
+}
+
 // TestConcurrentReadersAndWriter is designed to be run with race detector
 // enabled to validate the concurrent behavior of the WAL.
+func TestDigest(t *testing.T) {
+	_, a, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+	_, b, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+
+	// The same entries written in different batches at different times give
+	// the same digests.
+	es := makeLogEntries(1, 250)
+	require.NoError(t, a.StoreLogs(es[:120]))
+	require.NoError(t, a.StoreLogs(es[120:]))
+	for i := 0; i < len(es); i += 50 {
+		require.NoError(t, b.StoreLogs(es[i:i+50]))
+	}
+
+	da, err := a.Digest(1, 250)
+	require.NoError(t, err)
+	db, err := b.Digest(1, 250)
+	require.NoError(t, err)
+	require.Equal(t, da, db)
+
+	sub, err := a.Digest(1, 249)
+	require.NoError(t, err)
+	require.NotEqual(t, da, sub)
+
+	ta, err := a.DigestTree(1, 250, 16)
+	require.NoError(t, err)
+	tb, err := b.DigestTree(1, 250, 16)
+	require.NoError(t, err)
+	require.Equal(t, ta.Digest, tb.Digest)
+	require.Empty(t, ta.Diff(tb))
+	require.Equal(t, 1, int(ta.First))
+	require.Equal(t, 250, int(ta.Last))
+
+	// Diverge from index 200.
+	require.NoError(t, b.TruncateBack(199))
+	diverged := makeLogEntries(200, 51)
+	diverged[0].Data = []byte("something else")
+	require.NoError(t, b.StoreLogs(diverged))
+
+	tb, err = b.DigestTree(1, 250, 16)
+	require.NoError(t, err)
+	require.NotEqual(t, ta.Digest, tb.Digest)
+	diff := ta.Diff(tb)
+	require.Len(t, diff, 1)
+	require.Equal(t, 193, int(diff[0].First))
+	require.Equal(t, 208, int(diff[0].Last))
+	leaf, err := a.Digest(193, 208)
+	require.NoError(t, err)
+	require.Equal(t, leaf, diff[0].Digest)
+
+	_, err = a.Digest(0, 10)
+	require.ErrorIs(t, err, ErrOutOfRange)
+	_, err = a.Digest(10, 251)
+	require.ErrorIs(t, err, ErrOutOfRange)
+	_, err = a.DigestTree(1, 10, 0)
+	require.Error(t, err)
+}
+
+func TestReplay(t *testing.T) {
+	_, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	collect := func(from uint64) ([]uint64, error) {
+		var got []uint64
+		err := w.Replay(ctx, from, func(le types.LogEntry) error {
+			validateLogEntry(t, le)
+			got = append(got, le.Index)
+			return nil
+		})
+		return got, err
+	}
+
+	// Nothing to replay.
+	got, err := collect(0)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	for idx := uint64(1); idx <= 600; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	got, err = collect(0)
+	require.NoError(t, err)
+	require.Len(t, got, 600)
+	for i, idx := range got {
+		require.Equal(t, i+1, int(idx))
+	}
+
+	got, err = collect(590)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{590, 591, 592, 593, 594, 595, 596, 597, 598, 599, 600}, got)
+	got, err = collect(601)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	// Entries appended while replaying are included.
+	var n int
+	err = w.Replay(ctx, 550, func(le types.LogEntry) error {
+		if le.Index == 560 {
+			require.NoError(t, w.StoreLogs(makeLogEntries(601, 20)))
+		}
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 71, n)
+
+	// Errors from fn stop the replay.
+	n = 0
+	err = w.Replay(ctx, 0, func(le types.LogEntry) error {
+		n++
+		if le.Index == 300 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	require.ErrorContains(t, err, "stop")
+	require.Equal(t, 300, n)
+
+	// As does cancelling the context.
+	cctx, cancel := context.WithCancel(ctx)
+	err = w.Replay(cctx, 0, func(le types.LogEntry) error {
+		if le.Index == 10 {
+			cancel()
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Truncating the back of entries already replayed is an error.
+	err = w.Replay(ctx, 0, func(le types.LogEntry) error {
+		if le.Index == 400 {
+			require.NoError(t, w.TruncateBack(200))
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, ErrOutOfRange)
+
+	// As is starting before the first index.
+	require.NoError(t, w.TruncateFront(100))
+	_, err = collect(50)
+	require.ErrorIs(t, err, ErrOutOfRange)
+	got, err = collect(0)
+	require.NoError(t, err)
+	require.Len(t, got, 101)
+
+	require.NoError(t, w.Close())
+	_, err = collect(0)
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestExport(t *testing.T) {
+	_, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	es := makeLogEntries(1, 300)
+	es[9].Term = 2
+	es[9].Type = 3
+	es[9].Meta = []byte("meta")
+	require.NoError(t, w.StoreLogs(es[:150]))
+	require.NoError(t, w.StoreLogs(es[150:]))
+
+	decode := func(buf *bytes.Buffer) []ExportEntry {
+		var got []ExportEntry
+		dec := json.NewDecoder(buf)
+		for dec.More() {
+			var e ExportEntry
+			require.NoError(t, dec.Decode(&e))
+			got = append(got, e)
+		}
+		return got
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, w.Export(ctx, &buf, ExportOptions{}))
+	require.Equal(t, 300, bytes.Count(buf.Bytes(), []byte("\n")))
+	got := decode(&buf)
+	require.Len(t, got, 300)
+	for i, e := range got {
+		require.Equal(t, i+1, int(e.Index))
+		require.Equal(t, es[i].Data, e.Data)
+		require.False(t, e.AppendedAt.IsZero())
+	}
+	require.Equal(t, 2, int(got[9].Term))
+	require.Equal(t, 3, int(got[9].Type))
+	require.Equal(t, "meta", string(got[9].Meta))
+
+	buf.Reset()
+	require.NoError(t, w.Export(ctx, &buf, ExportOptions{Start: 140, End: 160, OmitData: true}))
+	got = decode(&buf)
+	require.Len(t, got, 21)
+	require.Equal(t, 140, int(got[0].Index))
+	require.Equal(t, 160, int(got[20].Index))
+	require.Nil(t, got[0].Data)
+
+	// End past the end of the log is clamped.
+	buf.Reset()
+	require.NoError(t, w.Export(ctx, &buf, ExportOptions{Start: 299, End: 1000}))
+	require.Len(t, decode(&buf), 2)
+
+	require.NoError(t, w.TruncateFront(100))
+	require.ErrorIs(t, w.Export(ctx, &buf, ExportOptions{Start: 50}), ErrOutOfRange)
+}
+
+func TestImport(t *testing.T) {
+	_, src, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, src.StoreLogs(makeLogEntries(1, 300)))
+	require.NoError(t, src.TruncateFront(20))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(ctx, &buf, ExportOptions{}))
+
+	dir, err := os.MkdirTemp("", "raft-wal-import-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	n, err := Import(dir, bytes.NewReader(buf.Bytes()), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	require.Equal(t, 281, n)
+
+	dst, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	first, err := dst.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 20, int(first))
+	segs, err := dst.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 1)
+	require.NoError(t, dst.Verify())
+
+	want, err := src.Digest(20, 300)
+	require.NoError(t, err)
+	got, err := dst.Digest(20, 300)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	var a, b types.LogEntry
+	require.NoError(t, src.GetLog(100, &a))
+	require.NoError(t, dst.GetLog(100, &b))
+	require.True(t, a.AppendedAt.Equal(b.AppendedAt))
+	require.NoError(t, dst.Close())
+
+	// Can't import into an existing log.
+	_, err = Import(dir, bytes.NewReader(buf.Bytes()))
+	require.ErrorContains(t, err, "already contains entries")
+
+	// Indexes must be contiguous.
+	dir2, err := os.MkdirTemp("", "raft-wal-import-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	_, err = Import(dir2, strings.NewReader(`{"index":1,"term":1}`+"\n"+`{"index":3,"term":1}`))
+	require.ErrorContains(t, err, "must be contiguous")
+	_, err = Import(dir2, strings.NewReader(`{"index":2`))
+	require.ErrorContains(t, err, "failed to decode")
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	tempDir := func() string {
+		dir, err := os.MkdirTemp("", "raft-wal-archive-test-*")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return dir
+	}
+
+	src, err := Open(tempDir(), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer src.Close()
+	for idx := uint64(1); idx <= 500; idx += 50 {
+		require.NoError(t, src.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	require.NoError(t, src.TruncateFront(30))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Archive(ctx, &buf))
+
+	dir := tempDir()
+	require.NoError(t, Unarchive(dir, bytes.NewReader(buf.Bytes())))
+	dst, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	first, err := dst.FirstIndex()
+	require.NoError(t, err)
+	last, err := dst.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 30, int(first))
+	require.Equal(t, 500, int(last))
+	require.NoError(t, dst.Verify())
+	want, err := src.Digest(30, 500)
+	require.NoError(t, err)
+	got, err := dst.Digest(30, 500)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// The copy carries on from where the original was.
+	require.NoError(t, dst.StoreLogs(makeLogEntries(501, 10)))
+	require.NoError(t, dst.Close())
+
+	// Can't unarchive over an existing log.
+	require.ErrorContains(t, Unarchive(dir, bytes.NewReader(buf.Bytes())), "already contains a log")
+
+	// Corruption is detected.
+	raw := append([]byte(nil), buf.Bytes()...)
+	i := bytes.Index(raw, []byte("Log entry 77"))
+	require.Greater(t, i, 0)
+	raw[i] ^= 0x1
+	err = Unarchive(tempDir(), bytes.NewReader(raw))
+	require.ErrorIs(t, err, ErrCorrupt)
+	require.ErrorContains(t, err, "doesn't match the archive manifest")
+
+	// As is a truncated archive.
+	err = Unarchive(tempDir(), bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	require.Error(t, err)
+
+	// Archiving needs the default SegmentFiler.
+	_, w, err := testOpenWAL(t, nil, nil, false)
+	require.NoError(t, err)
+	require.ErrorContains(t, w.Archive(ctx, &buf), "isn't supported")
+}
+
+func TestWithBackgroundIOLimit(t *testing.T) {
+	w, err := Open(t.TempDir(), WithBackgroundIOLimit(1))
+	require.NoError(t, err)
+	defer w.Close()
+
+	// More than the burst the limiter starts with.
+	entries := make([]types.LogEntry, 64)
+	for i := range entries {
+		entries[i] = types.LogEntry{Index: uint64(i + 1), Term: 1, Data: make([]byte, 32*1024)}
+	}
+	require.NoError(t, w.StoreLogs(entries))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = w.Archive(ctx, io.Discard)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	w.SetBackgroundIOLimit(0)
+	require.NoError(t, w.Archive(context.Background(), io.Discard))
+
+	_, err = Open(t.TempDir(), WithBackgroundIOLimit(-1))
+	require.ErrorContains(t, err, "can't be negative")
+}
+
+func TestImportTidwall(t *testing.T) {
+	tempDir := func() string {
+		dir, err := os.MkdirTemp("", "raft-wal-tidwall-test-*")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return dir
+	}
+	writeSeg := func(dir, name string, first, n uint64, asJSON bool) {
+		var buf bytes.Buffer
+		for idx := first; idx < first+n; idx++ {
+			data := fmt.Sprintf("Log entry %d", idx)
+			if asJSON {
+				fmt.Fprintf(&buf, `{"index":"%d","data":"+%s"}`+"\n", idx, data)
+			} else {
+				buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+				buf.WriteString(data)
+			}
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644))
+	}
+	check := func(dir string, first, last uint64) {
+		w, err := Open(dir, WithSegmentSize(8*1024))
+		require.NoError(t, err)
+		defer w.Close()
+		got, err := w.FirstIndex()
+		require.NoError(t, err)
+		require.Equal(t, first, got)
+		got, err = w.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, last, got)
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(last, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", last), string(le.Data))
+		require.Equal(t, 0, int(le.Term))
+	}
+
+	for _, asJSON := range []bool{false, true} {
+		format := TidwallBinary
+		if asJSON {
+			format = TidwallJSON
+		}
+		src := tempDir()
+		writeSeg(src, "00000000000000000001", 1, 200, asJSON)
+		writeSeg(src, "00000000000000000201", 201, 200, asJSON)
+		writeSeg(src, "00000000000000000401", 401, 50, asJSON)
+
+		n, err := ImportTidwall(tempDir(), src, format)
+		require.NoError(t, err)
+		require.Equal(t, 450, n)
+		dst := tempDir()
+		_, err = ImportTidwall(dst, src, format, WithSegmentSize(8*1024))
+		require.NoError(t, err)
+		check(dst, 1, 450)
+	}
+
+	// A front truncation that was interrupted leaves a .START segment which
+	// replaces everything before it.
+	src := tempDir()
+	writeSeg(src, "00000000000000000001", 1, 200, false)
+	writeSeg(src, "00000000000000000201", 201, 200, false)
+	writeSeg(src, "00000000000000000250.START", 250, 151, false)
+	dst := tempDir()
+	n, err := ImportTidwall(dst, src, TidwallBinary)
+	require.NoError(t, err)
+	require.Equal(t, 151, n)
+	check(dst, 250, 400)
+
+	// And a back truncation leaves a .END segment which replaces the one
+	// with the same index and everything after it.
+	src = tempDir()
+	writeSeg(src, "00000000000000000001", 1, 200, false)
+	writeSeg(src, "00000000000000000201", 201, 200, false)
+	writeSeg(src, "00000000000000000201.END", 201, 20, false)
+	writeSeg(src, "00000000000000000401", 401, 50, false)
+	dst = tempDir()
+	n, err = ImportTidwall(dst, src, TidwallBinary)
+	require.NoError(t, err)
+	require.Equal(t, 220, n)
+	check(dst, 1, 220)
+
+	// A torn entry is corruption.
+	src = tempDir()
+	writeSeg(src, "00000000000000000001", 1, 20, false)
+	f, err := os.OpenFile(filepath.Join(src, "00000000000000000001"), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{50, 'x'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = ImportTidwall(tempDir(), src, TidwallBinary)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	_, err = ImportTidwall(tempDir(), tempDir(), TidwallBinary)
+	require.ErrorContains(t, err, "no tidwall/wal segments")
+}
+
+func TestMigrateFormat(t *testing.T) {
+	ctx := context.Background()
+	dir, err := os.MkdirTemp("", "raft-wal-migrate-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 500; idx += 50 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 50)))
+	}
+	want, err := w.Digest(1, 500)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Make every sealed segment look like it was written before versions were
+	// recorded. The tail's header is covered by the CRC of its first commit so
+	// it's left alone.
+	setVersions := func(v uint8) {
+		meta := defaultMetaStore()
+		ps, err := meta.Load(dir)
+		require.NoError(t, err)
+		for i := range ps.Segments {
+			if ps.Segments[i].SealTime.IsZero() {
+				continue
+			}
+			ps.Segments[i].FormatVersion = v
+			if v > segment.FormatVersion {
+				continue
+			}
+			f, err := os.OpenFile(filepath.Join(dir, segment.FileName(ps.Segments[i])), os.O_WRONLY, 0)
+			require.NoError(t, err)
+			_, err = f.WriteAt([]byte{v}, 7)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+		}
+		require.NoError(t, meta.CommitState(ps))
+		require.NoError(t, meta.Close())
+	}
+	setVersions(0)
+
+	w, err = Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	n, err := w.MigrateFormat(ctx)
+	require.NoError(t, err)
+	require.Equal(t, len(segs)-1, n)
+
+	segs, err = w.Segments()
+	require.NoError(t, err)
+	for _, seg := range segs {
+		require.Equal(t, segment.FormatVersion, int(seg.FormatVersion))
+	}
+	require.NoError(t, w.Verify())
+	got, err := w.Digest(1, 500)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// Nothing is left to migrate.
+	n, err = w.MigrateFormat(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.NoError(t, w.StoreLogs(makeLogEntries(501, 10)))
+	require.NoError(t, w.Close())
+
+	// The migrated log reopens and the old files are gone.
+	w, err = Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	got, err = w.Digest(1, 500)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	files, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	require.NoError(t, err)
+	segs, err = w.Segments()
+	require.NoError(t, err)
+	require.Len(t, files, len(segs))
+	require.NoError(t, w.Close())
+
+	// Segments that need features we don't support are refused.
+	meta := defaultMetaStore()
+	ps, err := meta.Load(dir)
+	require.NoError(t, err)
+	ps.Segments[0].Features |= 1<<14 | 1<<15
+	require.NoError(t, meta.CommitState(ps))
+	require.NoError(t, meta.Close())
+	_, err = Open(dir, WithSegmentSize(8*1024))
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+	require.ErrorContains(t, err, "unknown(0x4000), unknown(0x8000)")
+
+	// Segments from a newer version are refused.
+	setVersions(segment.FormatVersion + 1)
+	_, err = Open(dir, WithSegmentSize(8*1024))
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
 func TestConcurrentReadersAndWriter(t *testing.T) {
 	_, w, err := testOpenWAL(t, nil, nil, false)
 	require.NoError(t, err)
@@ -766,41 +3376,249 @@ func TestConcurrentReadersAndWriter(t *testing.T) {
 
 			middle := (last - first) / 2
 
-			get := func(name string, idx uint64) int {
-				err = w.GetLog(idx, &log)
-				if err == ErrNotFound {
-					return 0
-				}
-				if err != nil {
-					panic("error fetching log: " + err.Error())
-				}
-				if log.Index != idx {
-					panic(fmt.Errorf("wrong %s log want=%d got=%d", name, idx, log.Index))
-				}
-				if string(log.Data) != fmt.Sprintf("Log entry %d", log.Index) {
-					panic(fmt.Errorf("wrong data in log %d: %s", log.Index, log.Data))
-				}
-				return 1
-			}
+			get := func(name string, idx uint64) int {
+				err = w.GetLog(idx, &log)
+				if err == ErrNotFound {
+					return 0
+				}
+				if err != nil {
+					panic("error fetching log: " + err.Error())
+				}
+				if log.Index != idx {
+					panic(fmt.Errorf("wrong %s log want=%d got=%d", name, idx, log.Index))
+				}
+				if string(log.Data) != fmt.Sprintf("Log entry %d", log.Index) {
+					panic(fmt.Errorf("wrong data in log %d: %s", log.Index, log.Data))
+				}
+				return 1
+			}
+
+			total += 3
+			good += get("first", first)
+			good += get("middle", middle)
+			good += get("last", last)
+		}
+	}
+
+	// Run writers
+	go appender()
+	go truncator()
+
+	// Run 10 readers
+	for i := 0; i < 1; /*0*/ i++ {
+		go reader()
+	}
+
+	// Wait for timeout
+	<-ctx.Done()
+}
+
+func TestOpenContext(t *testing.T) {
+	dir, err := os.MkdirTemp("", "wal-open-context")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 1000)))
+	require.NoError(t, w.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = OpenContext(ctx, dir, WithSegmentSize(8*1024))
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Giving up released the metadata so the WAL can still be opened.
+	w, err = OpenContext(context.Background(), dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), last)
+}
+
+func TestWithRecoveryProgress(t *testing.T) {
+	mem := fs.NewMem()
+	w, err := Open("wal", WithVFS(mem), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 1000)))
+	require.NoError(t, w.Close())
+
+	type report struct {
+		done, total int
+		phase       string
+	}
+	var got []report
+	w, err = Open("wal", WithVFS(mem), WithSegmentSize(8*1024),
+		WithRecoveryProgress(func(done, total int, phase string) {
+			got = append(got, report{done, total, phase})
+		}))
+	require.NoError(t, err)
+	defer w.Close()
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 1)
+
+	n := len(segs)
+	want := []report{{n, n, RecoveryPhaseList}}
+	for i := 1; i < n; i++ {
+		want = append(want, report{i, n - 1, RecoveryPhaseOpen})
+	}
+	want = append(want, report{0, 1, RecoveryPhaseTail}, report{1, 1, RecoveryPhaseTail})
+	require.Equal(t, want, got)
+}
+
+func TestWithLazySegmentOpen(t *testing.T) {
+	ts, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segFull(), segTail(1)},
+		[]walOpt{WithLazySegmentOpen()}, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, ts.calls["Open"])
+
+	var le types.LogEntry
+	require.NoError(t, w.GetLog(150, &le))
+	require.Equal(t, "Log entry 150", string(le.Data))
+	require.NoError(t, w.GetLog(160, &le))
+	require.Equal(t, 1, ts.calls["Open"])
+
+	rd, _, err := w.GetLogReader(50)
+	require.NoError(t, err)
+	data, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, "Log entry 50", string(data))
+	require.NoError(t, rd.Close())
+	require.Equal(t, 2, ts.calls["Open"])
+
+	require.NoError(t, w.Close())
+	ts.assertAllClosed(t, true)
+
+	_, err = Open("wal", WithVFS(fs.NewMem()), WithLazySegmentOpen(), WithStrictRecovery())
+	require.Error(t, err)
+}
+
+// countingFiler counts the readers it has open.
+type countingFiler struct {
+	types.SegmentFiler
+	open, opens int32
+}
+
+func (f *countingFiler) Open(info types.SegmentInfo) (types.SegmentReader, error) {
+	r, err := f.SegmentFiler.Open(info)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&f.open, 1)
+	atomic.AddInt32(&f.opens, 1)
+	return &countedReader{SegmentReader: r, f: f}, nil
+}
+
+type countedReader struct {
+	types.SegmentReader
+	f *countingFiler
+}
+
+func (r *countedReader) Close() error {
+	atomic.AddInt32(&r.f.open, -1)
+	return r.SegmentReader.Close()
+}
+
+func TestWithMaxOpenSegments(t *testing.T) {
+	mem := fs.NewMem()
+	w, err := Open("wal", WithVFS(mem), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	for idx := uint64(1); idx < 2000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.Close())
+
+	sf := &countingFiler{SegmentFiler: segment.NewFiler("wal", mem)}
+	w, err = Open("wal", WithVFS(mem), WithSegmentSize(8*1024), WithSegmentFiler(sf),
+		WithMaxOpenSegments(2))
+	require.NoError(t, err)
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 4)
+	require.Equal(t, int32(0), sf.open)
 
-			total += 3
-			good += get("first", first)
-			good += get("middle", middle)
-			good += get("last", last)
+	// Read from every segment twice over. No more than two are ever open.
+	var le types.LogEntry
+	for round := 0; round < 2; round++ {
+		for _, seg := range segs {
+			require.NoError(t, w.GetLog(seg.BaseIndex, &le))
+			require.Equal(t, fmt.Sprintf("Log entry %d", seg.BaseIndex), string(le.Data))
+			require.LessOrEqual(t, atomic.LoadInt32(&sf.open), int32(2))
 		}
 	}
+	require.Equal(t, int32(2*(len(segs)-1)), sf.opens)
 
-	// Run writers
-	go appender()
-	go truncator()
+	// A segment being streamed stays open until the stream is closed.
+	rd, _, err := w.GetLogReader(segs[0].BaseIndex)
+	require.NoError(t, err)
+	for _, seg := range segs[1:] {
+		require.NoError(t, w.GetLog(seg.BaseIndex, &le))
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&sf.open))
+	data, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("Log entry %d", segs[0].BaseIndex), string(data))
+	require.NoError(t, rd.Close())
+	require.Equal(t, int32(2), atomic.LoadInt32(&sf.open))
 
-	// Run 10 readers
-	for i := 0; i < 1; /*0*/ i++ {
-		go reader()
+	// Segments sealed since Open are limited too.
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	for idx := last + 1; idx < last+1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	segs, err = w.Segments()
+	require.NoError(t, err)
+	for _, seg := range segs[:len(segs)-1] {
+		require.NoError(t, w.GetLog(seg.BaseIndex, &le))
+		require.LessOrEqual(t, atomic.LoadInt32(&sf.open), int32(2))
 	}
 
-	// Wait for timeout
-	<-ctx.Done()
+	require.NoError(t, w.Close())
+	require.Equal(t, int32(0), atomic.LoadInt32(&sf.open))
+}
+
+func TestReopen(t *testing.T) {
+	w, err := Open("wal", WithVFS(fs.NewMem()), WithSegmentSize(8*1024), WithEntryCache(1000))
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 500)))
+	require.NoError(t, w.Reopen())
+
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(500), last)
+	require.NoError(t, w.StoreLogs(makeLogEntries(501, 500)))
+
+	// A closed WAL can be reopened too.
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Reopen())
+	require.NoError(t, w.StoreLogs(makeLogEntries(1001, 500)))
+	for idx := uint64(1); idx <= 1500; idx++ {
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(idx, &le))
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 2)
+}
+
+func TestCloseFinishesRotation(t *testing.T) {
+	// The tail is full and sealed but the next segment hasn't been started.
+	ts, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segTail(100)}, nil, false)
+	require.NoError(t, err)
+	require.Len(t, ts.metaState.Segments, 2)
+
+	require.NoError(t, w.Close())
+	segs := ts.metaState.Segments
+	require.Len(t, segs, 3)
+	require.False(t, segs[1].SealTime.IsZero())
+	require.Equal(t, uint64(200), segs[1].MaxIndex)
+	require.Equal(t, uint64(201), segs[2].BaseIndex)
+	require.True(t, segs[2].SealTime.IsZero())
 }
 
 func TestClose(t *testing.T) {
@@ -841,4 +3659,635 @@ func TestClose(t *testing.T) {
 
 	err = w.TruncateBack(2)
 	require.ErrorIs(t, err, ErrClosed)
+
+	_, err = w.GetStable([]byte("k"))
+	require.ErrorIs(t, err, ErrClosed)
+
+	err = w.SetStable([]byte("k"), []byte("v"))
+	require.ErrorIs(t, err, ErrClosed)
+
+	_, err = w.Digest(1, 2)
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestDeleteGracePeriod(t *testing.T) {
+	vfs := fs.NewMem()
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithDeleteGracePeriod(time.Hour))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 2000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	before, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+
+	// Truncated segments go to the trash rather than being deleted, and
+	// aren't purged until they've been there for the grace period.
+	require.NoError(t, w.TruncateFront(1000))
+	require.NoError(t, w.TruncateBack(1500))
+	trashed, err := vfs.ListDir("wal/trash")
+	require.NoError(t, err)
+	require.NotEmpty(t, trashed)
+	after, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+	for _, name := range trashed {
+		_, orig, _ := strings.Cut(name, "-")
+		require.Contains(t, before, orig)
+		require.NotContains(t, after, orig)
+	}
+	n, err := w.PurgeTrash()
+	require.NoError(t, err)
+	require.Zero(t, n)
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), first)
+	require.NoError(t, w.Close())
+
+	// Reopened with a shorter grace period they're purged straight away.
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithDeleteGracePeriod(time.Nanosecond))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		names, err := vfs.ListDir("wal/trash")
+		return err == nil && len(names) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1500), last)
+	require.NoError(t, w.Close())
+
+	// Without the option nothing is purged, and segments are deleted.
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	n, err = w.PurgeTrash()
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.NoError(t, w.TruncateFront(1400))
+	names, err := vfs.ListDir("wal/trash")
+	require.NoError(t, err)
+	require.Empty(t, names)
+	require.NoError(t, w.Close())
+
+	_, err = Open("wal", WithVFS(fs.NewMem()), WithDeleteGracePeriod(-time.Second))
+	require.ErrorContains(t, err, "can't be negative")
+}
+
+type failingArchiver struct{ calls int }
+
+func (a *failingArchiver) ArchiveSegment(types.SegmentInfo, types.ReadableFile) error {
+	a.calls++
+	return errors.New("bucket unavailable")
+}
+
+func TestArchiveOnTruncate(t *testing.T) {
+	vfs := fs.NewMem()
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithArchiveOnTruncate(NewDirArchiver(vfs, "archive")))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 2000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+
+	// Truncated segments are archived before they're deleted, and can be read
+	// from the archive.
+	require.NoError(t, w.TruncateFront(1000))
+	archived, err := vfs.ListDir("archive")
+	require.NoError(t, err)
+	require.NotEmpty(t, archived)
+	names, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+	sf := segment.NewFiler("archive", vfs)
+	n := 0
+	for _, seg := range segs {
+		name := segment.FileName(seg)
+		if seg.MaxIndex >= 1000 || seg.SealTime.IsZero() {
+			require.NotContains(t, archived, name)
+			continue
+		}
+		require.Contains(t, archived, name)
+		require.NotContains(t, names, name)
+		info := seg
+		info.Dir = ""
+		r, err := sf.Open(info)
+		require.NoError(t, err)
+		var le types.LogEntry
+		require.NoError(t, r.GetLog(seg.MaxIndex, &le))
+		require.NotEmpty(t, le.Data)
+		require.NoError(t, r.Close())
+		n++
+	}
+	require.Equal(t, len(archived), n)
+
+	// Other truncations just delete.
+	require.NoError(t, w.TruncateBack(1500))
+	require.NoError(t, w.Close())
+	after, err := vfs.ListDir("archive")
+	require.NoError(t, err)
+	require.Equal(t, archived, after)
+
+	// Segments that fail to archive are kept, and retried when the WAL is next
+	// opened rather than deleted as left over.
+	a := &failingArchiver{}
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithArchiveOnTruncate(a))
+	require.NoError(t, err)
+	before, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+	require.NoError(t, w.TruncateFront(1400))
+	require.NotZero(t, a.calls)
+	names, err = vfs.ListDir("wal")
+	require.NoError(t, err)
+	require.Equal(t, before, names)
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1400), first)
+	require.NoError(t, w.Close())
+
+	a = &failingArchiver{}
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithArchiveOnTruncate(a))
+	require.NoError(t, err)
+	require.NotZero(t, a.calls)
+	names, err = vfs.ListDir("wal")
+	require.NoError(t, err)
+	require.Equal(t, before, names)
+	require.NoError(t, w.Close())
+
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithArchiveOnTruncate(NewDirArchiver(vfs, "archive")))
+	require.NoError(t, err)
+	names, err = vfs.ListDir("wal")
+	require.NoError(t, err)
+	require.Less(t, len(names), len(before))
+	archived, err = vfs.ListDir("archive")
+	require.NoError(t, err)
+	for _, seg := range segs {
+		if !seg.SealTime.IsZero() && seg.MaxIndex < 1400 && seg.MinIndex >= 1000 {
+			require.Contains(t, archived, segment.FileName(seg))
+			require.NotContains(t, names, segment.FileName(seg))
+		}
+	}
+	require.NoError(t, w.Close())
+
+	// Once archived they're no longer pending, so reopening doesn't archive
+	// them again.
+	a = &failingArchiver{}
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithArchiveOnTruncate(a))
+	require.NoError(t, err)
+	require.Zero(t, a.calls)
+	require.NoError(t, w.Close())
+}
+
+func TestMergeSegments(t *testing.T) {
+	vfs := fs.NewMem()
+	opts := []walOpt{WithVFS(vfs), WithSegmentSize(64 * 1024)}
+	w, err := Open("wal", opts...)
+	require.NoError(t, err)
+
+	// Each TruncateBack seals the tail, leaving a small segment behind.
+	idx := uint64(1)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 10)))
+		require.NoError(t, w.TruncateBack(idx+8))
+		idx += 9
+	}
+	require.NoError(t, w.StoreLogs(makeLogEntries(idx, 5)))
+	last := idx + 4
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Len(t, segs, 21)
+
+	check := func(w *WAL) {
+		t.Helper()
+		first, err := w.FirstIndex()
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), first)
+		lastIdx, err := w.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, last, lastIdx)
+		for i := uint64(1); i <= last; i++ {
+			var le types.LogEntry
+			require.NoError(t, w.GetLog(i, &le))
+			validateLogEntry(t, le)
+		}
+	}
+
+	n, err := w.MergeSegments(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 20, n)
+	segs, err = w.Segments()
+	require.NoError(t, err)
+	require.Len(t, segs, 2)
+	require.Equal(t, uint64(1), segs[0].MinIndex)
+	require.Equal(t, idx-1, segs[0].MaxIndex)
+	check(w)
+	names, err := vfs.ListDir("wal")
+	require.NoError(t, err)
+	var segFiles []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".wal") {
+			segFiles = append(segFiles, name)
+		}
+	}
+	require.Len(t, segFiles, 2, "the merged files are deleted")
+
+	// Nothing more to merge.
+	n, err = w.MergeSegments(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// Appends and truncations carry on as usual, and the merged segment is
+	// recovered.
+	require.NoError(t, w.TruncateFront(5))
+	require.NoError(t, w.Close())
+	w, err = Open("wal", opts...)
+	require.NoError(t, err)
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), first)
+	require.NoError(t, w.StoreLogs(makeLogEntries(last+1, 5)))
+	var le types.LogEntry
+	require.NoError(t, w.GetLog(last+5, &le))
+	validateLogEntry(t, le)
+	require.NoError(t, w.Close())
+
+	// In the background.
+	vfs = fs.NewMem()
+	opts = []walOpt{WithVFS(vfs), WithSegmentSize(64 * 1024), WithSegmentMerging(10 * time.Millisecond)}
+	w, err = Open("wal", opts...)
+	require.NoError(t, err)
+	idx = 1
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 10)))
+		require.NoError(t, w.TruncateBack(idx+8))
+		idx += 9
+	}
+	require.Eventually(t, func() bool {
+		segs, err := w.Segments()
+		return err == nil && len(segs) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	last = idx - 1
+	check(w)
+	require.NoError(t, w.Close())
+
+	_, err = Open("wal", WithVFS(fs.NewMem()), WithSegmentMerging(-time.Second))
+	require.ErrorContains(t, err, "can't be negative")
+}
+
+func TestReclaimTruncatedTail(t *testing.T) {
+	vfs := fs.NewMem()
+	opts := []walOpt{WithVFS(vfs), WithSegmentSize(64 * 1024)}
+	w, err := Open("wal", opts...)
+	require.NoError(t, err)
+
+	entries := make([]types.LogEntry, 40)
+	for i := range entries {
+		entries[i] = types.LogEntry{Index: uint64(i + 1), Data: bytes.Repeat([]byte{byte(i)}, 1024)}
+	}
+	require.NoError(t, w.StoreLogs(entries))
+	require.NoError(t, w.TruncateBack(30))
+	require.NoError(t, w.StoreLogs([]types.LogEntry{{Index: 31, Data: []byte("new")}}))
+
+	fileSize := func(info types.SegmentInfo) int64 {
+		t.Helper()
+		f, err := vfs.OpenReader("wal", segment.FileName(info))
+		require.NoError(t, err)
+		defer f.Close()
+		n, err := io.Copy(io.Discard, io.NewSectionReader(f, 0, math.MaxInt64))
+		require.NoError(t, err)
+		return n
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Len(t, segs, 2)
+	truncated := segs[0]
+	require.Zero(t, truncated.IndexStart)
+	require.Equal(t, uint64(30), truncated.MaxIndex)
+	require.Equal(t, int64(64*1024), fileSize(truncated))
+
+	// The truncated tail is too big to be merged with the new one but it's
+	// rewritten on its own without the removed entries or the space after
+	// them.
+	n, err := w.MergeSegments(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	segs, err = w.Segments()
+	require.NoError(t, err)
+	require.Len(t, segs, 2)
+	rewritten := segs[0]
+	require.NotEqual(t, truncated.ID, rewritten.ID)
+	require.Equal(t, uint64(1), rewritten.MinIndex)
+	require.Equal(t, uint64(30), rewritten.MaxIndex)
+	require.NotZero(t, rewritten.IndexStart)
+	require.Less(t, fileSize(rewritten), int64(40*1024))
+	require.Greater(t, fileSize(rewritten), int64(30*1024))
+	_, err = vfs.OpenReader("wal", segment.FileName(truncated))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	check := func(w *WAL) {
+		t.Helper()
+		for _, e := range entries[:30] {
+			var le types.LogEntry
+			require.NoError(t, w.GetLog(e.Index, &le))
+			require.Equal(t, e.Data, le.Data)
+		}
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(31, &le))
+		require.Equal(t, "new", string(le.Data))
+	}
+	check(w)
+	n, err = w.MergeSegments(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.NoError(t, w.Close())
+
+	w, err = Open("wal", opts...)
+	require.NoError(t, err)
+	check(w)
+	require.NoError(t, w.Close())
+}
+
+func TestSealedMarkers(t *testing.T) {
+	vfs := fs.NewMem()
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithSealedMarkers())
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.TruncateFront(200))
+	infos, err := w.Segments()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// The marker of every sealed segment that's left says where it ends, and
+	// those of truncated segments are gone.
+	maxIndexes, err := segment.NewFiler("wal", vfs).SealedMaxIndexes()
+	require.NoError(t, err)
+	want := make(map[uint64]uint64)
+	for _, info := range infos {
+		if !info.SealTime.IsZero() {
+			want[info.ID] = info.MaxIndex
+		}
+	}
+	require.Greater(t, len(want), 1)
+	require.Equal(t, want, maxIndexes)
+
+	_, err = Open("wal", WithVFS(fs.NewMem()), WithSealedMarkers(), WithSegmentFileNaming(segment.FileNaming{Extension: ".sealed"}))
+	require.ErrorContains(t, err, "extension")
+}
+
+func TestManifest(t *testing.T) {
+	vfs := fs.NewMem()
+	manifestName := segment.FileNaming{}.ManifestName()
+	hasManifest := func() bool {
+		names, err := vfs.ListDir("wal")
+		require.NoError(t, err)
+		for _, name := range names {
+			if name == manifestName {
+				return true
+			}
+		}
+		return false
+	}
+
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithManifest())
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.TruncateFront(200))
+	infos, err := w.Segments()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.True(t, hasManifest())
+
+	// The manifest lists exactly the segments the WAL still has.
+	f := segment.NewFiler("wal", vfs, segment.WithManifest())
+	listed, err := f.List()
+	require.NoError(t, err)
+	want := make(map[uint64]uint64)
+	for _, info := range infos {
+		want[info.ID] = info.BaseIndex
+	}
+	require.Equal(t, want, listed)
+
+	// A segment created after the metadata was last committed is listed, so
+	// Open finds it and deletes it as a leftover.
+	sw, err := f.Create(types.SegmentInfo{ID: 1000, BaseIndex: 5000, MinIndex: 5000, SizeLimit: 8 * 1024})
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithManifest())
+	require.NoError(t, err)
+	for idx := uint64(200); idx <= 1000; idx++ {
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(idx, &le))
+		validateLogEntry(t, le)
+	}
+	require.NoError(t, w.Close())
+	listed, err = segment.NewFiler("wal", vfs, segment.WithManifest()).List()
+	require.NoError(t, err)
+	require.Equal(t, want, listed)
+
+	// Segments created while the option is off aren't in the manifest, but
+	// the next Open with it sees that it's behind and rebuilds it.
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	for idx := uint64(1001); idx <= 2000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	require.NoError(t, w.Close())
+	require.True(t, hasManifest())
+
+	w, err = Open("wal", WithVFS(vfs), WithSegmentSize(8*1024), WithManifest())
+	require.NoError(t, err)
+	infos, err = w.Segments()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	want = make(map[uint64]uint64)
+	for _, info := range infos {
+		want[info.ID] = info.BaseIndex
+	}
+	require.Greater(t, len(want), len(listed))
+	listed, err = segment.NewFiler("wal", vfs, segment.WithManifest()).List()
+	require.NoError(t, err)
+	require.Equal(t, want, listed)
+}
+
+// openFilesVFS is a MemFS that counts the files open on it. Once stall is
+// set, syncs block until their file is closed and then fail, like a write to
+// a disk that's gone away. Opening a reader on failName fails.
+type openFilesVFS struct {
+	*fs.MemFS
+
+	mu       sync.Mutex
+	open     map[*openFile]string
+	stall    bool
+	stalled  int
+	failName string
+}
+
+func newOpenFilesVFS() *openFilesVFS {
+	return &openFilesVFS{MemFS: fs.NewMem(), open: make(map[*openFile]string)}
+}
+
+func (v *openFilesVFS) track(name string, f types.WritableFile) *openFile {
+	of := &openFile{WritableFile: f, vfs: v, closed: make(chan struct{})}
+	v.mu.Lock()
+	v.open[of] = name
+	v.mu.Unlock()
+	return of
+}
+
+func (v *openFilesVFS) Create(dir, name string, size uint64) (types.WritableFile, error) {
+	f, err := v.MemFS.Create(dir, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return v.track(name, f), nil
+}
+
+func (v *openFilesVFS) OpenWriter(dir, name string) (types.WritableFile, error) {
+	f, err := v.MemFS.OpenWriter(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return v.track(name, f), nil
+}
+
+func (v *openFilesVFS) OpenReader(dir, name string) (types.ReadableFile, error) {
+	v.mu.Lock()
+	fail := name == v.failName
+	v.mu.Unlock()
+	if fail {
+		return nil, os.ErrPermission
+	}
+	f, err := v.MemFS.OpenReader(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return v.track(name, f.(types.WritableFile)), nil
+}
+
+// openNames returns the names of the files still open.
+func (v *openFilesVFS) openNames() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	names := make([]string, 0, len(v.open))
+	for _, name := range v.open {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (v *openFilesVFS) setStall(stall bool) {
+	v.mu.Lock()
+	v.stall = stall
+	v.mu.Unlock()
+}
+
+func (v *openFilesVFS) stalledSyncs() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.stalled
+}
+
+type openFile struct {
+	types.WritableFile
+	vfs       *openFilesVFS
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (f *openFile) Sync() error {
+	f.vfs.mu.Lock()
+	stall := f.vfs.stall
+	if stall {
+		f.vfs.stalled++
+	}
+	f.vfs.mu.Unlock()
+	if stall {
+		<-f.closed
+		return os.ErrClosed
+	}
+	return f.WritableFile.Sync()
+}
+
+func (f *openFile) Close() error {
+	f.closeOnce.Do(func() {
+		f.vfs.mu.Lock()
+		delete(f.vfs.open, f)
+		f.vfs.mu.Unlock()
+		close(f.closed)
+	})
+	return f.WritableFile.Close()
+}
+
+func TestCloseContextReleasesFiles(t *testing.T) {
+	vfs := newOpenFilesVFS()
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 2)
+	require.Len(t, vfs.openNames(), len(segs))
+
+	// A read holds the state, which would keep every segment open through
+	// Close, and an append is stuck syncing to a disk that's gone away.
+	_, release := w.acquireState()
+	vfs.setStall(true)
+	stored := make(chan error, 1)
+	go func() {
+		stored <- w.StoreLogs(makeLogEntries(1001, 1))
+	}()
+	require.Eventually(t, func() bool { return vfs.stalledSyncs() > 0 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, w.CloseContext(ctx), context.DeadlineExceeded)
+
+	// Every file was closed from under them, so the append fails rather than
+	// hanging and nothing is left open.
+	require.ErrorIs(t, <-stored, ErrFailed)
+	require.Empty(t, vfs.openNames())
+	release()
+	require.Empty(t, vfs.openNames())
+
+	require.ErrorIs(t, w.StoreLogs(makeLogEntries(1002, 1)), ErrClosed)
+	require.ErrorIs(t, w.Reopen(), ErrFailed)
+}
+
+func TestReopenFailureClosesFiles(t *testing.T) {
+	vfs := newOpenFilesVFS()
+	w, err := Open("wal", WithVFS(vfs), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	for idx := uint64(1); idx <= 1000; idx += 100 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 100)))
+	}
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 2)
+	require.NoError(t, w.Close())
+	require.Empty(t, vfs.openNames())
+
+	// The last sealed segment can't be opened, so every segment before it has
+	// been opened by the time Reopen gives up.
+	vfs.mu.Lock()
+	vfs.failName = segment.FileName(segs[len(segs)-2])
+	vfs.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		require.ErrorIs(t, w.Reopen(), os.ErrPermission)
+		require.Empty(t, vfs.openNames())
+	}
+
+	vfs.mu.Lock()
+	vfs.failName = ""
+	vfs.mu.Unlock()
+	require.NoError(t, w.Reopen())
+	defer w.Close()
+	require.Len(t, vfs.openNames(), len(segs))
+
+	var log types.LogEntry
+	require.NoError(t, w.GetLog(1000, &log))
+	validateLogEntry(t, log)
 }
@@ -0,0 +1,223 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package walhttp provides an http.Handler for inspecting and administering a
+// WAL. Everything is returned as JSON. The handler expects paths relative to
+// wherever it's mounted so use http.StripPrefix to add it to an existing mux:
+//
+//	mux.Handle("/debug/wal/", http.StripPrefix("/debug/wal", walhttp.NewHandler(w)))
+//
+// It serves:
+//
+//	GET    /stats             the WAL's Stats
+//	GET    /segments          the info of every segment
+//	POST   /verify            runs Verify and reports the result
+//	GET    /cursors           all named cursors
+//	GET    /cursors/{name}    a single cursor
+//	PUT    /cursors/{name}    sets a cursor, the body is {"index": N}
+//	DELETE /cursors/{name}    removes a cursor
+//	GET    /entries/{index}   an entry's metadata, add ?data=true for its Data
+//
+// The handler doesn't do any authentication. Cursors can be modified through
+// it so only expose it to trusted operators.
+package walhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+)
+
+// Handler serves admin endpoints for a WAL.
+type Handler struct {
+	w *wal.WAL
+}
+
+// NewHandler returns a Handler for w.
+func NewHandler(w *wal.WAL) *Handler {
+	return &Handler{w: w}
+}
+
+// VerifyResult is the response to POST /verify.
+type VerifyResult struct {
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Entry is the response to GET /entries/{index}. Data is only set if it was
+// requested and is base64 encoded like any []byte in JSON.
+type Entry struct {
+	Index      uint64    `json:"index"`
+	Term       uint64    `json:"term"`
+	Type       uint8     `json:"type"`
+	Meta       []byte    `json:"meta,omitempty"`
+	AppendedAt time.Time `json:"appendedAt"`
+	DataLen    int       `json:"dataLen,omitempty"`
+	Data       []byte    `json:"data,omitempty"`
+}
+
+type cursorBody struct {
+	Index uint64 `json:"index"`
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	resource, arg, _ := strings.Cut(path, "/")
+
+	switch {
+	case resource == "stats" && arg == "":
+		if !allowMethods(rw, req, http.MethodGet) {
+			return
+		}
+		st, err := h.w.Stats()
+		respond(rw, st, err)
+
+	case resource == "segments" && arg == "":
+		if !allowMethods(rw, req, http.MethodGet) {
+			return
+		}
+		segs, err := h.w.Segments()
+		respond(rw, segs, err)
+
+	case resource == "verify" && arg == "":
+		if !allowMethods(rw, req, http.MethodPost) {
+			return
+		}
+		h.verify(rw)
+
+	case resource == "cursors" && arg == "":
+		if !allowMethods(rw, req, http.MethodGet) {
+			return
+		}
+		cursors, err := h.w.Cursors()
+		respond(rw, cursors, err)
+
+	case resource == "cursors":
+		h.cursor(rw, req, arg)
+
+	case resource == "entries" && arg != "":
+		if !allowMethods(rw, req, http.MethodGet) {
+			return
+		}
+		h.entry(rw, req, arg)
+
+	default:
+		writeError(rw, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *Handler) verify(rw http.ResponseWriter) {
+	start := time.Now()
+	err := h.w.Verify()
+	if errors.Is(err, wal.ErrClosed) {
+		respond(rw, nil, err)
+		return
+	}
+	res := VerifyResult{OK: err == nil, Duration: time.Since(start)}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	respond(rw, res, nil)
+}
+
+func (h *Handler) cursor(rw http.ResponseWriter, req *http.Request, name string) {
+	switch req.Method {
+	case http.MethodGet:
+		idx, err := h.w.Cursor(name)
+		respond(rw, cursorBody{Index: idx}, err)
+
+	case http.MethodPut:
+		var body cursorBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		respond(rw, body, h.w.SetCursor(name, body.Index))
+
+	case http.MethodDelete:
+		if err := h.w.DeleteCursor(name); err != nil {
+			respond(rw, nil, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		allowMethods(rw, req, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (h *Handler) entry(rw http.ResponseWriter, req *http.Request, arg string) {
+	idx, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+	withData, _ := strconv.ParseBool(req.URL.Query().Get("data"))
+
+	var le types.LogEntry
+	if err := h.w.GetLog(idx, &le); err != nil {
+		respond(rw, nil, err)
+		return
+	}
+	e := Entry{
+		Index:      idx,
+		Term:       le.Term,
+		Type:       le.Type,
+		Meta:       le.Meta,
+		AppendedAt: le.AppendedAt,
+		DataLen:    len(le.Data),
+	}
+	if withData {
+		e.Data = le.Data
+	}
+	respond(rw, e, nil)
+}
+
+// allowMethods writes a 405 and returns false unless req uses one of methods.
+func allowMethods(rw http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	rw.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(rw, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+// respond writes v as JSON or an error response with a status that reflects
+// err.
+func respond(rw http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+		writeJSON(rw, http.StatusOK, v)
+	case errors.Is(err, wal.ErrNotFound), errors.Is(err, wal.ErrNoCursor):
+		writeError(rw, http.StatusNotFound, err)
+	case errors.Is(err, wal.ErrClosed):
+		writeError(rw, http.StatusServiceUnavailable, err)
+	default:
+		writeError(rw, http.StatusInternalServerError, err)
+	}
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, errorBody{Error: err.Error()})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
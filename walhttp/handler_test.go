@@ -0,0 +1,101 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package walhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft-wal-http-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := wal.Open(dir, wal.WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs([]types.LogEntry{
+		{Index: 1, Term: 1, Data: []byte("one")},
+		{Index: 2, Term: 2, Type: 3, Meta: []byte("meta"), Data: []byte("two")},
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/wal/", http.StripPrefix("/debug/wal", NewHandler(w)))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	do := func(method, path, body string, out interface{}) int {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+"/debug/wal"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode != http.StatusNoContent {
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	var st wal.Stats
+	require.Equal(t, http.StatusOK, do("GET", "/stats", "", &st))
+	require.Equal(t, 1, int(st.FirstIndex))
+	require.Equal(t, 2, int(st.LastIndex))
+
+	var segs []types.SegmentInfo
+	require.Equal(t, http.StatusOK, do("GET", "/segments", "", &segs))
+	require.Len(t, segs, 1)
+
+	var vr VerifyResult
+	require.Equal(t, http.StatusOK, do("POST", "/verify", "", &vr))
+	require.True(t, vr.OK)
+	require.Empty(t, vr.Error)
+	var eb errorBody
+	require.Equal(t, http.StatusMethodNotAllowed, do("GET", "/verify", "", &eb))
+	require.NotEmpty(t, eb.Error)
+
+	// Cursors.
+	var cb cursorBody
+	require.Equal(t, http.StatusNotFound, do("GET", "/cursors/indexer", "", &eb))
+	require.Equal(t, http.StatusOK, do("PUT", "/cursors/indexer", `{"index": 2}`, &cb))
+	require.Equal(t, http.StatusOK, do("GET", "/cursors/indexer", "", &cb))
+	require.Equal(t, 2, int(cb.Index))
+	var cursors map[string]uint64
+	require.Equal(t, http.StatusOK, do("GET", "/cursors", "", &cursors))
+	require.Equal(t, map[string]uint64{"indexer": 2}, cursors)
+	require.Equal(t, http.StatusBadRequest, do("PUT", "/cursors/indexer", `nope`, &eb))
+	require.Equal(t, http.StatusNoContent, do("DELETE", "/cursors/indexer", "", nil))
+	require.Equal(t, http.StatusNotFound, do("GET", "/cursors/indexer", "", &eb))
+
+	// Entries.
+	var e Entry
+	require.Equal(t, http.StatusOK, do("GET", "/entries/2", "", &e))
+	require.Equal(t, 2, int(e.Term))
+	require.Equal(t, 3, int(e.Type))
+	require.Equal(t, "meta", string(e.Meta))
+	require.Equal(t, 3, e.DataLen)
+	require.Nil(t, e.Data)
+	require.False(t, e.AppendedAt.IsZero())
+
+	e = Entry{}
+	require.Equal(t, http.StatusOK, do("GET", "/entries/2?data=true", "", &e))
+	require.Equal(t, "two", string(e.Data))
+
+	require.Equal(t, http.StatusNotFound, do("GET", "/entries/3", "", &eb))
+	require.Equal(t, http.StatusBadRequest, do("GET", "/entries/two", "", &eb))
+	require.Equal(t, http.StatusNotFound, do("GET", "/nope", "", &eb))
+
+	require.NoError(t, w.Close())
+	require.Equal(t, http.StatusServiceUnavailable, do("GET", "/stats", "", &eb))
+	require.Equal(t, http.StatusServiceUnavailable, do("POST", "/verify", "", &eb))
+}
@@ -0,0 +1,18 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !wasm
+
+package walmem
+
+import "github.com/dreamsxin/wal/raftwal"
+
+// NewStore returns a raftwal.Store over a new, empty in-memory WAL, for use as
+// the log and stable store of a hashicorp/raft node in tests.
+func NewStore() (*raftwal.Store, error) {
+	w, err := Open()
+	if err != nil {
+		return nil, err
+	}
+	return raftwal.New(w), nil
+}
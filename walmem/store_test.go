@@ -0,0 +1,30 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !wasm
+
+package walmem
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStore(t *testing.T) {
+	s, err := NewStore()
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.StoreLogs([]*raft.Log{{Index: 1, Term: 1, Data: []byte("one")}}))
+	var log raft.Log
+	require.NoError(t, s.GetLog(1, &log))
+	require.Equal(t, "one", string(log.Data))
+	require.ErrorIs(t, s.GetLog(2, &log), raft.ErrLogNotFound)
+
+	require.NoError(t, s.SetUint64([]byte("term"), 3))
+	term, err := s.GetUint64([]byte("term"))
+	require.NoError(t, err)
+	require.Equal(t, 3, int(term))
+}
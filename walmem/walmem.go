@@ -0,0 +1,32 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package walmem provides WALs that are held entirely in memory, for tests of
+// code that embeds the WAL. Each is a real *wal.WAL whose files are kept in an
+// fs.MemFS, so it checks appends, truncates and reports missing entries
+// exactly as one on disk does, but there's no temporary directory to clean up.
+//
+// Nothing is shared between WALs returned by separate calls. To test what
+// survives a restart, open a WAL with wal.WithVFS and an fs.MemFS instead and
+// open it again with the same MemFS after closing it.
+//
+// Since nothing touches the OS file system the package also builds for
+// WebAssembly (GOARCH=wasm), where it's the simplest way to use a WAL in a
+// browser or other sandbox. NewStore isn't available there since
+// hashicorp/raft doesn't build for it.
+package walmem
+
+import (
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/fs"
+)
+
+// dir is the name of the directory every in-memory WAL is kept in. It doesn't
+// matter what it is since each has its own file system.
+const dir = "wal"
+
+// Open returns a new, empty in-memory WAL. Its memory is freed once it's
+// closed and no longer referenced.
+func Open() (*wal.WAL, error) {
+	return wal.Open(dir, wal.WithVFS(fs.NewMem()))
+}
@@ -0,0 +1,52 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package walmem
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func makeEntries(first, n uint64) []types.LogEntry {
+	entries := make([]types.LogEntry, 0, n)
+	for idx := first; idx < first+n; idx++ {
+		entries = append(entries, types.LogEntry{Index: idx, Data: []byte(fmt.Sprintf("entry %d", idx))})
+	}
+	return entries
+}
+
+func TestOpen(t *testing.T) {
+	w, err := Open()
+	require.NoError(t, err)
+	defer w.Close()
+
+	var le types.LogEntry
+	require.ErrorIs(t, w.GetLog(1, &le), wal.ErrNotFound)
+
+	require.NoError(t, w.StoreLogs(makeEntries(1, 100)))
+	require.Error(t, w.StoreLogs(makeEntries(102, 1)), "gaps should be rejected")
+	require.NoError(t, w.GetLog(50, &le))
+	require.Equal(t, "entry 50", string(le.Data))
+	require.ErrorIs(t, w.GetLog(101, &le), wal.ErrNotFound)
+
+	require.NoError(t, w.TruncateFront(10))
+	require.NoError(t, w.TruncateBack(90))
+	require.ErrorIs(t, w.GetLog(9, &le), wal.ErrNotFound)
+	require.ErrorIs(t, w.GetLog(91, &le), wal.ErrNotFound)
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 10, int(first))
+
+	// Each WAL is independent.
+	other, err := Open()
+	require.NoError(t, err)
+	defer other.Close()
+	last, err := other.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 0, int(last))
+}
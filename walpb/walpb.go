@@ -0,0 +1,237 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package walpb encodes log entries as the LogEntry and LogEntries protobuf
+// messages defined in wal.proto, so that tools in other languages can read
+// them with code generated from the schema. The encoding is written directly
+// with protowire rather than generated, which keeps it free of reflection and
+// lets it append to and decode into reused buffers.
+//
+// Codec stores whole entries in the Data of another WAL's entries through
+// wal.TypedWAL:
+//
+//	tw := wal.NewTyped[types.LogEntry](w, walpb.Codec{})
+package walpb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dreamsxin/wal/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers from wal.proto.
+const (
+	fieldIndex      protowire.Number = 1
+	fieldTerm       protowire.Number = 2
+	fieldType       protowire.Number = 3
+	fieldMeta       protowire.Number = 4
+	fieldAppendedAt protowire.Number = 5
+	fieldData       protowire.Number = 6
+
+	fieldEntries protowire.Number = 1
+
+	// google.protobuf.Timestamp
+	fieldSeconds protowire.Number = 1
+	fieldNanos   protowire.Number = 2
+)
+
+// ErrInvalid is returned when data isn't a valid encoding of the message
+// being decoded.
+var ErrInvalid = errors.New("invalid protobuf encoding")
+
+// AppendEntry appends the LogEntry message encoding e to dst and returns the
+// extended buffer. Fields with zero values are left out as in proto3, and so
+// is AppendedAt if it's the zero time.
+func AppendEntry(dst []byte, e types.LogEntry) []byte {
+	if e.Index != 0 {
+		dst = protowire.AppendTag(dst, fieldIndex, protowire.VarintType)
+		dst = protowire.AppendVarint(dst, e.Index)
+	}
+	if e.Term != 0 {
+		dst = protowire.AppendTag(dst, fieldTerm, protowire.VarintType)
+		dst = protowire.AppendVarint(dst, e.Term)
+	}
+	if e.Type != 0 {
+		dst = protowire.AppendTag(dst, fieldType, protowire.VarintType)
+		dst = protowire.AppendVarint(dst, uint64(e.Type))
+	}
+	if len(e.Meta) > 0 {
+		dst = protowire.AppendTag(dst, fieldMeta, protowire.BytesType)
+		dst = protowire.AppendBytes(dst, e.Meta)
+	}
+	if !e.AppendedAt.IsZero() {
+		var ts [2 * (1 + binary.MaxVarintLen64)]byte
+		b := appendTimestamp(ts[:0], e.AppendedAt)
+		dst = protowire.AppendTag(dst, fieldAppendedAt, protowire.BytesType)
+		dst = protowire.AppendBytes(dst, b)
+	}
+	if len(e.Data) > 0 {
+		dst = protowire.AppendTag(dst, fieldData, protowire.BytesType)
+		dst = protowire.AppendBytes(dst, e.Data)
+	}
+	return dst
+}
+
+func appendTimestamp(dst []byte, t time.Time) []byte {
+	if secs := t.Unix(); secs != 0 {
+		dst = protowire.AppendTag(dst, fieldSeconds, protowire.VarintType)
+		dst = protowire.AppendVarint(dst, uint64(secs))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		dst = protowire.AppendTag(dst, fieldNanos, protowire.VarintType)
+		dst = protowire.AppendVarint(dst, uint64(nanos))
+	}
+	return dst
+}
+
+// UnmarshalEntry decodes the LogEntry message in data into e, replacing all of
+// its fields. Meta and Data are copied, reusing e's buffers if they're big
+// enough, so e doesn't refer to data afterwards. Unknown fields are skipped.
+func UnmarshalEntry(data []byte, e *types.LogEntry) error {
+	*e = types.LogEntry{Meta: e.Meta[:0], Data: e.Data[:0]}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %w", ErrInvalid, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		switch {
+		case num == fieldIndex && typ == protowire.VarintType:
+			e.Index, n = protowire.ConsumeVarint(data)
+		case num == fieldTerm && typ == protowire.VarintType:
+			e.Term, n = protowire.ConsumeVarint(data)
+		case num == fieldType && typ == protowire.VarintType:
+			var v uint64
+			if v, n = protowire.ConsumeVarint(data); n >= 0 && v > math.MaxUint8 {
+				return fmt.Errorf("%w: type %d is more than %d", ErrInvalid, v, math.MaxUint8)
+			}
+			e.Type = uint8(v)
+		case num == fieldMeta && typ == protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(data)
+			e.Meta = append(e.Meta[:0], b...)
+		case num == fieldAppendedAt && typ == protowire.BytesType:
+			var b []byte
+			if b, n = protowire.ConsumeBytes(data); n >= 0 {
+				var err error
+				if e.AppendedAt, err = consumeTimestamp(b); err != nil {
+					return err
+				}
+			}
+		case num == fieldData && typ == protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(data)
+			e.Data = append(e.Data[:0], b...)
+		case num == fieldIndex || num == fieldTerm || num == fieldType ||
+			num == fieldMeta || num == fieldAppendedAt || num == fieldData:
+			return fmt.Errorf("%w: field %d has wire type %d", ErrInvalid, num, typ)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: field %d: %w", ErrInvalid, num, protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+	// Empty and absent bytes fields can't be told apart so both are nil.
+	if len(e.Meta) == 0 {
+		e.Meta = nil
+	}
+	if len(e.Data) == 0 {
+		e.Data = nil
+	}
+	return nil
+}
+
+func consumeTimestamp(data []byte) (time.Time, error) {
+	var secs, nanos uint64
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return time.Time{}, fmt.Errorf("%w: appended_at: %w", ErrInvalid, protowire.ParseError(n))
+		}
+		data = data[n:]
+		switch {
+		case num == fieldSeconds && typ == protowire.VarintType:
+			secs, n = protowire.ConsumeVarint(data)
+		case num == fieldNanos && typ == protowire.VarintType:
+			nanos, n = protowire.ConsumeVarint(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return time.Time{}, fmt.Errorf("%w: appended_at: %w", ErrInvalid, protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+	// nanos is an int32 so negative values are sign extended to 64 bits.
+	if ns := int64(nanos); ns < 0 || ns >= int64(time.Second) {
+		return time.Time{}, fmt.Errorf("%w: appended_at has %d nanos", ErrInvalid, ns)
+	}
+	return time.Unix(int64(secs), int64(nanos)), nil
+}
+
+// AppendEntries appends the LogEntries message holding entries to dst and
+// returns the extended buffer.
+func AppendEntries(dst []byte, entries []types.LogEntry) []byte {
+	var buf []byte
+	for _, e := range entries {
+		buf = AppendEntry(buf[:0], e)
+		dst = protowire.AppendTag(dst, fieldEntries, protowire.BytesType)
+		dst = protowire.AppendBytes(dst, buf)
+	}
+	return dst
+}
+
+// UnmarshalEntries decodes the LogEntries message in data and returns its
+// entries.
+func UnmarshalEntries(data []byte) ([]types.LogEntry, error) {
+	var entries []types.LogEntry
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %w", ErrInvalid, protowire.ParseError(n))
+		}
+		data = data[n:]
+		if num != fieldEntries {
+			if n = protowire.ConsumeFieldValue(num, typ, data); n < 0 {
+				return nil, fmt.Errorf("%w: field %d: %w", ErrInvalid, num, protowire.ParseError(n))
+			}
+			data = data[n:]
+			continue
+		}
+		if typ != protowire.BytesType {
+			return nil, fmt.Errorf("%w: field %d has wire type %d", ErrInvalid, num, typ)
+		}
+		b, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: entry %d: %w", ErrInvalid, len(entries), protowire.ParseError(n))
+		}
+		data = data[n:]
+		var e types.LogEntry
+		if err := UnmarshalEntry(b, &e); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", len(entries), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Codec is a wal.Codec that stores whole log entries as LogEntry messages.
+type Codec struct{}
+
+// Marshal implements wal.Codec.
+func (Codec) Marshal(dst []byte, e types.LogEntry) ([]byte, error) {
+	return AppendEntry(dst, e), nil
+}
+
+// Unmarshal implements wal.Codec.
+func (Codec) Unmarshal(data []byte, e *types.LogEntry) error {
+	return UnmarshalEntry(data, e)
+}
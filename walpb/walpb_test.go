@@ -0,0 +1,170 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package walpb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// schema builds the descriptor of wal.proto by hand so that the encoding can
+// be checked against the protobuf library without generated code.
+func schema(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(num),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+	}
+	appendedAt := field("appended_at", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	appendedAt.TypeName = proto.String(".google.protobuf.Timestamp")
+	entries := field("entries", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	entries.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	entries.TypeName = proto.String(".dreamsxin.wal.v1.LogEntry")
+
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("wal.proto"),
+		Package:    proto.String("dreamsxin.wal.v1"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{timestamppb.File_google_protobuf_timestamp_proto.Path()},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("LogEntry"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("index", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+				field("term", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+				field("type", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+				field("meta", 4, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+				appendedAt,
+				field("data", 6, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+			},
+		}, {
+			Name:  proto.String("LogEntries"),
+			Field: []*descriptorpb.FieldDescriptorProto{entries},
+		}},
+	}, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+	return fd
+}
+
+func testEntries() []types.LogEntry {
+	return []types.LogEntry{
+		{Index: 1},
+		{Index: 2, Term: 3, Type: 255, Meta: []byte("meta"), Data: []byte("data")},
+		{Index: 1 << 40, AppendedAt: time.Unix(1700000000, 123456789)},
+		{Index: 4, AppendedAt: time.Unix(-5, 0)},
+		{Index: 5, AppendedAt: time.Unix(0, 0), Data: make([]byte, 1000)},
+	}
+}
+
+func TestEntryMatchesSchema(t *testing.T) {
+	md := schema(t).Messages().ByName("LogEntry")
+	fields := md.Fields()
+	for _, e := range testEntries() {
+		// What the protobuf library makes of our encoding.
+		got := dynamicpb.NewMessage(md)
+		require.NoError(t, proto.Unmarshal(AppendEntry(nil, e), got))
+		require.Equal(t, e.Index, got.Get(fields.ByName("index")).Uint())
+		require.Equal(t, e.Term, got.Get(fields.ByName("term")).Uint())
+		require.Equal(t, uint64(e.Type), got.Get(fields.ByName("type")).Uint())
+		require.Equal(t, string(e.Meta), string(got.Get(fields.ByName("meta")).Bytes()))
+		require.Equal(t, string(e.Data), string(got.Get(fields.ByName("data")).Bytes()))
+		require.Equal(t, !e.AppendedAt.IsZero(), got.Has(fields.ByName("appended_at")))
+
+		// And what we make of its encoding.
+		want := dynamicpb.NewMessage(md)
+		want.Set(fields.ByName("index"), protoreflect.ValueOfUint64(e.Index))
+		want.Set(fields.ByName("term"), protoreflect.ValueOfUint64(e.Term))
+		want.Set(fields.ByName("type"), protoreflect.ValueOfUint32(uint32(e.Type)))
+		want.Set(fields.ByName("meta"), protoreflect.ValueOfBytes(e.Meta))
+		want.Set(fields.ByName("data"), protoreflect.ValueOfBytes(e.Data))
+		if !e.AppendedAt.IsZero() {
+			want.Set(fields.ByName("appended_at"), protoreflect.ValueOfMessage(timestamppb.New(e.AppendedAt).ProtoReflect()))
+		}
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(want)
+		require.NoError(t, err)
+		require.Equal(t, b, AppendEntry(nil, e))
+
+		var le types.LogEntry
+		require.NoError(t, UnmarshalEntry(b, &le))
+		require.True(t, e.AppendedAt.Equal(le.AppendedAt))
+		le.AppendedAt = e.AppendedAt
+		require.Equal(t, e, le)
+	}
+}
+
+func TestEntriesMatchSchema(t *testing.T) {
+	md := schema(t).Messages().ByName("LogEntries")
+	entries := testEntries()
+	b := AppendEntries(nil, entries)
+
+	got := dynamicpb.NewMessage(md)
+	require.NoError(t, proto.Unmarshal(b, got))
+	require.Equal(t, len(entries), got.Get(md.Fields().ByName("entries")).List().Len())
+
+	decoded, err := UnmarshalEntries(b)
+	require.NoError(t, err)
+	require.Len(t, decoded, len(entries))
+	for i, e := range entries {
+		require.True(t, e.AppendedAt.Equal(decoded[i].AppendedAt))
+		decoded[i].AppendedAt = e.AppendedAt
+		require.Equal(t, e, decoded[i])
+	}
+}
+
+func TestUnmarshalEntry(t *testing.T) {
+	// Unknown fields are skipped and buffers reused.
+	b := AppendEntry(nil, types.LogEntry{Index: 7, Data: []byte("hello")})
+	b = protowire.AppendTag(b, 99, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte("future"))
+	le := types.LogEntry{Term: 9, Data: make([]byte, 0, 64)}
+	data := le.Data[:1]
+	require.NoError(t, UnmarshalEntry(b, &le))
+	require.Equal(t, types.LogEntry{Index: 7, Data: []byte("hello")}, le)
+	require.Equal(t, &data[0], &le.Data[0])
+
+	for name, b := range map[string][]byte{
+		"truncated": AppendEntry(nil, types.LogEntry{Index: 1, Data: []byte("data")})[:5],
+		"wire type": protowire.AppendVarint(protowire.AppendTag(nil, fieldData, protowire.VarintType), 1),
+		"type":      protowire.AppendVarint(protowire.AppendTag(nil, fieldType, protowire.VarintType), 256),
+		"nanos": protowire.AppendBytes(protowire.AppendTag(nil, fieldAppendedAt, protowire.BytesType),
+			protowire.AppendVarint(protowire.AppendTag(nil, fieldNanos, protowire.VarintType), uint64(time.Second))),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.ErrorIs(t, UnmarshalEntry(b, &le), ErrInvalid)
+		})
+	}
+}
+
+func TestCodec(t *testing.T) {
+	w, err := wal.Open("wal", wal.WithVFS(fs.NewMem()))
+	require.NoError(t, err)
+	tw := wal.NewTyped[types.LogEntry](w, Codec{})
+
+	entries := testEntries()
+	require.NoError(t, tw.Store(1, entries...))
+	for i, e := range entries {
+		got, err := tw.Get(uint64(i + 1))
+		require.NoError(t, err)
+		require.True(t, e.AppendedAt.Equal(got.AppendedAt))
+		got.AppendedAt = e.AppendedAt
+		require.Equal(t, e, got)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package waltest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/types"
+)
+
+var _ types.VFS = &CrashFS{}
+
+// CrashMode is what a crash loses of the writes made before it.
+type CrashMode int
+
+const (
+	// CrashProcess is the process dying while the OS carries on, so every
+	// write made survives, synced or not.
+	CrashProcess CrashMode = iota
+
+	// CrashPower is the machine losing power, so only what was synced
+	// survives. Data written to a file since it was last synced is lost, as
+	// are files created, renamed or deleted since their dir was last synced.
+	CrashPower
+
+	// CrashTorn is CrashProcess except that if the last thing done before the
+	// crash was a write, only its first half reached the disk.
+	CrashTorn
+)
+
+func (m CrashMode) String() string {
+	switch m {
+	case CrashProcess:
+		return "process"
+	case CrashPower:
+		return "power"
+	case CrashTorn:
+		return "torn"
+	}
+	return fmt.Sprintf("CrashMode(%d)", int(m))
+}
+
+// crashOpKind is the kind of a recorded crashOp.
+type crashOpKind int
+
+const (
+	crashCreate crashOpKind = iota
+	crashWrite
+	crashSync
+	crashSyncDir
+	crashDelete
+	crashRename
+)
+
+// crashOp is one change recorded by a CrashFS.
+type crashOp struct {
+	kind    crashOpKind
+	dir     string
+	name    string
+	newName string
+	// file identifies the file created, written or synced, like an inode
+	// number, since it may have been renamed or deleted since.
+	file int
+	size uint64
+	off  int64
+	data []byte
+}
+
+// CrashFS is an in-memory types.VFS that records every change made through it
+// so that Crash can later recreate the files as they would be after a crash
+// at any point. It makes the same durability promises as fs.FS: a new file's
+// dir entry is synced along with the file the first time it's synced, and
+// Delete and Rename sync the dir before they return. Nothing else syncs a dir.
+type CrashFS struct {
+	mu   sync.Mutex
+	live *fs.MemFS
+	ops  []crashOp
+	// names maps dir and then name to the file currently called that.
+	names map[string]map[string]int
+	files int
+}
+
+// NewCrashFS returns an empty CrashFS.
+func NewCrashFS() *CrashFS {
+	return &CrashFS{
+		live:  fs.NewMem(),
+		names: make(map[string]map[string]int),
+	}
+}
+
+// CrashPoints returns the number of changes recorded so far. A crash can be
+// simulated at any point from 0, before anything was done, up to it.
+func (c *CrashFS) CrashPoints() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.ops)
+}
+
+// record appends op. c.mu must be held.
+func (c *CrashFS) record(op crashOp) {
+	c.ops = append(c.ops, op)
+}
+
+// ListDir implements types.VFS.
+func (c *CrashFS) ListDir(dir string) ([]string, error) {
+	return c.live.ListDir(dir)
+}
+
+// Create implements types.VFS.
+func (c *CrashFS) Create(dir, name string, size uint64) (types.WritableFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := c.live.Create(dir, name, size)
+	if err != nil {
+		return nil, err
+	}
+	c.files++
+	id := c.files
+	if c.names[dir] == nil {
+		c.names[dir] = make(map[string]int)
+	}
+	c.names[dir][name] = id
+	c.record(crashOp{kind: crashCreate, dir: dir, name: name, file: id, size: size})
+	return &crashFile{WritableFile: f, c: c, dir: dir, file: id}, nil
+}
+
+// Delete implements types.VFS.
+func (c *CrashFS) Delete(dir, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.live.Delete(dir, name); err != nil {
+		return err
+	}
+	delete(c.names[dir], name)
+	c.record(crashOp{kind: crashDelete, dir: dir, name: name})
+	c.record(crashOp{kind: crashSyncDir, dir: dir})
+	return nil
+}
+
+// Rename implements types.VFS.
+func (c *CrashFS) Rename(dir, oldName, newName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.live.Rename(dir, oldName, newName); err != nil {
+		return err
+	}
+	c.names[dir][newName] = c.names[dir][oldName]
+	delete(c.names[dir], oldName)
+	c.record(crashOp{kind: crashRename, dir: dir, name: oldName, newName: newName})
+	c.record(crashOp{kind: crashSyncDir, dir: dir})
+	return nil
+}
+
+// OpenReader implements types.VFS.
+func (c *CrashFS) OpenReader(dir, name string) (types.ReadableFile, error) {
+	return c.live.OpenReader(dir, name)
+}
+
+// OpenWriter implements types.VFS.
+func (c *CrashFS) OpenWriter(dir, name string) (types.WritableFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := c.live.OpenWriter(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	// The file already exists so its dir entry is assumed to be durable.
+	return &crashFile{WritableFile: f, c: c, dir: dir, file: c.names[dir][name], dirSynced: true}, nil
+}
+
+// crashFile is a file opened for writing by a CrashFS.
+type crashFile struct {
+	types.WritableFile
+	c         *CrashFS
+	dir       string
+	file      int
+	dirSynced bool
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+
+	n, err := f.WritableFile.WriteAt(p, off)
+	if n > 0 {
+		data := append([]byte(nil), p[:n]...)
+		f.c.record(crashOp{kind: crashWrite, file: f.file, off: off, data: data})
+	}
+	return n, err
+}
+
+func (f *crashFile) Sync() error {
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+
+	f.c.record(crashOp{kind: crashSync, file: f.file})
+	if !f.dirSynced {
+		f.dirSynced = true
+		f.c.record(crashOp{kind: crashSyncDir, dir: f.dir})
+	}
+	return nil
+}
+
+// crashContents is the contents of one file while replaying.
+type crashContents struct {
+	size uint64
+	data []byte
+}
+
+func (cc *crashContents) write(off int64, p []byte) {
+	end := int(off) + len(p)
+	if end > len(cc.data) {
+		data := make([]byte, end)
+		copy(data, cc.data)
+		cc.data = data
+	}
+	copy(cc.data[off:], p)
+}
+
+func (cc crashContents) clone() crashContents {
+	return crashContents{size: cc.size, data: append([]byte(nil), cc.data...)}
+}
+
+// Crash returns a new fs.MemFS holding the files as they would be found after
+// a crash of the given mode once the first point changes had been made. It
+// panics if point is more than CrashPoints.
+func (c *CrashFS) Crash(point int, mode CrashMode) *fs.MemFS {
+	c.mu.Lock()
+	ops := c.ops[:point]
+	c.mu.Unlock()
+
+	var (
+		// live and durable are the contents of each file as the process saw
+		// them and as far as they're synced.
+		live    = make(map[int]*crashContents)
+		durable = make(map[int]crashContents)
+		// liveNames and durableNames map each dir's names to files.
+		liveNames    = make(map[string]map[string]int)
+		durableNames = make(map[string]map[string]int)
+	)
+	for i, op := range ops {
+		switch op.kind {
+		case crashCreate:
+			live[op.file] = &crashContents{size: op.size}
+			durable[op.file] = crashContents{size: op.size}
+			if liveNames[op.dir] == nil {
+				liveNames[op.dir] = make(map[string]int)
+			}
+			liveNames[op.dir][op.name] = op.file
+		case crashWrite:
+			data := op.data
+			if mode == CrashTorn && i == len(ops)-1 {
+				data = data[:len(data)/2]
+			}
+			live[op.file].write(op.off, data)
+		case crashSync:
+			durable[op.file] = live[op.file].clone()
+		case crashSyncDir:
+			names := make(map[string]int, len(liveNames[op.dir]))
+			for name, file := range liveNames[op.dir] {
+				names[name] = file
+			}
+			durableNames[op.dir] = names
+		case crashDelete:
+			delete(liveNames[op.dir], op.name)
+		case crashRename:
+			liveNames[op.dir][op.newName] = liveNames[op.dir][op.name]
+			delete(liveNames[op.dir], op.name)
+		}
+	}
+
+	names := liveNames
+	if mode == CrashPower {
+		names = durableNames
+	}
+	mem := fs.NewMem()
+	for dir, files := range names {
+		for name, file := range files {
+			contents := *live[file]
+			if mode == CrashPower {
+				contents = durable[file]
+			}
+			f, err := mem.Create(dir, name, contents.size)
+			if err != nil {
+				panic(err)
+			}
+			if _, err := f.WriteAt(contents.data, 0); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return mem
+}
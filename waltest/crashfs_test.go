@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package waltest
+
+import (
+	"testing"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrashFS(t *testing.T) {
+	c := NewCrashFS()
+	f, err := c.Create("d", "a", 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	_, err = f.WriteAt([]byte(" world"), 5)
+	require.NoError(t, err)
+	g, err := c.Create("d", "b", 0)
+	require.NoError(t, err)
+	_, err = g.WriteAt([]byte("unsynced"), 0)
+	require.NoError(t, err)
+
+	read := func(mem types.VFS, name string) string {
+		rf, err := mem.OpenReader("d", name)
+		require.NoError(t, err)
+		buf := make([]byte, 64)
+		n, _ := rf.ReadAt(buf, 0)
+		return string(buf[:n])
+	}
+
+	mem := c.Crash(c.CrashPoints(), CrashProcess)
+	require.Equal(t, "hello world", read(mem, "a"))
+	require.Equal(t, "unsynced", read(mem, "b"))
+
+	// Power loss drops the unsynced write and the new file whose dir entry was
+	// never synced.
+	mem = c.Crash(c.CrashPoints(), CrashPower)
+	require.Equal(t, "hello", read(mem, "a"))
+	names, err := mem.ListDir("d")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, names)
+
+	mem = c.Crash(c.CrashPoints(), CrashTorn)
+	require.Equal(t, "unsy", read(mem, "b"))
+
+	// Before anything was synced nothing survives a power loss.
+	mem = c.Crash(2, CrashPower)
+	names, err = mem.ListDir("d")
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	// Renames are durable once they return.
+	require.NoError(t, c.Rename("d", "b", "a"))
+	mem = c.Crash(c.CrashPoints(), CrashPower)
+	require.Equal(t, "", read(mem, "a"))
+}
+
+func TestCheckCrashes(t *testing.T) {
+	var batches [][]types.LogEntry
+	for idx := uint64(1); idx <= 120; idx += 10 {
+		batches = append(batches, makeEntries(idx, 10))
+	}
+	CheckCrashes(t, func(vfs types.VFS) (*wal.WAL, error) {
+		return wal.Open("wal", wal.WithVFS(vfs), wal.WithSegmentSize(1024))
+	}, batches)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package waltest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/types"
+)
+
+// OpenFunc opens a WAL whose files are kept in vfs, with whatever options the
+// test needs, e.g. wal.Open(dir, wal.WithVFS(vfs), wal.WithSegmentSize(n)).
+// It must use the same dir every time.
+type OpenFunc func(vfs types.VFS) (*wal.WAL, error)
+
+// crashAck is a batch that StoreLogs acknowledged after point changes to the
+// files.
+type crashAck struct {
+	point int
+	last  uint64
+}
+
+// CheckCrashes appends each of batches in turn to a WAL opened on a CrashFS.
+// Then for every point in the recording and every CrashMode it opens the WAL
+// again on the files as the crash would have left them and checks that:
+//
+//   - it opens;
+//   - every entry acknowledged before the crash is there;
+//   - the log starts at the first entry appended, has no gaps and each entry in
+//     it reads back as appended;
+//   - a new entry can be appended after the last one.
+//
+// It fails t at the first crash that breaks one of these. The batches must
+// start at index 1 and be contiguous.
+func CheckCrashes(t testing.TB, open OpenFunc, batches [][]types.LogEntry) {
+	t.Helper()
+
+	c := NewCrashFS()
+	w, err := open(c)
+	if err != nil {
+		t.Fatalf("failed to open WAL: %s", err)
+	}
+	appended := make(map[uint64][]byte)
+	var acks []crashAck
+	for _, batch := range batches {
+		if err := w.StoreLogs(batch); err != nil {
+			t.Fatalf("failed to append: %s", err)
+		}
+		last := batch[len(batch)-1].Index
+		acks = append(acks, crashAck{point: c.CrashPoints(), last: last})
+		for _, e := range batch {
+			appended[e.Index] = e.Data
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close WAL: %s", err)
+	}
+
+	points := c.CrashPoints()
+	for _, mode := range []CrashMode{CrashProcess, CrashPower, CrashTorn} {
+		for point := 0; point <= points; point++ {
+			var acked uint64
+			for _, a := range acks {
+				if a.point <= point {
+					acked = a.last
+				}
+			}
+			if err := checkCrash(open, c.Crash(point, mode), acked, appended); err != nil {
+				t.Fatalf("%s crash after %d of %d changes: %s", mode, point, points, err)
+			}
+		}
+	}
+}
+
+// checkCrash opens the WAL in vfs and checks it holds at least the entries up
+// to acked and otherwise only the entries appended.
+func checkCrash(open OpenFunc, vfs types.VFS, acked uint64, appended map[uint64][]byte) error {
+	w, err := open(vfs)
+	if err != nil {
+		return fmt.Errorf("failed to open: %w", err)
+	}
+	defer w.Close()
+
+	first, err := w.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := w.LastIndex()
+	if err != nil {
+		return err
+	}
+	if last < acked {
+		return fmt.Errorf("last index is %d but entries up to %d were acknowledged", last, acked)
+	}
+	if last > 0 && first != 1 {
+		return fmt.Errorf("first index is %d", first)
+	}
+	var le types.LogEntry
+	for idx := first; idx <= last && last > 0; idx++ {
+		want, ok := appended[idx]
+		if !ok {
+			return fmt.Errorf("entry %d was never appended", idx)
+		}
+		if err := w.GetLog(idx, &le); err != nil {
+			return fmt.Errorf("failed to read entry %d: %w", idx, err)
+		}
+		if !bytes.Equal(le.Data, want) {
+			return fmt.Errorf("entry %d has data %q, expected %q", idx, le.Data, want)
+		}
+	}
+	next := types.LogEntry{Index: last + 1, Data: []byte("after crash")}
+	if err := w.StoreLogs([]types.LogEntry{next}); err != nil {
+		return fmt.Errorf("failed to append after recovery: %w", err)
+	}
+	return nil
+}
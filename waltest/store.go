@@ -0,0 +1,113 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package waltest
+
+import (
+	"github.com/dreamsxin/wal/types"
+)
+
+var (
+	_ types.MetaStore    = &MetaStore{}
+	_ types.SegmentFiler = &SegmentFiler{}
+)
+
+// MetaStore wraps a types.MetaStore, injecting faults into its calls. Close
+// calls are never interfered with.
+type MetaStore struct {
+	types.MetaStore
+	in *Injector
+}
+
+// NewMetaStore returns a MetaStore that makes calls to ms subject to in.
+func NewMetaStore(ms types.MetaStore, in *Injector) *MetaStore {
+	return &MetaStore{MetaStore: ms, in: in}
+}
+
+// Load implements types.MetaStore.
+func (m *MetaStore) Load(dir string) (types.PersistentState, error) {
+	if err := m.in.check(OpLoad); err != nil {
+		return types.PersistentState{}, err
+	}
+	return m.MetaStore.Load(dir)
+}
+
+// CommitState implements types.MetaStore.
+func (m *MetaStore) CommitState(state types.PersistentState) error {
+	if err := m.in.check(OpCommitState); err != nil {
+		return err
+	}
+	return m.MetaStore.CommitState(state)
+}
+
+// GetStable implements types.MetaStore.
+func (m *MetaStore) GetStable(key []byte) ([]byte, error) {
+	if err := m.in.check(OpGetStable); err != nil {
+		return nil, err
+	}
+	return m.MetaStore.GetStable(key)
+}
+
+// SetStable implements types.MetaStore.
+func (m *MetaStore) SetStable(key, value []byte) error {
+	if err := m.in.check(OpSetStable); err != nil {
+		return err
+	}
+	return m.MetaStore.SetStable(key, value)
+}
+
+// SegmentFiler wraps a types.SegmentFiler, injecting faults into its calls.
+// The readers and writers it returns are those of the wrapped SegmentFiler, so
+// to interfere with their reads and writes wrap the VFS it uses instead.
+// Optional methods of the wrapped SegmentFiler aren't passed through, so for
+// example the WAL can't Archive through it.
+type SegmentFiler struct {
+	sf types.SegmentFiler
+	in *Injector
+}
+
+// NewSegmentFiler returns a SegmentFiler that makes calls to sf subject to
+// in.
+func NewSegmentFiler(sf types.SegmentFiler, in *Injector) *SegmentFiler {
+	return &SegmentFiler{sf: sf, in: in}
+}
+
+// Create implements types.SegmentFiler.
+func (s *SegmentFiler) Create(info types.SegmentInfo) (types.SegmentWriter, error) {
+	if err := s.in.check(OpSegmentCreate); err != nil {
+		return nil, err
+	}
+	return s.sf.Create(info)
+}
+
+// RecoverTail implements types.SegmentFiler.
+func (s *SegmentFiler) RecoverTail(info types.SegmentInfo) (types.SegmentWriter, error) {
+	if err := s.in.check(OpSegmentRecoverTail); err != nil {
+		return nil, err
+	}
+	return s.sf.RecoverTail(info)
+}
+
+// Open implements types.SegmentFiler.
+func (s *SegmentFiler) Open(info types.SegmentInfo) (types.SegmentReader, error) {
+	if err := s.in.check(OpSegmentOpen); err != nil {
+		return nil, err
+	}
+	return s.sf.Open(info)
+}
+
+// List implements types.SegmentFiler.
+func (s *SegmentFiler) List() (map[uint64]uint64, error) {
+	if err := s.in.check(OpSegmentList); err != nil {
+		return nil, err
+	}
+	return s.sf.List()
+}
+
+// Delete implements types.SegmentFiler.
+func (s *SegmentFiler) Delete(baseIndex, ID uint64) error {
+	if err := s.in.check(OpSegmentDelete); err != nil {
+		return err
+	}
+	return s.sf.Delete(baseIndex, ID)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package waltest
+
+import (
+	"github.com/dreamsxin/wal/types"
+)
+
+var (
+	_ types.VFS              = &VFS{}
+	_ types.WritableFile     = &writableFile{}
+	_ types.PageCacheDropper = &writableFile{}
+)
+
+// VFS wraps a types.VFS, and the files it opens, injecting faults into their
+// calls. Close calls are never interfered with.
+type VFS struct {
+	vfs types.VFS
+	in  *Injector
+}
+
+// NewVFS returns a VFS that makes calls to vfs subject to in.
+func NewVFS(vfs types.VFS, in *Injector) *VFS {
+	return &VFS{vfs: vfs, in: in}
+}
+
+// ListDir implements types.VFS.
+func (v *VFS) ListDir(dir string) ([]string, error) {
+	if err := v.in.check(OpListDir); err != nil {
+		return nil, err
+	}
+	return v.vfs.ListDir(dir)
+}
+
+// Create implements types.VFS.
+func (v *VFS) Create(dir, name string, size uint64) (types.WritableFile, error) {
+	if err := v.in.check(OpCreate); err != nil {
+		return nil, err
+	}
+	f, err := v.vfs.Create(dir, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return &writableFile{WritableFile: f, in: v.in}, nil
+}
+
+// Delete implements types.VFS.
+func (v *VFS) Delete(dir, name string) error {
+	if err := v.in.check(OpDelete); err != nil {
+		return err
+	}
+	return v.vfs.Delete(dir, name)
+}
+
+// Rename implements types.VFS.
+func (v *VFS) Rename(dir, oldName, newName string) error {
+	if err := v.in.check(OpRename); err != nil {
+		return err
+	}
+	return v.vfs.Rename(dir, oldName, newName)
+}
+
+// OpenReader implements types.VFS.
+func (v *VFS) OpenReader(dir, name string) (types.ReadableFile, error) {
+	if err := v.in.check(OpOpenReader); err != nil {
+		return nil, err
+	}
+	f, err := v.vfs.OpenReader(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &readableFile{ReadableFile: f, in: v.in}, nil
+}
+
+// OpenWriter implements types.VFS.
+func (v *VFS) OpenWriter(dir, name string) (types.WritableFile, error) {
+	if err := v.in.check(OpOpenWriter); err != nil {
+		return nil, err
+	}
+	f, err := v.vfs.OpenWriter(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &writableFile{WritableFile: f, in: v.in}, nil
+}
+
+type readableFile struct {
+	types.ReadableFile
+	in *Injector
+}
+
+func (f *readableFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.in.check(OpReadAt); err != nil {
+		return 0, err
+	}
+	return f.ReadableFile.ReadAt(p, off)
+}
+
+type writableFile struct {
+	types.WritableFile
+	in *Injector
+}
+
+func (f *writableFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.in.check(OpReadAt); err != nil {
+		return 0, err
+	}
+	return f.WritableFile.ReadAt(p, off)
+}
+
+func (f *writableFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.in.writeAt(f.WritableFile, p, off)
+}
+
+func (f *writableFile) Sync() error {
+	if err := f.in.check(OpSync); err != nil {
+		return err
+	}
+	return f.WritableFile.Sync()
+}
+
+func (f *writableFile) DropPageCache() error {
+	if d, ok := f.WritableFile.(types.PageCacheDropper); ok {
+		return d.DropPageCache()
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package waltest helps test code that embeds the WAL against realistic
+// failures. It wraps the VFS, MetaStore and SegmentFiler the WAL is built on
+// so that chosen calls fail, write only part of their data or are slowed
+// down. For example, to make the third fsync fail:
+//
+//	in := waltest.NewInjector()
+//	in.At(waltest.OpSync, 3, waltest.Fault{Err: errors.New("EIO")})
+//	w, err := wal.Open(dir, wal.WithVFS(waltest.NewVFS(fs.New(), in)))
+//
+// Wrapping the VFS is usually the most realistic choice since the WAL's own
+// SegmentFiler and MetaStore still run on top of it.
+package waltest
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Op names a kind of call faults can be injected into.
+type Op string
+
+// The calls of the wrapped types.VFS and the files it opens.
+const (
+	OpListDir    Op = "ListDir"
+	OpCreate     Op = "Create"
+	OpDelete     Op = "Delete"
+	OpRename     Op = "Rename"
+	OpOpenReader Op = "OpenReader"
+	OpOpenWriter Op = "OpenWriter"
+	OpReadAt     Op = "ReadAt"
+	OpWriteAt    Op = "WriteAt"
+	OpSync       Op = "Sync"
+)
+
+// The calls of the wrapped types.MetaStore.
+const (
+	OpLoad        Op = "Load"
+	OpCommitState Op = "CommitState"
+	OpGetStable   Op = "GetStable"
+	OpSetStable   Op = "SetStable"
+)
+
+// The calls of the wrapped types.SegmentFiler.
+const (
+	OpSegmentCreate      Op = "SegmentCreate"
+	OpSegmentRecoverTail Op = "SegmentRecoverTail"
+	OpSegmentOpen        Op = "SegmentOpen"
+	OpSegmentList        Op = "SegmentList"
+	OpSegmentDelete      Op = "SegmentDelete"
+)
+
+// ErrInjected is the error a Fault with PartialWrite set but no Err returns.
+var ErrInjected = errors.New("injected fault")
+
+// Fault describes what happens to a call.
+type Fault struct {
+	// Latency is how long to sleep before the call.
+	Latency time.Duration
+
+	// Err, if set, is returned instead of making the call.
+	Err error
+
+	// PartialWrite, if positive, makes a WriteAt write only its first
+	// PartialWrite bytes and then fail with Err, or ErrInjected if Err isn't
+	// set, as though the process crashed part way through. It's ignored for
+	// other calls.
+	PartialWrite int
+}
+
+// Injector counts the calls made through the wrappers sharing it and decides
+// which to interfere with. It's safe for concurrent use.
+type Injector struct {
+	mu     sync.Mutex
+	calls  map[Op]int
+	at     map[Op]map[int]Fault
+	from   map[Op]fromFault
+	onCall func(op Op, n int)
+}
+
+// fromFault is a Fault for every call from the nth on.
+type fromFault struct {
+	n int
+	f Fault
+}
+
+// NewInjector returns an Injector that doesn't interfere with any calls until
+// told to.
+func NewInjector() *Injector {
+	return &Injector{
+		calls: make(map[Op]int),
+		at:    make(map[Op]map[int]Fault),
+		from:  make(map[Op]fromFault),
+	}
+}
+
+// At injects f into the nth call of op, counting from 1. Calls made before At
+// is called count too.
+func (in *Injector) At(op Op, n int, f Fault) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.at[op] == nil {
+		in.at[op] = make(map[int]Fault)
+	}
+	in.at[op][n] = f
+}
+
+// From injects f into the nth call of op and every one after it, for example
+// to simulate a disk that has failed for good. Faults set with At take
+// precedence.
+func (in *Injector) From(op Op, n int, f Fault) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.from[op] = fromFault{n: n, f: f}
+}
+
+// Reset forgets all faults, but not the number of calls made so far.
+func (in *Injector) Reset() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.at = make(map[Op]map[int]Fault)
+	in.from = make(map[Op]fromFault)
+}
+
+// Calls returns how many calls of op have been made.
+func (in *Injector) Calls(op Op) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	return in.calls[op]
+}
+
+// OnCall sets fn to be called, before any fault is applied, with every call
+// made and its number. It's useful for finding which call to inject a fault
+// into. fn mustn't call the Injector.
+func (in *Injector) OnCall(fn func(op Op, n int)) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.onCall = fn
+}
+
+// fault counts a call of op and returns the fault to apply to it, after
+// sleeping for its Latency.
+func (in *Injector) fault(op Op) Fault {
+	in.mu.Lock()
+	in.calls[op]++
+	n := in.calls[op]
+	if in.onCall != nil {
+		in.onCall(op, n)
+	}
+	f, ok := in.at[op][n]
+	if !ok {
+		if ff, found := in.from[op]; found && n >= ff.n {
+			f = ff.f
+		}
+	}
+	in.mu.Unlock()
+
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	return f
+}
+
+// check counts a call of op and returns the error it should fail with, if
+// any.
+func (in *Injector) check(op Op) error {
+	return in.fault(op).Err
+}
+
+// writeAt counts a WriteAt call and makes it to w unless it should fail,
+// writing only part of p if the fault says so.
+func (in *Injector) writeAt(w io.WriterAt, p []byte, off int64) (int, error) {
+	f := in.fault(OpWriteAt)
+	if f.PartialWrite > 0 && f.PartialWrite < len(p) {
+		n, err := w.WriteAt(p[:f.PartialWrite], off)
+		if err != nil {
+			return n, err
+		}
+		if f.Err != nil {
+			return n, f.Err
+		}
+		return n, ErrInjected
+	}
+	if f.Err != nil {
+		return 0, f.Err
+	}
+	return w.WriteAt(p, off)
+}
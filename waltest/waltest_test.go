@@ -0,0 +1,369 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package waltest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dreamsxin/wal"
+	"github.com/dreamsxin/wal/fs"
+	"github.com/dreamsxin/wal/metadb"
+	"github.com/dreamsxin/wal/segment"
+	"github.com/dreamsxin/wal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func makeEntries(first, n uint64) []types.LogEntry {
+	entries := make([]types.LogEntry, 0, n)
+	for idx := first; idx < first+n; idx++ {
+		entries = append(entries, types.LogEntry{Index: idx, Data: []byte(fmt.Sprintf("entry %d", idx))})
+	}
+	return entries
+}
+
+func TestVFSFaults(t *testing.T) {
+	mem := fs.NewMem()
+	in := NewInjector()
+	w, err := wal.Open("wal", wal.WithVFS(NewVFS(mem, in)))
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeEntries(1, 10)))
+
+	// A failed fsync fails the append.
+	errEIO := errors.New("EIO")
+	in.At(OpSync, in.Calls(OpSync)+1, Fault{Err: errEIO})
+	require.ErrorIs(t, w.StoreLogs(makeEntries(11, 10)), errEIO)
+	require.NoError(t, w.Close())
+
+	// A torn write of the next batch is rolled back by recovery.
+	w, err = wal.Open("wal", wal.WithVFS(NewVFS(mem, in)))
+	require.NoError(t, err)
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	start := last + 1
+	in.At(OpWriteAt, in.Calls(OpWriteAt)+1, Fault{PartialWrite: 20})
+	require.ErrorIs(t, w.StoreLogs(makeEntries(start, 10)), ErrInjected)
+	require.NoError(t, w.Close())
+
+	w, err = wal.Open("wal", wal.WithVFS(mem))
+	require.NoError(t, err)
+	defer w.Close()
+	got, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, got)
+	var le types.LogEntry
+	require.NoError(t, w.GetLog(10, &le))
+	require.Equal(t, "entry 10", string(le.Data))
+}
+
+func TestFailedSync(t *testing.T) {
+	mem := fs.NewMem()
+	in := NewInjector()
+	w, err := wal.Open("wal", wal.WithVFS(NewVFS(mem, in)))
+	require.NoError(t, err)
+
+	// A failure before anything is in the tail just replaces it.
+	in.At(OpSync, in.Calls(OpSync)+1, Fault{Err: errors.New("EIO")})
+	require.ErrorIs(t, w.StoreLogs(makeEntries(1, 10)), wal.ErrFailed)
+	require.NoError(t, w.ClearError())
+	require.NoError(t, w.StoreLogs(makeEntries(1, 10)))
+
+	// Once a sync fails appends keep failing even though the disk is fine
+	// again.
+	errEIO := errors.New("EIO")
+	in.At(OpSync, in.Calls(OpSync)+1, Fault{Err: errEIO})
+	err = w.StoreLogs(makeEntries(11, 10))
+	require.ErrorIs(t, err, wal.ErrFailed)
+	require.ErrorIs(t, err, types.ErrWriteFailed)
+	require.ErrorIs(t, err, errEIO)
+	syncs := in.Calls(OpSync)
+	err = w.StoreLogs(makeEntries(11, 10))
+	require.ErrorIs(t, err, wal.ErrFailed)
+	require.ErrorIs(t, err, errEIO)
+	require.Error(t, w.AppendLogFrom(11, bytes.NewReader([]byte("entry 11")), 8))
+	require.Equal(t, syncs, in.Calls(OpSync))
+
+	// Reads still work and ClearError starts a new tail after the last
+	// successful append.
+	var le types.LogEntry
+	require.NoError(t, w.GetLog(10, &le))
+	require.NoError(t, w.ClearError())
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), last)
+	require.NoError(t, w.StoreLogs(makeEntries(11, 10)))
+	require.NoError(t, w.GetLog(20, &le))
+	require.Equal(t, "entry 20", string(le.Data))
+
+	// Errors that don't touch the file aren't sticky.
+	require.Error(t, w.StoreLogs(makeEntries(30, 1)))
+	require.NoError(t, w.StoreLogs(makeEntries(21, 1)))
+	require.NoError(t, w.Close())
+
+	w, err = wal.Open("wal", wal.WithVFS(NewVFS(mem, in)))
+	require.NoError(t, err)
+	defer w.Close()
+	last, err = w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(21), last)
+	require.NoError(t, w.GetLog(5, &le))
+	require.Equal(t, "entry 5", string(le.Data))
+
+	// Reopen recovers from a failure too.
+	in.At(OpSync, in.Calls(OpSync)+1, Fault{Err: errEIO})
+	require.ErrorIs(t, w.StoreLogs(makeEntries(22, 1)), wal.ErrFailed)
+	require.NoError(t, w.Reopen())
+	last, err = w.LastIndex()
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeEntries(last+1, 1)))
+}
+
+func TestSyncErrorPolicy(t *testing.T) {
+	errEIO := errors.New("EIO")
+	open := func(t *testing.T, mem *fs.MemFS, p wal.SyncErrorPolicy) (*wal.WAL, *Injector) {
+		in := NewInjector()
+		w, err := wal.Open("wal", wal.WithVFS(NewVFS(mem, in)), wal.WithSyncErrorPolicy(p))
+		require.NoError(t, err)
+		require.NoError(t, w.StoreLogs(makeEntries(1, 10)))
+		in.At(OpSync, in.Calls(OpSync)+1, Fault{Err: errEIO})
+		return w, in
+	}
+
+	t.Run("close", func(t *testing.T) {
+		mem := fs.NewMem()
+		w, _ := open(t, mem, wal.SyncErrorClose)
+		require.ErrorIs(t, w.StoreLogs(makeEntries(11, 10)), errEIO)
+		require.Eventually(t, func() bool {
+			return errors.Is(w.StoreLogs(makeEntries(11, 10)), wal.ErrClosed)
+		}, time.Second, time.Millisecond)
+
+		w, err := wal.Open("wal", wal.WithVFS(mem))
+		require.NoError(t, err)
+		defer w.Close()
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(10, &le))
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		w, _ := open(t, fs.NewMem(), wal.SyncErrorPanic)
+		defer w.Close()
+		var got interface{}
+		func() {
+			defer func() { got = recover() }()
+			w.StoreLogs(makeEntries(11, 10))
+		}()
+		err, ok := got.(error)
+		require.True(t, ok, "expected panic with an error, got %v", got)
+		require.ErrorIs(t, err, wal.ErrFailed)
+		require.ErrorIs(t, err, errEIO)
+	})
+
+	_, err := wal.Open("wal", wal.WithVFS(fs.NewMem()), wal.WithSyncErrorPolicy(wal.SyncErrorPanic+1))
+	require.Error(t, err)
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	in := NewInjector()
+	w, err := wal.Open("wal", wal.WithVFS(NewVFS(fs.NewMem(), in)))
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeEntries(1, 10)))
+
+	// An append stuck in fsync holds up Close but not CloseWithTimeout.
+	syncs := in.Calls(OpSync)
+	in.At(OpSync, syncs+1, Fault{Latency: 500 * time.Millisecond})
+	stored := make(chan error, 1)
+	go func() {
+		stored <- w.StoreLogs(makeEntries(11, 10))
+	}()
+	require.Eventually(t, func() bool {
+		return in.Calls(OpSync) > syncs
+	}, time.Second, time.Millisecond)
+
+	err = w.CloseWithTimeout(20 * time.Millisecond)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, w.StoreLogs(makeEntries(21, 1)), wal.ErrClosed)
+	_, err = w.LastIndex()
+	require.ErrorIs(t, err, wal.ErrClosed)
+
+	// The files were released from under the stuck append so it fails once
+	// it returns, and the WAL can't be reopened.
+	require.ErrorIs(t, <-stored, wal.ErrFailed)
+	require.ErrorIs(t, w.Reopen(), wal.ErrFailed)
+}
+
+func TestBackpressure(t *testing.T) {
+	for _, reject := range []bool{true, false} {
+		t.Run(fmt.Sprintf("reject=%v", reject), func(t *testing.T) {
+			in := NewInjector()
+			mode := wal.WithMaxPendingBytes(100)
+			if reject {
+				mode = wal.WithBackpressureReject()
+			}
+			w, err := wal.Open("wal", wal.WithVFS(NewVFS(fs.NewMem(), in)), wal.WithMaxPendingBytes(100), mode)
+			require.NoError(t, err)
+			defer w.Close()
+
+			// While one append is stuck in fsync there's no room for another.
+			syncs := in.Calls(OpSync)
+			in.At(OpSync, syncs+1, Fault{Latency: 200 * time.Millisecond})
+			stored := make(chan error, 1)
+			go func() {
+				stored <- w.StoreLogs(makeEntries(1, 10))
+			}()
+			require.Eventually(t, func() bool {
+				return in.Calls(OpSync) > syncs
+			}, time.Second, time.Millisecond)
+
+			err = w.StoreLogs(makeEntries(11, 10))
+			if reject {
+				require.ErrorIs(t, err, wal.ErrBackpressure)
+				require.True(t, wal.IsRetryable(err))
+			} else {
+				require.NoError(t, err)
+			}
+			require.NoError(t, <-stored)
+		})
+	}
+}
+
+func TestPipelinedAppends(t *testing.T) {
+	in := NewInjector()
+	w, err := wal.Open("wal", wal.WithVFS(NewVFS(fs.NewMem(), in)), wal.WithPipelinedAppends(4))
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.StoreLogs(makeEntries(1, 10)))
+
+	// The next append is written while the last one's sync is in flight but
+	// neither is visible until it's synced.
+	syncs := in.Calls(OpSync)
+	in.At(OpSync, syncs+1, Fault{Latency: 300 * time.Millisecond})
+	first := make(chan error, 1)
+	go func() {
+		first <- w.StoreLogs(makeEntries(11, 10))
+	}()
+	require.Eventually(t, func() bool {
+		return in.Calls(OpSync) > syncs
+	}, time.Second, time.Millisecond)
+
+	writes := in.Calls(OpWriteAt)
+	second := make(chan error, 1)
+	go func() {
+		second <- w.StoreLogs(makeEntries(21, 10))
+	}()
+	require.Eventually(t, func() bool {
+		return in.Calls(OpWriteAt) > writes
+	}, 200*time.Millisecond, time.Millisecond)
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), last)
+
+	require.NoError(t, <-first)
+	require.NoError(t, <-second)
+	last, err = w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), last)
+	var le types.LogEntry
+	require.NoError(t, w.GetLog(25, &le))
+	require.Equal(t, "entry 25", string(le.Data))
+
+	// A failed sync fails every append waiting on it.
+	errFail := errors.New("fail")
+	syncs = in.Calls(OpSync)
+	in.At(OpSync, syncs+1, Fault{Err: errFail, Latency: 100 * time.Millisecond})
+	go func() {
+		first <- w.StoreLogs(makeEntries(31, 10))
+	}()
+	require.Eventually(t, func() bool {
+		return in.Calls(OpSync) > syncs
+	}, time.Second, time.Millisecond)
+	go func() {
+		second <- w.StoreLogs(makeEntries(41, 10))
+	}()
+	require.ErrorIs(t, <-first, wal.ErrFailed)
+	require.ErrorIs(t, <-second, wal.ErrFailed)
+
+	require.NoError(t, w.ClearError())
+	require.NoError(t, w.StoreLogs(makeEntries(31, 10)))
+	last, err = w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(40), last)
+}
+
+func TestTruncateFrontDoesNotBlockAppends(t *testing.T) {
+	in := NewInjector()
+	mem := fs.NewMem()
+	ms := NewMetaStore(metadb.NewFlatMetaDB(mem), in)
+	w, err := wal.Open("wal", wal.WithVFS(mem), wal.WithMetaStore(ms), wal.WithSegmentSize(1024))
+	require.NoError(t, err)
+	defer w.Close()
+	for i := uint64(0); i < 10; i++ {
+		require.NoError(t, w.StoreLogs(makeEntries(i*10+1, 10)))
+	}
+	// Reopen so that no rotation the appends started is still in progress.
+	require.NoError(t, w.Reopen())
+
+	// While a truncation is stuck committing the metadata, appends carry on.
+	commits := in.Calls(OpCommitState)
+	in.At(OpCommitState, commits+1, Fault{Latency: 300 * time.Millisecond})
+	truncated := make(chan error, 1)
+	go func() {
+		truncated <- w.TruncateFront(50)
+	}()
+	require.Eventually(t, func() bool {
+		return in.Calls(OpCommitState) > commits
+	}, time.Second, time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, w.StoreLogs(makeEntries(101, 1)))
+	require.Less(t, time.Since(start), 200*time.Millisecond)
+	require.NoError(t, <-truncated)
+
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), first)
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(101), last)
+}
+
+func TestInjector(t *testing.T) {
+	in := NewInjector()
+	var seen []Op
+	in.OnCall(func(op Op, n int) {
+		seen = append(seen, op)
+	})
+	errFail := errors.New("fail")
+	in.At(OpCommitState, 2, Fault{Err: errFail})
+	in.From(OpSetStable, 2, Fault{Err: errFail, Latency: time.Millisecond})
+
+	ms := NewMetaStore(metadb.NewFlatMetaDB(fs.NewMem()), in)
+	_, err := ms.Load("meta")
+	require.NoError(t, err)
+	require.NoError(t, ms.CommitState(types.PersistentState{}))
+	require.ErrorIs(t, ms.CommitState(types.PersistentState{}), errFail)
+	require.NoError(t, ms.CommitState(types.PersistentState{}))
+
+	require.NoError(t, ms.SetStable([]byte("k"), []byte("v")))
+	start := time.Now()
+	require.ErrorIs(t, ms.SetStable([]byte("k"), []byte("v")), errFail)
+	require.ErrorIs(t, ms.SetStable([]byte("k"), []byte("v")), errFail)
+	require.GreaterOrEqual(t, time.Since(start), 2*time.Millisecond)
+	require.Equal(t, 3, in.Calls(OpSetStable))
+
+	in.Reset()
+	require.NoError(t, ms.SetStable([]byte("k"), []byte("v")))
+	require.Equal(t, []Op{OpLoad, OpCommitState, OpCommitState, OpCommitState,
+		OpSetStable, OpSetStable, OpSetStable, OpSetStable}, seen)
+	require.NoError(t, ms.Close())
+
+	mem := fs.NewMem()
+	sf := NewSegmentFiler(segment.NewFiler("wal", mem), in)
+	in.At(OpSegmentCreate, 1, Fault{Err: errFail})
+	_, err = wal.Open("wal", wal.WithVFS(mem), wal.WithSegmentFiler(sf))
+	require.ErrorIs(t, err, errFail)
+}